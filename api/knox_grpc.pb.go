@@ -0,0 +1,329 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: knox.proto
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// KnoxClient is the client API for Knox service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type KnoxClient interface {
+	// Reports whether a resource is cached and how far along its download is.
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*ResourceStatus, error)
+	// Caches a resource if it isn't cached already, waiting for the download to
+	// finish.
+	Create(ctx context.Context, in *CreateRequest, opts ...grpc.CallOption) (*ResourceStatus, error)
+	// Streams a resource, caching it first if necessary. The first response
+	// carries its headers and the rest carry its body.
+	Open(ctx context.Context, in *OpenRequest, opts ...grpc.CallOption) (Knox_OpenClient, error)
+	// Lists cached resources, most recently downloaded first.
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error)
+	// Removes a cached resource. Fails with FAILED_PRECONDITION while it is
+	// being downloaded or refreshed.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+}
+
+type knoxClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKnoxClient(cc grpc.ClientConnInterface) KnoxClient {
+	return &knoxClient{cc}
+}
+
+func (c *knoxClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*ResourceStatus, error) {
+	out := new(ResourceStatus)
+	err := c.cc.Invoke(ctx, "/knox.v1.Knox/GetStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *knoxClient) Create(ctx context.Context, in *CreateRequest, opts ...grpc.CallOption) (*ResourceStatus, error) {
+	out := new(ResourceStatus)
+	err := c.cc.Invoke(ctx, "/knox.v1.Knox/Create", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *knoxClient) Open(ctx context.Context, in *OpenRequest, opts ...grpc.CallOption) (Knox_OpenClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Knox_ServiceDesc.Streams[0], "/knox.v1.Knox/Open", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &knoxOpenClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Knox_OpenClient interface {
+	Recv() (*OpenResponse, error)
+	grpc.ClientStream
+}
+
+type knoxOpenClient struct {
+	grpc.ClientStream
+}
+
+func (x *knoxOpenClient) Recv() (*OpenResponse, error) {
+	m := new(OpenResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *knoxClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, "/knox.v1.Knox/List", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *knoxClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error) {
+	out := new(Stats)
+	err := c.cc.Invoke(ctx, "/knox.v1.Knox/GetStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *knoxClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/knox.v1.Knox/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// KnoxServer is the server API for Knox service.
+// All implementations must embed UnimplementedKnoxServer
+// for forward compatibility
+type KnoxServer interface {
+	// Reports whether a resource is cached and how far along its download is.
+	GetStatus(context.Context, *GetStatusRequest) (*ResourceStatus, error)
+	// Caches a resource if it isn't cached already, waiting for the download to
+	// finish.
+	Create(context.Context, *CreateRequest) (*ResourceStatus, error)
+	// Streams a resource, caching it first if necessary. The first response
+	// carries its headers and the rest carry its body.
+	Open(*OpenRequest, Knox_OpenServer) error
+	// Lists cached resources, most recently downloaded first.
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	GetStats(context.Context, *GetStatsRequest) (*Stats, error)
+	// Removes a cached resource. Fails with FAILED_PRECONDITION while it is
+	// being downloaded or refreshed.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	mustEmbedUnimplementedKnoxServer()
+}
+
+// UnimplementedKnoxServer must be embedded to have forward compatible implementations.
+type UnimplementedKnoxServer struct {
+}
+
+func (UnimplementedKnoxServer) GetStatus(context.Context, *GetStatusRequest) (*ResourceStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedKnoxServer) Create(context.Context, *CreateRequest) (*ResourceStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Create not implemented")
+}
+func (UnimplementedKnoxServer) Open(*OpenRequest, Knox_OpenServer) error {
+	return status.Errorf(codes.Unimplemented, "method Open not implemented")
+}
+func (UnimplementedKnoxServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedKnoxServer) GetStats(context.Context, *GetStatsRequest) (*Stats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedKnoxServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedKnoxServer) mustEmbedUnimplementedKnoxServer() {}
+
+// UnsafeKnoxServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KnoxServer will
+// result in compilation errors.
+type UnsafeKnoxServer interface {
+	mustEmbedUnimplementedKnoxServer()
+}
+
+func RegisterKnoxServer(s grpc.ServiceRegistrar, srv KnoxServer) {
+	s.RegisterService(&Knox_ServiceDesc, srv)
+}
+
+func _Knox_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KnoxServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/knox.v1.Knox/GetStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KnoxServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Knox_Create_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KnoxServer).Create(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/knox.v1.Knox/Create",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KnoxServer).Create(ctx, req.(*CreateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Knox_Open_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(OpenRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KnoxServer).Open(m, &knoxOpenServer{stream})
+}
+
+type Knox_OpenServer interface {
+	Send(*OpenResponse) error
+	grpc.ServerStream
+}
+
+type knoxOpenServer struct {
+	grpc.ServerStream
+}
+
+func (x *knoxOpenServer) Send(m *OpenResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Knox_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KnoxServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/knox.v1.Knox/List",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KnoxServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Knox_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KnoxServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/knox.v1.Knox/GetStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KnoxServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Knox_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KnoxServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/knox.v1.Knox/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KnoxServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Knox_ServiceDesc is the grpc.ServiceDesc for Knox service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Knox_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "knox.v1.Knox",
+	HandlerType: (*KnoxServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetStatus",
+			Handler:    _Knox_GetStatus_Handler,
+		},
+		{
+			MethodName: "Create",
+			Handler:    _Knox_Create_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _Knox_List_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _Knox_GetStats_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Knox_Delete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Open",
+			Handler:       _Knox_Open_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "knox.proto",
+}
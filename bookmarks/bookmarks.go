@@ -0,0 +1,102 @@
+package bookmarks
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+type Bookmark struct {
+	Url   string
+	Title string
+
+	// The folders the bookmark is in, outermost first, followed by any tags
+	// the browser exported with it.
+	Tags []string
+}
+
+// Parses a bookmarks file in the Netscape format that browsers export. Folders
+// are <H3> headings, each followed by a <DL> list holding its contents, and
+// bookmarks are <A> elements. The format is too loose for an HTML parser to
+// reliably nest lists under their headings, so it is read token by token.
+func Parse(in io.Reader) ([]Bookmark, error) {
+	var bookmarks []Bookmark
+	var folders []string
+	// The heading read most recently, which names the next list.
+	heading := ""
+	var current *Bookmark
+	var text *strings.Builder
+	tokenizer := html.NewTokenizer(in)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return nil, err
+			}
+			return bookmarks, nil
+		case html.StartTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.H3:
+				heading = ""
+				text = &strings.Builder{}
+			case atom.Dl:
+				folders = append(folders, heading)
+				heading = ""
+			case atom.A:
+				current = &Bookmark{}
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "href":
+						current.Url = strings.TrimSpace(attr.Val)
+					case "tags":
+						for _, tag := range strings.Split(attr.Val, ",") {
+							if tag = strings.TrimSpace(tag); tag != "" {
+								current.Tags = append(current.Tags, tag)
+							}
+						}
+					}
+				}
+				text = &strings.Builder{}
+			}
+		case html.TextToken:
+			if text != nil {
+				text.Write(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.H3:
+				if text != nil {
+					heading = strings.TrimSpace(text.String())
+				}
+				text = nil
+			case atom.Dl:
+				if len(folders) != 0 {
+					folders = folders[:len(folders)-1]
+				}
+			case atom.A:
+				if current == nil {
+					continue
+				}
+				if text != nil {
+					current.Title = strings.TrimSpace(text.String())
+				}
+				var tags []string
+				for _, folder := range folders {
+					if folder != "" {
+						tags = append(tags, folder)
+					}
+				}
+				current.Tags = append(tags, current.Tags...)
+				if current.Url != "" {
+					bookmarks = append(bookmarks, *current)
+				}
+				current = nil
+				text = nil
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package bookmarks
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// As exported by Firefox, which also exports tags. Chrome's exports are the
+// same without them.
+const exported = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks Menu</H1>
+
+<DL><p>
+    <DT><A HREF="https://example.com/top" ADD_DATE="1600000000">Top</A>
+    <DT><H3 ADD_DATE="1600000000">Recipes</H3>
+    <DL><p>
+        <DT><A HREF="https://example.com/cake" TAGS="dessert, baking">Cake &amp; Icing</A>
+        <DT><H3>Soups</H3>
+        <DL><p>
+            <DT><A HREF="https://example.com/soup">Soup</A>
+        </DL><p>
+        <DT><A HREF="https://example.com/bread">Bread</A>
+    </DL><p>
+    <DT><H3>Empty</H3>
+    <DL><p>
+    </DL><p>
+    <DT><A HREF="place:sort=8&maxResults=10">Recent</A>
+</DL>
+`
+
+func TestParse(t *testing.T) {
+	bookmarks, err := Parse(strings.NewReader(exported))
+	if err != nil {
+		t.Fatalf("Failed to parse bookmarks: %v", err)
+	}
+	expected := []Bookmark{
+		{"https://example.com/top", "Top", nil},
+		{"https://example.com/cake", "Cake & Icing", []string{"Recipes", "dessert", "baking"}},
+		{"https://example.com/soup", "Soup", []string{"Recipes", "Soups"}},
+		{"https://example.com/bread", "Bread", []string{"Recipes"}},
+		{"place:sort=8&maxResults=10", "Recent", nil},
+	}
+	if !reflect.DeepEqual(bookmarks, expected) {
+		t.Errorf("Wrong bookmarks.\n got = %v\nwant = %v", bookmarks, expected)
+	}
+}
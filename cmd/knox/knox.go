@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gnossen/knoxcache/server"
+	"google.golang.org/grpc"
+)
+
+var config = server.DefaultConfig()
+
+const defaultListenAddress = "0.0.0.0:8080"
+
+var listenAddresses stringListFlag
+var publicListenAddresses stringListFlag
+var readTimeout = flag.Duration("read-timeout", 1*time.Minute, "How long a client may take to send a request, including its body. Zero means forever.")
+var writeTimeout = flag.Duration("write-timeout", 1*time.Minute, "How long a write of a response may be stalled by a client that isn't reading it. Long downloads are unaffected as long as the client keeps up. Zero means forever.")
+var idleTimeout = flag.Duration("idle-timeout", 2*time.Minute, "How long an idle keep-alive connection from a client is kept open. Zero means forever.")
+var maxHeaderBytes = flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "The maximum size of a request's headers.")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long requests in flight at SIGINT or SIGTERM get to finish before knox exits anyway.")
+var configFile = flag.String("config-file", "", "A file of flags, one per line and written like on the command line but without the leading dashes, e.g. deny-host=example.com. Lines starting with # are ignored. Flags on the command line take precedence. The file is read again on SIGHUP, when changes to the allowed and denied hosts and content types, header rules, Set-Cookie policy, bandwidth caps, and TTLs take effect without a restart.")
+var grpcListenAddress = flag.String("grpc-listen-address", "", "The address on which to serve the gRPC API, either host:port or unix:///path/to/socket. Disabled if empty.")
+
+func init() {
+	flag.Var(&listenAddresses, "listen-address", "An address at which the service will listen, either host:port or unix:///path/to/socket. May be specified multiple times. Defaults to "+defaultListenAddress+" unless a --public-listen-address is given.")
+	flag.Var(&publicListenAddresses, "public-listen-address", "Like --listen-address, but without the admin pages, the APIs, or metrics. May be specified multiple times.")
+	flag.StringVar(&config.AdvertiseAddress, "advertise-address", config.AdvertiseAddress, "The address at which the service will be accessible.")
+	flag.StringVar(&config.DatastoreRoot, "file-store-root", config.DatastoreRoot, "The directory in which to place cached files.")
+	flag.StringVar(&config.DbFile, "db-file", config.DbFile, "The path to the sqlite db file.")
+	flag.StringVar(&config.Sqlite.JournalMode, "sqlite-journal-mode", config.Sqlite.JournalMode, "The sqlite journal mode. WAL only works if every knox process sharing the db runs on the same host.")
+	flag.DurationVar(&config.Sqlite.BusyTimeout, "sqlite-busy-timeout", config.Sqlite.BusyTimeout, "How long to wait on a locked sqlite db before failing.")
+	flag.IntVar(&config.Sqlite.MaxOpenConns, "db-max-open-conns", config.Sqlite.MaxOpenConns, "The maximum number of open db connections. Zero means unlimited.")
+	flag.IntVar(&config.Sqlite.MaxIdleConns, "db-max-idle-conns", config.Sqlite.MaxIdleConns, "The maximum number of idle db connections.")
+	flag.DurationVar(&config.Sqlite.ConnMaxLifetime, "db-conn-max-lifetime", config.Sqlite.ConnMaxLifetime, "The maximum time a db connection may be reused. Zero means forever.")
+	flag.StringVar(&config.RewriteRulesFile, "rewrite-rules-file", config.RewriteRulesFile, "A file of URL rewrite rules applied before fetching, one per line as a regex and its replacement, e.g. '^http://(.*) https://$1'. Lines starting with # are ignored.")
+	flag.StringVar(&config.HeaderRulesFile, "header-rules-file", config.HeaderRulesFile, "A file of rules for the response headers that are stored and served, one per line as '<store|serve> <host> <header> <drop|keep|set> [value]', e.g. 'serve *.example.com X-Frame-Options drop'. For each header, the first matching rule wins. Lines starting with # are ignored.")
+	flag.StringVar(&config.SetCookiePolicy, "set-cookie-policy", config.SetCookiePolicy, "What to do with the Set-Cookie headers of cached responses when serving them, which would otherwise hand every client the cookies knox was given. One of pass, strip-auth (drop HttpOnly cookies and ones named like sessions and tokens), or strip. Header rules like \"serve example.com Set-Cookie strip-auth\" set it for particular hosts.")
+	flag.BoolVar(&config.StripSetCookie, "strip-set-cookie", config.StripSetCookie, "Same as --set-cookie-policy strip.")
+	flag.StringVar(&config.RobotsPolicy, "robots-policy", config.RobotsPolicy, "What to do with resources that the origin's robots.txt disallows for knox, or whose X-Robots-Tag header or robots meta tag says noarchive or none. One of ignore, flag (cache them anyway, tagged robots:disallowed or robots:noarchive), or refuse (record a refusal instead of caching them).")
+	flag.StringVar(&config.CspMode, "csp-mode", config.CspMode, "What to do with the Content-Security-Policy headers and meta tags of cached pages, which can keep rewritten pages from rendering. One of adapt (allow knox's rewritten subresources and injected script), keep, or drop.")
+	flag.BoolVar(&config.KeepDefaultLinkSchemes, "keep-default-link-schemes", config.KeepDefaultLinkSchemes, "Whether cached pages keep mailto:, tel:, sms:, javascript:, data:, and blob: links as they are rather than pointing them at the cache.")
+	flag.Var((*stringListFlag)(&config.KeepLinkSchemes), "keep-link-scheme", "A scheme (e.g. ftp) of links that cached pages keep as they are rather than pointing them at the cache. May be specified multiple times.")
+	flag.Var((*stringListFlag)(&config.RewriteScriptUrlHosts), "rewrite-script-urls", "A host (example.com), wildcard (*.example.com), or CIDR whose cached scripts have the absolute http(s) URLs in their string literals pointed at the cache. This is best effort, and URLs put together from several parts still go to the origin. May be specified multiple times.")
+	flag.BoolVar(&config.StripDefaultTrackingParams, "strip-default-tracking-params", config.StripDefaultTrackingParams, "Whether to strip common tracking query parameters (utm_*, fbclid, gclid) from URLs.")
+	flag.Var((*stringListFlag)(&config.StripQueryParams), "strip-query-param", "A regex matching names of query parameters to strip from URLs. May be specified multiple times.")
+	flag.IntVar(&config.CompressionLevel, "compression-level", config.CompressionLevel, "The gzip level cached bodies are stored with, from 1 (fastest) to 9 (smallest). -1 is the default level, 0 stores bodies uncompressed, and -2 only does Huffman coding.")
+	flag.BoolVar(&config.CompressResponses, "compress-responses", config.CompressResponses, "Whether to compress responses with brotli or gzip for clients that accept them. Bodies of types that are compressed already, like images, are sent as they are.")
+	flag.BoolVar(&config.SkipCompressionDefaultTypes, "skip-compression-default-types", config.SkipCompressionDefaultTypes, "Whether to store common compressed formats, like JPEG, PNG, video, audio, zip, and WOFF2, without compressing them again.")
+	flag.Var((*stringListFlag)(&config.SkipCompressionTypes), "skip-compression-type", "A MIME type (image/jpeg), wildcard (video/*), or file extension (.zip) whose bodies are stored without compression since they are compressed already. May be specified multiple times.")
+	flag.Var((*stringListFlag)(&config.AllowHosts), "allow-host", "A host (example.com), wildcard (*.example.com), or CIDR that may be fetched. If specified, all other hosts are refused. May be specified multiple times.")
+	flag.Var((*stringListFlag)(&config.DenyHosts), "deny-host", "A host (example.com), wildcard (*.example.com), or CIDR that may not be fetched. May be specified multiple times.")
+	flag.Var((*stringListFlag)(&config.AllowContentTypes), "allow-content-type", "A MIME type (text/html), wildcard (image/*), or file extension (.pdf) that may be cached. If specified, all other responses are refused. May be specified multiple times.")
+	flag.Var((*stringListFlag)(&config.DenyContentTypes), "deny-content-type", "A MIME type (text/html), wildcard (video/*), or file extension (.mp4) that may not be cached. May be specified multiple times.")
+	flag.BoolVar(&config.AllowPrivateAddresses, "allow-private-addresses", config.AllowPrivateAddresses, "Whether to fetch from loopback, private, and link-local addresses.")
+	flag.Var((*stringListFlag)(&config.AdminAllowNetworks), "admin-allow-network", "A CIDR (e.g. 10.8.0.0/16) or IP address of clients allowed to reach the admin pages under /admin/ and the API under /api/. If specified, all other clients are refused them, while cached pages are still served to everyone. Clients connected over a unix socket are always allowed. The gRPC API isn't covered, so serve it on a private address. May be specified multiple times.")
+	flag.IntVar(&config.MaxResumeAttempts, "max-resume-attempts", config.MaxResumeAttempts, "How many times to resume an interrupted download before giving up.")
+	flag.IntVar(&config.MaxConcurrentDownloads, "max-concurrent-downloads", config.MaxConcurrentDownloads, "How many downloads from origins may run at once. Others wait in a queue, where requests for individual pages go ahead of bulk downloads like warming and imports. Zero means unlimited.")
+	flag.Int64Var(&config.UpstreamBandwidth, "upstream-bandwidth", config.UpstreamBandwidth, "The maximum rate, in bytes per second, at which knox downloads from origins in total. Zero means unlimited.")
+	flag.Int64Var(&config.UpstreamBandwidthPerHost, "upstream-bandwidth-per-host", config.UpstreamBandwidthPerHost, "The maximum rate, in bytes per second, at which knox downloads from each origin host. Zero means unlimited.")
+	flag.Int64Var(&config.DownstreamBandwidth, "downstream-bandwidth", config.DownstreamBandwidth, "The maximum rate, in bytes per second, at which knox sends responses to clients in total. Zero means unlimited.")
+	flag.Int64Var(&config.DownstreamBandwidthPerClient, "downstream-bandwidth-per-client", config.DownstreamBandwidthPerClient, "The maximum rate, in bytes per second, at which knox sends responses to each client address. Zero means unlimited.")
+	flag.BoolVar(&config.ForwardDefaultHeaders, "forward-default-headers", config.ForwardDefaultHeaders, "Whether to pass the Accept, Accept-Language, Sec-CH-UA, Sec-CH-UA-Mobile, and Sec-CH-UA-Platform headers of clients on to origins when fetching on their behalf, so that cached pages are the ones they would have been sent. The headers a resource was fetched with are shown on its headers page.")
+	flag.Var((*stringListFlag)(&config.ForwardHeaders), "forward-header", "The name of another request header to pass on from clients to origins when fetching on their behalf. May be specified multiple times.")
+	flag.Var((*stringListFlag)(&config.UpstreamHeaders), "upstream-header", "A request header to send to origins, written 'Name: value', e.g. 'Accept-Language: de-DE'. A forwarded header of the same name from the client being fetched for takes precedence. May be specified multiple times.")
+	flag.BoolVar(&config.UpstreamHttp2, "upstream-http2", config.UpstreamHttp2, "Whether to negotiate HTTP/2 with origins that support it.")
+	flag.StringVar(&config.UpstreamTlsMinVersion, "upstream-tls-min-version", config.UpstreamTlsMinVersion, "The minimum TLS version to accept from origins. One of 1.0, 1.1, 1.2, or 1.3.")
+	flag.StringVar(&config.UpstreamCaFile, "upstream-ca-file", config.UpstreamCaFile, "A PEM file of additional certificate authorities to trust when fetching from origins.")
+	flag.IntVar(&config.UpstreamMaxIdleConns, "upstream-max-idle-conns", config.UpstreamMaxIdleConns, "The maximum number of idle connections to origins kept open for reuse. Zero means unlimited.")
+	flag.IntVar(&config.UpstreamMaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", config.UpstreamMaxIdleConnsPerHost, "The maximum number of idle connections to each origin kept open for reuse. Connections beyond this are closed once their fetch finishes, so crawls of a single site should raise it.")
+	flag.IntVar(&config.UpstreamMaxConnsPerHost, "upstream-max-conns-per-host", config.UpstreamMaxConnsPerHost, "The maximum number of connections to each origin, idle or not. Fetches beyond this wait for a connection. Zero means unlimited.")
+	flag.DurationVar(&config.UpstreamIdleConnTimeout, "upstream-idle-conn-timeout", config.UpstreamIdleConnTimeout, "How long an idle connection to an origin is kept open. Zero means until the origin closes it.")
+	flag.DurationVar(&config.UpstreamKeepAlive, "upstream-keep-alive", config.UpstreamKeepAlive, "The interval between TCP keep-alive probes on connections to origins. Negative disables them.")
+	flag.DurationVar(&config.UpstreamResponseHeaderTimeout, "upstream-response-header-timeout", config.UpstreamResponseHeaderTimeout, "How long to wait for an origin to start responding before recording the fetch as failed. Zero means no limit.")
+	flag.DurationVar(&config.UpstreamReadTimeout, "upstream-read-timeout", config.UpstreamReadTimeout, "How long an origin may go without sending more of a body before the fetch is recorded as failed. Zero means no limit.")
+	flag.IntVar(&config.UpstreamTlsSessionCacheSize, "upstream-tls-session-cache-size", config.UpstreamTlsSessionCacheSize, "How many origins' TLS sessions to remember so that reconnecting to them skips the full handshake. Zero disables session resumption.")
+	flag.StringVar(&config.DnsServer, "dns-server", config.DnsServer, "The DNS server (host:port) to resolve origins with instead of the system's resolvers. With --dns-over-https, only used to resolve the endpoint's host.")
+	flag.StringVar(&config.DnsOverHttps, "dns-over-https", config.DnsOverHttps, "The URL of a DNS over HTTPS endpoint to resolve origins with instead of the system's resolvers. Its host must be an IP address unless --dns-server is given.")
+	flag.DurationVar(&config.DnsCacheTtl, "dns-cache-ttl", config.DnsCacheTtl, "How long to remember the addresses of origins. Zero disables caching.")
+	flag.DurationVar(&config.ResourceTtl, "resource-ttl", config.ResourceTtl, "How long a cached resource is served before it is fetched again. Zero means forever.")
+	flag.BoolVar(&config.HonorOriginCacheControl, "honor-origin-cache-control", config.HonorOriginCacheControl, "Whether the Cache-Control (s-maxage, max-age, no-cache, immutable) and Expires headers that origins send decide how long resources are served before they are fetched again, in place of --resource-ttl. Resources sent without them still use --resource-ttl, and immutable ones are never fetched again unless --origin-ttl-max is set.")
+	flag.DurationVar(&config.OriginTtlMin, "origin-ttl-min", config.OriginTtlMin, "With --honor-origin-cache-control, the shortest time a resource is served before it is fetched again, however soon its origin says it goes stale.")
+	flag.DurationVar(&config.OriginTtlMax, "origin-ttl-max", config.OriginTtlMax, "With --honor-origin-cache-control, the longest time a resource is served before it is fetched again, however long its origin says it stays fresh. Zero means no limit.")
+	flag.Int64Var(&config.MemoryCacheBytes, "memory-cache-size", config.MemoryCacheBytes, "How many bytes of decompressed bodies of recently served resources to keep in memory, so that popular ones are served without reading the disk. Zero disables the memory cache.")
+	flag.Int64Var(&config.MemoryCacheEntryBytes, "memory-cache-max-entry-size", config.MemoryCacheEntryBytes, "The largest decompressed body in bytes kept in the memory cache.")
+	flag.Int64Var(&config.MinFreeDiskBytes, "min-free-disk", config.MinFreeDiskBytes, "How many bytes to keep free on the datastore's disk. Downloads that would leave less free, going by the Content-Length of their responses, are refused instead of failing once the disk fills up.")
+	flag.Int64Var(&config.DiskBudgetBytes, "disk-budget", config.DiskBudgetBytes, "The most bytes the datastore may use on disk. Downloads that would take it over are refused. Zero means no budget.")
+	flag.StringVar(&config.Durability, "durability", config.Durability, "How sure knox makes that a body is on disk before marking its resource cached: none leaves it to the operating system, so a power loss can leave a cached resource with a truncated body; fsync fsyncs each body first; atomic also writes each body under a temporary name and renames it into place once complete.")
+	flag.DurationVar(&config.AccessFlushInterval, "access-flush-interval", config.AccessFlushInterval, "How often hit and access counts are written to the db. Counts from the last interval are lost if knox is killed.")
+	flag.DurationVar(&config.FailureTtl, "failure-ttl", config.FailureTtl, "How long to wait before retrying a resource whose origin could not be reached.")
+	flag.DurationVar(&config.MaxFailureTtl, "max-failure-ttl", config.MaxFailureTtl, "Each failure in a row to fetch a resource doubles --failure-ttl for it, up to this.")
+	flag.IntVar(&config.FailureRetries, "failure-retries", config.FailureRetries, "How many times in a row a resource that failed to be fetched is fetched again in the background once its --failure-ttl passes. Zero leaves it to be fetched when next requested. Refused responses aren't retried.")
+	flag.DurationVar(&config.FailureRetryInterval, "failure-retry-interval", config.FailureRetryInterval, "How often failed resources due to be retried under --failure-retries are looked for.")
+	flag.IntVar(&config.CircuitBreakerFailures, "circuit-breaker-failures", config.CircuitBreakerFailures, "How many consecutive connection failures, timeouts, or server errors from an origin open its circuit breaker, failing fetches from it without contacting it. Zero disables circuit breaking.")
+	flag.DurationVar(&config.CircuitBreakerCooldown, "circuit-breaker-cooldown", config.CircuitBreakerCooldown, "How long an origin's circuit breaker stays open before a single trial fetch is let through to decide whether to close it.")
+	flag.StringVar(&config.ReplicateTo, "replicate-to", config.ReplicateTo, "A directory, or the http(s) URL of another knox instance started with --accept-replicas, to copy completed resources to so that losing this datastore doesn't lose the archive. Deletions aren't copied. Disabled if empty.")
+	flag.DurationVar(&config.ReplicationInterval, "replication-interval", config.ReplicationInterval, "How often resources completed since the last pass are copied to --replicate-to.")
+	flag.BoolVar(&config.ReadOnly, "read-only", config.ReadOnly, "Whether to only serve what is cached already, e.g. to expose a finished archive publicly. Resources that aren't cached are answered with 404s instead of being fetched, expired ones are served without being refreshed, and creating, capturing, refreshing, deleting, importing, warming, and accepting replicas are refused.")
+	flag.BoolVar(&config.AcceptReplicas, "accept-replicas", config.AcceptReplicas, "Whether other knox instances may copy resources into this one through /api/v1/replicas, replacing any copies it has.")
+	flag.StringVar(&config.ColdTierRoot, "cold-tier-root", config.ColdTierRoot, "A directory, e.g. on cheaper storage or a mounted bucket, that the bodies of resources not accessed for --cold-tier-after are moved to, recompressed with zstd. They are moved back on their next access. Disabled if empty.")
+	flag.Var((*stringListFlag)(&config.VirtualHosts), "virtual-host", "A host name and the datastore root of a separate cache served to requests for it, written host=/path. Requests for any other host are served from --file-store-root. Replication, the cold tier, the gRPC API and the datastore metrics only cover the default cache. May be specified multiple times.")
+	flag.DurationVar(&config.ColdTierAfter, "cold-tier-after", config.ColdTierAfter, "How long a resource goes without being accessed before its body is moved to --cold-tier-root.")
+	flag.Var((*stringListFlag)(&config.RetentionRules), "retention", "How long resources of some hosts are kept after they were captured, written host=age or host=forever, e.g. news.example.com=30d or docs.example.com=forever. host is written like an --allow-host rule, or is * for every host. age is a number of days, e.g. 30d, or a duration, e.g. 12h. The first rule matching a resource's host decides, and resources no rule matches are kept forever. /admin/retention shows what each rule would delete. May be specified multiple times.")
+	flag.DurationVar(&config.RetentionInterval, "retention-interval", config.RetentionInterval, "How often resources past their --retention age are looked for and deleted.")
+	flag.StringVar(&config.EventsTo, "events-to", config.EventsTo, "Where to publish a JSON event whenever a resource is created, completes, fails, or is deleted, so that other systems can follow the cache without polling it: nats://[user:password@]host:port/subject, or the http(s) URL of a topic on a Kafka REST proxy, e.g. http://localhost:8082/topics/knox-events. Events that can't be published are dropped. Disabled if empty.")
+	flag.BoolVar(&config.HeadlessRender, "headless-render", config.HeadlessRender, "Whether to load HTML pages in headless Chrome and store the DOM they render, along with the subresources they load, instead of the HTML their origin sends.")
+	flag.StringVar(&config.HeadlessBrowserPath, "headless-browser-path", config.HeadlessBrowserPath, "The Chrome or Chromium binary to render pages and PDFs with. Looked up on the PATH if empty.")
+	flag.BoolVar(&config.HeadlessBrowserNoSandbox, "headless-browser-no-sandbox", config.HeadlessBrowserNoSandbox, "Whether to run the headless browser without its sandbox, which it needs in order to run as root.")
+	flag.DurationVar(&config.RenderLoadTimeout, "render-load-timeout", config.RenderLoadTimeout, "How long loading a page in the headless browser may take.")
+	flag.DurationVar(&config.RenderIdleTimeout, "render-idle-timeout", config.RenderIdleTimeout, "How long to wait for a rendered page's network activity to settle before storing it anyway.")
+	flag.StringVar(&config.LinkSigningKeyFile, "link-signing-key-file", config.LinkSigningKeyFile, "A file holding the secret that shareable /s/ links are signed with. Shareable links are disabled if empty.")
+	flag.StringVar(&config.OidcIssuer, "oidc-issuer", config.OidcIssuer, "The issuer URL of an OpenID Connect provider, e.g. https://accounts.google.com or https://keycloak.example.com/realms/office, that people have to sign in with to use the admin pages under /admin/. Register https://<this host>/auth/callback as the client's redirect URI. Signing in lasts 12 hours, or until knox restarts. The admin pages are open to everyone who can reach them if empty.")
+	flag.StringVar(&config.OidcClientId, "oidc-client-id", config.OidcClientId, "The client ID knox is registered with at --oidc-issuer.")
+	flag.StringVar(&config.OidcClientSecretFile, "oidc-client-secret-file", config.OidcClientSecretFile, "A file holding the client secret knox is registered with at --oidc-issuer. Empty for a public client.")
+	flag.StringVar(&config.OidcGroupsClaim, "oidc-groups-claim", config.OidcGroupsClaim, "The ID token claim listing the groups of whoever signs in.")
+	flag.Var((*stringListFlag)(&config.OidcGroupRoles), "oidc-group-role", "A group and the knox role its members get, written group=role. Viewers may look at the admin pages, and admins may also change things through them, like deleting resources or releasing legal holds. The group * matches everyone who signs in. People in no group with a role are refused. May be specified multiple times.")
+	flag.StringVar(&config.TemplateDir, "template-dir", config.TemplateDir, "A directory laid out like the built-in ui directory whose templates and static assets replace the built-in ones.")
+	flag.Var((*stringListFlag)(&config.Plugins), "plugin", "A Go plugin, built with -buildmode=plugin against the same version of knox, whose init functions register hooks with the server package. May be specified multiple times.")
+	flag.StringVar(&config.OtlpEndpoint, "otlp-endpoint", config.OtlpEndpoint, "The URL of an OpenTelemetry collector to export traces of requests and fetches to over OTLP/HTTP, e.g. http://localhost:4318. Tracing is disabled if empty.")
+}
+
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Listens on a TCP address or, given unix:///path, a unix domain socket.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix://") {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, "unix://")
+	// A socket left behind by a process that was killed would keep this one
+	// from being created.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// Extends the write deadline before each write, so that, unlike
+// http.Server's WriteTimeout, it limits how long a write may stall rather
+// than how long a whole response may take.
+type writeDeadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c writeDeadlineConn) Write(b []byte) (int, error) {
+	if err := c.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+type writeDeadlineListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l writeDeadlineListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return writeDeadlineConn{conn, l.timeout}, nil
+}
+
+func serve(address string, knox *server.Server, handler http.Handler, description string) *http.Server {
+	ln, err := listen(address)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", address, err)
+	}
+	log.Printf("Listening on %s%s", ln.Addr().String(), description)
+	if *writeTimeout > 0 {
+		ln = writeDeadlineListener{ln, *writeTimeout}
+	}
+	srv := &http.Server{
+		Handler:        handler,
+		ReadTimeout:    *readTimeout,
+		IdleTimeout:    *idleTimeout,
+		MaxHeaderBytes: *maxHeaderBytes,
+	}
+	srv.RegisterOnShutdown(knox.EndEventStreams)
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return srv
+}
+
+// Reads the flags in --config-file, then those on the command line, into
+// config, starting from the defaults.
+func loadConfigFile() error {
+	contents, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return err
+	}
+	config = server.DefaultConfig()
+	listenAddresses = nil
+	publicListenAddresses = nil
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value := line, "true"
+		if eq := strings.Index(line, "="); eq != -1 {
+			name, value = strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq+1:])
+		}
+		if err := flag.Set(strings.TrimLeft(name, "-"), value); err != nil {
+			return fmt.Errorf("%s:%d: %v", *configFile, i+1, err)
+		}
+	}
+	return flag.CommandLine.Parse(os.Args[1:])
+}
+
+func main() {
+	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfigFile(); err != nil {
+			log.Fatalf("Failed to load config file: %v", err)
+		}
+	}
+	knox, err := server.New(config)
+	if err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+	var grpcServer *grpc.Server
+	if *grpcListenAddress != "" {
+		ln, err := listen(*grpcListenAddress)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", *grpcListenAddress, err)
+		}
+		log.Printf("Serving gRPC on %s", ln.Addr().String())
+		grpcServer = knox.NewGrpcServer()
+		go func() {
+			if err := grpcServer.Serve(ln); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if len(listenAddresses) == 0 && len(publicListenAddresses) == 0 {
+		listenAddresses = append(listenAddresses, defaultListenAddress)
+	}
+	var servers []*http.Server
+	for _, address := range listenAddresses {
+		servers = append(servers, serve(address, knox, knox, ""))
+	}
+	publicHandler := server.WithoutAdmin(knox)
+	for _, address := range publicListenAddresses {
+		servers = append(servers, serve(address, knox, publicHandler, " without admin pages or APIs"))
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Printf("Shutting down on %v", sig)
+			break
+		}
+		if *configFile == "" {
+			log.Printf("Ignoring SIGHUP without --config-file")
+			continue
+		}
+		// The previous config is kept if the file can't be loaded.
+		previous := config
+		if err := loadConfigFile(); err != nil {
+			log.Printf("Failed to reload config file: %v", err)
+			config = previous
+			continue
+		}
+		if err := knox.Reload(config); err != nil {
+			log.Printf("Failed to reload config file: %v", err)
+			config = previous
+			continue
+		}
+		log.Printf("Reloaded %s", *configFile)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shut down listener: %v", err)
+		}
+	}
+	if grpcServer != nil {
+		grpcServer.Stop()
+	}
+	// Writes out the access counts from the last flush interval.
+	if err := knox.Close(); err != nil {
+		log.Fatalf("Failed to shut down: %v", err)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gnossen/knoxcache/datastore"
+	"github.com/gnossen/knoxcache/encoder"
+	"github.com/klauspost/compress/zstd"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup":   {"Copy the cache to a directory while it is in use.", runBackup},
+	"db":       {"Upgrade or downgrade the db schema, or show its version.", runDb},
+	"export":   {"Write the whole cache to a single archive.", runExport},
+	"import":   {"Unpack an archive written by export into an empty cache.", runImport},
+	"reencode": {"Store resources under the current link encoding and keep old links working.", runReencode},
+	"restore":  {"Put a backup in place as an empty cache.", runRestore},
+	"warm":     {"Have a running knox cache every URL listed in a file.", runWarm},
+}
+
+type datastoreFlags struct {
+	datastoreRoot *string
+	dbFile        *string
+	journalMode   *string
+	coldTierRoot  *string
+}
+
+func addDatastoreFlags(fs *flag.FlagSet) datastoreFlags {
+	return datastoreFlags{
+		fs.String("file-store-root", "", "The directory in which cached files are placed."),
+		fs.String("db-file", "", "The path to the sqlite db file."),
+		fs.String("sqlite-journal-mode", "", "The sqlite journal mode to set on the db. The db's current mode is kept if empty."),
+		fs.String("cold-tier-root", "", "The directory knox moves the bodies of idle resources to, if it was started with one."),
+	}
+}
+
+func (df datastoreFlags) dbFilePath() string {
+	if *df.dbFile != "" {
+		return *df.dbFile
+	}
+	return path.Join(*df.datastoreRoot, "knox.db")
+}
+
+func (df datastoreFlags) sqliteOptions() datastore.SqliteOptions {
+	opts := datastore.DefaultSqliteOptions()
+	opts.JournalMode = *df.journalMode
+	return opts
+}
+
+func (df datastoreFlags) open() (datastore.FileDatastore, error) {
+	ds, err := datastore.NewFileDatastoreWithOptions(df.dbFilePath(), *df.datastoreRoot, df.sqliteOptions())
+	if err != nil {
+		return ds, err
+	}
+	return ds.WithColdTier(*df.coldTierRoot), nil
+}
+
+// Wraps w in the compression implied by the extension of name.
+func compressedWriter(name string, w io.Writer) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.zst"):
+		return zstd.NewWriter(w)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return gzip.NewWriter(w), nil
+	case strings.HasSuffix(name, ".tar"):
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unrecognized archive extension on %s; expected .tar, .tar.gz, or .tar.zst", name)
+}
+
+func compressedReader(name string, r io.Reader) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.zst"):
+		return zstd.NewReader(r)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(name, ".tar"):
+		return r, nil
+	}
+	return nil, fmt.Errorf("unrecognized archive extension on %s; expected .tar, .tar.gz, or .tar.zst", name)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	df := addDatastoreFlags(fs)
+	out := fs.String("out", "", "The archive to write. The extension determines compression.")
+	fs.Parse(args)
+	if *out == "" {
+		return fmt.Errorf("--out is required")
+	}
+
+	ds, err := df.open()
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cw, err := compressedWriter(*out, f)
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	if err := ds.Export(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	df := addDatastoreFlags(fs)
+	in := fs.String("in", "", "The archive to read.")
+	fs.Parse(args)
+	if *in == "" {
+		return fmt.Errorf("--in is required")
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := compressedReader(*in, f)
+	if err != nil {
+		return err
+	}
+	if *df.datastoreRoot != "" {
+		if err := os.MkdirAll(*df.datastoreRoot, 0755); err != nil {
+			return err
+		}
+	}
+	return datastore.Import(tar.NewReader(r), df.dbFilePath(), *df.datastoreRoot, df.sqliteOptions())
+}
+
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	df := addDatastoreFlags(fs)
+	out := fs.String("out", "", "The directory to write the backup to. Files are hard linked where possible.")
+	fs.Parse(args)
+	if *out == "" {
+		return fmt.Errorf("--out is required")
+	}
+
+	ds, err := df.open()
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	return ds.Backup(*out)
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	df := addDatastoreFlags(fs)
+	in := fs.String("in", "", "The directory a backup was written to.")
+	fs.Parse(args)
+	if *in == "" {
+		return fmt.Errorf("--in is required")
+	}
+
+	if *df.datastoreRoot != "" {
+		if err := os.MkdirAll(*df.datastoreRoot, 0755); err != nil {
+			return err
+		}
+	}
+	return datastore.Restore(*in, df.dbFilePath(), *df.datastoreRoot, df.sqliteOptions())
+}
+
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func runReencode(args []string) error {
+	fs := flag.NewFlagSet("reencode", flag.ExitOnError)
+	df := addDatastoreFlags(fs)
+	var from stringListFlag
+	fs.Var(&from, "from", "A scheme links were issued with before. Links encoded with it are redirected to the resources they point to. May be repeated.")
+	fs.Parse(args)
+
+	// Resources are always moved to where knox looks for them, which isn't
+	// configurable.
+	scheme := encoder.NewDefaultEncoder().Encode
+	var aliasSchemes []func(string) (string, error)
+	for _, name := range from {
+		aliasScheme, err := encoder.LookupScheme(name)
+		if err != nil {
+			return err
+		}
+		aliasSchemes = append(aliasSchemes, aliasScheme)
+	}
+	ds, err := df.open()
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	stats, err := ds.Reencode(scheme, aliasSchemes...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d resources moved, %d aliases recorded\n", stats.Rekeyed, stats.Aliased)
+	if stats.Conflicts != 0 {
+		return fmt.Errorf("%d resources were left where they were because others are stored where they would go", stats.Conflicts)
+	}
+	return nil
+}
+
+func runDb(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected a subcommand: upgrade, downgrade, or version")
+	}
+	fs := flag.NewFlagSet("db "+args[0], flag.ExitOnError)
+	df := addDatastoreFlags(fs)
+	var to *int
+	switch args[0] {
+	case "upgrade", "version":
+	case "downgrade":
+		to = fs.Int("to", 0, "The schema version to go back to.")
+	default:
+		return fmt.Errorf("unknown subcommand %s; expected upgrade, downgrade, or version", args[0])
+	}
+	fs.Parse(args[1:])
+
+	ds, err := df.open()
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	switch args[0] {
+	case "upgrade":
+		err = ds.MigrateSchema(datastore.LatestSchemaVersion())
+	case "downgrade":
+		if *to == 0 {
+			return fmt.Errorf("--to is required")
+		}
+		err = ds.MigrateSchema(*to)
+	}
+	if err != nil {
+		return err
+	}
+	version, err := ds.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %d (latest %d)\n", version, datastore.LatestSchemaVersion())
+	return nil
+}
+
+type warmResult struct {
+	Url       string `json:"url"`
+	CachedUrl string `json:"cached_url"`
+	Error     string `json:"error"`
+}
+
+type warmResponse struct {
+	Results   []warmResult `json:"results"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+}
+
+func runWarm(args []string) error {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "The knox instance to cache the URLs with.")
+	concurrency := fs.Int("concurrency", 4, "How many URLs to fetch at once.")
+	rate := fs.Float64("rate", 0, "How many URLs to start fetching per second. Unlimited if zero.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: knoxctl warm [flags] <url file>\n\nThe file lists one URL per line. Use - to read from stdin.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	query := url.Values{"concurrency": []string{strconv.Itoa(*concurrency)}}
+	if *rate != 0 {
+		query.Set("rate", strconv.FormatFloat(*rate, 'f', -1, 64))
+	}
+	warmUrl := strings.TrimRight(*server, "/") + "/api/v1/warm?" + query.Encode()
+	res, err := http.Post(warmUrl, "text/plain", in)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&failure)
+		return fmt.Errorf("%s: %s", res.Status, failure.Error)
+	}
+	var response warmResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return err
+	}
+	for _, result := range response.Results {
+		if result.Error != "" {
+			fmt.Printf("failed %s: %s\n", result.Url, result.Error)
+		} else {
+			fmt.Printf("cached %s\n", result.Url)
+		}
+	}
+	fmt.Printf("%d cached, %d failed\n", response.Succeeded, response.Failed)
+	if response.Failed != 0 {
+		return fmt.Errorf("%d URLs could not be cached", response.Failed)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: knoxctl <command> [flags]\n\nCommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "knoxctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
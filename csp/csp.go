@@ -0,0 +1,162 @@
+package csp
+
+import (
+	"strings"
+)
+
+// Directives whose sources restrict where a page may load things from. Pages
+// served by knox load everything from knox itself, so host sources in these
+// no longer match anything.
+var fetchDirectives = map[string]bool{
+	"default-src":     true,
+	"script-src":      true,
+	"script-src-elem": true,
+	"script-src-attr": true,
+	"style-src":       true,
+	"style-src-elem":  true,
+	"style-src-attr":  true,
+	"img-src":         true,
+	"connect-src":     true,
+	"font-src":        true,
+	"media-src":       true,
+	"object-src":      true,
+	"frame-src":       true,
+	"child-src":       true,
+	"worker-src":      true,
+	"manifest-src":    true,
+	"prefetch-src":    true,
+	"base-uri":        true,
+	"form-action":     true,
+}
+
+// Directives that would send violation reports to the origin.
+var reportDirectives = map[string]bool{
+	"report-uri": true,
+	"report-to":  true,
+}
+
+type directive struct {
+	name    string
+	sources []string
+}
+
+func (d directive) String() string {
+	return strings.Join(append([]string{d.name}, d.sources...), " ")
+}
+
+func (d directive) has(source string) bool {
+	for _, s := range d.sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *directive) add(source string) {
+	if d.has(source) {
+		return
+	}
+	if len(d.sources) == 1 && d.sources[0] == "'none'" {
+		d.sources = nil
+	}
+	d.sources = append(d.sources, source)
+}
+
+func isKeyword(source string) bool {
+	return strings.HasPrefix(source, "'")
+}
+
+// Whether source is a scheme like "data:" rather than a host.
+func isScheme(source string) bool {
+	return strings.HasSuffix(source, ":") && !strings.Contains(source, "/")
+}
+
+// Hashes and nonces disable 'unsafe-inline'.
+func allowsAnyInlineScript(d directive) bool {
+	if !d.has("'unsafe-inline'") {
+		return false
+	}
+	for _, s := range d.sources {
+		if strings.HasPrefix(s, "'sha") || strings.HasPrefix(s, "'nonce-") {
+			return false
+		}
+	}
+	return true
+}
+
+// Adapts a Content-Security-Policy so that a page rewritten by knox still
+// renders. Host sources are replaced with 'self', since every subresource is
+// served from knox, reporting directives are removed, and scriptSource, e.g.
+// a hash of the script knox injects, is allowed to run. A value holding
+// several comma-separated policies is adapted policy by policy.
+func Adapt(value string, scriptSource string) string {
+	var policies []string
+	for _, policy := range strings.Split(value, ",") {
+		if adapted := adaptPolicy(policy, scriptSource); adapted != "" {
+			policies = append(policies, adapted)
+		}
+	}
+	return strings.Join(policies, ", ")
+}
+
+func adaptPolicy(policy string, scriptSource string) string {
+	var directives []directive
+	seen := map[string]bool{}
+	for _, raw := range strings.Split(policy, ";") {
+		fields := strings.Fields(raw)
+		if len(fields) == 0 {
+			continue
+		}
+		d := directive{strings.ToLower(fields[0]), fields[1:]}
+		// Browsers ignore all but the first occurrence of a directive.
+		if seen[d.name] || reportDirectives[d.name] {
+			continue
+		}
+		seen[d.name] = true
+		if fetchDirectives[d.name] {
+			d = adaptSources(d)
+		}
+		directives = append(directives, d)
+	}
+
+	// Inline scripts are governed by the most specific directive present.
+	for _, name := range []string{"script-src-elem", "script-src", "default-src"} {
+		if !seen[name] {
+			continue
+		}
+		for i := range directives {
+			if directives[i].name == name && !allowsAnyInlineScript(directives[i]) {
+				directives[i].add(scriptSource)
+			}
+		}
+		break
+	}
+
+	var adapted []string
+	for _, d := range directives {
+		adapted = append(adapted, d.String())
+	}
+	return strings.Join(adapted, "; ")
+}
+
+func adaptSources(d directive) directive {
+	adapted := directive{name: d.name}
+	for _, source := range d.sources {
+		lower := strings.ToLower(source)
+		switch {
+		case isKeyword(source):
+			adapted.add(source)
+		case isScheme(lower):
+			adapted.add(source)
+			// knox itself may be served over a different scheme than the
+			// origin was.
+			if lower == "http:" || lower == "https:" {
+				adapted.add("'self'")
+			}
+		default:
+			adapted.add("'self'")
+		}
+	}
+	return adapted
+}
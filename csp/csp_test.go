@@ -0,0 +1,48 @@
+package csp
+
+import (
+	"testing"
+)
+
+func TestAdapt(t *testing.T) {
+	script := "'sha256-abc='"
+	cases := []struct {
+		policy string
+		want   string
+	}{
+		{
+			"default-src 'self'",
+			"default-src 'self' 'sha256-abc='",
+		},
+		{
+			"default-src 'none'; img-src https://cdn.example.com *.example.com data:; report-uri /csp",
+			"default-src 'sha256-abc='; img-src 'self' data:",
+		},
+		{
+			"script-src https: 'nonce-xyz'; script-src 'none'; style-src 'self' 'unsafe-inline'",
+			"script-src https: 'self' 'nonce-xyz' 'sha256-abc='; style-src 'self' 'unsafe-inline'",
+		},
+		{
+			// Inline scripts are already allowed.
+			"script-src 'unsafe-inline' example.com",
+			"script-src 'unsafe-inline' 'self'",
+		},
+		{
+			"script-src 'self'; script-src-elem 'self'; frame-ancestors example.com",
+			"script-src 'self'; script-src-elem 'self' 'sha256-abc='; frame-ancestors example.com",
+		},
+		{
+			"sandbox allow-scripts, img-src example.com",
+			"sandbox allow-scripts, img-src 'self'",
+		},
+		{
+			"report-to default",
+			"",
+		},
+	}
+	for _, tc := range cases {
+		if got := Adapt(tc.policy, script); got != tc.want {
+			t.Errorf("Wrong adaptation of \"%s\".\n got = \"%s\"\nwant = \"%s\"", tc.policy, got, tc.want)
+		}
+	}
+}
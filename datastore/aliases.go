@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A link encoding other than the one its resource is stored under, such as
+// one issued before the encoding scheme changed. Aliases are kept when their
+// resource is deleted, since the hashed URL they point to still names what to
+// fetch again.
+type resourceAlias struct {
+	Alias     string `gorm:"primaryKey"`
+	HashedUrl string `gorm:"index"`
+}
+
+// Records that links to each of aliases are for the resource stored under
+// hashedUrl. Aliases already recorded are pointed at it instead.
+func (ds FileDatastore) AddAliases(hashedUrl string, aliases []string) error {
+	rows := make([]resourceAlias, 0, len(aliases))
+	for _, alias := range aliases {
+		if alias != hashedUrl {
+			rows = append(rows, resourceAlias{alias, hashedUrl})
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return ds.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "alias"}},
+		DoUpdates: clause.AssignmentColumns([]string{"hashed_url"}),
+	}).CreateInBatches(rows, 100).Error
+}
+
+// Returns the hashed URL that alias stands for, or "" if it isn't an alias.
+func (ds FileDatastore) ResolveAlias(alias string) (string, error) {
+	// Every request for a resource looks for an alias first, so this uses
+	// Find, which doesn't log when there is none.
+	var ras []resourceAlias
+	if result := ds.db.Where("alias = ?", alias).Limit(1).Find(&ras); result.Error != nil {
+		return "", result.Error
+	}
+	if len(ras) == 0 {
+		return "", nil
+	}
+	return ras[0].HashedUrl, nil
+}
+
+type ReencodeStats struct {
+	// Resources moved to the hashed URL the new scheme gives them.
+	Rekeyed int
+
+	// Aliases recorded, both for the hashed URLs resources were moved off of
+	// and for those the other schemes give them.
+	Aliased int
+
+	// Resources left where they were, without aliases, because another
+	// resource is already stored under the hashed URL the scheme gives them.
+	Conflicts int
+}
+
+// Stores every resource under the hashed URL that scheme gives its URL, and
+// records the one it was stored under, along with those that each of
+// aliasSchemes gives it, as aliases of it. Nothing else may be using the
+// datastore in the meantime.
+func (ds FileDatastore) Reencode(scheme func(string) (string, error), aliasSchemes ...func(string) (string, error)) (ReencodeStats, error) {
+	stats := ReencodeStats{}
+	var rms []resourceMetadata
+	result := ds.db.Select("id", "hashed_url", "url").FindInBatches(&rms, 500, func(tx *gorm.DB, batch int) error {
+		for _, rm := range rms {
+			hashedUrl, err := scheme(rm.Url)
+			if err != nil {
+				return err
+			}
+			aliases := []string{}
+			for _, aliasScheme := range aliasSchemes {
+				alias, err := aliasScheme(rm.Url)
+				if err != nil {
+					return err
+				}
+				aliases = append(aliases, alias)
+			}
+			if hashedUrl != rm.HashedUrl {
+				moved, err := ds.rekey(rm.ID, rm.HashedUrl, hashedUrl)
+				if err != nil {
+					return err
+				}
+				if !moved {
+					stats.Conflicts += 1
+					continue
+				}
+				stats.Rekeyed += 1
+				aliases = append(aliases, rm.HashedUrl)
+			}
+			// Aliases are looked up before resources, so one that is also
+			// another resource's hashed URL would hide it.
+			var added []string
+			for _, alias := range aliases {
+				var count int64
+				if result := ds.db.Model(&resourceMetadata{}).Where("hashed_url = ?", alias).Count(&count); result.Error != nil {
+					return result.Error
+				}
+				if alias == hashedUrl || count != 0 {
+					continue
+				}
+				existing, err := ds.ResolveAlias(alias)
+				if err != nil {
+					return err
+				}
+				if existing != hashedUrl {
+					stats.Aliased += 1
+				}
+				added = append(added, alias)
+			}
+			if err := ds.AddAliases(hashedUrl, added); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return stats, result.Error
+}
+
+// Moves the resource with the given ID, and everything else keyed by its
+// hashed URL, from hashedUrl to newHashedUrl. Returns false without moving
+// anything if another resource is already stored under newHashedUrl.
+func (ds FileDatastore) rekey(id uint, hashedUrl, newHashedUrl string) (bool, error) {
+	moved := false
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if result := tx.Model(&resourceMetadata{}).Where("hashed_url = ?", newHashedUrl).Count(&count); result.Error != nil {
+			return result.Error
+		}
+		if count != 0 {
+			return nil
+		}
+		if result := tx.Model(&resourceMetadata{}).Where("id = ?", id).Update("hashed_url", newHashedUrl); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Unscoped().Where("hashed_url = ?", newHashedUrl).Delete(&fetchFailure{}); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Model(&fetchFailure{}).Where("hashed_url = ?", hashedUrl).Update("hashed_url", newHashedUrl); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Exec("UPDATE OR IGNORE resource_tags SET hashed_url = ? WHERE hashed_url = ?", newHashedUrl, hashedUrl); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Where("hashed_url = ?", hashedUrl).Delete(&resourceTag{}); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Model(&resourceLink{}).Where("to_hashed_url = ?", hashedUrl).Update("to_hashed_url", newHashedUrl); result.Error != nil {
+			return result.Error
+		}
+		moved = true
+		return nil
+	})
+	return moved, err
+}
@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestReencode(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	scheme := func(url string) (string, error) {
+		return "v2-" + url, nil
+	}
+	oldScheme := func(url string) (string, error) {
+		return "v0-" + url, nil
+	}
+	var hrs []HttpResource
+	for i := 0; i < 2; i += 1 {
+		hr := randomHttpResource(r)
+		createHttpResource(t, &ds, hr)
+		hrs = append(hrs, hr)
+	}
+	if err := ds.AddTags(hrs[0].hashedUrl, []string{"recipes"}); err != nil {
+		t.Fatalf("Failed to add tags: %v", err)
+	}
+
+	stats, err := ds.Reencode(scheme, oldScheme)
+	if err != nil {
+		t.Fatalf("Failed to reencode: %v", err)
+	}
+	if stats != (ReencodeStats{Rekeyed: 2, Aliased: 4}) {
+		t.Errorf("Wrong stats. got = %+v", stats)
+	}
+	for _, hr := range hrs {
+		oldHashedUrl := hr.hashedUrl
+		hr.hashedUrl, _ = scheme(hr.resourceUrl)
+		if got := readHttpResource(t, ds, hr.hashedUrl); !reflect.DeepEqual(hr, got) {
+			t.Errorf("Expected:\n%v\ngot:\n%v", hr, got)
+		}
+		oldLink, _ := oldScheme(hr.resourceUrl)
+		for _, alias := range []string{oldHashedUrl, oldLink} {
+			if canonical, err := ds.ResolveAlias(alias); err != nil || canonical != hr.hashedUrl {
+				t.Errorf("Wrong resolution of %s. got = %q, %v, want = %q", alias, canonical, err, hr.hashedUrl)
+			}
+		}
+		if status, err := ds.Status(oldHashedUrl); err != nil || status != ResourceNotCached {
+			t.Errorf("Expected nothing under the old hashed URL. got = %v, %v", status, err)
+		}
+	}
+	newHashedUrl, _ := scheme(hrs[0].resourceUrl)
+	if tags, err := ds.Tags(newHashedUrl); err != nil || !reflect.DeepEqual(tags, []string{"recipes"}) {
+		t.Errorf("Expected tags to move with the resource. got = %v, %v", tags, err)
+	}
+	if canonical, err := ds.ResolveAlias(newHashedUrl); err != nil || canonical != "" {
+		t.Errorf("Expected the canonical hashed URL not to be an alias. got = %q, %v", canonical, err)
+	}
+
+	// Running it again changes nothing.
+	if stats, err = ds.Reencode(scheme, oldScheme); err != nil || stats != (ReencodeStats{}) {
+		t.Errorf("Expected nothing left to reencode. got = %+v, %v", stats, err)
+	}
+
+	// Resources each stored where the other would go stay put.
+	a := randomHttpResource(r)
+	b := randomHttpResource(r)
+	a.hashedUrl, _ = scheme(b.resourceUrl)
+	b.hashedUrl, _ = scheme(a.resourceUrl)
+	createHttpResource(t, &ds, a)
+	createHttpResource(t, &ds, b)
+	if stats, err = ds.Reencode(scheme); err != nil || stats != (ReencodeStats{Conflicts: 2}) {
+		t.Errorf("Expected conflicts. got = %+v, %v", stats, err)
+	}
+	for _, hr := range []HttpResource{a, b} {
+		if got := readHttpResource(t, ds, hr.hashedUrl); !reflect.DeepEqual(hr, got) {
+			t.Errorf("Expected:\n%v\ngot:\n%v", hr, got)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package datastore
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Names of entries within an exported archive.
+const archiveDbName = "knox.db"
+const archiveBlobPrefix = "blobs/"
+
+// Snapshot writes a consistent copy of the db to dbFilePath while the
+// datastore remains in use.
+func (ds FileDatastore) Snapshot(dbFilePath string) error {
+	if _, err := os.Stat(dbFilePath); err == nil {
+		return fmt.Errorf("%s already exists", dbFilePath)
+	}
+	return ds.db.Exec("VACUUM INTO ?", dbFilePath).Error
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// How many times to chase a body that is replaced by refreshes while it is
+// being exported.
+const maxExportAttempts = 3
+
+// Hands the body of rm to copyBlob. If a refresh has replaced the body since
+// the snapshot was taken, the replacement is handed over instead and the
+// snapshot's metadata is brought in line with it.
+func (ds FileDatastore) copyLiveBlob(snapshot FileDatastore, rm resourceMetadata, copyBlob func(rm resourceMetadata, filePath string) error) error {
+	for attempt := 0; ; attempt += 1 {
+		var err error
+		if rm.Tier == tierCold {
+			err = ds.copyColdBlob(snapshot, rm, copyBlob)
+		} else {
+			err = copyBlob(rm, resourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion))
+		}
+		if !os.IsNotExist(err) || attempt >= maxExportAttempts {
+			return err
+		}
+		if result := ds.db.First(&rm, rm.ID); result.Error != nil {
+			return result.Error
+		}
+		// The lease belongs to whoever is refreshing the live resource.
+		rm.LeaseOwner = ""
+		if result := snapshot.db.Save(&rm); result.Error != nil {
+			return result.Error
+		}
+	}
+}
+
+// Hands a hot copy of the cold body of rm to copyBlob, so that copies of the
+// datastore don't depend on its cold tier, and records in the snapshot that
+// the copy is hot.
+func (ds FileDatastore) copyColdBlob(snapshot FileDatastore, rm resourceMetadata, copyBlob func(rm resourceMetadata, filePath string) error) error {
+	tempDir, err := ioutil.TempDir("", "knox-thaw")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	tempPath := path.Join(tempDir, "body")
+	size, contentHash, err := ds.writeHotCopy(rm, tempPath)
+	if err != nil {
+		return err
+	}
+	if err := copyBlob(rm, tempPath); err != nil {
+		return err
+	}
+	return snapshot.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&resourceMetadata{}).Where("id = ?", rm.ID).Updates(map[string]interface{}{
+			"tier":          tierHot,
+			"bytes_on_disk": size,
+			"content_hash":  contentHash,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		return updateGlobalStats(tx, 0, size-int64(rm.BytesOnDisk))
+	})
+}
+
+// Export writes the db and the files of every completed resource to tw.
+// Resources that complete while the export is in progress are not included.
+func (ds FileDatastore) Export(tw *tar.Writer) error {
+	tempDir, err := ioutil.TempDir("", "knox-export")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	snapshotPath := path.Join(tempDir, archiveDbName)
+	if err := ds.Snapshot(snapshotPath); err != nil {
+		return err
+	}
+
+	// Files are only listed from the snapshot so that the archive agrees
+	// with its db. The db itself is archived last since exporting a file
+	// may update it.
+	snapshot, err := NewFileDatastoreWithOptions(snapshotPath, ds.rootPath, SqliteOptions{JournalMode: "DELETE"})
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	var rms []resourceMetadata
+	result := snapshot.db.Select("id", "blob_version", "tier", "bytes_on_disk").Where("download_complete = ?", true).Order("id").Find(&rms)
+	if result.Error != nil {
+		return result.Error
+	}
+	exportBlob := func(rm resourceMetadata, filePath string) error {
+		return writeArchiveFile(tw, archiveBlobPrefix+strconv.FormatUint(uint64(rm.ID), 10), filePath)
+	}
+	for _, rm := range rms {
+		if err := ds.copyLiveBlob(snapshot, rm, exportBlob); err != nil {
+			return fmt.Errorf("failed to export resource %d: %v", rm.ID, err)
+		}
+	}
+	if err := snapshot.Close(); err != nil {
+		return err
+	}
+	return writeArchiveFile(tw, archiveDbName, snapshotPath)
+}
+
+// Import unpacks an archive written by Export into an empty datastore at
+// dbFilePath and rootPath, opening the db with opts.
+func Import(tr *tar.Reader, dbFilePath string, rootPath string, opts SqliteOptions) error {
+	if rootPath != "" && !strings.HasSuffix(rootPath, "/") {
+		rootPath += "/"
+	}
+	if _, err := os.Stat(dbFilePath); err == nil {
+		return fmt.Errorf("refusing to overwrite existing db %s", dbFilePath)
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		var filePath string
+		if header.Name == archiveDbName {
+			filePath = dbFilePath
+		} else if strings.HasPrefix(header.Name, archiveBlobPrefix) {
+			id, err := strconv.ParseUint(header.Name[len(archiveBlobPrefix):], 10, 64)
+			if err != nil {
+				return fmt.Errorf("unexpected archive entry %s", header.Name)
+			}
+			filePath = resourceFilepath(rootPath, uint(id), 0)
+			if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+				return err
+			}
+		} else {
+			return fmt.Errorf("unexpected archive entry %s", header.Name)
+		}
+		f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		os.Chtimes(filePath, time.Now(), header.ModTime)
+	}
+	// Opening the db makes sure it's usable and brings its schema up to date.
+	ds, err := NewFileDatastoreWithOptions(dbFilePath, rootPath, opts)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		// Blobs are archived without their versions.
+		result := tx.Model(&resourceMetadata{}).Where("1 = 1").Update("blob_version", 0)
+		if result.Error != nil {
+			return result.Error
+		}
+		return dropUnfinishedDownloads(tx)
+	})
+}
@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	var hrs []HttpResource
+	for i := 0; i < 16; i += 1 {
+		hr := randomHttpResource(r)
+		createHttpResource(t, &ds, hr)
+		hrs = append(hrs, hr)
+	}
+	// Incomplete downloads are left out.
+	incomplete := randomHttpResource(r)
+	if rw, err := ds.TryCreate(incomplete.resourceUrl, incomplete.hashedUrl); err != nil || rw == nil {
+		t.Fatalf("Failed to create resource: %v", err)
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	if err := ds.Export(tw); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close archive: %v", err)
+	}
+
+	importRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	importDb := path.Join(importRoot, "knox.db")
+	if err := Import(tar.NewReader(bytes.NewReader(archive.Bytes())), importDb, importRoot, DefaultSqliteOptions()); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	imported, err := NewFileDatastore(importDb, importRoot)
+	if err != nil {
+		t.Fatalf("Failed to open imported FileDatastore: %v", err)
+	}
+	for _, hr := range hrs {
+		hr2 := readHttpResource(t, imported, hr.hashedUrl)
+		if !reflect.DeepEqual(hr, hr2) {
+			t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+		}
+	}
+	if status, err := imported.Status(incomplete.hashedUrl); err != nil || status != ResourceNotCached {
+		t.Errorf("Expected incomplete download to be dropped. got = %v, %v", status, err)
+	}
+	if stats, err := imported.Stats(); err != nil || stats.RecordCount != int64(len(hrs)) {
+		t.Errorf("Wrong imported stats. got = %v, %v, want %d records", stats, err, len(hrs))
+	}
+
+	// Importing over an existing datastore is refused.
+	if err := Import(tar.NewReader(bytes.NewReader(archive.Bytes())), importDb, importRoot, DefaultSqliteOptions()); err == nil {
+		t.Errorf("Expected import over existing db to fail.")
+	}
+}
+
+func TestExportRefreshedBlob(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	createHttpResource(t, &ds, hr)
+	snapshotPath := path.Join(datastoreRoot, "snapshot.db")
+	if err := ds.Snapshot(snapshotPath); err != nil {
+		t.Fatalf("Failed to snapshot: %v", err)
+	}
+	snapshot, err := NewFileDatastoreWithOptions(snapshotPath, datastoreRoot, SqliteOptions{JournalMode: "DELETE"})
+	if err != nil {
+		t.Fatalf("Failed to open snapshot: %v", err)
+	}
+	defer snapshot.Close()
+	var rm resourceMetadata
+	if result := snapshot.db.First(&rm); result.Error != nil {
+		t.Fatalf("Failed to read snapshot: %v", result.Error)
+	}
+
+	// Replace the body after the snapshot was taken.
+	rw, err := ds.TryRefresh(hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to refresh resource: %v", err)
+	}
+	if err = rw.WriteHeaders(&hr.headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	if _, err = rw.Write(hr.content); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource writer: %v", err)
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	exportBlob := func(rm resourceMetadata, filePath string) error {
+		return writeArchiveFile(tw, "blob", filePath)
+	}
+	if err := ds.copyLiveBlob(snapshot, rm, exportBlob); err != nil {
+		t.Fatalf("Failed to export refreshed blob: %v", err)
+	}
+	var synced resourceMetadata
+	if result := snapshot.db.First(&synced, rm.ID); result.Error != nil || synced.BlobVersion != 1 {
+		t.Errorf("Expected snapshot to follow the refresh. got = %d, %v", synced.BlobVersion, result.Error)
+	}
+}
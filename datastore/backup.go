@@ -0,0 +1,189 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/gorm"
+)
+
+// The name of the db within a backup directory.
+const backupDbName = "knox.db"
+
+// Copies the db to dbFilePath with SQLite's online backup API. The copy is
+// taken in a single read transaction, so it's consistent, and writers aren't
+// held up by it in WAL mode.
+func (ds FileDatastore) backupDb(dbFilePath string) error {
+	ctx := context.Background()
+	srcDb, err := ds.db.DB()
+	if err != nil {
+		return err
+	}
+	srcConn, err := srcDb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	destDb, err := sql.Open("sqlite3", dbFilePath)
+	if err != nil {
+		return err
+	}
+	defer destDb.Close()
+	destConn, err := destDb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			backup, err := destDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// Hard links src to dst, falling back to copying it where links aren't
+// possible, e.g. across filesystems. Finished resource files are never written
+// to again, so a link is as good as a copy.
+func linkOrCopy(src, dst string) error {
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil || os.IsNotExist(err) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// Drops downloads that were in progress when a copy of a datastore was taken,
+// since their files weren't copied, along with leases, since nobody holds
+// one on anything in a fresh datastore.
+func dropUnfinishedDownloads(tx *gorm.DB) error {
+	result := tx.Unscoped().Where("download_complete = ?", false).Delete(&resourceMetadata{})
+	if result.Error != nil {
+		return result.Error
+	}
+	result = tx.Model(&resourceMetadata{}).Where("lease_owner != ?", "").Update("lease_owner", "")
+	if result.Error != nil {
+		return result.Error
+	}
+	result = tx.Model(&globalStats{}).Where("id = ?", globalStatsId).Updates(map[string]interface{}{
+		"record_count":           tx.Model(&resourceMetadata{}).Select("count(*)"),
+		"disk_consumption_bytes": tx.Model(&resourceMetadata{}).Select("coalesce(sum(bytes_on_disk), 0)"),
+	})
+	return result.Error
+}
+
+// Backup writes a consistent copy of the datastore to outDir while it remains
+// in use. outDir ends up laid out like a datastore root, with the db in it,
+// and can be put back with Restore. Resources that complete while the backup
+// is in progress are not included.
+func (ds FileDatastore) Backup(outDir string) error {
+	if !strings.HasSuffix(outDir, "/") {
+		outDir += "/"
+	}
+	snapshotPath := outDir + backupDbName
+	if _, err := os.Stat(snapshotPath); err == nil {
+		return fmt.Errorf("%s already exists", snapshotPath)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	if err := ds.backupDb(snapshotPath); err != nil {
+		return err
+	}
+
+	snapshot, err := NewFileDatastoreWithOptions(snapshotPath, outDir, SqliteOptions{JournalMode: "DELETE"})
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	if err := snapshot.db.Transaction(dropUnfinishedDownloads); err != nil {
+		return err
+	}
+	var rms []resourceMetadata
+	result := snapshot.db.Select("id", "blob_version", "tier", "bytes_on_disk").Order("id").Find(&rms)
+	if result.Error != nil {
+		return result.Error
+	}
+	backupBlob := func(rm resourceMetadata, filePath string) error {
+		return linkOrCopy(filePath, resourceFilepath(outDir, rm.ID, rm.BlobVersion))
+	}
+	for _, rm := range rms {
+		if err := ds.copyLiveBlob(snapshot, rm, backupBlob); err != nil {
+			return fmt.Errorf("failed to back up resource %d: %v", rm.ID, err)
+		}
+	}
+	return snapshot.Close()
+}
+
+// Restore puts a backup written by Backup in place as a new datastore at
+// dbFilePath and rootPath, opening the db with opts.
+func Restore(backupDir string, dbFilePath string, rootPath string, opts SqliteOptions) error {
+	if !strings.HasSuffix(backupDir, "/") {
+		backupDir += "/"
+	}
+	if rootPath != "" && !strings.HasSuffix(rootPath, "/") {
+		rootPath += "/"
+	}
+	if _, err := os.Stat(dbFilePath); err == nil {
+		return fmt.Errorf("refusing to overwrite existing db %s", dbFilePath)
+	}
+	backup, err := NewFileDatastoreWithOptions(backupDir+backupDbName, backupDir, SqliteOptions{JournalMode: "DELETE"})
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+	var rms []resourceMetadata
+	if result := backup.db.Select("id", "blob_version").Order("id").Find(&rms); result.Error != nil {
+		return result.Error
+	}
+	for _, rm := range rms {
+		err := linkOrCopy(resourceFilepath(backupDir, rm.ID, rm.BlobVersion), resourceFilepath(rootPath, rm.ID, rm.BlobVersion))
+		if err != nil {
+			return fmt.Errorf("failed to restore resource %d: %v", rm.ID, err)
+		}
+	}
+	if err := backup.backupDb(dbFilePath); err != nil {
+		return err
+	}
+	// Opening the db makes sure it's usable and brings its schema up to date.
+	ds, err := NewFileDatastoreWithOptions(dbFilePath, rootPath, opts)
+	if err != nil {
+		return err
+	}
+	return ds.Close()
+}
@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	var hrs []HttpResource
+	for i := 0; i < 16; i += 1 {
+		hr := randomHttpResource(r)
+		createHttpResource(t, &ds, hr)
+		hrs = append(hrs, hr)
+	}
+	// Refreshed bodies are backed up under their versions.
+	rw, err := ds.TryRefresh(hrs[0].hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to refresh resource: %v", err)
+	}
+	hrs[0].content = []byte("refreshed")
+	if err = rw.WriteHeaders(&hrs[0].headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	if _, err = rw.Write(hrs[0].content); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource writer: %v", err)
+	}
+	// Incomplete downloads are left out.
+	incomplete := randomHttpResource(r)
+	if rw, err := ds.TryCreate(incomplete.resourceUrl, incomplete.hashedUrl); err != nil || rw == nil {
+		t.Fatalf("Failed to create resource: %v", err)
+	}
+
+	backupDir := path.Join(datastoreRoot, "backup")
+	if err := ds.Backup(backupDir); err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	if err := ds.Backup(backupDir); err == nil {
+		t.Errorf("Expected backing up over an existing backup to fail.")
+	}
+
+	restoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	restoreDb := path.Join(restoreRoot, "knox.db")
+	if err := Restore(backupDir, restoreDb, restoreRoot, DefaultSqliteOptions()); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	restored, err := NewFileDatastore(restoreDb, restoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to open restored FileDatastore: %v", err)
+	}
+	for _, hr := range hrs {
+		hr2 := readHttpResource(t, restored, hr.hashedUrl)
+		if !reflect.DeepEqual(hr, hr2) {
+			t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+		}
+	}
+	if status, err := restored.Status(incomplete.hashedUrl); err != nil || status != ResourceNotCached {
+		t.Errorf("Expected incomplete download to be dropped. got = %v, %v", status, err)
+	}
+	if stats, err := restored.Stats(); err != nil || stats.RecordCount != int64(len(hrs)) {
+		t.Errorf("Wrong restored stats. got = %v, %v, want %d records", stats, err, len(hrs))
+	}
+
+	// Restoring over an existing datastore is refused.
+	if err := Restore(backupDir, restoreDb, restoreRoot, DefaultSqliteOptions()); err == nil {
+		t.Errorf("Expected restore over existing db to fail.")
+	}
+}
@@ -3,15 +3,23 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"compress/gzip"
@@ -25,11 +33,38 @@ type HeaderReader interface {
 	io.ReadCloser
 }
 
-// TODO: May want to add metadata as well, including source URL and cache timestamp.
 type ResourceReader interface {
 	io.ReadCloser
+	ResourceInfo
+
+	// Returns the body as it is stored, a single gzip member, and how many
+	// bytes it is, or false if it isn't available that way or wouldn't be
+	// any smaller. Only the returned reader may be read from afterwards.
+	Gzipped() (io.Reader, int64, bool)
+}
+
+// What is stored about a cached resource besides its body.
+type ResourceInfo interface {
 	Headers() *http.Header
 	ResourceURL() string
+
+	// Hex-encoded SHA-256 of the stored body. Empty for resources cached
+	// before hashes were recorded.
+	ContentHash() string
+
+	// When the download of the stored body started.
+	CapturedAt() time.Time
+
+	// The media type of the stored body, e.g. "text/html", or "" if the
+	// origin didn't send one that could be parsed.
+	ContentType() string
+
+	// Number of bytes in the body uncompressed.
+	RawBytes() int
+
+	// The options the resource was captured with, as WriteCaptureOptions
+	// was given them, or "" if it was captured without any.
+	CaptureOptions() string
 }
 
 type ResourceWriter interface {
@@ -38,6 +73,93 @@ type ResourceWriter interface {
 	// WriteHeaders must be called before Write, otherwise headers will be
 	// assumed to be empty.
 	WriteHeaders(headers *http.Header) error
+
+	// WriteProtocol records the protocol the resource was fetched over, e.g.
+	// "HTTP/2.0".
+	WriteProtocol(protocol string) error
+
+	// WriteContentEncoding records the Content-Encoding the body was fetched
+	// with, e.g. "br", before it was decoded to be written.
+	WriteContentEncoding(encoding string) error
+
+	// WriteStatusCode records the HTTP status the origin responded with.
+	WriteStatusCode(code int) error
+
+	// WriteRequestHeaders records the headers of the request the resource
+	// was fetched with that say which variant of it the origin sent, e.g.
+	// Accept-Language.
+	WriteRequestHeaders(headers *http.Header) error
+
+	// WriteCaptureOptions records the options the resource is captured
+	// with, encoded however the caller likes, so that refreshing it can
+	// capture it the same way.
+	WriteCaptureOptions(options string) error
+
+	// WriteFilteredHeaders records the response headers, as the origin sent
+	// them, that were dropped or replaced before WriteHeaders was called.
+	WriteFilteredHeaders(headers *http.Header) error
+
+	// SetCompressionLevel sets the compress/gzip level the body is stored
+	// with from here on, e.g. gzip.NoCompression for content that is
+	// compressed already. It may only be called before Write or right after
+	// Checkpoint, Resume, or Reset.
+	SetCompressionLevel(level int) error
+
+	// Checkpoint makes everything written so far durable so that an
+	// interrupted download can be resumed from this point. validator
+	// identifies the version of the resource being downloaded (e.g. its
+	// ETag) and is handed back by Resume.
+	Checkpoint(validator string) error
+
+	// Resume discards everything written since the last checkpoint and
+	// returns the number of raw bytes written as of that checkpoint along
+	// with its validator. If there is no checkpoint, writing starts over from
+	// the beginning.
+	Resume() (rawBytes int, validator string, err error)
+
+	// Reset discards everything written so far, including checkpoints.
+	Reset() error
+
+	// Fail discards the resource instead of completing it and records
+	// fetchErr so that the resource is not fetched again before retryAfter.
+	// If the resource was being refreshed, the existing copy is kept and the
+	// failure is recorded as its refresh failure instead.
+	// Close must not be called after Fail.
+	Fail(fetchErr error, retryAfter time.Time) error
+
+	// Abandon discards the resource like Fail, but without recording a
+	// failure, for downloads given up on before the fetch could succeed or
+	// fail. Close must not be called after Abandon.
+	Abandon() error
+
+	// NotModified ends a refresh whose origin reported the existing copy to
+	// still be current. The existing copy is kept and counts as having been
+	// downloaded when the refresh started. Close must not be called after
+	// NotModified.
+	NotModified() error
+}
+
+// FetchFailure describes the most recent failed attempt to fetch a resource.
+type FetchFailure struct {
+	Url        string
+	Reason     string
+	FailedAt   time.Time
+	RetryAfter time.Time
+
+	// Whether the response was refused by caching policy.
+	Refused bool
+
+	// How many attempts in a row have failed, this one included. Only
+	// counted for resources that aren't cached.
+	Attempts int
+
+	// The options the failed capture was made with. See
+	// ResourceInfo.CaptureOptions.
+	CaptureOptions string
+}
+
+func (f FetchFailure) Error() string {
+	return fmt.Sprintf("failed to fetch %s: %s", f.Url, f.Reason)
 }
 
 type ResourceMetadata struct {
@@ -46,6 +168,58 @@ type ResourceMetadata struct {
 	DownloadDuration time.Duration
 	RawBytes         int
 	BytesOnDisk      int
+	AccessCount      int64
+	LastAccessed     time.Time
+	Protocol         string
+	ContentEncoding  string
+	ContentType      string
+	StatusCode       int
+
+	// The lowercased hostname the resource was fetched from, or "" if it
+	// has none.
+	Host string
+
+	// The most recent failed attempt to refresh the resource, if it hasn't
+	// been refreshed successfully since.
+	RefreshFailure *FetchFailure
+
+	// Whether the body has been offloaded to the cold tier, from which it is
+	// fetched back the next time it is opened.
+	Cold bool
+
+	// Whether the resource is under legal hold.
+	Held bool
+
+	// The position of the resource in the listing, to pass to ListAfter or
+	// ListBefore for the next or previous page.
+	Cursor string
+}
+
+// Narrows down the resources listed. Zero fields match everything.
+type ListFilter struct {
+	// A media type, e.g. "text/html", or all those of a top-level type, e.g.
+	// "image/*".
+	ContentType string
+
+	StatusCode int
+
+	// A hostname, matched case-insensitively.
+	Host string
+}
+
+func (f ListFilter) apply(query *gorm.DB) *gorm.DB {
+	if strings.HasSuffix(f.ContentType, "/*") {
+		query = query.Where("content_type LIKE ?", strings.ToLower(strings.TrimSuffix(f.ContentType, "*"))+"%")
+	} else if f.ContentType != "" {
+		query = query.Where("content_type = ?", strings.ToLower(f.ContentType))
+	}
+	if f.StatusCode != 0 {
+		query = query.Where("status_code = ?", f.StatusCode)
+	}
+	if f.Host != "" {
+		query = query.Where("host = ?", strings.ToLower(f.Host))
+	}
+	return query
 }
 
 type ResourceIterator interface {
@@ -56,6 +230,23 @@ type ResourceIterator interface {
 type ResourceStats struct {
 	RecordCount          int64
 	DiskConsumptionBytes int
+
+	// Requests served from the cache and requests that required a fetch.
+	Hits   int64
+	Misses int64
+}
+
+// How many resources have failed to be fetched.
+type FailureStats struct {
+	// Resources whose download failed and that won't be fetched again until
+	// their retry time has passed.
+	Failed int64
+
+	// Of those, the ones whose responses caching policy refused.
+	Refused int64
+
+	// Cached resources whose most recent refresh failed.
+	RefreshFailed int64
 }
 
 type ResourceStatus int
@@ -64,22 +255,272 @@ const (
 	ResourceNotCached ResourceStatus = iota
 	ResourceDownloading
 	ResourceCached
+	ResourceFailed
 )
 
+// How long a download may go without a heartbeat from its owner before
+// another instance is allowed to take it over.
+const defaultLeaseDuration = 30 * time.Second
+
+// Returned when the download of a resource has been abandoned by its owner.
+// Retrying TryCreate will take over the download.
+var ErrLeaseExpired = errors.New("download lease expired")
+
+// Returned by a ResourceWriter whose download was taken over by another owner.
+var ErrLeaseLost = errors.New("download lease lost to another owner")
+
+// Returned by Delete when there is no cached resource to delete.
+var ErrResourceNotCached = errors.New("resource not cached")
+
+// Returned by Delete when the resource is being downloaded or refreshed.
+var ErrResourceBusy = errors.New("resource is being downloaded")
+
+// Returned when asked to delete or refresh a resource under legal hold.
+var ErrResourceHeld = errors.New("resource is under legal hold")
+
+// Returned by ExpireFailure when no failure is recorded for the resource.
+var ErrNoFailure = errors.New("no failure recorded")
+
+// Returned when asked about a job that doesn't exist.
+var ErrNoJob = errors.New("no such job")
+
+// Returned when asked to change a job that has ended already.
+var ErrJobEnded = errors.New("job has already ended")
+
+// Returned by ResumeJob when the job isn't paused.
+var ErrJobNotPaused = errors.New("job is not paused")
+
+// Returned when a list cursor wasn't produced by this datastore.
+var ErrBadCursor = errors.New("malformed list cursor")
+
+// Wrapped by errors passed to Fail when the origin responded but caching
+// policy forbade storing the response, as opposed to the fetch failing.
+var ErrRefused = errors.New("refused by caching policy")
+
+// How often an in-progress download publishes its byte count.
+const progressUpdateInterval = 1 * time.Second
+
+type ResourceProgress struct {
+	Status          ResourceStatus
+	Url             string
+	DownloadStarted time.Time
+
+	// Empty until the download completes.
+	Protocol        string
+	ContentEncoding string
+
+	// For downloading resources, this lags behind the true count by up to
+	// progressUpdateInterval.
+	RawBytes int
+
+	// Only set when Status is ResourceFailed.
+	Failure *FetchFailure
+
+	// Only set when Status is ResourceCached and the most recent attempt to
+	// refresh the resource failed.
+	RefreshFailure *FetchFailure
+
+	// Whether the resource is under legal hold.
+	Held bool
+
+	// The options the resource is captured with. See
+	// ResourceInfo.CaptureOptions.
+	CaptureOptions string
+}
+
 type Datastore interface {
 	Status(hashedUrl string) (ResourceStatus, error)
 
+	// Like Status but with details on how far along a download is.
+	Progress(hashedUrl string) (ResourceProgress, error)
+
 	// Resource must exist when this method is called.
 	// If the resource is in the process of downloading, blocks until it is finished downloading.
 	Open(hashedUrl string) (ResourceReader, error)
 
-	// Creates resource if it does not exist.
+	// Like Open but without opening the body, and without waiting for a
+	// download to finish. Returns ErrResourceNotCached unless the resource
+	// is cached.
+	Stat(hashedUrl string) (ResourceInfo, error)
+
+	// Creates resource if it does not exist or if its download was abandoned.
 	// Returns (nil, nil) if the resource already exists.
 	TryCreate(resourceURL string, hashedUrl string) (ResourceWriter, error)
 
+	// Starts downloading a cached resource again. Its current contents
+	// continue to be served until the writer is closed, at which point they
+	// are replaced all at once. Returns (nil, nil) if the resource is not
+	// cached or is already being refreshed, and ErrResourceHeld if it is
+	// under legal hold.
+	TryRefresh(hashedUrl string) (ResourceWriter, error)
+
+	// Returns the failure recorded for the resource if it has not yet expired.
+	// Returns (nil, nil) otherwise.
+	Failure(hashedUrl string) (*FetchFailure, error)
+
+	// Like Failure, but also returns a failure that has expired. Failures
+	// are kept until the resource is fetched successfully.
+	RecordedFailure(hashedUrl string) (*FetchFailure, error)
+
+	// Lists the recorded failures of resources that aren't cached, expired
+	// or not, the most recent first.
+	Failures(offset, count int) ([]FailedResource, error)
+
+	// Lists up to count expired failures that caching policy didn't refuse,
+	// of resources that have failed fewer than maxAttempts times in a row,
+	// those that expired first first.
+	DueFailures(maxAttempts, count int) ([]FailedResource, error)
+
+	// Expires the failure recorded for the resource, so that it may be
+	// fetched again right away. Returns ErrNoFailure if there is none.
+	ExpireFailure(hashedUrl string) error
+
+	// Lists up to count resources, newest first, skipping the first offset.
+	// Prefer ListAfter, which doesn't have to scan the skipped resources.
 	List(offset, count int) (ResourceIterator, error)
 
+	// Lists up to count resources matching filter, newest first, starting
+	// right after the one whose Cursor is after, or with the newest if after
+	// is empty. Unlike with List, pages don't shift as resources are added.
+	ListAfter(after string, count int, filter ListFilter) (ResourceIterator, error)
+
+	// Lists up to count resources matching filter, newest first, ending
+	// right before the one whose Cursor is before.
+	ListBefore(before string, count int, filter ListFilter) (ResourceIterator, error)
+
 	Stats() (ResourceStats, error)
+
+	// Counts the failures that are still holding off fetches and the failed
+	// refreshes of cached resources.
+	FailureStats() (FailureStats, error)
+
+	// Records that the resource was served. hit is false if it had to be
+	// fetched in order to do so. Accesses are held in memory until
+	// FlushAccesses is called.
+	RecordAccess(hashedUrl string, hit bool) error
+
+	// Writes the accesses recorded since the last flush to the db.
+	FlushAccesses() error
+
+	// Removes a cached resource. Readers that already have it open can
+	// finish reading it. Returns ErrResourceHeld if it is under legal hold.
+	Delete(hashedUrl string) error
+
+	// Replaces the searchable title and text of a cached resource.
+	IndexText(hashedUrl string, title string, text string) error
+
+	// Finds cached resources whose text contains every term of query, most
+	// recently downloaded first.
+	Search(query string, offset, count int) ([]SearchResult, error)
+
+	// Lists the cached pages that have been indexed, the most recently
+	// downloaded first.
+	RecentPages(count int) ([]IndexedPage, error)
+
+	// Replaces the recorded outgoing links of a cached resource.
+	RecordLinks(hashedUrl string, links []Link) error
+
+	// Lists the targets of recorded links that aren't cached, the most linked
+	// first.
+	BrokenLinks(offset, count int) ([]BrokenLink, error)
+
+	// Lists cached resources, those using the most disk first.
+	Largest(offset, count int) (ResourceIterator, error)
+
+	// Breaks down the disk used by cached resources by host and by content
+	// type, the largest groups first.
+	DiskUsage() (DiskUsage, error)
+
+	// Adds tags to a resource, cached or not. Tags it already has are
+	// ignored.
+	AddTags(hashedUrl string, tags []string) error
+
+	// Lists the tags of a resource alphabetically.
+	Tags(hashedUrl string) ([]string, error)
+
+	// Like Tags for several resources at once, keyed by hashed URL.
+	// Resources without tags are left out.
+	TagsOf(hashedUrls []string) (map[string][]string, error)
+
+	// Places a cached resource under legal hold, or releases it. Until it
+	// is released, the resource can't be deleted or refreshed.
+	SetHold(hashedUrl string, held bool) error
+
+	// Returns how many bytes are free on the filesystem bodies are written
+	// to, not counting space reserved for the superuser.
+	FreeBytes() (int64, error)
+
+	// Returns the response headers stored for a resource, cached or being
+	// downloaded, and those that header rules dropped or replaced before
+	// they were stored, as the origin sent them.
+	StoredHeaders(hashedUrl string) (stored *http.Header, filtered *http.Header, err error)
+
+	// Returns the request headers recorded for a resource, cached or being
+	// downloaded, when it was fetched.
+	RequestHeaders(hashedUrl string) (*http.Header, error)
+
+	// Returns the hashed URL that alias stands for, or "" if it isn't an
+	// alias.
+	ResolveAlias(alias string) (string, error)
+
+	// Creates a queued job that isn't started before runAt, with the given
+	// items. Items without a state are queued.
+	CreateJob(kind string, spec string, runAt time.Time, items []JobItem) (Job, error)
+
+	// Returns ErrNoJob if there is no such job.
+	Job(id uint) (Job, error)
+
+	// Lists jobs, the most recently created first.
+	Jobs(offset, count int) ([]Job, error)
+
+	// Lists the items of a job in the order they were added.
+	JobItems(id uint, offset, count int) ([]JobItem, error)
+
+	// Returns the last count entries of a job's log, oldest first.
+	JobLog(id uint, count int) ([]JobLogEntry, error)
+
+	AppendJobLog(id uint, message string) error
+
+	// Takes on a job to run, if there is one due. See FileDatastore.ClaimJob.
+	ClaimJob() (*Job, error)
+
+	// Keeps the lease on a claimed job from expiring, and reports whether
+	// the job is to be cancelled or paused. Returns ErrLeaseLost if it was
+	// taken over.
+	RenewJobLease(id uint) (JobState, error)
+
+	// Marks up to count of a job's queued items as running and returns them.
+	NextJobItems(id uint, count int) ([]JobItem, error)
+
+	// Queues more items for a job. See FileDatastore.AddJobItems.
+	AddJobItems(id uint, items []JobItem, maxItems int) (int, error)
+
+	// Records what became of an item, and how many bytes were downloaded
+	// for it.
+	FinishJobItem(itemId uint, state JobItemState, errMsg string, bytes int) error
+
+	// Skips a job's queued items, e.g. once it has done as much as it may.
+	SkipJobItems(id uint, errMsg string) error
+
+	// Ends a claimed job, cancelling those of its items that weren't dealt
+	// with.
+	EndJob(id uint, state JobState, errMsg string) error
+
+	// Gives up a claimed job without ending it, either for it to be claimed
+	// again or, with JobPaused, to wait until it is resumed.
+	ReleaseJob(id uint, state JobState) error
+
+	// Cancels a job, right away if it isn't running, otherwise once its
+	// owner notices. Returns ErrJobEnded if it has ended already.
+	CancelJob(id uint) error
+
+	// Pauses a job, right away if it hasn't started, otherwise once its
+	// owner notices. Returns ErrJobEnded if it has ended already.
+	PauseJob(id uint) error
+
+	// Queues a paused job again. Returns ErrJobNotPaused if it isn't paused.
+	ResumeJob(id uint) error
+
 	// TODO: Might need to add Close method here as well once we add a networked
 	// db.
 
@@ -94,14 +535,26 @@ type resourceMetadata struct {
 	// Original URL.
 	Url string `gorm:"unique"`
 
-	// Request Headers.
+	// The hostname of Url, lowercased, or "" if it has none.
+	Host string `gorm:"index:idx_host_download_started,priority:1"`
+
+	// The headers of the request the resource was fetched with that say
+	// which variant of it was sent.
 	RequestHeaders string
 
 	// Response Headers
 	ResponseHeaders string
 
-	// Time download initiated.
-	DownloadStarted time.Time
+	// Response headers that header rules dropped or replaced before the
+	// rest were stored, as the origin sent them.
+	FilteredHeaders string
+
+	// The options the resource is captured with, encoded by the server.
+	CaptureOptions string
+
+	// Time download initiated. Indexed since resources are listed by it, on
+	// its own and within a host.
+	DownloadStarted time.Time `gorm:"index;index:idx_host_download_started,priority:2"`
 
 	// Time download finished.
 	DownloadFinished time.Time
@@ -114,10 +567,174 @@ type resourceMetadata struct {
 
 	// Whether the download has finished yet.
 	DownloadComplete bool
+
+	// Offset into the resource file of the last checkpoint of an in-progress
+	// download.
+	CheckpointOffset int64
+
+	// Number of raw bytes written as of the last checkpoint.
+	CheckpointRawBytes int
+
+	// Identifies the version of the resource being downloaded as of the last
+	// checkpoint.
+	CheckpointValidator string
+
+	// The datastore instance responsible for an in-progress download.
+	LeaseOwner string
+
+	// The download may be taken over by another instance after this time.
+	LeaseExpiry time.Time
+
+	// Number of times the resource has been served.
+	AccessCount int64
+
+	LastAccessed time.Time
+
+	// Incremented each time the resource is refreshed so that the new body
+	// can be written alongside the one being served.
+	BlobVersion int
+
+	// Hex-encoded SHA-256 of the body as stored on disk.
+	ContentHash string
+
+	// The protocol the body was fetched over, e.g. "HTTP/2.0".
+	Protocol string
+
+	// The Content-Encoding the body was fetched with, e.g. "br". Bodies are
+	// stored decoded, so this is only informational. Empty if the origin
+	// sent the body as it is.
+	ContentEncoding string
+
+	// The media type from the Content-Type response header, lowercased.
+	// Empty if there was none or it couldn't be parsed.
+	ContentType string `gorm:"index"`
+
+	// The HTTP status the origin responded with. Zero for resources cached
+	// before it was recorded.
+	StatusCode int `gorm:"index"`
+
+	// Describes the most recent failed refresh. Cleared once a refresh
+	// succeeds.
+	RefreshFailureReason string
+
+	RefreshFailedAt time.Time
+
+	// The resource will not be refreshed again until this time.
+	RefreshRetryAfter time.Time
+
+	// Whether the most recent failed refresh was refused by caching policy.
+	RefreshRefused bool
+
+	// Which tier the body is stored in. Empty for the hot tier.
+	Tier string `gorm:"index"`
+
+	// Whether the resource is under legal hold, which keeps it from being
+	// deleted or refreshed until it is released.
+	Held bool
+
+	// Whether the body is stored as a single gzip member, which any client
+	// that accepts gzip can decode. Each checkpoint of a download starts
+	// another member.
+	SingleGzipMember bool
 }
 
-func resourceFilepath(rootPath string, resourceId uint) string {
-	return rootPath + strconv.FormatUint(uint64(resourceId), 10)
+func (rm resourceMetadata) refreshFailure() *FetchFailure {
+	if rm.RefreshFailureReason == "" {
+		return nil
+	}
+	return &FetchFailure{Url: rm.Url, Reason: rm.RefreshFailureReason, FailedAt: rm.RefreshFailedAt, RetryAfter: rm.RefreshRetryAfter, Refused: rm.RefreshRefused}
+}
+
+type fetchFailure struct {
+	gorm.Model
+
+	HashedUrl string `gorm:"unique"`
+
+	Url string
+
+	// Description of what went wrong.
+	Reason string
+
+	FailedAt time.Time
+
+	// The resource will not be fetched again until this time.
+	RetryAfter time.Time
+
+	// Whether the response was refused by caching policy.
+	Refused bool
+
+	Attempts int
+
+	CaptureOptions string
+}
+
+func (ff fetchFailure) failure() *FetchFailure {
+	return &FetchFailure{ff.Url, ff.Reason, ff.FailedAt, ff.RetryAfter, ff.Refused, ff.Attempts, ff.CaptureOptions}
+}
+
+// Running totals over resourceMetadata, maintained alongside every change to
+// it so that Stats doesn't need to scan the whole table. There is only ever
+// one row.
+type globalStats struct {
+	ID                   uint `gorm:"primaryKey"`
+	RecordCount          int64
+	DiskConsumptionBytes int
+	Hits                 int64
+	Misses               int64
+}
+
+const globalStatsId = 1
+
+func updateGlobalStats(tx *gorm.DB, recordDelta int64, bytesDelta int64) error {
+	result := tx.Model(&globalStats{}).Where("id = ?", globalStatsId).Updates(map[string]interface{}{
+		"record_count":           gorm.Expr("record_count + ?", recordDelta),
+		"disk_consumption_bytes": gorm.Expr("disk_consumption_bytes + ?", bytesDelta),
+	})
+	return result.Error
+}
+
+// Computes the running totals from scratch if they don't exist yet, e.g. for
+// a db created before they were introduced.
+func initGlobalStats(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if result := tx.Model(&globalStats{}).Count(&count); result.Error != nil {
+			return result.Error
+		}
+		if count != 0 {
+			return nil
+		}
+		stats := globalStats{ID: globalStatsId}
+		if result := tx.Model(&resourceMetadata{}).Count(&stats.RecordCount); result.Error != nil {
+			return result.Error
+		}
+		result := tx.Model(&resourceMetadata{}).Select("coalesce(sum(bytes_on_disk), 0)").Scan(&stats.DiskConsumptionBytes)
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&stats).Error
+	})
+}
+
+// Resource files are fanned out over two levels of directories named after
+// the low bytes of the ID, e.g. resource 0x12ab34 lives at 34/ab/0012ab34, so
+// that no one directory grows too large. IDs are handed out in order, so the
+// high bytes would leave all recent resources in the same directory.
+func resourceFilepath(rootPath string, resourceId uint, blobVersion int) string {
+	name := fmt.Sprintf("%08x", resourceId)
+	filePath := rootPath + name[len(name)-2:] + "/" + name[len(name)-4:len(name)-2] + "/" + name
+	if blobVersion != 0 {
+		filePath += "." + strconv.Itoa(blobVersion)
+	}
+	return filePath
+}
+
+// Opens a resource file, creating the directories it belongs in first.
+func openResourceFile(filePath string, flag int) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filePath, flag, 0644)
 }
 
 func splitHeaderPair(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -144,19 +761,38 @@ func (e headerParseError) Error() string {
 	return e.msg
 }
 
-type FileResourceReader struct {
-	g           io.ReadCloser // gzip Reader
+type fileResourceInfo struct {
 	resourceURL string
 	// TODO: Change name to response headers
-	headers *http.Header
+	headers     *http.Header
+	contentHash string
+	capturedAt  time.Time
+	contentType string
+	rawBytes    int
+	options     string
 }
 
-func newFileResourceReader(f *os.File, resourceURL string, headers *http.Header) (FileResourceReader, error) {
-	g, err := gzip.NewReader(f)
-	if err != nil {
-		return FileResourceReader{}, err
+func newFileResourceInfo(rm resourceMetadata, headers *http.Header) fileResourceInfo {
+	return fileResourceInfo{rm.Url, headers, rm.ContentHash, rm.DownloadStarted, rm.ContentType, rm.RawBytes, rm.CaptureOptions}
+}
+
+type FileResourceReader struct {
+	g io.ReadCloser // decompressed body
+	fileResourceInfo
+
+	// The file g decompresses if it holds a single gzip member that is
+	// smaller than the body. Nil otherwise.
+	gzipped      *os.File
+	gzippedBytes int64
+}
+
+func newFileResourceReader(body io.ReadCloser, rm resourceMetadata, headers *http.Header) FileResourceReader {
+	rr := FileResourceReader{g: body, fileResourceInfo: newFileResourceInfo(rm, headers)}
+	if gr, ok := body.(gzipFileReader); ok && rm.SingleGzipMember && rm.BytesOnDisk < rm.RawBytes {
+		rr.gzipped = gr.f
+		rr.gzippedBytes = int64(rm.BytesOnDisk)
 	}
-	return FileResourceReader{g, resourceURL, headers}, nil
+	return rr
 }
 
 func (rr FileResourceReader) Read(b []byte) (int, error) {
@@ -167,119 +803,841 @@ func (rr FileResourceReader) Close() error {
 	return rr.g.Close()
 }
 
-func (rr FileResourceReader) Headers() *http.Header {
-	return rr.headers
-}
+func (rr FileResourceReader) Gzipped() (io.Reader, int64, bool) {
+	if rr.gzipped == nil {
+		return nil, 0, false
+	}
+	// The gzip reader has read ahead of the header.
+	if _, err := rr.gzipped.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, false
+	}
+	return io.LimitReader(rr.gzipped, rr.gzippedBytes), rr.gzippedBytes, true
+}
+
+func (ri fileResourceInfo) Headers() *http.Header {
+	return ri.headers
+}
+
+func (ri fileResourceInfo) ResourceURL() string {
+	return ri.resourceURL
+}
+
+func (ri fileResourceInfo) ContentHash() string {
+	return ri.contentHash
+}
+
+func (ri fileResourceInfo) CapturedAt() time.Time {
+	return ri.capturedAt
+}
+
+func (ri fileResourceInfo) ContentType() string {
+	return ri.contentType
+}
+
+func (ri fileResourceInfo) RawBytes() int {
+	return ri.rawBytes
+}
+
+func (ri fileResourceInfo) CaptureOptions() string {
+	return ri.options
+}
+
+type FileResourceWriter struct {
+	f        *os.File
+	g        *gzip.Writer
+	headers  *http.Header
+	filtered *http.Header
+	request  *http.Header
+	options  string
+	protocol string
+	encoding string
+	status   int
+	id       uint
+	ds       *FileDatastore
+	rawBytes int
+
+	// Where f is. Close renames it to filepath() if the two differ.
+	path string
+
+	lastProgressUpdate time.Time
+
+	checkpointOffset    int64
+	checkpointRawBytes  int
+	checkpointValidator string
+
+	stopHeartbeat chan struct{}
+	stopOnce      sync.Once
+	leaseLost     int32
+
+	// Set when replacing the body of a cached resource, in which case nothing
+	// is published until Close.
+	refresh         bool
+	blobVersion     int
+	downloadStarted time.Time
+
+	// Whether the body that a refresh replaced was in the cold tier.
+	replacedCold bool
+}
+
+func (rw *FileResourceWriter) filepath() string {
+	return resourceFilepath(rw.ds.rootPath, rw.id, rw.blobVersion)
+}
+
+func (rw *FileResourceWriter) heartbeat() {
+	ticker := time.NewTicker(rw.ds.leaseDuration / 3)
+	defer ticker.Stop()
+	lastRenewed := time.Now()
+	for {
+		select {
+		case <-rw.stopHeartbeat:
+			return
+		case <-ticker.C:
+			err := rw.renewLease()
+			if errors.Is(err, ErrLeaseLost) {
+				log.Printf("Lost lease on resource %d", rw.id)
+				return
+			} else if err != nil {
+				log.Printf("Failed to renew lease on resource %d: %v", rw.id, err)
+				// Once the lease may have expired, somebody else may be
+				// writing to the same file.
+				if time.Since(lastRenewed) >= rw.ds.leaseDuration {
+					log.Printf("Giving up lease on resource %d", rw.id)
+					atomic.StoreInt32(&rw.leaseLost, 1)
+					return
+				}
+				continue
+			}
+			lastRenewed = time.Now()
+		}
+	}
+}
+
+// Safe to call more than once.
+func (rw *FileResourceWriter) stopHeartbeating() {
+	rw.stopOnce.Do(func() {
+		close(rw.stopHeartbeat)
+	})
+}
+
+func (rw *FileResourceWriter) renewLease() error {
+	result := rw.ds.db.Model(&resourceMetadata{}).
+		Where("id = ? AND lease_owner = ?", rw.id, rw.ds.ownerId).
+		Update("lease_expiry", time.Now().Add(rw.ds.leaseDuration))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		atomic.StoreInt32(&rw.leaseLost, 1)
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (rw *FileResourceWriter) ownsLease() bool {
+	return atomic.LoadInt32(&rw.leaseLost) == 0
+}
+
+func headersAsString(headers *http.Header) (string, error) {
+	if headers == nil {
+		return "", nil
+	}
+	var headersBuffer bytes.Buffer
+	if err := headers.Write(&headersBuffer); err != nil {
+		return "", err
+	}
+	// Need an extra CRLF to mark the end of the headers.
+	if _, err := headersBuffer.Write([]byte("\r\n")); err != nil {
+		return "", err
+	}
+	return headersBuffer.String(), nil
+}
+
+func (rw *FileResourceWriter) Write(b []byte) (int, error) {
+	if !rw.ownsLease() {
+		return 0, ErrLeaseLost
+	}
+	rawBytes, err := rw.g.Write(b)
+	rw.rawBytes += rawBytes
+	if !rw.refresh && time.Since(rw.lastProgressUpdate) >= progressUpdateInterval {
+		rw.lastProgressUpdate = time.Now()
+		result := rw.ds.db.Model(&resourceMetadata{}).Where("id = ?", rw.id).Update("raw_bytes", rw.rawBytes)
+		if result.Error != nil {
+			log.Printf("Failed to update progress of resource %d: %v", rw.id, result.Error)
+		}
+	}
+	return rawBytes, err
+}
+
+// Returns the size of the file at filePath and the hex-encoded SHA-256 of its
+// contents.
+func hashFile(filePath string) (int64, string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (rw *FileResourceWriter) writeFinalMetadata() error {
+	bytesOnDisk, contentHash, err := hashFile(rw.filepath())
+	if err != nil {
+		return err
+	}
+	responseHeaders, err := headersAsString(rw.headers)
+	if err != nil {
+		return err
+	}
+	filteredHeaders, err := headersAsString(rw.filtered)
+	if err != nil {
+		return err
+	}
+	requestHeaders, err := headersAsString(rw.request)
+	if err != nil {
+		return err
+	}
+	return rw.ds.db.Transaction(func(tx *gorm.DB) error {
+		rm := resourceMetadata{}
+		if result := tx.First(&rm, "id = ? AND lease_owner = ?", rw.id, rw.ds.ownerId); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrLeaseLost
+		} else if result.Error != nil {
+			return result.Error
+		}
+		updates := map[string]interface{}{
+			"response_headers":  responseHeaders,
+			"filtered_headers":  filteredHeaders,
+			"request_headers":   requestHeaders,
+			"capture_options":   rw.options,
+			"download_finished": time.Now(),
+			"raw_bytes":         rw.rawBytes,
+			"bytes_on_disk":     bytesOnDisk,
+			"content_hash":      contentHash,
+			"protocol":          rw.protocol,
+			"content_encoding":  rw.encoding,
+			"content_type":      headerMediaType(rw.headers),
+			"status_code":       rw.status,
+			"download_complete": true,
+			"lease_owner":       "",
+			// Every checkpoint closes a member.
+			"single_gzip_member": rw.checkpointOffset == 0,
+		}
+		if rw.refresh {
+			rw.replacedCold = rm.Tier == tierCold
+			updates["tier"] = tierHot
+			updates["download_started"] = rw.downloadStarted
+			updates["blob_version"] = rw.blobVersion
+			updates["refresh_failure_reason"] = ""
+			updates["refresh_failed_at"] = time.Time{}
+			updates["refresh_retry_after"] = time.Time{}
+			updates["refresh_refused"] = false
+		}
+		// Nonzero only when replacing the body of a refreshed resource.
+		replacedBytes := int64(rm.BytesOnDisk)
+		if result := tx.Model(&rm).Updates(updates); result.Error != nil {
+			return result.Error
+		}
+		if err := updateGlobalStats(tx, 0, bytesOnDisk-replacedBytes); err != nil {
+			return err
+		}
+		result := tx.Unscoped().Where("hashed_url = (?)", tx.Model(&rm).Select("hashed_url").Where("id = ?", rw.id)).Delete(&fetchFailure{})
+		return result.Error
+	})
+}
+
+func (rw *FileResourceWriter) Close() error {
+	rw.stopHeartbeating()
+	// Make sure nobody has taken over before writing anything more to the
+	// file, since they'll be writing to it too.
+	if !rw.ownsLease() {
+		rw.f.Close()
+		return ErrLeaseLost
+	}
+	if err := rw.renewLease(); err != nil {
+		rw.f.Close()
+		return err
+	}
+	if err := rw.g.Close(); err != nil {
+		return err
+	}
+	if rw.ds.durability.syncs() {
+		if err := rw.f.Sync(); err != nil {
+			rw.f.Close()
+			return err
+		}
+	}
+	if err := rw.f.Close(); err != nil {
+		return err
+	}
+	// The body has to be in place before the resource is marked complete.
+	if finalPath := rw.filepath(); rw.path != finalPath {
+		if err := os.Rename(rw.path, finalPath); err != nil {
+			return err
+		}
+		rw.path = finalPath
+		if err := syncDir(filepath.Dir(finalPath)); err != nil {
+			return err
+		}
+	}
+	if err := rw.writeFinalMetadata(); err != nil {
+		return err
+	}
+	if rw.refresh {
+		// Readers that already opened the old body keep reading it.
+		oldPath := resourceFilepath(rw.ds.rootPath, rw.id, rw.blobVersion-1)
+		if rw.replacedCold {
+			oldPath = coldResourceFilepath(rw.ds.coldRoot, rw.id, rw.blobVersion-1)
+		}
+		if rw.replacedCold && rw.ds.coldRoot == "" {
+			log.Printf("Left cold body of resource %d behind since there is no cold tier", rw.id)
+		} else if err := os.Remove(oldPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove replaced body %s: %v", oldPath, err)
+		}
+	}
+	return nil
+}
+
+func (rw *FileResourceWriter) WriteHeaders(headers *http.Header) error {
+	rw.headers = headers
+	if rw.refresh {
+		return nil
+	}
+	// Stored right away so that whoever takes over an abandoned download
+	// doesn't need to fetch them again.
+	responseHeaders, err := headersAsString(headers)
+	if err != nil {
+		return err
+	}
+	result := rw.ds.db.Model(&resourceMetadata{}).Where("id = ?", rw.id).Update("response_headers", responseHeaders)
+	return result.Error
+}
+
+// Stored right away, like the headers.
+func (rw *FileResourceWriter) WriteFilteredHeaders(headers *http.Header) error {
+	rw.filtered = headers
+	if rw.refresh {
+		return nil
+	}
+	filteredHeaders, err := headersAsString(headers)
+	if err != nil {
+		return err
+	}
+	result := rw.ds.db.Model(&resourceMetadata{}).Where("id = ?", rw.id).Update("filtered_headers", filteredHeaders)
+	return result.Error
+}
+
+// Stored right away, like the headers.
+func (rw *FileResourceWriter) WriteRequestHeaders(headers *http.Header) error {
+	rw.request = headers
+	if rw.refresh {
+		return nil
+	}
+	requestHeaders, err := headersAsString(headers)
+	if err != nil {
+		return err
+	}
+	result := rw.ds.db.Model(&resourceMetadata{}).Where("id = ?", rw.id).Update("request_headers", requestHeaders)
+	return result.Error
+}
+
+// Stored right away, like the headers.
+func (rw *FileResourceWriter) WriteCaptureOptions(options string) error {
+	rw.options = options
+	if rw.refresh {
+		return nil
+	}
+	result := rw.ds.db.Model(&resourceMetadata{}).Where("id = ?", rw.id).Update("capture_options", options)
+	return result.Error
+}
+
+// Only stored once the download completes, since a resumed download may be
+// finished over a different protocol than it was started with.
+func (rw *FileResourceWriter) WriteProtocol(protocol string) error {
+	rw.protocol = protocol
+	return nil
+}
+
+// Only stored once the download completes, like the protocol.
+func (rw *FileResourceWriter) WriteContentEncoding(encoding string) error {
+	rw.encoding = encoding
+	return nil
+}
+
+// Only stored once the download completes, like the protocol.
+func (rw *FileResourceWriter) WriteStatusCode(code int) error {
+	rw.status = code
+	return nil
+}
+
+// Nothing has been written to the current gzip member yet, so it can be
+// replaced by one with a different level.
+func (rw *FileResourceWriter) SetCompressionLevel(level int) error {
+	g, err := gzip.NewWriterLevel(rw.f, level)
+	if err != nil {
+		return err
+	}
+	rw.g = g
+	return nil
+}
+
+// Each checkpoint ends the current gzip member and starts a new one. Readers
+// transparently concatenate the members.
+func (rw *FileResourceWriter) Checkpoint(validator string) error {
+	if !rw.ownsLease() {
+		return ErrLeaseLost
+	}
+	if err := rw.g.Close(); err != nil {
+		return err
+	}
+	if err := rw.f.Sync(); err != nil {
+		return err
+	}
+	offset, err := rw.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	// An abandoned refresh is started over rather than taken over, so its
+	// checkpoints only need to outlive failed requests.
+	if !rw.refresh {
+		result := rw.ds.db.Model(&resourceMetadata{}).Where("id = ?", rw.id).Updates(map[string]interface{}{
+			"checkpoint_offset":    offset,
+			"checkpoint_raw_bytes": rw.rawBytes,
+			"checkpoint_validator": validator,
+			"raw_bytes":            rw.rawBytes,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	rw.checkpointOffset = offset
+	rw.checkpointRawBytes = rw.rawBytes
+	rw.checkpointValidator = validator
+	rw.g.Reset(rw.f)
+	return nil
+}
+
+func (rw *FileResourceWriter) rewind(offset int64, rawBytes int) error {
+	if err := rw.f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := rw.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	// The partially written gzip member is abandoned rather than closed.
+	rw.g.Reset(rw.f)
+	rw.rawBytes = rawBytes
+	return nil
+}
+
+func (rw *FileResourceWriter) Resume() (int, string, error) {
+	if err := rw.rewind(rw.checkpointOffset, rw.checkpointRawBytes); err != nil {
+		return 0, "", err
+	}
+	return rw.checkpointRawBytes, rw.checkpointValidator, nil
+}
+
+func (rw *FileResourceWriter) Reset() error {
+	if err := rw.rewind(0, 0); err != nil {
+		return err
+	}
+	rw.checkpointOffset = 0
+	rw.checkpointRawBytes = 0
+	rw.checkpointValidator = ""
+	if rw.refresh {
+		return nil
+	}
+	result := rw.ds.db.Model(&resourceMetadata{}).Where("id = ?", rw.id).Updates(map[string]interface{}{
+		"checkpoint_offset":    0,
+		"checkpoint_raw_bytes": 0,
+		"checkpoint_validator": "",
+		"raw_bytes":            0,
+	})
+	return result.Error
+}
+
+func (rw *FileResourceWriter) Fail(fetchErr error, retryAfter time.Time) error {
+	return rw.discard(fetchErr, retryAfter)
+}
+
+func (rw *FileResourceWriter) Abandon() error {
+	return rw.discard(nil, time.Time{})
+}
+
+// Discards the resource, recording fetchErr unless it is nil.
+func (rw *FileResourceWriter) discard(fetchErr error, retryAfter time.Time) error {
+	rw.stopHeartbeating()
+	rw.f.Close()
+	if !rw.ownsLease() {
+		return ErrLeaseLost
+	}
+	if err := os.Remove(rw.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if rw.refresh && fetchErr == nil {
+		result := rw.ds.db.Model(&resourceMetadata{}).
+			Where("id = ? AND lease_owner = ?", rw.id, rw.ds.ownerId).
+			Update("lease_owner", "")
+		return result.Error
+	}
+	if rw.refresh {
+		// The resource is still cached, so the failure is recorded alongside
+		// it rather than replacing it.
+		result := rw.ds.db.Model(&resourceMetadata{}).
+			Where("id = ? AND lease_owner = ?", rw.id, rw.ds.ownerId).
+			Updates(map[string]interface{}{
+				"lease_owner":            "",
+				"refresh_failure_reason": fetchErr.Error(),
+				"refresh_failed_at":      time.Now(),
+				"refresh_retry_after":    retryAfter,
+				"refresh_refused":        errors.Is(fetchErr, ErrRefused),
+			})
+		return result.Error
+	}
+	return rw.ds.db.Transaction(func(tx *gorm.DB) error {
+		rm := resourceMetadata{}
+		if result := tx.First(&rm, "id = ? AND lease_owner = ?", rw.id, rw.ds.ownerId); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrLeaseLost
+		} else if result.Error != nil {
+			return result.Error
+		}
+		// The stub record must be removed outright so that the unique
+		// constraints don't prevent a retry.
+		if result := tx.Unscoped().Delete(&rm); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Exec("DELETE FROM resource_texts WHERE docid = ?", rm.ID); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Where("from_id = ?", rm.ID).Delete(&resourceLink{}); result.Error != nil {
+			return result.Error
+		}
+		if err := updateGlobalStats(tx, -1, 0); err != nil {
+			return err
+		}
+		if fetchErr == nil {
+			return nil
+		}
+		// Find, unlike First, doesn't log there being none as an error.
+		previous := fetchFailure{}
+		if result := tx.Select("attempts").Where("hashed_url = ?", rm.HashedUrl).Limit(1).Find(&previous); result.Error != nil {
+			return result.Error
+		}
+		ff := fetchFailure{
+			HashedUrl:      rm.HashedUrl,
+			Url:            rm.Url,
+			Reason:         fetchErr.Error(),
+			FailedAt:       time.Now(),
+			RetryAfter:     retryAfter,
+			Refused:        errors.Is(fetchErr, ErrRefused),
+			Attempts:       previous.Attempts + 1,
+			CaptureOptions: rw.options,
+		}
+		result := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "hashed_url"}},
+			DoUpdates: clause.AssignmentColumns([]string{"url", "reason", "failed_at", "retry_after", "refused", "attempts", "capture_options", "updated_at"}),
+		}).Create(&ff)
+		return result.Error
+	})
+}
+
+func (rw *FileResourceWriter) NotModified() error {
+	rw.stopHeartbeating()
+	rw.f.Close()
+	if !rw.refresh {
+		return fmt.Errorf("resource %d is not being refreshed", rw.id)
+	}
+	if !rw.ownsLease() {
+		return ErrLeaseLost
+	}
+	if err := os.Remove(rw.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	result := rw.ds.db.Model(&resourceMetadata{}).
+		Where("id = ? AND lease_owner = ?", rw.id, rw.ds.ownerId).
+		Updates(map[string]interface{}{
+			"lease_owner":            "",
+			"download_started":       rw.downloadStarted,
+			"refresh_failure_reason": "",
+			"refresh_failed_at":      time.Time{},
+			"refresh_retry_after":    time.Time{},
+			"refresh_refused":        false,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func newFileResourceWriter(f *os.File, path string, id uint, ds *FileDatastore) (*FileResourceWriter, error) {
+	rw := &FileResourceWriter{
+		f:                  f,
+		path:               path,
+		g:                  gzip.NewWriter(f),
+		id:                 id,
+		ds:                 ds,
+		lastProgressUpdate: time.Now(),
+		stopHeartbeat:      make(chan struct{}),
+	}
+	go rw.heartbeat()
+	return rw, nil
+}
+
+type FileDatastore struct {
+	rootPath string
+	db       *gorm.DB
+
+	// Where cold bodies are kept. Empty if there is no cold tier.
+	coldRoot string
+
+	// Identifies this instance when holding download leases.
+	ownerId       string
+	leaseDuration time.Duration
+
+	accesses *accessBuffer
+
+	// Recently served small bodies. Nil if disabled.
+	memory *memoryCache
+
+	durability Durability
+}
+
+type resourceAccesses struct {
+	count        int
+	lastAccessed time.Time
+}
+
+// Accesses recorded since the last flush. Writing each one to the db as it
+// happened would hold up every request on a write lock.
+type accessBuffer struct {
+	mu           sync.Mutex
+	hits, misses int64
+	resources    map[string]resourceAccesses
+}
+
+func newAccessBuffer() *accessBuffer {
+	return &accessBuffer{resources: map[string]resourceAccesses{}}
+}
+
+// Empties the buffer, returning what was in it.
+func (ab *accessBuffer) take() (int64, int64, map[string]resourceAccesses) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	hits, misses, resources := ab.hits, ab.misses, ab.resources
+	ab.hits, ab.misses, ab.resources = 0, 0, map[string]resourceAccesses{}
+	return hits, misses, resources
+}
+
+// Puts accesses that could not be flushed back so that the next flush tries
+// again.
+func (ab *accessBuffer) restore(hits, misses int64, resources map[string]resourceAccesses) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	ab.hits += hits
+	ab.misses += misses
+	for hashedUrl, ra := range resources {
+		existing := ab.resources[hashedUrl]
+		existing.count += ra.count
+		if ra.lastAccessed.After(existing.lastAccessed) {
+			existing.lastAccessed = ra.lastAccessed
+		}
+		ab.resources[hashedUrl] = existing
+	}
+}
+
+func newOwnerId() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix)), nil
+}
+
+type SqliteOptions struct {
+	// One of the values accepted by PRAGMA journal_mode, e.g. "WAL" or
+	// "DELETE". WAL allows readers to proceed concurrently with a writer but
+	// only works when every process sharing the db runs on the same host.
+	JournalMode string
 
-func (rr FileResourceReader) ResourceURL() string {
-	return rr.resourceURL
-}
+	// How long to wait on a locked database before failing.
+	BusyTimeout time.Duration
 
-type FileResourceWriter struct {
-	g        io.WriteCloser // gzip writer
-	headers  *http.Header
-	id       uint
-	ds       *FileDatastore
-	rawBytes int
+	// Zero means unlimited.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
 }
 
-func headersAsString(headers *http.Header) (string, error) {
-	if headers == nil {
-		return "", nil
+func DefaultSqliteOptions() SqliteOptions {
+	return SqliteOptions{
+		JournalMode:  "WAL",
+		BusyTimeout:  5 * time.Second,
+		MaxOpenConns: 4,
+		MaxIdleConns: 2,
 	}
-	var headersBuffer bytes.Buffer
-	if err := headers.Write(&headersBuffer); err != nil {
-		return "", err
+}
+
+func sqliteDsn(dbFilePath string, opts SqliteOptions) string {
+	separator := "?"
+	if strings.Contains(dbFilePath, "?") {
+		separator = "&"
 	}
-	// Need an extra CRLF to mark the end of the headers.
-	if _, err := headersBuffer.Write([]byte("\r\n")); err != nil {
-		return "", err
+	// Set via the DSN so that they apply to every pooled connection.
+	// Transactions take the write lock up front. A transaction that reads
+	// before it writes would otherwise fail right away, without waiting out
+	// the busy timeout, if another connection wrote in between.
+	dsn := fmt.Sprintf("%s%s_busy_timeout=%d&_txlock=immediate", dbFilePath, separator, opts.BusyTimeout.Milliseconds())
+	if opts.JournalMode != "" {
+		dsn += "&_journal_mode=" + opts.JournalMode
 	}
-	return headersBuffer.String(), nil
+	return dsn
 }
 
-func (rw *FileResourceWriter) Write(b []byte) (int, error) {
-	rawBytes, err := rw.g.Write(b)
-	rw.rawBytes += rawBytes
-	return rawBytes, err
+func NewFileDatastore(dbFilePath string, rootPath string) (FileDatastore, error) {
+	return NewFileDatastoreWithOptions(dbFilePath, rootPath, DefaultSqliteOptions())
 }
 
-func (rw *FileResourceWriter) writeFinalMetadata() error {
-	fi, err := os.Stat(resourceFilepath(rw.ds.rootPath, rw.id))
+func NewFileDatastoreWithOptions(dbFilePath string, rootPath string, opts SqliteOptions) (FileDatastore, error) {
+	// Must end in a slash.
+	if rootPath != "" && !strings.HasSuffix(rootPath, "/") {
+		rootPath += "/"
+	}
+	// TODO: Check if it exists first.
+	db, err := gorm.Open(sqlite.Open(sqliteDsn(dbFilePath, opts)), &gorm.Config{})
 	if err != nil {
-		return err
+		return FileDatastore{}, err
 	}
-	bytesOnDisk := fi.Size()
-	responseHeaders, err := headersAsString(rw.headers)
+	sqlDb, err := db.DB()
 	if err != nil {
-		return err
+		return FileDatastore{}, err
 	}
-	rm := resourceMetadata{}
-	result := rw.ds.db.Model(&rm).Where("id = ?", rw.id).Updates(map[string]interface{}{
-		"response_headers":  responseHeaders,
-		"download_finished": time.Now(),
-		"raw_bytes":         rw.rawBytes,
-		"bytes_on_disk":     bytesOnDisk,
-		"download_complete": true,
-	})
-	if result.Error != nil {
-		return result.Error
+	sqlDb.SetMaxOpenConns(opts.MaxOpenConns)
+	sqlDb.SetMaxIdleConns(opts.MaxIdleConns)
+	sqlDb.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	fresh := !db.Migrator().HasTable(&resourceMetadata{})
+	if err = checkSchemaNotNewer(db); err != nil {
+		return FileDatastore{}, err
 	}
-	return nil
+	if err = db.AutoMigrate(&resourceMetadata{}, &fetchFailure{}, &globalStats{}, &resourceLink{}, &resourceTag{}, &resourceAlias{}, &schemaVersion{}, &replicationCursor{}, &job{}, &jobItem{}, &jobLogEntry{}); err != nil {
+		return FileDatastore{}, err
+	}
+	if err = initSchemaVersion(db, fresh); err != nil {
+		return FileDatastore{}, err
+	}
+	if err = initGlobalStats(db); err != nil {
+		return FileDatastore{}, err
+	}
+	if err = db.Exec(createResourceTextsTable).Error; err != nil {
+		return FileDatastore{}, err
+	}
+	ownerId, err := newOwnerId()
+	if err != nil {
+		return FileDatastore{}, err
+	}
+	return FileDatastore{rootPath, db, "", ownerId, defaultLeaseDuration, newAccessBuffer(), nil, DurabilityNone}, nil
 }
 
-func (rw *FileResourceWriter) Close() error {
-	if err := rw.g.Close(); err != nil {
-		return err
+func (ds FileDatastore) Close() error {
+	if err := ds.FlushAccesses(); err != nil {
+		log.Printf("Failed to flush accesses: %v\n", err)
 	}
-	if err := rw.writeFinalMetadata(); err != nil {
+	sqlDb, err := ds.db.DB()
+	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (rw *FileResourceWriter) WriteHeaders(headers *http.Header) error {
-	rw.headers = headers
-	return nil
+	return sqlDb.Close()
 }
 
-func newFileResourceWriter(f *os.File, id uint, ds *FileDatastore) (*FileResourceWriter, error) {
-	return &FileResourceWriter{gzip.NewWriter(f), nil, id, ds, 0}, nil
+func (ds FileDatastore) Status(hashedUrl string) (ResourceStatus, error) {
+	progress, err := ds.Progress(hashedUrl)
+	if err != nil {
+		return ResourceNotCached, err
+	}
+	return progress.Status, nil
 }
 
-type FileDatastore struct {
-	rootPath string
-	db       *gorm.DB
+func (ds FileDatastore) Progress(hashedUrl string) (ResourceProgress, error) {
+	rm := resourceMetadata{}
+	result := ds.db.First(&rm, "hashed_url = ?", hashedUrl)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		failure, err := ds.Failure(hashedUrl)
+		if err != nil {
+			return ResourceProgress{}, err
+		} else if failure != nil {
+			return ResourceProgress{Status: ResourceFailed, Url: failure.Url, Failure: failure}, nil
+		}
+		return ResourceProgress{Status: ResourceNotCached}, nil
+	} else if result.Error != nil {
+		return ResourceProgress{}, result.Error
+	}
+	progress := ResourceProgress{
+		Status:          ResourceCached,
+		Url:             rm.Url,
+		DownloadStarted: rm.DownloadStarted,
+		RawBytes:        rm.RawBytes,
+		Protocol:        rm.Protocol,
+		ContentEncoding: rm.ContentEncoding,
+		RefreshFailure:  rm.refreshFailure(),
+		Held:            rm.Held,
+		CaptureOptions:  rm.CaptureOptions,
+	}
+	if !rm.DownloadComplete {
+		progress.Status = ResourceDownloading
+	}
+	return progress, nil
 }
 
-func NewFileDatastore(dbFilePath string, rootPath string) (FileDatastore, error) {
-	// Must end in a slash.
-	if rootPath != "" && !strings.HasSuffix(rootPath, "/") {
-		rootPath += "/"
+func (ds FileDatastore) StoredHeaders(hashedUrl string) (*http.Header, *http.Header, error) {
+	rm := resourceMetadata{}
+	result := ds.db.Select("response_headers", "filtered_headers").First(&rm, "hashed_url = ?", hashedUrl)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrResourceNotCached
+	} else if result.Error != nil {
+		return nil, nil, result.Error
 	}
-	// TODO: Check if it exists first.
-	db, err := gorm.Open(sqlite.Open(dbFilePath), &gorm.Config{})
+	stored, err := readHeaders(rm.ResponseHeaders)
 	if err != nil {
-		return FileDatastore{}, err
+		return nil, nil, err
 	}
-	if err = db.AutoMigrate(&resourceMetadata{}); err != nil {
-		return FileDatastore{}, err
+	filtered, err := readHeaders(rm.FilteredHeaders)
+	if err != nil {
+		return nil, nil, err
 	}
-	return FileDatastore{rootPath, db}, nil
+	return stored, filtered, nil
 }
 
-func (ds FileDatastore) Status(hashedUrl string) (ResourceStatus, error) {
+func (ds FileDatastore) RequestHeaders(hashedUrl string) (*http.Header, error) {
 	rm := resourceMetadata{}
-	result := ds.db.First(&rm, "hashed_url = ?", hashedUrl)
+	result := ds.db.Select("request_headers").First(&rm, "hashed_url = ?", hashedUrl)
 	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return ResourceNotCached, nil
+		return nil, ErrResourceNotCached
 	} else if result.Error != nil {
-		return ResourceNotCached, result.Error
-	} else if !rm.DownloadComplete {
-		return ResourceDownloading, nil
-	} else {
-		return ResourceCached, nil
+		return nil, result.Error
+	}
+	return readHeaders(rm.RequestHeaders)
+}
+
+// The media type of a Content-Type header, lowercased, or "" if there is none
+// or it can't be parsed.
+func headerMediaType(headers *http.Header) string {
+	if headers == nil {
+		return ""
 	}
+	mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
 }
 
 func readHeaders(hs string) (*http.Header, error) {
@@ -337,14 +1695,40 @@ func withExponentialBackoff(f successFunc, base time.Duration, growthFactor floa
 	return fmt.Errorf("Unreachable code.")
 }
 
+func (ds FileDatastore) Failure(hashedUrl string) (*FetchFailure, error) {
+	ff := fetchFailure{}
+	result := ds.db.First(&ff, "hashed_url = ? AND retry_after > ?", hashedUrl, time.Now())
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	return ff.failure(), nil
+}
+
 func (ds FileDatastore) awaitCompletedResource(hashedUrl string) (resourceMetadata, error) {
 	rm := resourceMetadata{}
+	var failure *FetchFailure
+	leaseExpired := false
 	getResource := func() error {
 		result := ds.db.First(&rm, "hashed_url = ?", hashedUrl)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			// The download may have failed while we were waiting on it.
+			var err error
+			if failure, err = ds.Failure(hashedUrl); err != nil {
+				return err
+			} else if failure != nil {
+				return nil
+			}
+		}
 		if result.Error != nil {
 			return result.Error
 		}
 		if !rm.DownloadComplete {
+			if rm.LeaseExpiry.Before(time.Now()) {
+				leaseExpired = true
+				return nil
+			}
 			return fmt.Errorf("download incomplete")
 		}
 		return nil
@@ -357,6 +1741,12 @@ func (ds FileDatastore) awaitCompletedResource(hashedUrl string) (resourceMetada
 	if err != nil {
 		return rm, err
 	}
+	if failure != nil {
+		return rm, *failure
+	}
+	if leaseExpired {
+		return rm, ErrLeaseExpired
+	}
 	return rm, nil
 }
 
@@ -365,40 +1755,131 @@ func (ds FileDatastore) Open(hashedUrl string) (ResourceReader, error) {
 	if err != nil {
 		return nil, err
 	}
-	f, err := os.Open(ds.rootPath + strconv.FormatUint(uint64(rm.ID), 10))
+	if cached := ds.memory.get(rm); cached != nil {
+		headers := cached.headers.Clone()
+		return newFileResourceReader(ioutil.NopCloser(bytes.NewReader(cached.body)), rm, &headers), nil
+	}
+	body, rm, err := ds.openBody(rm)
+	if os.IsNotExist(err) {
+		// A refresh, or a move between tiers, may have replaced the body
+		// after we looked it up.
+		if rm, err = ds.awaitCompletedResource(hashedUrl); err != nil {
+			return nil, err
+		}
+		body, rm, err = ds.openBody(rm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	headers, err := readHeaders(rm.ResponseHeaders)
 	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if body, err = ds.memory.fill(rm, body, headers); err != nil {
 		return nil, err
 	}
+	return newFileResourceReader(body, rm, headers), nil
+}
+
+func (ds FileDatastore) Stat(hashedUrl string) (ResourceInfo, error) {
+	rm := resourceMetadata{}
+	result := ds.db.First(&rm, "hashed_url = ? AND download_complete = ?", hashedUrl, true)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrResourceNotCached
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
 	headers, err := readHeaders(rm.ResponseHeaders)
 	if err != nil {
 		return nil, err
 	}
-	return newFileResourceReader(f, rm.Url, headers)
+	return newFileResourceInfo(rm, headers), nil
 }
 
 func (ds FileDatastore) tryCreateStubRecord(resourceUrl, hashedUrl string) (bool, uint, error) {
-	// TODO: Actually collect requestHeaders
 	rm := &resourceMetadata{
-		gorm.Model{},
-		hashedUrl,
-		resourceUrl,
-		"",
-		"",
-		time.Now(),
-		time.UnixMicro(0),
-		0,
-		0,
-		false,
-	}
-	result := ds.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&rm)
+		HashedUrl:        hashedUrl,
+		Url:              resourceUrl,
+		Host:             resourceHost(resourceUrl),
+		DownloadStarted:  time.Now(),
+		DownloadFinished: time.UnixMicro(0),
+		LeaseOwner:       ds.ownerId,
+		LeaseExpiry:      time.Now().Add(ds.leaseDuration),
+	}
+	created := false
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rm)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		created = true
+		return updateGlobalStats(tx, 1, 0)
+	})
+	if err != nil || !created {
+		return false, 0, err
+	}
+	return true, rm.ID, nil
+}
 
+// Takes over the download of a resource whose owner stopped renewing its
+// lease. Returns (nil, nil) if there is nothing to take over.
+func (ds FileDatastore) tryTakeOver(hashedUrl string) (*FileResourceWriter, error) {
+	rm := resourceMetadata{}
+	result := ds.db.First(&rm, "hashed_url = ?", hashedUrl)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	now := time.Now()
+	if rm.DownloadComplete || !rm.LeaseExpiry.Before(now) {
+		return nil, nil
+	}
+	result = ds.db.Model(&resourceMetadata{}).
+		Where("id = ? AND download_complete = ? AND lease_expiry < ?", rm.ID, false, now).
+		Updates(map[string]interface{}{
+			"lease_owner":  ds.ownerId,
+			"lease_expiry": now.Add(ds.leaseDuration),
+		})
 	if result.Error != nil {
-		return false, 0, result.Error
+		return nil, result.Error
 	}
 	if result.RowsAffected == 0 {
-		return false, 0, nil
+		// Someone else got there first.
+		return nil, nil
 	}
-	return true, rm.ID, nil
+	log.Printf("Taking over abandoned download of %s from %s", rm.Url, rm.LeaseOwner)
+
+	path := ds.abandonedWritePath(resourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion))
+	f, err := openResourceFile(path, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	rw, err := newFileResourceWriter(f, path, rm.ID, &ds)
+	if err != nil {
+		return nil, err
+	}
+	if rw.headers, err = readHeaders(rm.ResponseHeaders); err != nil {
+		return nil, err
+	}
+	if rw.filtered, err = readHeaders(rm.FilteredHeaders); err != nil {
+		return nil, err
+	}
+	if rw.request, err = readHeaders(rm.RequestHeaders); err != nil {
+		return nil, err
+	}
+	rw.options = rm.CaptureOptions
+	rw.checkpointOffset = rm.CheckpointOffset
+	rw.checkpointRawBytes = rm.CheckpointRawBytes
+	rw.checkpointValidator = rm.CheckpointValidator
+	if err := rw.rewind(rw.checkpointOffset, rw.checkpointRawBytes); err != nil {
+		return nil, err
+	}
+	return rw, nil
 }
 
 func (ds FileDatastore) TryCreate(resourceURL string, hashedUrl string) (ResourceWriter, error) {
@@ -408,14 +1889,19 @@ func (ds FileDatastore) TryCreate(resourceURL string, hashedUrl string) (Resourc
 	}
 
 	if !created {
-		return nil, nil
+		rw, err := ds.tryTakeOver(hashedUrl)
+		if rw == nil || err != nil {
+			return nil, err
+		}
+		return rw, nil
 	}
 
-	f, err := os.Create(resourceFilepath(ds.rootPath, id))
+	path := ds.writePath(resourceFilepath(ds.rootPath, id, 0))
+	f, err := openResourceFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
 	if err != nil {
 		return nil, err
 	}
-	fileResourceWriter, err := newFileResourceWriter(f, id, &ds)
+	fileResourceWriter, err := newFileResourceWriter(f, path, id, &ds)
 	if err != nil {
 		return nil, err
 	}
@@ -423,6 +1909,48 @@ func (ds FileDatastore) TryCreate(resourceURL string, hashedUrl string) (Resourc
 	return resourceWriter, nil
 }
 
+func (ds FileDatastore) TryRefresh(hashedUrl string) (ResourceWriter, error) {
+	rm := resourceMetadata{}
+	result := ds.db.First(&rm, "hashed_url = ? AND download_complete = ?", hashedUrl, true)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, result.Error
+	}
+	if rm.Held {
+		return nil, ErrResourceHeld
+	}
+	// Completed resources only hold a lease while being refreshed.
+	now := time.Now()
+	result = ds.db.Model(&resourceMetadata{}).
+		Where("id = ? AND download_complete = ? AND (lease_owner = ? OR lease_expiry < ?)", rm.ID, true, "", now).
+		Updates(map[string]interface{}{
+			"lease_owner":  ds.ownerId,
+			"lease_expiry": now.Add(ds.leaseDuration),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	blobVersion := rm.BlobVersion + 1
+	path := ds.writePath(resourceFilepath(ds.rootPath, rm.ID, blobVersion))
+	f, err := openResourceFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	rw, err := newFileResourceWriter(f, path, rm.ID, &ds)
+	if err != nil {
+		return nil, err
+	}
+	rw.refresh = true
+	rw.blobVersion = blobVersion
+	rw.downloadStarted = now
+	return rw, nil
+}
+
 type fileResourceIterator struct {
 	rootPath string
 	rms      *[]resourceMetadata
@@ -432,7 +1960,24 @@ type fileResourceIterator struct {
 func (fri *fileResourceIterator) Next() (ResourceMetadata, error) {
 	rm := (*fri.rms)[fri.index]
 	fri.index += 1
-	return ResourceMetadata{rm.Url, rm.DownloadStarted, rm.DownloadFinished.Sub(rm.DownloadStarted), rm.RawBytes, rm.BytesOnDisk}, nil
+	return ResourceMetadata{
+		Url:              rm.Url,
+		DownloadStarted:  rm.DownloadStarted,
+		DownloadDuration: rm.DownloadFinished.Sub(rm.DownloadStarted),
+		RawBytes:         rm.RawBytes,
+		BytesOnDisk:      rm.BytesOnDisk,
+		AccessCount:      rm.AccessCount,
+		LastAccessed:     rm.LastAccessed,
+		Protocol:         rm.Protocol,
+		ContentEncoding:  rm.ContentEncoding,
+		ContentType:      rm.ContentType,
+		StatusCode:       rm.StatusCode,
+		Host:             rm.Host,
+		RefreshFailure:   rm.refreshFailure(),
+		Cold:             rm.Tier == tierCold,
+		Held:             rm.Held,
+		Cursor:           listCursor(rm),
+	}, nil
 }
 
 func (fri *fileResourceIterator) HasNext() bool {
@@ -441,19 +1986,179 @@ func (fri *fileResourceIterator) HasNext() bool {
 
 func (ds FileDatastore) List(offset, count int) (ResourceIterator, error) {
 	var rms []resourceMetadata
-	result := ds.db.Limit(count).Offset(offset).Order("download_started desc").Find(&rms)
+	result := ds.db.Limit(count).Offset(offset).Order("download_started desc, id desc").Find(&rms)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &fileResourceIterator{ds.rootPath, &rms, 0}, nil
+}
+
+// Resources are listed by when their download started, newest first, with
+// ties broken by id.
+func listCursor(rm resourceMetadata) string {
+	return fmt.Sprintf("%d.%d", rm.DownloadStarted.UnixNano(), rm.ID)
+}
+
+func parseListCursor(cursor string) (time.Time, uint, error) {
+	parts := strings.Split(cursor, ".")
+	if len(parts) != 2 {
+		return time.Time{}, 0, ErrBadCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrBadCursor
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrBadCursor
+	}
+	return time.Unix(0, nanos), uint(id), nil
+}
+
+func (ds FileDatastore) ListAfter(after string, count int, filter ListFilter) (ResourceIterator, error) {
+	query := filter.apply(ds.db.Limit(count).Order("download_started desc, id desc"))
+	if after != "" {
+		started, id, err := parseListCursor(after)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("(download_started < ? OR (download_started = ? AND id < ?))", started, started, id)
+	}
+	var rms []resourceMetadata
+	if result := query.Find(&rms); result.Error != nil {
+		return nil, result.Error
+	}
+	return &fileResourceIterator{ds.rootPath, &rms, 0}, nil
+}
+
+func (ds FileDatastore) ListBefore(before string, count int, filter ListFilter) (ResourceIterator, error) {
+	started, id, err := parseListCursor(before)
+	if err != nil {
+		return nil, err
+	}
+	var rms []resourceMetadata
+	result := filter.apply(ds.db.Limit(count).Order("download_started, id")).
+		Where("(download_started > ? OR (download_started = ? AND id > ?))", started, started, id).
+		Find(&rms)
 	if result.Error != nil {
 		return nil, result.Error
 	}
+	for i, j := 0, len(rms)-1; i < j; i, j = i+1, j-1 {
+		rms[i], rms[j] = rms[j], rms[i]
+	}
 	return &fileResourceIterator{ds.rootPath, &rms, 0}, nil
 }
 
 func (ds FileDatastore) Stats() (ResourceStats, error) {
-	var resourceCount int64 = 0
-	ds.db.Model(&resourceMetadata{}).Count(&resourceCount)
+	stats := globalStats{}
+	if result := ds.db.First(&stats, globalStatsId); result.Error != nil {
+		return ResourceStats{}, result.Error
+	}
+	return ResourceStats{stats.RecordCount, stats.DiskConsumptionBytes, stats.Hits, stats.Misses}, nil
+}
+
+func (ds FileDatastore) FailureStats() (FailureStats, error) {
+	stats := FailureStats{}
+	now := time.Now()
+	if result := ds.db.Model(&fetchFailure{}).Where("retry_after > ?", now).Count(&stats.Failed); result.Error != nil {
+		return FailureStats{}, result.Error
+	}
+	if result := ds.db.Model(&fetchFailure{}).Where("retry_after > ? AND refused = ?", now, true).Count(&stats.Refused); result.Error != nil {
+		return FailureStats{}, result.Error
+	}
+	if result := ds.db.Model(&resourceMetadata{}).Where("refresh_failure_reason != ?", "").Count(&stats.RefreshFailed); result.Error != nil {
+		return FailureStats{}, result.Error
+	}
+	return stats, nil
+}
+
+func (ds FileDatastore) RecordAccess(hashedUrl string, hit bool) error {
+	ds.accesses.mu.Lock()
+	defer ds.accesses.mu.Unlock()
+	if hit {
+		ds.accesses.hits += 1
+	} else {
+		ds.accesses.misses += 1
+	}
+	ra := ds.accesses.resources[hashedUrl]
+	ra.count += 1
+	ra.lastAccessed = time.Now()
+	ds.accesses.resources[hashedUrl] = ra
+	return nil
+}
 
-	var byteSum int = 0
-	ds.db.Model(&resourceMetadata{}).Select("sum(bytes_on_disk)").Scan(&byteSum)
+func (ds FileDatastore) Delete(hashedUrl string) error {
+	rm := resourceMetadata{}
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.First(&rm, "hashed_url = ?", hashedUrl)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrResourceNotCached
+		} else if result.Error != nil {
+			return result.Error
+		}
+		// Pulling the row out from under a download would leave it writing
+		// to a file nobody will ever read.
+		if !rm.DownloadComplete || (rm.LeaseOwner != "" && rm.LeaseExpiry.After(time.Now())) {
+			return ErrResourceBusy
+		}
+		if rm.Held {
+			return ErrResourceHeld
+		}
+		if result := tx.Unscoped().Delete(&rm); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Exec("DELETE FROM resource_texts WHERE docid = ?", rm.ID); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Where("from_id = ?", rm.ID).Delete(&resourceLink{}); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Where("hashed_url = ?", rm.HashedUrl).Delete(&resourceTag{}); result.Error != nil {
+			return result.Error
+		}
+		return updateGlobalStats(tx, -1, -int64(rm.BytesOnDisk))
+	})
+	if err != nil {
+		return err
+	}
+	ds.memory.remove(rm.ID)
+	filePath := resourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion)
+	if rm.Tier == tierCold {
+		// Without a cold tier there's nowhere to remove the body from.
+		if ds.coldRoot == "" {
+			return nil
+		}
+		filePath = coldResourceFilepath(ds.coldRoot, rm.ID, rm.BlobVersion)
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
 
-	return ResourceStats{resourceCount, byteSum}, nil
+func (ds FileDatastore) FlushAccesses() error {
+	hits, misses, resources := ds.accesses.take()
+	if hits == 0 && misses == 0 && len(resources) == 0 {
+		return nil
+	}
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		for hashedUrl, ra := range resources {
+			result := tx.Model(&resourceMetadata{}).Where("hashed_url = ?", hashedUrl).Updates(map[string]interface{}{
+				"access_count":  gorm.Expr("access_count + ?", ra.count),
+				"last_accessed": ra.lastAccessed,
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		result := tx.Model(&globalStats{}).Where("id = ?", globalStatsId).Updates(map[string]interface{}{
+			"hits":   gorm.Expr("hits + ?", hits),
+			"misses": gorm.Expr("misses + ?", misses),
+		})
+		return result.Error
+	})
+	if err != nil {
+		ds.accesses.restore(hits, misses, resources)
+	}
+	return err
 }
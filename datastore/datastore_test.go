@@ -2,15 +2,19 @@ package datastore
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"errors"
 	"io/ioutil"
 	"math"
 	"math/rand"
 	"net/http"
+	"os"
 	"path"
 	"reflect"
 	"testing"
+	"time"
 )
 
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789$-_.+!*',():;@&=/#[]")
@@ -155,3 +159,1050 @@ func TestInvolution(t *testing.T) {
 		}
 	}
 }
+
+func TestFailure(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+	if err = rw.Fail(fmt.Errorf("connection refused"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to record failure: %v", err)
+	}
+
+	status, err := ds.Status(hr.hashedUrl)
+	if err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	if status != ResourceFailed {
+		t.Errorf("Wrong status. got = %v, want = %v", status, ResourceFailed)
+	}
+	failure, err := ds.Failure(hr.hashedUrl)
+	if err != nil {
+		t.Fatalf("Failed to get failure: %v", err)
+	}
+	if failure == nil || failure.Reason != "connection refused" || failure.Url != hr.resourceUrl || failure.Refused {
+		t.Errorf("Wrong failure recorded: %v", failure)
+	}
+	var openFailure FetchFailure
+	if _, err = ds.Open(hr.hashedUrl); !errors.As(err, &openFailure) {
+		t.Errorf("Expected Open to return a FetchFailure but got: %v", err)
+	}
+
+	// A retry is allowed to succeed and clears the failure.
+	createHttpResource(t, &ds, hr)
+	if failure, err = ds.Failure(hr.hashedUrl); err != nil || failure != nil {
+		t.Errorf("Expected failure to be cleared. got = %v, %v", failure, err)
+	}
+	hr2 := readHttpResource(t, ds, hr.hashedUrl)
+	if !reflect.DeepEqual(hr, hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+	if err = rw.Abandon(); err != nil {
+		t.Fatalf("Failed to abandon download: %v", err)
+	}
+	if status, err := ds.Status(hr.hashedUrl); err != nil || status != ResourceNotCached {
+		t.Errorf("Expected the resource not to be cached. got = %v, %v", status, err)
+	}
+	if failure, err := ds.RecordedFailure(hr.hashedUrl); err != nil || failure != nil {
+		t.Errorf("Expected no failure to be recorded. got = %v, %v", failure, err)
+	}
+
+	// An abandoned refresh leaves the existing copy as it was.
+	createHttpResource(t, &ds, hr)
+	rw, err = ds.TryRefresh(hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to start refresh: %v", err)
+	}
+	if err = rw.Abandon(); err != nil {
+		t.Fatalf("Failed to abandon refresh: %v", err)
+	}
+	if progress, err := ds.Progress(hr.hashedUrl); err != nil || progress.Status != ResourceCached || progress.RefreshFailure != nil {
+		t.Errorf("Expected the resource to be cached without a refresh failure. got = %+v, %v", progress, err)
+	}
+	hr2 := readHttpResource(t, ds, hr.hashedUrl)
+	if !reflect.DeepEqual(hr, hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+	}
+	if rw, err = ds.TryRefresh(hr.hashedUrl); err != nil || rw == nil {
+		t.Errorf("Expected the resource to be refreshed again. got = %v, %v", rw, err)
+	}
+}
+
+func TestRefusedFailure(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+	if err = rw.Fail(fmt.Errorf("%w: video/mp4", ErrRefused), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to record failure: %v", err)
+	}
+	failure, err := ds.Failure(hr.hashedUrl)
+	if err != nil || failure == nil || !failure.Refused {
+		t.Errorf("Expected refusal to be recorded. got = %v, %v", failure, err)
+	}
+	if stats, err := ds.FailureStats(); err != nil || stats != (FailureStats{Failed: 1, Refused: 1}) {
+		t.Errorf("Wrong failure stats. got = %+v, %v", stats, err)
+	}
+
+	// The flag follows refresh failures too, and is cleared once a refresh
+	// succeeds.
+	createHttpResource(t, &ds, hr)
+	rw, err = ds.TryRefresh(hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to start refresh: %v", err)
+	}
+	if err = rw.Fail(fmt.Errorf("%w: video/mp4", ErrRefused), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to record refresh failure: %v", err)
+	}
+	progress, err := ds.Progress(hr.hashedUrl)
+	if err != nil || progress.RefreshFailure == nil || !progress.RefreshFailure.Refused {
+		t.Errorf("Expected refresh refusal to be recorded. got = %v, %v", progress, err)
+	}
+	if stats, err := ds.FailureStats(); err != nil || stats != (FailureStats{RefreshFailed: 1}) {
+		t.Errorf("Wrong failure stats. got = %+v, %v", stats, err)
+	}
+	rw, err = ds.TryRefresh(hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to start refresh: %v", err)
+	}
+	if err = rw.NotModified(); err != nil {
+		t.Fatalf("Failed to end refresh: %v", err)
+	}
+	if progress, err = ds.Progress(hr.hashedUrl); err != nil || progress.RefreshFailure != nil {
+		t.Errorf("Expected refresh failure to be cleared. got = %v, %v", progress, err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	progress, err := ds.Progress(hr.hashedUrl)
+	if err != nil || progress.Status != ResourceNotCached {
+		t.Fatalf("Wrong progress for missing resource. got = %v, %v", progress, err)
+	}
+
+	rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+	progress, err = ds.Progress(hr.hashedUrl)
+	if err != nil || progress.Status != ResourceDownloading || progress.Url != hr.resourceUrl {
+		t.Fatalf("Wrong progress for downloading resource. got = %v, %v", progress, err)
+	}
+
+	// Force the next write to publish its progress.
+	rw.(*FileResourceWriter).lastProgressUpdate = time.Time{}
+	if _, err = rw.Write(hr.content); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	progress, err = ds.Progress(hr.hashedUrl)
+	if err != nil || progress.RawBytes != len(hr.content) {
+		t.Fatalf("Wrong progress after write. got = %v, %v, want %d bytes", progress, err, len(hr.content))
+	}
+
+	if err = rw.WriteProtocol("HTTP/2.0"); err != nil {
+		t.Fatalf("Failed to write protocol: %v", err)
+	}
+	if err = rw.WriteContentEncoding("br"); err != nil {
+		t.Fatalf("Failed to write content encoding: %v", err)
+	}
+	if err = rw.WriteStatusCode(404); err != nil {
+		t.Fatalf("Failed to write status code: %v", err)
+	}
+	if err = rw.WriteHeaders(&hr.headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	filtered := http.Header{"Date": []string{"Mon, 02 Jan 2006 15:04:05 GMT"}}
+	if err = rw.WriteFilteredHeaders(&filtered); err != nil {
+		t.Fatalf("Failed to write filtered headers: %v", err)
+	}
+	request := http.Header{"Accept-Language": []string{"de-DE"}, "User-Agent": []string{"test"}}
+	if err = rw.WriteRequestHeaders(&request); err != nil {
+		t.Fatalf("Failed to write request headers: %v", err)
+	}
+	if err = rw.WriteCaptureOptions(`{"depth":1}`); err != nil {
+		t.Fatalf("Failed to write capture options: %v", err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource: %v", err)
+	}
+	if stored, gotFiltered, err := ds.StoredHeaders(hr.hashedUrl); err != nil || !reflect.DeepEqual(*stored, hr.headers) || !reflect.DeepEqual(*gotFiltered, filtered) {
+		t.Errorf("Wrong stored headers. got = %v, %v, %v, want = %v, %v", stored, gotFiltered, err, hr.headers, filtered)
+	}
+	if _, _, err := ds.StoredHeaders("missing"); err != ErrResourceNotCached {
+		t.Errorf("Expected missing resource to have no headers. got = %v", err)
+	}
+	if got, err := ds.RequestHeaders(hr.hashedUrl); err != nil || !reflect.DeepEqual(*got, request) {
+		t.Errorf("Wrong request headers. got = %v, %v, want = %v", got, err, request)
+	}
+	if _, err := ds.RequestHeaders("missing"); err != ErrResourceNotCached {
+		t.Errorf("Expected missing resource to have no request headers. got = %v", err)
+	}
+	if info, err := ds.Stat(hr.hashedUrl); err != nil || info.CaptureOptions() != `{"depth":1}` {
+		t.Errorf("Wrong capture options. got = %v, %v", info, err)
+	}
+	progress, err = ds.Progress(hr.hashedUrl)
+	if err != nil || progress.Status != ResourceCached || progress.RawBytes != len(hr.content) || progress.Protocol != "HTTP/2.0" || progress.ContentEncoding != "br" || progress.CaptureOptions != `{"depth":1}` {
+		t.Fatalf("Wrong progress for cached resource. got = %v, %v", progress, err)
+	}
+	ri, err := ds.ListAfter("", 1, ListFilter{})
+	if err != nil || !ri.HasNext() {
+		t.Fatalf("Failed to list resources: %v", err)
+	}
+	if metadata, err := ri.Next(); err != nil || metadata.StatusCode != 404 {
+		t.Errorf("Wrong status code. got = %v, %v, want = 404", metadata.StatusCode, err)
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+	if err = rw.WriteHeaders(&hr.headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	half := len(hr.content) / 2
+	if _, err = rw.Write(hr.content[:half]); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Checkpoint("\"etag\""); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	// Simulate a connection that drops partway through the second half.
+	if _, err = rw.Write([]byte("garbage that must not survive")); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	rawBytes, validator, err := rw.Resume()
+	if err != nil {
+		t.Fatalf("Failed to resume: %v", err)
+	}
+	if rawBytes != half || validator != "\"etag\"" {
+		t.Fatalf("Wrong resume point. got = (%d, %s), want = (%d, %s)", rawBytes, validator, half, "\"etag\"")
+	}
+	if _, err = rw.Write(hr.content[half:]); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource: %v", err)
+	}
+	hr2 := readHttpResource(t, ds, hr.hashedUrl)
+	if !reflect.DeepEqual(hr, hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+	}
+}
+
+func TestAbandonedDownloadTakeover(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	dbPath := path.Join(datastoreRoot, "knox.db")
+	ds1, err := NewFileDatastore(dbPath, datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	ds2, err := NewFileDatastore(dbPath, datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	ds1.leaseDuration = 100 * time.Millisecond
+	ds2.leaseDuration = 100 * time.Millisecond
+
+	hr := randomHttpResource(r)
+	rw1, err := ds1.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw1 == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+	if err = rw1.WriteHeaders(&hr.headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	if rw, err := ds2.TryCreate(hr.resourceUrl, hr.hashedUrl); err != nil || rw != nil {
+		t.Fatalf("Expected live download not to be taken over. got = %v, %v", rw, err)
+	}
+
+	// Simulate the owner dying without releasing its lease.
+	rw1.(*FileResourceWriter).stopHeartbeating()
+	time.Sleep(3 * ds1.leaseDuration)
+
+	if _, err = ds2.Open(hr.hashedUrl); !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("Expected Open to report expired lease but got: %v", err)
+	}
+	rw2, err := ds2.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw2 == nil {
+		t.Fatalf("Failed to take over download: %v, %v", rw2, err)
+	}
+	rawBytes, _, err := rw2.Resume()
+	if err != nil || rawBytes != 0 {
+		t.Fatalf("Wrong resume point. got = %d, %v", rawBytes, err)
+	}
+	if _, err = io.Copy(rw2, bytes.NewReader(hr.content)); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw2.Close(); err != nil {
+		t.Fatalf("Failed to close resource: %v", err)
+	}
+
+	if err = rw1.Close(); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected original owner to have lost its lease but got: %v", err)
+	}
+
+	// Headers written by the original owner survive the takeover.
+	hr2 := readHttpResource(t, ds1, hr.hashedUrl)
+	if !reflect.DeepEqual(hr, hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+	}
+}
+
+func TestLeaseRenewalFailure(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	ds.leaseDuration = 100 * time.Millisecond
+	hr := randomHttpResource(r)
+	rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+
+	// Every renewal fails from here on, so the lease must be assumed lost
+	// once it could have expired.
+	ds.Close()
+	time.Sleep(3 * ds.leaseDuration)
+	if _, err = rw.Write(hr.content); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected Write to report lost lease but got: %v", err)
+	}
+	if err = rw.Checkpoint(""); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected Checkpoint to report lost lease but got: %v", err)
+	}
+	if err = rw.Fail(fmt.Errorf("connection refused"), time.Now()); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected Fail to report lost lease but got: %v", err)
+	}
+	// Closing after failing must not panic.
+	if err = rw.Close(); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected Close to report lost lease but got: %v", err)
+	}
+}
+
+func TestSqliteOptions(t *testing.T) {
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	opts := DefaultSqliteOptions()
+	opts.BusyTimeout = 1234 * time.Millisecond
+	ds, err := NewFileDatastoreWithOptions(path.Join(datastoreRoot, "knox.db"), datastoreRoot, opts)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	var journalMode string
+	if result := ds.db.Raw("PRAGMA journal_mode").Scan(&journalMode); result.Error != nil {
+		t.Fatalf("Failed to query journal mode: %v", result.Error)
+	}
+	if journalMode != "wal" {
+		t.Errorf("Wrong journal mode. got = %s, want = %s", journalMode, "wal")
+	}
+	var busyTimeout int
+	if result := ds.db.Raw("PRAGMA busy_timeout").Scan(&busyTimeout); result.Error != nil {
+		t.Fatalf("Failed to query busy timeout: %v", result.Error)
+	}
+	if busyTimeout != 1234 {
+		t.Errorf("Wrong busy timeout. got = %d, want = %d", busyTimeout, 1234)
+	}
+}
+
+func TestStats(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	dbPath := path.Join(datastoreRoot, "knox.db")
+	ds, err := NewFileDatastore(dbPath, datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	for i := 0; i < 8; i += 1 {
+		createHttpResource(t, &ds, randomHttpResource(r))
+	}
+	hr := randomHttpResource(r)
+	rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+	if err = rw.Fail(fmt.Errorf("connection refused"), time.Now()); err != nil {
+		t.Fatalf("Failed to record failure: %v", err)
+	}
+
+	var wantCount int64
+	ds.db.Model(&resourceMetadata{}).Count(&wantCount)
+	var wantBytes int
+	ds.db.Model(&resourceMetadata{}).Select("sum(bytes_on_disk)").Scan(&wantBytes)
+	want := ResourceStats{wantCount, wantBytes, 0, 0}
+	if wantCount != 8 {
+		t.Fatalf("Wrong number of records. got = %d, want = %d", wantCount, 8)
+	}
+
+	stats, err := ds.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if stats != want {
+		t.Errorf("Wrong stats. got = %v, want = %v", stats, want)
+	}
+
+	// Totals are recomputed for a db that doesn't have them.
+	ds.db.Delete(&globalStats{}, globalStatsId)
+	ds, err = NewFileDatastore(dbPath, datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	if stats, err = ds.Stats(); err != nil || stats != want {
+		t.Errorf("Wrong recomputed stats. got = %v, %v, want = %v", stats, err, want)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	createHttpResource(t, &ds, hr)
+	downloading := randomHttpResource(r)
+	if rw, err := ds.TryCreate(downloading.resourceUrl, downloading.hashedUrl); err != nil || rw == nil {
+		t.Fatalf("Failed to create resource: %v", err)
+	}
+
+	if err := ds.Delete(downloading.hashedUrl); err != ErrResourceBusy {
+		t.Errorf("Expected in-progress download to be busy. got = %v", err)
+	}
+	if err := ds.Delete(hr.hashedUrl); err != nil {
+		t.Fatalf("Failed to delete resource: %v", err)
+	}
+	if status, err := ds.Status(hr.hashedUrl); err != nil || status != ResourceNotCached {
+		t.Errorf("Expected deleted resource to be gone. got = %v, %v", status, err)
+	}
+	if err := ds.Delete(hr.hashedUrl); err != ErrResourceNotCached {
+		t.Errorf("Expected nothing left to delete. got = %v", err)
+	}
+	stats, err := ds.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	// Only the stub of the in-progress download is left.
+	if stats.RecordCount != 1 || stats.DiskConsumptionBytes != 0 {
+		t.Errorf("Wrong stats after delete. got = %v", stats)
+	}
+
+	// The resource can be cached again.
+	createHttpResource(t, &ds, hr)
+}
+
+func TestRecordAccess(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	createHttpResource(t, &ds, hr)
+	for _, hit := range []bool{false, true, true} {
+		if err := ds.RecordAccess(hr.hashedUrl, hit); err != nil {
+			t.Fatalf("Failed to record access: %v", err)
+		}
+	}
+	// Nothing is written until the accesses are flushed.
+	stats, err := ds.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("Expected unflushed accesses to be left out. got = (%d, %d)", stats.Hits, stats.Misses)
+	}
+	if err := ds.FlushAccesses(); err != nil {
+		t.Fatalf("Failed to flush accesses: %v", err)
+	}
+	stats, err = ds.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("Wrong hit counts. got = (%d, %d), want = (%d, %d)", stats.Hits, stats.Misses, 2, 1)
+	}
+	ri, err := ds.List(0, 1)
+	if err != nil || !ri.HasNext() {
+		t.Fatalf("Failed to list resources: %v", err)
+	}
+	metadata, err := ri.Next()
+	if err != nil {
+		t.Fatalf("Failed to list resource: %v", err)
+	}
+	if metadata.AccessCount != 3 || metadata.LastAccessed.IsZero() {
+		t.Errorf("Wrong access info. got = (%d, %v)", metadata.AccessCount, metadata.LastAccessed)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	if rw, err := ds.TryRefresh(hr.hashedUrl); err != nil || rw != nil {
+		t.Fatalf("Expected nothing to refresh for a missing resource. got = %v, %v", rw, err)
+	}
+	createHttpResource(t, &ds, hr)
+	oldReader, err := ds.Open(hr.hashedUrl)
+	if err != nil {
+		t.Fatalf("Failed to open resource %s: %v", hr.hashedUrl, err)
+	}
+	defer oldReader.Close()
+
+	refreshed := randomHttpResource(r)
+	refreshed.hashedUrl = hr.hashedUrl
+	refreshed.resourceUrl = hr.resourceUrl
+	rw, err := ds.TryRefresh(hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to refresh resource %v: %v", hr, err)
+	}
+	if rw2, err := ds.TryRefresh(hr.hashedUrl); err != nil || rw2 != nil {
+		t.Fatalf("Expected only one refresh at a time. got = %v, %v", rw2, err)
+	}
+	if err = rw.WriteHeaders(&refreshed.headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	request := http.Header{"Accept-Language": []string{"fr"}}
+	if err = rw.WriteRequestHeaders(&request); err != nil {
+		t.Fatalf("Failed to write request headers: %v", err)
+	}
+	if _, err = rw.Write(refreshed.content); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+
+	// The old contents are served until the refresh completes.
+	if hr2 := readHttpResource(t, ds, hr.hashedUrl); !reflect.DeepEqual(hr, hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+	}
+	if got, err := ds.RequestHeaders(hr.hashedUrl); err != nil || len(*got) != 0 {
+		t.Errorf("Expected no request headers before the refresh completes. got = %v, %v", got, err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource: %v", err)
+	}
+	if hr2 := readHttpResource(t, ds, hr.hashedUrl); !reflect.DeepEqual(refreshed, hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", refreshed, hr2)
+	}
+	if got, err := ds.RequestHeaders(hr.hashedUrl); err != nil || !reflect.DeepEqual(*got, request) {
+		t.Errorf("Wrong request headers after the refresh. got = %v, %v, want = %v", got, err, request)
+	}
+
+	// Readers that opened the resource before it was replaced aren't cut off.
+	oldContent, err := ioutil.ReadAll(oldReader)
+	if err != nil || !bytes.Equal(oldContent, hr.content) {
+		t.Errorf("Wrong content for old reader. got = %q, %v, want = %q", oldContent, err, hr.content)
+	}
+
+	var wantBytes int
+	ds.db.Model(&resourceMetadata{}).Select("sum(bytes_on_disk)").Scan(&wantBytes)
+	if stats, err := ds.Stats(); err != nil || stats.RecordCount != 1 || stats.DiskConsumptionBytes != wantBytes {
+		t.Errorf("Wrong stats. got = %v, %v, want %d records and %d bytes", stats, err, 1, wantBytes)
+	}
+
+	// A failed refresh leaves the resource as it was.
+	if rw, err = ds.TryRefresh(hr.hashedUrl); err != nil || rw == nil {
+		t.Fatalf("Failed to refresh resource %v: %v", hr, err)
+	}
+	if err = rw.Fail(fmt.Errorf("connection refused"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to record failure: %v", err)
+	}
+	if failure, err := ds.Failure(hr.hashedUrl); err != nil || failure != nil {
+		t.Errorf("Expected no failure to be recorded. got = %v, %v", failure, err)
+	}
+	if hr2 := readHttpResource(t, ds, hr.hashedUrl); !reflect.DeepEqual(refreshed, hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", refreshed, hr2)
+	}
+	progress, err := ds.Progress(hr.hashedUrl)
+	if err != nil || progress.Status != ResourceCached || progress.RefreshFailure == nil || progress.RefreshFailure.Reason != "connection refused" {
+		t.Errorf("Expected refresh failure to be recorded. got = %v, %v", progress, err)
+	}
+
+	// A successful refresh clears it.
+	if rw, err = ds.TryRefresh(hr.hashedUrl); err != nil || rw == nil {
+		t.Fatalf("Failed to refresh resource %v: %v", hr, err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource: %v", err)
+	}
+	if progress, err = ds.Progress(hr.hashedUrl); err != nil || progress.RefreshFailure != nil {
+		t.Errorf("Expected refresh failure to be cleared. got = %v, %v", progress.RefreshFailure, err)
+	}
+}
+
+func TestRefreshNotModified(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	createHttpResource(t, &ds, hr)
+	before, err := ds.Progress(hr.hashedUrl)
+	if err != nil {
+		t.Fatalf("Failed to get progress: %v", err)
+	}
+
+	rw, err := ds.TryRefresh(hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to refresh resource %v: %v", hr, err)
+	}
+	if err := rw.NotModified(); err != nil {
+		t.Fatalf("Failed to end refresh: %v", err)
+	}
+	if hr2 := readHttpResource(t, ds, hr.hashedUrl); !reflect.DeepEqual(hr, hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+	}
+	after, err := ds.Progress(hr.hashedUrl)
+	if err != nil {
+		t.Fatalf("Failed to get progress: %v", err)
+	}
+	if !after.DownloadStarted.After(before.DownloadStarted) {
+		t.Errorf("Expected download start to move forward. got = %v, was %v", after.DownloadStarted, before.DownloadStarted)
+	}
+	// The lease is given up.
+	if rw, err := ds.TryRefresh(hr.hashedUrl); err != nil || rw == nil {
+		t.Fatalf("Failed to refresh resource again: %v", err)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	same := randomHttpResource(r)
+	same.content = hr.content
+	different := randomHttpResource(r)
+	hashes := map[string]string{}
+	for _, resource := range []HttpResource{hr, same, different} {
+		createHttpResource(t, &ds, resource)
+		rr, err := ds.Open(resource.hashedUrl)
+		if err != nil {
+			t.Fatalf("Failed to open resource %s: %v", resource.hashedUrl, err)
+		}
+		if rr.ContentHash() == "" || rr.CapturedAt().IsZero() {
+			t.Errorf("Missing content hash or capture time. got = %q, %v", rr.ContentHash(), rr.CapturedAt())
+		}
+		hashes[resource.hashedUrl] = rr.ContentHash()
+		rr.Close()
+	}
+	if hashes[hr.hashedUrl] != hashes[same.hashedUrl] {
+		t.Errorf("Expected identical content to have the same hash. got = %s, %s", hashes[hr.hashedUrl], hashes[same.hashedUrl])
+	}
+	if hashes[hr.hashedUrl] == hashes[different.hashedUrl] {
+		t.Errorf("Expected different content to have different hashes. got = %s", hashes[hr.hashedUrl])
+	}
+}
+
+func TestStat(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+	rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+	if err = rw.WriteHeaders(&hr.headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	if _, err = rw.Write(hr.content); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	// Doesn't wait for the download.
+	if _, err := ds.Stat(hr.hashedUrl); !errors.Is(err, ErrResourceNotCached) {
+		t.Errorf("Expected a resource being downloaded not to be cached. got = %v", err)
+	}
+	filePath := rw.(*FileResourceWriter).filepath()
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource: %v", err)
+	}
+
+	// The body isn't needed.
+	if err := os.Remove(filePath); err != nil {
+		t.Fatalf("%v", err)
+	}
+	info, err := ds.Stat(hr.hashedUrl)
+	if err != nil {
+		t.Fatalf("Failed to stat resource: %v", err)
+	}
+	if info.ResourceURL() != hr.resourceUrl || info.RawBytes() != len(hr.content) || info.ContentHash() == "" || !reflect.DeepEqual(*info.Headers(), hr.headers) {
+		t.Errorf("Wrong info. got = %s, %d, %q, %v", info.ResourceURL(), info.RawBytes(), info.ContentHash(), info.Headers())
+	}
+}
+
+func TestGzipped(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	single := randomHttpResource(r)
+	single.content = bytes.Repeat([]byte("compressible "), 4096)
+	createHttpResource(t, &ds, single)
+
+	rr, err := ds.Open(single.hashedUrl)
+	if err != nil {
+		t.Fatalf("Failed to open resource: %v", err)
+	}
+	// Reading some of the body first doesn't matter.
+	if _, err := rr.Read(make([]byte, 16)); err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	gzipped, size, ok := rr.Gzipped()
+	if !ok {
+		t.Fatalf("Expected a single gzip member to be available.")
+	}
+	stored, err := ioutil.ReadAll(gzipped)
+	if err != nil || int64(len(stored)) != size || size >= int64(len(single.content)) {
+		t.Fatalf("Wrong stored body. got = %d bytes of %d, %v", len(stored), size, err)
+	}
+	rr.Close()
+	g, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	g.Multistream(false)
+	if content, err := ioutil.ReadAll(g); err != nil || !bytes.Equal(content, single.content) {
+		t.Errorf("Expected the first gzip member to hold the whole body. got = %d bytes, %v", len(content), err)
+	}
+
+	// Each checkpoint starts another member.
+	multi := randomHttpResource(r)
+	multi.content = single.content
+	rw, err := ds.TryCreate(multi.resourceUrl, multi.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", multi, err)
+	}
+	if err = rw.WriteHeaders(&multi.headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	half := len(multi.content) / 2
+	if _, err = rw.Write(multi.content[:half]); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Checkpoint(""); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if _, err = rw.Write(multi.content[half:]); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource: %v", err)
+	}
+
+	// Nor is a body that compression made no smaller.
+	incompressible := randomHttpResource(r)
+	incompressible.content = make([]byte, 4096)
+	r.Read(incompressible.content)
+	createHttpResource(t, &ds, incompressible)
+
+	for _, hr := range []HttpResource{multi, incompressible} {
+		rr, err := ds.Open(hr.hashedUrl)
+		if err != nil {
+			t.Fatalf("Failed to open resource: %v", err)
+		}
+		if _, _, ok := rr.Gzipped(); ok {
+			t.Errorf("Expected no stored gzip body for %s.", hr.resourceUrl)
+		}
+		rr.Close()
+	}
+	if got := readHttpResource(t, ds, multi.hashedUrl); !bytes.Equal(got.content, multi.content) {
+		t.Errorf("Wrong body after a checkpoint.")
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	compressed := randomHttpResource(r)
+	compressed.content = bytes.Repeat([]byte("a"), 64*1024)
+	createHttpResource(t, &ds, compressed)
+
+	// Stored without compression, except for the half after the checkpoint.
+	stored := randomHttpResource(r)
+	stored.content = compressed.content
+	rw, err := ds.TryCreate(stored.resourceUrl, stored.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", stored, err)
+	}
+	if err = rw.WriteHeaders(&stored.headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	if err = rw.SetCompressionLevel(gzip.NoCompression); err != nil {
+		t.Fatalf("Failed to set compression level: %v", err)
+	}
+	half := len(stored.content) / 2
+	if _, err = rw.Write(stored.content[:half]); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Checkpoint("\"etag\""); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if err = rw.SetCompressionLevel(gzip.BestCompression); err != nil {
+		t.Fatalf("Failed to set compression level: %v", err)
+	}
+	if _, err = rw.Write(stored.content[half:]); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource: %v", err)
+	}
+	if got := readHttpResource(t, ds, stored.hashedUrl); !reflect.DeepEqual(stored, got) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", stored, got)
+	}
+
+	bytesOnDisk := map[string]int{}
+	ri, err := ds.List(0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list resources: %v", err)
+	}
+	for ri.HasNext() {
+		rm, err := ri.Next()
+		if err != nil {
+			t.Fatalf("Failed to list resources: %v", err)
+		}
+		bytesOnDisk[rm.Url] = rm.BytesOnDisk
+	}
+	if got := bytesOnDisk[compressed.resourceUrl]; got > 1024 {
+		t.Errorf("Expected the default level to compress the body. got = %d bytes on disk", got)
+	}
+	if got := bytesOnDisk[stored.resourceUrl]; got < half {
+		t.Errorf("Expected half the body to be stored uncompressed. got = %d bytes on disk", got)
+	}
+}
+
+// Returns the URLs and cursors of a page of resources listed by list.
+func listPage(t *testing.T, list func(cursor string, count int, filter ListFilter) (ResourceIterator, error), cursor string, count int, filter ListFilter) ([]string, []string) {
+	ri, err := list(cursor, count, filter)
+	if err != nil {
+		t.Fatalf("Failed to list resources: %v", err)
+	}
+	var urls, cursors []string
+	for ri.HasNext() {
+		metadata, err := ri.Next()
+		if err != nil {
+			t.Fatalf("Failed to list resource: %v", err)
+		}
+		urls = append(urls, metadata.Url)
+		cursors = append(cursors, metadata.Cursor)
+	}
+	return urls, cursors
+}
+
+func TestListCursor(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	var hrs []HttpResource
+	for i := 0; i < 5; i += 1 {
+		hr := randomHttpResource(r)
+		createHttpResource(t, &ds, hr)
+		hrs = append(hrs, hr)
+	}
+	// Resources that started at the same time are ordered by id.
+	ds.db.Model(&resourceMetadata{}).Where("id IN ?", []int{2, 3}).Update("download_started", time.Now())
+	want := []string{hrs[2].resourceUrl, hrs[1].resourceUrl, hrs[4].resourceUrl, hrs[3].resourceUrl, hrs[0].resourceUrl}
+
+	first, firstCursors := listPage(t, ds.ListAfter, "", 2, ListFilter{})
+	if !reflect.DeepEqual(first, want[:2]) {
+		t.Errorf("Wrong first page. got = %v, want = %v", first, want[:2])
+	}
+	// Resources added in the meantime don't shift the next page.
+	createHttpResource(t, &ds, randomHttpResource(r))
+	second, secondCursors := listPage(t, ds.ListAfter, firstCursors[1], 2, ListFilter{})
+	if !reflect.DeepEqual(second, want[2:4]) {
+		t.Errorf("Wrong second page. got = %v, want = %v", second, want[2:4])
+	}
+	third, _ := listPage(t, ds.ListAfter, secondCursors[1], 2, ListFilter{})
+	if !reflect.DeepEqual(third, want[4:]) {
+		t.Errorf("Wrong third page. got = %v, want = %v", third, want[4:])
+	}
+	back, _ := listPage(t, ds.ListBefore, secondCursors[0], 2, ListFilter{})
+	if !reflect.DeepEqual(back, want[:2]) {
+		t.Errorf("Wrong page before the second. got = %v, want = %v", back, want[:2])
+	}
+	if _, err := ds.ListAfter("bogus", 2, ListFilter{}); !errors.Is(err, ErrBadCursor) {
+		t.Errorf("Expected a bad cursor to be rejected. got = %v", err)
+	}
+}
+
+func TestListFilter(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	resources := []struct {
+		contentType string
+		statusCode  int
+		host        string
+	}{
+		{"text/html; charset=utf-8", 200, "blog.example"},
+		{"image/png", 200, "cdn.example"},
+		{"image/jpeg", 404, "Blog.example"},
+		{"", 200, "cdn.example"},
+	}
+	var hrs []HttpResource
+	for _, resource := range resources {
+		hr := randomHttpResource(r)
+		hr.resourceUrl = fmt.Sprintf("https://%s/%s", resource.host, hr.resourceUrl)
+		hr.headers = http.Header{}
+		if resource.contentType != "" {
+			hr.headers.Set("Content-Type", resource.contentType)
+		}
+		rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+		if err != nil || rw == nil {
+			t.Fatalf("Failed to create resource %v: %v", hr, err)
+		}
+		rw.WriteHeaders(&hr.headers)
+		rw.WriteStatusCode(resource.statusCode)
+		if err := rw.Close(); err != nil {
+			t.Fatalf("Failed to close resource: %v", err)
+		}
+		hrs = append(hrs, hr)
+	}
+	for _, test := range []struct {
+		filter ListFilter
+		want   []string
+	}{
+		{ListFilter{ContentType: "text/HTML"}, []string{hrs[0].resourceUrl}},
+		{ListFilter{ContentType: "image/*"}, []string{hrs[2].resourceUrl, hrs[1].resourceUrl}},
+		{ListFilter{ContentType: "image/*", StatusCode: 200}, []string{hrs[1].resourceUrl}},
+		{ListFilter{StatusCode: 200}, []string{hrs[3].resourceUrl, hrs[1].resourceUrl, hrs[0].resourceUrl}},
+		{ListFilter{Host: "BLOG.example"}, []string{hrs[2].resourceUrl, hrs[0].resourceUrl}},
+		{ListFilter{Host: "cdn.example", ContentType: "image/*"}, []string{hrs[1].resourceUrl}},
+	} {
+		if got, _ := listPage(t, ds.ListAfter, "", 10, test.filter); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Wrong resources for %+v. got = %v, want = %v", test.filter, got, test.want)
+		}
+	}
+	// Cursors apply along with the filter.
+	_, cursors := listPage(t, ds.ListAfter, "", 1, ListFilter{ContentType: "image/*"})
+	if got, _ := listPage(t, ds.ListAfter, cursors[0], 10, ListFilter{ContentType: "image/*"}); !reflect.DeepEqual(got, []string{hrs[1].resourceUrl}) {
+		t.Errorf("Wrong second page of images. got = %v", got)
+	}
+}
@@ -0,0 +1,13 @@
+package datastore
+
+import "syscall"
+
+// Returns how many bytes are free for knox to write on the filesystem the
+// bodies of resources are written to.
+func (ds FileDatastore) FreeBytes() (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(ds.rootPath, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
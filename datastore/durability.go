@@ -0,0 +1,82 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+)
+
+// How far the datastore goes to make sure the body of a resource is on disk
+// before marking the resource complete.
+type Durability string
+
+const (
+	// Leaves writing bodies out to the operating system, so a power loss
+	// can leave a complete resource with a truncated body.
+	DurabilityNone Durability = "none"
+	// Fsyncs each body before its resource is marked complete.
+	DurabilityFsync Durability = "fsync"
+	// Also writes each body under a temporary name and only renames it into
+	// place once it has been fsynced, so nothing at a body's path is ever
+	// half written.
+	DurabilityAtomic Durability = "atomic"
+)
+
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(s); d {
+	case DurabilityNone, DurabilityFsync, DurabilityAtomic:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown durability %q", s)
+}
+
+// Returns a copy of ds that writes bodies with durability d.
+func (ds FileDatastore) WithDurability(d Durability) FileDatastore {
+	ds.durability = d
+	return ds
+}
+
+func (d Durability) syncs() bool {
+	return d == DurabilityFsync || d == DurabilityAtomic
+}
+
+// Where the body at finalPath is written until it is complete.
+func partialFilepath(finalPath string) string {
+	return finalPath + ".partial"
+}
+
+func (ds FileDatastore) writePath(finalPath string) string {
+	if ds.durability == DurabilityAtomic {
+		return partialFilepath(finalPath)
+	}
+	return finalPath
+}
+
+// Returns where an abandoned download of the body at finalPath was being
+// written, which depends on the durability of the instance that started it.
+func (ds FileDatastore) abandonedWritePath(finalPath string) string {
+	path := ds.writePath(finalPath)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return path
+	}
+	other := partialFilepath(finalPath)
+	if other == path {
+		other = finalPath
+	}
+	if _, err := os.Stat(other); err == nil {
+		return other
+	}
+	return path
+}
+
+// Fsyncs the directory at dirPath so that files renamed into it stay there.
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDurability(t *testing.T) {
+	for _, s := range []string{"none", "fsync", "atomic"} {
+		if d, err := ParseDurability(s); err != nil || string(d) != s {
+			t.Errorf("Failed to parse %s: %v, %v", s, d, err)
+		}
+	}
+	if _, err := ParseDurability("sometimes"); err == nil {
+		t.Errorf("Expected an unknown durability to be refused.")
+	}
+}
+
+func TestAtomicDurability(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	ds = ds.WithDurability(DurabilityAtomic)
+	hr := randomHttpResource(r)
+	rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+	if err = rw.WriteHeaders(&hr.headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	if _, err = rw.Write(hr.content); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	finalPath := rw.(*FileResourceWriter).filepath()
+	if _, err := os.Stat(finalPath); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing at %s before the body is complete. got = %v", finalPath, err)
+	}
+	if _, err := os.Stat(partialFilepath(finalPath)); err != nil {
+		t.Errorf("Expected the body to be written to its partial file: %v", err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource: %v", err)
+	}
+	if _, err := os.Stat(partialFilepath(finalPath)); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial file to have been renamed. got = %v", err)
+	}
+	if hr2 := readHttpResource(t, ds, hr.hashedUrl); !reflect.DeepEqual(hr, hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+	}
+
+	// A failed download leaves nothing behind.
+	hr = randomHttpResource(r)
+	rw, err = ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", hr, err)
+	}
+	failedPath := rw.(*FileResourceWriter).filepath()
+	if err = rw.Fail(errors.New("connection reset"), time.Now()); err != nil {
+		t.Fatalf("Failed to fail resource: %v", err)
+	}
+	for _, p := range []string{failedPath, partialFilepath(failedPath)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed. got = %v", p, err)
+		}
+	}
+}
+
+// A download started without atomic durability can be taken over by an
+// instance with it and the other way around.
+func TestTakeOverAcrossDurabilities(t *testing.T) {
+	for _, durabilities := range [][2]Durability{{DurabilityNone, DurabilityAtomic}, {DurabilityAtomic, DurabilityFsync}} {
+		r := rand.New(rand.NewSource(0))
+		datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+		if err != nil {
+			t.Fatalf("Failed to create test temp dir: %v", err)
+		}
+		dbPath := path.Join(datastoreRoot, "knox.db")
+		ds1, err := NewFileDatastore(dbPath, datastoreRoot)
+		if err != nil {
+			t.Fatalf("Failed to create FileDatastore: %v", err)
+		}
+		ds2, err := NewFileDatastore(dbPath, datastoreRoot)
+		if err != nil {
+			t.Fatalf("Failed to create FileDatastore: %v", err)
+		}
+		ds1 = ds1.WithDurability(durabilities[0])
+		ds2 = ds2.WithDurability(durabilities[1])
+		ds1.leaseDuration = 100 * time.Millisecond
+		ds2.leaseDuration = 100 * time.Millisecond
+
+		hr := randomHttpResource(r)
+		half := len(hr.content) / 2
+		rw1, err := ds1.TryCreate(hr.resourceUrl, hr.hashedUrl)
+		if err != nil || rw1 == nil {
+			t.Fatalf("Failed to create resource %v: %v", hr, err)
+		}
+		if err = rw1.WriteHeaders(&hr.headers); err != nil {
+			t.Fatalf("Failed to write headers: %v", err)
+		}
+		if _, err = rw1.Write(hr.content[:half]); err != nil {
+			t.Fatalf("Failed to write body: %v", err)
+		}
+		if err = rw1.Checkpoint(""); err != nil {
+			t.Fatalf("Failed to checkpoint: %v", err)
+		}
+		rw1.(*FileResourceWriter).stopHeartbeating()
+		time.Sleep(3 * ds1.leaseDuration)
+
+		rw2, err := ds2.TryCreate(hr.resourceUrl, hr.hashedUrl)
+		if err != nil || rw2 == nil {
+			t.Fatalf("Failed to take over download: %v, %v", rw2, err)
+		}
+		if rawBytes, _, err := rw2.Resume(); err != nil || rawBytes != half {
+			t.Fatalf("Wrong resume point. got = %d, %v", rawBytes, err)
+		}
+		if _, err = rw2.Write(hr.content[half:]); err != nil {
+			t.Fatalf("Failed to write body: %v", err)
+		}
+		if err = rw2.Close(); err != nil {
+			t.Fatalf("Failed to close resource: %v", err)
+		}
+		if hr2 := readHttpResource(t, ds2, hr.hashedUrl); !bytes.Equal(hr.content, hr2.content) {
+			t.Errorf("Wrong body after %s was taken over with %s durability.", durabilities[0], durabilities[1])
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package datastore
+
+import "time"
+
+// A resource that isn't cached because fetching it failed.
+type FailedResource struct {
+	HashedUrl string
+	FetchFailure
+}
+
+func (ds FileDatastore) RecordedFailure(hashedUrl string) (*FetchFailure, error) {
+	// Find, unlike First, doesn't log there being none as an error, and
+	// cachePage looks whenever a fetch fails.
+	var ffs []fetchFailure
+	result := ds.db.Where("hashed_url = ?", hashedUrl).Limit(1).Find(&ffs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if len(ffs) == 0 {
+		return nil, nil
+	}
+	return ffs[0].failure(), nil
+}
+
+func (ds FileDatastore) Failures(offset, count int) ([]FailedResource, error) {
+	var ffs []fetchFailure
+	result := ds.db.Order("failed_at DESC").Order("id").Offset(offset).Limit(count).Find(&ffs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return failedResources(ffs), nil
+}
+
+func (ds FileDatastore) DueFailures(maxAttempts, count int) ([]FailedResource, error) {
+	var ffs []fetchFailure
+	result := ds.db.Where("retry_after <= ? AND refused = ? AND attempts < ?", time.Now(), false, maxAttempts).
+		Order("retry_after").Order("id").Limit(count).Find(&ffs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return failedResources(ffs), nil
+}
+
+// Only failures that are still holding off fetches are changed, so that one
+// that expired a while ago keeps its place among the due ones.
+func (ds FileDatastore) ExpireFailure(hashedUrl string) error {
+	now := time.Now()
+	result := ds.db.Model(&fetchFailure{}).Where("hashed_url = ? AND retry_after > ?", hashedUrl, now).Update("retry_after", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 0 {
+		return nil
+	}
+	failure, err := ds.RecordedFailure(hashedUrl)
+	if err != nil {
+		return err
+	}
+	if failure == nil {
+		return ErrNoFailure
+	}
+	return nil
+}
+
+func failedResources(ffs []fetchFailure) []FailedResource {
+	failed := make([]FailedResource, 0, len(ffs))
+	for _, ff := range ffs {
+		failed = append(failed, FailedResource{ff.HashedUrl, *ff.failure()})
+	}
+	return failed
+}
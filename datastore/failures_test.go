@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFailures(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	fail := func(hr HttpResource, fetchErr error, retryAfter time.Time, options string) {
+		rw, err := ds.TryCreate(hr.resourceUrl, hr.hashedUrl)
+		if err != nil || rw == nil {
+			t.Fatalf("Failed to create resource %v: %v", hr, err)
+		}
+		if options != "" {
+			rw.WriteCaptureOptions(options)
+		}
+		if err = rw.Fail(fetchErr, retryAfter); err != nil {
+			t.Fatalf("Failed to record failure: %v", err)
+		}
+	}
+	hr := randomHttpResource(r)
+	refused := randomHttpResource(r)
+	if err := ds.ExpireFailure(hr.hashedUrl); !errors.Is(err, ErrNoFailure) {
+		t.Errorf("Expected no failure to expire. got = %v", err)
+	}
+
+	fail(hr, fmt.Errorf("connection refused"), time.Now(), `{"depth":1}`)
+	fail(refused, fmt.Errorf("%w: video/mp4", ErrRefused), time.Now(), "")
+	// Attempts are counted until a fetch succeeds, and the options of the
+	// latest one are kept.
+	fail(hr, fmt.Errorf("connection reset"), time.Now().Add(time.Hour), `{"depth":2}`)
+	failure, err := ds.RecordedFailure(hr.hashedUrl)
+	if err != nil || failure == nil || failure.Attempts != 2 || failure.Reason != "connection reset" || failure.CaptureOptions != `{"depth":2}` {
+		t.Errorf("Wrong recorded failure. got = %+v, %v", failure, err)
+	}
+	failed, err := ds.Failures(0, 10)
+	if err != nil || len(failed) != 2 || failed[0].HashedUrl != hr.hashedUrl || failed[1].HashedUrl != refused.hashedUrl {
+		t.Errorf("Wrong failures. got = %+v, %v", failed, err)
+	}
+	if due, err := ds.DueFailures(3, 10); err != nil || len(due) != 0 {
+		t.Errorf("Expected failures still holding off fetches and refusals not to be due. got = %+v, %v", due, err)
+	}
+
+	if err := ds.ExpireFailure(hr.hashedUrl); err != nil {
+		t.Fatalf("Failed to expire failure: %v", err)
+	}
+	if failure, err := ds.Failure(hr.hashedUrl); err != nil || failure != nil {
+		t.Errorf("Expected the failure to have expired. got = %+v, %v", failure, err)
+	}
+	if due, err := ds.DueFailures(3, 10); err != nil || len(due) != 1 || due[0].HashedUrl != hr.hashedUrl {
+		t.Errorf("Expected the expired failure to be due. got = %+v, %v", due, err)
+	}
+	if due, err := ds.DueFailures(2, 10); err != nil || len(due) != 0 {
+		t.Errorf("Expected failures with too many attempts not to be due. got = %+v, %v", due, err)
+	}
+
+	createHttpResource(t, &ds, hr)
+	if failure, err := ds.RecordedFailure(hr.hashedUrl); err != nil || failure != nil {
+		t.Errorf("Expected a successful fetch to clear the failure. got = %+v, %v", failure, err)
+	}
+	if failed, err := ds.Failures(0, 10); err != nil || len(failed) != 1 {
+		t.Errorf("Wrong failures. got = %+v, %v", failed, err)
+	}
+}
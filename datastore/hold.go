@@ -0,0 +1,23 @@
+package datastore
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// Places a cached resource under legal hold, or releases it. A resource
+// still being downloaded can't be held, since a failed download removes it.
+func (ds FileDatastore) SetHold(hashedUrl string, held bool) error {
+	rm := resourceMetadata{}
+	result := ds.db.First(&rm, "hashed_url = ?", hashedUrl)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return ErrResourceNotCached
+	} else if result.Error != nil {
+		return result.Error
+	}
+	if !rm.DownloadComplete {
+		return ErrResourceBusy
+	}
+	return ds.db.Model(&resourceMetadata{}).Where("id = ?", rm.ID).Update("held", held).Error
+}
@@ -0,0 +1,46 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"testing"
+)
+
+func TestHold(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+
+	if err := ds.SetHold(hr.hashedUrl, true); !errors.Is(err, ErrResourceNotCached) {
+		t.Errorf("Expected resources that aren't cached not to be held. got = %v", err)
+	}
+	createHttpResource(t, &ds, hr)
+	if err := ds.SetHold(hr.hashedUrl, true); err != nil {
+		t.Fatalf("Failed to hold resource: %v", err)
+	}
+	if progress, err := ds.Progress(hr.hashedUrl); err != nil || !progress.Held {
+		t.Errorf("Expected the resource to be held. got = %v, %v", progress, err)
+	}
+	if err := ds.Delete(hr.hashedUrl); !errors.Is(err, ErrResourceHeld) {
+		t.Errorf("Expected a held resource not to be deleted. got = %v", err)
+	}
+	if rw, err := ds.TryRefresh(hr.hashedUrl); !errors.Is(err, ErrResourceHeld) || rw != nil {
+		t.Errorf("Expected a held resource not to be refreshed. got = %v, %v", rw, err)
+	}
+
+	if err := ds.SetHold(hr.hashedUrl, false); err != nil {
+		t.Fatalf("Failed to release resource: %v", err)
+	}
+	if err := ds.Delete(hr.hashedUrl); err != nil {
+		t.Errorf("Failed to delete released resource: %v", err)
+	}
+}
@@ -0,0 +1,571 @@
+package datastore
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type JobState string
+
+const (
+	JobQueued  JobState = "queued"
+	JobRunning JobState = "running"
+
+	// Put aside until it is resumed, with the items that were being dealt
+	// with queued again.
+	JobPaused JobState = "paused"
+
+	// Every item of the job was dealt with, successfully or not.
+	JobFinished JobState = "finished"
+
+	// The job itself went wrong, e.g. its items couldn't be listed.
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+type JobItemState string
+
+const (
+	JobItemQueued  JobItemState = "queued"
+	JobItemRunning JobItemState = "running"
+	JobItemDone    JobItemState = "done"
+
+	// There was nothing to do, e.g. because the resource was cached already.
+	JobItemSkipped JobItemState = "skipped"
+	JobItemFailed  JobItemState = "failed"
+
+	// The URL can't be fetched at all.
+	JobItemInvalid JobItemState = "invalid"
+
+	// The job ended before the item was dealt with.
+	JobItemCancelled JobItemState = "cancelled"
+)
+
+// Long-running work, like caching a batch of URLs or crawling a site, made up
+// of items that are each a URL. What a job does with its items is up to the
+// server, which describes it with Kind and Spec.
+type Job struct {
+	Id    uint
+	Kind  string
+	Spec  string
+	State JobState
+
+	// Why the job failed, if it did.
+	Error string
+
+	Created time.Time
+
+	// The job isn't started before then.
+	RunAt time.Time
+
+	// Zero until the job is first started, and until it ends.
+	Started  time.Time
+	Finished time.Time
+
+	// Whether the job is to be cancelled or paused, once whoever runs it
+	// notices.
+	CancelRequested bool
+	PauseRequested  bool
+
+	// How many of the job's items are in each state.
+	Items map[JobItemState]int
+
+	// How many bytes were downloaded for the job's items in all.
+	Bytes int
+}
+
+// Whether the job has ended, and won't change any more.
+func (j Job) Ended() bool {
+	return j.State == JobFinished || j.State == JobFailed || j.State == JobCancelled
+}
+
+// How many items the job has in all.
+func (j Job) TotalItems() int {
+	total := 0
+	for _, count := range j.Items {
+		total += count
+	}
+	return total
+}
+
+type JobItem struct {
+	Id        uint
+	Url       string
+	HashedUrl string
+
+	// How many links away from the job's first item the item was found,
+	// for jobs that follow links.
+	Depth int
+
+	State JobItemState
+
+	// What went wrong, for failed and invalid items, or why a skipped one
+	// was skipped if it wasn't cached already.
+	Error string
+
+	// How many bytes were downloaded for the item.
+	Bytes int
+}
+
+type JobLogEntry struct {
+	At      time.Time
+	Message string
+}
+
+type job struct {
+	gorm.Model
+
+	Kind  string
+	Spec  string
+	State string `gorm:"index"`
+	Error string
+
+	RunAt      time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	CancelRequested bool
+	PauseRequested  bool
+
+	// Who is running the job, like for resources being downloaded.
+	LeaseOwner  string
+	LeaseExpiry time.Time
+}
+
+type jobItem struct {
+	ID    uint `gorm:"primarykey"`
+	JobID uint `gorm:"index"`
+
+	Url       string
+	HashedUrl string
+	Depth     int
+	State     string
+	Error     string
+	Bytes     int
+}
+
+type jobLogEntry struct {
+	ID    uint `gorm:"primarykey"`
+	JobID uint `gorm:"index"`
+
+	At      time.Time
+	Message string
+}
+
+func (ds FileDatastore) CreateJob(kind string, spec string, runAt time.Time, items []JobItem) (Job, error) {
+	j := job{Kind: kind, Spec: spec, State: string(JobQueued), RunAt: runAt}
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Create(&j); result.Error != nil {
+			return result.Error
+		}
+		return createJobItems(tx, j.ID, items)
+	})
+	if err != nil {
+		return Job{}, err
+	}
+	return ds.Job(j.ID)
+}
+
+func createJobItems(tx *gorm.DB, jobId uint, items []JobItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	rows := make([]jobItem, 0, len(items))
+	for _, item := range items {
+		state := item.State
+		if state == "" {
+			state = JobItemQueued
+		}
+		rows = append(rows, jobItem{JobID: jobId, Url: item.Url, HashedUrl: item.HashedUrl, Depth: item.Depth, State: string(state), Error: item.Error})
+	}
+	// SQLite limits how many variables a statement may have.
+	return tx.CreateInBatches(&rows, 100).Error
+}
+
+func (ds FileDatastore) Job(id uint) (Job, error) {
+	j := job{}
+	result := ds.db.First(&j, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return Job{}, ErrNoJob
+	} else if result.Error != nil {
+		return Job{}, result.Error
+	}
+	jobs, err := ds.withItemCounts([]job{j})
+	if err != nil {
+		return Job{}, err
+	}
+	return jobs[0], nil
+}
+
+func (ds FileDatastore) Jobs(offset, count int) ([]Job, error) {
+	var js []job
+	if result := ds.db.Order("id DESC").Offset(offset).Limit(count).Find(&js); result.Error != nil {
+		return nil, result.Error
+	}
+	return ds.withItemCounts(js)
+}
+
+func (ds FileDatastore) withItemCounts(js []job) ([]Job, error) {
+	ids := make([]uint, 0, len(js))
+	for _, j := range js {
+		ids = append(ids, j.ID)
+	}
+	var counts []struct {
+		JobID uint
+		State string
+		Count int
+		Bytes int
+	}
+	result := ds.db.Model(&jobItem{}).Select("job_id, state, COUNT(*) AS count, coalesce(SUM(bytes), 0) AS bytes").
+		Where("job_id IN ?", ids).Group("job_id, state").Scan(&counts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	byJob := map[uint]map[JobItemState]int{}
+	bytesByJob := map[uint]int{}
+	for _, c := range counts {
+		if byJob[c.JobID] == nil {
+			byJob[c.JobID] = map[JobItemState]int{}
+		}
+		byJob[c.JobID][JobItemState(c.State)] = c.Count
+		bytesByJob[c.JobID] += c.Bytes
+	}
+	jobs := make([]Job, 0, len(js))
+	for _, j := range js {
+		items := byJob[j.ID]
+		if items == nil {
+			items = map[JobItemState]int{}
+		}
+		jobs = append(jobs, Job{
+			Id:              j.ID,
+			Kind:            j.Kind,
+			Spec:            j.Spec,
+			State:           JobState(j.State),
+			Error:           j.Error,
+			Created:         j.CreatedAt,
+			RunAt:           j.RunAt,
+			Started:         j.StartedAt,
+			Finished:        j.FinishedAt,
+			CancelRequested: j.CancelRequested,
+			PauseRequested:  j.PauseRequested,
+			Items:           items,
+			Bytes:           bytesByJob[j.ID],
+		})
+	}
+	return jobs, nil
+}
+
+func (ds FileDatastore) JobItems(id uint, offset, count int) ([]JobItem, error) {
+	var rows []jobItem
+	if result := ds.db.Where("job_id = ?", id).Order("id").Offset(offset).Limit(count).Find(&rows); result.Error != nil {
+		return nil, result.Error
+	}
+	return jobItemsOf(rows), nil
+}
+
+func jobItemsOf(rows []jobItem) []JobItem {
+	items := make([]JobItem, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, JobItem{row.ID, row.Url, row.HashedUrl, row.Depth, JobItemState(row.State), row.Error, row.Bytes})
+	}
+	return items
+}
+
+func (ds FileDatastore) JobLog(id uint, count int) ([]JobLogEntry, error) {
+	var rows []jobLogEntry
+	if result := ds.db.Where("job_id = ?", id).Order("id DESC").Limit(count).Find(&rows); result.Error != nil {
+		return nil, result.Error
+	}
+	entries := make([]JobLogEntry, len(rows))
+	for i, row := range rows {
+		entries[len(rows)-1-i] = JobLogEntry{row.At, row.Message}
+	}
+	return entries, nil
+}
+
+func (ds FileDatastore) AppendJobLog(id uint, message string) error {
+	return ds.db.Create(&jobLogEntry{JobID: id, At: time.Now(), Message: message}).Error
+}
+
+// Takes on the oldest queued job that is due, or a running job whose owner
+// stopped renewing its lease, in which case the items it was in the middle
+// of are queued again. Returns nil if there is no such job.
+func (ds FileDatastore) ClaimJob() (*Job, error) {
+	for {
+		now := time.Now()
+		due := ds.db.Where("(state = ? AND run_at <= ?) OR (state = ? AND lease_expiry < ?)", JobQueued, now, JobRunning, now)
+		j := job{}
+		result := due.Order("id").Limit(1).Find(&j)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil, nil
+		}
+		claimed := false
+		err := ds.db.Transaction(func(tx *gorm.DB) error {
+			updates := map[string]interface{}{
+				"state":        JobRunning,
+				"lease_owner":  ds.ownerId,
+				"lease_expiry": now.Add(ds.leaseDuration),
+			}
+			if j.StartedAt.IsZero() {
+				updates["started_at"] = now
+			}
+			// Someone else may have claimed it meanwhile.
+			result := tx.Model(&job{}).
+				Where("id = ? AND ((state = ? AND run_at <= ?) OR (state = ? AND lease_expiry < ?))", j.ID, JobQueued, now, JobRunning, now).
+				Updates(updates)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			claimed = true
+			return tx.Model(&jobItem{}).Where("job_id = ? AND state = ?", j.ID, JobItemRunning).Update("state", JobItemQueued).Error
+		})
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			claimedJob, err := ds.Job(j.ID)
+			return &claimedJob, err
+		}
+	}
+}
+
+// Keeps the lease on a running job from expiring, and reports what its owner
+// is asked to do with it: JobCancelled, JobPaused, or "" for nothing. Returns
+// ErrLeaseLost if another instance has taken it over.
+func (ds FileDatastore) RenewJobLease(id uint) (JobState, error) {
+	result := ds.db.Model(&job{}).Where("id = ? AND state = ? AND lease_owner = ?", id, JobRunning, ds.ownerId).
+		Update("lease_expiry", time.Now().Add(ds.leaseDuration))
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", ErrLeaseLost
+	}
+	j := job{}
+	if result := ds.db.Select("cancel_requested", "pause_requested").First(&j, id); result.Error != nil {
+		return "", result.Error
+	}
+	if j.CancelRequested {
+		return JobCancelled, nil
+	} else if j.PauseRequested {
+		return JobPaused, nil
+	}
+	return "", nil
+}
+
+// Marks up to count of the job's queued items as running, in the order they
+// were added, and returns them.
+func (ds FileDatastore) NextJobItems(id uint, count int) ([]JobItem, error) {
+	var rows []jobItem
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Where("job_id = ? AND state = ?", id, JobItemQueued).Order("id").Limit(count).Find(&rows); result.Error != nil {
+			return result.Error
+		}
+		ids := make([]uint, 0, len(rows))
+		for i := range rows {
+			ids = append(ids, rows[i].ID)
+			rows[i].State = string(JobItemRunning)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		return tx.Model(&jobItem{}).Where("id IN ?", ids).Update("state", JobItemRunning).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobItemsOf(rows), nil
+}
+
+// Adds queued items to a job, leaving out those whose URL it has already and
+// any that would give it more than maxItems in all. Returns how many were
+// added.
+func (ds FileDatastore) AddJobItems(id uint, items []JobItem, maxItems int) (int, error) {
+	added := 0
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		var total int64
+		if result := tx.Model(&jobItem{}).Where("job_id = ?", id).Count(&total); result.Error != nil {
+			return result.Error
+		}
+		var fresh []JobItem
+		seen := map[string]bool{}
+		for _, item := range items {
+			if int(total)+len(fresh) >= maxItems {
+				break
+			}
+			if seen[item.HashedUrl] {
+				continue
+			}
+			seen[item.HashedUrl] = true
+			var existing int64
+			if result := tx.Model(&jobItem{}).Where("job_id = ? AND hashed_url = ?", id, item.HashedUrl).Count(&existing); result.Error != nil {
+				return result.Error
+			}
+			if existing == 0 {
+				item.State = JobItemQueued
+				fresh = append(fresh, item)
+			}
+		}
+		added = len(fresh)
+		return createJobItems(tx, id, fresh)
+	})
+	return added, err
+}
+
+func (ds FileDatastore) FinishJobItem(itemId uint, state JobItemState, errMsg string, bytes int) error {
+	return ds.db.Model(&jobItem{}).Where("id = ?", itemId).Updates(map[string]interface{}{"state": state, "error": errMsg, "bytes": bytes}).Error
+}
+
+// Skips the job's items that are still queued, saying why with errMsg.
+func (ds FileDatastore) SkipJobItems(id uint, errMsg string) error {
+	return ds.db.Model(&jobItem{}).Where("job_id = ? AND state = ?", id, JobItemQueued).
+		Updates(map[string]interface{}{"state": JobItemSkipped, "error": errMsg}).Error
+}
+
+// Ends a running job, cancelling any of its items that weren't dealt with.
+func (ds FileDatastore) EndJob(id uint, state JobState, errMsg string) error {
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&job{}).Where("id = ? AND state = ? AND lease_owner = ?", id, JobRunning, ds.ownerId).Updates(map[string]interface{}{
+			"state":       state,
+			"error":       errMsg,
+			"finished_at": time.Now(),
+			"lease_owner": "",
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrLeaseLost
+		}
+		return cancelJobItems(tx, id)
+	})
+}
+
+func cancelJobItems(tx *gorm.DB, id uint) error {
+	return tx.Model(&jobItem{}).Where("job_id = ? AND state IN ?", id, []JobItemState{JobItemQueued, JobItemRunning}).
+		Update("state", JobItemCancelled).Error
+}
+
+// Gives up a running job without ending it, along with the items it was in
+// the middle of. With JobQueued, whoever claims it next carries on with it.
+// With JobPaused, it waits to be resumed first.
+func (ds FileDatastore) ReleaseJob(id uint, state JobState) error {
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&job{}).Where("id = ? AND state = ? AND lease_owner = ?", id, JobRunning, ds.ownerId).Updates(map[string]interface{}{
+			"state":           state,
+			"lease_owner":     "",
+			"pause_requested": false,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrLeaseLost
+		}
+		return tx.Model(&jobItem{}).Where("job_id = ? AND state = ?", id, JobItemRunning).Update("state", JobItemQueued).Error
+	})
+}
+
+// Changes a job that isn't running right away. A running job is only
+// flagged with requested, and its owner changes it once it notices.
+func requestJobChange(tx *gorm.DB, id uint, from JobState, updates map[string]interface{}, requested string) (bool, error) {
+	result := tx.Model(&job{}).Where("id = ? AND state = ?", id, from).Updates(updates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected != 0 {
+		return true, nil
+	}
+	// Claimed meanwhile, so the owner has to be told.
+	return false, tx.Model(&job{}).Where("id = ? AND state = ?", id, JobRunning).Update(requested, true).Error
+}
+
+func findJob(tx *gorm.DB, id uint) (job, error) {
+	j := job{}
+	result := tx.First(&j, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return j, ErrNoJob
+	}
+	return j, result.Error
+}
+
+// Cancels a queued or paused job right away. A running job is only marked to
+// be cancelled, and its owner ends it once it notices. Returns ErrJobEnded if
+// the job has ended already.
+func (ds FileDatastore) CancelJob(id uint) error {
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		j, err := findJob(tx, id)
+		if err != nil {
+			return err
+		}
+		switch JobState(j.State) {
+		case JobQueued, JobPaused:
+			cancelled, err := requestJobChange(tx, id, JobState(j.State), map[string]interface{}{
+				"state":            JobCancelled,
+				"cancel_requested": true,
+				"finished_at":      time.Now(),
+			}, "cancel_requested")
+			if err != nil || !cancelled {
+				return err
+			}
+			return cancelJobItems(tx, id)
+		case JobRunning:
+			return tx.Model(&job{}).Where("id = ?", id).Update("cancel_requested", true).Error
+		default:
+			return ErrJobEnded
+		}
+	})
+}
+
+// Pauses a queued job right away. A running job is only marked to be paused,
+// and its owner puts it aside once it notices. Returns ErrJobEnded if the job
+// has ended already.
+func (ds FileDatastore) PauseJob(id uint) error {
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		j, err := findJob(tx, id)
+		if err != nil {
+			return err
+		}
+		switch JobState(j.State) {
+		case JobQueued:
+			_, err := requestJobChange(tx, id, JobQueued, map[string]interface{}{"state": JobPaused}, "pause_requested")
+			return err
+		case JobRunning:
+			return tx.Model(&job{}).Where("id = ?", id).Update("pause_requested", true).Error
+		case JobPaused:
+			return nil
+		default:
+			return ErrJobEnded
+		}
+	})
+}
+
+// Queues a paused job again, to be carried on with once it is due. A running
+// job that is still to be paused is left running. Returns ErrJobNotPaused if
+// the job is neither, and ErrJobEnded if it has ended already.
+func (ds FileDatastore) ResumeJob(id uint) error {
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		j, err := findJob(tx, id)
+		if err != nil {
+			return err
+		}
+		switch JobState(j.State) {
+		case JobPaused:
+			return tx.Model(&job{}).Where("id = ?", id).Update("state", JobQueued).Error
+		case JobRunning:
+			if j.PauseRequested {
+				return tx.Model(&job{}).Where("id = ?", id).Update("pause_requested", false).Error
+			}
+			return ErrJobNotPaused
+		case JobQueued:
+			return ErrJobNotPaused
+		default:
+			return ErrJobEnded
+		}
+	})
+}
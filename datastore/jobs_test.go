@@ -0,0 +1,218 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestJobs(t *testing.T) {
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	dbPath := path.Join(datastoreRoot, "knox.db")
+	ds1, err := NewFileDatastore(dbPath, datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	ds2, err := NewFileDatastore(dbPath, datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	ds1.leaseDuration = 100 * time.Millisecond
+	ds2.leaseDuration = 100 * time.Millisecond
+
+	if _, err := ds1.Job(1); !errors.Is(err, ErrNoJob) {
+		t.Errorf("Expected no job. got = %v", err)
+	}
+	later, err := ds1.CreateJob("batch", "", time.Now().Add(time.Hour), []JobItem{{Url: "http://c.com", HashedUrl: "c"}})
+	if err != nil {
+		t.Fatalf("Failed to create job: %v", err)
+	}
+	j, err := ds1.CreateJob("crawl", `{"depth":1}`, time.Now(), []JobItem{
+		{Url: "http://a.com", HashedUrl: "a"},
+		{Url: "b", State: JobItemInvalid, Error: "no host"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create job: %v", err)
+	}
+	if j.State != JobQueued || j.Spec != `{"depth":1}` || j.Items[JobItemQueued] != 1 || j.Items[JobItemInvalid] != 1 || j.TotalItems() != 2 {
+		t.Errorf("Wrong job. got = %+v", j)
+	}
+	if jobs, err := ds1.Jobs(0, 10); err != nil || len(jobs) != 2 || jobs[0].Id != j.Id || jobs[1].Id != later.Id {
+		t.Errorf("Wrong jobs. got = %+v, %v", jobs, err)
+	}
+
+	// Jobs that aren't due yet aren't claimed.
+	claimed, err := ds1.ClaimJob()
+	if err != nil || claimed == nil || claimed.Id != j.Id || claimed.State != JobRunning || claimed.Started.IsZero() {
+		t.Fatalf("Wrong claimed job. got = %+v, %v", claimed, err)
+	}
+	if claimed, err := ds2.ClaimJob(); err != nil || claimed != nil {
+		t.Errorf("Expected no job to claim. got = %+v, %v", claimed, err)
+	}
+
+	items, err := ds1.NextJobItems(j.Id, 10)
+	if err != nil || len(items) != 1 || items[0].HashedUrl != "a" || items[0].State != JobItemRunning {
+		t.Fatalf("Wrong next items. got = %+v, %v", items, err)
+	}
+	// Items are only added once, and no more than the maximum.
+	added, err := ds1.AddJobItems(j.Id, []JobItem{
+		{Url: "http://a.com", HashedUrl: "a", Depth: 1},
+		{Url: "http://d.com", HashedUrl: "d", Depth: 1},
+		{Url: "http://d.com", HashedUrl: "d", Depth: 1},
+		{Url: "http://e.com", HashedUrl: "e", Depth: 1},
+		{Url: "http://f.com", HashedUrl: "f", Depth: 1},
+	}, 4)
+	if err != nil || added != 2 {
+		t.Errorf("Wrong number of items added. got = %d, %v", added, err)
+	}
+	if err := ds1.FinishJobItem(items[0].Id, JobItemDone, "", 100); err != nil {
+		t.Fatalf("Failed to finish item: %v", err)
+	}
+	if err := ds1.AppendJobLog(j.Id, "first"); err != nil {
+		t.Fatalf("Failed to append to log: %v", err)
+	}
+	if err := ds1.AppendJobLog(j.Id, "second"); err != nil {
+		t.Fatalf("Failed to append to log: %v", err)
+	}
+	if log, err := ds1.JobLog(j.Id, 1); err != nil || len(log) != 1 || log[0].Message != "second" {
+		t.Errorf("Wrong log. got = %+v, %v", log, err)
+	}
+
+	// A job whose owner stops renewing its lease is taken over, along with
+	// the items it was in the middle of.
+	if _, err := ds1.NextJobItems(j.Id, 1); err != nil {
+		t.Fatalf("Failed to get next items: %v", err)
+	}
+	time.Sleep(3 * ds1.leaseDuration)
+	claimed, err = ds2.ClaimJob()
+	if err != nil || claimed == nil || claimed.Id != j.Id || claimed.Items[JobItemQueued] != 2 || claimed.Items[JobItemDone] != 1 {
+		t.Fatalf("Expected the abandoned job to be taken over. got = %+v, %v", claimed, err)
+	}
+	if _, err := ds1.RenewJobLease(j.Id); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected the lease to be lost. got = %v", err)
+	}
+
+	if err := ds1.CancelJob(j.Id); err != nil {
+		t.Fatalf("Failed to cancel job: %v", err)
+	}
+	if requested, err := ds2.RenewJobLease(j.Id); err != nil || requested != JobCancelled {
+		t.Errorf("Expected the owner to be told to cancel the job. got = %v, %v", requested, err)
+	}
+	if err := ds2.EndJob(j.Id, JobCancelled, ""); err != nil {
+		t.Fatalf("Failed to end job: %v", err)
+	}
+	j, err = ds1.Job(j.Id)
+	if err != nil || j.State != JobCancelled || !j.Ended() || j.Finished.IsZero() || j.Items[JobItemCancelled] != 2 || j.Items[JobItemDone] != 1 || j.Bytes != 100 {
+		t.Errorf("Wrong cancelled job. got = %+v, %v", j, err)
+	}
+	if err := ds1.CancelJob(j.Id); !errors.Is(err, ErrJobEnded) {
+		t.Errorf("Expected an ended job not to be cancelled. got = %v", err)
+	}
+
+	// Queued jobs are cancelled right away.
+	if err := ds1.CancelJob(later.Id); err != nil {
+		t.Fatalf("Failed to cancel job: %v", err)
+	}
+	if later, err := ds1.Job(later.Id); err != nil || later.State != JobCancelled || later.Items[JobItemCancelled] != 1 {
+		t.Errorf("Wrong cancelled job. got = %+v, %v", later, err)
+	}
+
+	// Released jobs are claimed again.
+	j, err = ds1.CreateJob("batch", "", time.Now(), []JobItem{{Url: "http://g.com", HashedUrl: "g"}})
+	if err != nil {
+		t.Fatalf("Failed to create job: %v", err)
+	}
+	if claimed, err := ds1.ClaimJob(); err != nil || claimed == nil || claimed.Id != j.Id {
+		t.Fatalf("Wrong claimed job. got = %+v, %v", claimed, err)
+	}
+	if _, err := ds1.NextJobItems(j.Id, 1); err != nil {
+		t.Fatalf("Failed to get next items: %v", err)
+	}
+	if err := ds1.ReleaseJob(j.Id, JobQueued); err != nil {
+		t.Fatalf("Failed to release job: %v", err)
+	}
+	if claimed, err := ds2.ClaimJob(); err != nil || claimed == nil || claimed.Id != j.Id || claimed.Items[JobItemQueued] != 1 {
+		t.Errorf("Expected the released job to be claimed. got = %+v, %v", claimed, err)
+	}
+
+	if err := ds2.SkipJobItems(j.Id, "enough"); err != nil {
+		t.Fatalf("Failed to skip items: %v", err)
+	}
+	if items, err := ds2.JobItems(j.Id, 0, 10); err != nil || len(items) != 1 || items[0].State != JobItemSkipped || items[0].Error != "enough" {
+		t.Errorf("Expected the queued item to be skipped. got = %+v, %v", items, err)
+	}
+}
+
+func TestPauseJobs(t *testing.T) {
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	j, err := ds.CreateJob("batch", "", time.Now(), []JobItem{{Url: "http://a.com", HashedUrl: "a"}, {Url: "http://b.com", HashedUrl: "b"}})
+	if err != nil {
+		t.Fatalf("Failed to create job: %v", err)
+	}
+	if err := ds.ResumeJob(j.Id); !errors.Is(err, ErrJobNotPaused) {
+		t.Errorf("Expected a queued job not to be resumed. got = %v", err)
+	}
+
+	// Queued jobs are paused right away, and aren't claimed until resumed.
+	if err := ds.PauseJob(j.Id); err != nil {
+		t.Fatalf("Failed to pause job: %v", err)
+	}
+	if claimed, err := ds.ClaimJob(); err != nil || claimed != nil {
+		t.Errorf("Expected a paused job not to be claimed. got = %+v, %v", claimed, err)
+	}
+	if err := ds.ResumeJob(j.Id); err != nil {
+		t.Fatalf("Failed to resume job: %v", err)
+	}
+	if claimed, err := ds.ClaimJob(); err != nil || claimed == nil || claimed.Id != j.Id {
+		t.Fatalf("Expected the resumed job to be claimed. got = %+v, %v", claimed, err)
+	}
+
+	// Running jobs are paused by their owner, which queues the items it was
+	// in the middle of again.
+	items, err := ds.NextJobItems(j.Id, 2)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Wrong next items. got = %+v, %v", items, err)
+	}
+	if err := ds.FinishJobItem(items[0].Id, JobItemDone, "", 0); err != nil {
+		t.Fatalf("Failed to finish item: %v", err)
+	}
+	if err := ds.PauseJob(j.Id); err != nil {
+		t.Fatalf("Failed to pause job: %v", err)
+	}
+	if requested, err := ds.RenewJobLease(j.Id); err != nil || requested != JobPaused {
+		t.Errorf("Expected the owner to be told to pause the job. got = %v, %v", requested, err)
+	}
+	if err := ds.ReleaseJob(j.Id, JobPaused); err != nil {
+		t.Fatalf("Failed to release job: %v", err)
+	}
+	j, err = ds.Job(j.Id)
+	if err != nil || j.State != JobPaused || j.PauseRequested || j.Items[JobItemDone] != 1 || j.Items[JobItemQueued] != 1 {
+		t.Errorf("Wrong paused job. got = %+v, %v", j, err)
+	}
+
+	// Paused jobs are cancelled right away.
+	if err := ds.CancelJob(j.Id); err != nil {
+		t.Fatalf("Failed to cancel job: %v", err)
+	}
+	if j, err := ds.Job(j.Id); err != nil || j.State != JobCancelled || j.Items[JobItemCancelled] != 1 {
+		t.Errorf("Wrong cancelled job. got = %+v, %v", j, err)
+	}
+	if err := ds.PauseJob(j.Id); !errors.Is(err, ErrJobEnded) {
+		t.Errorf("Expected an ended job not to be paused. got = %v", err)
+	}
+	if err := ds.ResumeJob(j.Id); !errors.Is(err, ErrJobEnded) {
+		t.Errorf("Expected an ended job not to be resumed. got = %v", err)
+	}
+}
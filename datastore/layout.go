@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Where resource files were kept before they were fanned out over
+// directories: all in the root, named after their decimal IDs.
+func legacyResourceFilepath(rootPath string, resourceId uint, blobVersion int) string {
+	filePath := rootPath + strconv.FormatUint(uint64(resourceId), 10)
+	if blobVersion != 0 {
+		filePath += "." + strconv.Itoa(blobVersion)
+	}
+	return filePath
+}
+
+// Moves every resource file from where from says it is to where to says it
+// should be, returning how many were moved. Files that aren't where from says
+// are skipped, so an interrupted move can just be run again.
+func (ds FileDatastore) moveResourceFiles(from, to func(string, uint, int) string) (int, error) {
+	rows, err := ds.db.Model(&resourceMetadata{}).Select("id, blob_version").Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	moved := 0
+	for rows.Next() {
+		var id uint
+		var blobVersion int
+		if err := rows.Scan(&id, &blobVersion); err != nil {
+			return moved, err
+		}
+		// A refresh may have stopped partway through writing the next version.
+		for _, version := range []int{blobVersion, blobVersion + 1} {
+			oldPath := from(ds.rootPath, id, version)
+			if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return moved, err
+			}
+			newPath := to(ds.rootPath, id, version)
+			if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+				return moved, err
+			}
+			if err := os.Rename(oldPath, newPath); err != nil {
+				return moved, err
+			}
+			moved += 1
+		}
+	}
+	return moved, rows.Err()
+}
@@ -0,0 +1,23 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestResourceFilepath(t *testing.T) {
+	cases := []struct {
+		id          uint
+		blobVersion int
+		want        string
+	}{
+		{1, 0, "/root/01/00/00000001"},
+		{0x12ab34, 0, "/root/34/ab/0012ab34"},
+		{0x12ab34, 2, "/root/34/ab/0012ab34.2"},
+		{0x123456789, 0, "/root/89/67/123456789"},
+	}
+	for _, c := range cases {
+		if got := resourceFilepath("/root/", c.id, c.blobVersion); got != c.want {
+			t.Errorf("Wrong path for %x.%d. got = %s, want = %s", c.id, c.blobVersion, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// An outgoing link from a cached page.
+type Link struct {
+	Url       string
+	HashedUrl string
+}
+
+type resourceLink struct {
+	ID uint `gorm:"primarykey"`
+
+	// The resource the link appears on.
+	FromID uint `gorm:"index"`
+
+	ToUrl       string
+	ToHashedUrl string `gorm:"index"`
+}
+
+// A link target that cached pages point to but that isn't cached itself.
+type BrokenLink struct {
+	Url       string
+	HashedUrl string
+
+	// How many cached pages link to the target and one of them.
+	Referrers       int
+	ExampleReferrer string
+
+	// Why the target couldn't be fetched, if fetching it was attempted.
+	FailureReason string
+	FailedAt      *time.Time
+}
+
+// Replaces the recorded outgoing links of a cached resource.
+func (ds FileDatastore) RecordLinks(hashedUrl string, links []Link) error {
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		rm := resourceMetadata{}
+		result := tx.Select("id").First(&rm, "hashed_url = ? AND download_complete = ?", hashedUrl, true)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrResourceNotCached
+		} else if result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Where("from_id = ?", rm.ID).Delete(&resourceLink{}); result.Error != nil {
+			return result.Error
+		}
+		if len(links) == 0 {
+			return nil
+		}
+		rows := make([]resourceLink, 0, len(links))
+		for _, link := range links {
+			rows = append(rows, resourceLink{FromID: rm.ID, ToUrl: link.Url, ToHashedUrl: link.HashedUrl})
+		}
+		return tx.CreateInBatches(rows, 100).Error
+	})
+}
+
+// Lists the targets of recorded links that aren't cached, the most linked
+// first.
+func (ds FileDatastore) BrokenLinks(offset, count int) ([]BrokenLink, error) {
+	var links []BrokenLink
+	result := ds.db.Raw(`SELECT resource_links.to_url AS url, resource_links.to_hashed_url AS hashed_url,
+			COUNT(DISTINCT resource_links.from_id) AS referrers, MIN(referrer.url) AS example_referrer,
+			fetch_failures.reason AS failure_reason, fetch_failures.failed_at AS failed_at
+		FROM resource_links
+		JOIN resource_metadata AS referrer ON referrer.id = resource_links.from_id AND referrer.deleted_at IS NULL
+		LEFT JOIN resource_metadata AS target ON target.hashed_url = resource_links.to_hashed_url
+			AND target.deleted_at IS NULL AND target.download_complete
+		LEFT JOIN fetch_failures ON fetch_failures.hashed_url = resource_links.to_hashed_url
+			AND fetch_failures.deleted_at IS NULL
+		WHERE target.id IS NULL
+		GROUP BY resource_links.to_hashed_url, resource_links.to_url, fetch_failures.reason, fetch_failures.failed_at
+		ORDER BY referrers DESC, resource_links.to_url
+		LIMIT ? OFFSET ?`, count, offset).Scan(&links)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return links, nil
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestBrokenLinks(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	first := randomHttpResource(r)
+	createHttpResource(t, &ds, first)
+	second := randomHttpResource(r)
+	createHttpResource(t, &ds, second)
+	missing := randomHttpResource(r)
+	failed := randomHttpResource(r)
+	rw, err := ds.TryCreate(failed.resourceUrl, failed.hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to create resource %v: %v", failed, err)
+	}
+	if err = rw.Fail(fmt.Errorf("connection refused"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to record failure: %v", err)
+	}
+
+	link := func(hr HttpResource) Link {
+		return Link{hr.resourceUrl, hr.hashedUrl}
+	}
+	if err := ds.RecordLinks(first.hashedUrl, []Link{link(second), link(missing), link(failed)}); err != nil {
+		t.Fatalf("Failed to record links: %v", err)
+	}
+	if err := ds.RecordLinks(second.hashedUrl, []Link{link(first), link(failed)}); err != nil {
+		t.Fatalf("Failed to record links: %v", err)
+	}
+	if err := ds.RecordLinks(missing.hashedUrl, nil); err != ErrResourceNotCached {
+		t.Errorf("Expected links of uncached resource not to be recorded. got = %v", err)
+	}
+
+	broken, err := ds.BrokenLinks(0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list broken links: %v", err)
+	}
+	if len(broken) != 2 {
+		t.Fatalf("Wrong number of broken links. got = %v", broken)
+	}
+	if broken[0].Url != failed.resourceUrl || broken[0].Referrers != 2 || broken[0].FailureReason != "connection refused" || broken[0].FailedAt == nil {
+		t.Errorf("Wrong first broken link. got = %v", broken[0])
+	}
+	if broken[1].Url != missing.resourceUrl || broken[1].Referrers != 1 || broken[1].ExampleReferrer != first.resourceUrl || broken[1].FailureReason != "" {
+		t.Errorf("Wrong second broken link. got = %v", broken[1])
+	}
+	if broken, err = ds.BrokenLinks(1, 10); err != nil || len(broken) != 1 {
+		t.Errorf("Expected offset to skip a link. got = %v, %v", broken, err)
+	}
+
+	// Recording again replaces the old links, and deleting a page forgets
+	// its links.
+	if err := ds.RecordLinks(first.hashedUrl, []Link{link(second)}); err != nil {
+		t.Fatalf("Failed to record links: %v", err)
+	}
+	if broken, err = ds.BrokenLinks(0, 10); err != nil || len(broken) != 1 || broken[0].Referrers != 1 {
+		t.Errorf("Expected rerecorded links to be replaced. got = %v, %v", broken, err)
+	}
+	if err := ds.Delete(second.hashedUrl); err != nil {
+		t.Fatalf("Failed to delete resource: %v", err)
+	}
+	if broken, err = ds.BrokenLinks(0, 10); err != nil || len(broken) != 1 || broken[0].Url != second.resourceUrl {
+		t.Errorf("Expected only the deleted page to be broken. got = %v, %v", broken, err)
+	}
+}
@@ -0,0 +1,163 @@
+package datastore
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Identifies a stored body. A refresh or a move between tiers writes a new
+// blob version, and a resource deleted and cached again starts a new download,
+// so an entry can never be served for a body other than its own.
+type memoryCacheKey struct {
+	id              uint
+	blobVersion     int
+	downloadStarted int64
+}
+
+func memoryCacheKeyOf(rm resourceMetadata) memoryCacheKey {
+	return memoryCacheKey{rm.ID, rm.BlobVersion, rm.DownloadStarted.UnixNano()}
+}
+
+type memoryCacheEntry struct {
+	key     memoryCacheKey
+	body    []byte
+	headers http.Header
+}
+
+// A bounded, least recently used set of decompressed bodies, along with their
+// headers, kept so that popular small resources are served without touching
+// the disk. Entries for bodies that have been replaced are never looked up
+// again and age out like any other.
+type memoryCache struct {
+	maxBytes      int64
+	maxEntryBytes int64
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List
+	entries map[memoryCacheKey]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+// Statistics of the memory cache of a single instance.
+type MemoryCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Bytes   int64
+}
+
+func newMemoryCache(maxBytes, maxEntryBytes int64) *memoryCache {
+	if maxEntryBytes > maxBytes {
+		maxEntryBytes = maxBytes
+	}
+	return &memoryCache{
+		maxBytes:      maxBytes,
+		maxEntryBytes: maxEntryBytes,
+		lru:           list.New(),
+		entries:       map[memoryCacheKey]*list.Element{},
+	}
+}
+
+// Returns a copy of ds that keeps up to maxBytes of decompressed bodies no
+// larger than maxEntryBytes in memory. A maxBytes of zero disables the cache.
+// The cache is shared by every copy of the returned datastore.
+func (ds FileDatastore) WithMemoryCache(maxBytes, maxEntryBytes int64) FileDatastore {
+	if maxBytes <= 0 {
+		ds.memory = nil
+	} else {
+		ds.memory = newMemoryCache(maxBytes, maxEntryBytes)
+	}
+	return ds
+}
+
+// Returns the cached body of rm, or nil if it isn't cached.
+func (mc *memoryCache) get(rm resourceMetadata) *memoryCacheEntry {
+	if mc == nil {
+		return nil
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	elem, ok := mc.entries[memoryCacheKeyOf(rm)]
+	if !ok {
+		mc.misses += 1
+		return nil
+	}
+	mc.hits += 1
+	mc.lru.MoveToFront(elem)
+	return elem.Value.(*memoryCacheEntry)
+}
+
+func (mc *memoryCache) add(entry *memoryCacheEntry) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if _, ok := mc.entries[entry.key]; ok {
+		return
+	}
+	mc.entries[entry.key] = mc.lru.PushFront(entry)
+	mc.bytes += int64(len(entry.body))
+	for mc.bytes > mc.maxBytes {
+		oldest := mc.lru.Back()
+		evicted := mc.lru.Remove(oldest).(*memoryCacheEntry)
+		delete(mc.entries, evicted.key)
+		mc.bytes -= int64(len(evicted.body))
+	}
+}
+
+// Drops every cached body of the resource with the given id.
+func (mc *memoryCache) remove(id uint) {
+	if mc == nil {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for key, elem := range mc.entries {
+		if key.id == id {
+			mc.lru.Remove(elem)
+			delete(mc.entries, key)
+			mc.bytes -= int64(len(elem.Value.(*memoryCacheEntry).body))
+		}
+	}
+}
+
+// Reads body into the cache if it is small enough, and returns a reader over
+// the whole body either way.
+func (mc *memoryCache) fill(rm resourceMetadata, body io.ReadCloser, headers *http.Header) (io.ReadCloser, error) {
+	if mc == nil || int64(rm.RawBytes) > mc.maxEntryBytes {
+		return body, nil
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(body, mc.maxEntryBytes+1))
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if int64(len(buf)) > mc.maxEntryBytes {
+		// The recorded size was wrong. Serve the rest from the file.
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), body), body}, nil
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	mc.add(&memoryCacheEntry{memoryCacheKeyOf(rm), buf, headers.Clone()})
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+// Returns the statistics of the memory cache of this instance, which are all
+// zero if it has none.
+func (ds FileDatastore) MemoryCacheStats() MemoryCacheStats {
+	mc := ds.memory
+	if mc == nil {
+		return MemoryCacheStats{}
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return MemoryCacheStats{mc.hits, mc.misses, len(mc.entries), mc.bytes}
+}
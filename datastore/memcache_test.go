@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryCache(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	// Room for two of the roughly 100 byte bodies.
+	ds = ds.WithMemoryCache(250, 200)
+	var hrs []HttpResource
+	for i := 0; i < 3; i += 1 {
+		hr := randomHttpResource(r)
+		createHttpResource(t, &ds, hr)
+		hrs = append(hrs, hr)
+	}
+	var rms []resourceMetadata
+	ds.db.Order("id").Find(&rms)
+
+	for i := 0; i < 2; i += 1 {
+		if hr := readHttpResource(t, ds, hrs[0].hashedUrl); !reflect.DeepEqual(hrs[0], hr) {
+			t.Fatalf("Expected:\n%v\ngot:\n%v", hrs[0], hr)
+		}
+	}
+	if stats := ds.MemoryCacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Bytes != int64(len(hrs[0].content)) {
+		t.Errorf("Wrong memory cache stats. got = %+v", stats)
+	}
+	// Cached bodies are served without the file.
+	if err := os.Remove(resourceFilepath(ds.rootPath, rms[0].ID, rms[0].BlobVersion)); err != nil {
+		t.Fatalf("Failed to remove body: %v", err)
+	}
+	if hr := readHttpResource(t, ds, hrs[0].hashedUrl); !reflect.DeepEqual(hrs[0], hr) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hrs[0], hr)
+	}
+
+	// Reading two more evicts the least recently used.
+	readHttpResource(t, ds, hrs[1].hashedUrl)
+	readHttpResource(t, ds, hrs[2].hashedUrl)
+	if stats := ds.MemoryCacheStats(); stats.Entries != 2 || stats.Bytes > 250 {
+		t.Errorf("Wrong memory cache stats. got = %+v", stats)
+	}
+	if _, err := ds.Open(hrs[0].hashedUrl); err == nil {
+		t.Errorf("Expected the evicted body to be read from its missing file")
+	}
+
+	// A refreshed body replaces the cached one.
+	rw, err := ds.TryRefresh(hrs[1].hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to refresh resource: %v", err)
+	}
+	staleBytes := len(hrs[1].content)
+	hrs[1].content = []byte("refreshed")
+	if err = rw.WriteHeaders(&hrs[1].headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	if _, err = rw.Write(hrs[1].content); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource writer: %v", err)
+	}
+	if hr := readHttpResource(t, ds, hrs[1].hashedUrl); !reflect.DeepEqual(hrs[1], hr) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hrs[1], hr)
+	}
+
+	// Deleting a resource drops its cached body. The stale body of the
+	// refreshed one is left to age out.
+	if err := ds.Delete(hrs[2].hashedUrl); err != nil {
+		t.Fatalf("Failed to delete resource: %v", err)
+	}
+	if stats := ds.MemoryCacheStats(); stats.Entries != 2 || stats.Bytes != int64(staleBytes+len(hrs[1].content)) {
+		t.Errorf("Wrong memory cache stats. got = %+v", stats)
+	}
+}
@@ -0,0 +1,279 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// A completed resource as it is stored, for copying it to another datastore.
+// The body that goes with it is the resource file as it is on disk.
+type ReplicaResource struct {
+	HashedUrl        string
+	Url              string
+	RequestHeaders   string
+	ResponseHeaders  string
+	CaptureOptions   string
+	DownloadStarted  time.Time
+	DownloadFinished time.Time
+	RawBytes         int
+	BytesOnDisk      int
+	ContentHash      string
+	Protocol         string
+	ContentEncoding  string
+	StatusCode       int
+	SingleGzipMember bool
+}
+
+// Where replication to a target has got to. Resources are replicated in the
+// order they finished downloading, with the ID breaking ties.
+type ReplicaCursor struct {
+	Finished time.Time
+	ID       uint
+}
+
+type replicationCursor struct {
+	Target     string `gorm:"primaryKey"`
+	Finished   time.Time
+	ResourceId uint
+}
+
+// Where replication to target has got to. The zero cursor comes before
+// everything.
+func (ds FileDatastore) ReplicaCursor(target string) (ReplicaCursor, error) {
+	var rc replicationCursor
+	result := ds.db.Limit(1).Find(&rc, "target = ?", target)
+	if result.Error != nil {
+		return ReplicaCursor{}, result.Error
+	}
+	return ReplicaCursor{rc.Finished, rc.ResourceId}, nil
+}
+
+func (ds FileDatastore) SaveReplicaCursor(target string, cursor ReplicaCursor) error {
+	return ds.db.Save(&replicationCursor{target, cursor.Finished, cursor.ID}).Error
+}
+
+// Lists up to count completed resources that finished after cursor and
+// before before, in the order they should be replicated. Refreshing a
+// resource moves it to the end.
+func (ds FileDatastore) FinishedAfter(cursor ReplicaCursor, before time.Time, count int) ([]ReplicaCursor, error) {
+	var rms []resourceMetadata
+	result := ds.db.Select("id", "download_finished").
+		Where("download_complete = ? AND download_finished < ?", true, before).
+		Where("download_finished > ? OR (download_finished = ? AND id > ?)", cursor.Finished, cursor.Finished, cursor.ID).
+		Order("download_finished, id").
+		Limit(count).
+		Find(&rms)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	cursors := make([]ReplicaCursor, len(rms))
+	for i, rm := range rms {
+		cursors[i] = ReplicaCursor{rm.DownloadFinished, rm.ID}
+	}
+	return cursors, nil
+}
+
+func newReplicaResource(rm resourceMetadata) ReplicaResource {
+	return ReplicaResource{
+		HashedUrl:        rm.HashedUrl,
+		Url:              rm.Url,
+		RequestHeaders:   rm.RequestHeaders,
+		ResponseHeaders:  rm.ResponseHeaders,
+		CaptureOptions:   rm.CaptureOptions,
+		DownloadStarted:  rm.DownloadStarted,
+		DownloadFinished: rm.DownloadFinished,
+		RawBytes:         rm.RawBytes,
+		BytesOnDisk:      rm.BytesOnDisk,
+		ContentHash:      rm.ContentHash,
+		Protocol:         rm.Protocol,
+		ContentEncoding:  rm.ContentEncoding,
+		StatusCode:       rm.StatusCode,
+		SingleGzipMember: rm.SingleGzipMember,
+	}
+}
+
+// How many times to chase a body that is replaced by refreshes while it is
+// being opened for replication.
+const maxReplicaOpenAttempts = 3
+
+// Opens the resource with the given ID for replication. The file stays
+// readable even if a refresh replaces it. Returns ErrResourceNotCached if the
+// resource is gone or isn't complete.
+func (ds FileDatastore) OpenReplica(id uint) (ReplicaResource, *os.File, error) {
+	for attempt := 0; ; attempt += 1 {
+		var rm resourceMetadata
+		result := ds.db.First(&rm, "id = ? AND download_complete = ?", id, true)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ReplicaResource{}, nil, ErrResourceNotCached
+		} else if result.Error != nil {
+			return ReplicaResource{}, nil, result.Error
+		}
+		if rm.Tier == tierCold {
+			// Replicas are sent the hot body, so it has to be brought back.
+			thawed, err := ds.thaw(rm)
+			if err != nil {
+				return ReplicaResource{}, nil, err
+			}
+			if thawed == nil {
+				return ReplicaResource{}, nil, ErrResourceBusy
+			}
+			rm = *thawed
+		}
+		f, err := os.Open(resourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion))
+		if err == nil {
+			return newReplicaResource(rm), f, nil
+		}
+		if !os.IsNotExist(err) || attempt >= maxReplicaOpenAttempts {
+			return ReplicaResource{}, nil, err
+		}
+	}
+}
+
+// Stores a resource copied from another datastore, replacing any copy already
+// here. body is the resource file as it was on disk there, and has to match
+// the size and hash in rr. Returns ErrResourceBusy if the resource is being
+// downloaded or refreshed here.
+func (ds FileDatastore) PutReplica(rr ReplicaResource, body io.Reader) error {
+	var existing resourceMetadata
+	result := ds.db.Limit(1).Find(&existing, "hashed_url = ?", rr.HashedUrl)
+	if result.Error != nil {
+		return result.Error
+	}
+	exists := result.RowsAffected != 0
+	if exists && existing.DownloadComplete && existing.ContentHash == rr.ContentHash && existing.DownloadFinished.Equal(rr.DownloadFinished) {
+		io.Copy(ioutil.Discard, body)
+		return nil
+	}
+
+	// Written next to where it will end up so that it can be renamed there.
+	tempDir := ds.rootPath
+	if tempDir == "" {
+		tempDir = "."
+	}
+	tempFile, err := ioutil.TempFile(tempDir, "replica-")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, h), body)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size != int64(rr.BytesOnDisk) || hex.EncodeToString(h.Sum(nil)) != rr.ContentHash {
+		return fmt.Errorf("body of %s doesn't match its size and hash", rr.Url)
+	}
+
+	now := time.Now()
+	rm := resourceMetadata{
+		HashedUrl:        rr.HashedUrl,
+		Url:              rr.Url,
+		Host:             resourceHost(rr.Url),
+		RequestHeaders:   rr.RequestHeaders,
+		ResponseHeaders:  rr.ResponseHeaders,
+		CaptureOptions:   rr.CaptureOptions,
+		DownloadStarted:  rr.DownloadStarted,
+		DownloadFinished: rr.DownloadFinished,
+		RawBytes:         rr.RawBytes,
+		BytesOnDisk:      rr.BytesOnDisk,
+		DownloadComplete: true,
+		ContentHash:      rr.ContentHash,
+		Protocol:         rr.Protocol,
+		ContentEncoding:  rr.ContentEncoding,
+		StatusCode:       rr.StatusCode,
+		SingleGzipMember: rr.SingleGzipMember,
+	}
+	if headers, err := readHeaders(rr.ResponseHeaders); err == nil {
+		rm.ContentType = headerMediaType(headers)
+	}
+	err = ds.db.Transaction(func(tx *gorm.DB) error {
+		if !exists {
+			if result := tx.Create(&rm); result.Error != nil {
+				return result.Error
+			}
+			if err := updateGlobalStats(tx, 1, int64(rm.BytesOnDisk)); err != nil {
+				return err
+			}
+		} else {
+			rm.BlobVersion = existing.BlobVersion + 1
+			result := tx.Model(&resourceMetadata{}).
+				Where("id = ? AND (lease_owner = ? OR lease_expiry < ?)", existing.ID, "", now).
+				Updates(map[string]interface{}{
+					"url":                    rm.Url,
+					"host":                   rm.Host,
+					"request_headers":        rm.RequestHeaders,
+					"response_headers":       rm.ResponseHeaders,
+					"capture_options":        rm.CaptureOptions,
+					"download_started":       rm.DownloadStarted,
+					"download_finished":      rm.DownloadFinished,
+					"raw_bytes":              rm.RawBytes,
+					"bytes_on_disk":          rm.BytesOnDisk,
+					"download_complete":      true,
+					"checkpoint_offset":      0,
+					"checkpoint_raw_bytes":   0,
+					"checkpoint_validator":   "",
+					"lease_owner":            "",
+					"blob_version":           rm.BlobVersion,
+					"content_hash":           rm.ContentHash,
+					"protocol":               rm.Protocol,
+					"content_encoding":       rm.ContentEncoding,
+					"content_type":           rm.ContentType,
+					"status_code":            rm.StatusCode,
+					"single_gzip_member":     rm.SingleGzipMember,
+					"refresh_failure_reason": "",
+					"refresh_failed_at":      time.Time{},
+					"refresh_retry_after":    time.Time{},
+					"refresh_refused":        false,
+					"tier":                   tierHot,
+				})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return ErrResourceBusy
+			}
+			rm.ID = existing.ID
+			if err := updateGlobalStats(tx, 0, int64(rm.BytesOnDisk-existing.BytesOnDisk)); err != nil {
+				return err
+			}
+		}
+		if result := tx.Unscoped().Where("hashed_url = ?", rm.HashedUrl).Delete(&fetchFailure{}); result.Error != nil {
+			return result.Error
+		}
+		filePath := resourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion)
+		if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+			return err
+		}
+		return os.Rename(tempPath, filePath)
+	})
+	if err != nil {
+		return err
+	}
+	if exists {
+		// Readers that already opened the old body keep reading it.
+		oldPath := resourceFilepath(ds.rootPath, existing.ID, existing.BlobVersion)
+		if existing.Tier == tierCold {
+			oldPath = coldResourceFilepath(ds.coldRoot, existing.ID, existing.BlobVersion)
+		}
+		if existing.Tier == tierCold && ds.coldRoot == "" {
+			log.Printf("Left cold body of resource %d behind since there is no cold tier", existing.ID)
+		} else if err := os.Remove(oldPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove replaced body %s: %v", oldPath, err)
+		}
+	}
+	return nil
+}
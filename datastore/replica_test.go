@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Copies everything completed in src since cursor to dst, the way the
+// replication worker does, and returns the new cursor.
+func replicateAll(t *testing.T, src, dst FileDatastore, cursor ReplicaCursor) ReplicaCursor {
+	for {
+		cursors, err := src.FinishedAfter(cursor, time.Now().Add(time.Second), 3)
+		if err != nil {
+			t.Fatalf("Failed to list finished resources: %v", err)
+		}
+		if len(cursors) == 0 {
+			return cursor
+		}
+		for _, next := range cursors {
+			rr, f, err := src.OpenReplica(next.ID)
+			if err != nil {
+				t.Fatalf("Failed to open resource %d: %v", next.ID, err)
+			}
+			err = dst.PutReplica(rr, f)
+			f.Close()
+			if err != nil {
+				t.Fatalf("Failed to replicate resource %d: %v", next.ID, err)
+			}
+			cursor = next
+		}
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	srcRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	src, err := NewFileDatastore(path.Join(srcRoot, "knox.db"), srcRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	dstRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	dst, err := NewFileDatastore(path.Join(dstRoot, "knox.db"), dstRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+
+	var hrs []HttpResource
+	for i := 0; i < 8; i += 1 {
+		hr := randomHttpResource(r)
+		createHttpResource(t, &src, hr)
+		hrs = append(hrs, hr)
+	}
+	// Incomplete downloads aren't replicated.
+	incomplete := randomHttpResource(r)
+	if rw, err := src.TryCreate(incomplete.resourceUrl, incomplete.hashedUrl); err != nil || rw == nil {
+		t.Fatalf("Failed to create resource: %v", err)
+	}
+
+	cursor := replicateAll(t, src, dst, ReplicaCursor{})
+	for _, hr := range hrs {
+		if hr2 := readHttpResource(t, dst, hr.hashedUrl); !reflect.DeepEqual(hr, hr2) {
+			t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+		}
+	}
+	if status, err := dst.Status(incomplete.hashedUrl); err != nil || status != ResourceNotCached {
+		t.Errorf("Expected incomplete download not to be replicated. got = %v, %v", status, err)
+	}
+
+	if err := src.SaveReplicaCursor("dst", cursor); err != nil {
+		t.Fatalf("Failed to save cursor: %v", err)
+	}
+	if saved, err := src.ReplicaCursor("dst"); err != nil || saved.ID != cursor.ID || !saved.Finished.Equal(cursor.Finished) {
+		t.Errorf("Wrong saved cursor. got = %v, %v, want = %v", saved, err, cursor)
+	}
+	if saved, err := src.ReplicaCursor("elsewhere"); err != nil || saved != (ReplicaCursor{}) {
+		t.Errorf("Expected a zero cursor for a new target. got = %v, %v", saved, err)
+	}
+
+	// A refresh moves the resource past the cursor, and replicating it
+	// replaces the copy.
+	time.Sleep(10 * time.Millisecond)
+	rw, err := src.TryRefresh(hrs[0].hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to refresh resource: %v", err)
+	}
+	hrs[0].content = []byte("refreshed")
+	if err = rw.WriteHeaders(&hrs[0].headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	if _, err = rw.Write(hrs[0].content); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource writer: %v", err)
+	}
+	cursors, err := src.FinishedAfter(cursor, time.Now().Add(time.Second), 100)
+	if err != nil || len(cursors) != 1 {
+		t.Fatalf("Expected only the refreshed resource to be left. got = %v, %v", cursors, err)
+	}
+	replicateAll(t, src, dst, cursor)
+	if hr2 := readHttpResource(t, dst, hrs[0].hashedUrl); !reflect.DeepEqual(hrs[0], hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hrs[0], hr2)
+	}
+
+	srcStats, err := src.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if stats, err := dst.Stats(); err != nil || stats.RecordCount != int64(len(hrs)) || stats.DiskConsumptionBytes != srcStats.DiskConsumptionBytes {
+		t.Errorf("Wrong replica stats. got = %v, %v, want %d records and %d bytes", stats, err, len(hrs), srcStats.DiskConsumptionBytes)
+	}
+
+	// Bodies that don't match their metadata are refused.
+	rr, f, err := src.OpenReplica(cursors[0].ID)
+	if err != nil {
+		t.Fatalf("Failed to open resource: %v", err)
+	}
+	f.Close()
+	rr.DownloadFinished = time.Now()
+	if err := dst.PutReplica(rr, bytes.NewReader([]byte("corrupt"))); err == nil {
+		t.Errorf("Expected a corrupt body to be refused.")
+	}
+	if hr2 := readHttpResource(t, dst, hrs[0].hashedUrl); !reflect.DeepEqual(hrs[0], hr2) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hrs[0], hr2)
+	}
+}
@@ -0,0 +1,237 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Returned when opening a db last migrated by a newer version of knox.
+var ErrSchemaTooNew = errors.New("db schema is newer than this version of knox supports")
+
+// Returned by CheckSchema when the db has migrations left to apply.
+var ErrSchemaOutdated = errors.New("db schema is out of date; run knoxctl db upgrade")
+
+// A row for each migration that has been applied to the db.
+type schemaVersion struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// A change to the db, or to the files alongside it, that AutoMigrate can't
+// make on its own. Either func may be nil if there's nothing to do. Both are
+// run inside a transaction, and down must undo up, so that the db can be
+// handed back to the version of knox that came before.
+type migration struct {
+	version int
+	name    string
+	up      func(ds FileDatastore) error
+	down    func(ds FileDatastore) error
+}
+
+// In order of version, which starts at 1 and goes up by one each time. Never
+// change or remove a migration once it has been released; add another one.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "baseline",
+	},
+	{
+		version: 2,
+		name:    "shard resource files",
+		up: func(ds FileDatastore) error {
+			_, err := ds.moveResourceFiles(legacyResourceFilepath, resourceFilepath)
+			return err
+		},
+		down: func(ds FileDatastore) error {
+			_, err := ds.moveResourceFiles(resourceFilepath, legacyResourceFilepath)
+			return err
+		},
+	},
+	{
+		version: 3,
+		name:    "content type column",
+		up: func(ds FileDatastore) error {
+			return ds.backfillContentTypes()
+		},
+	},
+	{
+		version: 4,
+		name:    "host column",
+		up: func(ds FileDatastore) error {
+			return ds.backfillHosts()
+		},
+	},
+}
+
+// The schema version this version of knox expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func readSchemaVersion(db *gorm.DB) (int, error) {
+	var version int
+	result := db.Model(&schemaVersion{}).Select("coalesce(max(version), 0)").Scan(&version)
+	return version, result.Error
+}
+
+// Fails if the db was migrated by a newer version of knox. This has to be done
+// before AutoMigrate gets a chance to touch the schema.
+func checkSchemaNotNewer(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&schemaVersion{}) {
+		return nil
+	}
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("%w: db is at version %d, knox supports up to %d", ErrSchemaTooNew, version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// Records the schema version of dbs that don't have one yet. Fresh dbs are
+// created by AutoMigrate with the latest schema, so every migration counts as
+// applied. Dbs from before migrations were tracked are at the baseline.
+func initSchemaVersion(db *gorm.DB, fresh bool) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if result := tx.Model(&schemaVersion{}).Count(&count); result.Error != nil {
+			return result.Error
+		}
+		if count != 0 {
+			return nil
+		}
+		applied := migrations[:1]
+		if fresh {
+			applied = migrations
+		}
+		now := time.Now()
+		for _, m := range applied {
+			if result := tx.Create(&schemaVersion{m.version, m.name, now}); result.Error != nil {
+				return result.Error
+			}
+		}
+		return nil
+	})
+}
+
+// A copy of ds that goes through db, e.g. a transaction.
+func (ds FileDatastore) withDb(db *gorm.DB) FileDatastore {
+	ds.db = db
+	return ds
+}
+
+// The version of the schema the db is at.
+func (ds FileDatastore) SchemaVersion() (int, error) {
+	return readSchemaVersion(ds.db)
+}
+
+// Fails with ErrSchemaOutdated if the db has migrations left to apply.
+func (ds FileDatastore) CheckSchema() error {
+	version, err := ds.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < LatestSchemaVersion() {
+		return fmt.Errorf("%w: db is at version %d, knox needs %d", ErrSchemaOutdated, version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// Applies or reverts migrations, one transaction each, until the db is at
+// target. Nothing else may be using the datastore in the meantime.
+func (ds FileDatastore) MigrateSchema(target int) error {
+	if target < 1 || target > LatestSchemaVersion() {
+		return fmt.Errorf("no schema version %d; versions go from 1 to %d", target, LatestSchemaVersion())
+	}
+	version, err := ds.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	for version < target {
+		m := migrations[version]
+		log.Printf("Applying migration %d (%s)", m.version, m.name)
+		err := ds.db.Transaction(func(tx *gorm.DB) error {
+			if m.up != nil {
+				if err := m.up(ds.withDb(tx)); err != nil {
+					return err
+				}
+			}
+			return tx.Create(&schemaVersion{m.version, m.name, time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		version = m.version
+	}
+	for version > target {
+		m := migrations[version-1]
+		log.Printf("Reverting migration %d (%s)", m.version, m.name)
+		err := ds.db.Transaction(func(tx *gorm.DB) error {
+			if m.down != nil {
+				if err := m.down(ds.withDb(tx)); err != nil {
+					return err
+				}
+			}
+			return tx.Delete(&schemaVersion{}, m.version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		version = m.version - 1
+	}
+	return nil
+}
+
+// Fills in the content type column of resources cached before it existed from
+// their stored headers. Their status codes weren't kept anywhere, so those
+// stay unknown.
+func (ds FileDatastore) backfillContentTypes() error {
+	var rms []resourceMetadata
+	result := ds.db.Select("id", "response_headers").Where("content_type = ?", "").FindInBatches(&rms, 500, func(tx *gorm.DB, batch int) error {
+		for _, rm := range rms {
+			headers, err := readHeaders(rm.ResponseHeaders)
+			if err != nil {
+				return err
+			}
+			contentType := headerMediaType(headers)
+			if contentType == "" {
+				continue
+			}
+			if result := ds.db.Model(&resourceMetadata{}).Where("id = ?", rm.ID).Update("content_type", contentType); result.Error != nil {
+				return result.Error
+			}
+		}
+		return nil
+	})
+	return result.Error
+}
+
+// Fills in the host column of resources cached before it existed from their
+// URLs.
+func (ds FileDatastore) backfillHosts() error {
+	var rms []resourceMetadata
+	result := ds.db.Select("id", "url").Where("host = ?", "").FindInBatches(&rms, 500, func(tx *gorm.DB, batch int) error {
+		for _, rm := range rms {
+			host := resourceHost(rm.Url)
+			if host == "" {
+				continue
+			}
+			if result := ds.db.Model(&resourceMetadata{}).Where("id = ?", rm.ID).Update("host", host); result.Error != nil {
+				return result.Error
+			}
+		}
+		return nil
+	})
+	return result.Error
+}
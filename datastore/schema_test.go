@@ -0,0 +1,203 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestFreshSchema(t *testing.T) {
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	if version, err := ds.SchemaVersion(); err != nil || version != LatestSchemaVersion() {
+		t.Errorf("Expected a fresh db to be at the latest version. got = %d, %v, want = %d", version, err, LatestSchemaVersion())
+	}
+	if err := ds.CheckSchema(); err != nil {
+		t.Errorf("Expected a fresh db to pass the schema check. got = %v", err)
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	dbPath := path.Join(datastoreRoot, "knox.db")
+	ds, err := NewFileDatastore(dbPath, datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	var hrs []HttpResource
+	for i := 0; i < 8; i += 1 {
+		hr := randomHttpResource(r)
+		createHttpResource(t, &ds, hr)
+		hrs = append(hrs, hr)
+	}
+
+	// Make it look like a db from before migrations were tracked.
+	var rms []resourceMetadata
+	if result := ds.db.Find(&rms); result.Error != nil {
+		t.Fatalf("Failed to list resources: %v", result.Error)
+	}
+	for _, rm := range rms {
+		oldPath := legacyResourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion)
+		if err := os.Rename(resourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion), oldPath); err != nil {
+			t.Fatalf("Failed to move resource file: %v", err)
+		}
+	}
+	if err := ds.db.Migrator().DropTable(&schemaVersion{}); err != nil {
+		t.Fatalf("Failed to drop schema_version: %v", err)
+	}
+	ds.Close()
+	ds, err = NewFileDatastore(dbPath, datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileDatastore: %v", err)
+	}
+	if version, err := ds.SchemaVersion(); err != nil || version != 1 {
+		t.Fatalf("Expected an untracked db to be at the baseline. got = %d, %v", version, err)
+	}
+	if err := ds.CheckSchema(); !errors.Is(err, ErrSchemaOutdated) {
+		t.Fatalf("Wrong schema check result. got = %v, want = %v", err, ErrSchemaOutdated)
+	}
+
+	if err := ds.MigrateSchema(LatestSchemaVersion()); err != nil {
+		t.Fatalf("Failed to upgrade: %v", err)
+	}
+	if err := ds.CheckSchema(); err != nil {
+		t.Errorf("Expected the upgraded db to pass the schema check. got = %v", err)
+	}
+	for _, hr := range hrs {
+		hr2 := readHttpResource(t, ds, hr.hashedUrl)
+		if !reflect.DeepEqual(hr, hr2) {
+			t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+		}
+	}
+
+	// And back again.
+	if err := ds.MigrateSchema(1); err != nil {
+		t.Fatalf("Failed to downgrade: %v", err)
+	}
+	if version, err := ds.SchemaVersion(); err != nil || version != 1 {
+		t.Errorf("Wrong version after downgrading. got = %d, %v", version, err)
+	}
+	for _, rm := range rms {
+		if _, err := os.Stat(legacyResourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion)); err != nil {
+			t.Errorf("Expected resource files to be moved back. got = %v", err)
+		}
+	}
+	if err := ds.MigrateSchema(0); err == nil {
+		t.Errorf("Expected downgrading past the baseline to fail.")
+	}
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	dbPath := path.Join(datastoreRoot, "knox.db")
+	ds, err := NewFileDatastore(dbPath, datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	if result := ds.db.Create(&schemaVersion{Version: LatestSchemaVersion() + 1, Name: "from the future"}); result.Error != nil {
+		t.Fatalf("Failed to record migration: %v", result.Error)
+	}
+	ds.Close()
+	if _, err := NewFileDatastore(dbPath, datastoreRoot); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Wrong error opening a newer db. got = %v, want = %v", err, ErrSchemaTooNew)
+	}
+}
+
+func TestBackfillContentTypes(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	dbPath := path.Join(datastoreRoot, "knox.db")
+	ds, err := NewFileDatastore(dbPath, datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	contentTypes := []string{"Text/HTML; charset=utf-8", "image/png", "", "not a type"}
+	for _, contentType := range contentTypes {
+		hr := randomHttpResource(r)
+		hr.headers = http.Header{}
+		if contentType != "" {
+			hr.headers.Set("Content-Type", contentType)
+		}
+		createHttpResource(t, &ds, hr)
+	}
+	want := []string{"text/html", "image/png", "", ""}
+	contentTypesInDb := func() []string {
+		var got []string
+		ds.db.Model(&resourceMetadata{}).Order("id").Pluck("content_type", &got)
+		return got
+	}
+	if got := contentTypesInDb(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong content types recorded. got = %q, want = %q", got, want)
+	}
+
+	// Make it look like a db from before the column existed.
+	ds.db.Model(&resourceMetadata{}).Where("1 = 1").Update("content_type", "")
+	ds.db.Where("version >= ?", 3).Delete(&schemaVersion{})
+	if err := ds.CheckSchema(); !errors.Is(err, ErrSchemaOutdated) {
+		t.Fatalf("Wrong schema check result. got = %v, want = %v", err, ErrSchemaOutdated)
+	}
+	if err := ds.MigrateSchema(LatestSchemaVersion()); err != nil {
+		t.Fatalf("Failed to upgrade: %v", err)
+	}
+	if got := contentTypesInDb(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong content types after upgrading. got = %q, want = %q", got, want)
+	}
+}
+
+func TestBackfillHosts(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	urls := []string{"https://Blog.example:8443/post", "POST 00 https://api.example/search", "not a url"}
+	for _, resourceUrl := range urls {
+		hr := randomHttpResource(r)
+		hr.resourceUrl = resourceUrl
+		createHttpResource(t, &ds, hr)
+	}
+	want := []string{"blog.example", "api.example", ""}
+	hostsInDb := func() []string {
+		var got []string
+		ds.db.Model(&resourceMetadata{}).Order("id").Pluck("host", &got)
+		return got
+	}
+	if got := hostsInDb(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong hosts recorded. got = %q, want = %q", got, want)
+	}
+
+	// Make it look like a db from before the column existed.
+	ds.db.Model(&resourceMetadata{}).Where("1 = 1").Update("host", "")
+	ds.db.Delete(&schemaVersion{}, 4)
+	if err := ds.MigrateSchema(LatestSchemaVersion()); err != nil {
+		t.Fatalf("Failed to upgrade: %v", err)
+	}
+	if got := hostsInDb(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong hosts after upgrading. got = %q, want = %q", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Wrap each match within SearchResult.Snippet. Neither can appear in indexed
+// text.
+const SnippetMatchStart = "\x02"
+const SnippetMatchEnd = "\x03"
+
+// How many tokens of context a snippet includes.
+const snippetTokens = 24
+
+// The searchable text of cached pages, keyed by resource id. FTS4 rather than
+// FTS5 since go-sqlite3 only includes the latter behind a build tag.
+const createResourceTextsTable = "CREATE VIRTUAL TABLE IF NOT EXISTS resource_texts USING fts4(title, body)"
+
+var snippetMarkerStripper = strings.NewReplacer(SnippetMatchStart, "", SnippetMatchEnd, "")
+
+type SearchResult struct {
+	Url             string
+	Title           string
+	DownloadStarted time.Time
+
+	// An excerpt of the text around the matches.
+	Snippet string
+}
+
+type IndexedPage struct {
+	Url              string
+	Title            string
+	DownloadFinished time.Time
+}
+
+// Turns free text into a query for documents containing every term, so that
+// stray quotes or operators in it can't make the query malformed.
+func ftsQuery(query string) string {
+	var terms []string
+	for _, term := range strings.Fields(query) {
+		term = strings.ReplaceAll(term, "\"", "")
+		if term != "" {
+			terms = append(terms, "\""+term+"\"")
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+func (ds FileDatastore) IndexText(hashedUrl string, title string, text string) error {
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		rm := resourceMetadata{}
+		result := tx.Select("id").First(&rm, "hashed_url = ? AND download_complete = ?", hashedUrl, true)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrResourceNotCached
+		} else if result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Exec("DELETE FROM resource_texts WHERE docid = ?", rm.ID); result.Error != nil {
+			return result.Error
+		}
+		title = snippetMarkerStripper.Replace(title)
+		text = snippetMarkerStripper.Replace(text)
+		return tx.Exec("INSERT INTO resource_texts (docid, title, body) VALUES (?, ?, ?)", rm.ID, title, text).Error
+	})
+}
+
+func (ds FileDatastore) Search(query string, offset, count int) ([]SearchResult, error) {
+	match := ftsQuery(query)
+	if match == "" {
+		return nil, nil
+	}
+	var results []SearchResult
+	result := ds.db.Raw(`SELECT resource_metadata.url, resource_metadata.download_started, resource_texts.title,
+			snippet(resource_texts, ?, ?, '...', -1, ?) AS snippet
+		FROM resource_texts JOIN resource_metadata ON resource_metadata.id = resource_texts.docid
+		WHERE resource_texts MATCH ? AND resource_metadata.deleted_at IS NULL
+		ORDER BY resource_metadata.download_started DESC
+		LIMIT ? OFFSET ?`,
+		SnippetMatchStart, SnippetMatchEnd, snippetTokens, match, count, offset).Scan(&results)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return results, nil
+}
+
+func (ds FileDatastore) RecentPages(count int) ([]IndexedPage, error) {
+	var pages []IndexedPage
+	result := ds.db.Raw(`SELECT resource_metadata.url, resource_metadata.download_finished, resource_texts.title
+		FROM resource_texts JOIN resource_metadata ON resource_metadata.id = resource_texts.docid
+		WHERE resource_metadata.deleted_at IS NULL
+		ORDER BY resource_metadata.download_finished DESC
+		LIMIT ?`, count).Scan(&pages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return pages, nil
+}
@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	gardening := randomHttpResource(r)
+	createHttpResource(t, &ds, gardening)
+	cooking := randomHttpResource(r)
+	createHttpResource(t, &ds, cooking)
+	if err := ds.IndexText(gardening.hashedUrl, "Gardening", "Tomatoes need plenty of sun and water."); err != nil {
+		t.Fatalf("Failed to index text: %v", err)
+	}
+	if err := ds.IndexText(cooking.hashedUrl, "Cooking", "Roast the tomatoes with garlic."); err != nil {
+		t.Fatalf("Failed to index text: %v", err)
+	}
+	if err := ds.IndexText(randomHttpResource(r).hashedUrl, "Missing", "text"); err != ErrResourceNotCached {
+		t.Errorf("Expected uncached resource not to be indexed. got = %v", err)
+	}
+
+	results, err := ds.Search("tomatoes", 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Wrong number of results. got = %v", results)
+	}
+	// Most recently downloaded first.
+	if results[0].Url != cooking.resourceUrl || results[0].Title != "Cooking" {
+		t.Errorf("Wrong first result. got = %v", results[0])
+	}
+	want := "Roast the " + SnippetMatchStart + "tomatoes" + SnippetMatchEnd + " with garlic."
+	if results[0].Snippet != want {
+		t.Errorf("Wrong snippet. got = %q, want = %q", results[0].Snippet, want)
+	}
+
+	// Every term has to match, and operators are taken literally.
+	if results, err = ds.Search("tomatoes \"sun", 0, 10); err != nil || len(results) != 1 || results[0].Url != gardening.resourceUrl {
+		t.Errorf("Wrong results for multiple terms. got = %v, %v", results, err)
+	}
+	if results, err = ds.Search("sun OR garlic", 0, 10); err != nil || len(results) != 0 {
+		t.Errorf("Expected no results. got = %v, %v", results, err)
+	}
+
+	pages, err := ds.RecentPages(10)
+	if err != nil {
+		t.Fatalf("Failed to list recent pages: %v", err)
+	}
+	if len(pages) != 2 || pages[0].Url != cooking.resourceUrl || pages[0].Title != "Cooking" || pages[1].Url != gardening.resourceUrl {
+		t.Errorf("Wrong recent pages. got = %v", pages)
+	}
+	if pages, err = ds.RecentPages(1); err != nil || len(pages) != 1 {
+		t.Errorf("Expected count to limit recent pages. got = %v, %v", pages, err)
+	}
+
+	// Reindexing replaces the old text.
+	if err := ds.IndexText(cooking.hashedUrl, "Cooking", "Roast the peppers."); err != nil {
+		t.Fatalf("Failed to index text: %v", err)
+	}
+	if results, err = ds.Search("tomatoes", 0, 10); err != nil || len(results) != 1 {
+		t.Errorf("Expected reindexed text to be replaced. got = %v, %v", results, err)
+	}
+
+	if err := ds.Delete(gardening.hashedUrl); err != nil {
+		t.Fatalf("Failed to delete resource: %v", err)
+	}
+	if results, err = ds.Search("tomatoes", 0, 10); err != nil || len(results) != 0 {
+		t.Errorf("Expected deleted resource not to be found. got = %v, %v", results, err)
+	}
+}
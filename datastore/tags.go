@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"sort"
+
+	"gorm.io/gorm/clause"
+)
+
+// Tags are keyed by hashed URL rather than by resource so that they can be
+// given to a resource before it is cached.
+type resourceTag struct {
+	ID        uint   `gorm:"primarykey"`
+	HashedUrl string `gorm:"uniqueIndex:idx_resource_tag"`
+	Tag       string `gorm:"uniqueIndex:idx_resource_tag"`
+}
+
+// Adds tags to a resource, cached or not. Tags it already has are ignored.
+func (ds FileDatastore) AddTags(hashedUrl string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	rows := make([]resourceTag, 0, len(tags))
+	for _, tag := range tags {
+		rows = append(rows, resourceTag{HashedUrl: hashedUrl, Tag: tag})
+	}
+	return ds.db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(rows, 100).Error
+}
+
+// Lists the tags of a resource alphabetically.
+func (ds FileDatastore) Tags(hashedUrl string) ([]string, error) {
+	var tags []string
+	result := ds.db.Model(&resourceTag{}).Where("hashed_url = ?", hashedUrl).Pluck("tag", &tags)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (ds FileDatastore) TagsOf(hashedUrls []string) (map[string][]string, error) {
+	tags := map[string][]string{}
+	if len(hashedUrls) == 0 {
+		return tags, nil
+	}
+	var rows []resourceTag
+	result := ds.db.Where("hashed_url IN ?", hashedUrls).Order("hashed_url, tag").Find(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for _, row := range rows {
+		tags[row.HashedUrl] = append(tags[row.HashedUrl], row.Tag)
+	}
+	return tags, nil
+}
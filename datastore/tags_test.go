@@ -0,0 +1,82 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	hr := randomHttpResource(r)
+
+	// Tags may be given before the resource is cached.
+	if err := ds.AddTags(hr.hashedUrl, []string{"recipes", "Bookmarks bar"}); err != nil {
+		t.Fatalf("Failed to add tags: %v", err)
+	}
+	createHttpResource(t, &ds, hr)
+	if err := ds.AddTags(hr.hashedUrl, []string{"recipes", "dessert"}); err != nil {
+		t.Fatalf("Failed to add tags: %v", err)
+	}
+	tags, err := ds.Tags(hr.hashedUrl)
+	if err != nil {
+		t.Fatalf("Failed to get tags: %v", err)
+	}
+	expected := []string{"Bookmarks bar", "dessert", "recipes"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Wrong tags. got = %v, want = %v", tags, expected)
+	}
+
+	if err := ds.Delete(hr.hashedUrl); err != nil {
+		t.Fatalf("Failed to delete resource: %v", err)
+	}
+	if tags, err = ds.Tags(hr.hashedUrl); err != nil || len(tags) != 0 {
+		t.Errorf("Expected tags to be deleted with the resource. got = %v, %v", tags, err)
+	}
+}
+
+func TestTagsOf(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	var hrs []HttpResource
+	for i := 0; i < 3; i += 1 {
+		hr := randomHttpResource(r)
+		createHttpResource(t, &ds, hr)
+		hrs = append(hrs, hr)
+	}
+	if err := ds.AddTags(hrs[0].hashedUrl, []string{"recipes", "dessert"}); err != nil {
+		t.Fatalf("Failed to add tags: %v", err)
+	}
+	if err := ds.AddTags(hrs[2].hashedUrl, []string{"news"}); err != nil {
+		t.Fatalf("Failed to add tags: %v", err)
+	}
+	// The third resource isn't asked about.
+	tags, err := ds.TagsOf([]string{hrs[0].hashedUrl, hrs[1].hashedUrl})
+	if err != nil {
+		t.Fatalf("Failed to get tags: %v", err)
+	}
+	want := map[string][]string{hrs[0].hashedUrl: {"dessert", "recipes"}}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("Wrong tags. got = %v, want = %v", tags, want)
+	}
+	if tags, err := ds.TagsOf(nil); err != nil || len(tags) != 0 {
+		t.Errorf("Expected no tags for no resources. got = %v, %v", tags, err)
+	}
+}
@@ -0,0 +1,347 @@
+package datastore
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"gorm.io/gorm"
+)
+
+// The tiers a resource's body can be stored in. Hot bodies are gzipped in the
+// datastore root. Cold bodies are recompressed with zstd at its highest level
+// and kept under the cold tier root, which may be on cheaper, slower storage,
+// e.g. a mounted bucket.
+const (
+	tierHot  = ""
+	tierCold = "cold"
+)
+
+// Returned when a resource is in the cold tier but the datastore wasn't given
+// one.
+var ErrNoColdTier = errors.New("resource is in the cold tier, which isn't configured")
+
+// Returns a copy of ds that offloads bodies to, and fetches them back from, a
+// cold tier rooted at coldRoot.
+func (ds FileDatastore) WithColdTier(coldRoot string) FileDatastore {
+	if coldRoot != "" && !strings.HasSuffix(coldRoot, "/") {
+		coldRoot += "/"
+	}
+	ds.coldRoot = coldRoot
+	return ds
+}
+
+func coldResourceFilepath(coldRoot string, resourceId uint, blobVersion int) string {
+	return resourceFilepath(coldRoot, resourceId, blobVersion) + ".zst"
+}
+
+func (ds FileDatastore) coldFilepath(rm resourceMetadata) (string, error) {
+	if ds.coldRoot == "" {
+		return "", ErrNoColdTier
+	}
+	return coldResourceFilepath(ds.coldRoot, rm.ID, rm.BlobVersion), nil
+}
+
+// Writes everything read from r to a new file at filePath through compress,
+// which wraps the file in an encoder. The file is written under a temporary
+// name and renamed into place once it is complete. Returns the size of the
+// file and the hex-encoded SHA-256 of its contents.
+func writeBlob(filePath string, r io.Reader, compress func(w io.Writer) (io.WriteCloser, error)) (int64, string, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return 0, "", err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".tmp-")
+	if err != nil {
+		return 0, "", err
+	}
+	tempPath := f.Name()
+	defer os.Remove(tempPath)
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(f, h)}
+	err = func() error {
+		cw, err := compress(counter)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(cw, r); err != nil {
+			cw.Close()
+			return err
+		}
+		return cw.Close()
+	}()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return 0, "", err
+	}
+	return counter.n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+func gzipCompressor(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func zstdCompressor(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+}
+
+// Adapts a zstd decoder, whose Close doesn't return an error, to an
+// io.ReadCloser that also closes the file it reads from.
+type zstdFileReader struct {
+	*zstd.Decoder
+	f *os.File
+}
+
+func (zr zstdFileReader) Close() error {
+	zr.Decoder.Close()
+	return zr.f.Close()
+}
+
+// Opens a cold body, decompressing it as it is read.
+func openColdBlob(filePath string) (io.ReadCloser, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	d, err := zstd.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return zstdFileReader{d, f}, nil
+}
+
+// Writes the body of the cold resource rm to filePath in the hot format.
+func (ds FileDatastore) writeHotCopy(rm resourceMetadata, filePath string) (int64, string, error) {
+	coldPath, err := ds.coldFilepath(rm)
+	if err != nil {
+		return 0, "", err
+	}
+	body, err := openColdBlob(coldPath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer body.Close()
+	return writeBlob(filePath, body, gzipCompressor)
+}
+
+// Takes the lease on a completed resource that nobody is downloading or
+// refreshing, so that its body can be moved between tiers. Returns false if
+// somebody holds the lease.
+func (ds FileDatastore) tryLeaseForMove(rm resourceMetadata) (bool, error) {
+	now := time.Now()
+	result := ds.db.Model(&resourceMetadata{}).
+		Where("id = ? AND blob_version = ? AND tier = ? AND download_complete = ? AND (lease_owner = ? OR lease_expiry < ?)", rm.ID, rm.BlobVersion, rm.Tier, true, "", now).
+		Updates(map[string]interface{}{
+			"lease_owner":  ds.ownerId,
+			"lease_expiry": now.Add(ds.leaseDuration),
+		})
+	return result.RowsAffected != 0, result.Error
+}
+
+func (ds FileDatastore) releaseLease(id uint) {
+	result := ds.db.Model(&resourceMetadata{}).Where("id = ? AND lease_owner = ?", id, ds.ownerId).Update("lease_owner", "")
+	if result.Error != nil {
+		log.Printf("Failed to release lease on resource %d: %v", id, result.Error)
+	}
+}
+
+// Moves the body of rm, which has to be hot, to the cold tier. Returns false
+// if the resource is busy or has changed since rm was read.
+func (ds FileDatastore) freeze(rm resourceMetadata) (bool, error) {
+	coldPath, err := ds.coldFilepath(rm)
+	if err != nil {
+		return false, err
+	}
+	if leased, err := ds.tryLeaseForMove(rm); err != nil || !leased {
+		return false, err
+	}
+	defer ds.releaseLease(rm.ID)
+	hotPath := resourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion)
+	hot, err := os.Open(hotPath)
+	if err != nil {
+		return false, err
+	}
+	body, err := gzip.NewReader(hot)
+	if err != nil {
+		hot.Close()
+		return false, err
+	}
+	size, _, err := writeBlob(coldPath, body, zstdCompressor)
+	hot.Close()
+	if err != nil {
+		return false, err
+	}
+	err = ds.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&resourceMetadata{}).Where("id = ? AND lease_owner = ?", rm.ID, ds.ownerId).Updates(map[string]interface{}{
+			"tier":          tierCold,
+			"bytes_on_disk": size,
+			"lease_owner":   "",
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrLeaseLost
+		}
+		return updateGlobalStats(tx, 0, size-int64(rm.BytesOnDisk))
+	})
+	if err != nil {
+		os.Remove(coldPath)
+		return false, err
+	}
+	// Readers that already opened the hot body keep reading it.
+	if err := os.Remove(hotPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove offloaded body %s: %v", hotPath, err)
+	}
+	return true, nil
+}
+
+// Moves the body of rm, which has to be cold, back to the hot tier, and
+// returns the resource as it is afterwards. Returns nil if the resource is
+// busy or has changed since rm was read. The body is recompressed, so its
+// content hash changes.
+func (ds FileDatastore) thaw(rm resourceMetadata) (*resourceMetadata, error) {
+	coldPath, err := ds.coldFilepath(rm)
+	if err != nil {
+		return nil, err
+	}
+	if leased, err := ds.tryLeaseForMove(rm); err != nil || !leased {
+		return nil, err
+	}
+	defer ds.releaseLease(rm.ID)
+	// Written as a new version, like a refresh, so that the path isn't
+	// reused by anything that saw the resource before it went cold.
+	blobVersion := rm.BlobVersion + 1
+	hotPath := resourceFilepath(ds.rootPath, rm.ID, blobVersion)
+	size, contentHash, err := ds.writeHotCopy(rm, hotPath)
+	if err != nil {
+		return nil, err
+	}
+	err = ds.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&resourceMetadata{}).Where("id = ? AND lease_owner = ?", rm.ID, ds.ownerId).Updates(map[string]interface{}{
+			"tier":               tierHot,
+			"blob_version":       blobVersion,
+			"bytes_on_disk":      size,
+			"content_hash":       contentHash,
+			"lease_owner":        "",
+			"single_gzip_member": true,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrLeaseLost
+		}
+		return updateGlobalStats(tx, 0, size-int64(rm.BytesOnDisk))
+	})
+	if err != nil {
+		os.Remove(hotPath)
+		return nil, err
+	}
+	if err := os.Remove(coldPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove cold body %s: %v", coldPath, err)
+	}
+	rm.Tier = tierHot
+	rm.BlobVersion = blobVersion
+	rm.BytesOnDisk = int(size)
+	rm.ContentHash = contentHash
+	rm.SingleGzipMember = true
+	return &rm, nil
+}
+
+// Opens the body of rm, moving it back to the hot tier first if it is cold.
+// If the resource is too busy to move, its cold body is read directly.
+func (ds FileDatastore) openBody(rm resourceMetadata) (io.ReadCloser, resourceMetadata, error) {
+	if rm.Tier == tierCold {
+		thawed, err := ds.thaw(rm)
+		if err != nil {
+			return nil, rm, err
+		}
+		if thawed == nil {
+			coldPath, err := ds.coldFilepath(rm)
+			if err != nil {
+				return nil, rm, err
+			}
+			body, err := openColdBlob(coldPath)
+			return body, rm, err
+		}
+		rm = *thawed
+	}
+	f, err := os.Open(resourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion))
+	if err != nil {
+		return nil, rm, err
+	}
+	g, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, rm, err
+	}
+	return gzipFileReader{g, f}, rm, nil
+}
+
+// Closes the file a gzip reader reads from along with the reader.
+type gzipFileReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (gr gzipFileReader) Close() error {
+	gr.Reader.Close()
+	return gr.f.Close()
+}
+
+// Moves the bodies of up to count hot resources that haven't been accessed
+// or downloaded since idleSince to the cold tier, the least recently accessed
+// first. Returns how many were moved.
+func (ds FileDatastore) OffloadIdle(idleSince time.Time, count int) (int, error) {
+	if ds.coldRoot == "" {
+		return 0, ErrNoColdTier
+	}
+	var rms []resourceMetadata
+	result := ds.db.
+		Where("tier = ? AND download_complete = ? AND last_accessed < ? AND download_finished < ?", tierHot, true, idleSince, idleSince).
+		Where("lease_owner = ? OR lease_expiry < ?", "", time.Now()).
+		Order("last_accessed, id").
+		Limit(count).
+		Find(&rms)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	moved := 0
+	for _, rm := range rms {
+		frozen, err := ds.freeze(rm)
+		if err != nil {
+			return moved, fmt.Errorf("failed to offload resource %d: %v", rm.ID, err)
+		}
+		if frozen {
+			moved += 1
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,169 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func wantDiskBytes(t *testing.T, ds FileDatastore) {
+	var wantBytes int
+	ds.db.Model(&resourceMetadata{}).Select("coalesce(sum(bytes_on_disk), 0)").Scan(&wantBytes)
+	if stats, err := ds.Stats(); err != nil || stats.DiskConsumptionBytes != wantBytes {
+		t.Errorf("Wrong disk usage. got = %v, %v, want %d bytes", stats, err, wantBytes)
+	}
+}
+
+func TestColdTier(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	coldRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	beforeCreation := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	var hrs []HttpResource
+	for i := 0; i < 4; i += 1 {
+		hr := randomHttpResource(r)
+		createHttpResource(t, &ds, hr)
+		hrs = append(hrs, hr)
+	}
+	if _, err := ds.OffloadIdle(time.Now().Add(time.Second), 10); err != ErrNoColdTier {
+		t.Errorf("Expected offloading without a cold tier to fail. got = %v", err)
+	}
+
+	ds = ds.WithColdTier(coldRoot)
+	if moved, err := ds.OffloadIdle(beforeCreation, 2); err != nil || moved != 0 {
+		t.Fatalf("Expected nothing to be idle yet. got = %d, %v", moved, err)
+	}
+	idleSince := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	// Resources accessed since then stay hot.
+	if err := ds.RecordAccess(hrs[3].hashedUrl, true); err != nil {
+		t.Fatalf("Failed to record access: %v", err)
+	}
+	if err := ds.FlushAccesses(); err != nil {
+		t.Fatalf("Failed to flush accesses: %v", err)
+	}
+	if moved, err := ds.OffloadIdle(idleSince, 2); err != nil || moved != 2 {
+		t.Fatalf("Failed to offload. got = %d, %v", moved, err)
+	}
+	if moved, err := ds.OffloadIdle(idleSince, 10); err != nil || moved != 1 {
+		t.Fatalf("Failed to offload. got = %d, %v", moved, err)
+	}
+	var rms []resourceMetadata
+	ds.db.Order("id").Find(&rms)
+	for i, rm := range rms {
+		wantCold := i != 3
+		if (rm.Tier == tierCold) != wantCold {
+			t.Errorf("Wrong tier for resource %d. got = %q", i, rm.Tier)
+		}
+		_, hotErr := os.Stat(resourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion))
+		_, coldErr := os.Stat(coldResourceFilepath(ds.coldRoot, rm.ID, rm.BlobVersion))
+		if wantCold != (os.IsNotExist(hotErr) && coldErr == nil) {
+			t.Errorf("Wrong files for resource %d. got hot = %v, cold = %v", i, hotErr, coldErr)
+		}
+	}
+	wantDiskBytes(t, ds)
+	ri, err := ds.List(0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list resources: %v", err)
+	}
+	cold := 0
+	for ri.HasNext() {
+		metadata, err := ri.Next()
+		if err != nil {
+			t.Fatalf("Failed to list resource: %v", err)
+		}
+		if metadata.Cold {
+			cold += 1
+		}
+	}
+	if cold != 3 {
+		t.Errorf("Wrong number of cold resources listed. got = %d, want = 3", cold)
+	}
+
+	// Opening a cold resource brings it back.
+	if hr := readHttpResource(t, ds, hrs[0].hashedUrl); !reflect.DeepEqual(hrs[0], hr) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hrs[0], hr)
+	}
+	var rm resourceMetadata
+	ds.db.First(&rm, rms[0].ID)
+	if rm.Tier != tierHot || rm.BlobVersion != rms[0].BlobVersion+1 {
+		t.Errorf("Expected the resource to be hot again. got tier = %q, version = %d", rm.Tier, rm.BlobVersion)
+	}
+	if _, err := os.Stat(coldResourceFilepath(ds.coldRoot, rms[0].ID, rms[0].BlobVersion)); !os.IsNotExist(err) {
+		t.Errorf("Expected the cold body to be removed. got = %v", err)
+	}
+	if size, contentHash, err := hashFile(resourceFilepath(ds.rootPath, rm.ID, rm.BlobVersion)); err != nil || int(size) != rm.BytesOnDisk || contentHash != rm.ContentHash {
+		t.Errorf("Wrong size or hash of the hot body. got = %d, %s, %v, want = %d, %s", size, contentHash, err, rm.BytesOnDisk, rm.ContentHash)
+	}
+
+	// Cold resources are copied hot into backups, which don't need the cold
+	// tier.
+	backupDir := path.Join(datastoreRoot, "backup")
+	if err := ds.Backup(backupDir); err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	restoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	restoreDb := path.Join(restoreRoot, "knox.db")
+	if err := Restore(backupDir, restoreDb, restoreRoot, DefaultSqliteOptions()); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	restored, err := NewFileDatastore(restoreDb, restoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to open restored FileDatastore: %v", err)
+	}
+	for _, hr := range hrs {
+		if hr2 := readHttpResource(t, restored, hr.hashedUrl); !reflect.DeepEqual(hr, hr2) {
+			t.Fatalf("Expected:\n%v\ngot:\n%v", hr, hr2)
+		}
+	}
+	wantDiskBytes(t, restored)
+
+	// A refresh replaces a cold body with a hot one.
+	rw, err := ds.TryRefresh(hrs[1].hashedUrl)
+	if err != nil || rw == nil {
+		t.Fatalf("Failed to refresh resource: %v", err)
+	}
+	hrs[1].content = []byte("refreshed")
+	if err = rw.WriteHeaders(&hrs[1].headers); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	if _, err = rw.Write(hrs[1].content); err != nil {
+		t.Fatalf("Failed to write body: %v", err)
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatalf("Failed to close resource writer: %v", err)
+	}
+	if _, err := os.Stat(coldResourceFilepath(ds.coldRoot, rms[1].ID, rms[1].BlobVersion)); !os.IsNotExist(err) {
+		t.Errorf("Expected the cold body to be removed. got = %v", err)
+	}
+	if hr := readHttpResource(t, ds, hrs[1].hashedUrl); !reflect.DeepEqual(hrs[1], hr) {
+		t.Fatalf("Expected:\n%v\ngot:\n%v", hrs[1], hr)
+	}
+
+	// Deleting a cold resource removes its cold body.
+	if err := ds.Delete(hrs[2].hashedUrl); err != nil {
+		t.Fatalf("Failed to delete resource: %v", err)
+	}
+	if _, err := os.Stat(coldResourceFilepath(ds.coldRoot, rms[2].ID, rms[2].BlobVersion)); !os.IsNotExist(err) {
+		t.Errorf("Expected the cold body to be removed. got = %v", err)
+	}
+	wantDiskBytes(t, ds)
+}
@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// The disk used by, and the accesses to, the cached resources sharing a host
+// or content type.
+type UsageGroup struct {
+	Name          string
+	ResourceCount int
+	BytesOnDisk   int
+	AccessCount   int64
+}
+
+type DiskUsage struct {
+	ByHost        []UsageGroup
+	ByContentType []UsageGroup
+}
+
+// Lists cached resources, those using the most disk first.
+func (ds FileDatastore) Largest(offset, count int) (ResourceIterator, error) {
+	var rms []resourceMetadata
+	result := ds.db.Where("download_complete = ?", true).Limit(count).Offset(offset).Order("bytes_on_disk desc").Find(&rms)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &fileResourceIterator{ds.rootPath, &rms, 0}, nil
+}
+
+// The host a resource is stored and counted under, or "" if it has none. Keys
+// of requests other than plain GETs end in the URL the request was made to.
+func resourceHost(resourceUrl string) string {
+	fields := strings.Fields(resourceUrl)
+	if len(fields) == 0 {
+		return ""
+	}
+	parsedUrl, err := url.Parse(fields[len(fields)-1])
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsedUrl.Hostname())
+}
+
+func sortedUsageGroups(groups map[string]*UsageGroup) []UsageGroup {
+	sorted := make([]UsageGroup, 0, len(groups))
+	for _, group := range groups {
+		sorted = append(sorted, *group)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].BytesOnDisk != sorted[j].BytesOnDisk {
+			return sorted[i].BytesOnDisk > sorted[j].BytesOnDisk
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// Breaks down the disk used by cached resources by host and by content type,
+// the largest groups first.
+func (ds FileDatastore) DiskUsage() (DiskUsage, error) {
+	byHost, err := ds.usageBy("host")
+	if err != nil {
+		return DiskUsage{}, err
+	}
+	byContentType, err := ds.usageBy("content_type")
+	if err != nil {
+		return DiskUsage{}, err
+	}
+	return DiskUsage{byHost, byContentType}, nil
+}
+
+// Groups cached resources by the value of column, the largest groups first.
+func (ds FileDatastore) usageBy(column string) ([]UsageGroup, error) {
+	var rows []struct {
+		Name          string
+		ResourceCount int
+		BytesOnDisk   int
+		AccessCount   int64
+	}
+	result := ds.db.Model(&resourceMetadata{}).
+		Select(column+" AS name, count(*) AS resource_count, coalesce(sum(bytes_on_disk), 0) AS bytes_on_disk, coalesce(sum(access_count), 0) AS access_count").
+		Where("download_complete = ?", true).
+		Group(column).
+		Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	groups := map[string]*UsageGroup{}
+	for _, row := range rows {
+		name := row.Name
+		if name == "" {
+			name = "(none)"
+		}
+		groups[name] = &UsageGroup{name, row.ResourceCount, row.BytesOnDisk, row.AccessCount}
+	}
+	return sortedUsageGroups(groups), nil
+}
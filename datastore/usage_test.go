@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	datastoreRoot, err := ioutil.TempDir("", "knox-datastore-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	ds, err := NewFileDatastore(path.Join(datastoreRoot, "knox.db"), datastoreRoot)
+	if err != nil {
+		t.Fatalf("Failed to create FileDatastore: %v", err)
+	}
+	resource := func(resourceUrl string, contentType string, size int) HttpResource {
+		headers := http.Header{}
+		if contentType != "" {
+			headers.Set("Content-Type", contentType)
+		}
+		// Random content so that compression doesn't change the ordering.
+		return HttpResource{
+			randomStringWithLength(r, 20, alphanumericRunes),
+			resourceUrl,
+			headers,
+			[]byte(randomStringWithLength(r, size, alphanumericRunes)),
+		}
+	}
+	video := resource("https://Video.example/clip.mp4", "video/mp4", 20000)
+	page := resource("https://blog.example/post", "text/html; charset=utf-8", 5000)
+	other := resource("https://blog.example/other", "text/html", 2000)
+	posted := resource("POST 0000000000000000000000000000000000000000000000000000000000000000 https://api.example/search", "", 100)
+	for _, hr := range []HttpResource{video, page, other, posted} {
+		createHttpResource(t, &ds, hr)
+	}
+	if rw, err := ds.TryCreate("https://unfinished.example/", randomStringWithLength(r, 20, alphanumericRunes)); err != nil || rw == nil {
+		t.Fatalf("Failed to start download: %v", err)
+	}
+
+	ri, err := ds.Largest(0, 2)
+	if err != nil {
+		t.Fatalf("Failed to list largest resources: %v", err)
+	}
+	var largest []string
+	for ri.HasNext() {
+		metadata, err := ri.Next()
+		if err != nil {
+			t.Fatalf("Failed to list resource: %v", err)
+		}
+		largest = append(largest, metadata.Url)
+	}
+	if len(largest) != 2 || largest[0] != video.resourceUrl || largest[1] != page.resourceUrl {
+		t.Errorf("Wrong largest resources. got = %v", largest)
+	}
+
+	for _, hr := range []HttpResource{page, other, other} {
+		if err := ds.RecordAccess(hr.hashedUrl, true); err != nil {
+			t.Fatalf("Failed to record access: %v", err)
+		}
+	}
+	if err := ds.FlushAccesses(); err != nil {
+		t.Fatalf("Failed to flush accesses: %v", err)
+	}
+
+	usage, err := ds.DiskUsage()
+	if err != nil {
+		t.Fatalf("Failed to get disk usage: %v", err)
+	}
+	names := func(groups []UsageGroup) []string {
+		var names []string
+		for _, group := range groups {
+			names = append(names, group.Name)
+		}
+		return names
+	}
+	if got := names(usage.ByHost); len(got) != 3 || got[0] != "video.example" || got[1] != "blog.example" || got[2] != "api.example" {
+		t.Errorf("Wrong hosts. got = %v", got)
+	}
+	if usage.ByHost[1].ResourceCount != 2 {
+		t.Errorf("Wrong resource count for blog.example. got = %d", usage.ByHost[1].ResourceCount)
+	}
+	if usage.ByHost[1].AccessCount != 3 || usage.ByContentType[1].AccessCount != 3 {
+		t.Errorf("Wrong access counts for blog.example and text/html. got = %d, %d", usage.ByHost[1].AccessCount, usage.ByContentType[1].AccessCount)
+	}
+	if got := names(usage.ByContentType); len(got) != 3 || got[0] != "video/mp4" || got[1] != "text/html" || got[2] != "(none)" {
+		t.Errorf("Wrong content types. got = %v", got)
+	}
+	stats, err := ds.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	total := 0
+	for _, group := range usage.ByHost {
+		total += group.BytesOnDisk
+	}
+	if total != stats.DiskConsumptionBytes {
+		t.Errorf("Usage doesn't add up to the total. got = %d, want = %d", total, stats.DiskConsumptionBytes)
+	}
+}
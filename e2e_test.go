@@ -1,17 +1,37 @@
 package e2etest
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,7 +39,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gnossen/knoxcache/api"
 	enc "github.com/gnossen/knoxcache/encoder"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcstatus "google.golang.org/grpc/status"
 )
 
 var binary = flag.String("binary", "", "The knox binary")
@@ -101,7 +126,7 @@ func (kp KnoxProcess) awaitPort() (string, error) {
 	return "", fmt.Errorf("Unreachable code")
 }
 
-func NewKnoxProcess(path, datastoreRoot, address, processId string) (KnoxProcess, error) {
+func NewKnoxProcess(path, datastoreRoot, address, processId string, extraArgs ...string) (KnoxProcess, error) {
 	kp := KnoxProcess{
 		processId: processId,
 	}
@@ -118,7 +143,7 @@ func NewKnoxProcess(path, datastoreRoot, address, processId string) (KnoxProcess
 
 	kp.proc, err = os.StartProcess(
 		path,
-		[]string{
+		append([]string{
 			path,
 			"--file-store-root",
 			datastoreRoot,
@@ -126,7 +151,9 @@ func NewKnoxProcess(path, datastoreRoot, address, processId string) (KnoxProcess
 			address,
 			"--advertise-address",
 			address,
-		},
+			// The test origins all listen on localhost.
+			"--allow-private-addresses",
+		}, extraArgs...),
 		&os.ProcAttr{
 			Files: []*os.File{
 				nil,
@@ -182,6 +209,28 @@ func (kp KnoxProcess) Get(rawUrl string) (*http.Response, error) {
 	return http.Get(requestUrl)
 }
 
+func (kp KnoxProcess) GetStatus(rawUrl string) (map[string]interface{}, error) {
+	encoder := enc.NewDefaultEncoder()
+	requestUrlHash, err := encoder.Encode(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	requestUrl := fmt.Sprintf("http://localhost:%s/api/v1/resources/%s/status", kp.Port(), requestUrlHash)
+	res, err := http.Get(requestUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Status request failed with code %d", res.StatusCode)
+	}
+	status := map[string]interface{}{}
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
 type HttpHandler func(http.ResponseWriter, *http.Request)
 
 type HttpHandlerConfig map[string]HttpHandler
@@ -470,5 +519,6133 @@ func TestConcurrentCreationMultipleKnox(t *testing.T) {
 	}
 }
 
-// TODO: Test a long-lived download.
-// TODO: Test a process that dies in the middle of a download.
+func TestOriginFailureNotRetried(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/broken": func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(503)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	rawUrl := fmt.Sprintf("http://%s/broken", testServerAddress)
+	for i := 0; i < 2; i += 1 {
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if res.StatusCode != 502 {
+			t.Errorf("Wrong response code. got = %d, want = %d.", res.StatusCode, 502)
+		}
+		if res.Header.Get("Retry-After") == "" {
+			t.Errorf("Missing Retry-After header.")
+		}
+	}
+
+	expectedCounts := map[string]int{
+		"/broken": 1,
+	}
+
+	if !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+}
+
+func TestRedirectToBlockedHost(t *testing.T) {
+	path := getKnoxBinary(t)
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1", "--deny-host", "blocked.example.com")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/redirect": func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "http://blocked.example.com/", http.StatusFound)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	// Retrying won't get around the host being blocked, so the origin isn't
+	// reported as unreachable until a retry, nor fetched again.
+	rawUrl := fmt.Sprintf("http://%s/redirect", testServerAddress)
+	for i := 0; i < 2; i += 1 {
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if body := getHttpResponseBody(res, t); res.StatusCode != 403 {
+			t.Errorf("Expected the redirect to a blocked host to be refused. got = %d: %s", res.StatusCode, body)
+		}
+	}
+	th.mu.Lock()
+	if expectedCounts := map[string]int{"/redirect": 1}; !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+	th.mu.Unlock()
+}
+
+func TestResourceStatus(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	body := "testing123"
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/test1": cannedContent(body),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	rawUrl := fmt.Sprintf("http://%s/test1", testServerAddress)
+	status, err := kp.GetStatus(rawUrl)
+	if err != nil {
+		t.Fatalf("Status request failed: %v", err)
+	}
+	if status["state"] != "not_cached" {
+		t.Errorf("Wrong state. got = %v, want = %v", status["state"], "not_cached")
+	}
+
+	if _, err := kp.Get(rawUrl); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	status, err = kp.GetStatus(rawUrl)
+	if err != nil {
+		t.Fatalf("Status request failed: %v", err)
+	}
+	if status["state"] != "cached" {
+		t.Errorf("Wrong state. got = %v, want = %v", status["state"], "cached")
+	}
+	if status["raw_bytes"] != float64(len(body)) {
+		t.Errorf("Wrong byte count. got = %v, want = %v", status["raw_bytes"], len(body))
+	}
+}
+
+func TestBundle(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("<html><body><img src=\"/img.png\"><a href=\"/other\">x</a><link rel=\"stylesheet\" href=\"/style.css\"></body></html>"),
+			"/img.png": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				io.WriteString(w, "png")
+			},
+			"/style.css": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/css")
+				io.WriteString(w, "body { background: url('bg.png'); }")
+			},
+			"/bg.png": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				io.WriteString(w, "bg")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	pageUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	for _, resource := range []string{"page", "img.png", "style.css", "bg.png"} {
+		rawUrl := fmt.Sprintf("http://%s/%s", testServerAddress, resource)
+		if _, err := kp.Get(rawUrl); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+
+	encoder := enc.NewDefaultEncoder()
+	pageHash, err := encoder.Encode(pageUrl)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	res, err := http.Get(fmt.Sprintf("http://localhost:%s/bundle/%s.html", kp.Port(), pageHash))
+	if err != nil {
+		t.Fatalf("Bundle request failed: %v", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected status code 200 but found %d", res.StatusCode)
+	}
+	bundle := getHttpResponseBody(res, t)
+	for _, want := range []string{
+		"src=\"data:image/png;base64,cG5n\"",
+		fmt.Sprintf("href=\"http://%s/other\"", testServerAddress),
+		// The stylesheet with its background inlined in turn.
+		"href=\"data:text/css;base64," + base64.StdEncoding.EncodeToString([]byte("body { background: url(\"data:image/png;base64,Ymc=\"); }")),
+	} {
+		if !strings.Contains(bundle, want) {
+			t.Errorf("Bundle missing %s:\n%s", want, bundle)
+		}
+	}
+
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/bundle/%s.zip", kp.Port(), pageHash))
+	if err != nil {
+		t.Fatalf("Bundle request failed: %v", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected status code 200 but found %d", res.StatusCode)
+	}
+	archive := getHttpResponseBody(res, t)
+	zr, err := zip.NewReader(strings.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Failed to read zip bundle: %v", err)
+	}
+	files := map[string]string{}
+	for _, zf := range zr.File {
+		r, err := zf.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", zf.Name, err)
+		}
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", zf.Name, err)
+		}
+		files[zf.Name] = string(content)
+	}
+	if files["resources/0.png"] != "png" {
+		t.Errorf("Expected resources/0.png in bundle, found files %v", reflect.ValueOf(files).MapKeys())
+	}
+	if !strings.Contains(files["index.html"], "src=\"resources/0.png\"") {
+		t.Errorf("index.html does not reference the bundled image:\n%s", files["index.html"])
+	}
+	if files["resources/1.css"] != "body { background: url(\"2.png\"); }" || files["resources/2.png"] != "bg" {
+		t.Errorf("Stylesheet and its background not bundled, found files %v", reflect.ValueOf(files).MapKeys())
+	}
+	var manifest []struct {
+		Path       string    `json:"path"`
+		Url        string    `json:"url"`
+		CapturedAt time.Time `json:"captured_at"`
+	}
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &manifest); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if len(manifest) != 4 || manifest[0].Url != pageUrl || manifest[1].Path != "resources/0.png" || manifest[1].CapturedAt.IsZero() {
+		t.Errorf("Unexpected manifest: %s", files["manifest.json"])
+	}
+}
+
+// Fills in and posts the create form the way a browser would.
+func submitCreateForm(t *testing.T, kp KnoxProcess, rawUrl string) *http.Response {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	client := &http.Client{Jar: jar}
+	base := fmt.Sprintf("http://localhost:%s/", kp.Port())
+	res, err := client.Get(base)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	match := regexp.MustCompile(`name="csrf_token" value="([^"]*)"`).FindStringSubmatch(getHttpResponseBody(res, t))
+	if match == nil {
+		t.Fatalf("Create form has no CSRF token.")
+	}
+	res, err = client.PostForm(base, url.Values{"csrf_token": {match[1]}, "url": {rawUrl}})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	return res
+}
+
+func TestCreateForm(t *testing.T) {
+	path := getKnoxBinary(t)
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/forged": cannedContent("forged"),
+			"/page":   cannedContent("page"),
+			"/legacy": cannedContent("legacy"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	base := fmt.Sprintf("http://localhost:%s/", kp.Port())
+	forgedUrl := fmt.Sprintf("http://%s/forged", testServerAddress)
+
+	// A page on another site can post the form, but not with the token.
+	forged := []*http.Request{}
+	for _, header := range []http.Header{{}, {"Sec-Fetch-Site": {"cross-site"}}} {
+		req, err := http.NewRequest("POST", base, strings.NewReader(url.Values{"url": {forgedUrl}}.Encode()))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		req.Header = header
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "knox_csrf", Value: "guessed"})
+		forged = append(forged, req)
+	}
+	for _, req := range forged {
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if getHttpResponseBody(res, t); res.StatusCode != 403 {
+			t.Errorf("Expected a forged form to be refused. got = %d", res.StatusCode)
+		}
+	}
+
+	pageUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	res := submitCreateForm(t, kp, pageUrl)
+	if body := getHttpResponseBody(res, t); res.StatusCode != 200 || !strings.Contains(body, "/c/") {
+		t.Errorf("Expected a link to the cached copy. got = %d:\n%s", res.StatusCode, body)
+	}
+	// Waits for the download the form started.
+	res, err = kp.Get(pageUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+
+	// The old form's GET is sent on to /capture.
+	legacyUrl := fmt.Sprintf("http://%s/legacy", testServerAddress)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err = client.Get(base + "?url=" + url.QueryEscape(legacyUrl))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if location := res.Header.Get("Location"); res.StatusCode != 302 || location != "/capture?url="+url.QueryEscape(legacyUrl) {
+		t.Errorf("Expected a redirect to /capture. got = %d, %s", res.StatusCode, location)
+	}
+	res, err = http.Get(base + "?url=" + url.QueryEscape(legacyUrl))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if getHttpResponseBody(res, t); res.StatusCode != 200 {
+		t.Errorf("Expected the legacy form to still capture. got = %d", res.StatusCode)
+	}
+	if status, err := kp.GetStatus(legacyUrl); err != nil || status["state"] == "not_cached" {
+		t.Errorf("Expected the legacy form to have started a capture. got = %v, %v", status, err)
+	}
+
+	req, err := http.NewRequest("PUT", base, nil)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if getHttpResponseBody(res, t); res.StatusCode != 405 {
+		t.Errorf("Expected PUT to be refused. got = %d", res.StatusCode)
+	}
+
+	if status, err := kp.GetStatus(forgedUrl); err != nil || status["state"] != "not_cached" {
+		t.Errorf("Expected the forged URL not to be cached. got = %v, %v", status, err)
+	}
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if th.UriCounts["/page"] != 1 || th.UriCounts["/forged"] != 0 {
+		t.Errorf("Wrong fetches from the origin. got = %v", th.UriCounts)
+	}
+}
+
+func TestTemplateDir(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	templateDir := t.TempDir()
+	for name, content := range map[string]string{
+		"templates/create.html":       `<p>Restyled {{.CachedUrl}}</p><input name="csrf_token" value="{{.CsrfToken}}">`,
+		"templates/admin_list.html":   "<p>{{range .Rows}}{{shortUrl .Url}} {{end}}page {{.Page}} of {{.PageCount}}</p>",
+		"templates/service-worker.js": "// {{js .AdvertisedAddress}}",
+		"static/interception.js":      "",
+		"static/knox.css":             "body { color: red; }",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(templateDir, name)), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(templateDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--template-dir", templateDir)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{"/page": cannedContent("<html></html>")},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	pageUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	res := submitCreateForm(t, kp, pageUrl)
+	if body := getHttpResponseBody(res, t); res.StatusCode != 200 || !strings.Contains(body, "<p>Restyled http://localhost:") {
+		t.Errorf("Expected the restyled create page. got = %d:\n%s", res.StatusCode, body)
+	}
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/admin/list/0", fmt.Sprintf("<p>%s page 1 of 1</p>", pageUrl)},
+		{"/static/knox.css", "body { color: red; }"},
+	} {
+		res, err := http.Get(fmt.Sprintf("http://localhost:%s%s", kp.Port(), tc.path))
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", tc.path, err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("Expected status code 200 for %s but found %d", tc.path, res.StatusCode)
+		}
+		if body := getHttpResponseBody(res, t); !strings.Contains(body, tc.want) {
+			t.Errorf("Expected %s to contain %q but found:\n%s", tc.path, tc.want, body)
+		}
+	}
+}
+
+func TestAdminPagesEscapeUrls(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{"/page": cannedContent("<html></html>")},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	payload := "<script>alert(1)</script>"
+	pageUrl := fmt.Sprintf("http://%s/page?q=\"%s", testServerAddress, payload)
+	res := submitCreateForm(t, kp, pageUrl)
+	if body := getHttpResponseBody(res, t); res.StatusCode != 200 || strings.Contains(body, payload) {
+		t.Errorf("Expected the create page without the unescaped payload. got = %d:\n%s", res.StatusCode, body)
+	}
+	for _, path := range []string{
+		"/admin/list/0",
+		"/admin/list/" + url.PathEscape(payload),
+		"/admin/search?q=" + url.QueryEscape(payload),
+		"/admin/links",
+		"/admin/rewrite?url=" + url.QueryEscape(payload),
+		"/admin/usage",
+		"/admin/import",
+	} {
+		res, err := http.Get(fmt.Sprintf("http://localhost:%s%s", kp.Port(), path))
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+		body := getHttpResponseBody(res, t)
+		if res.StatusCode != 200 {
+			// Errors may echo the payload but must not be rendered as HTML.
+			if contentType := res.Header.Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+				t.Errorf("Expected plain text error for %s but found %s", path, contentType)
+			}
+		} else if strings.Contains(body, payload) {
+			t.Errorf("Response for %s contains unescaped payload:\n%s", path, body)
+		}
+	}
+}
+
+func TestBrokenLinks(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--failure-ttl", "1h")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent(`<html><body>
+				<a href="/cached">cached</a> <a href="/uncaptured">uncaptured</a> <a href="/down">down</a>
+				<a href="mailto:someone@example.com">mail</a> <a href="#top">top</a>
+				<img src="/cached"></body></html>`),
+			"/cached": cannedContent("cached"),
+			"/down": func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(503)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	for _, path := range []string{"/cached", "/down", "/page"} {
+		res, err := kp.Get(fmt.Sprintf("http://%s%s", testServerAddress, path))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		res.Body.Close()
+	}
+
+	res, err := http.Get(fmt.Sprintf("http://localhost:%s/admin/links", kp.Port()))
+	if err != nil {
+		t.Fatalf("Broken links request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	if res.StatusCode != 200 {
+		t.Fatalf("Broken links request failed with code %d:\n%s", res.StatusCode, body)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("http://%s/uncaptured", testServerAddress),
+		fmt.Sprintf("http://%s/down", testServerAddress),
+		"Not cached",
+		"origin responded with 503",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected report to contain %q:\n%s", want, body)
+		}
+	}
+	for _, unwanted := range []string{"/cached\"", "mailto", "#top"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("Expected report not to contain %q:\n%s", unwanted, body)
+		}
+	}
+}
+
+func TestFailedFetches(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--failure-ttl", "1h")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	down := true
+	cookie := ""
+	var mu sync.Mutex
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/flaky": func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				cookie = r.Header.Get("Cookie")
+				if down {
+					w.WriteHeader(503)
+					return
+				}
+				io.WriteString(w, "back up")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	rawUrl := fmt.Sprintf("http://%s/flaky", testServerAddress)
+	res, err := http.Post(fmt.Sprintf("http://localhost:%s/api/v1/capture", kp.Port()), "application/json",
+		strings.NewReader(fmt.Sprintf(`{"url": %q, "cookies": {"session": "abc"}}`, rawUrl)))
+	if err != nil {
+		t.Fatalf("Capture request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode == 200 {
+		t.Fatalf("Expected the capture to fail.")
+	}
+
+	failuresUrl := fmt.Sprintf("http://localhost:%s/admin/failures", kp.Port())
+	res, err = http.Get(failuresUrl)
+	if err != nil {
+		t.Fatalf("Failures request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	for _, want := range []string{rawUrl, "origin responded with 503", "Retry"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected failures page to contain %q:\n%s", want, body)
+		}
+	}
+
+	// Retrying captures the resource again with the same options, without
+	// waiting out --failure-ttl.
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	encoder := enc.NewDefaultEncoder()
+	requestUrlHash, err := encoder.Encode(rawUrl)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	res, err = http.PostForm(fmt.Sprintf("http://localhost:%s/admin/retry/%s", kp.Port(), requestUrlHash), url.Values{"return": {"/admin/failures"}})
+	if err != nil {
+		t.Fatalf("Retry request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || res.Request.URL.Path != "/admin/failures" {
+		t.Errorf("Expected to land on /admin/failures but got %d for %s", res.StatusCode, res.Request.URL.Path)
+	}
+	statusUrl := fmt.Sprintf("http://localhost:%s/api/v1/resources/%s/status", kp.Port(), requestUrlHash)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		res, err := http.Get(statusUrl)
+		if err != nil {
+			t.Fatalf("Status request failed: %v", err)
+		}
+		status := map[string]interface{}{}
+		json.NewDecoder(res.Body).Decode(&status)
+		res.Body.Close()
+		if status["state"] == "cached" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Retry never completed. got = %v", status)
+		}
+	}
+	mu.Lock()
+	if cookie != "session=abc" {
+		t.Errorf("Expected the retry to send the captured cookie. got = %q", cookie)
+	}
+	mu.Unlock()
+	res, err = http.Get(failuresUrl)
+	if err != nil {
+		t.Fatalf("Failures request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); strings.Contains(body, rawUrl) {
+		t.Errorf("Expected the fetched resource to leave the failures page:\n%s", body)
+	}
+}
+
+func TestFailureRetries(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--failure-ttl", "100ms", "--failure-retries", "3",
+		"--failure-retry-interval", "50ms", "--circuit-breaker-failures", "0")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	flakyFetches := 0
+	var mu sync.Mutex
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/flaky": func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				flakyFetches += 1
+				fetches := flakyFetches
+				mu.Unlock()
+				if fetches <= 2 {
+					w.WriteHeader(503)
+					return
+				}
+				io.WriteString(w, "back up")
+			},
+			"/down": func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(503)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	for _, path := range []string{"/flaky", "/down"} {
+		res, err := kp.Get(fmt.Sprintf("http://%s%s", testServerAddress, path))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		res.Body.Close()
+	}
+	// Backing off, the retries are done within 100ms, 200ms and 400ms of
+	// each other.
+	time.Sleep(2 * time.Second)
+	th.mu.Lock()
+	counts := map[string]int{"/flaky": th.UriCounts["/flaky"], "/down": th.UriCounts["/down"]}
+	th.mu.Unlock()
+	if want := map[string]int{"/flaky": 3, "/down": 3}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("Wrong fetch counts. got = %v, want = %v", counts, want)
+	}
+	res, err := kp.Get(fmt.Sprintf("http://%s/flaky", testServerAddress))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if got := getHttpResponseBody(res, t); got != "back up" {
+		t.Errorf("Expected a retry to have cached the resource. got = %q", got)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	release := make(chan struct{})
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/slow": func(w http.ResponseWriter, r *http.Request) {
+				<-release
+				io.WriteString(w, "finally")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(path string) (*http.Response, string) {
+		res, err := client.Get(fmt.Sprintf("http://localhost:%s%s", kp.Port(), path))
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+		return res, getHttpResponseBody(res, t)
+	}
+
+	res, body := get("/")
+	if !strings.Contains(body, "javascript:location.href=") {
+		t.Errorf("Expected a bookmarklet on the home page:\n%s", body)
+	}
+	if res, _ = get("/capture"); res.StatusCode != 400 {
+		t.Errorf("Expected capture without a url to fail. got = %d", res.StatusCode)
+	}
+
+	slowUrl := fmt.Sprintf("http://%s/slow", testServerAddress)
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(slowUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	progressPath := "/progress/" + encodedUrl
+	if res, _ = get(progressPath); res.StatusCode != 404 {
+		t.Errorf("Expected no progress before capturing. got = %d", res.StatusCode)
+	}
+	// Answered while the origin is still holding the response.
+	res, _ = get("/capture?url=" + url.QueryEscape(slowUrl))
+	if res.StatusCode != 302 || res.Header.Get("Location") != progressPath {
+		t.Fatalf("Expected redirect to progress. got = %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+	res, body = get(progressPath)
+	if res.StatusCode != 200 || !strings.Contains(body, "Capturing") {
+		t.Errorf("Expected progress page. got = %d:\n%s", res.StatusCode, body)
+	}
+
+	close(release)
+	cachedUrl := fmt.Sprintf("http://localhost:%s/c/%s", kp.Port(), encodedUrl)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res, _ = get(progressPath)
+		if res.StatusCode == 302 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Capture never completed. Last status %d", res.StatusCode)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if res.Header.Get("Location") != cachedUrl {
+		t.Errorf("Wrong redirect once captured. got = %s, want = %s", res.Header.Get("Location"), cachedUrl)
+	}
+	res, _ = get("/capture?url=" + url.QueryEscape(slowUrl))
+	if res.StatusCode != 302 || res.Header.Get("Location") != cachedUrl {
+		t.Errorf("Expected redirect straight to the cached copy. got = %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+	if _, body = get(strings.TrimPrefix(cachedUrl, "http://localhost:"+kp.Port())); body != "finally" {
+		t.Errorf("Wrong cached body. got = %q", body)
+	}
+}
+
+func TestCaptureApi(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/api": func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				w.Header().Set("Content-Type", "text/plain")
+				fmt.Fprintf(w, "%s %s token=%s", r.Method, body, r.Header.Get("X-Token"))
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	apiUrl := fmt.Sprintf("http://%s/api", testServerAddress)
+	captureApiUrl := fmt.Sprintf("http://localhost:%s/api/v1/capture", kp.Port())
+	capture := func(request string) (int, map[string]interface{}) {
+		res, err := http.Post(captureApiUrl, "application/json", strings.NewReader(request))
+		if err != nil {
+			t.Fatalf("Capture request failed: %v", err)
+		}
+		defer res.Body.Close()
+		response := map[string]interface{}{}
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode capture response: %v", err)
+		}
+		return res.StatusCode, response
+	}
+	replay := func(cachedUrl interface{}) string {
+		res, err := http.Get(fmt.Sprint(cachedUrl))
+		if err != nil {
+			t.Fatalf("Replay request failed: %v", err)
+		}
+		body := getHttpResponseBody(res, t)
+		if res.StatusCode != 200 {
+			t.Errorf("Replay failed with code %d:\n%s", res.StatusCode, body)
+		}
+		return body
+	}
+
+	request := fmt.Sprintf(`{"method": "POST", "url": %q, "headers": {"X-Token": ["abc"]}, "body": "one"}`, apiUrl)
+	code, first := capture(request)
+	if code != 200 || first["state"] != "cached" {
+		t.Fatalf("Capture failed with code %d: %v", code, first)
+	}
+	if got := replay(first["cached_url"]); got != "POST one token=abc" {
+		t.Errorf("Wrong replayed response. got = %q", got)
+	}
+	// Capturing the same request again replays it rather than sending it.
+	if code, again := capture(request); code != 200 || again["key"] != first["key"] {
+		t.Errorf("Expected the same entry. got = %d: %v", code, again)
+	}
+	if th.UriCounts["/api"] != 1 {
+		t.Errorf("Expected one request to the origin. got = %d", th.UriCounts["/api"])
+	}
+
+	code, second := capture(fmt.Sprintf(`{"method": "POST", "url": %q, "body": "two"}`, apiUrl))
+	if code != 200 || second["key"] == first["key"] {
+		t.Fatalf("Expected a different body to be captured separately. got = %d: %v", code, second)
+	}
+	if got := replay(second["cached_url"]); got != "POST two token=" {
+		t.Errorf("Wrong replayed response. got = %q", got)
+	}
+	if got := replay(first["cached_url"]); got != "POST one token=abc" {
+		t.Errorf("Expected the first capture to be unchanged. got = %q", got)
+	}
+
+	res, err := http.Post(fmt.Sprintf("http://localhost:%s/api/v1/resources/%s/refresh", kp.Port(), first["key"]), "", nil)
+	if err != nil {
+		t.Fatalf("Refresh request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("Expected captured POST not to be refreshed. got = %d", res.StatusCode)
+	}
+
+	uncaptured, err := enc.NewDefaultEncoder().Encode(enc.RequestKey("POST", apiUrl, []byte("three")))
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+	if res, err = http.Get(fmt.Sprintf("http://localhost:%s/c/%s", kp.Port(), uncaptured)); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("Expected uncaptured request to be missing. got = %d", res.StatusCode)
+	}
+
+	for _, bad := range []string{
+		fmt.Sprintf(`{"method": "DELETE", "url": %q}`, apiUrl),
+		`{"method": "POST", "url": "/api"}`,
+		`{"method": "POST", "url": "http://example.com", "extra": true}`,
+	} {
+		if code, response := capture(bad); code != 400 {
+			t.Errorf("Expected %s to be rejected. got = %d: %v", bad, code, response)
+		}
+	}
+	if res, err = http.Get(captureApiUrl); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 405 {
+		t.Errorf("Expected GET to be rejected. got = %d", res.StatusCode)
+	}
+}
+
+func TestCaptureOptions(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	var mu sync.Mutex
+	cookies := map[string]string{}
+	remember := func(r *http.Request) string {
+		mu.Lock()
+		defer mu.Unlock()
+		cookies[r.URL.Path] = r.Header.Get("Cookie")
+		return cookies[r.URL.Path]
+	}
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `<html><body><a href="/linked">linked</a><a href="http://other.invalid/">other</a> cookie=%s</body></html>`, remember(r))
+			},
+			"/linked": func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `<html><body><a href="/page">back</a> cookie=%s</body></html>`, remember(r))
+			},
+			"/ttl": func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "short-lived")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	pageUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	linkedUrl := fmt.Sprintf("http://%s/linked", testServerAddress)
+
+	captureApiUrl := fmt.Sprintf("http://localhost:%s/api/v1/capture", kp.Port())
+	capture := func(request string) (int, map[string]interface{}) {
+		res, err := http.Post(captureApiUrl, "application/json", strings.NewReader(request))
+		if err != nil {
+			t.Fatalf("Capture request failed: %v", err)
+		}
+		defer res.Body.Close()
+		response := map[string]interface{}{}
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode capture response: %v", err)
+		}
+		return res.StatusCode, response
+	}
+
+	code, captured := capture(fmt.Sprintf(`{"url": %q, "cookies": {"session": "abc"}, "rewrite_html": false, "depth": 1}`, pageUrl))
+	if code != 200 || captured["state"] != "cached" {
+		t.Fatalf("Capture failed with code %d: %v", code, captured)
+	}
+	res, err := http.Get(fmt.Sprint(captured["cached_url"]))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	if !strings.HasPrefix(body, `<html><body><a href="/linked">`) || !strings.Contains(body, "cookie=session=abc") {
+		t.Errorf("Expected the page to be fetched with the cookie and served as it was stored:\n%s", body)
+	}
+
+	// The linked page on the same host is captured in the background with
+	// the same options.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, err := kp.GetStatus(linkedUrl)
+		if err != nil {
+			t.Fatalf("Failed to get status: %v", err)
+		}
+		if status["state"] == "cached" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the linked page to be captured. got = %v", status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if res, err = kp.Get(linkedUrl); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); !strings.HasPrefix(body, `<html><body><a href="/page">`) || !strings.Contains(body, "cookie=session=abc") {
+		t.Errorf("Expected the linked page to be captured with the same options:\n%s", body)
+	}
+	if th.UriCounts["/page"] != 1 {
+		t.Errorf("Expected the page not to be captured again through its link. got = %d", th.UriCounts["/page"])
+	}
+
+	// Refreshing captures the page the same way again.
+	mu.Lock()
+	cookies["/page"] = ""
+	mu.Unlock()
+	if res, err = http.Post(fmt.Sprintf("http://localhost:%s/api/v1/resources/%s/refresh", kp.Port(), captured["key"]), "", nil); err != nil {
+		t.Fatalf("Refresh request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	mu.Lock()
+	if res.StatusCode != 200 || cookies["/page"] != "session=abc" {
+		t.Errorf("Expected the refresh to send the cookie again. got = %d, %q", res.StatusCode, cookies["/page"])
+	}
+	mu.Unlock()
+
+	ttlUrl := fmt.Sprintf("http://%s/ttl", testServerAddress)
+	if code, response := capture(fmt.Sprintf(`{"url": %q, "ttl": "1s"}`, ttlUrl)); code != 200 {
+		t.Fatalf("Capture failed with code %d: %v", code, response)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if res, err = kp.Get(ttlUrl); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if th.UriCounts["/ttl"] != 2 {
+		t.Errorf("Expected the page to be fetched again once its TTL passed. got = %d", th.UriCounts["/ttl"])
+	}
+
+	for _, bad := range []string{
+		fmt.Sprintf(`{"url": %q, "depth": 9}`, pageUrl),
+		fmt.Sprintf(`{"url": %q, "ttl": "soon"}`, pageUrl),
+		fmt.Sprintf(`{"url": %q, "cookies": {"a b": "c"}}`, pageUrl),
+		fmt.Sprintf(`{"method": "POST", "url": %q, "render": true}`, pageUrl),
+	} {
+		if code, response := capture(bad); code != 400 {
+			t.Errorf("Expected %s to be rejected. got = %d: %v", bad, code, response)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	version := 0
+	var mu sync.Mutex
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/test1": func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				version += 1
+				body := fmt.Sprintf("version %d", version)
+				mu.Unlock()
+				io.WriteString(w, body)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	encoder := enc.NewDefaultEncoder()
+	rawUrl := fmt.Sprintf("http://%s/test1", testServerAddress)
+	requestUrlHash, err := encoder.Encode(rawUrl)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectBody := func(want string) {
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if got := getHttpResponseBody(res, t); got != want {
+			t.Fatalf("Wrong content. got = \"%s\", want = \"%s\".", got, want)
+		}
+	}
+	expectBody("version 1")
+
+	refreshUrl := fmt.Sprintf("http://localhost:%s/api/v1/resources/%s/refresh", kp.Port(), requestUrlHash)
+	res, err := http.Get(refreshUrl)
+	if err != nil {
+		t.Fatalf("Refresh request failed: %v", err)
+	}
+	if res.StatusCode != 405 {
+		t.Errorf("Wrong response code for GET. got = %d, want = %d.", res.StatusCode, 405)
+	}
+	res, err = http.Post(refreshUrl, "", nil)
+	if err != nil {
+		t.Fatalf("Refresh request failed: %v", err)
+	}
+	status := map[string]interface{}{}
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode refresh response: %v", err)
+	}
+	if res.StatusCode != 200 || status["state"] != "cached" {
+		t.Errorf("Wrong refresh response. got = %d %v, want = %d with state %v", res.StatusCode, status, 200, "cached")
+	}
+	expectBody("version 2")
+
+	// The admin list's refresh button sends the browser back to the list.
+	adminRefreshUrl := fmt.Sprintf("http://localhost:%s/admin/refresh/%s", kp.Port(), requestUrlHash)
+	res, err = http.PostForm(adminRefreshUrl, url.Values{"page": []string{"0"}})
+	if err != nil {
+		t.Fatalf("Admin refresh request failed: %v", err)
+	}
+	if res.StatusCode != 200 || res.Request.URL.Path != "/admin/list/0" {
+		t.Errorf("Expected to land on /admin/list/0 but got %d for %s", res.StatusCode, res.Request.URL.Path)
+	}
+	// The admin refresh happens in the background.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		got := getHttpResponseBody(res, t)
+		if got == "version 3" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Admin refresh never completed. got = \"%s\"", got)
+		}
+	}
+
+	// Forms on other sites can't trigger refreshes.
+	for _, header := range []http.Header{
+		{"Sec-Fetch-Site": []string{"cross-site"}},
+		{"Origin": []string{"http://attacker.example"}},
+	} {
+		req, err := http.NewRequest("POST", adminRefreshUrl, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		req.Header = header
+		res, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Admin refresh request failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 403 {
+			t.Errorf("Wrong response code for cross-site refresh with %v. got = %d, want = %d.", header, res.StatusCode, 403)
+		}
+	}
+
+	missingHash, err := encoder.Encode(fmt.Sprintf("http://%s/missing", testServerAddress))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	res, err = http.Post(fmt.Sprintf("http://localhost:%s/api/v1/resources/%s/refresh", kp.Port(), missingHash), "", nil)
+	if err != nil {
+		t.Fatalf("Refresh request failed: %v", err)
+	}
+	if res.StatusCode != 404 {
+		t.Errorf("Wrong response code for uncached resource. got = %d, want = %d.", res.StatusCode, 404)
+	}
+
+	expectedCounts := map[string]int{
+		"/test1": 3,
+	}
+	if !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/test1": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("ETag", "\"origin\"")
+				io.WriteString(w, "testing123")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	rawUrl := fmt.Sprintf("http://%s/test1", testServerAddress)
+	res, err := kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	if etag == "" || etag == "\"origin\"" {
+		t.Fatalf("Expected an ETag generated by knox but found %q", etag)
+	}
+	if _, err := http.ParseTime(lastModified); err != nil {
+		t.Fatalf("Bad Last-Modified %q: %v", lastModified, err)
+	}
+
+	encoder := enc.NewDefaultEncoder()
+	requestUrlHash, err := encoder.Encode(rawUrl)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	requestUrl := fmt.Sprintf("http://localhost:%s/c/%s", kp.Port(), requestUrlHash)
+	for _, tc := range []struct {
+		header string
+		value  string
+		want   int
+	}{
+		{"If-None-Match", etag, 304},
+		{"If-None-Match", "\"other\", " + etag, 304},
+		{"If-None-Match", "\"other\"", 200},
+		{"If-Modified-Since", lastModified, 304},
+		{"If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", 200},
+	} {
+		req, err := http.NewRequest("GET", requestUrl, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		req.Header.Set(tc.header, tc.value)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.want {
+			t.Errorf("Wrong response code for %s: %s. got = %d, want = %d.", tc.header, tc.value, res.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestHeadRequest(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/plain": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "testing123")
+			},
+			"/page": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				io.WriteString(w, `<html><body><a href="/plain">plain</a></body></html>`)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	encoder := enc.NewDefaultEncoder()
+	head := func(rawUrl string, header http.Header) *http.Response {
+		requestUrlHash, err := encoder.Encode(rawUrl)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://localhost:%s/c/%s", kp.Port(), requestUrlHash), nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		req.Header = header
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// A HEAD for something not cached yet caches it like a GET.
+	plainUrl := fmt.Sprintf("http://%s/plain", testServerAddress)
+	if res := head(plainUrl, http.Header{}); res.StatusCode != 200 {
+		t.Errorf("Wrong response code. got = %d, want = 200", res.StatusCode)
+	}
+	res, err := kp.Get(plainUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	etag := res.Header.Get("ETag")
+	res = head(plainUrl, http.Header{})
+	if res.StatusCode != 200 || res.ContentLength != int64(len("testing123")) {
+		t.Errorf("Expected the length of the body. got = %d, %d", res.StatusCode, res.ContentLength)
+	}
+	if res.Header.Get("ETag") != etag || res.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the same headers as a GET. got = %v", res.Header)
+	}
+	if res := head(plainUrl, http.Header{"If-None-Match": {etag}}); res.StatusCode != 304 {
+		t.Errorf("Expected the client's copy to be current. got = %d", res.StatusCode)
+	}
+
+	// How long a transformed page is isn't known until it is transformed.
+	pageUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	res, err = kp.Get(pageUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res := head(pageUrl, http.Header{}); res.StatusCode != 200 || res.ContentLength != -1 || res.Header.Get("Content-Type") != "text/html" {
+		t.Errorf("Expected no Content-Length for a transformed page. got = %d, %d, %v", res.StatusCode, res.ContentLength, res.Header)
+	}
+
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if expectedCounts := map[string]int{"/plain": 1, "/page": 1}; !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	// Large enough that it would be sent in chunks without a length, and
+	// random so that it isn't stored any smaller and passed through gzipped.
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(content)
+	body := string(content)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/big": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				io.WriteString(w, body)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	bigUrl := fmt.Sprintf("http://%s/big", testServerAddress)
+	for i := 0; i < 2; i += 1 {
+		res, err := kp.Get(bigUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if got := getHttpResponseBody(res, t); got != body {
+			t.Fatalf("Wrong body. got %d bytes, want %d", len(got), len(body))
+		}
+		if res.ContentLength != int64(len(body)) || len(res.TransferEncoding) != 0 {
+			t.Errorf("Expected the length of the body rather than chunks. got = %d, %v", res.ContentLength, res.TransferEncoding)
+		}
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--resource-ttl", "1ms", "--failure-ttl", "1h")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	body := "testing123"
+	originDown := false
+	var mu sync.Mutex
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/test1": func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if originDown {
+					w.WriteHeader(503)
+					return
+				}
+				io.WriteString(w, body)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	rawUrl := fmt.Sprintf("http://%s/test1", testServerAddress)
+	res, err := kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if got := getHttpResponseBody(res, t); got != body || res.Header.Get("Warning") != "" {
+		t.Fatalf("Wrong response. got = %q with warnings %v, want = %q", got, res.Header["Warning"], body)
+	}
+
+	mu.Lock()
+	originDown = true
+	mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+
+	// The second request tries to refresh the expired copy. The third doesn't
+	// bother until the failure expires.
+	for i := 0; i < 2; i += 1 {
+		res, err = kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if res.StatusCode != 200 {
+			t.Errorf("Wrong response code. got = %d, want = %d.", res.StatusCode, 200)
+		}
+		if got := getHttpResponseBody(res, t); got != body {
+			t.Errorf("Wrong content. got = %q, want = %q", got, body)
+		}
+		if !strings.Contains(strings.Join(res.Header["Warning"], ","), "Revalidation Failed") {
+			t.Errorf("Expected a Warning header but found %v", res.Header["Warning"])
+		}
+	}
+
+	expectedCounts := map[string]int{
+		"/test1": 2,
+	}
+	if !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+
+	status, err := kp.GetStatus(rawUrl)
+	if err != nil {
+		t.Fatalf("Status request failed: %v", err)
+	}
+	if status["state"] != "cached" || status["refresh_failure"] == nil {
+		t.Errorf("Expected a cached resource with a refresh failure but found %v", status)
+	}
+}
+
+func TestRevalidateExpired(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--resource-ttl", "1ms")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	body := "testing123"
+	notModified := 0
+	var mu sync.Mutex
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/test1": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					mu.Lock()
+					notModified += 1
+					mu.Unlock()
+					w.WriteHeader(304)
+					return
+				}
+				io.WriteString(w, body)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	rawUrl := fmt.Sprintf("http://%s/test1", testServerAddress)
+	for i := 0; i < 2; i += 1 {
+		if i != 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if got := getHttpResponseBody(res, t); got != body || res.Header.Get("Warning") != "" {
+			t.Fatalf("Wrong response. got = %q with warnings %v, want = %q", got, res.Header["Warning"], body)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if notModified != 1 {
+		t.Errorf("Expected the expired copy to be revalidated once. got = %d", notModified)
+	}
+}
+
+func TestOriginCacheControl(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--resource-ttl", "1ms", "--honor-origin-cache-control", "--origin-ttl-min", "1ms")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	cacheControl := map[string]string{
+		"/short":     "max-age=1",
+		"/immutable": "public, max-age=1, immutable",
+		"/no-cache":  "no-cache",
+		"/plain":     "",
+	}
+	handlers := HttpHandlerConfig{}
+	for uri, value := range cacheControl {
+		value := value
+		handlers[uri] = func(w http.ResponseWriter, r *http.Request) {
+			if value != "" {
+				w.Header().Set("Cache-Control", value)
+			}
+			io.WriteString(w, "testing123")
+		}
+	}
+	testServer, th, testServerAddress, err := NewTestHttpServer(handlers)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	fetchAll := func() {
+		for uri := range cacheControl {
+			res, err := kp.Get(fmt.Sprintf("http://%s%s", testServerAddress, uri))
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			getHttpResponseBody(res, t)
+		}
+	}
+	fetchAll()
+	time.Sleep(10 * time.Millisecond)
+	fetchAll()
+	// Only resources without a lifetime of their own, or that must be
+	// revalidated, expire with --resource-ttl.
+	expectedCounts := map[string]int{"/short": 1, "/immutable": 1, "/no-cache": 2, "/plain": 2}
+	if !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	fetchAll()
+	expectedCounts = map[string]int{"/short": 2, "/immutable": 1, "/no-cache": 3, "/plain": 3}
+	if !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts after max-age are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+}
+
+func TestUpstreamHttp2(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	caFile := filepath.Join(datastoreRoot, "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: origin.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPem, 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	for _, tc := range []struct {
+		http2 string
+		want  string
+	}{
+		{"true", "HTTP/2.0"},
+		{"false", "HTTP/1.1"},
+	} {
+		kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1", "--upstream-ca-file", caFile, "--upstream-http2="+tc.http2)
+		if err != nil {
+			t.Fatalf("Failed to start process: %v\n", err)
+		}
+		rawUrl := origin.URL + "/test1"
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if got := getHttpResponseBody(res, t); got != tc.want {
+			t.Errorf("Wrong protocol seen by origin. got = %q, want = %q", got, tc.want)
+		}
+		status, err := kp.GetStatus(rawUrl)
+		if err != nil {
+			t.Fatalf("Status request failed: %v", err)
+		}
+		if status["protocol"] != tc.want {
+			t.Errorf("Wrong protocol recorded. got = %v, want = %v", status["protocol"], tc.want)
+		}
+		kp.DumpStreams()
+		kp.Close()
+	}
+}
+
+// TODO: Test a long-lived download.
+// TODO: Test a process that dies in the middle of a download.
+
+func TestGrpc(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	// Find a free port for the gRPC listener.
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	grpcAddress := ln.Addr().String()
+	ln.Close()
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--grpc-listen-address", grpcAddress)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	body := "testing123"
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/test1": cannedContent(body),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	conn, err := grpc.Dial(grpcAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial gRPC server: %v", err)
+	}
+	defer conn.Close()
+	client := api.NewKnoxClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rawUrl := fmt.Sprintf("http://%s/test1", testServerAddress)
+	status, err := client.GetStatus(ctx, &api.GetStatusRequest{Url: rawUrl})
+	if err != nil || status.State != api.ResourceState_NOT_CACHED {
+		t.Fatalf("Expected resource not to be cached. got = %v, %v", status, err)
+	}
+	status, err = client.Create(ctx, &api.CreateRequest{Url: rawUrl})
+	if err != nil || status.State != api.ResourceState_CACHED || status.RawBytes != int64(len(body)) {
+		t.Fatalf("Expected resource to be cached. got = %v, %v", status, err)
+	}
+
+	stream, err := client.Open(ctx, &api.OpenRequest{Url: rawUrl})
+	if err != nil {
+		t.Fatalf("Failed to open resource: %v", err)
+	}
+	first, err := stream.Recv()
+	if err != nil || first.GetHeaders() == nil {
+		t.Fatalf("Expected headers first. got = %v, %v", first, err)
+	}
+	var content []byte
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read resource: %v", err)
+		}
+		content = append(content, resp.GetChunk()...)
+	}
+	if string(content) != body {
+		t.Errorf("Wrong content. got = %q, want = %q", content, body)
+	}
+
+	list, err := client.List(ctx, &api.ListRequest{})
+	if err != nil || len(list.Resources) != 1 || list.Resources[0].Url != rawUrl {
+		t.Errorf("Wrong resource list. got = %v, %v", list, err)
+	}
+	if stats, err := client.GetStats(ctx, &api.GetStatsRequest{}); err != nil || stats.RecordCount != 1 {
+		t.Errorf("Wrong stats. got = %v, %v", stats, err)
+	}
+
+	if _, err := client.Delete(ctx, &api.DeleteRequest{Url: rawUrl}); err != nil {
+		t.Fatalf("Failed to delete resource: %v", err)
+	}
+	if _, err := client.Delete(ctx, &api.DeleteRequest{Url: rawUrl}); grpcstatus.Code(err) != codes.NotFound {
+		t.Errorf("Wrong error deleting a missing resource. got = %v, want = %v", err, codes.NotFound)
+	}
+	status, err = client.GetStatus(ctx, &api.GetStatusRequest{Url: rawUrl})
+	if err != nil || status.State != api.ResourceState_NOT_CACHED {
+		t.Errorf("Expected deleted resource not to be cached. got = %v, %v", status, err)
+	}
+
+	expectedCounts := map[string]int{
+		"/test1": 1,
+	}
+	if !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("<html><head><title>Gardening</title><script>var hidden = 'zucchini';</script></head>" +
+				"<body><p>Tomatoes need plenty of &lt;sun&gt;.</p></body></html>"),
+			"/plain": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "tomatoes")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	pageUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	for _, rawUrl := range []string{pageUrl, fmt.Sprintf("http://%s/plain", testServerAddress)} {
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		res.Body.Close()
+	}
+
+	search := func(query string) []map[string]interface{} {
+		res, err := http.Get(fmt.Sprintf("http://localhost:%s/api/v1/search?q=%s", kp.Port(), url.QueryEscape(query)))
+		if err != nil {
+			t.Fatalf("Search request failed: %v", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Search failed with code %d", res.StatusCode)
+		}
+		var resp struct {
+			Results []map[string]interface{} `json:"results"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode search response: %v", err)
+		}
+		return resp.Results
+	}
+
+	// Only HTML pages are indexed.
+	results := search("tomatoes")
+	if len(results) != 1 {
+		t.Fatalf("Wrong number of results. got = %v", results)
+	}
+	if results[0]["url"] != pageUrl || results[0]["title"] != "Gardening" {
+		t.Errorf("Wrong result. got = %v", results[0])
+	}
+	if want := "<mark>Tomatoes</mark> need plenty of &lt;sun&gt;."; results[0]["snippet_html"] != want {
+		t.Errorf("Wrong snippet. got = %v, want = %v", results[0]["snippet_html"], want)
+	}
+	if results := search("zucchini"); len(results) != 0 {
+		t.Errorf("Expected script contents not to be indexed. got = %v", results)
+	}
+
+	res, err := http.Get(fmt.Sprintf("http://localhost:%s/admin/search?q=tomatoes", kp.Port()))
+	if err != nil {
+		t.Fatalf("Search page request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	if res.StatusCode != 200 || !strings.Contains(body, "<mark>Tomatoes</mark>") {
+		t.Errorf("Expected search page to show the match. got = %d:\n%s", res.StatusCode, body)
+	}
+}
+
+func TestReader(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	paragraph := "<p>Tomatoes need plenty of sun, water, and patience, and they reward all three generously.</p>"
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/article": cannedContent(`<html><head><title>Growing Tomatoes</title><meta name="author" content="A. Gardener"></head><body>
+				<nav><a href="/">Home</a> <a href="/about">About</a></nav>
+				<div class="sidebar"><p>Subscribe to our newsletter for more gardening tips, tricks, and offers.</p></div>
+				<div class="post-content">` + paragraph + paragraph + `
+					<img src="/tomato.png" alt="A tomato" onerror="alert(1)">
+					<p>Read <a href="javascript:alert(1)">more</a> or <a href="/more">here</a>.</p>
+					<script>alert(1)</script>
+				</div></body></html>`),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	articleUrl := fmt.Sprintf("http://%s/article", testServerAddress)
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(articleUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	readerUrl := fmt.Sprintf("http://localhost:%s/read/%s", kp.Port(), encodedUrl)
+	res, err := http.Get(readerUrl)
+	if err != nil {
+		t.Fatalf("Reader request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("Expected uncached page to be missing. got = %d", res.StatusCode)
+	}
+
+	res, err = kp.Get(articleUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	res, err = http.Get(readerUrl)
+	if err != nil {
+		t.Fatalf("Reader request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	if res.StatusCode != 200 {
+		t.Fatalf("Reader request failed with code %d:\n%s", res.StatusCode, body)
+	}
+	cachedImage, err := enc.NewDefaultEncoder().Encode(fmt.Sprintf("http://%s/tomato.png", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	for _, want := range []string{
+		"<h1>Growing Tomatoes</h1>",
+		"A. Gardener",
+		paragraph,
+		fmt.Sprintf(`<img src="http://localhost:%s/c/%s" alt="A tomato"/>`, kp.Port(), cachedImage),
+		"Read <a>more</a>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected reader view to contain %q:\n%s", want, body)
+		}
+	}
+	for _, unwanted := range []string{"alert", "newsletter", "About"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("Expected reader view not to contain %q:\n%s", unwanted, body)
+		}
+	}
+}
+
+func TestContentTypePolicy(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--deny-content-type", "video/*", "--deny-content-type", ".iso", "--failure-ttl", "1h")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	withType := func(contentType string) HttpHandler {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			io.WriteString(w, "data")
+		}
+	}
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/clip":      withType("video/mp4"),
+			"/disk.iso":  withType("application/octet-stream"),
+			"/notes.txt": withType("text/plain"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/clip", 403},
+		{"/disk.iso", 403},
+		{"/notes.txt", 200},
+	} {
+		rawUrl := fmt.Sprintf("http://%s%s", testServerAddress, tc.path)
+		// The second request is answered from the recorded decision.
+		for i := 0; i < 2; i++ {
+			res, err := kp.Get(rawUrl)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			body := getHttpResponseBody(res, t)
+			if res.StatusCode != tc.code {
+				t.Errorf("Wrong status for %s. got = %d, want = %d:\n%s", tc.path, res.StatusCode, tc.code, body)
+			}
+		}
+		if th.UriCounts[tc.path] != 1 {
+			t.Errorf("Expected %s to be fetched once. got = %d", tc.path, th.UriCounts[tc.path])
+		}
+	}
+
+	status, err := kp.GetStatus(fmt.Sprintf("http://%s/clip", testServerAddress))
+	if err != nil {
+		t.Fatalf("Status request failed: %v", err)
+	}
+	failure, ok := status["failure"].(map[string]interface{})
+	if !ok || failure["refused"] != true || !strings.Contains(fmt.Sprint(failure["reason"]), "video/mp4") {
+		t.Errorf("Expected the refusal to be recorded. got = %v", status)
+	}
+}
+
+// Printing needs Chrome, so this only covers requests refused before a browser
+// is started.
+func TestPdfRefusals(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("<html><body>Hello</body></html>"),
+			"/notes.txt": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "notes")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	pdfUrl := func(resourceUrl string, query string) string {
+		encodedUrl, err := enc.NewDefaultEncoder().Encode(resourceUrl)
+		if err != nil {
+			t.Fatalf("Failed to encode url: %v", err)
+		}
+		return fmt.Sprintf("http://localhost:%s/pdf/%s%s", kp.Port(), encodedUrl, query)
+	}
+	pageUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	notesUrl := fmt.Sprintf("http://%s/notes.txt", testServerAddress)
+	for _, resourceUrl := range []string{pageUrl, notesUrl} {
+		res, err := kp.Get(resourceUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		res.Body.Close()
+	}
+
+	for _, tc := range []struct {
+		url  string
+		code int
+	}{
+		{pdfUrl(fmt.Sprintf("http://%s/uncached", testServerAddress), ""), 404},
+		{pdfUrl(notesUrl, ""), 400},
+		{pdfUrl(pageUrl, "?size=quarto"), 400},
+		{pdfUrl(pageUrl, "?margin=2furlongs"), 400},
+		{pdfUrl(pageUrl, "?margin=5in"), 400},
+		{pdfUrl(pageUrl, "?landscape=sideways"), 400},
+	} {
+		res, err := http.Get(tc.url)
+		if err != nil {
+			t.Fatalf("PDF request failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.code {
+			t.Errorf("Wrong status for %s. got = %d, want = %d", tc.url, res.StatusCode, tc.code)
+		}
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{"/page": cannedContent("<html>canonical</html>")},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	rulesFile := filepath.Join(t.TempDir(), "rewrites.txt")
+	rules := fmt.Sprintf("# Send the mirror to the origin.\n^http://mirror\\.invalid/(.*)$ http://%s/$1\n", testServerAddress)
+	if err := ioutil.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--rewrite-rules-file", rulesFile)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	canonicalUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	encoder := enc.NewDefaultEncoder()
+	encodedMirrorUrl, err := encoder.Encode("http://mirror.invalid/page")
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	encodedCanonicalUrl, err := encoder.Encode(canonicalUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	res, err := client.Get(fmt.Sprintf("http://localhost:%s/c/%s", kp.Port(), encodedMirrorUrl))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 302 || !strings.HasSuffix(res.Header.Get("Location"), "/c/"+encodedCanonicalUrl) {
+		t.Fatalf("Expected redirect to the canonical entry. got = %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	res, err = kp.Get("http://mirror.invalid/page")
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	if !strings.Contains(body, "canonical") {
+		t.Errorf("Expected the rewritten page:\n%s", body)
+	}
+	if th.UriCounts["/page"] != 1 {
+		t.Errorf("Expected one request to the origin. got = %d", th.UriCounts["/page"])
+	}
+
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/admin/rewrite?url=%s", kp.Port(), url.QueryEscape("http://mirror.invalid/page")))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body = getHttpResponseBody(res, t)
+	if !strings.Contains(body, rulesFile+":2") || !strings.Contains(body, canonicalUrl) {
+		t.Errorf("Expected the dry run to show the applied rule:\n%s", body)
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Set-Cookie", "session=1")
+				w.Header().Set("Content-Security-Policy", "default-src 'self'")
+				w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+				w.Header().Set("Via", "1.1 origin")
+				w.Header().Set("Alt-Svc", "h3=\":443\"")
+				io.WriteString(w, "<html></html>")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	rulesFile := filepath.Join(t.TempDir(), "headers.txt")
+	rules := "store * Via keep\nserve * X-Frame-Options set DENY\n"
+	if err := ioutil.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--header-rules-file", rulesFile, "--strip-set-cookie", "--csp-mode", "keep")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	res, err := kp.Get(fmt.Sprintf("http://%s/page", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	expected := map[string]string{
+		"Set-Cookie":              "",
+		"Content-Security-Policy": "default-src 'self'",
+		"X-Frame-Options":         "DENY",
+		"Via":                     "1.1 origin",
+		"Alt-Svc":                 "",
+	}
+	for key, want := range expected {
+		if got := res.Header.Get(key); got != want {
+			t.Errorf("Wrong %s header. got = %q, want = %q", key, got, want)
+		}
+	}
+}
+
+func TestSetCookiePolicy(t *testing.T) {
+	path := getKnoxBinary(t)
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Set-Cookie", "session=1; Path=/")
+				w.Header().Add("Set-Cookie", "theme=dark; Path=/")
+				w.Header().Add("Set-Cookie", "prefs=1; HttpOnly")
+				io.WriteString(w, "<html></html>")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	localhostAddress := strings.Replace(testServerAddress, "127.0.0.1", "localhost", 1)
+
+	rulesFile := filepath.Join(t.TempDir(), "headers.txt")
+	if err := ioutil.WriteFile(rulesFile, []byte("serve localhost Set-Cookie strip-auth\n"), 0644); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+	cases := []struct {
+		args []string
+		want map[string][]string
+	}{
+		{nil, map[string][]string{
+			testServerAddress: {"theme=dark; Path=/"},
+		}},
+		{[]string{"--set-cookie-policy", "pass"}, map[string][]string{
+			testServerAddress: {"session=1; Path=/", "theme=dark; Path=/", "prefs=1; HttpOnly"},
+		}},
+		{[]string{"--set-cookie-policy", "strip", "--header-rules-file", rulesFile}, map[string][]string{
+			testServerAddress: nil,
+			localhostAddress:  {"theme=dark; Path=/"},
+		}},
+	}
+	for _, tc := range cases {
+		func() {
+			kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1", tc.args...)
+			if err != nil {
+				t.Fatalf("Failed to start process: %v\n", err)
+			}
+			defer kp.Close()
+			defer kp.DumpStreams()
+			for address, want := range tc.want {
+				res, err := kp.Get(fmt.Sprintf("http://%s/page", address))
+				if err != nil {
+					t.Fatalf("Failed to get page: %v", err)
+				}
+				getHttpResponseBody(res, t)
+				if got := res.Header.Values("Set-Cookie"); !reflect.DeepEqual(got, want) {
+					t.Errorf("Wrong cookies from %s with %v. got = %q, want = %q", address, tc.args, got, want)
+				}
+			}
+		}()
+	}
+}
+
+func TestCspModes(t *testing.T) {
+	path := getKnoxBinary(t)
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Security-Policy", "script-src https://cdn.example.com; report-uri /csp")
+				io.WriteString(w, `<html><head><meta http-equiv="Content-Security-Policy" content="img-src https://cdn.example.com"></head></html>`)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	for _, tc := range []struct {
+		mode       string
+		header     string
+		headerHash bool
+		meta       string
+	}{
+		{"adapt", "script-src 'self' 'sha256-", true, `content="img-src &#39;self&#39;"`},
+		{"keep", "script-src https://cdn.example.com; report-uri /csp", false, `content="img-src https://cdn.example.com"`},
+		{"drop", "", false, ""},
+	} {
+		kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1", "--csp-mode", tc.mode)
+		if err != nil {
+			t.Fatalf("Failed to start process: %v\n", err)
+		}
+		defer kp.Close()
+		defer kp.DumpStreams()
+
+		res, err := kp.Get(fmt.Sprintf("http://%s/page", testServerAddress))
+		if err != nil {
+			t.Fatalf("Failed to get page: %v", err)
+		}
+		body := getHttpResponseBody(res, t)
+		header := res.Header.Get("Content-Security-Policy")
+		if tc.headerHash && !strings.HasPrefix(header, tc.header) || !tc.headerHash && header != tc.header {
+			t.Errorf("Wrong policy header with --csp-mode %s: %s", tc.mode, header)
+		}
+		if tc.meta == "" && strings.Contains(body, "Content-Security-Policy") || !strings.Contains(body, tc.meta) {
+			t.Errorf("Wrong policy meta tag with --csp-mode %s:\n%s", tc.mode, body)
+		}
+	}
+}
+
+func TestIntegrityStripped(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent(`<html><head>` +
+				`<script src="/app.js" integrity="sha384-abc" crossorigin="anonymous"></script>` +
+				`<link rel="stylesheet" href="/app.css" integrity="sha384-def">` +
+				`</head></html>`),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	res, err := kp.Get(fmt.Sprintf("http://%s/page", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	if strings.Contains(body, "integrity") {
+		t.Errorf("Expected integrity attributes to be removed:\n%s", body)
+	}
+	if !strings.Contains(body, `crossorigin="anonymous"`) {
+		t.Errorf("Expected other attributes to be kept:\n%s", body)
+	}
+}
+
+func TestResourceHints(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent(`<html><head>` +
+				`<link rel="dns-prefetch" href="//cdn.example">` +
+				`<link rel="preconnect" href="https://cdn.example" crossorigin>` +
+				`<link rel="preconnect stylesheet" href="/app.css">` +
+				`<link rel="preload" as="font" href="/font.woff2" crossorigin="anonymous">` +
+				`<link rel="preload" as="image" href="/hero.jpg" imagesrcset="/hero-2x.jpg 2x" imagesizes="100vw">` +
+				`<link rel="modulepreload" href="/app.mjs">` +
+				`</head></html>`),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	res, err := kp.Get(fmt.Sprintf("http://%s/page", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	for _, removed := range []string{"dns-prefetch", "preconnect", "cdn.example", "imagesrcset", "imagesizes"} {
+		if strings.Contains(body, removed) {
+			t.Errorf("Expected %s to be removed:\n%s", removed, body)
+		}
+	}
+	encoder := enc.NewDefaultEncoder()
+	for _, link := range []struct{ attrs, path string }{
+		{`rel="stylesheet"`, "/app.css"},
+		{`rel="preload" as="font"`, "/font.woff2"},
+		{`rel="preload" as="image"`, "/hero.jpg"},
+		{`rel="modulepreload"`, "/app.mjs"},
+	} {
+		encoded, err := encoder.Encode(fmt.Sprintf("http://%s%s", testServerAddress, link.path))
+		if err != nil {
+			t.Fatalf("Failed to encode url: %v", err)
+		}
+		if want := fmt.Sprintf(`<link %s href="http://localhost:%s/c/%s"`, link.attrs, kp.Port(), encoded); !strings.Contains(body, want) {
+			t.Errorf("Expected %s:\n%s", want, body)
+		}
+	}
+	if !strings.Contains(body, `crossorigin="anonymous"`) {
+		t.Errorf("Expected the font preload to stay CORS:\n%s", body)
+	}
+}
+
+func TestNoscriptRewritten(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent(`<html><head>` +
+				`<noscript><link rel="stylesheet" href="/nojs.css"></noscript>` +
+				`</head><body>` +
+				`<noscript><img src="/pixel.gif"> 1 < 2 <a href="/nojs">Without JavaScript</a></noscript>` +
+				`</body></html>`),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	res, err := kp.Get(fmt.Sprintf("http://%s/page", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	encoder := enc.NewDefaultEncoder()
+	for _, path := range []string{"/nojs.css", "/pixel.gif", "/nojs"} {
+		encoded, err := encoder.Encode(fmt.Sprintf("http://%s%s", testServerAddress, path))
+		if err != nil {
+			t.Fatalf("Failed to encode url: %v", err)
+		}
+		if want := fmt.Sprintf(`"http://localhost:%s/c/%s"`, kp.Port(), encoded); !strings.Contains(body, want) {
+			t.Errorf("Expected %s in a noscript block to point at the cache:\n%s", path, body)
+		}
+	}
+	if strings.Contains(body, `href="/`) || strings.Contains(body, `src="/`) {
+		t.Errorf("Expected no links to the origin:\n%s", body)
+	}
+	// Copied as it was rather than parsed and rendered again.
+	if !strings.Contains(body, "1 < 2") {
+		t.Errorf("Expected the noscript text to be kept:\n%s", body)
+	}
+}
+
+func TestWebAppManifest(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/app/page": cannedContent(`<html><head>` +
+				`<link rel="manifest" href="/app/manifest.json">` +
+				`<link rel="icon" href="/favicon.png">` +
+				`</head></html>`),
+			"/plain": cannedContent("<html><head><title>No icon</title></head></html>"),
+			"/app/manifest.json": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"name": "App", "start_url": "./?source=pwa", "scope": "/app/", "display": "standalone",`+
+					`"icons": [{"src": "icon-192.png", "sizes": "192x192"}],`+
+					`"shortcuts": [{"name": "Inbox", "url": "/app/inbox", "icons": [{"src": "/inbox.png"}]}]}`)
+			},
+			"/favicon.png":      cannedContent("favicon"),
+			"/app/icon-192.png": cannedContent("icon"),
+			"/inbox.png":        cannedContent("inbox"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	encoder := enc.NewDefaultEncoder()
+	cachedUrl := func(path string) string {
+		encoded, err := encoder.Encode(fmt.Sprintf("http://%s%s", testServerAddress, path))
+		if err != nil {
+			t.Fatalf("Failed to encode url: %v", err)
+		}
+		return fmt.Sprintf("http://localhost:%s/c/%s", kp.Port(), encoded)
+	}
+	res, err := kp.Get(fmt.Sprintf("http://%s/app/page", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	manifestUrl := strings.Replace(cachedUrl("/app/manifest.json"), "/c/", "/manifest/", 1)
+	if !strings.Contains(body, fmt.Sprintf(`<link rel="manifest" href="%s"/>`, manifestUrl)) {
+		t.Errorf("Expected the manifest link to point at %s:\n%s", manifestUrl, body)
+	}
+	if strings.Count(body, `rel="icon"`) != 1 {
+		t.Errorf("Expected no icon to be added to a page with one:\n%s", body)
+	}
+
+	// The manifest and icons are cached along with the page.
+	requested := func(path string) int {
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		return th.UriCounts[path]
+	}
+	for _, path := range []string{"/app/manifest.json", "/favicon.png", "/app/icon-192.png", "/inbox.png"} {
+		for i := 0; requested(path) == 0; i += 1 {
+			if i == 100 {
+				t.Fatalf("Expected %s to be cached along with the page", path)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	res, err = http.Get(manifestUrl)
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %v", err)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "application/manifest+json" {
+		t.Errorf("Wrong content type. got = %q", contentType)
+	}
+	var manifest struct {
+		Name     string `json:"name"`
+		StartUrl string `json:"start_url"`
+		Scope    string `json:"scope"`
+		Icons    []struct {
+			Src   string `json:"src"`
+			Sizes string `json:"sizes"`
+		} `json:"icons"`
+		Shortcuts []struct {
+			Url   string `json:"url"`
+			Icons []struct {
+				Src string `json:"src"`
+			} `json:"icons"`
+		} `json:"shortcuts"`
+	}
+	if err := json.Unmarshal([]byte(getHttpResponseBody(res, t)), &manifest); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if manifest.Name != "App" || manifest.StartUrl != cachedUrl("/app/?source=pwa") || manifest.Scope != fmt.Sprintf("http://localhost:%s/c/", kp.Port()) {
+		t.Errorf("Wrong manifest. got = %+v", manifest)
+	}
+	if len(manifest.Icons) != 1 || manifest.Icons[0].Src != cachedUrl("/app/icon-192.png") || manifest.Icons[0].Sizes != "192x192" {
+		t.Errorf("Wrong icons. got = %+v", manifest.Icons)
+	}
+	if len(manifest.Shortcuts) != 1 || manifest.Shortcuts[0].Url != cachedUrl("/app/inbox") ||
+		len(manifest.Shortcuts[0].Icons) != 1 || manifest.Shortcuts[0].Icons[0].Src != cachedUrl("/inbox.png") {
+		t.Errorf("Wrong shortcuts. got = %+v", manifest.Shortcuts)
+	}
+
+	// Pages that don't link to an icon get the origin's default one.
+	res, err = kp.Get(fmt.Sprintf("http://%s/plain", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	body = getHttpResponseBody(res, t)
+	if want := fmt.Sprintf(`<link rel="icon" href="%s"/></head>`, cachedUrl("/favicon.ico")); !strings.Contains(body, want) {
+		t.Errorf("Expected %s:\n%s", want, body)
+	}
+}
+
+func TestScriptUrlRewriting(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--rewrite-script-urls", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	var testServerAddress string
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/app.js": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+				fmt.Fprintf(w, `fetch("http://%s/data.json"); var base = "http://%s/img/";`, testServerAddress, testServerAddress)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	res, err := kp.Get(fmt.Sprintf("http://%s/app.js", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to get script: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	encoded, err := enc.NewDefaultEncoder().Encode(fmt.Sprintf("http://%s/data.json", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	want := fmt.Sprintf(`fetch("http://localhost:%s/c/%s"); var base = "http://%s/img/";`, kp.Port(), encoded, testServerAddress)
+	if body != want {
+		t.Errorf("Wrong script. got = %s, want = %s", body, want)
+	}
+
+	// Scripts from other hosts are served as they are.
+	otherHost := strings.Replace(testServerAddress, "127.0.0.1", "localhost", 1)
+	res, err = kp.Get(fmt.Sprintf("http://%s/app.js", otherHost))
+	if err != nil {
+		t.Fatalf("Failed to get script: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); strings.Contains(body, "/c/") {
+		t.Errorf("Expected a script from another host to be kept. got = %s", body)
+	}
+}
+
+func TestSignedLinks(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	keyFile := filepath.Join(t.TempDir(), "link-key")
+	if err := ioutil.WriteFile(keyFile, []byte("not very secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--link-signing-key-file", keyFile)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{"/page": cannedContent("<html><a href=\"/other\">shared page</a></html>")},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	encoder := enc.NewDefaultEncoder()
+	pageUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	encodedUrl, err := encoder.Encode(pageUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	share := func(encodedUrl string, ttl string) (int, map[string]interface{}) {
+		shareUrl := fmt.Sprintf("http://localhost:%s/api/v1/resources/%s/share", kp.Port(), encodedUrl)
+		res, err := http.PostForm(shareUrl, url.Values{"ttl": []string{ttl}})
+		if err != nil {
+			t.Fatalf("Share request failed: %v", err)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal([]byte(getHttpResponseBody(res, t)), &body); err != nil {
+			t.Fatalf("Failed to parse share response: %v", err)
+		}
+		return res.StatusCode, body
+	}
+	if status, _ := share(encodedUrl, ""); status != 404 {
+		t.Errorf("Expected sharing an uncached page to fail. got = %d", status)
+	}
+
+	res, err := kp.Get(pageUrl)
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if status, _ := share(encodedUrl, "-1h"); status != 400 {
+		t.Errorf("Expected a negative ttl to be rejected. got = %d", status)
+	}
+	status, body := share(encodedUrl, "1h")
+	if status != 200 || body["expires"] == nil {
+		t.Fatalf("Failed to share page. got = %d: %v", status, body)
+	}
+	signedUrl := body["url"].(string)
+
+	res, err = http.Get(signedUrl)
+	if err != nil {
+		t.Fatalf("Failed to get signed link: %v", err)
+	}
+	page := getHttpResponseBody(res, t)
+	if res.StatusCode != 200 || !strings.Contains(page, "shared page") {
+		t.Fatalf("Expected the shared page. got = %d:\n%s", res.StatusCode, page)
+	}
+	// The page mustn't send anyone into the rest of the cache.
+	if !strings.Contains(page, fmt.Sprintf("href=\"http://%s/other\"", testServerAddress)) {
+		t.Errorf("Expected links to point at their original locations:\n%s", page)
+	}
+
+	parsedSignedUrl, err := url.Parse(signedUrl)
+	if err != nil {
+		t.Fatalf("Failed to parse signed link: %v", err)
+	}
+	query := parsedSignedUrl.Query()
+	otherEncodedUrl, err := encoder.Encode(fmt.Sprintf("http://%s/other", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	extended := url.Values{"sig": query["sig"], "exp": []string{"99999999999"}}
+	for _, forged := range []string{
+		fmt.Sprintf("http://localhost:%s/s/%s?%s", kp.Port(), encodedUrl, extended.Encode()),
+		fmt.Sprintf("http://localhost:%s/s/%s?sig=%s", kp.Port(), encodedUrl, query.Get("sig")),
+		fmt.Sprintf("http://localhost:%s/s/%s?%s", kp.Port(), otherEncodedUrl, query.Encode()),
+		fmt.Sprintf("http://localhost:%s/s/%s?exp=1&sig=%s", kp.Port(), encodedUrl, query.Get("sig")),
+	} {
+		res, err := http.Get(forged)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		getHttpResponseBody(res, t)
+		if res.StatusCode != 403 {
+			t.Errorf("Expected %s to be refused. got = %d", forged, res.StatusCode)
+		}
+	}
+}
+
+func TestDiskUsageReport(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/small": cannedContent("<html>small</html>"),
+			"/large": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				buf := make([]byte, 64*1024)
+				rand.New(rand.NewSource(0)).Read(buf)
+				w.Write(buf)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	smallUrl := fmt.Sprintf("http://%s/small", testServerAddress)
+	largeUrl := fmt.Sprintf("http://%s/large", testServerAddress)
+	for _, rawUrl := range []string{smallUrl, largeUrl} {
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", rawUrl, err)
+		}
+		getHttpResponseBody(res, t)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(fmt.Sprintf("http://localhost:%s/admin/usage?top=1", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	if res.StatusCode != 200 {
+		t.Fatalf("Failed to get usage report. got = %d:\n%s", res.StatusCode, body)
+	}
+	if !strings.Contains(body, largeUrl) || strings.Contains(body, smallUrl) {
+		t.Errorf("Expected only the largest resource to be listed:\n%s", body)
+	}
+	host := strings.Split(testServerAddress, ":")[0]
+	for _, group := range []string{"application/octet-stream", "text/html"} {
+		if !strings.Contains(body, "<td>"+group+"</td>") {
+			t.Errorf("Expected usage by %s:\n%s", group, body)
+		}
+	}
+	// Hosts link to what is cached from them.
+	hostList := fmt.Sprintf("/admin/list/0?host=%s", host)
+	if !strings.Contains(body, fmt.Sprintf(`<a href="%s">%s</a>`, hostList, host)) {
+		t.Errorf("Expected usage by %s:\n%s", host, body)
+	}
+	for listUrl, want := range map[string]bool{hostList: true, "/admin/list/0?host=other.example": false} {
+		res, err := client.Get(fmt.Sprintf("http://localhost:%s%s", kp.Port(), listUrl))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if body := getHttpResponseBody(res, t); strings.Contains(body, smallUrl) != want {
+			t.Errorf("Expected %s to list %s: %v\n%s", listUrl, smallUrl, want, body)
+		}
+	}
+
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(largeUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	deleteUrl := fmt.Sprintf("http://localhost:%s/admin/delete/%s", kp.Port(), encodedUrl)
+	res, err = client.PostForm(deleteUrl, url.Values{"return": []string{"/admin/usage?top=1"}})
+	if err != nil {
+		t.Fatalf("Delete request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 303 || res.Header.Get("Location") != "/admin/usage?top=1" {
+		t.Errorf("Expected redirect back to the report. got = %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+	status, err := kp.GetStatus(largeUrl)
+	if err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	if status["state"] != "not_cached" {
+		t.Errorf("Expected deleted resource not to be cached. got = %v", status["state"])
+	}
+	res, err = client.PostForm(deleteUrl, url.Values{"return": []string{"https://elsewhere.example/"}})
+	if err != nil {
+		t.Fatalf("Delete request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 404 {
+		t.Errorf("Expected deleting an uncached resource to fail. got = %d", res.StatusCode)
+	}
+}
+
+func TestWarmApi(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/a": cannedContent("<html>a</html>"),
+			"/b": cannedContent("<html>b</html>"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	// Nothing listens on a port that was just closed.
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedAddress := ln.Addr().String()
+	ln.Close()
+
+	urls := []string{
+		fmt.Sprintf("http://%s/a", testServerAddress),
+		fmt.Sprintf("http://%s/b", testServerAddress),
+		fmt.Sprintf("http://%s/unreachable", closedAddress),
+	}
+	body := "# Pages to warm.\n" + strings.Join(urls, "\n") + "\n\n"
+	warmUrl := fmt.Sprintf("http://localhost:%s/api/v1/warm", kp.Port())
+
+	res, err := http.Post(warmUrl+"?concurrency=0", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Warm request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 400 {
+		t.Errorf("Expected bad concurrency to be rejected. got = %d", res.StatusCode)
+	}
+
+	// Sent as a form, like curl --data-binary does, to check that the body
+	// isn't parsed as one.
+	res, err = http.Post(warmUrl+"?concurrency=2&rate=100", "application/x-www-form-urlencoded", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Warm request failed: %v", err)
+	}
+	var response struct {
+		Results []struct {
+			Url       string `json:"url"`
+			CachedUrl string `json:"cached_url"`
+			Error     string `json:"error"`
+		} `json:"results"`
+		Succeeded int `json:"succeeded"`
+		Failed    int `json:"failed"`
+	}
+	if err := json.Unmarshal([]byte(getHttpResponseBody(res, t)), &response); err != nil {
+		t.Fatalf("Failed to parse warm response: %v", err)
+	}
+	if response.Succeeded != 2 || response.Failed != 1 || len(response.Results) != 3 {
+		t.Fatalf("Wrong warm results. got = %+v", response)
+	}
+	for i, result := range response.Results {
+		if result.Url != urls[i] {
+			t.Errorf("Results out of order. got = %s, want = %s", result.Url, urls[i])
+		}
+	}
+	if response.Results[0].CachedUrl == "" || response.Results[2].Error == "" {
+		t.Errorf("Wrong warm results. got = %+v", response)
+	}
+
+	// Warmed pages are served without going back to the origin.
+	res, err = kp.Get(urls[0])
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	expectedCounts := map[string]int{"/a": 1, "/b": 1}
+	if !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+}
+
+func TestBatchApi(t *testing.T) {
+	path := getKnoxBinary(t)
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/a": cannedContent("<html>a</html>"),
+			"/b": cannedContent("<html>b</html>"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	// Nothing listens on a port that was just closed.
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedAddress := ln.Addr().String()
+	ln.Close()
+
+	urls := []string{
+		fmt.Sprintf("http://%s/a", testServerAddress),
+		fmt.Sprintf("http://%s/b", testServerAddress),
+		fmt.Sprintf("http://%s/unreachable", closedAddress),
+		"ftp://example.com/file",
+	}
+	res, err := kp.Get(urls[0])
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+	getHttpResponseBody(res, t)
+
+	type batchStatus struct {
+		StatusUrl string `json:"status_url"`
+		Done      bool   `json:"done"`
+		Cached    int    `json:"cached"`
+		Failed    int    `json:"failed"`
+		Results   []struct {
+			State     string `json:"state"`
+			JobId     string `json:"job_id"`
+			CachedUrl string `json:"cached_url"`
+			Error     string `json:"error"`
+		} `json:"results"`
+	}
+	readStatus := func(res *http.Response) batchStatus {
+		var status batchStatus
+		if err := json.Unmarshal([]byte(getHttpResponseBody(res, t)), &status); err != nil {
+			t.Fatalf("Failed to parse batch status: %v", err)
+		}
+		return status
+	}
+	base := fmt.Sprintf("http://localhost:%s", kp.Port())
+	request, err := json.Marshal(map[string][]string{"urls": urls})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	res, err = http.Post(base+"/api/v1/cache:batch", "application/json", bytes.NewReader(request))
+	if err != nil {
+		t.Fatalf("Batch request failed: %v", err)
+	}
+	if res.StatusCode != 202 {
+		t.Fatalf("Expected the batch to be accepted. got = %d: %s", res.StatusCode, getHttpResponseBody(res, t))
+	}
+	status := readStatus(res)
+	if len(status.Results) != 4 {
+		t.Fatalf("Wrong batch results. got = %+v", status)
+	}
+	if result := status.Results[0]; result.State != "cached" || result.JobId != "" || result.CachedUrl == "" {
+		t.Errorf("Expected a page that was cached already to get no job. got = %+v", result)
+	}
+	for _, result := range status.Results[1:3] {
+		if result.JobId == "" || result.State == "invalid" {
+			t.Errorf("Expected a job for each uncached page. got = %+v", result)
+		}
+	}
+	if result := status.Results[3]; result.State != "invalid" || result.JobId != "" || result.Error == "" {
+		t.Errorf("Expected a URL that can't be cached to be invalid. got = %+v", result)
+	}
+
+	for start := time.Now(); !status.Done; time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Timed out waiting for the batch. got = %+v", status)
+		}
+		res, err = http.Get(base + status.StatusUrl)
+		if err != nil {
+			t.Fatalf("Status request failed: %v", err)
+		}
+		status = readStatus(res)
+	}
+	if status.Cached != 2 || status.Failed != 2 || status.Results[1].State != "cached" || status.Results[2].State != "failed" || status.Results[2].Error == "" {
+		t.Errorf("Wrong batch results. got = %+v", status)
+	}
+	th.mu.Lock()
+	if expectedCounts := map[string]int{"/a": 1, "/b": 1}; !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+	th.mu.Unlock()
+
+	tooMany, err := json.Marshal(map[string][]string{"urls": make([]string, 1001)})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	res, err = http.Post(base+"/api/v1/cache:batch", "application/json", bytes.NewReader(tooMany))
+	if err != nil {
+		t.Fatalf("Batch request failed: %v", err)
+	}
+	if getHttpResponseBody(res, t); res.StatusCode != 413 {
+		t.Errorf("Expected a batch that is too big to be refused. got = %d", res.StatusCode)
+	}
+	res, err = http.Get(base + "/api/v1/batches/unknown")
+	if err != nil {
+		t.Fatalf("Status request failed: %v", err)
+	}
+	if getHttpResponseBody(res, t); res.StatusCode != 404 {
+		t.Errorf("Expected an unknown batch not to be found. got = %d", res.StatusCode)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	path := getKnoxBinary(t)
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/start": cannedContent(`<html><a href="/a">a</a> <a href="/b">b</a> <a href="http://example.com/">elsewhere</a></html>`),
+			"/a":     cannedContent(`<html><a href="/c">c</a></html>`),
+			"/b":     cannedContent(`<html><a href="/start">start</a></html>`),
+			"/c":     cannedContent("<html>c</html>"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	type jobStatus struct {
+		Id        uint           `json:"id"`
+		StatusUrl string         `json:"status_url"`
+		State     string         `json:"state"`
+		Done      bool           `json:"done"`
+		Total     int            `json:"total"`
+		Items     map[string]int `json:"items"`
+		Log       []struct {
+			Message string `json:"message"`
+		} `json:"log"`
+	}
+	base := fmt.Sprintf("http://localhost:%s", kp.Port())
+	readStatus := func(res *http.Response) jobStatus {
+		var status jobStatus
+		if err := json.Unmarshal([]byte(getHttpResponseBody(res, t)), &status); err != nil {
+			t.Fatalf("Failed to parse job status: %v", err)
+		}
+		return status
+	}
+	queue := func(request string) jobStatus {
+		res, err := http.Post(base+"/api/v1/jobs", "application/json", strings.NewReader(request))
+		if err != nil {
+			t.Fatalf("Job request failed: %v", err)
+		}
+		if res.StatusCode != 202 {
+			t.Fatalf("Expected the job to be queued. got = %d: %s", res.StatusCode, getHttpResponseBody(res, t))
+		}
+		return readStatus(res)
+	}
+	wait := func(status jobStatus) jobStatus {
+		for start := time.Now(); !status.Done; time.Sleep(50 * time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("Timed out waiting for the job. got = %+v", status)
+			}
+			res, err := http.Get(base + status.StatusUrl)
+			if err != nil {
+				t.Fatalf("Status request failed: %v", err)
+			}
+			status = readStatus(res)
+		}
+		return status
+	}
+
+	// A crawl of depth 1 visits the pages on the same host the first page
+	// links to, but not the pages they link to.
+	crawl := wait(queue(fmt.Sprintf(`{"kind": "crawl", "urls": ["http://%s/start"], "depth": 1}`, testServerAddress)))
+	if crawl.State != "finished" || crawl.Total != 3 || crawl.Items["done"] != 3 || len(crawl.Log) == 0 {
+		t.Errorf("Wrong crawl status. got = %+v", crawl)
+	}
+	th.mu.Lock()
+	if expectedCounts := map[string]int{"/start": 1, "/a": 1, "/b": 1}; !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+	th.mu.Unlock()
+
+	// Refreshing fetches every matching resource again.
+	refresh := wait(queue(`{"kind": "refresh", "content_type": "text/html"}`))
+	if refresh.State != "finished" || refresh.Items["done"] != 3 {
+		t.Errorf("Wrong refresh status. got = %+v", refresh)
+	}
+	th.mu.Lock()
+	if expectedCounts := map[string]int{"/start": 2, "/a": 2, "/b": 2}; !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+	th.mu.Unlock()
+
+	// Jobs that haven't started yet are cancelled right away.
+	runAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	scheduled := queue(fmt.Sprintf(`{"kind": "url", "urls": ["http://%s/c"], "run_at": %q}`, testServerAddress, runAt))
+	if scheduled.State != "queued" {
+		t.Errorf("Expected the job to be queued. got = %+v", scheduled)
+	}
+	cancelUrl := fmt.Sprintf("%s/api/v1/jobs/%d/cancel", base, scheduled.Id)
+	res, err := http.Post(cancelUrl, "application/json", nil)
+	if err != nil {
+		t.Fatalf("Cancel request failed: %v", err)
+	}
+	if status := readStatus(res); res.StatusCode != 200 || status.State != "cancelled" || !status.Done || status.Items["cancelled"] != 1 {
+		t.Errorf("Expected the job to be cancelled. got = %d: %+v", res.StatusCode, status)
+	}
+	res, err = http.Post(cancelUrl, "application/json", nil)
+	if err != nil {
+		t.Fatalf("Cancel request failed: %v", err)
+	}
+	if getHttpResponseBody(res, t); res.StatusCode != 409 {
+		t.Errorf("Expected a job that ended not to be cancelled again. got = %d", res.StatusCode)
+	}
+
+	res, err = http.Post(base+"/api/v1/jobs", "application/json", strings.NewReader(`{"kind": "crawl", "urls": ["ftp://example.com/"], "depth": 1}`))
+	if err != nil {
+		t.Fatalf("Job request failed: %v", err)
+	}
+	if getHttpResponseBody(res, t); res.StatusCode != 400 {
+		t.Errorf("Expected a crawl of a URL that can't be cached to be refused. got = %d", res.StatusCode)
+	}
+	res, err = http.Get(base + "/api/v1/jobs/1000")
+	if err != nil {
+		t.Fatalf("Status request failed: %v", err)
+	}
+	if getHttpResponseBody(res, t); res.StatusCode != 404 {
+		t.Errorf("Expected an unknown job not to be found. got = %d", res.StatusCode)
+	}
+
+	res, err = http.Get(base + "/admin/jobs")
+	if err != nil {
+		t.Fatalf("Jobs page request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	for _, want := range []string{fmt.Sprintf(`href="/admin/jobs/%d"`, crawl.Id), "crawl", "refresh", "cancelled"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected jobs page to contain %q:\n%s", want, body)
+		}
+	}
+	res, err = http.Get(fmt.Sprintf("%s/admin/jobs/%d", base, crawl.Id))
+	if err != nil {
+		t.Fatalf("Job page request failed: %v", err)
+	}
+	body = getHttpResponseBody(res, t)
+	for _, want := range []string{fmt.Sprintf("http://%s/a", testServerAddress), "Started", "Finished with 3 done"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected job page to contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestScopedCrawl(t *testing.T) {
+	path := getKnoxBinary(t)
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/docs/index": cannedContent(`<html><a href="/docs/a">a</a> <a href="/docs/a?print=1">print</a> <a href="/blog/x">blog</a></html>`),
+			"/docs/a":     cannedContent(`<html><a href="/docs/c">c</a></html>`),
+			"/docs/c":     cannedContent("<html>c</html>"),
+			"/blog/x":     cannedContent("<html>x</html>"),
+			"/big/index":  cannedContent(`<html><a href="/big/a">a</a> <a href="/big/b">b</a></html>`),
+			"/big/a":      cannedContent("<html>a</html>"),
+			"/big/b":      cannedContent("<html>b</html>"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	type jobStatus struct {
+		StatusUrl  string         `json:"status_url"`
+		State      string         `json:"state"`
+		Done       bool           `json:"done"`
+		Total      int            `json:"total"`
+		Items      map[string]int `json:"items"`
+		Bytes      int            `json:"bytes"`
+		PathPrefix string         `json:"path_prefix"`
+		Exclude    []string       `json:"exclude"`
+		MaxBytes   int            `json:"max_bytes"`
+	}
+	base := fmt.Sprintf("http://localhost:%s", kp.Port())
+	post := func(request string) (int, jobStatus) {
+		res, err := http.Post(base+"/api/v1/jobs", "application/json", strings.NewReader(request))
+		if err != nil {
+			t.Fatalf("Job request failed: %v", err)
+		}
+		var status jobStatus
+		json.Unmarshal([]byte(getHttpResponseBody(res, t)), &status)
+		return res.StatusCode, status
+	}
+	wait := func(request string) jobStatus {
+		code, status := post(request)
+		if code != 202 {
+			t.Fatalf("Expected the job to be queued. got = %d", code)
+		}
+		for start := time.Now(); !status.Done; time.Sleep(50 * time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("Timed out waiting for the job. got = %+v", status)
+			}
+			res, err := http.Get(base + status.StatusUrl)
+			if err != nil {
+				t.Fatalf("Status request failed: %v", err)
+			}
+			status = jobStatus{}
+			if err := json.Unmarshal([]byte(getHttpResponseBody(res, t)), &status); err != nil {
+				t.Fatalf("Failed to parse job status: %v", err)
+			}
+		}
+		return status
+	}
+
+	// Only links under the path prefix that aren't excluded are followed.
+	crawl := wait(fmt.Sprintf(`{"kind": "crawl", "urls": ["http://%s/docs/index"], "depth": 2, "path_prefix": "/docs/", "exclude": ["print="]}`, testServerAddress))
+	if crawl.State != "finished" || crawl.Total != 3 || crawl.Items["done"] != 3 || crawl.Bytes == 0 ||
+		crawl.PathPrefix != "/docs/" || !reflect.DeepEqual(crawl.Exclude, []string{"print="}) {
+		t.Errorf("Wrong crawl status. got = %+v", crawl)
+	}
+	th.mu.Lock()
+	if expectedCounts := map[string]int{"/docs/index": 1, "/docs/a": 1, "/docs/c": 1}; !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+	th.mu.Unlock()
+
+	// Once a crawl has downloaded its max_bytes, the pages it has left are
+	// skipped.
+	crawl = wait(fmt.Sprintf(`{"kind": "crawl", "urls": ["http://%s/big/index"], "depth": 1, "max_bytes": 1}`, testServerAddress))
+	if crawl.State != "finished" || crawl.Items["done"] != 1 || crawl.Items["skipped"] != 2 || crawl.Bytes == 0 || crawl.MaxBytes != 1 {
+		t.Errorf("Wrong crawl status. got = %+v", crawl)
+	}
+	th.mu.Lock()
+	if th.UriCounts["/big/a"] != 0 || th.UriCounts["/big/b"] != 0 {
+		t.Errorf("Expected the pages past max_bytes not to be fetched. got = %v", th.UriCounts)
+	}
+	th.mu.Unlock()
+
+	for _, request := range []string{
+		`{"kind": "crawl", "urls": ["http://%s/docs/index"], "depth": 1, "scope": "everywhere"}`,
+		`{"kind": "crawl", "urls": ["http://%s/docs/index"], "depth": 1, "path_prefix": "docs"}`,
+		`{"kind": "crawl", "urls": ["http://%s/docs/index"], "depth": 1, "include": ["("]}`,
+		`{"kind": "crawl", "urls": ["http://%s/docs/index"], "depth": 1, "max_bytes": -1}`,
+	} {
+		if code, _ := post(fmt.Sprintf(request, testServerAddress)); code != 400 {
+			t.Errorf("Expected %s to be refused. got = %d", request, code)
+		}
+	}
+}
+
+func TestJobPauseAndCancel(t *testing.T) {
+	path := getKnoxBinary(t)
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	// Pages under /hang aren't served until released, or until knox gives up
+	// on them.
+	release := make(chan struct{})
+	aborted := make(chan string, 10)
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/hang": func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-release:
+					io.WriteString(w, "<html>finally</html>")
+				case <-r.Context().Done():
+					aborted <- r.URL.Path
+				}
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	type jobStatus struct {
+		Id             uint           `json:"id"`
+		StatusUrl      string         `json:"status_url"`
+		State          string         `json:"state"`
+		PauseRequested bool           `json:"pause_requested"`
+		Done           bool           `json:"done"`
+		Items          map[string]int `json:"items"`
+	}
+	base := fmt.Sprintf("http://localhost:%s", kp.Port())
+	readStatus := func(res *http.Response) jobStatus {
+		var status jobStatus
+		if err := json.Unmarshal([]byte(getHttpResponseBody(res, t)), &status); err != nil {
+			t.Fatalf("Failed to parse job status: %v", err)
+		}
+		return status
+	}
+	queue := func(rawUrl string) jobStatus {
+		request := fmt.Sprintf(`{"kind": "batch", "urls": [%q]}`, rawUrl)
+		res, err := http.Post(base+"/api/v1/jobs", "application/json", strings.NewReader(request))
+		if err != nil {
+			t.Fatalf("Job request failed: %v", err)
+		}
+		if res.StatusCode != 202 {
+			t.Fatalf("Expected the job to be queued. got = %d: %s", res.StatusCode, getHttpResponseBody(res, t))
+		}
+		return readStatus(res)
+	}
+	change := func(status jobStatus, action string) (int, jobStatus) {
+		res, err := http.Post(fmt.Sprintf("%s/api/v1/jobs/%d/%s", base, status.Id, action), "application/json", nil)
+		if err != nil {
+			t.Fatalf("Request to %s the job failed: %v", action, err)
+		}
+		if res.StatusCode != 200 {
+			getHttpResponseBody(res, t)
+			return res.StatusCode, status
+		}
+		return res.StatusCode, readStatus(res)
+	}
+	waitFor := func(status jobStatus, state string) jobStatus {
+		for start := time.Now(); status.State != state; time.Sleep(50 * time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("Timed out waiting for the job to be %s. got = %+v", state, status)
+			}
+			res, err := http.Get(base + status.StatusUrl)
+			if err != nil {
+				t.Fatalf("Status request failed: %v", err)
+			}
+			status = readStatus(res)
+		}
+		return status
+	}
+	awaitFetch := func(uri string) {
+		for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+			th.mu.Lock()
+			count := th.UriCounts[uri]
+			th.mu.Unlock()
+			if count != 0 {
+				return
+			}
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("Timed out waiting for %s to be fetched", uri)
+			}
+		}
+	}
+	awaitAborted := func(uri string) {
+		select {
+		case got := <-aborted:
+			if got != uri {
+				t.Errorf("Expected the fetch of %s to be given up on. got = %s", uri, got)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for the fetch of %s to be given up on", uri)
+		}
+	}
+
+	// Cancelling a running job gives up on the fetch it is in the middle of,
+	// which is neither cached nor recorded as a failure.
+	cancelled := queue(fmt.Sprintf("http://%s/hang/cancelled", testServerAddress))
+	awaitFetch("/hang/cancelled")
+	if code, _ := change(cancelled, "cancel"); code != 200 {
+		t.Fatalf("Expected the job to be cancelled. got = %d", code)
+	}
+	awaitAborted("/hang/cancelled")
+	cancelled = waitFor(cancelled, "cancelled")
+	if !cancelled.Done || cancelled.Items["cancelled"] != 1 {
+		t.Errorf("Wrong cancelled job. got = %+v", cancelled)
+	}
+	if code, _ := change(cancelled, "pause"); code != 409 {
+		t.Errorf("Expected a job that ended not to be paused. got = %d", code)
+	}
+
+	// Pausing a running job gives up on the fetch it is in the middle of too,
+	// but fetches it again once resumed.
+	paused := queue(fmt.Sprintf("http://%s/hang/paused", testServerAddress))
+	awaitFetch("/hang/paused")
+	if code, _ := change(paused, "pause"); code != 200 {
+		t.Fatalf("Expected the job to be paused. got = %d", code)
+	}
+	awaitAborted("/hang/paused")
+	paused = waitFor(paused, "paused")
+	if paused.Done || paused.PauseRequested || paused.Items["queued"] != 1 {
+		t.Errorf("Wrong paused job. got = %+v", paused)
+	}
+	res, err := http.Get(base + "/admin/jobs")
+	if err != nil {
+		t.Fatalf("Jobs page request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	if want := fmt.Sprintf(`action="/admin/jobs/%d/resume"`, paused.Id); !strings.Contains(body, want) {
+		t.Errorf("Expected jobs page to contain %q:\n%s", want, body)
+	}
+	res, err = http.Get(base + "/admin/failures")
+	if err != nil {
+		t.Fatalf("Failures page request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); strings.Contains(body, "/hang/") {
+		t.Errorf("Expected fetches that were given up on not to be failures:\n%s", body)
+	}
+
+	close(release)
+	if code, _ := change(paused, "resume"); code != 200 {
+		t.Fatalf("Expected the job to be resumed. got = %d", code)
+	}
+	if code, _ := change(paused, "resume"); code != 409 {
+		t.Errorf("Expected a job that isn't paused not to be resumed. got = %d", code)
+	}
+	resumed := waitFor(paused, "finished")
+	if resumed.Items["done"] != 1 {
+		t.Errorf("Wrong resumed job. got = %+v", resumed)
+	}
+	th.mu.Lock()
+	if expectedCounts := map[string]int{"/hang/cancelled": 1, "/hang/paused": 2}; !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+	th.mu.Unlock()
+}
+
+func TestBookmarksImport(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/article": cannedContent("<html>article</html>"),
+			"/recipe":  cannedContent("<html>recipe</html>"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	articleUrl := fmt.Sprintf("http://%s/article", testServerAddress)
+	recipeUrl := fmt.Sprintf("http://%s/recipe", testServerAddress)
+	exported := fmt.Sprintf(`<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<DL><p>
+    <DT><H3>Reading</H3>
+    <DL><p>
+        <DT><A HREF="%s">Article</A>
+        <DT><H3>Cooking</H3>
+        <DL><p>
+            <DT><A HREF="%s">Recipe</A>
+        </DL><p>
+    </DL><p>
+    <DT><A HREF="javascript:alert(1)">Bookmarklet</A>
+</DL>
+`, articleUrl, recipeUrl)
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	part, err := mw.CreateFormFile("bookmarks", "bookmarks.html")
+	if err != nil {
+		t.Fatalf("Failed to create form: %v", err)
+	}
+	io.WriteString(part, exported)
+	mw.Close()
+	res, err := http.Post(fmt.Sprintf("http://localhost:%s/admin/import", kp.Port()), mw.FormDataContentType(), &form)
+	if err != nil {
+		t.Fatalf("Import request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	if res.StatusCode != 200 || !strings.Contains(body, "Caching 2 bookmarks") || !strings.Contains(body, "Skipped 1") {
+		t.Fatalf("Unexpected import response. got = %d:\n%s", res.StatusCode, body)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, rawUrl := range []string{articleUrl, recipeUrl} {
+		for {
+			status, err := kp.GetStatus(rawUrl)
+			if err != nil {
+				t.Fatalf("Failed to get status: %v", err)
+			}
+			if status["state"] == "cached" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was never cached. Last state %v", rawUrl, status["state"])
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/admin/list/0", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body = getHttpResponseBody(res, t)
+	if !strings.Contains(body, "<td>Reading</td>") || !strings.Contains(body, "<td>Cooking, Reading</td>") {
+		t.Errorf("Expected folders to be kept as tags:\n%s", body)
+	}
+}
+
+func TestFeed(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/first":  cannedContent("<html><head><title>Salt &amp; Pepper</title></head><body>first</body></html>"),
+			"/second": cannedContent("<html><body>untitled</body></html>"),
+			"/plain": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "plain")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	firstUrl := fmt.Sprintf("http://%s/first", testServerAddress)
+	secondUrl := fmt.Sprintf("http://%s/second", testServerAddress)
+	for _, rawUrl := range []string{firstUrl, secondUrl, fmt.Sprintf("http://%s/plain", testServerAddress)} {
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		res.Body.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res, err := http.Get(fmt.Sprintf("http://localhost:%s/admin/feed.xml", kp.Port()))
+	if err != nil {
+		t.Fatalf("Feed request failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 || !strings.HasPrefix(res.Header.Get("Content-Type"), "application/atom+xml") {
+		t.Fatalf("Unexpected feed response: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	var feed struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+		Updated string   `xml:"updated"`
+		Entries []struct {
+			Title   string `xml:"title"`
+			Updated string `xml:"updated"`
+			Link    struct {
+				Href string `xml:"href,attr"`
+			} `xml:"link"`
+		} `xml:"entry"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&feed); err != nil {
+		t.Fatalf("Failed to decode feed: %v", err)
+	}
+
+	// Only pages are listed, the most recent first.
+	if len(feed.Entries) != 2 {
+		t.Fatalf("Wrong number of entries. got = %v", feed.Entries)
+	}
+	if feed.Entries[0].Title != secondUrl || feed.Entries[1].Title != "Salt & Pepper" {
+		t.Errorf("Wrong entry titles. got = %q, %q", feed.Entries[0].Title, feed.Entries[1].Title)
+	}
+	if feed.Updated != feed.Entries[0].Updated {
+		t.Errorf("Expected feed to be updated as of its newest entry. got = %s, want = %s", feed.Updated, feed.Entries[0].Updated)
+	}
+	cachedPrefix := fmt.Sprintf("http://localhost:%s/c/", kp.Port())
+	for _, entry := range feed.Entries {
+		if !strings.HasPrefix(entry.Link.Href, cachedPrefix) {
+			t.Errorf("Expected entry to link to the cached copy. got = %s", entry.Link.Href)
+		}
+	}
+	res, err = http.Get(feed.Entries[1].Link.Href)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); !strings.Contains(body, "first") {
+		t.Errorf("Expected entry link to serve the page. got:\n%s", body)
+	}
+}
+
+func TestMultipleListenAddresses(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	socketDir, err := ioutil.TempDir("", "knox-sockets")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(socketDir)
+	adminSocket := filepath.Join(socketDir, "admin.sock")
+	publicSocket := filepath.Join(socketDir, "public.sock")
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1",
+		"--listen-address", "unix://"+adminSocket,
+		"--public-listen-address", "unix://"+publicSocket)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("<html>page</html>"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	socketClient := func(socket string) *http.Client {
+		return &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+	}
+	getStatus := func(client *http.Client, path string) int {
+		res, err := client.Get("http://knox" + path)
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(fmt.Sprintf("http://%s/page", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to encode URL: %v", err)
+	}
+	public := socketClient(publicSocket)
+	if status := getStatus(public, "/c/"+encodedUrl); status != 200 {
+		t.Errorf("Expected public socket to serve pages. got = %d", status)
+	}
+	for _, path := range []string{"/admin/list/0", "/api/v1/resources/" + encodedUrl + "/status", "/metrics"} {
+		if status := getStatus(public, path); status != 404 {
+			t.Errorf("Expected public socket not to serve %s. got = %d", path, status)
+		}
+	}
+
+	admin := socketClient(adminSocket)
+	tcp := &http.Client{}
+	for _, client := range []*http.Client{admin, tcp} {
+		host := "knox"
+		if client == tcp {
+			host = "localhost:" + kp.Port()
+		}
+		res, err := client.Get(fmt.Sprintf("http://%s/api/v1/resources/%s/status", host, encodedUrl))
+		if err != nil {
+			t.Fatalf("Status request failed: %v", err)
+		}
+		body := getHttpResponseBody(res, t)
+		if res.StatusCode != 200 || !strings.Contains(body, `"state":"cached"`) {
+			t.Errorf("Expected %s to serve the API. got = %d: %s", host, res.StatusCode, body)
+		}
+	}
+}
+
+func TestTracingExport(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	exports := make(chan []byte, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/v1/traces" {
+			exports <- body
+		}
+	}))
+	defer collector.Close()
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--otlp-endpoint", collector.URL)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("<html>page</html>"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	res, err := kp.Get(fmt.Sprintf("http://%s/page", testServerAddress))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+
+	// Spans are exported in batches every few seconds.
+	var exported []byte
+	timeout := time.After(15 * time.Second)
+	for !bytes.Contains(exported, []byte("cachePage")) || !bytes.Contains(exported, []byte("GET /c/")) {
+		select {
+		case body := <-exports:
+			exported = append(exported, body...)
+		case <-timeout:
+			t.Fatalf("Expected request and fetch spans to be exported. got = %q", exported)
+		}
+	}
+	for _, name := range []string{"fetch", "body", "store", "transform"} {
+		if !bytes.Contains(exported, []byte(name)) {
+			t.Errorf("Expected a %s span to be exported.", name)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	grpcAddress := ln.Addr().String()
+	ln.Close()
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--grpc-listen-address", grpcAddress, "--circuit-breaker-failures", "2", "--circuit-breaker-cooldown", "1h")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	broken := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/broken1": broken,
+			"/broken2": broken,
+			"/broken3": broken,
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	for _, path := range []string{"/broken1", "/broken2", "/broken3"} {
+		res, err := kp.Get(fmt.Sprintf("http://%s%s", testServerAddress, path))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 502 {
+			t.Errorf("Wrong response code for %s. got = %d, want = %d.", path, res.StatusCode, 502)
+		}
+	}
+	if count := th.UriCounts["/broken3"]; count != 0 {
+		t.Errorf("Expected the open circuit to keep knox from contacting the origin. got = %d requests", count)
+	}
+
+	conn, err := grpc.Dial(grpcAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial gRPC server: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stats, err := api.NewKnoxClient(conn).GetStats(ctx, &api.GetStatsRequest{})
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	breakers := stats.CircuitBreakers
+	if len(breakers) != 1 || breakers[0].Host != testServerAddress || breakers[0].State != api.CircuitState_OPEN || breakers[0].ConsecutiveFailures != 2 {
+		t.Errorf("Wrong circuit breakers. got = %v", breakers)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--read-timeout", "1s", "--write-timeout", "1s")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	chunk := strings.Repeat("x", 1024)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/slow": func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 5; i += 1 {
+					io.WriteString(w, chunk)
+					w.(http.Flusher).Flush()
+					time.Sleep(500 * time.Millisecond)
+				}
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	// The download takes longer than the write timeout, but is streamed as
+	// it arrives.
+	res, err := kp.Get(fmt.Sprintf("http://%s/slow", testServerAddress))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); body != strings.Repeat(chunk, 5) {
+		t.Errorf("Wrong body. got %d bytes, want %d", len(body), 5*len(chunk))
+	}
+
+	// A client that never finishes its request is disconnected.
+	conn, err := net.Dial("tcp", "localhost:"+kp.Port())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\n")
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("Expected knox to close the connection. got = %v", err)
+	}
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--upstream-response-header-timeout", "500ms", "--upstream-read-timeout", "500ms")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	release := make(chan struct{})
+	defer close(release)
+	hang := func(r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/silent": func(w http.ResponseWriter, r *http.Request) {
+				hang(r)
+			},
+			"/stalled": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "1000")
+				io.WriteString(w, "partial")
+				w.(http.Flusher).Flush()
+				hang(r)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	// Origins that stop responding are given up on, and the failure is
+	// recorded like any other rather than fetched again right away.
+	for _, uri := range []string{"/silent", "/stalled"} {
+		rawUrl := fmt.Sprintf("http://%s%s", testServerAddress, uri)
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		getHttpResponseBody(res, t)
+		res, err = kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if body := getHttpResponseBody(res, t); res.StatusCode != 502 || res.Header.Get("Retry-After") == "" {
+			t.Errorf("Expected the timed out fetch of %s to be recorded as failed. got = %d: %s", uri, res.StatusCode, body)
+		}
+	}
+	th.mu.Lock()
+	if expectedCounts := map[string]int{"/silent": 1, "/stalled": 1}; !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+	th.mu.Unlock()
+}
+
+func TestMaxConcurrentDownloads(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--max-concurrent-downloads", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	unblock := make(chan struct{})
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/slow": func(w http.ResponseWriter, r *http.Request) {
+				<-unblock
+				io.WriteString(w, "slow")
+			},
+			"/fast": cannedContent("fast"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	bodies := make(chan string, 2)
+	get := func(path string) {
+		res, err := kp.Get(fmt.Sprintf("http://%s%s", testServerAddress, path))
+		if err != nil {
+			t.Errorf("Request for %s failed: %v", path, err)
+			bodies <- ""
+			return
+		}
+		bodies <- getHttpResponseBody(res, t)
+	}
+	requested := func(path string) int {
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		return th.UriCounts[path]
+	}
+	go get("/slow")
+	for requested("/slow") == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	go get("/fast")
+	time.Sleep(500 * time.Millisecond)
+	if requested("/fast") != 0 {
+		t.Errorf("Expected the second download to wait for the first.")
+	}
+	close(unblock)
+	got := []string{<-bodies, <-bodies}
+	if got[0] != "slow" || got[1] != "fast" {
+		t.Errorf("Wrong bodies. got = %v, want = [slow fast]", got)
+	}
+}
+
+func TestBandwidthThrottling(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--upstream-bandwidth-per-host", "16384", "--downstream-bandwidth", "16384")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	body := strings.Repeat("x", 48*1024)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			// Of a type that isn't compressed on the way out, so that all
+			// of it counts against the cap.
+			"/large": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				io.WriteString(w, body)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	// The first fetch is capped on the way in and the second, from the
+	// cache, on the way out. Each gets its first second's worth for free.
+	for i, description := range []string{"download", "cached copy"} {
+		start := time.Now()
+		res, err := kp.Get(fmt.Sprintf("http://%s/large", testServerAddress))
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		if got := getHttpResponseBody(res, t); got != body {
+			t.Errorf("Wrong body for the %s. got %d bytes, want %d", description, len(got), len(body))
+		}
+		if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+			t.Errorf("Expected the %s to be throttled to 16KiB/s. got 48KiB in %v", description, elapsed)
+		}
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	body := strings.Repeat("compressible ", 1000)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/text": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, body)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	rawUrl := fmt.Sprintf("http://%s/text", testServerAddress)
+	res, err := kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(rawUrl)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// Without the client decompressing for us.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for _, page := range []string{"/c/" + encodedUrl, "/admin/list/0"} {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s%s", kp.Port(), page), nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer res.Body.Close()
+		if res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Expected %s to be compressed. got = %v", page, res.Header)
+			continue
+		}
+		gr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		got, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", page, err)
+		}
+		if page != "/admin/list/0" && string(got) != body {
+			t.Errorf("Wrong body. got %d bytes, want %d", len(got), len(body))
+		}
+	}
+}
+
+func TestGzipPassthrough(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	// Bodies served from memory are decompressed already.
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--memory-cache-size", "0")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	body := strings.Repeat("compressible ", 1000)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/data": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				io.WriteString(w, body)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	rawUrl := fmt.Sprintf("http://%s/data", testServerAddress)
+	res, err := kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(rawUrl)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	get := func(acceptEncoding string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/c/%s", kp.Port(), encodedUrl), nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		// Without the client decompressing for us.
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer res.Body.Close()
+		got, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("Failed to read body: %v", err)
+		}
+		return res, got
+	}
+
+	// Sent as it is stored, although knox wouldn't compress the type itself.
+	res, got := get("gzip")
+	if res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("Vary") != "Accept-Encoding" || res.ContentLength != int64(len(got)) || len(got) >= len(body) {
+		t.Fatalf("Expected the stored gzip body. got %d bytes, %v", len(got), res.Header)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if decoded, err := ioutil.ReadAll(gr); err != nil || string(decoded) != body {
+		t.Errorf("Wrong body. got %d bytes, %v, want %d", len(decoded), err, len(body))
+	}
+
+	// Clients that don't accept gzip get the body decompressed.
+	for _, acceptEncoding := range []string{"identity", "br"} {
+		res, got := get(acceptEncoding)
+		if res.Header.Get("Content-Encoding") != "" || string(got) != body {
+			t.Errorf("Expected the body as it is for %q. got %d bytes, %v", acceptEncoding, len(got), res.Header)
+		}
+	}
+}
+
+func TestSkipCompression(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	grpcAddress := ln.Addr().String()
+	ln.Close()
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--grpc-listen-address", grpcAddress, "--compression-level", "9")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	// Compresses well, but is stored as it is because it claims not to.
+	body := strings.Repeat("a", 64*1024)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/photo": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/jpeg")
+				io.WriteString(w, body)
+			},
+			"/text": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, body)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	conn, err := grpc.Dial(grpcAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial gRPC server: %v", err)
+	}
+	defer conn.Close()
+	client := api.NewKnoxClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, path := range []string{"/photo", "/text"} {
+		rawUrl := fmt.Sprintf("http://%s%s", testServerAddress, path)
+		if _, err := client.Create(ctx, &api.CreateRequest{Url: rawUrl}); err != nil {
+			t.Fatalf("Failed to cache %s: %v", rawUrl, err)
+		}
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if got := getHttpResponseBody(res, t); got != body {
+			t.Errorf("Wrong body for %s. got %d bytes, want %d", path, len(got), len(body))
+		}
+	}
+	list, err := client.List(ctx, &api.ListRequest{})
+	if err != nil {
+		t.Fatalf("Failed to list resources: %v", err)
+	}
+	bytesOnDisk := map[string]int64{}
+	for _, resource := range list.Resources {
+		bytesOnDisk[strings.TrimPrefix(resource.Url, "http://"+testServerAddress)] = resource.BytesOnDisk
+	}
+	if got := bytesOnDisk["/photo"]; got < int64(len(body)) {
+		t.Errorf("Expected the JPEG to be stored uncompressed. got = %d bytes on disk", got)
+	}
+	if got := bytesOnDisk["/text"]; got == 0 || got > 1024 {
+		t.Errorf("Expected the text to be compressed. got = %d bytes on disk", got)
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	var acceptEncoding string
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", "gzip")
+				gw := gzip.NewWriter(w)
+				io.WriteString(gw, `<html><body><a href="/other">link</a></body></html>`)
+				gw.Close()
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	rawUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	res, err := kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	// The link can only have been rewritten if the page was decoded.
+	if !strings.Contains(body, "/c/") || !strings.Contains(body, ">link</a>") {
+		t.Errorf("Expected a decoded page with rewritten links. got = %q", body)
+	}
+	if !strings.Contains(acceptEncoding, "br") || !strings.Contains(acceptEncoding, "gzip") {
+		t.Errorf("Wrong Accept-Encoding sent to the origin. got = %q", acceptEncoding)
+	}
+
+	status, err := kp.GetStatus(rawUrl)
+	if err != nil {
+		t.Fatalf("Status request failed: %v", err)
+	}
+	if status["content_encoding"] != "gzip" {
+		t.Errorf("Wrong content encoding. got = %v, want = %v", status["content_encoding"], "gzip")
+	}
+}
+
+// Waits for the replication worker, which leaves resources that finished in
+// the last several seconds for its next pass.
+func awaitReplicated(t *testing.T, kp KnoxProcess, rawUrl string) {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		status, err := kp.GetStatus(rawUrl)
+		if err != nil {
+			t.Fatalf("Status request failed: %v", err)
+		}
+		if status["state"] == "cached" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be replicated. got state = %v", rawUrl, status["state"])
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	path := getKnoxBinary(t)
+	body := "replicate me"
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent(body),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	rawUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+
+	remote, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "remote", "--accept-replicas")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer remote.Close()
+	defer remote.DumpStreams()
+	// A knox instance serving the replica directory shares its db with the
+	// primary's replication worker.
+	replicaDir := makeDatastoreRoot(t)
+	local, err := NewKnoxProcess(path, replicaDir, "localhost:0", "local")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer local.Close()
+	defer local.DumpStreams()
+
+	for i, replica := range []struct {
+		target string
+		kp     KnoxProcess
+	}{
+		{"http://localhost:" + remote.Port(), remote},
+		{replicaDir, local},
+	} {
+		primary, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", fmt.Sprintf("primary%d", i), "--replicate-to", replica.target, "--replication-interval", "100ms")
+		if err != nil {
+			t.Fatalf("Failed to start process: %v\n", err)
+		}
+		res, err := primary.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if got := getHttpResponseBody(res, t); got != body {
+			t.Fatalf("Wrong content. got = %q, want = %q", got, body)
+		}
+		awaitReplicated(t, replica.kp, rawUrl)
+		primary.Close()
+		primary.DumpStreams()
+
+		res, err = replica.kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request to replica failed: %v", err)
+		}
+		if got := getHttpResponseBody(res, t); got != body {
+			t.Errorf("Wrong replicated content. got = %q, want = %q", got, body)
+		}
+	}
+	// Each primary fetched the page once, and the replicas served it
+	// without going to the origin.
+	if th.UriCounts["/page"] != 2 {
+		t.Errorf("Wrong origin request count. got = %d, want = 2", th.UriCounts["/page"])
+	}
+
+	// Instances that don't accept replicas refuse them.
+	res, err := http.Post(fmt.Sprintf("http://localhost:%s/api/v1/replicas", local.Port()), "multipart/form-data", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("Wrong status. got = %d, want = 404", res.StatusCode)
+	}
+}
+
+func TestAccessesFlushedOnShutdown(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("page"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	rawUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--access-flush-interval", "1h")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	for i := 0; i < 2; i++ {
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		getHttpResponseBody(res, t)
+	}
+	if err := kp.Close(); err != nil {
+		t.Fatalf("Failed to stop process: %v", err)
+	}
+	kp.DumpStreams()
+
+	// The miss and the hit were written on shutdown, long before the flush
+	// interval was up.
+	kp, err = NewKnoxProcess(path, datastoreRoot, "localhost:0", "2")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	res, err := http.Get(fmt.Sprintf("http://localhost:%s/metrics", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if metrics := getHttpResponseBody(res, t); !strings.Contains(metrics, "\nknox_datastore_hit_ratio 0.5\n") {
+		t.Errorf("Expected a hit ratio of 0.5. got = %s", metrics)
+	}
+}
+
+func TestColdTier(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	coldRoot := makeDatastoreRoot(t)
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("page"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	rawUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	res, err := kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if err := kp.Close(); err != nil {
+		t.Fatalf("Failed to stop process: %v", err)
+	}
+	kp.DumpStreams()
+
+	// Idle resources are offloaded as soon as knox starts.
+	kp, err = NewKnoxProcess(path, datastoreRoot, "localhost:0", "2", "--cold-tier-root", coldRoot, "--cold-tier-after", "1ms")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		res, err := http.Get(fmt.Sprintf("http://localhost:%s/metrics", kp.Port()))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		metrics := getHttpResponseBody(res, t)
+		if strings.Contains(metrics, "\nknox_resources_offloaded_total 1\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a resource to be offloaded. got = %s", metrics)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/admin/list/0", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); !strings.Contains(body, "<td>Cold</td>") {
+		t.Errorf("Expected the admin list to show the resource as cold. got = %s", body)
+	}
+
+	// The body is fetched back from the cold tier, not the origin.
+	res, err = kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); body != "page" {
+		t.Errorf("Wrong body. got = %q, want = %q", body, "page")
+	}
+	if hits := th.UriCounts["/page"]; hits != 1 {
+		t.Errorf("Expected the origin to be hit once. got = %d", hits)
+	}
+}
+
+func TestListResources(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("page"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	var rawUrls []string
+	for i := 0; i < 3; i++ {
+		rawUrl := fmt.Sprintf("http://%s/page%d", testServerAddress, i)
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		res.Body.Close()
+		rawUrls = append(rawUrls, rawUrl)
+	}
+
+	list := func(query string) ([]string, string) {
+		res, err := http.Get(fmt.Sprintf("http://localhost:%s/api/v1/resources?%s", kp.Port(), query))
+		if err != nil {
+			t.Fatalf("List request failed: %v", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("List failed with code %d", res.StatusCode)
+		}
+		var resp struct {
+			Resources []struct {
+				Url string `json:"url"`
+			} `json:"resources"`
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode list response: %v", err)
+		}
+		var urls []string
+		for _, resource := range resp.Resources {
+			urls = append(urls, resource.Url)
+		}
+		return urls, resp.NextCursor
+	}
+
+	first, cursor := list("count=2")
+	if want := []string{rawUrls[2], rawUrls[1]}; !reflect.DeepEqual(first, want) || cursor == "" {
+		t.Fatalf("Wrong first page. got = %v, %q, want = %v", first, cursor, want)
+	}
+	// A resource cached in between doesn't shift the next page.
+	res, err := kp.Get(fmt.Sprintf("http://%s/page3", testServerAddress))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	second, cursor := list("count=2&after=" + url.QueryEscape(cursor))
+	if want := []string{rawUrls[0]}; !reflect.DeepEqual(second, want) || cursor != "" {
+		t.Errorf("Wrong second page. got = %v, %q, want = %v", second, cursor, want)
+	}
+
+	// The sniffed content type and the status were recorded.
+	if typed, _ := list("content_type=text/plain&status=200"); len(typed) != 4 {
+		t.Errorf("Expected every resource to be listed as text/plain. got = %v", typed)
+	}
+	if typed, _ := list("content_type=image/*"); len(typed) != 0 {
+		t.Errorf("Expected no images. got = %v", typed)
+	}
+
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/api/v1/resources?after=bogus", kp.Port()))
+	if err != nil {
+		t.Fatalf("List request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("Expected a malformed cursor to be rejected. got = %d", res.StatusCode)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("page"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	rawUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+
+	// Stands in for a Kafka REST proxy.
+	type eventJson struct {
+		Type       string `json:"type"`
+		Url        string `json:"url"`
+		EncodedUrl string `json:"encoded_url"`
+	}
+	events := make(chan eventJson, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var records struct {
+			Records []struct {
+				Key   string    `json:"key"`
+				Value eventJson `json:"value"`
+			} `json:"records"`
+		}
+		json.NewDecoder(r.Body).Decode(&records)
+		for _, record := range records.Records {
+			events <- record.Value
+		}
+		w.Write([]byte(`{"offsets":[]}`))
+	}))
+	defer proxy.Close()
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--events-to", proxy.URL+"/topics/knox-events")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	res, err := kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(rawUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	res, err = http.PostForm(fmt.Sprintf("http://localhost:%s/admin/delete/%s", kp.Port(), encodedUrl), url.Values{})
+	if err != nil {
+		t.Fatalf("Delete request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+
+	for _, wantType := range []string{"created", "completed", "deleted"} {
+		want := eventJson{wantType, rawUrl, encodedUrl}
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("Wrong event. got = %+v, want = %+v", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for %s event", wantType)
+		}
+	}
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/notes.txt": cannedContent("notes"),
+			"/clip":      cannedContent("clip"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	configFile := filepath.Join(datastoreRoot, "knox.conf")
+	if err := ioutil.WriteFile(configFile, []byte("# Nothing is denied yet.\nfailure-ttl=1h\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--config-file", configFile)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	res, err := kp.Get(fmt.Sprintf("http://%s/notes.txt", testServerAddress))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); res.StatusCode != 200 {
+		t.Fatalf("Wrong status. got = %d, want = 200:\n%s", res.StatusCode, body)
+	}
+
+	host := strings.Split(testServerAddress, ":")[0]
+	if err := ioutil.WriteFile(configFile, []byte("failure-ttl=1h\ndeny-host="+host+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if err := kp.proc.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to signal process: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		stderr, err := ioutil.ReadFile(kp.stderr.Name())
+		if err != nil {
+			t.Fatalf("Failed to read stderr: %v", err)
+		}
+		if strings.Contains(string(stderr), "Reloaded "+configFile) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the config file to be reloaded:\n%s", stderr)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The listener stays up and the new host rules apply.
+	res, err = kp.Get(fmt.Sprintf("http://%s/clip", testServerAddress))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); res.StatusCode != 403 {
+		t.Errorf("Expected the host to be denied after the reload. got = %d:\n%s", res.StatusCode, body)
+	}
+}
+
+func TestAdminEvents(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	unblock := make(chan struct{})
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/slow": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "10")
+				io.WriteString(w, "first")
+				w.(http.Flusher).Flush()
+				<-unblock
+				io.WriteString(w, "later")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	rawUrl := fmt.Sprintf("http://%s/slow", testServerAddress)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	stream, err := http.Get(fmt.Sprintf("http://localhost:%s/admin/events", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer stream.Body.Close()
+	if contentType := stream.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Wrong content type. got = %q", contentType)
+	}
+	type eventJson struct {
+		Type     string `json:"type"`
+		Url      string `json:"url"`
+		RawBytes int64  `json:"raw_bytes"`
+	}
+	events := make(chan eventJson, 100)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(stream.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				var event eventJson
+				json.Unmarshal([]byte(data), &event)
+				events <- event
+			}
+		}
+	}()
+	awaitEvent := func(want eventJson) {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case got, ok := <-events:
+				if !ok {
+					t.Fatalf("Stream ended before %+v", want)
+				}
+				if got == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Timed out waiting for %+v", want)
+			}
+		}
+	}
+
+	go func() {
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Errorf("Request failed: %v", err)
+			return
+		}
+		getHttpResponseBody(res, t)
+	}()
+	awaitEvent(eventJson{"created", rawUrl, 0})
+	awaitEvent(eventJson{"progress", rawUrl, 5})
+	close(unblock)
+	awaitEvent(eventJson{"completed", rawUrl, 0})
+
+	res, err := http.Get(fmt.Sprintf("http://localhost:%s/admin/list/0", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); !strings.Contains(body, "/static/admin_live.js") {
+		t.Errorf("Expected the admin list to follow the event stream:\n%s", body)
+	}
+}
+
+func TestResourceEvents(t *testing.T) {
+	path := getKnoxBinary(t)
+	unblock := make(chan struct{})
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/slow": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "10")
+				io.WriteString(w, "first")
+				w.(http.Flusher).Flush()
+				<-unblock
+				io.WriteString(w, "later")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	rawUrl := fmt.Sprintf("http://%s/slow", testServerAddress)
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(rawUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode %s: %v", rawUrl, err)
+	}
+
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	stream, err := http.Get(fmt.Sprintf("http://localhost:%s/api/v1/resources/%s/events", kp.Port(), encodedUrl))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer stream.Body.Close()
+	if contentType := stream.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Wrong content type. got = %q", contentType)
+	}
+	type eventJson struct {
+		Event     string
+		State     string `json:"state"`
+		RawBytes  int64  `json:"raw_bytes"`
+		Percent   int    `json:"percent"`
+		CachedUrl string `json:"cached_url"`
+	}
+	events := make(chan eventJson, 100)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(stream.Body)
+		eventType := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "event: ") {
+				eventType = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				event := eventJson{Event: eventType}
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+				events <- event
+			}
+		}
+	}()
+	awaitEvent := func(matches func(eventJson) bool, description string) eventJson {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case got, ok := <-events:
+				if !ok {
+					t.Fatalf("Stream ended before %s", description)
+				}
+				if matches(got) {
+					return got
+				}
+			case <-timeout:
+				t.Fatalf("Timed out waiting for %s", description)
+			}
+		}
+	}
+
+	awaitEvent(func(e eventJson) bool { return e.Event == "state" && e.State == "not_cached" }, "the resource not to be cached")
+	res := submitCreateForm(t, kp, rawUrl)
+	if body := getHttpResponseBody(res, t); res.StatusCode != 200 || !strings.Contains(body, "/static/create.js") || !strings.Contains(body, "/api/v1/resources/"+encodedUrl+"/events") {
+		t.Errorf("Expected the create page to follow the download. got = %d:\n%s", res.StatusCode, body)
+	}
+	awaitEvent(func(e eventJson) bool { return e.State == "downloading" && e.RawBytes == 5 && e.Percent == 50 }, "half of the download")
+	close(unblock)
+	cached := awaitEvent(func(e eventJson) bool { return e.Event == "state" && e.State == "cached" }, "the download to finish")
+	if !strings.Contains(cached.CachedUrl, "/c/") {
+		t.Errorf("Expected the cached URL. got = %+v", cached)
+	}
+	select {
+	case event, ok := <-events:
+		if ok {
+			t.Errorf("Expected the stream to end once the resource was cached. got = %+v", event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("Timed out waiting for the stream to end.")
+	}
+}
+
+func TestStoredHeaders(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Origin-Header", "kept-value")
+				w.Header().Set("Via", "1.1 origin")
+				w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+				io.WriteString(w, "<html></html>")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	rawUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+
+	rulesFile := filepath.Join(t.TempDir(), "headers.txt")
+	if err := ioutil.WriteFile(rulesFile, []byte("serve * X-Frame-Options set DENY\n"), 0644); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--header-rules-file", rulesFile)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	res, err := kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(rawUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/admin/headers/%s", kp.Port(), encodedUrl))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Wrong status. got = %d", res.StatusCode)
+	}
+	body := getHttpResponseBody(res, t)
+	stored := body[:strings.Index(body, `id="filtered"`)]
+	filtered := body[strings.Index(body, `id="filtered"`):]
+	for _, want := range []string{"X-Origin-Header", "kept-value", "Sent as DENY", "X-Frame-Options set DENY"} {
+		if !strings.Contains(stored, want) {
+			t.Errorf("Expected %q among the stored headers:\n%s", want, stored)
+		}
+	}
+	for _, want := range []string{"Via", "1.1 origin", "Date", "store * Date drop"} {
+		if !strings.Contains(filtered, want) {
+			t.Errorf("Expected %q among the filtered headers:\n%s", want, filtered)
+		}
+	}
+	if strings.Contains(stored, "1.1 origin") {
+		t.Errorf("Expected Via not to be stored:\n%s", stored)
+	}
+
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/admin/list/0", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); !strings.Contains(body, "/admin/headers/"+encodedUrl) {
+		t.Errorf("Expected the admin list to link to the headers:\n%s", body)
+	}
+
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/admin/headers/%s", kp.Port(), encodedUrl+"x"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 404 && res.StatusCode != 400 {
+		t.Errorf("Expected an uncached resource to be refused. got = %d", res.StatusCode)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "<html><body>lang=%s archive=%s cookie=%s</body></html>", r.Header.Get("Accept-Language"), r.Header.Get("X-Archive"), r.Header.Get("Cookie"))
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	rawUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--upstream-header", "X-Archive: knox")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(rawUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s/c/%s", kp.Port(), encodedUrl), nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Accept-Language", "de-DE")
+	req.Header.Set("Cookie", "session=secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); !strings.Contains(body, "lang=de-DE archive=knox cookie=<") {
+		t.Errorf("Expected the page to be fetched with the client's language and the upstream header, but not its cookies:\n%s", body)
+	}
+
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/admin/headers/%s", kp.Port(), encodedUrl))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	request := body[strings.Index(body, `id="request"`):strings.Index(body, `id="stored"`)]
+	for _, want := range []string{"Accept-Language", "de-DE", "X-Archive", "knox", "User-Agent"} {
+		if !strings.Contains(request, want) {
+			t.Errorf("Expected %q among the request headers:\n%s", want, request)
+		}
+	}
+	if strings.Contains(request, "secret") {
+		t.Errorf("Expected the cookie not to be recorded:\n%s", request)
+	}
+}
+
+func TestStatsApi(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "<html></html>")
+			},
+			"/broken": func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(503)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	for _, resource := range []string{"/page", "/page", "/broken"} {
+		res, err := kp.Get(fmt.Sprintf("http://%s%s", testServerAddress, resource))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		getHttpResponseBody(res, t)
+	}
+
+	res, err := http.Get(fmt.Sprintf("http://localhost:%s/api/v1/stats", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Wrong content type. got = %q", contentType)
+	}
+	var stats struct {
+		ResourceCount  int64 `json:"resource_count"`
+		InstanceHits   int64 `json:"instance_hits"`
+		InstanceMisses int64 `json:"instance_misses"`
+		Downloads      []struct {
+			Url string `json:"url"`
+		} `json:"downloads"`
+		Failed  int64 `json:"failed"`
+		Domains []struct {
+			Host          string `json:"host"`
+			ResourceCount int    `json:"resource_count"`
+		} `json:"domains"`
+	}
+	if err := json.Unmarshal([]byte(getHttpResponseBody(res, t)), &stats); err != nil {
+		t.Fatalf("Failed to parse stats: %v", err)
+	}
+	if stats.ResourceCount != 1 || stats.InstanceHits != 1 || stats.InstanceMisses != 1 || stats.Failed != 1 || len(stats.Downloads) != 0 {
+		t.Errorf("Wrong stats. got = %+v", stats)
+	}
+	host := strings.Split(testServerAddress, ":")[0]
+	if len(stats.Domains) != 1 || stats.Domains[0].Host != host || stats.Domains[0].ResourceCount != 1 {
+		t.Errorf("Wrong domains. got = %+v", stats.Domains)
+	}
+}
+
+func TestInternationalizedDomains(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	// The same name entered in Unicode and in punycode.
+	var locations []string
+	for _, rawUrl := range []string{"http://Bücher.invalid/", "http://xn--bcher-kva.invalid/"} {
+		res, err := client.Get(fmt.Sprintf("http://localhost:%s/capture?url=%s", kp.Port(), url.QueryEscape(rawUrl)))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		getHttpResponseBody(res, t)
+		locations = append(locations, res.Header.Get("Location"))
+	}
+	encodedUrl, err := enc.NewDefaultEncoder().Encode("http://xn--bcher-kva.invalid/")
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	for _, location := range locations {
+		if location != "/progress/"+encodedUrl {
+			t.Errorf("Expected both spellings to be captured as one resource. got = %q", locations)
+		}
+	}
+
+	// Fetched by its punycode name, which can't resolve.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res, err := http.Get(fmt.Sprintf("http://localhost:%s/progress/%s", kp.Port(), encodedUrl))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body := getHttpResponseBody(res, t)
+		if res.StatusCode == 200 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if res.StatusCode != 502 || !strings.Contains(body, "xn--bcher-kva.invalid") {
+			t.Errorf("Expected the punycode name to have been looked up. got = %d:\n%s", res.StatusCode, body)
+		}
+		break
+	}
+}
+
+func TestKeptLinkSchemes(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	links := []string{
+		"mailto:someone@example.com",
+		"TEL:+15555550100",
+		"javascript:void(0)",
+		"data:text/plain,hello",
+		"#section",
+		"ftp://files.example/a.txt",
+	}
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "<html><body>")
+				for _, link := range append(links, "/other") {
+					fmt.Fprintf(w, `<a href="%s">link</a>`, link)
+				}
+				io.WriteString(w, "</body></html>")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--keep-link-scheme", "ftp")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	res, err := kp.Get(fmt.Sprintf("http://%s/page", testServerAddress))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body := getHttpResponseBody(res, t)
+	for _, link := range links {
+		if !strings.Contains(body, fmt.Sprintf(`href="%s"`, link)) {
+			t.Errorf("Expected %s to be kept:\n%s", link, body)
+		}
+	}
+	otherUrl, err := enc.NewDefaultEncoder().Encode(fmt.Sprintf("http://%s/other", testServerAddress))
+	if err != nil {
+		t.Fatalf("Failed to encode url: %v", err)
+	}
+	if !strings.Contains(body, "/c/"+otherUrl) {
+		t.Errorf("Expected the relative link to point at the cache:\n%s", body)
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	path := getKnoxBinary(t)
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/shared":  cannedContent("shared"),
+			"/default": cannedContent("default"),
+			"/team": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				io.WriteString(w, `<html><body><a href="/shared">shared</a></body></html>`)
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	teamRoot := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "link-key")
+	if err := ioutil.WriteFile(keyFile, []byte("shared by every cache\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1", "--virtual-host", "Team-A.test="+teamRoot, "--link-signing-key-file", keyFile)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	encoder := enc.NewDefaultEncoder()
+	get := func(host string, path string) (int, string) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%s%s", kp.Port(), path), nil)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+		return res.StatusCode, getHttpResponseBody(res, t)
+	}
+	cache := func(host string, rawUrl string) string {
+		encodedUrl, err := encoder.Encode(rawUrl)
+		if err != nil {
+			t.Fatalf("Failed to encode %s: %v", rawUrl, err)
+		}
+		status, body := get(host, "/c/"+encodedUrl)
+		if status != 200 {
+			t.Fatalf("Failed to get %s through %s: %d", rawUrl, host, status)
+		}
+		return body
+	}
+	list := func(host string) []string {
+		status, body := get(host, "/api/v1/resources")
+		if status != 200 {
+			t.Fatalf("List through %s failed with code %d", host, status)
+		}
+		var resp struct {
+			Resources []struct {
+				Url string `json:"url"`
+			} `json:"resources"`
+		}
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("Failed to decode list response: %v", err)
+		}
+		var urls []string
+		for _, resource := range resp.Resources {
+			urls = append(urls, resource.Url)
+		}
+		sort.Strings(urls)
+		return urls
+	}
+
+	defaultHost := "localhost:" + kp.Port()
+	teamHost := "team-a.test:" + kp.Port()
+	sharedUrl := fmt.Sprintf("http://%s/shared", testServerAddress)
+	defaultUrl := fmt.Sprintf("http://%s/default", testServerAddress)
+	teamUrl := fmt.Sprintf("http://%s/team", testServerAddress)
+
+	cache(defaultHost, sharedUrl)
+	cache(defaultHost, defaultUrl)
+	page := cache(teamHost, teamUrl)
+	cache(teamHost, sharedUrl)
+
+	// Links on pages served to a virtual host stay on it.
+	if !strings.Contains(page, fmt.Sprintf(`href="http://%s/c/`, teamHost)) {
+		t.Errorf("Expected links pointing at %s. got:\n%s", teamHost, page)
+	}
+	if got, want := list(defaultHost), []string{defaultUrl, sharedUrl}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong resources in the default cache. got = %v, want = %v", got, want)
+	}
+	if got, want := list(teamHost), []string{sharedUrl, teamUrl}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong resources in the virtual host's cache. got = %v, want = %v", got, want)
+	}
+	// Each cache fetched the resource they share on its own.
+	th.mu.Lock()
+	sharedFetches := th.UriCounts["/shared"]
+	th.mu.Unlock()
+	if sharedFetches != 2 {
+		t.Errorf("Expected /shared to be fetched once per cache. got = %d", sharedFetches)
+	}
+	if _, err := os.Stat(filepath.Join(teamRoot, "knox.db")); err != nil {
+		t.Errorf("Expected the virtual host's database in its root: %v", err)
+	}
+
+	// A link signed for one cache doesn't open another's copy of the same
+	// URL.
+	encodedUrl, err := encoder.Encode(sharedUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode %s: %v", sharedUrl, err)
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%s/api/v1/resources/%s/share", kp.Port(), encodedUrl), nil)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	req.Host = teamHost
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Share request failed: %v", err)
+	}
+	var shared struct {
+		Url string `json:"url"`
+	}
+	if err := json.Unmarshal([]byte(getHttpResponseBody(res, t)), &shared); err != nil || res.StatusCode != 200 {
+		t.Fatalf("Failed to share %s through %s. got = %d, %v", sharedUrl, teamHost, res.StatusCode, err)
+	}
+	signedUrl, err := url.Parse(shared.Url)
+	if err != nil {
+		t.Fatalf("Bad signed link %s: %v", shared.Url, err)
+	}
+	if status, body := get(teamHost, signedUrl.RequestURI()); status != 200 || body != "shared" {
+		t.Errorf("Expected the signed link to work on %s. got = %d: %s", teamHost, status, body)
+	}
+	if status, _ := get(defaultHost, signedUrl.RequestURI()); status != 403 {
+		t.Errorf("Expected the signed link not to work on %s. got = %d", defaultHost, status)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/cached":   cannedContent("cached"),
+			"/uncached": cannedContent("uncached"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	cachedUrl := fmt.Sprintf("http://%s/cached", testServerAddress)
+	uncachedUrl := fmt.Sprintf("http://%s/uncached", testServerAddress)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	res, err := kp.Get(cachedUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	kp.Close()
+
+	kp, err = NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--read-only")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	res, err = kp.Get(cachedUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); res.StatusCode != 200 || body != "cached" {
+		t.Errorf("Expected the cached copy. got = %d: %q", res.StatusCode, body)
+	}
+	res, err = kp.Get(uncachedUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 404 {
+		t.Errorf("Expected a 404 for a resource that isn't cached. got = %d", res.StatusCode)
+	}
+
+	// The create form sends visitors to what is cached instead.
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); res.Request.URL.Path != "/admin/list/0" || strings.Contains(body, "/admin/refresh/") {
+		t.Errorf("Expected a list without refresh buttons. got = %s:\n%s", res.Request.URL, body)
+	}
+
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(cachedUrl)
+	if err != nil {
+		t.Fatalf("Failed to encode %s: %v", cachedUrl, err)
+	}
+	base := fmt.Sprintf("http://localhost:%s", kp.Port())
+	refused := []struct {
+		method string
+		url    string
+	}{
+		{"GET", base + "/?url=" + url.QueryEscape(uncachedUrl)},
+		{"POST", base + "/"},
+		{"GET", base + "/capture?url=" + url.QueryEscape(uncachedUrl)},
+		{"POST", base + "/admin/refresh/" + encodedUrl},
+		{"POST", base + "/admin/delete/" + encodedUrl},
+		{"GET", base + "/admin/import"},
+		{"POST", base + "/api/v1/resources/" + encodedUrl + "/refresh"},
+		{"POST", base + "/api/v1/capture"},
+		{"POST", base + "/api/v1/warm"},
+		{"POST", base + "/api/v1/cache:batch"},
+		{"POST", base + "/api/v1/jobs"},
+		{"POST", base + "/api/v1/replicas"},
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for _, request := range refused {
+		req, err := http.NewRequest(request.method, request.url, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		getHttpResponseBody(res, t)
+		if res.StatusCode != 403 {
+			t.Errorf("Expected %s %s to be refused. got = %d", request.method, request.url, res.StatusCode)
+		}
+	}
+
+	res, err = kp.Get(cachedUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if getHttpResponseBody(res, t); res.StatusCode != 200 {
+		t.Errorf("Expected the resource to still be cached. got = %d", res.StatusCode)
+	}
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if got, want := th.UriCounts, map[string]int{"/cached": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong fetches from the origin. got = %v, want = %v", got, want)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	path := getKnoxBinary(t)
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	unblock := make(chan struct{})
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/slow": func(w http.ResponseWriter, r *http.Request) {
+				<-unblock
+				io.WriteString(w, "slow")
+			},
+			"/cached": cannedContent("cached"),
+			"/new":    cannedContent("new"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	get := func(path string) (int, string) {
+		res, err := kp.Get(fmt.Sprintf("http://%s%s", testServerAddress, path))
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+		return res.StatusCode, getHttpResponseBody(res, t)
+	}
+	maintenanceUrl := fmt.Sprintf("http://localhost:%s/api/v1/maintenance", kp.Port())
+	type maintenanceStatus struct {
+		Maintenance      bool `json:"maintenance"`
+		DownloadsRunning int  `json:"downloads_running"`
+		Drained          bool `json:"drained"`
+	}
+	decodeStatus := func(res *http.Response) maintenanceStatus {
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Maintenance request failed with code %d", res.StatusCode)
+		}
+		var status maintenanceStatus
+		if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+			t.Fatalf("Failed to decode maintenance status: %v", err)
+		}
+		return status
+	}
+	getStatus := func() maintenanceStatus {
+		res, err := http.Get(maintenanceUrl)
+		if err != nil {
+			t.Fatalf("Maintenance request failed: %v", err)
+		}
+		return decodeStatus(res)
+	}
+
+	if status, _ := get("/cached"); status != 200 {
+		t.Fatalf("Failed to cache /cached: %d", status)
+	}
+	slowBody := make(chan string, 1)
+	go func() {
+		_, body := get("/slow")
+		slowBody <- body
+	}()
+	for getStatus().DownloadsRunning == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res, err := http.Post(maintenanceUrl, "application/json", strings.NewReader(`{"maintenance": true}`))
+	if err != nil {
+		t.Fatalf("Maintenance request failed: %v", err)
+	}
+	if status := decodeStatus(res); !status.Maintenance || status.Drained {
+		t.Errorf("Expected maintenance with a download in flight. got = %+v", status)
+	}
+	if status, body := get("/new"); status != 503 || !strings.Contains(body, "down for maintenance") {
+		t.Errorf("Expected a maintenance page for a new download. got = %d:\n%s", status, body)
+	}
+	if status, body := get("/cached"); status != 200 || body != "cached" {
+		t.Errorf("Expected the cached copy during maintenance. got = %d: %q", status, body)
+	}
+	res, err = http.Get(fmt.Sprintf("http://localhost:%s/", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); !strings.Contains(body, "down for maintenance") {
+		t.Errorf("Expected a maintenance banner on the create page. got:\n%s", body)
+	}
+
+	// The download in flight finishes, after which knox is drained.
+	close(unblock)
+	if body := <-slowBody; body != "slow" {
+		t.Errorf("Wrong body for the download in flight. got = %q", body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !getStatus().Drained {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting to drain. got = %+v", getStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Maintenance ends through the admin page.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err = client.PostForm(fmt.Sprintf("http://localhost:%s/admin/maintenance", kp.Port()), url.Values{"enable": {"false"}})
+	if err != nil {
+		t.Fatalf("Maintenance request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != http.StatusSeeOther {
+		t.Errorf("Expected a redirect back to the admin page. got = %d", res.StatusCode)
+	}
+	if status, body := get("/new"); status != 200 || body != "new" {
+		t.Errorf("Expected /new to be cached after maintenance. got = %d: %q", status, body)
+	}
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if got := th.UriCounts["/new"]; got != 1 {
+		t.Errorf("Expected /new to be fetched once. got = %d", got)
+	}
+}
+
+func TestRobotsPolicy(t *testing.T) {
+	path := getKnoxBinary(t)
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/robots.txt": cannedContent("User-agent: *\nDisallow: /private\n"),
+			"/private":    cannedContent("private"),
+			"/header": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Robots-Tag", "noarchive")
+				io.WriteString(w, "header")
+			},
+			"/otherbot": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Robots-Tag", "otherbot: noarchive")
+				io.WriteString(w, "otherbot")
+			},
+			"/meta": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				io.WriteString(w, `<html><head><meta name="robots" content="noindex, noarchive"></head><body>meta</body></html>`)
+			},
+			"/page": cannedContent("page"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	cases := []struct {
+		policy string
+		want   map[string]int
+		tags   []string
+	}{
+		{"ignore", map[string]int{"/private": 200, "/header": 200, "/otherbot": 200, "/meta": 200, "/page": 200}, nil},
+		{"flag", map[string]int{"/private": 200, "/header": 200, "/otherbot": 200, "/meta": 200, "/page": 200}, []string{"robots:disallowed", "robots:noarchive"}},
+		{"refuse", map[string]int{"/private": 403, "/header": 403, "/otherbot": 200, "/meta": 403, "/page": 200}, nil},
+	}
+	for _, tc := range cases {
+		func() {
+			kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1", "--robots-policy", tc.policy)
+			if err != nil {
+				t.Fatalf("Failed to start process: %v\n", err)
+			}
+			defer kp.Close()
+			defer kp.DumpStreams()
+			th.mu.Lock()
+			th.UriCounts = map[string]int{}
+			th.mu.Unlock()
+			for path, want := range tc.want {
+				res, err := kp.Get(fmt.Sprintf("http://%s%s", testServerAddress, path))
+				if err != nil {
+					t.Fatalf("Request for %s failed: %v", path, err)
+				}
+				getHttpResponseBody(res, t)
+				if res.StatusCode != want {
+					t.Errorf("Wrong status for %s with --robots-policy=%s. got = %d, want = %d", path, tc.policy, res.StatusCode, want)
+				}
+			}
+			th.mu.Lock()
+			privateFetches, robotsFetches := th.UriCounts["/private"], th.UriCounts["/robots.txt"]
+			th.mu.Unlock()
+			if tc.policy == "refuse" && privateFetches != 0 {
+				t.Errorf("Expected /private not to be fetched. got = %d", privateFetches)
+			}
+			if tc.policy == "ignore" && robotsFetches != 0 {
+				t.Errorf("Expected robots.txt not to be fetched. got = %d", robotsFetches)
+			}
+			if tc.policy != "ignore" && robotsFetches != 1 {
+				t.Errorf("Expected robots.txt to be fetched once with --robots-policy=%s. got = %d", tc.policy, robotsFetches)
+			}
+
+			res, err := http.Get(fmt.Sprintf("http://localhost:%s/admin/list/0", kp.Port()))
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			list := getHttpResponseBody(res, t)
+			for _, tag := range []string{"robots:disallowed", "robots:noarchive"} {
+				want := false
+				for _, wanted := range tc.tags {
+					want = want || wanted == tag
+				}
+				if got := strings.Contains(list, tag); got != want {
+					t.Errorf("Wrong tagging with %s for --robots-policy=%s. got = %v, want = %v", tag, tc.policy, got, want)
+				}
+			}
+		}()
+	}
+}
+
+func TestDiskSpacePreflight(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/small": cannedContent("small"),
+			"/big": func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "65536")
+				io.WriteString(w, strings.Repeat("x", 65536))
+			},
+			"/new": cannedContent("new"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	smallUrl := fmt.Sprintf("http://%s/small", testServerAddress)
+	bigUrl := fmt.Sprintf("http://%s/big", testServerAddress)
+	newUrl := fmt.Sprintf("http://%s/new", testServerAddress)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--disk-budget", "16384")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	res, err := kp.Get(smallUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); res.StatusCode != 200 || body != "small" {
+		t.Errorf("Expected a page within the budget to be cached. got = %d: %q", res.StatusCode, body)
+	}
+	res, err = kp.Get(bigUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); res.StatusCode != 507 || !strings.Contains(body, "budget") {
+		t.Errorf("Expected a page over the budget to be refused. got = %d: %.100q", res.StatusCode, body)
+	}
+	if status, err := kp.GetStatus(bigUrl); err != nil || status["state"] != "not_cached" {
+		t.Errorf("Expected nothing to be kept of the refused page. got = %v, %v", status, err)
+	}
+	kp.DumpStreams()
+	kp.Close()
+
+	// With no room left, what is cached is still served but nothing new is
+	// fetched.
+	kp, err = NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--min-free-disk", strconv.FormatInt(1<<60, 10))
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	res, err = kp.Get(smallUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); res.StatusCode != 200 || body != "small" {
+		t.Errorf("Expected the cached page to be served. got = %d: %q", res.StatusCode, body)
+	}
+	res, err = kp.Get(newUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); res.StatusCode != 507 || !strings.Contains(body, "kept free") {
+		t.Errorf("Expected a new page to be refused. got = %d: %q", res.StatusCode, body)
+	}
+	if status, err := kp.GetStatus(newUrl); err != nil || status["state"] != "not_cached" {
+		t.Errorf("Expected nothing to be kept of the refused page. got = %v, %v", status, err)
+	}
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if expectedCounts := map[string]int{"/small": 1, "/big": 1}; !reflect.DeepEqual(th.UriCounts, expectedCounts) {
+		t.Errorf("URI request counts are not right. got = %v\n want = %v\n", th.UriCounts, expectedCounts)
+	}
+}
+
+func TestAtomicDurability(t *testing.T) {
+	path := getKnoxBinary(t)
+	datastoreRoot := makeDatastoreRoot(t)
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("page"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	pageUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+
+	kp, err := NewKnoxProcess(path, datastoreRoot, "localhost:0", "1", "--durability", "atomic")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	res, err := kp.Get(pageUrl)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := getHttpResponseBody(res, t); res.StatusCode != 200 || body != "page" {
+		t.Errorf("Expected the page to be cached. got = %d: %q", res.StatusCode, body)
+	}
+	// Only renamed bodies are left once the download is done.
+	err = filepath.Walk(datastoreRoot, func(p string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(p, ".partial") {
+			t.Errorf("Expected %s to have been renamed into place.", p)
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Failed to list the datastore: %v", err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	path := getKnoxBinary(t)
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/news": cannedContent("news"),
+			"/docs": cannedContent("docs"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+	_, port, err := net.SplitHostPort(testServerAddress)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The test server is reachable under two host names, one kept forever
+	// and one kept hardly at all.
+	newsUrl := fmt.Sprintf("http://127.0.0.1:%s/news", port)
+	docsUrl := fmt.Sprintf("http://localhost:%s/docs", port)
+	args := []string{"--retention", "localhost=forever", "--retention", "127.0.0.1=1ms"}
+
+	root := makeDatastoreRoot(t)
+	kp, err := NewKnoxProcess(path, root, "localhost:0", "1", args...)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	for _, rawUrl := range []string{newsUrl, docsUrl} {
+		res, err := kp.Get(rawUrl)
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", rawUrl, err)
+		}
+		getHttpResponseBody(res, t)
+		if res.StatusCode != 200 {
+			t.Fatalf("Wrong status for %s. got = %d, want = 200", rawUrl, res.StatusCode)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// The report shows what would be deleted without deleting it.
+	res, err := http.Get(fmt.Sprintf("http://localhost:%s/admin/retention", kp.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	report := getHttpResponseBody(res, t)
+	if res.StatusCode != 200 {
+		t.Fatalf("Wrong status for the report. got = %d, want = 200", res.StatusCode)
+	}
+	if !strings.Contains(report, newsUrl) || !strings.Contains(report, "would delete 1 resources") {
+		t.Errorf("Expected the report to show %s would be deleted. got = %s", newsUrl, report)
+	}
+	if strings.Contains(report, docsUrl) {
+		t.Errorf("Expected the report not to show %s, which is kept forever.", docsUrl)
+	}
+	status, err := kp.GetStatus(newsUrl)
+	if err != nil || status["state"] != "cached" {
+		t.Errorf("Expected the report to leave %s cached. got = %v, %v", newsUrl, status, err)
+	}
+	kp.DumpStreams()
+	kp.Close()
+
+	// Expired resources are deleted on the pass made at startup.
+	kp, err = NewKnoxProcess(path, root, "localhost:0", "1", args...)
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, err := kp.GetStatus(newsUrl)
+		if err != nil {
+			t.Fatalf("Status request failed: %v", err)
+		}
+		if status["state"] == "not_cached" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be deleted. got = %v", newsUrl, status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	status, err = kp.GetStatus(docsUrl)
+	if err != nil || status["state"] != "cached" {
+		t.Errorf("Expected %s to be kept. got = %v, %v", docsUrl, status, err)
+	}
+}
+
+func TestLegalHold(t *testing.T) {
+	path := getKnoxBinary(t)
+
+	testServer, th, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/evidence": cannedContent("evidence"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	rawUrl := fmt.Sprintf("http://%s/evidence", testServerAddress)
+	res, err := kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %v", rawUrl, err)
+	}
+	getHttpResponseBody(res, t)
+	encodedUrl, err := enc.NewDefaultEncoder().Encode(rawUrl)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	hold := func(held bool) {
+		res, err := client.PostForm(fmt.Sprintf("http://localhost:%s/admin/hold/%s", kp.Port(), encodedUrl), url.Values{"held": []string{strconv.FormatBool(held)}})
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		getHttpResponseBody(res, t)
+		if res.StatusCode != 303 {
+			t.Fatalf("Wrong status for hold=%v. got = %d, want = 303", held, res.StatusCode)
+		}
+	}
+	deleteUrl := fmt.Sprintf("http://localhost:%s/admin/delete/%s", kp.Port(), encodedUrl)
+
+	hold(true)
+	status, err := kp.GetStatus(rawUrl)
+	if err != nil || status["held"] != true {
+		t.Errorf("Expected the status to show the hold. got = %v, %v", status, err)
+	}
+	res, err = client.PostForm(deleteUrl, nil)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 403 {
+		t.Errorf("Wrong status deleting a held resource. got = %d, want = 403", res.StatusCode)
+	}
+	res, err = http.Post(fmt.Sprintf("http://localhost:%s/api/v1/resources/%s/refresh", kp.Port(), encodedUrl), "", nil)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 403 {
+		t.Errorf("Wrong status refreshing a held resource. got = %d, want = 403", res.StatusCode)
+	}
+	th.mu.Lock()
+	fetches := th.UriCounts["/evidence"]
+	th.mu.Unlock()
+	if fetches != 1 {
+		t.Errorf("Expected a held resource not to be fetched again. got = %d fetches", fetches)
+	}
+
+	hold(false)
+	res, err = client.PostForm(deleteUrl, nil)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 303 {
+		t.Errorf("Wrong status deleting a released resource. got = %d, want = 303", res.StatusCode)
+	}
+}
+
+func TestAdminAllowNetwork(t *testing.T) {
+	path := getKnoxBinary(t)
+
+	testServer, _, testServerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/page": cannedContent("page"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer testServer.Close()
+
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1", "--admin-allow-network", "10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+
+	// The cache is still open to everyone.
+	rawUrl := fmt.Sprintf("http://%s/page", testServerAddress)
+	res, err := kp.Get(rawUrl)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %v", rawUrl, err)
+	}
+	if body := getHttpResponseBody(res, t); res.StatusCode != 200 || body != "page" {
+		t.Errorf("Wrong response for %s. got = %d %q, want = 200 \"page\"", rawUrl, res.StatusCode, body)
+	}
+
+	for _, path := range []string{"/admin/list/0", "/admin/usage", "/api/v1/stats"} {
+		res, err := http.Get(fmt.Sprintf("http://localhost:%s%s", kp.Port(), path))
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+		getHttpResponseBody(res, t)
+		if res.StatusCode != 403 {
+			t.Errorf("Wrong status for %s from outside --admin-allow-network. got = %d, want = 403", path, res.StatusCode)
+		}
+	}
+}
+
+func TestOidcLogin(t *testing.T) {
+	path := getKnoxBinary(t)
+
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The groups of whoever signs in with each code.
+	groups := map[string][]string{"viewer": {"ops"}, "admin": {"ops", "admins"}, "nobody": {"sales"}}
+	var mu sync.Mutex
+	var issuer, nonce string
+	segment := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	provider, _, providerAddress, err := NewTestHttpServer(
+		HttpHandlerConfig{
+			"/.well-known/openid-configuration": func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]string{
+					"issuer":                 issuer,
+					"authorization_endpoint": issuer + "/authorize",
+					"token_endpoint":         issuer + "/token",
+					"jwks_uri":               issuer + "/jwks",
+				})
+			},
+			"/jwks": func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"keys": []map[string]string{{
+						"kty": "RSA",
+						"kid": "key",
+						"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+						"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+					}},
+				})
+			},
+			"/token": func(w http.ResponseWriter, r *http.Request) {
+				code := r.FormValue("code")
+				mu.Lock()
+				signed := segment(map[string]string{"alg": "RS256", "kid": "key"}) + "." + segment(map[string]interface{}{
+					"iss":    issuer,
+					"aud":    "knox",
+					"sub":    code,
+					"email":  code + "@example.com",
+					"nonce":  nonce,
+					"exp":    time.Now().Add(time.Hour).Unix(),
+					"groups": groups[code],
+				})
+				mu.Unlock()
+				digest := sha256.Sum256([]byte(signed))
+				signature, err := rsa.SignPKCS1v15(cryptorand.Reader, key, crypto.SHA256, digest[:])
+				if err != nil {
+					w.WriteHeader(500)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]string{"id_token": signed + "." + base64.RawURLEncoding.EncodeToString(signature)})
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer provider.Close()
+	issuer = "http://" + providerAddress
+
+	kp, err := NewKnoxProcess(path, makeDatastoreRoot(t), "localhost:0", "1",
+		"--oidc-issuer", issuer, "--oidc-client-id", "knox", "--oidc-group-role", "ops=viewer", "--oidc-group-role", "admins=admin")
+	if err != nil {
+		t.Fatalf("Failed to start process: %v\n", err)
+	}
+	defer kp.Close()
+	defer kp.DumpStreams()
+	knoxUrl := fmt.Sprintf("http://localhost:%s", kp.Port())
+
+	signIn := func(code string) (*http.Client, int) {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		client := &http.Client{
+			Jar: jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		res, err := client.Get(knoxUrl + "/admin/list/0")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		getHttpResponseBody(res, t)
+		if res.StatusCode != 303 || !strings.HasPrefix(res.Header.Get("Location"), "/auth/login?") {
+			t.Fatalf("Expected to be sent to sign in. got = %d %s", res.StatusCode, res.Header.Get("Location"))
+		}
+		res, err = client.Get(knoxUrl + res.Header.Get("Location"))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		getHttpResponseBody(res, t)
+		authUrl, err := url.Parse(res.Header.Get("Location"))
+		if err != nil || res.StatusCode != 302 || authUrl.Host != providerAddress {
+			t.Fatalf("Expected to be sent to the provider. got = %d %s", res.StatusCode, res.Header.Get("Location"))
+		}
+		query := authUrl.Query()
+		if query.Get("client_id") != "knox" || query.Get("code_challenge") == "" {
+			t.Errorf("Wrong authorization request: %s", authUrl)
+		}
+		mu.Lock()
+		nonce = query.Get("nonce")
+		mu.Unlock()
+		callback := query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+		res, err = client.Get(callback)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		getHttpResponseBody(res, t)
+		return client, res.StatusCode
+	}
+
+	viewer, status := signIn("viewer")
+	if status != 303 {
+		t.Fatalf("Wrong status signing in. got = %d, want = 303", status)
+	}
+	res, err := viewer.Get(knoxUrl + "/admin/list/0")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 200 {
+		t.Errorf("Wrong status for a viewer looking at the admin pages. got = %d, want = 200", res.StatusCode)
+	}
+	res, err = viewer.PostForm(knoxUrl+"/admin/maintenance", url.Values{"enable": {"false"}})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 403 {
+		t.Errorf("Wrong status for a viewer changing something. got = %d, want = 403", res.StatusCode)
+	}
+
+	admin, status := signIn("admin")
+	if status != 303 {
+		t.Fatalf("Wrong status signing in. got = %d, want = 303", status)
+	}
+	res, err = admin.PostForm(knoxUrl+"/admin/maintenance", url.Values{"enable": {"false"}})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 303 {
+		t.Errorf("Wrong status for an admin changing something. got = %d, want = 303", res.StatusCode)
+	}
+
+	if _, status := signIn("nobody"); status != 403 {
+		t.Errorf("Wrong status signing in without a role. got = %d, want = 403", status)
+	}
+	res, err = http.PostForm(knoxUrl+"/admin/maintenance", url.Values{"enable": {"false"}})
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	getHttpResponseBody(res, t)
+	if res.StatusCode != 401 {
+		t.Errorf("Wrong status changing something without signing in. got = %d, want = 401", res.StatusCode)
+	}
+}
@@ -1,4 +1,4 @@
-package encoder
+package encoder_test
 
 import (
 	"bytes"
@@ -64,3 +64,39 @@ func BenchmarkRandomStrings(b *testing.B) {
 		invertForBenchmark(e, randomString(r))
 	}
 }
+
+func TestRequestKey(t *testing.T) {
+	key := encoder.RequestKey("POST", "https://example.com/api?q=1", []byte(`{"a":1}`))
+	method, bodyHash, url, ok := encoder.ParseRequestKey(key)
+	if !ok || method != "POST" || url != "https://example.com/api?q=1" || len(bodyHash) != 64 {
+		t.Errorf("Failed to parse request key '%s'. got = %s, %s, %s, %v", key, method, bodyHash, url, ok)
+	}
+	if other := encoder.RequestKey("POST", "https://example.com/api?q=1", []byte(`{"a":2}`)); other == key {
+		t.Errorf("Expected different bodies to have different keys.")
+	}
+	if _, _, _, ok := encoder.ParseRequestKey("https://example.com/api?q=1"); ok {
+		t.Errorf("Expected a URL not to parse as a request key.")
+	}
+	invert(encoder.NewDefaultEncoder(), key, t)
+}
+
+func TestLookupScheme(t *testing.T) {
+	url := "https://example.com/?a"
+	current, err := encoder.LookupScheme("base64")
+	if err != nil {
+		t.Fatalf("Failed to look up base64: %v", err)
+	}
+	if encoded, _ := current(url); encoded != "aHR0cHM6Ly9leGFtcGxlLmNvbS8_YQ==" {
+		t.Errorf("Expected base64 to match the default encoder. got = %s", encoded)
+	}
+	unpadded, err := encoder.LookupScheme("base64-unpadded")
+	if err != nil {
+		t.Fatalf("Failed to look up base64-unpadded: %v", err)
+	}
+	if encoded, _ := unpadded(url); encoded != "aHR0cHM6Ly9leGFtcGxlLmNvbS8_YQ" {
+		t.Errorf("Wrong unpadded encoding. got = %s", encoded)
+	}
+	if _, err := encoder.LookupScheme("base32"); err == nil {
+		t.Errorf("Expected an unknown scheme to be refused")
+	}
+}
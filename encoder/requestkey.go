@@ -0,0 +1,27 @@
+package encoder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+)
+
+// Responses to requests other than plain GETs are cached under request keys
+// rather than bare URLs: "<method> <hex SHA-256 of the body> <url>". URLs
+// can't contain spaces, so the two can't be mistaken for each other, and
+// request keys encode like any URL.
+var requestKeyRegex = regexp.MustCompile(`^([A-Z]+) ([0-9a-f]{64}) (\S+)$`)
+
+func RequestKey(method string, url string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return method + " " + hex.EncodeToString(bodyHash[:]) + " " + url
+}
+
+// Splits a request key into its parts. ok is false if key is a bare URL.
+func ParseRequestKey(key string) (method string, bodyHash string, url string, ok bool) {
+	match := requestKeyRegex.FindStringSubmatch(key)
+	if match == nil {
+		return "", "", "", false
+	}
+	return match[1], match[2], match[3], true
+}
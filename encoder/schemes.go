@@ -0,0 +1,36 @@
+package encoder
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Turns a URL into the path segment of a link to it. Unlike an Encoder, a
+// scheme that links are no longer issued with needn't be reversible, since
+// the resources its links point to are found through aliases instead.
+type Scheme func(url string) (string, error)
+
+// Every scheme links have been issued with, by name. "base64" is what
+// DefaultEncoder implements. "base64-unpadded" is the same without the
+// trailing equals signs, which some chat clients and link shorteners drop.
+var schemes = map[string]Scheme{
+	"base64": NewDefaultEncoder().Encode,
+	"base64-unpadded": func(url string) (string, error) {
+		return base64.RawURLEncoding.EncodeToString([]byte(url)), nil
+	},
+}
+
+func LookupScheme(name string) (Scheme, error) {
+	scheme, ok := schemes[name]
+	if !ok {
+		var names []string
+		for name := range schemes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown encoding scheme %s; expected one of %s", name, strings.Join(names, ", "))
+	}
+	return scheme, nil
+}
@@ -3,10 +3,34 @@ module github.com/gnossen/knoxcache
 go 1.16
 
 replace (
+	github.com/gnossen/knoxcache/api => ./api
+	github.com/gnossen/knoxcache/bookmarks => ./bookmarks
+	github.com/gnossen/knoxcache/csp => ./csp
 	github.com/gnossen/knoxcache/datastore => ./datastore
 	github.com/gnossen/knoxcache/encoder => ./encoder
+	github.com/gnossen/knoxcache/headerfilter => ./headerfilter
+	github.com/gnossen/knoxcache/hostfilter => ./hostfilter
+	github.com/gnossen/knoxcache/metrics => ./metrics
+	github.com/gnossen/knoxcache/normalizer => ./normalizer
+	github.com/gnossen/knoxcache/renderer => ./renderer
+	github.com/gnossen/knoxcache/resolver => ./resolver
+	github.com/gnossen/knoxcache/server => ./server
+	github.com/gnossen/knoxcache/throttle => ./throttle
+	github.com/gnossen/knoxcache/typefilter => ./typefilter
+	github.com/gnossen/knoxcache/ui => ./ui
 )
 
 require golang.org/x/net v0.0.0-20210525063256-abc453219eb5
 require gorm.io/gorm v1.23.8
 require gorm.io/driver/sqlite v1.3.6
+require github.com/klauspost/compress v1.15.9
+require google.golang.org/grpc v1.46.2
+require google.golang.org/protobuf v1.28.0
+require github.com/chromedp/chromedp v0.7.8
+require github.com/chromedp/cdproto v0.0.0-20220217222649-d8c14a5c6edf
+require go.opentelemetry.io/otel v1.7.0
+require go.opentelemetry.io/otel/trace v1.7.0
+require go.opentelemetry.io/otel/sdk v1.7.0
+require go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+require github.com/andybalholm/brotli v1.0.4
+require github.com/mattn/go-sqlite3 v1.14.12
@@ -0,0 +1,211 @@
+package headerfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// When a rule applies. Store rules change what is written to the datastore,
+// so they only affect resources cached afterward. Serve rules change what is
+// sent to clients, so they apply to everything already cached too.
+type Stage string
+
+const (
+	Store Stage = "store"
+	Serve Stage = "serve"
+)
+
+type Action string
+
+const (
+	// Removes the header.
+	Drop Action = "drop"
+
+	// Leaves the header alone, overriding any later rule that would change it.
+	Keep Action = "keep"
+
+	// Replaces every value of the header, or adds it if missing.
+	Set Action = "set"
+
+	// Removes the cookies that look like they keep a client signed in from
+	// Set-Cookie, leaving the rest. Only for Set-Cookie.
+	StripAuthCookies Action = "strip-auth"
+)
+
+type Rule struct {
+	Stage Stage
+
+	// One of "*", an exact hostname ("example.com"), or a wildcard matching
+	// any subdomain ("*.example.com").
+	Host string
+
+	Header string
+	Action Action
+	Value  string
+
+	// Where the rule was defined, e.g. "headers.txt:3".
+	Source string
+}
+
+func (r Rule) matchesHost(host string) bool {
+	if r.Host == "*" {
+		return true
+	}
+	if strings.HasPrefix(r.Host, "*.") {
+		return strings.HasSuffix(host, r.Host[1:])
+	}
+	return host == r.Host
+}
+
+// Parses a rule of the form "<stage> <host> <header> <action> [value]", e.g.
+// "serve *.example.com Set-Cookie drop". The value of a set rule is the rest
+// of the line and may contain spaces.
+func ParseRule(line string, source string) (Rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return Rule{}, fmt.Errorf("%s: expected a stage, host, header, and action", source)
+	}
+	r := Rule{
+		Stage:  Stage(strings.ToLower(fields[0])),
+		Host:   strings.ToLower(fields[1]),
+		Header: http.CanonicalHeaderKey(fields[2]),
+		Action: Action(strings.ToLower(fields[3])),
+		Source: source,
+	}
+	if r.Stage != Store && r.Stage != Serve {
+		return Rule{}, fmt.Errorf("%s: unknown stage '%s'", source, fields[0])
+	}
+	if r.Host != "*" && strings.Contains(strings.TrimPrefix(r.Host, "*."), "*") {
+		return Rule{}, fmt.Errorf("%s: expected a host like example.com or *.example.com", source)
+	}
+	switch r.Action {
+	case Drop, Keep, StripAuthCookies:
+		if len(fields) != 4 {
+			return Rule{}, fmt.Errorf("%s: %s rules take no value", source, r.Action)
+		}
+		if r.Action == StripAuthCookies && r.Header != "Set-Cookie" {
+			return Rule{}, fmt.Errorf("%s: %s rules only apply to Set-Cookie", source, r.Action)
+		}
+	case Set:
+		if len(fields) < 5 {
+			return Rule{}, fmt.Errorf("%s: set rules need a value", source)
+		}
+		// Everything after the action, with its spacing intact.
+		rest := line
+		for _, field := range fields[:4] {
+			rest = strings.TrimLeft(rest, " \t")
+			rest = rest[len(field):]
+		}
+		r.Value = strings.TrimSpace(rest)
+	default:
+		return Rule{}, fmt.Errorf("%s: unknown action '%s'", source, fields[3])
+	}
+	return r, nil
+}
+
+// Parses rules, one per line. Blank lines and lines starting with # are
+// ignored.
+func ParseRules(in io.Reader, name string) ([]Rule, error) {
+	var rules []Rule
+	scanner := bufio.NewScanner(in)
+	for lineNum := 1; scanner.Scan(); lineNum += 1 {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRule(line, fmt.Sprintf("%s:%d", name, lineNum))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func LoadRules(path string) ([]Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRules(f, path)
+}
+
+type HeaderFilter struct {
+	rules []Rule
+}
+
+// For each header, the first matching rule wins, so rules for specific hosts
+// should come before rules for every host.
+func NewHeaderFilter(rules []Rule) HeaderFilter {
+	return HeaderFilter{rules}
+}
+
+func (hf HeaderFilter) Rules() []Rule {
+	return hf.rules
+}
+
+// Applies the rules for stage to the headers of a response from host.
+func (hf HeaderFilter) Apply(stage Stage, host string, header http.Header) {
+	host = strings.ToLower(host)
+	decided := map[string]bool{}
+	for _, r := range hf.rules {
+		if r.Stage != stage || decided[r.Header] || !r.matchesHost(host) {
+			continue
+		}
+		decided[r.Header] = true
+		switch r.Action {
+		case Drop:
+			header.Del(r.Header)
+		case Set:
+			header.Set(r.Header, r.Value)
+		case StripAuthCookies:
+			var kept []string
+			for _, value := range header.Values(r.Header) {
+				if !isAuthCookie(value) {
+					kept = append(kept, value)
+				}
+			}
+			header.Del(r.Header)
+			for _, value := range kept {
+				header.Add(r.Header, value)
+			}
+		}
+	}
+}
+
+// Matches the names of cookies that sessions and tokens are usually kept in.
+var authCookieNameRegex = regexp.MustCompile(`(?i)sess|^sid$|[._-]sid$|^sid[._-]|auth|token|login|jwt|csrf|xsrf|remember|credential|passw|saml`)
+
+// Reports whether the cookie set by a Set-Cookie value looks like it keeps a
+// client signed in: either its name is like those of sessions and tokens, or
+// it's HttpOnly, which is how sites keep session cookies from scripts. Values
+// that don't parse are treated as such too, to be safe.
+func isAuthCookie(setCookie string) bool {
+	cookies := (&http.Response{Header: http.Header{"Set-Cookie": {setCookie}}}).Cookies()
+	if len(cookies) == 0 {
+		return true
+	}
+	return cookies[0].HttpOnly || authCookieNameRegex.MatchString(cookies[0].Name)
+}
+
+// Returns the rule that Apply follows for header at stage in a response from
+// host, or false if no rule applies to it.
+func (hf HeaderFilter) Match(stage Stage, host string, header string) (Rule, bool) {
+	host = strings.ToLower(host)
+	header = http.CanonicalHeaderKey(header)
+	for _, r := range hf.rules {
+		if r.Stage == stage && r.Header == header && r.matchesHost(host) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
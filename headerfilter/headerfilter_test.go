@@ -0,0 +1,135 @@
+package headerfilter
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# Keep cookies from the one site that needs them.
+serve login.example.com Set-Cookie keep
+serve * set-cookie drop
+serve *.example.com X-Frame-Options set  SAMEORIGIN  please
+store * Date drop
+`), "test")
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	hf := NewHeaderFilter(rules)
+	cases := []struct {
+		stage Stage
+		host  string
+		want  http.Header
+	}{
+		{Serve, "login.example.com", http.Header{
+			"Set-Cookie":      {"a=1", "b=2"},
+			"Date":            {"today"},
+			"X-Frame-Options": {"SAMEORIGIN  please"},
+		}},
+		{Serve, "Other.Example.com", http.Header{
+			"Date":            {"today"},
+			"X-Frame-Options": {"SAMEORIGIN  please"},
+		}},
+		{Serve, "example.com", http.Header{
+			"Date": {"today"},
+		}},
+		{Store, "example.com", http.Header{
+			"Set-Cookie": {"a=1", "b=2"},
+		}},
+	}
+	for _, tc := range cases {
+		header := http.Header{
+			"Set-Cookie": {"a=1", "b=2"},
+			"Date":       {"today"},
+		}
+		hf.Apply(tc.stage, tc.host, header)
+		if !reflect.DeepEqual(header, tc.want) {
+			t.Errorf("Wrong headers at %s for %s. got = %v, want = %v", tc.stage, tc.host, header, tc.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+serve login.example.com Set-Cookie keep
+serve * set-cookie drop
+store * Date drop
+`), "test")
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	hf := NewHeaderFilter(rules)
+	cases := []struct {
+		stage      Stage
+		host       string
+		header     string
+		wantSource string
+	}{
+		{Serve, "Login.example.com", "set-cookie", "test:2"},
+		{Serve, "example.com", "Set-Cookie", "test:3"},
+		{Serve, "example.com", "Date", ""},
+		{Store, "example.com", "date", "test:4"},
+		{Store, "example.com", "Set-Cookie", ""},
+	}
+	for _, tc := range cases {
+		r, ok := hf.Match(tc.stage, tc.host, tc.header)
+		if ok != (tc.wantSource != "") || r.Source != tc.wantSource {
+			t.Errorf("Wrong rule for %s at %s for %s. got = %v, %v, want = %q", tc.header, tc.stage, tc.host, r, ok, tc.wantSource)
+		}
+	}
+}
+
+func TestStripAuthCookies(t *testing.T) {
+	r, err := ParseRule("serve * set-cookie Strip-Auth", "test")
+	if err != nil {
+		t.Fatalf("Failed to parse rule: %v", err)
+	}
+	header := http.Header{
+		"Set-Cookie": {
+			"SESSIONID=abc; Path=/",
+			"theme=dark; Path=/",
+			"prefs=1; HttpOnly",
+			"_csrf=xyz",
+			"consent=yes; Max-Age=31536000",
+			"user_token=t",
+			"sid=1",
+			"not a cookie",
+		},
+		"Date": {"today"},
+	}
+	NewHeaderFilter([]Rule{r}).Apply(Serve, "example.com", header)
+	want := http.Header{
+		"Set-Cookie": {"theme=dark; Path=/", "consent=yes; Max-Age=31536000"},
+		"Date":       {"today"},
+	}
+	if !reflect.DeepEqual(header, want) {
+		t.Errorf("Wrong headers. got = %v, want = %v", header, want)
+	}
+
+	header = http.Header{"Set-Cookie": {"session=1"}}
+	NewHeaderFilter([]Rule{r}).Apply(Serve, "example.com", header)
+	if _, ok := header["Set-Cookie"]; ok {
+		t.Errorf("Expected Set-Cookie to be removed once it has no cookies left. got = %v", header)
+	}
+}
+
+func TestBadRules(t *testing.T) {
+	for _, line := range []string{
+		"serve * Date",
+		"fetch * Date drop",
+		"serve exa*mple.com Date drop",
+		"serve *.*.com Date drop",
+		"serve * Date drop now",
+		"serve * Date set",
+		"serve * Date rename Day",
+		"serve * Date strip-auth",
+		"serve * Set-Cookie strip-auth now",
+	} {
+		if _, err := ParseRule(line, "test"); err == nil {
+			t.Errorf("Expected an error for '%s'", line)
+		}
+	}
+}
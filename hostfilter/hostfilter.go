@@ -0,0 +1,240 @@
+package hostfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gnossen/knoxcache/resolver"
+)
+
+// BlockedError is returned when a fetch targets a host that is not permitted.
+type BlockedError struct {
+	Host string
+}
+
+func (e BlockedError) Error() string {
+	return fmt.Sprintf("host %s is not permitted", e.Host)
+}
+
+// Loopback, private, link-local, and other non-public ranges. Fetching these
+// on behalf of a client would expose services that are only meant to be
+// reachable from the machine or network knox runs in.
+var PrivateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// A rule is one of an exact hostname ("example.com"), a wildcard matching any
+// subdomain ("*.example.com"), or a CIDR ("10.0.0.0/8").
+type rule struct {
+	host     string
+	wildcard bool
+	network  *net.IPNet
+}
+
+func parseRule(s string) (rule, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return rule{}, fmt.Errorf("empty host rule")
+	}
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return rule{}, err
+		}
+		return rule{network: network}, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return rule{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+	if strings.HasPrefix(s, "*.") {
+		return rule{host: s[2:], wildcard: true}, nil
+	}
+	return rule{host: s}, nil
+}
+
+func (r rule) matchesHost(host string) bool {
+	if r.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.network.Contains(ip)
+	}
+	if r.wildcard {
+		return strings.HasSuffix(host, "."+r.host)
+	}
+	return host == r.host
+}
+
+func (r rule) matchesIP(ip net.IP) bool {
+	return r.network != nil && r.network.Contains(ip)
+}
+
+type HostFilter struct {
+	allow []rule
+	deny  []rule
+}
+
+// If allow is empty, every host not matched by deny is permitted. Otherwise,
+// a host must match allow and not match deny.
+func NewHostFilter(allow, deny []string) (HostFilter, error) {
+	hf := HostFilter{}
+	for _, s := range allow {
+		r, err := parseRule(s)
+		if err != nil {
+			return HostFilter{}, fmt.Errorf("bad allow rule '%s': %v", s, err)
+		}
+		hf.allow = append(hf.allow, r)
+	}
+	for _, s := range deny {
+		r, err := parseRule(s)
+		if err != nil {
+			return HostFilter{}, fmt.Errorf("bad deny rule '%s': %v", s, err)
+		}
+		hf.deny = append(hf.deny, r)
+	}
+	return hf, nil
+}
+
+// Rules written like those of a HostFilter, matched against hosts as they
+// appear in URLs without resolving them, for settings that apply to some
+// hosts rather than deciding which may be fetched. CIDRs only match IP
+// literals.
+type HostList []rule
+
+func NewHostList(rules []string) (HostList, error) {
+	var hl HostList
+	for _, s := range rules {
+		r, err := parseRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad host rule '%s': %v", s, err)
+		}
+		hl = append(hl, r)
+	}
+	return hl, nil
+}
+
+// Reports whether a hostname (or IP literal) as it appears in a URL matches
+// any of the rules. The port, if any, is ignored.
+func (hl HostList) Matches(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	for _, r := range hl {
+		if r.matchesHost(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hf HostFilter) hasAllowedNetworks() bool {
+	for _, r := range hf.allow {
+		if r.network != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks a hostname (or IP literal) as it appears in a URL. The port, if any,
+// is ignored.
+func (hf HostFilter) CheckHost(host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	for _, r := range hf.deny {
+		if r.matchesHost(host) {
+			return BlockedError{host}
+		}
+	}
+	if len(hf.allow) == 0 {
+		return nil
+	}
+	for _, r := range hf.allow {
+		if r.matchesHost(host) {
+			return nil
+		}
+	}
+	// A hostname may still resolve into an allowed network, which is checked
+	// by CheckIP once it has been resolved.
+	if net.ParseIP(host) == nil && hf.hasAllowedNetworks() {
+		return nil
+	}
+	return BlockedError{host}
+}
+
+// Checks an address that a hostname resolved to. host is only used for
+// reporting and for hostname allow rules.
+func (hf HostFilter) CheckIP(host string, ip net.IP) error {
+	for _, r := range hf.deny {
+		if r.matchesIP(ip) {
+			return BlockedError{host}
+		}
+	}
+	if !hf.hasAllowedNetworks() {
+		return nil
+	}
+	for _, r := range hf.allow {
+		if r.matchesIP(ip) || (r.network == nil && r.matchesHost(host)) {
+			return nil
+		}
+	}
+	return BlockedError{host}
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Wraps dialer so that hostnames are resolved with r and checked
+// against the filter before connecting. The connection is made to the checked
+// address itself so that a second resolution can't be used to sneak past the
+// filter.
+func (hf HostFilter) DialContext(dialer *net.Dialer, r resolver.Resolver) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if err := hf.CheckHost(host); err != nil {
+			return nil, err
+		}
+		addrs, err := r.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error = BlockedError{host}
+		for _, addr := range addrs {
+			if lastErr = hf.CheckIP(host, addr.IP); lastErr != nil {
+				continue
+			}
+			var conn net.Conn
+			conn, lastErr = dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+			if lastErr == nil {
+				return conn, nil
+			}
+		}
+		return nil, lastErr
+	}
+}
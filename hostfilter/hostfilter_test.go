@@ -0,0 +1,141 @@
+package hostfilter
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCheckHost(t *testing.T) {
+	hf, err := NewHostFilter(
+		[]string{"example.com", "*.example.org"},
+		[]string{"bad.example.org", "10.1.0.0/16"},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create host filter: %v", err)
+	}
+	cases := map[string]bool{
+		"example.com":         true,
+		"EXAMPLE.com:8080":    true,
+		"www.example.com":     false,
+		"www.example.org":     true,
+		"example.org":         false,
+		"bad.example.org":     false,
+		"10.2.3.4":            false,
+		"10.1.3.4":            false,
+		"192.168.0.1":         false,
+		"[::1]:80":            false,
+		"unrelated.host.test": false,
+	}
+	for host, want := range cases {
+		err := hf.CheckHost(host)
+		if got := err == nil; got != want {
+			t.Errorf("Wrong decision for '%s'. got = %v, want = %v", host, got, want)
+		}
+		var blocked BlockedError
+		if err != nil && !errors.As(err, &blocked) {
+			t.Errorf("Expected BlockedError for '%s' but got %v", host, err)
+		}
+	}
+}
+
+func TestHostList(t *testing.T) {
+	hl, err := NewHostList([]string{"example.com", "*.example.org", "10.1.0.0/16", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Failed to create host list: %v", err)
+	}
+	cases := map[string]bool{
+		"EXAMPLE.com:8080": true,
+		"www.example.com":  false,
+		"www.example.org":  true,
+		"example.org":      false,
+		"10.1.3.4":         true,
+		"127.0.0.1:8080":   true,
+		"localhost":        false,
+		"internal.test":    false,
+	}
+	for host, want := range cases {
+		if got := hl.Matches(host); got != want {
+			t.Errorf("Wrong match for '%s'. got = %v, want = %v", host, got, want)
+		}
+	}
+	if _, err := NewHostList([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("Expected a bad rule to be refused")
+	}
+}
+
+func TestHostnamesDeferredToAllowedNetworks(t *testing.T) {
+	hf, err := NewHostFilter([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create host filter: %v", err)
+	}
+	// Might resolve into 10.0.0.0/8, so it has to be checked after resolution.
+	if err := hf.CheckHost("internal.test"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := hf.CheckHost("192.168.0.1"); err == nil {
+		t.Errorf("Expected IP literal outside allowed network to be blocked.")
+	}
+}
+
+func TestCheckIP(t *testing.T) {
+	hf, err := NewHostFilter([]string{"example.com", "10.0.0.0/8"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatalf("Failed to create host filter: %v", err)
+	}
+	type check struct {
+		host string
+		ip   string
+		want bool
+	}
+	for _, c := range []check{
+		{"foo.test", "10.2.3.4", true},
+		{"foo.test", "10.1.3.4", false},
+		{"foo.test", "8.8.8.8", false},
+		{"example.com", "8.8.8.8", true},
+		{"example.com", "10.1.0.1", false},
+	} {
+		if got := hf.CheckIP(c.host, net.ParseIP(c.ip)) == nil; got != c.want {
+			t.Errorf("Wrong decision for %s (%s). got = %v, want = %v", c.host, c.ip, got, c.want)
+		}
+	}
+}
+
+func TestEmptyFilterAllowsEverything(t *testing.T) {
+	hf, err := NewHostFilter(nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create host filter: %v", err)
+	}
+	if err := hf.CheckHost("anything.test"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := hf.CheckIP("anything.test", net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestPrivateNetworks(t *testing.T) {
+	hf, err := NewHostFilter(nil, PrivateNetworks)
+	if err != nil {
+		t.Fatalf("Failed to create host filter: %v", err)
+	}
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.20.0.1", "192.168.1.1", "169.254.169.254", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1", "224.0.0.251", "255.255.255.255", "198.18.0.1", "192.0.0.8", "64:ff9b::7f00:1", "ff02::1"} {
+		if err := hf.CheckIP("host.test", net.ParseIP(ip)); err == nil {
+			t.Errorf("Expected %s to be blocked.", ip)
+		}
+	}
+	for _, ip := range []string{"8.8.8.8", "172.32.0.1", "2001:4860:4860::8888"} {
+		if err := hf.CheckIP("host.test", net.ParseIP(ip)); err != nil {
+			t.Errorf("Expected %s to be allowed but got %v", ip, err)
+		}
+	}
+	if err := hf.CheckHost("169.254.169.254:80"); err == nil {
+		t.Errorf("Expected link-local IP literal to be blocked.")
+	}
+}
+
+func TestBadRule(t *testing.T) {
+	if _, err := NewHostFilter([]string{"10.0.0.0/99"}, nil); err == nil {
+		t.Errorf("Expected error for invalid CIDR.")
+	}
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("knox_test_total", "A test counter.")
+	c.Inc()
+	c.Add(2)
+	r.NewGaugeFunc("knox_test_ratio", "A test gauge.", func() float64 { return 0.5 })
+	r.NewCounterFunc("knox_test_sampled_total", "A sampled test counter.", func() float64 { return 7 })
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+	want := `# HELP knox_test_total A test counter.
+# TYPE knox_test_total counter
+knox_test_total 3
+# HELP knox_test_ratio A test gauge.
+# TYPE knox_test_ratio gauge
+knox_test_ratio 0.5
+# HELP knox_test_sampled_total A sampled test counter.
+# TYPE knox_test_sampled_total counter
+knox_test_sampled_total 7
+`
+	if buf.String() != want {
+		t.Errorf("Wrong exposition.\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,199 @@
+package normalizer
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// Query parameters that only exist to track where a link was shared from.
+var DefaultStripPatterns = []string{
+	"^utm_",
+	"^fbclid$",
+	"^gclid$",
+}
+
+type Normalizer struct {
+	stripRules   []*regexp.Regexp
+	rewriteRules []RewriteRule
+}
+
+// Query parameters whose names match any of stripPatterns are removed during
+// normalization, after which rewriteRules are applied in order.
+func NewNormalizer(stripPatterns []string, rewriteRules []RewriteRule) (Normalizer, error) {
+	var stripRules []*regexp.Regexp
+	for _, pattern := range stripPatterns {
+		rule, err := regexp.Compile(pattern)
+		if err != nil {
+			return Normalizer{}, err
+		}
+		stripRules = append(stripRules, rule)
+	}
+	return Normalizer{stripRules, rewriteRules}, nil
+}
+
+func (n Normalizer) shouldStrip(key string) bool {
+	for _, rule := range n.stripRules {
+		if rule.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strips matching query parameters while leaving the order and encoding of
+// the remaining ones untouched. Some origins care about either.
+func (n Normalizer) stripQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	var kept []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		rawKey := pair
+		if i := strings.Index(pair, "="); i >= 0 {
+			rawKey = pair[:i]
+		}
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		if n.shouldStrip(key) {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	return strings.Join(kept, "&")
+}
+
+func (n Normalizer) RewriteRules() []RewriteRule {
+	return n.rewriteRules
+}
+
+// Normalizes an absolute URL so that equivalent URLs map to the same cache
+// entry.
+func (n Normalizer) Normalize(rawUrl string) (string, error) {
+	normalized, _, err := n.Explain(rawUrl)
+	return normalized, err
+}
+
+// Normalizes rawUrl like Normalize and also returns the rewrites that were
+// applied along the way.
+func (n Normalizer) Explain(rawUrl string) (string, []RewriteStep, error) {
+	normalized, err := n.canonicalize(rawUrl)
+	if err != nil {
+		return "", nil, err
+	}
+	var steps []RewriteStep
+	for _, rule := range n.rewriteRules {
+		rewritten := rule.Pattern.ReplaceAllString(normalized, rule.Replacement)
+		if rewritten == normalized {
+			continue
+		}
+		parsedUrl, err := url.Parse(rewritten)
+		if err != nil || !isHttpScheme(parsedUrl.Scheme) || parsedUrl.Host == "" {
+			return "", steps, fmt.Errorf("rewrite rule %s turned '%s' into '%s', which is not an absolute http or https URL", rule.Source, normalized, rewritten)
+		}
+		if rewritten, err = n.canonicalize(rewritten); err != nil {
+			return "", steps, err
+		}
+		if rewritten == normalized {
+			continue
+		}
+		steps = append(steps, RewriteStep{rule, normalized, rewritten})
+		normalized = rewritten
+	}
+	return normalized, steps, nil
+}
+
+func isHttpScheme(scheme string) bool {
+	scheme = strings.ToLower(scheme)
+	return scheme == "http" || scheme == "https"
+}
+
+func (n Normalizer) canonicalize(rawUrl string) (string, error) {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	parsedUrl.Scheme = strings.ToLower(parsedUrl.Scheme)
+	parsedUrl.Host = strings.ToLower(parsedUrl.Host)
+	if parsedUrl.Host, err = asciiHost(parsedUrl.Host); err != nil {
+		return "", err
+	}
+	parsedUrl.RawQuery = n.stripQuery(parsedUrl.RawQuery)
+	parsedUrl.ForceQuery = false
+	return parsedUrl.String(), nil
+}
+
+func isAscii(s string) bool {
+	for i := 0; i < len(s); i += 1 {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Converts an internationalized hostname, with or without a port, to the
+// punycode form that is looked up in DNS, so that it is cached under one
+// entry however it was entered. ASCII hosts are left alone, since the IDNA
+// rules would refuse some that resolve fine, like those with underscores.
+func asciiHost(host string) (string, error) {
+	if isAscii(host) {
+		return host, nil
+	}
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, ""
+	}
+	hostname, err = idna.Lookup.ToASCII(hostname)
+	if err != nil {
+		return "", fmt.Errorf("bad internationalized hostname %s: %v", host, err)
+	}
+	if port != "" {
+		return net.JoinHostPort(hostname, port), nil
+	}
+	return hostname, nil
+}
+
+// Shows the punycode labels of a hostname in Unicode, as people entered them.
+// Hostnames that can't be shown that way are returned as they are.
+func DisplayHost(hostname string) string {
+	if !strings.Contains(hostname, "xn--") {
+		return hostname
+	}
+	unicodeHostname, err := idna.Display.ToUnicode(hostname)
+	if err != nil {
+		return hostname
+	}
+	// Labels that don't come back the same way, like "xn--abc-", would show
+	// as a different hostname than the one fetched from.
+	if asciiHostname, err := idna.Lookup.ToASCII(unicodeHostname); err != nil || asciiHostname != hostname {
+		return hostname
+	}
+	return unicodeHostname
+}
+
+// Like DisplayHost, but for the hostname of a URL.
+func DisplayUrl(rawUrl string) string {
+	if !strings.Contains(rawUrl, "xn--") {
+		return rawUrl
+	}
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	hostname := parsedUrl.Hostname()
+	// The rest of the URL is left exactly as it was rather than being
+	// reassembled, which could escape it differently.
+	i := strings.Index(rawUrl, hostname)
+	if hostname == "" || i < 0 {
+		return rawUrl
+	}
+	return rawUrl[:i] + DisplayHost(hostname) + rawUrl[i+len(hostname):]
+}
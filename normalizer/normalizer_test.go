@@ -0,0 +1,116 @@
+package normalizer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	n, err := NewNormalizer(append(DefaultStripPatterns, "^ref$"), nil)
+	if err != nil {
+		t.Fatalf("Failed to create normalizer: %v", err)
+	}
+	cases := map[string]string{
+		"http://foo.bar/baz":                                   "http://foo.bar/baz",
+		"HTTP://Foo.Bar/Baz":                                   "http://foo.bar/Baz",
+		"http://foo.bar/baz?utm_source=x&utm_medium=y":         "http://foo.bar/baz",
+		"http://foo.bar/baz?b=2&fbclid=abc&a=1":                "http://foo.bar/baz?b=2&a=1",
+		"http://foo.bar/baz?gclid=abc&q=a%20b#frag":            "http://foo.bar/baz?q=a%20b#frag",
+		"http://foo.bar/baz?ref=hn&referrer=x":                 "http://foo.bar/baz?referrer=x",
+		"http://foo.bar/baz?utm%5Fsource=x&gclidx=1":           "http://foo.bar/baz?gclidx=1",
+		"https://foo.bar/?utm_campaign=spring&id=7&utm_term=z": "https://foo.bar/?id=7",
+		"http://Bücher.example/a":                              "http://xn--bcher-kva.example/a",
+		"http://xn--bcher-kva.example/a":                       "http://xn--bcher-kva.example/a",
+		"http://b%C3%BCcher.example:8080/a":                    "http://xn--bcher-kva.example:8080/a",
+		"http://under_score.example/":                          "http://under_score.example/",
+	}
+	for in, want := range cases {
+		got, err := n.Normalize(in)
+		if err != nil {
+			t.Errorf("Failed to normalize '%s': %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("Wrong normalization of '%s'. got = '%s', want = '%s'", in, got, want)
+		}
+	}
+}
+
+func TestDisplayUrl(t *testing.T) {
+	cases := map[string]string{
+		"http://xn--bcher-kva.example/xn--a?b": "http://bücher.example/xn--a?b",
+		"https://foo.bar/a%20b":                "https://foo.bar/a%20b",
+		"http://xn--invalid-.example/":         "http://xn--invalid-.example/",
+	}
+	for in, want := range cases {
+		if got := DisplayUrl(in); got != want {
+			t.Errorf("Wrong display of '%s'. got = '%s', want = '%s'", in, got, want)
+		}
+	}
+	if got := DisplayHost("xn--bcher-kva.example"); got != "bücher.example" {
+		t.Errorf("Wrong display of host. got = '%s'", got)
+	}
+}
+
+func TestBadPattern(t *testing.T) {
+	if _, err := NewNormalizer([]string{"("}, nil); err == nil {
+		t.Errorf("Expected error for invalid pattern.")
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	rules, err := ParseRewriteRules(strings.NewReader(`
+# Mobile sites have the same content.
+^(https?)://m\.example\.com/ $1://example.com/
+^http://example\.com/ https://example.com/
+^https://mirror\.test/(?P<path>.*)$ https://origin.test/${path}
+`), "rules")
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	n, err := NewNormalizer(DefaultStripPatterns, rules)
+	if err != nil {
+		t.Fatalf("Failed to create normalizer: %v", err)
+	}
+	cases := map[string]string{
+		"http://M.Example.com/a?utm_source=x": "https://example.com/a",
+		"https://m.example.com/b":             "https://example.com/b",
+		"https://mirror.test/c/d":             "https://origin.test/c/d",
+		"http://unrelated.test/":              "http://unrelated.test/",
+	}
+	for in, want := range cases {
+		if got, err := n.Normalize(in); err != nil || got != want {
+			t.Errorf("Wrong normalization of '%s'. got = '%s', %v, want = '%s'", in, got, err, want)
+		}
+	}
+
+	normalized, steps, err := n.Explain("http://m.example.com/a")
+	if err != nil || normalized != "https://example.com/a" {
+		t.Fatalf("Wrong explanation. got = '%s', %v", normalized, err)
+	}
+	if len(steps) != 2 || steps[0].Rule.Source != "rules:3" || steps[0].After != "http://example.com/a" || steps[1].Rule.Source != "rules:4" {
+		t.Errorf("Wrong steps. got = %v", steps)
+	}
+}
+
+func TestRewriteToNonHttpUrl(t *testing.T) {
+	rules, err := ParseRewriteRules(strings.NewReader(`^https?:// ftp://`), "rules")
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	n, err := NewNormalizer(nil, rules)
+	if err != nil {
+		t.Fatalf("Failed to create normalizer: %v", err)
+	}
+	if _, err := n.Normalize("http://example.com/"); err == nil {
+		t.Errorf("Expected rewrite to a non-http URL to fail.")
+	}
+}
+
+func TestBadRewriteRules(t *testing.T) {
+	for _, bad := range []string{"^http://", "( x", "a b c"} {
+		if _, err := ParseRewriteRules(strings.NewReader(bad), "rules"); err == nil {
+			t.Errorf("Expected rule '%s' to be rejected.", bad)
+		}
+	}
+}
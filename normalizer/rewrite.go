@@ -0,0 +1,64 @@
+package normalizer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Rewrites URLs matching Pattern by expanding Replacement, which may refer to
+// submatches as $1 or ${name}.
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+
+	// Where the rule was defined, e.g. "rewrites.txt:3".
+	Source string
+}
+
+// A rewrite rule that changed a URL during normalization.
+type RewriteStep struct {
+	Rule   RewriteRule
+	Before string
+	After  string
+}
+
+// Parses rewrite rules, one per line as a pattern and a replacement separated
+// by whitespace. Blank lines and lines starting with # are ignored. Since URLs
+// can't contain whitespace, patterns that need to match it can use \s.
+func ParseRewriteRules(in io.Reader, name string) ([]RewriteRule, error) {
+	var rules []RewriteRule
+	scanner := bufio.NewScanner(in)
+	for lineNum := 1; scanner.Scan(); lineNum += 1 {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", name, lineNum)
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: expected a pattern and a replacement", source)
+		}
+		pattern, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		rules = append(rules, RewriteRule{pattern, fields[1], source})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func LoadRewriteRules(path string) ([]RewriteRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRewriteRules(f, path)
+}
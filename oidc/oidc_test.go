@@ -0,0 +1,196 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testProvider struct {
+	srv    *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	// What the token endpoint was last sent.
+	form url.Values
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tp := &testProvider{rsaKey: rsaKey, ecKey: ecKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 tp.srv.URL,
+			"authorization_endpoint": tp.srv.URL + "/authorize",
+			"token_endpoint":         tp.srv.URL + "/token",
+			"jwks_uri":               tp.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+			},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		tp.form = r.PostForm
+		if id, secret, ok := r.BasicAuth(); !ok || id != "knox" || secret != "s3cret" {
+			w.WriteHeader(401)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": "token-for-" + r.PostForm.Get("code")})
+	})
+	tp.srv = httptest.NewServer(mux)
+	return tp
+}
+
+func (tp *testProvider) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	segment := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := segment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, tp.rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("%v", err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, tp.ecKey, digest[:])
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestDiscoverAndExchange(t *testing.T) {
+	tp := newTestProvider(t)
+	defer tp.srv.Close()
+	p, err := Discover(context.Background(), http.DefaultClient, tp.srv.URL)
+	if err != nil {
+		t.Fatalf("Failed to discover provider: %v", err)
+	}
+	if _, err := Discover(context.Background(), http.DefaultClient, tp.srv.URL+"/other"); err == nil {
+		t.Errorf("Expected discovery for the wrong issuer to fail.")
+	}
+
+	authUrl, err := url.Parse(p.AuthCodeUrl("knox", "https://knox.example/auth/callback", []string{"groups"}, "state", "nonce", "verifier"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	query := authUrl.Query()
+	challenge := sha256.Sum256([]byte("verifier"))
+	if authUrl.Path != "/authorize" || query.Get("scope") != "openid groups" || query.Get("state") != "state" || query.Get("nonce") != "nonce" ||
+		query.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) || query.Get("code_challenge_method") != "S256" {
+		t.Errorf("Wrong authorization URL: %s", authUrl)
+	}
+
+	token, err := p.Exchange(context.Background(), "knox", "s3cret", "https://knox.example/auth/callback", "abc", "verifier")
+	if err != nil || token != "token-for-abc" {
+		t.Errorf("Wrong token. got = %q, %v", token, err)
+	}
+	if tp.form.Get("code_verifier") != "verifier" || tp.form.Get("redirect_uri") != "https://knox.example/auth/callback" {
+		t.Errorf("Wrong token request: %v", tp.form)
+	}
+	if _, err := p.Exchange(context.Background(), "knox", "wrong", "https://knox.example/auth/callback", "abc", "verifier"); err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("Expected the provider's error. got = %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tp := newTestProvider(t)
+	defer tp.srv.Close()
+	p, err := Discover(context.Background(), http.DefaultClient, tp.srv.URL)
+	if err != nil {
+		t.Fatalf("Failed to discover provider: %v", err)
+	}
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    tp.srv.URL,
+			"aud":    []string{"knox", "other"},
+			"sub":    "1234",
+			"nonce":  "nonce",
+			"iat":    now.Unix(),
+			"exp":    now.Add(time.Hour).Unix(),
+			"groups": []string{"ops", "admins"},
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	for _, alg := range []struct{ alg, kid string }{{"RS256", "rsa"}, {"ES256", "ec"}} {
+		verified, err := p.Verify(context.Background(), tp.sign(t, alg.alg, alg.kid, claims(nil)), "knox", "nonce", now)
+		if err != nil {
+			t.Errorf("Failed to verify %s token: %v", alg.alg, err)
+			continue
+		}
+		if groups := verified.Strings("groups"); verified.String("sub") != "1234" || len(groups) != 2 || groups[1] != "admins" {
+			t.Errorf("Wrong claims: %v", verified)
+		}
+	}
+
+	cases := map[string]string{
+		"wrong issuer":   tp.sign(t, "RS256", "rsa", claims(map[string]interface{}{"iss": "https://evil.example"})),
+		"wrong audience": tp.sign(t, "RS256", "rsa", claims(map[string]interface{}{"aud": "other"})),
+		"wrong nonce":    tp.sign(t, "RS256", "rsa", claims(map[string]interface{}{"nonce": "replayed"})),
+		"expired":        tp.sign(t, "RS256", "rsa", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+		"no subject":     tp.sign(t, "RS256", "rsa", claims(map[string]interface{}{"sub": nil})),
+		"wrong key":      tp.sign(t, "RS256", "ec", claims(nil)),
+		"unknown key":    tp.sign(t, "RS256", "rotated", claims(nil)),
+		"unsigned":       tp.sign(t, "none", "rsa", claims(nil)),
+		"not a token":    "garbage",
+	}
+	for name, token := range cases {
+		if _, err := p.Verify(context.Background(), token, "knox", "nonce", now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Expected a token with %s to be invalid. got = %v", name, err)
+		}
+	}
+	tampered := strings.Split(tp.sign(t, "RS256", "rsa", claims(nil)), ".")
+	tampered[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`))
+	if _, err := p.Verify(context.Background(), strings.Join(tampered, "."), "knox", "nonce", now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a tampered token to be invalid. got = %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package renderer
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+)
+
+// The largest response handed to the browser. Anything bigger fails to load.
+const maxResponseBytes = 32 * 1024 * 1024
+
+// Serializes the document the way the browser currently has it, doctype
+// included.
+const serializeDocument = `(document.doctype ? new XMLSerializer().serializeToString(document.doctype) + "\n" : "") + document.documentElement.outerHTML`
+
+// Headers that describe the response as it came over the wire rather than
+// the body handed to the browser.
+var wireHeaders = []string{
+	"Content-Encoding",
+	"Content-Length",
+	"Transfer-Encoding",
+}
+
+type Subresource struct {
+	Url      string
+	Headers  http.Header
+	Protocol string
+	Body     []byte
+}
+
+type Page struct {
+	// The document serialized from the DOM once the page settled.
+	Html string
+
+	// The successful GET responses the page loaded other than documents.
+	Subresources []Subresource
+}
+
+// Answers a request made by a page in the browser's place.
+type FetchFunc func(req *http.Request) (*http.Response, error)
+
+// Dimensions are in inches.
+type PdfOptions struct {
+	PaperWidth  float64
+	PaperHeight float64
+	Margin      float64
+	Landscape   bool
+}
+
+type Options struct {
+	// The Chrome or Chromium binary. Looked up on the PATH if empty.
+	ExecPath string
+
+	// Disables Chrome's sandbox, which won't start as root.
+	NoSandbox bool
+
+	// Sends every request the browser makes while rendering, so that the
+	// browser never reaches the network itself. Redirects are handed back to
+	// the browser to follow.
+	Client *http.Client
+
+	// How long loading a page may take.
+	LoadTimeout time.Duration
+
+	// How long to wait after a page loads for its network activity to settle
+	// before capturing it anyway.
+	IdleTimeout time.Duration
+}
+
+// Loads pages in headless Chrome so that pages assembled by scripts can be
+// stored the way they render rather than as the empty shell their origin
+// sends.
+type Renderer struct {
+	allocatorOptions []chromedp.ExecAllocatorOption
+	client           http.Client
+	loadTimeout      time.Duration
+	idleTimeout      time.Duration
+}
+
+func NewRenderer(opts Options) *Renderer {
+	allocatorOptions := append([]chromedp.ExecAllocatorOption{}, chromedp.DefaultExecAllocatorOptions[:]...)
+	if opts.ExecPath != "" {
+		allocatorOptions = append(allocatorOptions, chromedp.ExecPath(opts.ExecPath))
+	}
+	if opts.NoSandbox {
+		allocatorOptions = append(allocatorOptions, chromedp.NoSandbox)
+	}
+	client := *opts.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &Renderer{allocatorOptions, client, opts.LoadTimeout, opts.IdleTimeout}
+}
+
+// Converts CDP headers, which join repeated headers with newlines.
+func httpHeaders(headers network.Headers) http.Header {
+	converted := http.Header{}
+	for name, value := range headers {
+		// HTTP/2 pseudo-headers like :authority.
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		for _, line := range strings.Split(fmt.Sprint(value), "\n") {
+			converted.Add(name, line)
+		}
+	}
+	return converted
+}
+
+func headerEntries(headers http.Header) []*fetch.HeaderEntry {
+	var entries []*fetch.HeaderEntry
+	for name, values := range headers {
+		for _, value := range values {
+			entries = append(entries, &fetch.HeaderEntry{Name: name, Value: value})
+		}
+	}
+	return entries
+}
+
+// Sends a request the browser paused on with fetchFunc and returns the
+// response, with its body read in full.
+func send(ctx context.Context, paused *fetch.EventRequestPaused, userAgent string, fetchFunc FetchFunc) (*http.Response, []byte, error) {
+	var body io.Reader
+	if paused.Request.HasPostData {
+		body = strings.NewReader(paused.Request.PostData)
+	}
+	req, err := http.NewRequestWithContext(ctx, paused.Request.Method, paused.Request.URL, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header = httpHeaders(paused.Request.Headers)
+	// Left to the transport so that bodies come back decoded.
+	req.Header.Del("Accept-Encoding")
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	resp, err := fetchFunc(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBytes+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(respBody) > maxResponseBytes {
+		return nil, nil, fmt.Errorf("response larger than %d bytes", maxResponseBytes)
+	}
+	for _, name := range wireHeaders {
+		resp.Header.Del(name)
+	}
+	return resp, respBody, nil
+}
+
+// A page open in a browser of its own.
+type loadedPage struct {
+	ctx    context.Context
+	cancel func()
+
+	mu           sync.Mutex
+	subresources []Subresource
+}
+
+func (lp *loadedPage) Close() {
+	lp.cancel()
+}
+
+// Starts a browser, loads pageUrl in it and waits for the page to settle.
+// Every request the page makes is answered by fetchFunc.
+func (r *Renderer) load(pageUrl string, userAgent string, fetchFunc FetchFunc) (*loadedPage, error) {
+	allocatorCtx, cancelAllocator := chromedp.NewExecAllocator(context.Background(), r.allocatorOptions...)
+	ctx, cancel := chromedp.NewContext(allocatorCtx)
+	lp := &loadedPage{ctx: ctx}
+	lp.cancel = func() {
+		cancel()
+		cancelAllocator()
+	}
+
+	idle := make(chan struct{}, 1)
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		switch ev := ev.(type) {
+		case *fetch.EventRequestPaused:
+			// Listeners must not block, and answering the browser does.
+			go func() {
+				executorCtx := cdp.WithExecutor(ctx, chromedp.FromContext(ctx).Target)
+				resp, body, err := send(ctx, ev, userAgent, fetchFunc)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Failed to fetch %s for %s: %v\n", ev.Request.URL, pageUrl, err)
+					}
+					fetch.FailRequest(ev.RequestID, network.ErrorReasonFailed).Do(executorCtx)
+					return
+				}
+				fulfill := fetch.FulfillRequest(ev.RequestID, int64(resp.StatusCode)).
+					WithResponseHeaders(headerEntries(resp.Header)).
+					WithBody(base64.StdEncoding.EncodeToString(body))
+				if err := fulfill.Do(executorCtx); err != nil {
+					return
+				}
+				if ev.Request.Method != "GET" || resp.StatusCode != 200 || ev.ResourceType == network.ResourceTypeDocument {
+					return
+				}
+				lp.mu.Lock()
+				defer lp.mu.Unlock()
+				lp.subresources = append(lp.subresources, Subresource{ev.Request.URL, resp.Header, resp.Proto, body})
+			}()
+		case *page.EventLifecycleEvent:
+			if ev.Name == "networkIdle" {
+				select {
+				case idle <- struct{}{}:
+				default:
+				}
+			}
+		}
+	})
+
+	// The first run starts the browser, which is killed once its context is
+	// done, so it mustn't be given the load timeout.
+	setup := []chromedp.Action{
+		fetch.Enable(),
+		network.Enable(),
+		// Web sockets can't be intercepted.
+		network.SetBlockedURLS([]string{"ws://*", "wss://*"}),
+		page.SetLifecycleEventsEnabled(true),
+	}
+	if userAgent != "" {
+		setup = append(setup, emulation.SetUserAgentOverride(userAgent))
+	}
+	if err := chromedp.Run(ctx, setup...); err != nil {
+		lp.Close()
+		return nil, fmt.Errorf("failed to start browser: %w", err)
+	}
+	loadCtx, cancelLoad := context.WithTimeout(ctx, r.loadTimeout)
+	defer cancelLoad()
+	if err := chromedp.Run(loadCtx, chromedp.Navigate(pageUrl)); err != nil {
+		lp.Close()
+		return nil, fmt.Errorf("failed to load %s: %w", pageUrl, err)
+	}
+	select {
+	case <-idle:
+	case <-time.After(r.idleTimeout):
+		// Plenty of pages poll forever.
+	}
+	return lp, nil
+}
+
+// Renders pageUrl and returns the resulting document along with the
+// subresources it loaded.
+func (r *Renderer) Render(pageUrl string, userAgent string) (Page, error) {
+	lp, err := r.load(pageUrl, userAgent, r.client.Do)
+	if err != nil {
+		return Page{}, err
+	}
+	defer lp.Close()
+	var html string
+	if err := chromedp.Run(lp.ctx, chromedp.Evaluate(serializeDocument, &html)); err != nil {
+		return Page{}, fmt.Errorf("failed to serialize %s: %w", pageUrl, err)
+	}
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return Page{html, lp.subresources}, nil
+}
+
+// Loads pageUrl with every request answered by fetchFunc and prints it.
+func (r *Renderer) PrintToPdf(pageUrl string, userAgent string, fetchFunc FetchFunc, opts PdfOptions) ([]byte, error) {
+	lp, err := r.load(pageUrl, userAgent, fetchFunc)
+	if err != nil {
+		return nil, err
+	}
+	defer lp.Close()
+	var pdf []byte
+	printPdf := chromedp.ActionFunc(func(ctx context.Context) error {
+		var err error
+		pdf, _, err = page.PrintToPDF().
+			WithPaperWidth(opts.PaperWidth).
+			WithPaperHeight(opts.PaperHeight).
+			WithMarginTop(opts.Margin).
+			WithMarginBottom(opts.Margin).
+			WithMarginLeft(opts.Margin).
+			WithMarginRight(opts.Margin).
+			WithLandscape(opts.Landscape).
+			WithPrintBackground(true).
+			Do(ctx)
+		return err
+	})
+	if err := chromedp.Run(lp.ctx, printPdf); err != nil {
+		return nil, fmt.Errorf("failed to print %s: %w", pageUrl, err)
+	}
+	return pdf, nil
+}
@@ -0,0 +1,118 @@
+package renderer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/network"
+)
+
+func TestHttpHeaders(t *testing.T) {
+	got := httpHeaders(network.Headers{
+		":authority": "example.com",
+		"Set-Cookie": "a=1\nb=2",
+		"Accept":     "*/*",
+	})
+	want := http.Header{
+		"Set-Cookie": []string{"a=1", "b=2"},
+		"Accept":     []string{"*/*"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong headers. got = %v, want = %v", got, want)
+	}
+}
+
+func findBrowser() string {
+	for _, name := range []string{"headless-shell", "chromium", "chromium-browser", "google-chrome"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func TestRender(t *testing.T) {
+	browserPath := findBrowser()
+	if browserPath == "" {
+		t.Skip("No Chrome or Chromium found.")
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `<!DOCTYPE html><html><body><div id="content"></div><script>
+				fetch("/content.txt").then(r => r.text()).then(text => {
+					document.getElementById("content").textContent = text;
+				});
+			</script></body></html>`)
+		case "/content.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "rendered by script")
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer origin.Close()
+
+	r := NewRenderer(Options{
+		ExecPath:    browserPath,
+		NoSandbox:   true,
+		Client:      origin.Client(),
+		LoadTimeout: 30 * time.Second,
+		IdleTimeout: 10 * time.Second,
+	})
+	rendered, err := r.Render(origin.URL+"/", "")
+	if err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+	if !strings.HasPrefix(rendered.Html, "<!DOCTYPE html>") || !strings.Contains(rendered.Html, `<div id="content">rendered by script</div>`) {
+		t.Errorf("Expected rendered DOM. got = %s", rendered.Html)
+	}
+	found := false
+	for _, subresource := range rendered.Subresources {
+		if subresource.Url == origin.URL+"/content.txt" {
+			found = string(subresource.Body) == "rendered by script"
+		}
+	}
+	if !found {
+		t.Errorf("Expected the fetched text among the subresources. got = %v", rendered.Subresources)
+	}
+}
+
+func TestPrintToPdf(t *testing.T) {
+	browserPath := findBrowser()
+	if browserPath == "" {
+		t.Skip("No Chrome or Chromium found.")
+	}
+	r := NewRenderer(Options{
+		ExecPath:    browserPath,
+		NoSandbox:   true,
+		Client:      http.DefaultClient,
+		LoadTimeout: 30 * time.Second,
+		IdleTimeout: 10 * time.Second,
+	})
+	fetched := false
+	fetchFunc := func(req *http.Request) (*http.Response, error) {
+		fetched = true
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"text/html"}},
+			Body:       io.NopCloser(strings.NewReader("<html><body><h1>Printed</h1></body></html>")),
+		}, nil
+	}
+	pdf, err := r.PrintToPdf("http://example.invalid/", "", fetchFunc, PdfOptions{PaperWidth: 8.5, PaperHeight: 11, Margin: 0.4})
+	if err != nil {
+		t.Fatalf("Failed to print: %v", err)
+	}
+	if !fetched {
+		t.Errorf("Expected the page to be fetched with fetchFunc.")
+	}
+	if !strings.HasPrefix(string(pdf), "%PDF-") {
+		t.Errorf("Expected a PDF. got = %.20q", pdf)
+	}
+}
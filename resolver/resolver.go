@@ -0,0 +1,220 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver looks up the addresses of a host. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Returns a resolver that sends every query to server ("host:port") rather
+// than the resolvers configured for the system.
+func NewServerResolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// Resolves hosts with DNS over HTTPS (RFC 8484).
+type DohResolver struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewDohResolver(endpoint string, client *http.Client) *DohResolver {
+	return &DohResolver{endpoint, client}
+}
+
+func (r *DohResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	var addrs []net.IPAddr
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		found, err := r.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs = append(addrs, found...)
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses found")
+		}
+		return nil, &net.DNSError{Err: lastErr.Error(), Name: host, Server: r.endpoint}
+	}
+	return addrs, nil
+}
+
+func (r *DohResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IPAddr, error) {
+	name, err := dnsmessage.NewName(dnsName(host))
+	if err != nil {
+		return nil, err
+	}
+	// The ID is zero as recommended for caching by HTTP intermediaries.
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", r.endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("resolver responded with %s", resp.Status)
+	}
+	// DNS messages are limited to 64KiB.
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65536))
+	if err != nil {
+		return nil, err
+	}
+	return parseAddrs(body)
+}
+
+func dnsName(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
+
+// Extracts the A and AAAA records from a DNS response.
+func parseAddrs(response []byte) ([]net.IPAddr, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(response)
+	if err != nil {
+		return nil, err
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("resolver responded with %v", header.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	var addrs []net.IPAddr
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return addrs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, net.IPAddr{IP: net.IP(a.A[:])})
+		case dnsmessage.TypeAAAA:
+			aaaa, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, net.IPAddr{IP: net.IP(aaaa.AAAA[:])})
+		default:
+			// e.g. the CNAMEs leading to the addresses.
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// The most hosts a CachingResolver remembers at once.
+const maxCacheEntries = 4096
+
+type cacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// Remembers successful lookups for a fixed duration so that fetching many
+// resources from the same host doesn't query the underlying resolver for
+// each one.
+type CachingResolver struct {
+	resolver Resolver
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]cacheEntry
+	nextSweep time.Time
+}
+
+func NewCachingResolver(resolver Resolver, ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		resolver: resolver,
+		ttl:      ttl,
+		entries:  map[string]cacheEntry{},
+	}
+}
+
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = strings.ToLower(host)
+	now := time.Now()
+	r.mu.Lock()
+	entry, ok := r.entries[host]
+	r.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.addrs, nil
+	}
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Expired entries are swept out at most once per ttl so that the cost
+	// of a sweep is spread over all the lookups in between.
+	if !now.Before(r.nextSweep) {
+		for h, e := range r.entries {
+			if !now.Before(e.expires) {
+				delete(r.entries, h)
+			}
+		}
+		r.nextSweep = now.Add(r.ttl)
+	}
+	if _, ok := r.entries[host]; !ok && len(r.entries) >= maxCacheEntries {
+		// Which host is evicted hardly matters as long as the map stays
+		// bounded.
+		for h := range r.entries {
+			delete(r.entries, h)
+			break
+		}
+	}
+	r.entries[host] = cacheEntry{addrs, now.Add(r.ttl)}
+	return addrs, nil
+}
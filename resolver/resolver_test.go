@@ -0,0 +1,146 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type countingResolver struct {
+	lookups int
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups += 1
+	return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	underlying := &countingResolver{}
+	r := NewCachingResolver(underlying, time.Hour)
+	for i := 0; i < 3; i += 1 {
+		if _, err := r.LookupIPAddr(context.Background(), "example.com"); err != nil {
+			t.Fatalf("Lookup failed: %v", err)
+		}
+	}
+	if _, err := r.LookupIPAddr(context.Background(), "EXAMPLE.com"); err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if underlying.lookups != 1 {
+		t.Errorf("Wrong number of lookups. got = %d, want = %d", underlying.lookups, 1)
+	}
+
+	r = NewCachingResolver(underlying, time.Nanosecond)
+	underlying.lookups = 0
+	for i := 0; i < 2; i += 1 {
+		if _, err := r.LookupIPAddr(context.Background(), "example.com"); err != nil {
+			t.Fatalf("Lookup failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if underlying.lookups != 2 {
+		t.Errorf("Wrong number of lookups after expiry. got = %d, want = %d", underlying.lookups, 2)
+	}
+}
+
+func TestCachingResolverBounded(t *testing.T) {
+	r := NewCachingResolver(&countingResolver{}, time.Hour)
+	for i := 0; i < maxCacheEntries+16; i += 1 {
+		if _, err := r.LookupIPAddr(context.Background(), fmt.Sprintf("host%d.example.com", i)); err != nil {
+			t.Fatalf("Lookup failed: %v", err)
+		}
+	}
+	if len(r.entries) > maxCacheEntries {
+		t.Errorf("Cache grew too large. got = %d, want <= %d", len(r.entries), maxCacheEntries)
+	}
+}
+
+// Answers A queries with 192.0.2.1 and AAAA queries with 2001:db8::1, each
+// behind a CNAME.
+func dohHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(415)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Failed to read query: %v", err)
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(body); err != nil || len(query.Questions) != 1 {
+			t.Errorf("Bad query: %v", err)
+			w.WriteHeader(400)
+			return
+		}
+		question := query.Questions[0]
+		target := dnsmessage.MustNewName("target.example.net.")
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true, RecursionAvailable: true},
+			Questions: query.Questions,
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.CNAMEResource{CNAME: target},
+			}},
+		}
+		answerHeader := dnsmessage.ResourceHeader{Name: target, Type: question.Type, Class: dnsmessage.ClassINET}
+		if question.Type == dnsmessage.TypeA {
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: answerHeader,
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			})
+		} else if question.Type == dnsmessage.TypeAAAA {
+			aaaa := dnsmessage.AAAAResource{}
+			copy(aaaa.AAAA[:], net.ParseIP("2001:db8::1"))
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: answerHeader, Body: &aaaa})
+		}
+		packed, err := response.Pack()
+		if err != nil {
+			t.Errorf("Failed to pack response: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}
+}
+
+func TestDohResolver(t *testing.T) {
+	server := httptest.NewServer(dohHandler(t))
+	defer server.Close()
+
+	r := NewDohResolver(server.URL, server.Client())
+	addrs, err := r.LookupIPAddr(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	want := []net.IPAddr{{IP: net.ParseIP("192.0.2.1").To4()}, {IP: net.ParseIP("2001:db8::1")}}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Wrong addresses. got = %v, want = %v", addrs, want)
+	}
+
+	addrs, err = r.LookupIPAddr(context.Background(), "198.51.100.7")
+	if err != nil || len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("Expected IP literal to be returned as is. got = %v, %v", addrs, err)
+	}
+}
+
+func TestDohResolverError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	r := NewDohResolver(server.URL, server.Client())
+	if addrs, err := r.LookupIPAddr(context.Background(), "www.example.com"); err == nil {
+		t.Errorf("Expected lookup to fail but got %v", addrs)
+	}
+}
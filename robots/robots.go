@@ -0,0 +1,206 @@
+package robots
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// The product token knox looks for in robots.txt user-agent lines and in
+// agent-specific robots directives.
+const Agent = "knox"
+
+// The rules of a robots.txt that apply to one agent. The zero value allows
+// everything, as does a missing robots.txt.
+type Rules struct {
+	rules []rule
+}
+
+type rule struct {
+	allow bool
+	// The length of the pattern, since the longest matching one wins.
+	length  int
+	pattern *regexp.Regexp
+}
+
+// A group of rules and the agents they apply to.
+type group struct {
+	agents []string
+	rules  []rule
+}
+
+// Parses a robots.txt as described in RFC 9309 and returns the rules that
+// apply to agent: those of the group naming it, or else those of the group
+// for "*". Lines that aren't understood are ignored.
+func Parse(in io.Reader, agent string) Rules {
+	var groups []*group
+	var current *group
+	// Consecutive user-agent lines start a single group.
+	inAgents := false
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = &group{}
+				groups = append(groups, current)
+				inAgents = true
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inAgents = false
+			// An empty disallow allows everything, the same as no rule.
+			if current == nil || value == "" {
+				continue
+			}
+			current.rules = append(current.rules, rule{key == "allow", len(value), compilePattern(value)})
+		}
+	}
+	agent = strings.ToLower(agent)
+	var matched, wildcard []rule
+	found := false
+	for _, g := range groups {
+		for _, a := range g.agents {
+			if a == agent {
+				matched = append(matched, g.rules...)
+				found = true
+			} else if a == "*" {
+				wildcard = append(wildcard, g.rules...)
+			}
+		}
+	}
+	if !found {
+		matched = wildcard
+	}
+	return Rules{matched}
+}
+
+// Reports whether path, with its query if any, may be fetched. The longest
+// matching rule decides, and allow wins over disallow when they are as long.
+func (r Rules) Allowed(path string) bool {
+	if path == "" {
+		path = "/"
+	}
+	allowed := true
+	longest := -1
+	for _, rule := range r.rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if rule.length > longest || (rule.length == longest && rule.allow) {
+			allowed = rule.allow
+			longest = rule.length
+		}
+	}
+	return allowed
+}
+
+// Compiles a robots.txt pattern, a prefix in which * matches any characters
+// and a trailing $ anchors the end of the path.
+func compilePattern(pattern string) *regexp.Regexp {
+	anchored := strings.HasSuffix(pattern, "$")
+	parts := strings.Split(strings.TrimSuffix(pattern, "$"), "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	expr := "^" + strings.Join(parts, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// Robots directives that take a value after a colon, which would otherwise be
+// mistaken for the agent the directives after them apply to.
+var valuedDirectives = map[string]bool{
+	"unavailable_after": true,
+	"max-snippet":       true,
+	"max-image-preview": true,
+	"max-video-preview": true,
+}
+
+// Reports whether robots directives, as in an X-Robots-Tag header or the
+// content of a robots <meta>, forbid agent from archiving the page.
+// Directives may be prefixed with the agent they apply to, e.g.
+// "otherbot: noarchive", in which case they only apply to that agent.
+func NoArchive(directives string, agent string) bool {
+	agent = strings.ToLower(agent)
+	appliesTo := ""
+	for _, directive := range strings.Split(directives, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if i := strings.Index(directive, ":"); i >= 0 {
+			// Everything up to the next agent prefix applies to the agent
+			// it names.
+			if prefix := strings.TrimSpace(directive[:i]); !valuedDirectives[prefix] {
+				appliesTo = prefix
+				directive = strings.TrimSpace(directive[i+1:])
+			}
+		}
+		if appliesTo != "" && appliesTo != agent {
+			continue
+		}
+		if directive == "noarchive" || directive == "none" {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether any of the values of an X-Robots-Tag header forbid agent
+// from archiving the response.
+func HeaderNoArchive(values []string, agent string) bool {
+	for _, value := range values {
+		if NoArchive(value, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the robots <meta> elements in the head of an HTML document,
+// named either robots or agent, forbid agent from archiving it. Only the
+// beginning of the document needs to be given, since the head comes first.
+func MetaNoArchive(doc []byte, agent string) bool {
+	tokenizer := html.NewTokenizer(bytes.NewReader(doc))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.DataAtom == atom.Body {
+				return false
+			}
+			if token.DataAtom != atom.Meta {
+				continue
+			}
+			var name, content string
+			for _, attr := range token.Attr {
+				switch strings.ToLower(attr.Key) {
+				case "name":
+					name = strings.ToLower(strings.TrimSpace(attr.Val))
+				case "content":
+					content = attr.Val
+				}
+			}
+			if (name == "robots" || name == strings.ToLower(agent)) && NoArchive(content, agent) {
+				return true
+			}
+		}
+	}
+}
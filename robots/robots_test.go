@@ -0,0 +1,105 @@
+package robots
+
+import (
+	"strings"
+	"testing"
+)
+
+const robotsTxt = `# Comments are ignored.
+User-agent: otherbot
+Disallow: /
+
+User-agent: *
+Disallow: /private/
+Allow: /private/public
+Disallow: /*.pdf$
+Disallow: /search?
+
+User-agent: Knox
+User-agent: anotherbot
+Disallow: /knox-only
+Allow: /knox-only/allowed # trailing comment
+Disallow:
+`
+
+func TestAllowed(t *testing.T) {
+	cases := []struct {
+		agent string
+		path  string
+		want  bool
+	}{
+		// The group naming knox replaces the one for everyone else.
+		{"knox", "/private/page", true},
+		{"knox", "/knox-only/page", false},
+		{"knox", "/knox-only/allowed/page", true},
+		{"knox", "/", true},
+		{"somebot", "/", true},
+		{"somebot", "/private/page", false},
+		// The longest matching rule wins.
+		{"somebot", "/private/public/page", true},
+		{"somebot", "/docs/paper.pdf", false},
+		{"somebot", "/docs/paper.pdf.html", true},
+		{"somebot", "/search?q=knox", false},
+		{"somebot", "/search", true},
+		{"otherbot", "/anything", false},
+		{"otherbot", "", false},
+	}
+	for _, tc := range cases {
+		rules := Parse(strings.NewReader(robotsTxt), tc.agent)
+		if got := rules.Allowed(tc.path); got != tc.want {
+			t.Errorf("Allowed(%q) for %s: got = %v, want = %v", tc.path, tc.agent, got, tc.want)
+		}
+	}
+	if !(Rules{}).Allowed("/anything") {
+		t.Errorf("Expected no rules to allow everything.")
+	}
+}
+
+func TestNoArchive(t *testing.T) {
+	cases := []struct {
+		directives string
+		want       bool
+	}{
+		{"noarchive", true},
+		{"NoArchive", true},
+		{"none", true},
+		{"noindex, nofollow", false},
+		{"noindex, noarchive", true},
+		{"knox: noarchive", true},
+		{"otherbot: noarchive", false},
+		{"otherbot: noindex, noarchive", false},
+		{"otherbot: noindex, knox: noarchive", true},
+		{"unavailable_after: 25 Jun 2010 15:00:00 PST, noarchive", true},
+		{"max-snippet: 20", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		if got := NoArchive(tc.directives, Agent); got != tc.want {
+			t.Errorf("NoArchive(%q): got = %v, want = %v", tc.directives, got, tc.want)
+		}
+	}
+	if !HeaderNoArchive([]string{"otherbot: none", "noarchive"}, Agent) {
+		t.Errorf("Expected any header value to be able to forbid archiving.")
+	}
+}
+
+func TestMetaNoArchive(t *testing.T) {
+	cases := []struct {
+		doc  string
+		want bool
+	}{
+		{`<html><head><meta name="robots" content="noarchive"></head><body></body></html>`, true},
+		{`<html><head><meta name="Knox" content="none"/></head></html>`, true},
+		{`<html><head><meta name="otherbot" content="noarchive"></head></html>`, false},
+		{`<html><head><meta name="robots" content="noindex"></head></html>`, false},
+		// Only the head is looked at.
+		{`<html><head></head><body><meta name="robots" content="noarchive"></body></html>`, false},
+		// A document cut short still counts.
+		{`<!DOCTYPE html><meta name="robots" content="noarchive"><title>Cut`, true},
+	}
+	for _, tc := range cases {
+		if got := MetaNoArchive([]byte(tc.doc), Agent); got != tc.want {
+			t.Errorf("MetaNoArchive(%q): got = %v, want = %v", tc.doc, got, tc.want)
+		}
+	}
+}
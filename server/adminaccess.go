@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Parses --admin-allow-network values, each a CIDR or a single IP address.
+func parseAdminNetworks(specs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if ip := net.ParseIP(spec); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("bad admin network '%s': %v", spec, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Reports whether the client at remoteAddr may reach the admin pages and
+// the API. Clients connected over a unix domain socket, whose address isn't
+// an IP, always may, since the socket's permissions already decide who can
+// connect.
+func adminAllowed(networks []*net.IPNet, remoteAddr string) bool {
+	if len(networks) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuses requests for /admin/ and /api/ from clients outside
+// --admin-allow-network, leaving the rest of the cache open to everyone.
+func (s *Server) restrictAdmin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isApi := strings.HasPrefix(r.URL.Path, "/api/")
+		if (isApi || strings.HasPrefix(r.URL.Path, "/admin/")) && !adminAllowed(s.settings().adminNetworks, r.RemoteAddr) {
+			if isApi {
+				writeJson(w, 403, map[string]string{"error": "Management is not allowed from this address."})
+			} else {
+				writeError(w, 403, "Management is not allowed from this address.")
+			}
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
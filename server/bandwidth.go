@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gnossen/knoxcache/throttle"
+)
+
+// Reads the bodies of responses from origins no faster than the upstream
+// caps allow.
+type throttleTransport struct {
+	next     http.RoundTripper
+	settings func() *runtimeSettings
+}
+
+func (t throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	settings := t.settings()
+	resp.Body = throttle.NewReader(req.Context(), resp.Body, settings.upstreamLimiter, settings.upstreamHostLimiters.Get(req.URL.Hostname()))
+	return resp, nil
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	limiters []*throttle.Limiter
+}
+
+func (tw *throttledResponseWriter) Write(b []byte) (int, error) {
+	return throttle.Write(tw.r.Context(), tw.ResponseWriter, b, tw.limiters...)
+}
+
+func (tw *throttledResponseWriter) Flush() {
+	if flusher, ok := tw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Sends responses to clients no faster than the downstream caps allow.
+func (s *Server) throttleResponses(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := s.settings()
+		if settings.downstreamLimiter == nil && settings.downstreamClientLimiters == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			// E.g. a client connected over a unix domain socket.
+			client = r.RemoteAddr
+		}
+		limiters := []*throttle.Limiter{settings.downstreamLimiter, settings.downstreamClientLimiters.Get(client)}
+		handler.ServeHTTP(&throttledResponseWriter{w, r, limiters}, r)
+	})
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+// The most URLs one batch may ask for.
+const maxBatchUrls = 1000
+
+// The states a URL in a batch goes through. URLs that are already cached or
+// can't be cached at all are reported right away and get no job.
+const (
+	batchInvalid     = "invalid"
+	batchQueued      = "queued"
+	batchDownloading = "downloading"
+	batchCached      = "cached"
+	batchFailed      = "failed"
+	batchCancelled   = "cancelled"
+)
+
+type batchRequestJson struct {
+	Urls []string `json:"urls"`
+}
+
+type batchResultJson struct {
+	Url       string `json:"url"`
+	State     string `json:"state"`
+	JobId     string `json:"job_id,omitempty"`
+	CachedUrl string `json:"cached_url,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type batchStatusJson struct {
+	Id          string            `json:"id"`
+	StatusUrl   string            `json:"status_url"`
+	Created     time.Time         `json:"created"`
+	Done        bool              `json:"done"`
+	Queued      int               `json:"queued"`
+	Downloading int               `json:"downloading"`
+	Cached      int               `json:"cached"`
+	Failed      int               `json:"failed"`
+	Cancelled   int               `json:"cancelled"`
+	Results     []batchResultJson `json:"results"`
+}
+
+// Returns the state of a URL in a batch, which is kept as an item of a batch
+// job.
+func batchState(state datastore.JobItemState) string {
+	switch state {
+	case datastore.JobItemRunning:
+		return batchDownloading
+	case datastore.JobItemDone, datastore.JobItemSkipped:
+		return batchCached
+	case datastore.JobItemFailed:
+		return batchFailed
+	case datastore.JobItemInvalid:
+		return batchInvalid
+	case datastore.JobItemCancelled:
+		return batchCancelled
+	default:
+		return batchQueued
+	}
+}
+
+// Reports on a batch job and its items, which are all of its URLs. cachedUrl
+// gives the URL each is served from.
+func batchStatus(j datastore.Job, items []datastore.JobItem, cachedUrl func(string) string) batchStatusJson {
+	id := strconv.FormatUint(uint64(j.Id), 10)
+	status := batchStatusJson{
+		Id:        id,
+		StatusUrl: "/api/v1/batches/" + id,
+		Created:   j.Created,
+		Done:      j.Ended(),
+		Results:   []batchResultJson{},
+	}
+	for _, item := range items {
+		result := batchResultJson{Url: item.Url, State: batchState(item.State), Error: item.Error}
+		if item.State != datastore.JobItemInvalid {
+			result.CachedUrl = cachedUrl(item.Url)
+		}
+		// URLs that were cached already when the batch was queued were
+		// skipped right away.
+		if item.State != datastore.JobItemInvalid && item.State != datastore.JobItemSkipped {
+			result.JobId = fmt.Sprintf("%s-%d", id, item.Id)
+		}
+		switch result.State {
+		case batchQueued:
+			status.Queued += 1
+		case batchDownloading:
+			status.Downloading += 1
+		case batchCached:
+			status.Cached += 1
+		case batchFailed, batchInvalid:
+			status.Failed += 1
+		case batchCancelled:
+			status.Cancelled += 1
+		}
+		status.Results = append(status.Results, result)
+	}
+	return status
+}
+
+// Caches rawUrl, waiting for whoever is downloading it already if anyone is.
+// Returns whether it was fetched, and if so how many bytes were downloaded.
+func (s *Server) cacheBatchUrl(ctx context.Context, encodedUrl, rawUrl, userAgent string) (bool, int, error) {
+	fetched, err := s.maybeCachePage(ctx, encodedUrl, rawUrl, userAgent)
+	if err != nil {
+		return fetched, 0, err
+	}
+	f, err := s.dsFrom(ctx).Open(encodedUrl)
+	if err != nil {
+		return fetched, 0, err
+	}
+	var bytes int
+	if fetched {
+		bytes = f.RawBytes()
+	}
+	return fetched, bytes, f.Close()
+}
+
+func (s *Server) writeBatchStatus(w http.ResponseWriter, r *http.Request, status int, j datastore.Job) {
+	items, err := s.dsFrom(r.Context()).JobItems(j.Id, 0, maxBatchUrls)
+	if err != nil {
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Failed to list batch: %v", err)})
+		return
+	}
+	protocol, host := getProtocol(r), s.getHost(r)
+	writeJson(w, status, batchStatus(j, items, func(rawUrl string) string {
+		cachedUrl, _ := translateAbsoluteUrlToCachedUrl(rawUrl, protocol, host)
+		return cachedUrl
+	}))
+}
+
+// Queues a batch job to cache up to maxBatchUrls URLs and responds right away
+// with what became of each. The response's status_url can be polled until
+// the batch is done.
+func (s *Server) handleBatchApiRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJson(w, 405, map[string]string{"error": "Batches require a POST."})
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeJson(w, 403, map[string]string{"error": "Cross-site requests are not allowed."})
+		return
+	}
+	var batchReq batchRequestJson
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWarmRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&batchReq); err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Bad batch request: %v", err)})
+		return
+	}
+	if len(batchReq.Urls) == 0 {
+		writeJson(w, 400, map[string]string{"error": "No urls were given."})
+		return
+	}
+	if len(batchReq.Urls) > maxBatchUrls {
+		writeJson(w, 413, map[string]string{"error": fmt.Sprintf("A batch may have at most %d urls.", maxBatchUrls)})
+		return
+	}
+	if s.inMaintenance() {
+		writeJson(w, 503, map[string]string{"error": errMaintenance.Error()})
+		return
+	}
+	j, err := s.queueJob(r, jobBatch, batchReq.Urls, jobParams{}, time.Time{})
+	if err != nil {
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Internal error: %v", err)})
+		return
+	}
+	s.writeBatchStatus(w, r, 202, j)
+}
+
+// Reports how far along a batch from /api/v1/cache:batch is.
+func (s *Server) handleBatchStatusApiRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/v1/batches/"), 10, 32)
+	if err != nil {
+		writeJson(w, 404, map[string]string{"error": "No such batch."})
+		return
+	}
+	j, err := s.dsFrom(r.Context()).Job(uint(id))
+	if errors.Is(err, datastore.ErrNoJob) || (err == nil && j.Kind != jobBatch) {
+		writeJson(w, 404, map[string]string{"error": "No such batch."})
+		return
+	} else if err != nil {
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Failed to look up batch: %v", err)})
+		return
+	}
+	s.writeBatchStatus(w, r, 200, j)
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+func TestBatchStatus(t *testing.T) {
+	j := datastore.Job{Id: 7, Kind: jobBatch, State: datastore.JobRunning}
+	items := []datastore.JobItem{
+		{Id: 1, Url: "not a url", State: datastore.JobItemInvalid, Error: "Could not interpret requested url 'not a url'"},
+		{Id: 2, Url: "https://example.com/a", State: datastore.JobItemSkipped},
+		{Id: 3, Url: "https://example.com/b", State: datastore.JobItemRunning},
+		{Id: 4, Url: "https://example.com/c", State: datastore.JobItemFailed, Error: "connection refused"},
+		{Id: 5, Url: "https://example.com/d", State: datastore.JobItemDone},
+	}
+	status := batchStatus(j, items, func(rawUrl string) string { return "cached " + rawUrl })
+	if status.StatusUrl != "/api/v1/batches/7" || status.Done || status.Queued != 0 || status.Downloading != 1 || status.Cached != 2 || status.Failed != 2 {
+		t.Errorf("Wrong status: %+v", status)
+	}
+	if result := status.Results[0]; result.State != batchInvalid || result.JobId != "" || result.CachedUrl != "" {
+		t.Errorf("Expected an invalid URL to get no job. got = %+v", result)
+	}
+	if result := status.Results[1]; result.State != batchCached || result.JobId != "" || result.CachedUrl != "cached https://example.com/a" {
+		t.Errorf("Expected a URL that was cached already to get no job. got = %+v", result)
+	}
+	if result := status.Results[3]; result.State != batchFailed || result.JobId != "7-4" || result.Error != "connection refused" {
+		t.Errorf("Wrong result: %+v", result)
+	}
+
+	j.State = datastore.JobCancelled
+	items[2].State = datastore.JobItemCancelled
+	if status := batchStatus(j, items, func(string) string { return "" }); !status.Done || status.Downloading != 0 || status.Cancelled != 1 {
+		t.Errorf("Wrong status of cancelled batch: %+v", status)
+	}
+}
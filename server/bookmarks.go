@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/gnossen/knoxcache/bookmarks"
+)
+
+// The largest bookmarks file accepted for import.
+const maxBookmarksFileBytes = 32 * 1024 * 1024
+
+type adminImportData struct {
+	Imported int
+	Skipped  []bookmarks.Bookmark
+	Done     bool
+}
+
+// Serves a form for uploading a bookmarks file exported from a browser and
+// queues every bookmark in an uploaded file for caching. The folders each
+// bookmark is in become its tags.
+func (s *Server) handleAdminImportRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		s.renderPage(w, 200, "admin_import.html", adminImportData{})
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, 405, "Method not allowed.")
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeError(w, 403, "Cross-site requests are not allowed.")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBookmarksFileBytes)
+	f, _, err := r.FormFile("bookmarks")
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Expected a bookmarks file: %v", err))
+		return
+	}
+	defer f.Close()
+	parsed, err := bookmarks.Parse(f)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Failed to read bookmarks: %v", err))
+		return
+	}
+
+	data := adminImportData{Done: true}
+	var urls []string
+	for _, bookmark := range parsed {
+		parsedUrl, err := url.Parse(bookmark.Url)
+		if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+			data.Skipped = append(data.Skipped, bookmark)
+			continue
+		}
+		normalizedUrl, err := s.urlNormalizer.Normalize(bookmark.Url)
+		if err != nil {
+			data.Skipped = append(data.Skipped, bookmark)
+			continue
+		}
+		encodedUrl, err := encoder.Encode(normalizedUrl)
+		if err != nil {
+			data.Skipped = append(data.Skipped, bookmark)
+			continue
+		}
+		if err := s.dsFrom(r.Context()).AddTags(encodedUrl, bookmark.Tags); err != nil {
+			writeError(w, 500, fmt.Sprintf("Failed to tag %s: %v", bookmark.Url, err))
+			return
+		}
+		urls = append(urls, normalizedUrl)
+	}
+	data.Imported = len(urls)
+
+	userAgent := r.Header.Get("User-Agent")
+	protocol := getProtocol(r)
+	host := s.getHost(r)
+	go func() {
+		results := s.warmUrls(detachSpan(r.Context()), urls, defaultWarmConcurrency, nil, userAgent, protocol, host)
+		failed := 0
+		for _, result := range results {
+			if result.Error != "" {
+				failed += 1
+			}
+		}
+		log.Printf("Finished importing %d bookmarks, %d of which failed\n", len(results), failed)
+	}()
+	s.renderPage(w, 200, "admin_import.html", data)
+}
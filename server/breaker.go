@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gnossen/knoxcache/api"
+	"github.com/gnossen/knoxcache/hostfilter"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	// Whether a fetch has been let through since the cooldown ended and
+	// hasn't finished yet.
+	trial bool
+}
+
+// Tracks consecutive failed fetches from each origin. After threshold of
+// them, fetches from the origin fail fast for cooldown, after which a single
+// trial fetch decides whether it is let back in. Only origins whose last
+// fetch failed are tracked.
+type circuitBreakers struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+func newCircuitBreakers(threshold int, cooldown time.Duration) *circuitBreakers {
+	return &circuitBreakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		circuits:  map[string]*circuit{},
+	}
+}
+
+// Returns an error if fetches from host should fail fast. Otherwise, the
+// caller has to report the outcome of its fetch with record or release.
+func (cb *circuitBreakers) allow(host string, now time.Time) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c, ok := cb.circuits[host]
+	if !ok || c.failures < cb.threshold {
+		return nil
+	}
+	if now.Before(c.openUntil) {
+		return fmt.Errorf("%w for %s until %s after %d consecutive failures", errCircuitOpen, host, c.openUntil.Format(time.RFC3339), c.failures)
+	}
+	if c.trial {
+		return fmt.Errorf("%w for %s while a trial fetch is in flight", errCircuitOpen, host)
+	}
+	c.trial = true
+	return nil
+}
+
+func (cb *circuitBreakers) record(host string, failed bool, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if !failed {
+		delete(cb.circuits, host)
+		return
+	}
+	c, ok := cb.circuits[host]
+	if !ok {
+		c = &circuit{}
+		cb.circuits[host] = c
+	}
+	c.failures += 1
+	c.trial = false
+	if c.failures >= cb.threshold {
+		c.openUntil = now.Add(cb.cooldown)
+	}
+}
+
+// Ends a fetch that says nothing about the health of host, e.g. one that
+// was canceled.
+func (cb *circuitBreakers) release(host string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if c, ok := cb.circuits[host]; ok {
+		c.trial = false
+	}
+}
+
+func (cb *circuitBreakers) snapshot(now time.Time) []*api.CircuitBreaker {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	breakers := []*api.CircuitBreaker{}
+	for host, c := range cb.circuits {
+		breaker := &api.CircuitBreaker{
+			Host:                host,
+			State:               api.CircuitState_CLOSED,
+			ConsecutiveFailures: int32(c.failures),
+		}
+		if c.failures >= cb.threshold {
+			if now.Before(c.openUntil) {
+				breaker.State = api.CircuitState_OPEN
+				breaker.OpenUntil = timestamppb.New(c.openUntil)
+			} else {
+				breaker.State = api.CircuitState_HALF_OPEN
+			}
+		}
+		breakers = append(breakers, breaker)
+	}
+	sort.Slice(breakers, func(i, j int) bool { return breakers[i].Host < breakers[j].Host })
+	return breakers
+}
+
+// Fails fetches from origins whose circuit breaker is open. Transport errors
+// and server errors count as failures.
+type breakerTransport struct {
+	next     http.RoundTripper
+	breakers *circuitBreakers
+}
+
+func (t breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := t.breakers.allow(host, time.Now()); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	var blocked hostfilter.BlockedError
+	if errors.Is(err, context.Canceled) || errors.As(err, &blocked) {
+		t.breakers.release(host)
+	} else {
+		t.breakers.record(host, err != nil || resp.StatusCode >= 500, time.Now())
+	}
+	return resp, err
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gnossen/knoxcache/api"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	cb := newCircuitBreakers(2, time.Minute)
+	now := time.Now()
+	state := func() api.CircuitState {
+		breakers := cb.snapshot(now)
+		if len(breakers) == 0 {
+			return api.CircuitState_CIRCUIT_STATE_UNSPECIFIED
+		}
+		return breakers[0].State
+	}
+
+	cb.record("example.com", true, now)
+	if err := cb.allow("example.com", now); err != nil || state() != api.CircuitState_CLOSED {
+		t.Fatalf("Expected a closed circuit after one failure. got = %v, %v", state(), err)
+	}
+	cb.record("example.com", true, now)
+	if err := cb.allow("example.com", now); !errors.Is(err, errCircuitOpen) || state() != api.CircuitState_OPEN {
+		t.Fatalf("Expected an open circuit after two failures. got = %v, %v", state(), err)
+	}
+	if err := cb.allow("other.com", now); err != nil {
+		t.Errorf("Expected other hosts to be let through. got = %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := cb.allow("example.com", now); err != nil || state() != api.CircuitState_HALF_OPEN {
+		t.Fatalf("Expected a trial fetch after the cooldown. got = %v, %v", state(), err)
+	}
+	if err := cb.allow("example.com", now); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected only one trial fetch. got = %v", err)
+	}
+	cb.record("example.com", true, now)
+	if err := cb.allow("example.com", now); !errors.Is(err, errCircuitOpen) || state() != api.CircuitState_OPEN {
+		t.Fatalf("Expected a failed trial to reopen the circuit. got = %v, %v", state(), err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := cb.allow("example.com", now); err != nil {
+		t.Fatalf("Expected a trial fetch after the cooldown. got = %v", err)
+	}
+	cb.record("example.com", false, now)
+	if breakers := cb.snapshot(now); len(breakers) != 0 {
+		t.Errorf("Expected a successful trial to close the circuit. got = %v", breakers)
+	}
+}
+
+func TestBreakerTransport(t *testing.T) {
+	requests := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		w.WriteHeader(503)
+	}))
+	defer origin.Close()
+	cb := newCircuitBreakers(3, time.Minute)
+	client := &http.Client{Transport: breakerTransport{http.DefaultTransport, cb}}
+
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(origin.URL)
+		if i < 3 {
+			if err != nil {
+				t.Fatalf("Expected fetch %d to reach the origin. got = %v", i, err)
+			}
+			resp.Body.Close()
+		} else if !errors.Is(err, errCircuitOpen) {
+			t.Errorf("Expected fetch %d to fail fast. got = %v", i, err)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("Wrong number of requests reaching the origin. got = %d, want = 3", requests)
+	}
+	originUrl, _ := url.Parse(origin.URL)
+	breakers := cb.snapshot(time.Now())
+	if len(breakers) != 1 || breakers[0].Host != originUrl.Host || breakers[0].ConsecutiveFailures != 3 || breakers[0].OpenUntil == nil {
+		t.Errorf("Wrong circuit breakers. got = %v", breakers)
+	}
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+	"golang.org/x/net/html"
+)
+
+// Subresources larger than this are linked to rather than inlined.
+const maxInlinedBytes = 10 * 1024 * 1024
+
+type cachedResource struct {
+	headers    *http.Header
+	body       []byte
+	capturedAt time.Time
+}
+
+// Reads a resource in full if it has already been cached. Returns nil if it
+// hasn't.
+func (s *Server) readCachedResource(ctx context.Context, rawUrl string) (*cachedResource, error) {
+	encodedUrl, err := encoder.Encode(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	progress, err := s.dsFrom(ctx).Progress(encodedUrl)
+	if err != nil || progress.Status != datastore.ResourceCached {
+		return nil, err
+	}
+	f, err := s.dsFrom(ctx).Open(encodedUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(f, maxInlinedBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxInlinedBytes {
+		return nil, nil
+	}
+	return &cachedResource{f.Headers(), body, progress.DownloadStarted}, nil
+}
+
+func dataUri(resource *cachedResource) string {
+	return fmt.Sprintf("data:%s;base64,%s", getContentType(resource.headers), base64.StdEncoding.EncodeToString(resource.body))
+}
+
+// Attributes whose targets are embedded in the page rather than navigated to.
+var inlinedAttrs = map[string]string{
+	"img":    "src",
+	"script": "src",
+	"link":   "href",
+}
+
+// Only these kinds of link elements are inlined.
+var inlinedLinkRels = map[string]bool{
+	"stylesheet":    true,
+	"icon":          true,
+	"shortcut icon": true,
+}
+
+func getAttr(node *html.Node, key string) (int, bool) {
+	for i, attr := range node.Attr {
+		if attr.Key == key {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+func removeAttr(node *html.Node, key string) {
+	if i, ok := getAttr(node, key); ok {
+		node.Attr = append(node.Attr[:i], node.Attr[i+1:]...)
+	}
+}
+
+// Embeds a cached subresource in a bundle, returning the link to use for it.
+type embedFunc func(absoluteUrl string, resource *cachedResource) (string, error)
+
+// Matches the url() references in a stylesheet, quoted or not.
+var cssUrlRegex = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^"')\s]*))\s*\)`)
+
+// Rewrites the url() references in a stylesheet the same way bundleHtml
+// rewrites links, so that fonts and backgrounds load without knox too.
+func (s *Server) bundleCss(ctx context.Context, cssUrl *url.URL, css []byte, embed embedFunc) []byte {
+	return cssUrlRegex.ReplaceAllFunc(css, func(match []byte) []byte {
+		groups := cssUrlRegex.FindSubmatch(match)
+		ref := string(groups[1]) + string(groups[2]) + string(groups[3])
+		if ref == "" || strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "#") {
+			return match
+		}
+		absoluteUrl, err := s.resolveUrl(ref, cssUrl)
+		if err != nil {
+			return match
+		}
+		link := absoluteUrl
+		resource, err := s.readCachedResource(ctx, absoluteUrl)
+		if err == nil && resource != nil {
+			link, err = embed(absoluteUrl, resource)
+		}
+		if err != nil {
+			log.Printf("Failed to bundle %s: %v\n", absoluteUrl, err)
+			link = absoluteUrl
+		}
+		return []byte(fmt.Sprintf("url(\"%s\")", link))
+	})
+}
+
+// Returns resource with everything it refers to embedded as well. Only
+// stylesheets refer to anything.
+func (s *Server) bundleSubresources(ctx context.Context, absoluteUrl string, resource *cachedResource, embed embedFunc) *cachedResource {
+	if getContentType(resource.headers) != "text/css" {
+		return resource
+	}
+	cssUrl, err := url.Parse(absoluteUrl)
+	if err != nil {
+		return resource
+	}
+	bundled := *resource
+	bundled.body = s.bundleCss(ctx, cssUrl, resource.body, embed)
+	return &bundled
+}
+
+// Rewrites the page so that it renders without knox. Cached subresources are
+// handed to embed and everything else points at its original location.
+func (s *Server) bundleHtml(ctx context.Context, resourceUrl *url.URL, in io.Reader, out io.Writer, embed embedFunc) error {
+	var visitNode func(node *html.Node)
+	visitNode = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			embedded := false
+			inlinedAttr, inlinable := inlinedAttrs[node.Data]
+			if i, ok := getAttr(node, "rel"); node.Data == "link" && (!ok || !inlinedLinkRels[strings.ToLower(node.Attr[i].Val)]) {
+				inlinable = false
+			}
+			for i, attr := range node.Attr {
+				isLink := false
+				for _, linkAttr := range linkAttrs[node.Data] {
+					isLink = isLink || attr.Key == linkAttr
+				}
+				if !isLink {
+					continue
+				}
+				absoluteUrl, err := s.resolveUrl(attr.Val, resourceUrl)
+				if err != nil {
+					continue
+				}
+				node.Attr[i].Val = absoluteUrl
+				if !inlinable || attr.Key != inlinedAttr {
+					continue
+				}
+				resource, err := s.readCachedResource(ctx, absoluteUrl)
+				if err == nil && resource != nil {
+					node.Attr[i].Val, err = embed(absoluteUrl, resource)
+				}
+				if err != nil {
+					log.Printf("Failed to bundle %s: %v\n", absoluteUrl, err)
+					node.Attr[i].Val = absoluteUrl
+					continue
+				}
+				embedded = embedded || resource != nil
+			}
+			if embedded {
+				// Otherwise browsers would prefer the uncached alternatives.
+				removeAttr(node, "srcset")
+				// The hash no longer needs to match anything fetched.
+				removeAttr(node, "integrity")
+			}
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			visitNode(c)
+		}
+	}
+
+	doc, err := html.Parse(in)
+	if err != nil {
+		return err
+	}
+	visitNode(doc)
+	if err := runTransformHooks(doc, resourceUrl); err != nil {
+		return err
+	}
+	return html.Render(out, doc)
+}
+
+type bundleManifestEntry struct {
+	Path        string    `json:"path"`
+	Url         string    `json:"url"`
+	ContentType string    `json:"content_type"`
+	CapturedAt  time.Time `json:"captured_at"`
+}
+
+// Picks the extension of a bundled file. The URL's own extension is kept if it
+// suits the content type since the system's mime table may list several,
+// e.g. .jpe before .jpg. Otherwise the first one listed is used.
+func bundleExtension(absoluteUrl string, contentType string) string {
+	ext := ""
+	if parsedUrl, err := url.Parse(absoluteUrl); err == nil {
+		ext = path.Ext(parsedUrl.Path)
+	}
+	exts, err := mime.ExtensionsByType(contentType)
+	if err != nil || len(exts) == 0 {
+		return ext
+	}
+	for _, candidate := range exts {
+		if strings.EqualFold(candidate, ext) {
+			return ext
+		}
+	}
+	return exts[0]
+}
+
+// Writes a zip holding the page as index.html, the cached subresources it
+// embeds, and a manifest describing where each file came from.
+func (s *Server) writeZipBundle(ctx context.Context, pageUrl *url.URL, page io.Reader, pageCapturedAt time.Time, out io.Writer) error {
+	zw := zip.NewWriter(out)
+	manifest := []bundleManifestEntry{{
+		Path:        "index.html",
+		Url:         pageUrl.String(),
+		ContentType: "text/html",
+		CapturedAt:  pageCapturedAt,
+	}}
+	pathsByUrl := map[string]string{}
+	var embed embedFunc
+	embed = func(absoluteUrl string, resource *cachedResource) (string, error) {
+		if p, ok := pathsByUrl[absoluteUrl]; ok {
+			return p, nil
+		}
+		contentType := getContentType(resource.headers)
+		p := fmt.Sprintf("resources/%d%s", len(pathsByUrl), bundleExtension(absoluteUrl, contentType))
+		// Claimed up front so that stylesheets referring to each other
+		// don't embed each other forever.
+		pathsByUrl[absoluteUrl] = p
+		// Links in a stylesheet are relative to it rather than to index.html.
+		resource = s.bundleSubresources(ctx, absoluteUrl, resource, func(absoluteUrl string, resource *cachedResource) (string, error) {
+			p, err := embed(absoluteUrl, resource)
+			return strings.TrimPrefix(p, "resources/"), err
+		})
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: p, Method: zip.Deflate, Modified: resource.capturedAt})
+		if err != nil {
+			delete(pathsByUrl, absoluteUrl)
+			return "", err
+		}
+		if _, err := fw.Write(resource.body); err != nil {
+			delete(pathsByUrl, absoluteUrl)
+			return "", err
+		}
+		manifest = append(manifest, bundleManifestEntry{p, absoluteUrl, contentType, resource.capturedAt})
+		return p, nil
+	}
+
+	var index bytes.Buffer
+	if err := s.bundleHtml(ctx, pageUrl, page, &index, embed); err != nil {
+		return err
+	}
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: "index.html", Method: zip.Deflate, Modified: pageCapturedAt})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, &index); err != nil {
+		return err
+	}
+	fw, err = zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	manifestEncoder := json.NewEncoder(fw)
+	manifestEncoder.SetIndent("", "  ")
+	if err := manifestEncoder.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Writes the page as a single file with its cached subresources inlined.
+func (s *Server) writeHtmlBundle(ctx context.Context, pageUrl *url.URL, page io.Reader, out io.Writer) error {
+	// Stylesheets that refer to one another are linked to rather than inlined
+	// into each other endlessly.
+	inlining := map[string]bool{}
+	var embed embedFunc
+	embed = func(absoluteUrl string, resource *cachedResource) (string, error) {
+		if inlining[absoluteUrl] {
+			return absoluteUrl, nil
+		}
+		inlining[absoluteUrl] = true
+		defer delete(inlining, absoluteUrl)
+		return dataUri(s.bundleSubresources(ctx, absoluteUrl, resource, embed)), nil
+	}
+	return s.bundleHtml(ctx, pageUrl, page, out, embed)
+}
+
+// Serves /bundle/<hash>.html, a single self-contained file for a cached page,
+// and /bundle/<hash>.zip, an archive of the page and its subresources.
+func (s *Server) handleBundleRequest(w http.ResponseWriter, r *http.Request) {
+	prefix := "/bundle/"
+	ext := path.Ext(r.URL.Path)
+	if !strings.HasPrefix(r.URL.Path, prefix) || (ext != ".html" && ext != ".zip") {
+		writeError(w, 404, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	encodedUrl := r.URL.Path[len(prefix) : len(r.URL.Path)-len(ext)]
+	if _, err := encoder.Decode(encodedUrl); err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl))
+		return
+	}
+	progress, err := s.dsFrom(r.Context()).Progress(encodedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	if progress.Status != datastore.ResourceCached {
+		writeError(w, 404, "Resource is not cached.")
+		return
+	}
+	f, err := s.dsFrom(r.Context()).Open(encodedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	defer f.Close()
+	if cachedContentType(f) != "text/html" {
+		writeError(w, 400, "Only HTML pages can be bundled.")
+		return
+	}
+	parsedUrl, err := url.Parse(keyUrl(f.ResourceURL()))
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Bad URL: %v", err))
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s%s\"", parsedUrl.Hostname(), ext))
+	if ext == ".zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		err = s.writeZipBundle(r.Context(), parsedUrl, f, progress.DownloadStarted, w)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = s.writeHtmlBundle(r.Context(), parsedUrl, f, w)
+	}
+	if err != nil {
+		log.Printf("Failed to bundle %s: %v\n", f.ResourceURL(), err)
+	}
+}
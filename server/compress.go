@@ -0,0 +1,238 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gnossen/knoxcache/datastore"
+	"github.com/gnossen/knoxcache/typefilter"
+)
+
+// Bodies known to be smaller than this are sent as they are, since they don't
+// shrink by enough to be worth it.
+const minCompressedBytes = 1024
+
+// The brotli quality responses are compressed with. Higher qualities are too
+// slow to compress with on every request.
+const brotliQuality = 4
+
+// The types worth compressing. Everything else is either compressed already
+// or unknown.
+var compressibleTypes = mustTypeList(
+	"text/*", "image/svg+xml", "image/x-icon", "image/bmp",
+	"application/json", "application/ld+json", "application/manifest+json",
+	"application/javascript", "application/x-javascript", "application/ecmascript",
+	"application/xml", "application/xhtml+xml", "application/rss+xml", "application/atom+xml",
+	"application/wasm", "application/pdf", "font/ttf", "font/otf", "application/vnd.ms-fontobject",
+)
+
+func mustTypeList(types ...string) typefilter.TypeList {
+	tl, err := typefilter.NewTypeList(types)
+	if err != nil {
+		panic(err)
+	}
+	return tl
+}
+
+// The parts of gzip.Writer and brotli.Writer that compressingResponseWriter
+// uses.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var compressorPools = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotliQuality)
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+// Returns how much the client prefers each of the encodings knox compresses
+// with, from 0, not at all, to 1.
+func acceptedEncodings(r *http.Request) map[string]float64 {
+	accepted := map[string]float64{}
+	wildcard := -1.0
+	for _, value := range strings.Split(strings.Join(r.Header.Values("Accept-Encoding"), ","), ",") {
+		parts := strings.Split(value, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		switch coding {
+		case "br", "gzip":
+			accepted[coding] = q
+		case "*":
+			wildcard = q
+		}
+	}
+	// * stands for the encodings that aren't listed.
+	for _, coding := range []string{"br", "gzip"} {
+		if _, ok := accepted[coding]; !ok && wildcard >= 0 {
+			accepted[coding] = wildcard
+		}
+	}
+	return accepted
+}
+
+// Returns the encoding to compress a response to r with, brotli or gzip, or
+// "" if the client accepts neither. Brotli is preferred when the client
+// accepts both equally.
+func negotiateEncoding(r *http.Request) string {
+	accepted := acceptedEncodings(r)
+	if accepted["br"] > 0 && accepted["br"] >= accepted["gzip"] {
+		return "br"
+	}
+	if accepted["gzip"] > 0 {
+		return "gzip"
+	}
+	return ""
+}
+
+// Returns the body of f as it is stored, gzipped, if it can be sent to r that
+// way rather than decompressed and maybe compressed again.
+func (s *Server) storedGzip(r *http.Request, f datastore.ResourceReader) (io.Reader, int64, bool) {
+	if !s.config.CompressResponses || acceptedEncodings(r)["gzip"] <= 0 {
+		return nil, 0, false
+	}
+	return f.Gzipped()
+}
+
+// The compressed body isn't byte for byte the one a strong validator would
+// promise.
+func weakenEtag(headers http.Header) {
+	if etag := headers.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		headers.Set("ETag", "W/"+etag)
+	}
+}
+
+// Compresses the bodies handler writes for clients that accept brotli or
+// gzip. Bodies that are encoded already, e.g. stored ones passed through as
+// they are, are left alone.
+func (s *Server) compressResponses(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.config.CompressResponses {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressingResponseWriter{ResponseWriter: w, r: r, encoding: negotiateEncoding(r)}
+		defer cw.finish()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	r *http.Request
+	// The negotiated encoding, or "" if the client accepts none.
+	encoding string
+
+	wroteHeader bool
+	// Nil unless the body is being compressed.
+	c compressor
+}
+
+func (cw *compressingResponseWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.startCompressing(status)
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+// Decides whether to compress the body the headers are for, and changes them
+// to match if so.
+func (cw *compressingResponseWriter) startCompressing(status int) {
+	headers := cw.Header()
+	contentType := headers.Get("Content-Type")
+	// Events are flushed one at a time, which compresses poorly.
+	if !compressibleTypes.Matches(contentType, "") || strings.HasPrefix(strings.ToLower(contentType), "text/event-stream") {
+		return
+	}
+	// Whatever was decided, caches have to know it depends on the client.
+	if !headerHasToken(headers, "Vary", "Accept-Encoding") {
+		headers.Add("Vary", "Accept-Encoding")
+	}
+	if cw.encoding == "" || headers.Get("Content-Encoding") != "" || status < 200 || status == 204 || status == 206 || status == 304 {
+		return
+	}
+	if length, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64); err == nil && length < minCompressedBytes {
+		return
+	}
+	headers.Del("Content-Length")
+	headers.Set("Content-Encoding", cw.encoding)
+	weakenEtag(headers)
+	if cw.r.Method == "HEAD" {
+		return
+	}
+	cw.c = compressorPools[cw.encoding].Get().(compressor)
+	cw.c.Reset(cw.ResponseWriter)
+}
+
+func (cw *compressingResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			// What net/http would otherwise have sniffed once the body
+			// was compressed.
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(200)
+	}
+	if cw.c == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.c.Write(b)
+}
+
+func (cw *compressingResponseWriter) Flush() {
+	if cw.c != nil {
+		cw.c.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *compressingResponseWriter) finish() {
+	// A HEAD has to say what a GET would have been sent with.
+	if !cw.wroteHeader && cw.r.Method == "HEAD" {
+		cw.WriteHeader(200)
+	}
+	if cw.c == nil {
+		return
+	}
+	cw.c.Close()
+	cw.c.Reset(nil)
+	compressorPools[cw.encoding].Put(cw.c)
+	cw.c = nil
+}
+
+// Reports whether one of the comma-separated values of the header named key
+// is token.
+func headerHasToken(headers http.Header, key string, token string) bool {
+	for _, value := range headers.Values(key) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"GZIP;q=0.8, deflate", "gzip"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		if got := negotiateEncoding(r); got != tc.want {
+			t.Errorf("Wrong encoding for %q. got = %q, want = %q", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+func TestCompressResponses(t *testing.T) {
+	s := newServer(DefaultConfig())
+	body := strings.Repeat("<p>compressible</p>", 200)
+	serve := func(method, acceptEncoding string, headers http.Header, body string) *http.Response {
+		handler := s.compressResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for key, values := range headers {
+				w.Header()[key] = values
+			}
+			io.WriteString(w, body)
+		}))
+		r := httptest.NewRequest(method, "/", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+	decode := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	}
+
+	htmlHeaders := http.Header{"Content-Type": {"text/html"}, "Etag": {`"abc"`}, "Content-Length": {strconv.Itoa(len(body))}}
+	for encoding, newReader := range decode {
+		res := serve("GET", encoding, htmlHeaders, body)
+		if res.Header.Get("Content-Encoding") != encoding || res.Header.Get("Content-Length") != "" || res.Header.Get("ETag") != `W/"abc"` {
+			t.Errorf("Wrong headers for %s. got = %v", encoding, res.Header)
+		}
+		r, err := newReader(res.Body)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || string(got) != body {
+			t.Errorf("Wrong %s body. got = %q, %v", encoding, got, err)
+		}
+	}
+
+	// A HEAD is sent the headers the GET would be.
+	if res := serve("HEAD", "gzip", htmlHeaders, ""); res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("Content-Length") != "" {
+		t.Errorf("Wrong headers for a HEAD. got = %v", res.Header)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		acceptEncoding string
+		headers        http.Header
+		body           string
+		wantVary       bool
+	}{
+		{"not accepted", "identity", http.Header{"Content-Type": {"text/html"}}, body, true},
+		{"already compressed", "gzip", http.Header{"Content-Type": {"image/png"}}, body, false},
+		{"already encoded", "gzip", http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}}, body, true},
+		{"small", "gzip", http.Header{"Content-Type": {"text/html"}, "Content-Length": {"5"}}, "small", true},
+		{"events", "gzip", http.Header{"Content-Type": {"text/event-stream"}}, body, false},
+	} {
+		res := serve("GET", tc.acceptEncoding, tc.headers, tc.body)
+		got, _ := ioutil.ReadAll(res.Body)
+		if string(got) != tc.body || res.Header.Get("Content-Encoding") != tc.headers.Get("Content-Encoding") {
+			t.Errorf("Expected the %s body to be sent as it is. got = %v", tc.name, res.Header)
+		}
+		if vary := res.Header.Get("Vary") == "Accept-Encoding"; vary != tc.wantVary {
+			t.Errorf("Wrong Vary for the %s body. got = %v", tc.name, res.Header)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"compress/gzip"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+// Configures the server returned by New. Each field corresponds to a flag of
+// cmd/knox, whose help describes it in more detail.
+type Config struct {
+	// The address at which the service will be accessible.
+	AdvertiseAddress string
+
+	// The directory in which to place cached files.
+	DatastoreRoot string
+
+	// The path to the sqlite db file. Defaults to knox.db in DatastoreRoot.
+	DbFile string
+
+	Sqlite datastore.SqliteOptions
+
+	// Files of URL rewrite rules and response header rules. Unused if empty.
+	RewriteRulesFile string
+	HeaderRulesFile  string
+
+	// What is done to the Set-Cookie headers of cached responses when they
+	// are served, unless a header rule for the host says otherwise. One of
+	// pass, strip-auth, or strip. StripSetCookie is the same as strip.
+	SetCookiePolicy string
+	StripSetCookie  bool
+
+	// One of adapt, keep, or drop.
+	CspMode string
+
+	// What is done with resources that robots.txt disallows or whose
+	// noarchive directives forbid archiving. One of ignore, flag (cache
+	// and tag them), or refuse.
+	RobotsPolicy string
+
+	// Schemes of links that cached pages keep as they are rather than
+	// pointing them at the cache, in addition to mailto, tel, sms,
+	// javascript, data, and blob if KeepDefaultLinkSchemes is set. Links to
+	// fragments of the same page are always kept.
+	KeepDefaultLinkSchemes bool
+	KeepLinkSchemes        []string
+
+	// Hosts, wildcards, or CIDRs whose scripts have the absolute http(s)
+	// URLs in their string literals pointed at the cache.
+	RewriteScriptUrlHosts []string
+
+	StripDefaultTrackingParams bool
+
+	// Regexes matching names of query parameters to strip from URLs.
+	StripQueryParams []string
+
+	// The compress/gzip level cached bodies are stored with.
+	CompressionLevel int
+
+	// Whether to compress responses for clients that accept brotli or gzip.
+	CompressResponses bool
+
+	// Content types, written like AllowContentTypes, whose bodies are stored
+	// without compression since they are compressed already, in addition to
+	// common compressed formats if SkipCompressionDefaultTypes is set.
+	SkipCompressionDefaultTypes bool
+	SkipCompressionTypes        []string
+
+	// Hosts, wildcards, or CIDRs that may or may not be fetched.
+	AllowHosts []string
+	DenyHosts  []string
+
+	// MIME types, wildcards, or file extensions that may or may not be
+	// cached.
+	AllowContentTypes []string
+	DenyContentTypes  []string
+
+	AllowPrivateAddresses bool
+	MaxResumeAttempts     int
+
+	// CIDRs or IP addresses of the clients allowed to reach /admin/ and
+	// /api/. Everyone may if empty. The rest of the cache is served to
+	// everyone either way.
+	AdminAllowNetworks []string
+
+	// The number of downloads from origins that may run at once. Zero means
+	// unlimited.
+	MaxConcurrentDownloads int
+
+	// Caps in bytes per second on downloads from origins, in total and from
+	// each host, and on responses to clients, in total and to each client
+	// address. Zero means unlimited.
+	UpstreamBandwidth            int64
+	UpstreamBandwidthPerHost     int64
+	DownstreamBandwidth          int64
+	DownstreamBandwidthPerClient int64
+
+	UpstreamHttp2         bool
+	UpstreamTlsMinVersion string
+	UpstreamCaFile        string
+
+	// Names of the request headers passed on from clients to origins when
+	// fetching on their behalf, in addition to Accept, Accept-Language, and
+	// the basic client hints if ForwardDefaultHeaders is set.
+	ForwardDefaultHeaders bool
+	ForwardHeaders        []string
+
+	// Request headers sent to origins, written "Name: value", unless the
+	// client being fetched for sent one of the same name that is forwarded.
+	UpstreamHeaders []string
+
+	// Limits on the pool of connections to origins. Zero means no limit,
+	// except that zero UpstreamMaxIdleConnsPerHost means 2.
+	UpstreamMaxIdleConns        int
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamMaxConnsPerHost     int
+	UpstreamIdleConnTimeout     time.Duration
+
+	// The interval between TCP keep-alive probes. Negative disables them.
+	UpstreamKeepAlive time.Duration
+
+	// How long an origin may take to start responding, and to send more of
+	// a body, before the fetch is given up on and recorded as failed. Zero
+	// means no limit.
+	UpstreamResponseHeaderTimeout time.Duration
+	UpstreamReadTimeout           time.Duration
+
+	// The number of origins whose TLS sessions are remembered for
+	// resumption. Zero disables resumption.
+	UpstreamTlsSessionCacheSize int
+
+	DnsServer    string
+	DnsOverHttps string
+	DnsCacheTtl  time.Duration
+
+	// How long a cached resource is served before it is fetched again. Zero
+	// means forever.
+	ResourceTtl time.Duration
+
+	// Whether the Cache-Control and Expires headers a resource was sent with
+	// decide how long it is served instead, clamped to between OriginTtlMin
+	// and OriginTtlMax. Zero OriginTtlMax means no upper bound.
+	HonorOriginCacheControl bool
+	OriginTtlMin            time.Duration
+	OriginTtlMax            time.Duration
+
+	// Bounds on the decompressed bodies kept in memory, in total and per
+	// resource. Zero MemoryCacheBytes disables the memory cache.
+	MemoryCacheBytes      int64
+	MemoryCacheEntryBytes int64
+
+	// Downloads are refused rather than leave less than MinFreeDiskBytes
+	// free on the datastore's disk, or take the bytes the datastore uses
+	// over DiskBudgetBytes. Zero DiskBudgetBytes means no budget.
+	MinFreeDiskBytes int64
+	DiskBudgetBytes  int64
+
+	// One of none, fsync or atomic. See datastore.Durability.
+	Durability string
+
+	AccessFlushInterval time.Duration
+	FailureTtl          time.Duration
+
+	// Each failure in a row to fetch a resource doubles how long it is
+	// held off for, starting from FailureTtl, up to MaxFailureTtl.
+	MaxFailureTtl time.Duration
+
+	// How many times in a row a resource that failed to be fetched is
+	// fetched again in the background once its failure expires, checked
+	// every FailureRetryInterval. Zero leaves it to be fetched when next
+	// requested.
+	FailureRetries       int
+	FailureRetryInterval time.Duration
+
+	// Fetches from an origin fail fast for CircuitBreakerCooldown after this
+	// many consecutive failures. Zero disables circuit breaking.
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+
+	// A directory or the URL of another knox instance that completed
+	// resources are copied to every ReplicationInterval. Replication is
+	// disabled if empty.
+	ReplicateTo         string
+	ReplicationInterval time.Duration
+
+	// Whether other knox instances may replicate to this one.
+	AcceptReplicas bool
+
+	// Whether to only serve what is cached already, refusing to fetch
+	// anything or to change the cache.
+	ReadOnly bool
+
+	// A directory that the bodies of resources not accessed for
+	// ColdTierAfter are moved to. Tiering is disabled if empty.
+	ColdTierRoot  string
+	ColdTierAfter time.Duration
+
+	// Separate caches for requests to other host names, each written
+	// host=root with its database in root. Replication, the cold tier, the
+	// gRPC API and the datastore metrics only cover the default cache.
+	VirtualHosts []string
+
+	// Rules, each written host=age or host=forever, for how long after
+	// they were captured the resources of the hosts they match are kept.
+	// The first rule matching a resource's host decides; resources no rule
+	// matches are kept forever. Expired resources are deleted every
+	// RetentionInterval.
+	RetentionRules    []string
+	RetentionInterval time.Duration
+
+	// A nats:// URL or the URL of a topic on a Kafka REST proxy that
+	// resource lifecycle events are published to. Disabled if empty.
+	EventsTo string
+
+	HeadlessRender           bool
+	HeadlessBrowserPath      string
+	HeadlessBrowserNoSandbox bool
+	RenderLoadTimeout        time.Duration
+	RenderIdleTimeout        time.Duration
+
+	// A file holding the secret that shareable links are signed with.
+	// Shareable links are disabled if empty.
+	LinkSigningKeyFile string
+
+	// The OpenID Connect provider that people sign in to the admin pages
+	// with, e.g. https://accounts.google.com. The admin pages are open to
+	// everyone who can reach them if empty.
+	OidcIssuer   string
+	OidcClientId string
+	// A file holding the client secret. Empty for a public client.
+	OidcClientSecretFile string
+	// The ID token claim listing the groups people are in.
+	OidcGroupsClaim string
+	// Rules, each written group=role, giving the people in a group the
+	// viewer or admin role. The group * matches everyone who signs in.
+	// People with no role are refused.
+	OidcGroupRoles []string
+
+	// Replaces the built-in templates and static assets if not empty.
+	TemplateDir string
+
+	// Go plugins to load, which register hooks when initialized.
+	Plugins []string
+
+	// The URL of a collector to export traces to over OTLP/HTTP. Tracing is
+	// disabled if empty.
+	OtlpEndpoint string
+}
+
+// Returns the configuration knox runs with when no flags are given.
+func DefaultConfig() Config {
+	return Config{
+		AdvertiseAddress:              "localhost:8080",
+		Sqlite:                        datastore.DefaultSqliteOptions(),
+		SetCookiePolicy:               "strip-auth",
+		CspMode:                       "adapt",
+		RobotsPolicy:                  "ignore",
+		KeepDefaultLinkSchemes:        true,
+		OidcGroupsClaim:               "groups",
+		StripDefaultTrackingParams:    true,
+		CompressionLevel:              gzip.DefaultCompression,
+		CompressResponses:             true,
+		SkipCompressionDefaultTypes:   true,
+		MaxResumeAttempts:             3,
+		MaxConcurrentDownloads:        16,
+		ForwardDefaultHeaders:         true,
+		UpstreamHttp2:                 true,
+		UpstreamTlsMinVersion:         "1.2",
+		UpstreamMaxIdleConns:          100,
+		UpstreamMaxIdleConnsPerHost:   16,
+		UpstreamIdleConnTimeout:       90 * time.Second,
+		UpstreamKeepAlive:             30 * time.Second,
+		UpstreamResponseHeaderTimeout: 30 * time.Second,
+		UpstreamReadTimeout:           60 * time.Second,
+		UpstreamTlsSessionCacheSize:   256,
+		DnsCacheTtl:                   1 * time.Minute,
+		MemoryCacheBytes:              64 * 1024 * 1024,
+		MemoryCacheEntryBytes:         256 * 1024,
+		Durability:                    string(datastore.DurabilityNone),
+		AccessFlushInterval:           10 * time.Second,
+		FailureTtl:                    1 * time.Minute,
+		MaxFailureTtl:                 24 * time.Hour,
+		FailureRetryInterval:          1 * time.Minute,
+		OriginTtlMin:                  1 * time.Minute,
+		CircuitBreakerFailures:        5,
+		CircuitBreakerCooldown:        30 * time.Second,
+		ReplicationInterval:           1 * time.Minute,
+		ColdTierAfter:                 30 * 24 * time.Hour,
+		RetentionInterval:             1 * time.Hour,
+		RenderLoadTimeout:             30 * time.Second,
+		RenderIdleTimeout:             10 * time.Second,
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// What a crawl's links may be followed to, besides how deep it goes.
+const (
+	// Pages on the same host as the page linking to them.
+	crawlScopeHost = "host"
+
+	// Pages on the same registrable domain as the page linking to them,
+	// e.g. any of *.example.co.uk from www.example.co.uk.
+	crawlScopeDomain = "domain"
+)
+
+// The most include and exclude patterns a crawl may have.
+const maxCrawlPatterns = 20
+
+// Which links a crawl follows, from its jobParams.
+type crawlScope struct {
+	domain     bool
+	pathPrefix string
+	include    []*regexp.Regexp
+	exclude    []*regexp.Regexp
+}
+
+// Returns the scope params ask for, or an error fit to show the client that
+// asked for the crawl if it doesn't make sense.
+func newCrawlScope(params jobParams) (crawlScope, error) {
+	scope := crawlScope{pathPrefix: params.PathPrefix}
+	switch params.Scope {
+	case "", crawlScopeHost:
+	case crawlScopeDomain:
+		scope.domain = true
+	default:
+		return crawlScope{}, fmt.Errorf("A crawl's scope must be %s or %s.", crawlScopeHost, crawlScopeDomain)
+	}
+	if params.PathPrefix != "" && !strings.HasPrefix(params.PathPrefix, "/") {
+		return crawlScope{}, fmt.Errorf("Bad path_prefix '%s'; it must start with /.", params.PathPrefix)
+	}
+	if len(params.Include)+len(params.Exclude) > maxCrawlPatterns {
+		return crawlScope{}, fmt.Errorf("A crawl may have at most %d include and exclude patterns.", maxCrawlPatterns)
+	}
+	var err error
+	if scope.include, err = compileCrawlPatterns("include", params.Include); err != nil {
+		return crawlScope{}, err
+	}
+	if scope.exclude, err = compileCrawlPatterns("exclude", params.Exclude); err != nil {
+		return crawlScope{}, err
+	}
+	return scope, nil
+}
+
+func compileCrawlPatterns(name string, patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Bad %s pattern '%s': %v", name, pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Whether the crawl follows a link from pageUrl to linkUrl.
+func (s crawlScope) allows(pageUrl, linkUrl *url.URL) bool {
+	if !s.sameSite(pageUrl.Hostname(), linkUrl.Hostname()) {
+		return false
+	}
+	if s.pathPrefix != "" && !strings.HasPrefix(linkUrl.Path, s.pathPrefix) {
+		return false
+	}
+	rawUrl := linkUrl.String()
+	if len(s.include) != 0 && !matchesAny(s.include, rawUrl) {
+		return false
+	}
+	return !matchesAny(s.exclude, rawUrl)
+}
+
+func (s crawlScope) sameSite(pageHost, linkHost string) bool {
+	if strings.EqualFold(pageHost, linkHost) {
+		return true
+	}
+	if !s.domain {
+		return false
+	}
+	// Hosts without a registrable domain, like addresses and localhost,
+	// only match themselves.
+	pageDomain, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(pageHost))
+	if err != nil {
+		return false
+	}
+	linkDomain, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(linkHost))
+	return err == nil && pageDomain == linkDomain
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
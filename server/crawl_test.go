@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNewCrawlScope(t *testing.T) {
+	tooMany := make([]string, maxCrawlPatterns+1)
+	for i := range tooMany {
+		tooMany[i] = "a"
+	}
+	for _, tc := range []struct {
+		name   string
+		params jobParams
+		ok     bool
+	}{
+		{"default", jobParams{}, true},
+		{"host", jobParams{Scope: "host"}, true},
+		{"domain", jobParams{Scope: "domain", PathPrefix: "/docs/", Include: []string{`\.html$`}, Exclude: []string{`\?`}}, true},
+		{"unknown scope", jobParams{Scope: "internet"}, false},
+		{"relative prefix", jobParams{PathPrefix: "docs/"}, false},
+		{"bad include", jobParams{Include: []string{"("}}, false},
+		{"bad exclude", jobParams{Exclude: []string{"[a-"}}, false},
+		{"too many patterns", jobParams{Exclude: tooMany}, false},
+	} {
+		if _, err := newCrawlScope(tc.params); (err == nil) != tc.ok {
+			t.Errorf("%s: wrong result. got = %v, want ok = %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestCrawlScopeAllows(t *testing.T) {
+	for _, tc := range []struct {
+		params jobParams
+		page   string
+		link   string
+		want   bool
+	}{
+		{jobParams{}, "http://a.example.co.uk/", "http://A.example.co.uk/x", true},
+		{jobParams{}, "http://a.example.co.uk/", "http://b.example.co.uk/x", false},
+		{jobParams{Scope: "domain"}, "http://a.example.co.uk/", "http://b.example.co.uk/x", true},
+		{jobParams{Scope: "domain"}, "http://a.example.co.uk/", "http://example.co.uk/x", true},
+		{jobParams{Scope: "domain"}, "http://a.example.co.uk/", "http://other.co.uk/x", false},
+		{jobParams{Scope: "domain"}, "http://localhost:8080/", "http://localhost:9090/x", true},
+		{jobParams{Scope: "domain"}, "http://127.0.0.1/", "http://127.0.0.2/x", false},
+		{jobParams{PathPrefix: "/docs/"}, "http://a.com/", "http://a.com/docs/x", true},
+		{jobParams{PathPrefix: "/docs/"}, "http://a.com/docs/", "http://a.com/blog/x", false},
+		{jobParams{Include: []string{`/x$`, `/y$`}}, "http://a.com/", "http://a.com/y", true},
+		{jobParams{Include: []string{`/x$`}}, "http://a.com/", "http://a.com/z", false},
+		{jobParams{Exclude: []string{`\?page=`}}, "http://a.com/", "http://a.com/x?page=2", false},
+		{jobParams{Include: []string{`/x`}, Exclude: []string{`/x/private`}}, "http://a.com/", "http://a.com/x/private", false},
+	} {
+		scope, err := newCrawlScope(tc.params)
+		if err != nil {
+			t.Fatalf("Failed to make scope %+v: %v", tc.params, err)
+		}
+		pageUrl, _ := url.Parse(tc.page)
+		linkUrl, _ := url.Parse(tc.link)
+		if got := scope.allows(pageUrl, linkUrl); got != tc.want {
+			t.Errorf("Wrong result for %s -> %s with %+v. got = %v, want = %v", tc.page, tc.link, tc.params, got, tc.want)
+		}
+	}
+}
+
+func TestNewCrawlScopeError(t *testing.T) {
+	_, err := newCrawlScope(jobParams{Include: []string{"("}})
+	if err == nil || !strings.Contains(err.Error(), "Bad include pattern '('") {
+		t.Errorf("Wrong error. got = %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"crypto/hmac"
+	"net/http"
+
+	"github.com/gnossen/knoxcache/oidc"
+)
+
+// The cookie the token in the create form is checked against. A page on
+// another site can make the browser post the form, but it can't read the
+// cookie to fill in the token.
+const csrfCookie = "knox_csrf"
+
+const csrfField = "csrf_token"
+
+// Returns the token for the forms on the page r asks for, setting the cookie
+// it is checked against if the browser doesn't have one yet.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	token, err := oidc.RandomString()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Secure:   getProtocol(r) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// Reports whether the form posted in r carries the token from its cookie.
+func checkCsrfToken(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return hmac.Equal([]byte(r.PostFormValue(csrfField)), []byte(cookie.Value))
+}
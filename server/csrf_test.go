@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCsrfToken(t *testing.T) {
+	w := httptest.NewRecorder()
+	token, err := csrfToken(w, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || cookies[0].Value != token {
+		t.Fatalf("Expected the token to be set as a cookie. got = %v", cookies)
+	}
+
+	// The token stays the same for as long as the browser keeps the cookie.
+	again := httptest.NewRequest("GET", "/", nil)
+	again.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	if got, err := csrfToken(w, again); err != nil || got != token || len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected the token from the cookie. got = %q, %v", got, err)
+	}
+
+	post := func(cookie *http.Cookie, formToken string) *http.Request {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{csrfField: {formToken}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+	if !checkCsrfToken(post(cookies[0], token)) {
+		t.Errorf("Expected the token from the form to be accepted.")
+	}
+	if checkCsrfToken(post(cookies[0], "forged")) {
+		t.Errorf("Expected a different token to be refused.")
+	}
+	if checkCsrfToken(post(nil, token)) {
+		t.Errorf("Expected a token without its cookie to be refused.")
+	}
+	if checkCsrfToken(post(&http.Cookie{Name: csrfCookie, Value: ""}, "")) {
+		t.Errorf("Expected an empty token to be refused.")
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Returned instead of starting a download that would leave the datastore's
+// disk with less than --min-free-disk free or take it over --disk-budget.
+var errInsufficientStorage = errors.New("not enough disk space")
+
+// Checks that expectedBytes more can be written when free bytes are free,
+// used bytes are used by the cache, and reserved bytes are expected by other
+// downloads.
+func (s *Server) checkDiskSpace(free, used, reserved, expectedBytes int64) error {
+	needed := reserved + expectedBytes
+	if free-needed <= s.config.MinFreeDiskBytes {
+		return fmt.Errorf("%w: %s free, %s needed with %s kept free", errInsufficientStorage,
+			formatDataSize(int(free)), formatDataSize(int(needed)), formatDataSize(int(s.config.MinFreeDiskBytes)))
+	}
+	if s.config.DiskBudgetBytes != 0 && used+needed > s.config.DiskBudgetBytes {
+		return fmt.Errorf("%w: %s used and %s needed of a %s budget", errInsufficientStorage,
+			formatDataSize(int(used)), formatDataSize(int(needed)), formatDataSize(int(s.config.DiskBudgetBytes)))
+	}
+	return nil
+}
+
+// Checks that there is room to start a download in the cache ctx is for.
+func (s *Server) checkDiskSpaceFor(ctx context.Context) error {
+	release, err := s.reserveDiskSpace(ctx, 0)
+	if err != nil {
+		return err
+	}
+	release()
+	return nil
+}
+
+// Reserves room for a download of expectedBytes in the cache ctx is for, or
+// returns an errInsufficientStorage saying why there isn't any. Bodies are
+// stored compressed, but the full size is reserved since how well they will
+// compress isn't known. The caller has to call the returned function once
+// the download is done.
+func (s *Server) reserveDiskSpace(ctx context.Context, expectedBytes int64) (func(), error) {
+	store := s.dsFrom(ctx)
+	free, err := store.FreeBytes()
+	if err != nil {
+		// Better to risk running out than to refuse everything.
+		log.Printf("Failed to check free disk space: %v\n", err)
+		return func() {}, nil
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		return nil, err
+	}
+	host := virtualHostFrom(ctx)
+	s.reservationsMu.Lock()
+	defer s.reservationsMu.Unlock()
+	if err := s.checkDiskSpace(free, int64(stats.DiskConsumptionBytes), s.diskReservations[host], expectedBytes); err != nil {
+		s.downloadsRefusedForSpace.Inc()
+		return nil, err
+	}
+	s.diskReservations[host] += expectedBytes
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.reservationsMu.Lock()
+			defer s.reservationsMu.Unlock()
+			s.diskReservations[host] -= expectedBytes
+		})
+	}, nil
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	s := newServer(DefaultConfig())
+	const mb = 1024 * 1024
+	cases := []struct {
+		name                          string
+		minFree, budget               int64
+		free, used, reserved, expects int64
+		ok                            bool
+	}{
+		{"room to spare", 100 * mb, 0, 500 * mb, 0, 100 * mb, 200 * mb, true},
+		{"below the free minimum", 100 * mb, 0, 500 * mb, 0, 100 * mb, 350 * mb, false},
+		{"larger than the disk", 0, 0, 500 * mb, 0, 0, 600 * mb, false},
+		{"disk full", 0, 0, 0, 0, 0, 0, false},
+		{"within budget", 0, 1000 * mb, 500 * mb, 700 * mb, 100 * mb, 100 * mb, true},
+		{"over budget", 0, 1000 * mb, 500 * mb, 700 * mb, 100 * mb, 300 * mb, false},
+	}
+	for _, tc := range cases {
+		s.config.MinFreeDiskBytes, s.config.DiskBudgetBytes = tc.minFree, tc.budget
+		err := s.checkDiskSpace(tc.free, tc.used, tc.reserved, tc.expects)
+		if tc.ok && err != nil {
+			t.Errorf("Expected room for %s. got = %v", tc.name, err)
+		} else if !tc.ok && !errors.Is(err, errInsufficientStorage) {
+			t.Errorf("Expected no room for %s. got = %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The content encodings knox can decode, in the order it prefers them.
+const acceptEncoding = "gzip, br, zstd, deflate"
+
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+	// The Content-Encoding the body was sent with.
+	encoding string
+}
+
+func (b *decodedBody) Close() error {
+	var err error
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		if cerr := b.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// "deflate" is supposed to mean zlib, but some origins send bare deflate
+// streams, which can be told apart by their first two bytes.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{d}, nil
+	case "deflate":
+		return newDeflateReader(r)
+	}
+	return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+}
+
+// Asks origins for the encodings knox can decode and decodes responses, so
+// that bodies are handed on, and stored, as they are meant to be read.
+type decodingTransport struct {
+	next http.RoundTripper
+}
+
+func (t decodingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if req.Header.Get("Range") != "" {
+		// Ranges of a decoded body don't line up with ranges of the encoded
+		// one.
+		req.Header.Set("Accept-Encoding", "identity")
+	} else {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	contentEncoding := resp.Header.Get("Content-Encoding")
+	var encodings []string
+	for _, encoding := range strings.Split(contentEncoding, ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if encoding != "" && encoding != "identity" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) == 0 {
+		resp.Header.Del("Content-Encoding")
+		return resp, nil
+	}
+	if req.Method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == 304 {
+		// There's no body to decode, and the headers describe the one that
+		// would have been sent.
+		return resp, nil
+	}
+	resp.Header.Del("Content-Encoding")
+	body := &decodedBody{Reader: resp.Body, closers: []io.Closer{resp.Body}, encoding: contentEncoding}
+	// Encodings are listed in the order they were applied.
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoder, err := newDecoder(encodings[i], body.Reader)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		body.Reader = decoder
+		body.closers = append(body.closers, decoder)
+	}
+	resp.Body = body
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// Returns the Content-Encoding resp was sent with before decodingTransport
+// decoded it, or "" if it wasn't encoded.
+func originalContentEncoding(resp *http.Response) string {
+	if body, ok := resp.Body.(*decodedBody); ok {
+		return body.encoding
+	}
+	return ""
+}
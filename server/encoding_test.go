@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const encodedContent = "<html><body>Hello, world!</body></html>"
+
+func encode(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("Failed to create zstd writer: %v", err)
+		}
+		w = zw
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			t.Fatalf("Failed to create flate writer: %v", err)
+		}
+		w = fw
+	default:
+		t.Fatalf("Unknown encoding %s", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodingTransport(t *testing.T) {
+	cases := []struct {
+		name      string
+		encodings []string
+		header    string
+	}{
+		{"gzip", []string{"gzip"}, "gzip"},
+		{"brotli", []string{"br"}, "br"},
+		{"zstd", []string{"zstd"}, "zstd"},
+		{"zlib deflate", []string{"deflate"}, "deflate"},
+		{"raw deflate", []string{"raw-deflate"}, "deflate"},
+		{"stacked", []string{"gzip", "br"}, "gzip, br"},
+		{"identity", nil, "identity"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			body := []byte(encodedContent)
+			for _, encoding := range c.encodings {
+				body = encode(t, encoding, body)
+			}
+			var acceptEncodingSent string
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncodingSent = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Encoding", c.header)
+				w.Write(body)
+			}))
+			defer origin.Close()
+			client := &http.Client{Transport: decodingTransport{http.DefaultTransport}}
+
+			resp, err := client.Get(origin.URL)
+			if err != nil {
+				t.Fatalf("Failed to fetch: %v", err)
+			}
+			defer resp.Body.Close()
+			got, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Failed to read body: %v", err)
+			}
+			if string(got) != encodedContent {
+				t.Errorf("Wrong body. got = %q, want = %q", got, encodedContent)
+			}
+			if acceptEncodingSent != acceptEncoding {
+				t.Errorf("Wrong Accept-Encoding. got = %q, want = %q", acceptEncodingSent, acceptEncoding)
+			}
+			if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+				t.Errorf("Expected Content-Encoding to be removed. got = %q", ce)
+			}
+			wantOriginal := c.header
+			if c.encodings == nil {
+				wantOriginal = ""
+			}
+			if got := originalContentEncoding(resp); got != wantOriginal {
+				t.Errorf("Wrong original encoding. got = %q, want = %q", got, wantOriginal)
+			}
+		})
+	}
+}
+
+func TestDecodingTransportRange(t *testing.T) {
+	var acceptEncodingSent string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncodingSent = r.Header.Get("Accept-Encoding")
+		w.WriteHeader(206)
+	}))
+	defer origin.Close()
+	client := &http.Client{Transport: decodingTransport{http.DefaultTransport}}
+
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Range", "bytes=10-")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	resp.Body.Close()
+	if acceptEncodingSent != "identity" {
+		t.Errorf("Expected ranges to be fetched unencoded. got = %q", acceptEncodingSent)
+	}
+	if req.Header.Get("Accept-Encoding") != "" {
+		t.Errorf("Expected the caller's request to be left alone.")
+	}
+}
+
+func TestDecodingTransportNotModified(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.WriteHeader(304)
+	}))
+	defer origin.Close()
+	client := &http.Client{Transport: decodingTransport{http.DefaultTransport}}
+
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 304 || resp.Header.Get("Content-Encoding") != "br" {
+		t.Errorf("Expected a 304 to pass through untouched. got = %d, %q", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestDecodingTransportUnsupported(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "compress")
+		w.Write([]byte("garbage"))
+	}))
+	defer origin.Close()
+	client := &http.Client{Transport: decodingTransport{http.DefaultTransport}}
+
+	if resp, err := client.Get(origin.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected an unsupported encoding to fail the fetch.")
+	}
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The lifecycle events published about each resource. Resources that expire
+// under --retention are deleted like any other, so there is no separate
+// event for eviction.
+const (
+	// A download of a resource that wasn't cached has started.
+	eventCreated = "created"
+	// A download or refresh has been stored and is being served.
+	eventCompleted = "completed"
+	// A download or refresh failed. Until the retry time has passed,
+	// requests for the resource are answered with the failure.
+	eventFailed = "failed"
+	// The resource was deleted through the admin page or the gRPC API, or
+	// for having outlived its --retention rule.
+	eventDeleted = "deleted"
+	// How much of a download in flight has been written so far. Only sent
+	// to the admin pages' event streams.
+	eventProgress = "progress"
+)
+
+// How each event is published, as a single JSON object:
+//
+//	{
+//	  "type": "created" | "completed" | "failed" | "deleted",
+//	  "time": "2006-01-02T15:04:05.999999999Z07:00",
+//	  "url": the URL or request key the resource is cached under,
+//	  "encoded_url": the resource's path under /c/ on this instance,
+//	  "error": why a download failed, only for failed events,
+//	  "raw_bytes": the bytes written so far, only for progress events,
+//	  "host": the --virtual-host whose cache the resource is in, omitted for
+//	          the default cache
+//	}
+//
+// Consumers should ignore fields they don't know, since more may be added.
+type cacheEventJson struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Url        string    `json:"url"`
+	EncodedUrl string    `json:"encoded_url"`
+	Error      string    `json:"error,omitempty"`
+	RawBytes   int64     `json:"raw_bytes,omitempty"`
+	Host       string    `json:"host,omitempty"`
+}
+
+// How many events may wait to be published before more are dropped.
+const eventQueueSize = 1000
+
+// How many queued events are published at a time.
+const eventBatchSize = 100
+
+// Somewhere events are published to.
+type eventSink interface {
+	publish(events []cacheEventJson) error
+	close() error
+}
+
+// Queues an event about the resource cached under rawUrl without waiting for
+// it to be published, and sends it to the admin pages' event streams. ctx
+// says which cache the resource is in.
+func (s *Server) publishEvent(ctx context.Context, eventType, encodedUrl, rawUrl string, cause error) {
+	event := cacheEventJson{
+		Type:       eventType,
+		Time:       time.Now(),
+		Url:        rawUrl,
+		EncodedUrl: encodedUrl,
+		Host:       virtualHostFrom(ctx),
+	}
+	if cause != nil {
+		event.Error = cause.Error()
+	}
+	s.broadcastLiveEvent(event)
+	if s.eventQueue == nil {
+		return
+	}
+	select {
+	case s.eventQueue <- event:
+	default:
+		s.eventsDropped.Inc()
+	}
+}
+
+// Returns the sink for --events-to, which is either a NATS server and
+// subject, written nats://[user:password@]host:port/subject, or the http(s)
+// URL of a topic on a Kafka REST proxy, e.g.
+// http://host:8082/topics/knox-events.
+func newEventSink(target string) (eventSink, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "nats":
+		subject := strings.TrimPrefix(u.Path, "/")
+		if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+			return nil, fmt.Errorf("bad NATS subject %q", subject)
+		}
+		return &natsSink{addr: u.Host, subject: subject, user: u.User}, nil
+	case "http", "https":
+		return kafkaRestSink{target, &http.Client{Timeout: 30 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("unsupported event target %s; expected a nats:// or http(s) URL", target)
+}
+
+func (s *Server) publishEventsPeriodically(sink eventSink) {
+	defer s.backgroundWork.Done()
+	defer func() {
+		if err := sink.close(); err != nil {
+			log.Printf("Failed to close %s: %v\n", s.config.EventsTo, err)
+		}
+	}()
+	for {
+		var batch []cacheEventJson
+		select {
+		case event := <-s.eventQueue:
+			batch = append(batch, event)
+		case <-s.stopBackground:
+		}
+	fill:
+		for len(batch) < eventBatchSize {
+			select {
+			case event := <-s.eventQueue:
+				batch = append(batch, event)
+			default:
+				break fill
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := sink.publish(batch); err != nil {
+			s.eventsDropped.Add(uint64(len(batch)))
+			log.Printf("Failed to publish %d events to %s: %v\n", len(batch), s.config.EventsTo, err)
+		} else {
+			s.eventsPublished.Add(uint64(len(batch)))
+		}
+	}
+}
+
+// A topic on a Kafka REST proxy, which takes records over its v2 API. Each
+// record is keyed by the resource's URL so that the events about a resource
+// stay in order.
+type kafkaRestSink struct {
+	url    string
+	client *http.Client
+}
+
+type kafkaRecordJson struct {
+	Key   string         `json:"key"`
+	Value cacheEventJson `json:"value"`
+}
+
+func (s kafkaRestSink) publish(events []cacheEventJson) error {
+	var records struct {
+		Records []kafkaRecordJson `json:"records"`
+	}
+	for _, event := range events {
+		records.Records = append(records.Records, kafkaRecordJson{event.Url, event})
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Post(s.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		var failure struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(res.Body).Decode(&failure)
+		return fmt.Errorf("%s: %s", res.Status, failure.Message)
+	}
+	return nil
+}
+
+func (s kafkaRestSink) close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// A subject on a NATS server, published to over the core NATS protocol. The
+// connection is made when the first batch is published and again after it
+// breaks.
+type natsSink struct {
+	addr    string
+	subject string
+	user    *url.Userinfo
+
+	// Held while writing to conn, which the goroutine reading from it also
+	// writes to.
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+	// Closed once the goroutine reading from conn finds it broken.
+	broken chan struct{}
+	// Signaled when the server answers a ping.
+	pongs chan struct{}
+}
+
+type natsConnectJson struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+}
+
+func (s *natsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	info, err := r.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("expected INFO from NATS server, got %q", strings.TrimSpace(info))
+	}
+	connect := natsConnectJson{Name: "knox"}
+	if s.user != nil {
+		connect.User = s.user.Username()
+		connect.Pass, _ = s.user.Password()
+	}
+	connectJson, err := json.Marshal(connect)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CONNECT %s\r\n", connectJson)
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn = conn
+	s.w = w
+	s.broken = make(chan struct{})
+	s.pongs = make(chan struct{}, 1)
+	go s.read(conn, r, w, s.broken, s.pongs)
+	return nil
+}
+
+// Answers the server's pings, which it disconnects clients that don't answer,
+// and logs the errors it reports, until conn breaks.
+func (s *natsSink) read(conn net.Conn, r *bufio.Reader, w *bufio.Writer, broken, pongs chan struct{}) {
+	defer close(broken)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			s.mu.Lock()
+			if s.conn == conn {
+				w.WriteString("PONG\r\n")
+				w.Flush()
+			}
+			s.mu.Unlock()
+		case line == "PONG":
+			select {
+			case pongs <- struct{}{}:
+			default:
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("NATS server %s reported an error: %s\n", s.addr, line)
+		}
+	}
+}
+
+func (s *natsSink) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *natsSink) publish(events []cacheEventJson) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		select {
+		case <-s.broken:
+			s.disconnect()
+		default:
+		}
+	}
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.w, "PUB %s %d\r\n%s\r\n", s.subject, len(payload), payload)
+	}
+	if err := s.w.Flush(); err != nil {
+		s.disconnect()
+		return err
+	}
+	return nil
+}
+
+func (s *natsSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	// The server answers in order, so once it answers a ping it has
+	// processed everything published before it.
+	s.w.WriteString("PING\r\n")
+	err := s.w.Flush()
+	if err == nil {
+		select {
+		case <-s.pongs:
+		case <-s.broken:
+			err = errors.New("connection closed before the last events were acknowledged")
+		case <-time.After(10 * time.Second):
+			err = errors.New("timed out waiting for the last events to be acknowledged")
+		}
+	}
+	s.disconnect()
+	return err
+}
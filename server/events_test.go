@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEvents = []cacheEventJson{
+	{Type: eventCreated, Time: time.Unix(1, 0).UTC(), Url: "http://example.com/", EncodedUrl: "abc"},
+	{Type: eventFailed, Time: time.Unix(2, 0).UTC(), Url: "http://example.com/", EncodedUrl: "abc", Error: "origin responded with 503"},
+}
+
+// Accepts a single NATS client, pings it once it has connected, and sends
+// every message it publishes to messages.
+func fakeNatsServer(t *testing.T, messages chan<- string) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(messages)
+				return
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "CONNECT":
+				messages <- line
+				fmt.Fprintf(conn, "PING\r\n")
+			case "PUB":
+				size, _ := strconv.Atoi(fields[2])
+				payload := make([]byte, size+2)
+				if _, err := io.ReadFull(r, payload); err != nil {
+					close(messages)
+					return
+				}
+				messages <- fields[1] + " " + string(payload[:size])
+			case "PING":
+				fmt.Fprintf(conn, "PONG\r\n")
+			case "PONG":
+				messages <- "PONG"
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNatsSink(t *testing.T) {
+	messages := make(chan string, 10)
+	addr := fakeNatsServer(t, messages)
+	sink, err := newEventSink("nats://knox:secret@" + addr + "/knox.events")
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	if err := sink.publish(testEvents); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	var connect natsConnectJson
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(<-messages, "CONNECT ")), &connect); err != nil || connect.User != "knox" || connect.Pass != "secret" {
+		t.Errorf("Wrong CONNECT. got = %+v, %v", connect, err)
+	}
+	// The answer to the server's ping may come before, between, or after
+	// the published messages.
+	var published []string
+	pongs := 0
+	for i := 0; i < len(testEvents)+1; i += 1 {
+		if got := <-messages; got == "PONG" {
+			pongs += 1
+		} else {
+			published = append(published, got)
+		}
+	}
+	if pongs != 1 {
+		t.Errorf("Expected the server's ping to be answered once. got = %d", pongs)
+	}
+	for i, want := range testEvents {
+		wantJson, _ := json.Marshal(want)
+		if i >= len(published) || published[i] != "knox.events "+string(wantJson) {
+			t.Errorf("Wrong messages. got = %q, want %q at %d", published, "knox.events "+string(wantJson), i)
+		}
+	}
+	if err := sink.close(); err != nil {
+		t.Errorf("Failed to close sink: %v", err)
+	}
+	if _, ok := <-messages; ok {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+func TestKafkaRestSink(t *testing.T) {
+	var got []kafkaRecordJson
+	var contentType string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/knox-events" {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error_code":40401,"message":"Topic not found."}`))
+			return
+		}
+		contentType = r.Header.Get("Content-Type")
+		var records struct {
+			Records []kafkaRecordJson `json:"records"`
+		}
+		json.NewDecoder(r.Body).Decode(&records)
+		got = append(got, records.Records...)
+		w.Write([]byte(`{"offsets":[]}`))
+	}))
+	defer s.Close()
+
+	sink, err := newEventSink(s.URL + "/topics/knox-events")
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	if err := sink.publish(testEvents); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	if contentType != "application/vnd.kafka.json.v2+json" {
+		t.Errorf("Wrong content type. got = %q", contentType)
+	}
+	if len(got) != len(testEvents) {
+		t.Fatalf("Wrong number of records. got = %d, want = %d", len(got), len(testEvents))
+	}
+	for i, record := range got {
+		if record.Key != testEvents[i].Url || record.Value != testEvents[i] {
+			t.Errorf("Wrong record %d. got = %+v, want = %+v", i, record, testEvents[i])
+		}
+	}
+
+	missing, err := newEventSink(s.URL + "/topics/missing")
+	if err != nil {
+		t.Fatalf("Failed to create sink: %v", err)
+	}
+	if err := missing.publish(testEvents); err == nil || !strings.Contains(err.Error(), "Topic not found.") {
+		t.Errorf("Expected publishing to a missing topic to fail. got = %v", err)
+	}
+}
+
+func TestNewEventSink(t *testing.T) {
+	for _, target := range []string{"nats://localhost:4222", "nats://localhost:4222/", "kafka://localhost:9092/knox-events", "/tmp/events"} {
+		if _, err := newEventSink(target); err == nil {
+			t.Errorf("Expected %q to be refused", target)
+		}
+	}
+}
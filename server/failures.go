@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+	enc "github.com/gnossen/knoxcache/encoder"
+)
+
+const maxFailuresPerPage = 100
+
+// The most failed resources retried in one pass over a cache.
+const maxRetriesPerPass = 100
+
+// Returns how long a resource is held off for after attempts failures in a
+// row to fetch it: --failure-ttl, doubled for each failure after the first,
+// up to --max-failure-ttl.
+func (s *Server) failureBackoff(attempts int) time.Duration {
+	settings := s.settings()
+	backoff := settings.failureTtl
+	for i := 1; i < attempts && backoff < settings.maxFailureTtl; i += 1 {
+		backoff *= 2
+	}
+	if backoff > settings.maxFailureTtl && settings.maxFailureTtl > settings.failureTtl {
+		return settings.maxFailureTtl
+	}
+	return backoff
+}
+
+// Fetches a resource that failed to be fetched again right away, the way it
+// was captured. Captured requests other than plain GETs aren't repeated,
+// since their bodies aren't kept.
+func (s *Server) retryFailedResource(ctx context.Context, failed datastore.FailedResource, userAgent string) error {
+	if _, _, _, ok := enc.ParseRequestKey(failed.Url); ok {
+		return errNotRefreshable
+	}
+	if err := s.dsFrom(ctx).ExpireFailure(failed.HashedUrl); err != nil {
+		return err
+	}
+	resourceWriter, err := s.startCachingPage(ctx, failed.HashedUrl, failed.Url)
+	if err != nil || resourceWriter == nil {
+		return err
+	}
+	return s.cachePage(ctx, failed.Url, resourceWriter, userAgent, nil, capturedWithOptions(failed.Url, failed.CaptureOptions))
+}
+
+func (s *Server) retryFailuresPeriodically() {
+	defer s.backgroundWork.Done()
+	ticker := time.NewTicker(s.config.FailureRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopBackground:
+			return
+		}
+		if s.inMaintenance() {
+			continue
+		}
+		for _, ctx := range s.cacheContexts() {
+			if !s.retryDueFailures(ctx) {
+				return
+			}
+		}
+	}
+}
+
+// Retries the resources of the cache ctx is for whose failures have expired,
+// one at a time, until each has failed --failure-retries times in a row.
+// Returns false if it stopped early because knox is shutting down.
+func (s *Server) retryDueFailures(ctx context.Context) bool {
+	ctx = withDownloadPriority(ctx, backgroundPriority)
+	due, err := s.dsFrom(ctx).DueFailures(s.config.FailureRetries, maxRetriesPerPass)
+	if err != nil {
+		log.Printf("Failed to look for failures to retry: %v\n", err)
+		return true
+	}
+	for _, failed := range due {
+		select {
+		case <-s.stopBackground:
+			return false
+		default:
+		}
+		log.Printf("Retrying %s after %d failed attempts\n", failed.Url, failed.Attempts)
+		if err := s.retryFailedResource(ctx, failed, ""); err != nil {
+			log.Printf("Failed to retry %s: %v\n", failed.Url, err)
+		}
+	}
+	return true
+}
+
+type failedResourceRow struct {
+	datastore.FailedResource
+
+	// Whether the failure has stopped holding off fetches.
+	Expired bool
+
+	// Whether the request can be repeated. See retryFailedResource.
+	Retryable bool
+}
+
+type adminFailuresData struct {
+	Rows      []failedResourceRow
+	ReturnUrl string
+	Page      int
+	HasPrev   bool
+	PrevPage  int
+	HasNext   bool
+	NextPage  int
+}
+
+func (s *Server) handleAdminFailuresRequest(w http.ResponseWriter, r *http.Request) {
+	pageNum, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || pageNum < 0 {
+		pageNum = 0
+	}
+	failed, err := s.dsFrom(r.Context()).Failures(pageNum*maxFailuresPerPage, maxFailuresPerPage)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to list failures: %v\n", err)
+		log.Printf(msg)
+		writeError(w, 500, msg)
+		return
+	}
+	now := time.Now()
+	var rows []failedResourceRow
+	for _, f := range failed {
+		_, _, _, captured := enc.ParseRequestKey(f.Url)
+		rows = append(rows, failedResourceRow{
+			FailedResource: f,
+			Expired:        !f.RetryAfter.After(now),
+			Retryable:      !captured,
+		})
+	}
+	s.renderPage(w, 200, "admin_failures.html", adminFailuresData{
+		Rows:      rows,
+		ReturnUrl: r.URL.RequestURI(),
+		Page:      pageNum + 1,
+		HasPrev:   pageNum != 0,
+		PrevPage:  pageNum - 1,
+		HasNext:   len(failed) == maxFailuresPerPage,
+		NextPage:  pageNum + 1,
+	})
+}
+
+// Retries a resource from the failures page right away, in the background,
+// and sends the browser back to the page it came from.
+func (s *Server) handleAdminRetryRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, 405, "Method not allowed.")
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeError(w, 403, "Cross-site requests are not allowed.")
+		return
+	}
+	prefix := "/admin/retry/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, 400, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	encodedUrl := r.URL.Path[len(prefix):]
+	failure, err := s.dsFrom(r.Context()).RecordedFailure(encodedUrl)
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Failed to look up failure: %v", err))
+		return
+	} else if failure == nil {
+		writeError(w, 404, "No failure is recorded for the resource.")
+		return
+	}
+	failed := datastore.FailedResource{HashedUrl: encodedUrl, FetchFailure: *failure}
+	if _, _, _, ok := enc.ParseRequestKey(failed.Url); ok {
+		writeError(w, 400, "Captured requests other than plain GETs can't be retried.")
+		return
+	}
+	// Expired here rather than in the background, so that the page the
+	// browser goes back to shows it.
+	if err := s.dsFrom(r.Context()).ExpireFailure(encodedUrl); err != nil && !errors.Is(err, datastore.ErrNoFailure) {
+		writeError(w, 500, fmt.Sprintf("Failed to expire failure: %v", err))
+		return
+	}
+	log.Printf("Retrying %s\n", failed.Url)
+	ctx := detachSpan(r.Context())
+	userAgent := r.Header.Get("User-Agent")
+	go func() {
+		if err := s.retryFailedResource(ctx, failed, userAgent); err != nil {
+			log.Printf("Failed to retry %s: %v\n", failed.Url, err)
+		}
+	}()
+	http.Redirect(w, r, adminReturnUrl(r, "/admin/failures"), http.StatusSeeOther)
+}
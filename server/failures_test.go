@@ -0,0 +1,27 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureBackoff(t *testing.T) {
+	s := newServer(DefaultConfig())
+	for _, tc := range []struct {
+		max      time.Duration
+		attempts int
+		want     time.Duration
+	}{
+		{time.Hour, 1, time.Minute},
+		{time.Hour, 3, 4 * time.Minute},
+		{time.Hour, 7, time.Hour},
+		{time.Hour, 1000, time.Hour},
+		// A maximum below --failure-ttl turns backing off off.
+		{0, 3, time.Minute},
+	} {
+		s.currentSettings.Store(&runtimeSettings{failureTtl: time.Minute, maxFailureTtl: tc.max})
+		if got := s.failureBackoff(tc.attempts); got != tc.want {
+			t.Errorf("Wrong backoff after %d attempts with maximum %v. got = %v, want = %v", tc.attempts, tc.max, got, tc.want)
+		}
+	}
+}
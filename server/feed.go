@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const atomNamespace = "http://www.w3.org/2005/Atom"
+
+// How many captures the feed lists.
+const feedEntries = 50
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Id      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// Serves an Atom feed of the most recently cached pages, each linking to its
+// cached copy.
+func (s *Server) handleFeedRequest(w http.ResponseWriter, r *http.Request) {
+	pages, err := s.dsFrom(r.Context()).RecentPages(feedEntries)
+	if err != nil {
+		log.Printf("Failed to list recent pages: %v\n", err)
+		writeError(w, 500, fmt.Sprintf("Internal error: %v", err))
+		return
+	}
+	protocol, host := getProtocol(r), s.getHost(r)
+	feedUrl := fmt.Sprintf("%s://%s/admin/feed.xml", protocol, host)
+	feed := atomFeed{
+		Xmlns: atomNamespace,
+		Id:    feedUrl,
+		Title: fmt.Sprintf("Recently cached on %s", host),
+		// A feed without entries still needs a timestamp.
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: feedUrl, Rel: "self"},
+			{Href: fmt.Sprintf("%s://%s/admin/list/0", protocol, host)},
+		},
+	}
+	for i, page := range pages {
+		cachedUrl, err := translateAbsoluteUrlToCachedUrl(page.Url, protocol, host)
+		if err != nil {
+			log.Printf("failed to get cached URL for %s: %v\n", page.Url, err)
+			continue
+		}
+		updated := page.DownloadFinished.UTC().Format(time.RFC3339)
+		if i == 0 {
+			feed.Updated = updated
+		}
+		title := page.Title
+		if title == "" {
+			title = page.Url
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Id:      cachedUrl,
+			Title:   title,
+			Updated: updated,
+			Link:    atomLink{Href: cachedUrl},
+			Summary: page.Url,
+		})
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(feed); err != nil {
+		log.Printf("Failed to write feed: %v\n", err)
+	}
+}
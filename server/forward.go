@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Request headers that decide which variant of a page an origin sends, so
+// that fetching with the client's makes the cached page the one the client
+// would have been sent.
+var defaultForwardHeaders = []string{"Accept", "Accept-Language", "Sec-CH-UA", "Sec-CH-UA-Mobile", "Sec-CH-UA-Platform"}
+
+// Request headers that knox sets itself, or that would hand the client's
+// credentials to whoever fetches the cached copy.
+var unforwardableHeaders = map[string]bool{
+	"Authorization": true, "Connection": true, "Content-Length": true, "Cookie": true, "Host": true,
+	"If-Match": true, "If-Modified-Since": true, "If-None-Match": true, "If-Range": true,
+	"If-Unmodified-Since": true, "Proxy-Authorization": true, "Range": true, "Te": true,
+	"Transfer-Encoding": true, "Upgrade": true, "User-Agent": true,
+}
+
+type clientHeadersKey struct{}
+
+// Returns ctx carrying the headers to forward for the client that work done
+// with it is on behalf of.
+func withClientHeaders(ctx context.Context, headers http.Header) context.Context {
+	return context.WithValue(ctx, clientHeadersKey{}, headers)
+}
+
+// Returns the headers to forward for the client that work done with ctx is on
+// behalf of, or nil if there is none.
+func clientHeadersFrom(ctx context.Context) http.Header {
+	headers, _ := ctx.Value(clientHeadersKey{}).(http.Header)
+	return headers
+}
+
+func (s *Server) loadForwardHeaders() error {
+	names := s.config.ForwardHeaders
+	if s.config.ForwardDefaultHeaders {
+		names = append(names, defaultForwardHeaders...)
+	}
+	s.forwardHeaders = nil
+	for _, name := range names {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("Bad header name %q", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if unforwardableHeaders[name] {
+			return fmt.Errorf("%s can't be forwarded", name)
+		}
+		s.forwardHeaders = append(s.forwardHeaders, name)
+	}
+	s.upstreamHeaders = http.Header{}
+	for _, header := range s.config.UpstreamHeaders {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Bad upstream header %q", header)
+		}
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("Bad upstream header %q", header)
+		}
+		if name = http.CanonicalHeaderKey(name); unforwardableHeaders[name] && name != "User-Agent" {
+			return fmt.Errorf("%s is set by knox", name)
+		}
+		s.upstreamHeaders.Add(name, value)
+	}
+	return nil
+}
+
+// Marks each request with the headers of its client that fetches on its
+// behalf pass on.
+func (s *Server) withForwardedHeaders(handler http.Handler) http.Handler {
+	if len(s.forwardHeaders) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded := http.Header{}
+		for _, name := range s.forwardHeaders {
+			if values := r.Header.Values(name); len(values) != 0 {
+				forwarded[name] = values
+			}
+		}
+		if len(forwarded) != 0 {
+			r = r.WithContext(withClientHeaders(r.Context(), forwarded))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Adds the client's forwarded headers and the upstream headers to a fetch
+// done with ctx, leaving any that req has already, e.g. those of a captured
+// request, alone.
+func (s *Server) setUpstreamHeaders(ctx context.Context, req *http.Request) {
+	for name, values := range clientHeadersFrom(ctx) {
+		if len(req.Header.Values(name)) == 0 {
+			req.Header[name] = values
+		}
+	}
+	for name, values := range s.upstreamHeaders {
+		if len(req.Header.Values(name)) == 0 {
+			req.Header[name] = values
+		}
+	}
+}
+
+// Returns the headers of req that say which variant of a resource was
+// fetched: its User-Agent, and those that are forwarded or configured. The
+// rest, like cookies, aren't worth keeping or shouldn't be kept.
+func (s *Server) recordedRequestHeaders(req *http.Request) http.Header {
+	recorded := http.Header{}
+	record := func(name string) {
+		if values := req.Header.Values(name); len(values) != 0 {
+			recorded[name] = values
+		}
+	}
+	record("User-Agent")
+	for _, name := range s.forwardHeaders {
+		record(name)
+	}
+	for name := range s.upstreamHeaders {
+		record(name)
+	}
+	return recorded
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestLoadForwardHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		forward  []string
+		upstream []string
+		ok       bool
+	}{
+		{[]string{"dnt"}, []string{"Accept-Language: de-DE"}, true},
+		{nil, []string{"User-Agent: archiver"}, true},
+		{[]string{"Cookie"}, nil, false},
+		{[]string{"User-Agent"}, nil, false},
+		{[]string{"bad header"}, nil, false},
+		{nil, []string{"Accept-Language"}, false},
+		{nil, []string{"Range: bytes=0-"}, false},
+	} {
+		c := DefaultConfig()
+		c.ForwardHeaders = tc.forward
+		c.UpstreamHeaders = tc.upstream
+		s := newServer(c)
+		if err := s.loadForwardHeaders(); (err == nil) != tc.ok {
+			t.Errorf("Wrong result for %v and %v. got = %v, want ok = %v", tc.forward, tc.upstream, err, tc.ok)
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	c := DefaultConfig()
+	c.ForwardHeaders = []string{"dnt"}
+	c.UpstreamHeaders = []string{"Accept-Language: de-DE", "X-Archive: knox"}
+	s := newServer(c)
+	if err := s.loadForwardHeaders(); err != nil {
+		t.Fatalf("Failed to load forwarded headers: %v", err)
+	}
+
+	var ctx context.Context
+	handler := s.withForwardedHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = detachSpan(r.Context())
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Language", "fr-CH, fr;q=0.9")
+	r.Header.Set("DNT", "1")
+	r.Header.Set("Cookie", "session=secret")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	// Headers a captured request has already are left alone.
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Archive", "captured")
+	req.Header.Set("User-Agent", "test")
+	s.setUpstreamHeaders(ctx, req)
+	want := http.Header{
+		"Accept-Language": {"fr-CH, fr;q=0.9"},
+		"Dnt":             {"1"},
+		"X-Archive":       {"captured"},
+		"User-Agent":      {"test"},
+	}
+	if !reflect.DeepEqual(req.Header, want) {
+		t.Errorf("Wrong upstream headers. got = %v, want = %v", req.Header, want)
+	}
+	req.Header.Set("Cookie", "other=secret")
+	if got := s.recordedRequestHeaders(req); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong recorded headers. got = %v, want = %v", got, want)
+	}
+
+	// Without a client, the upstream headers stand in for the client's.
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	s.setUpstreamHeaders(context.Background(), req)
+	if got := req.Header.Get("Accept-Language"); got != "de-DE" {
+		t.Errorf("Wrong Accept-Language without a client. got = %q", got)
+	}
+}
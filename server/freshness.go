@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The lifetime of a resource its origin says never changes.
+const foreverLifetime = time.Duration(math.MaxInt64)
+
+// Returns how long a response with headers stays fresh according to its
+// Cache-Control and Expires headers, and false if it has neither. Responses
+// without a Date are taken to have been sent at capturedAt.
+func originLifetime(headers http.Header, capturedAt time.Time) (time.Duration, bool) {
+	var maxAge, sharedMaxAge *time.Duration
+	immutable := false
+	for _, value := range headers.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+			name := strings.ToLower(parts[0])
+			switch name {
+			case "no-store", "no-cache":
+				return 0, true
+			case "immutable":
+				immutable = true
+			case "max-age", "s-maxage":
+				if len(parts) != 2 {
+					continue
+				}
+				seconds, err := strconv.ParseInt(strings.Trim(parts[1], `"`), 10, 64)
+				if err != nil || seconds < 0 {
+					// Caches are to treat bad ages as stale.
+					seconds = 0
+				}
+				age := time.Duration(seconds) * time.Second
+				if seconds > int64(foreverLifetime/time.Second) {
+					age = foreverLifetime
+				}
+				if name == "max-age" {
+					maxAge = &age
+				} else {
+					sharedMaxAge = &age
+				}
+			}
+		}
+	}
+	if immutable {
+		return foreverLifetime, true
+	}
+	var lifetime time.Duration
+	switch {
+	case sharedMaxAge != nil:
+		lifetime = *sharedMaxAge
+	case maxAge != nil:
+		lifetime = *maxAge
+	case headers.Get("Expires") != "":
+		expires, err := http.ParseTime(headers.Get("Expires"))
+		if err != nil {
+			// Including "0", which means already expired.
+			return 0, true
+		}
+		date, err := http.ParseTime(headers.Get("Date"))
+		if err != nil {
+			date = capturedAt
+		}
+		if lifetime = expires.Sub(date); lifetime < 0 {
+			lifetime = 0
+		}
+	default:
+		return 0, false
+	}
+	// Time spent in caches between the origin and knox counts too.
+	if age, err := strconv.ParseInt(headers.Get("Age"), 10, 64); err == nil && age > 0 && lifetime != foreverLifetime {
+		if lifetime -= time.Duration(age) * time.Second; lifetime < 0 {
+			lifetime = 0
+		}
+	}
+	return lifetime, true
+}
+
+// Clamps an origin's lifetime to between --origin-ttl-min and
+// --origin-ttl-max, returning it as a TTL.
+func (s *Server) clampOriginTtl(lifetime time.Duration) time.Duration {
+	settings := s.settings()
+	if lifetime < settings.originTtlMin {
+		return settings.originTtlMin
+	}
+	if settings.originTtlMax != 0 && lifetime > settings.originTtlMax {
+		return settings.originTtlMax
+	}
+	if lifetime == foreverLifetime {
+		return 0
+	}
+	return lifetime
+}
+
+// Returns how long the resource at encodedUrl, captured at capturedAt with
+// options, is served before it is fetched again: the TTL it was captured
+// with, else the one its origin sent under --honor-origin-cache-control,
+// else --resource-ttl. Zero means forever.
+func (s *Server) resourceTtlOf(ctx context.Context, encodedUrl string, options captureOptions, capturedAt time.Time) time.Duration {
+	if options.Ttl != nil || !s.settings().honorOriginCacheControl {
+		return options.ttl(s.settings().resourceTtl)
+	}
+	stored, filtered, err := s.dsFrom(ctx).StoredHeaders(encodedUrl)
+	if err != nil {
+		log.Printf("Failed to read headers of %s, using --resource-ttl: %v\n", encodedUrl, err)
+		return options.ttl(s.settings().resourceTtl)
+	}
+	// The store rules drop some of what the origin sent, Date among them.
+	headers := stored.Clone()
+	for name, values := range *filtered {
+		headers[name] = values
+	}
+	if lifetime, ok := originLifetime(headers, capturedAt); ok {
+		return s.clampOriginTtl(lifetime)
+	}
+	return options.ttl(s.settings().resourceTtl)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOriginLifetime(t *testing.T) {
+	capturedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		headers  http.Header
+		lifetime time.Duration
+		ok       bool
+	}{
+		{http.Header{}, 0, false},
+		{http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute, true},
+		{http.Header{"Cache-Control": {`max-age="60", s-maxage=600`}}, 10 * time.Minute, true},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40 * time.Second, true},
+		{http.Header{"Cache-Control": {"Max-Age=31536000, Immutable"}}, foreverLifetime, true},
+		{http.Header{"Cache-Control": {"max-age=60", "no-cache"}}, 0, true},
+		{http.Header{"Cache-Control": {"max-age=soon"}}, 0, true},
+		{http.Header{"Expires": {"Mon, 01 Jan 2024 01:00:00 GMT"}}, time.Hour, true},
+		{http.Header{"Expires": {"Mon, 01 Jan 2024 01:00:00 GMT"}, "Date": {"Mon, 01 Jan 2024 00:30:00 GMT"}}, 30 * time.Minute, true},
+		{http.Header{"Expires": {"0"}}, 0, true},
+		{http.Header{"Cache-Control": {"private"}}, 0, false},
+	} {
+		lifetime, ok := originLifetime(tc.headers, capturedAt)
+		if lifetime != tc.lifetime || ok != tc.ok {
+			t.Errorf("Wrong lifetime for %v. got = %v, %v, want = %v, %v", tc.headers, lifetime, ok, tc.lifetime, tc.ok)
+		}
+	}
+}
+
+func TestClampOriginTtl(t *testing.T) {
+	c := DefaultConfig()
+	c.HonorOriginCacheControl = true
+	c.OriginTtlMin = time.Minute
+	for _, tc := range []struct {
+		max      time.Duration
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{0, 0, time.Minute},
+		{0, time.Hour, time.Hour},
+		{0, foreverLifetime, 0},
+		{time.Hour, 2 * time.Hour, time.Hour},
+		{time.Hour, foreverLifetime, time.Hour},
+	} {
+		c.OriginTtlMax = tc.max
+		settings, err := newRuntimeSettings(c)
+		if err != nil {
+			t.Fatalf("Failed to make settings: %v", err)
+		}
+		s := newServer(c)
+		s.currentSettings.Store(settings)
+		if got := s.clampOriginTtl(tc.lifetime); got != tc.want {
+			t.Errorf("Wrong TTL for %v with maximum %v. got = %v, want = %v", tc.lifetime, tc.max, got, tc.want)
+		}
+	}
+	c.OriginTtlMax = time.Second
+	if _, err := newRuntimeSettings(c); err == nil {
+		t.Errorf("Expected a maximum below the minimum to be refused.")
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gnossen/knoxcache/api"
+	"github.com/gnossen/knoxcache/datastore"
+	"github.com/gnossen/knoxcache/hostfilter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Size of the body chunks streamed by Open.
+const openChunkBytes = 64 * 1024
+
+const defaultGrpcListCount = 25
+
+var resourceStates = map[datastore.ResourceStatus]api.ResourceState{
+	datastore.ResourceNotCached:   api.ResourceState_NOT_CACHED,
+	datastore.ResourceDownloading: api.ResourceState_DOWNLOADING,
+	datastore.ResourceCached:      api.ResourceState_CACHED,
+	datastore.ResourceFailed:      api.ResourceState_FAILED,
+}
+
+// Serves the API from the caches of the Server it embeds.
+type knoxServer struct {
+	api.UnimplementedKnoxServer
+	*Server
+}
+
+// Normalizes and encodes a requested URL the same way the HTTP endpoints do.
+func (s *Server) resolveRequestedUrl(rawUrl string) (string, string, error) {
+	normalizedUrl, err := s.urlNormalizer.Normalize(rawUrl)
+	if err != nil {
+		return "", "", status.Errorf(codes.InvalidArgument, "could not normalize url '%s': %v", rawUrl, err)
+	}
+	encodedUrl, err := encoder.Encode(normalizedUrl)
+	if err != nil {
+		return "", "", status.Errorf(codes.InvalidArgument, "could not interpret url '%s': %v", rawUrl, err)
+	}
+	return encodedUrl, normalizedUrl, nil
+}
+
+// Translates the errors from caching a resource into gRPC status codes.
+func cacheErrorStatus(err error) error {
+	var blocked hostfilter.BlockedError
+	var failure datastore.FetchFailure
+	if errors.Is(err, errReadOnly) {
+		return status.Error(codes.NotFound, err.Error())
+	} else if errors.Is(err, errMaintenance) {
+		return status.Error(codes.Unavailable, err.Error())
+	} else if errors.Is(err, errInsufficientStorage) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	} else if errors.As(err, &blocked) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	} else if errors.As(err, &failure) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Errorf(codes.Internal, "internal error: %v", err)
+}
+
+func newFetchFailureProto(failure *datastore.FetchFailure) *api.FetchFailure {
+	if failure == nil {
+		return nil
+	}
+	return &api.FetchFailure{
+		Reason:     failure.Reason,
+		FailedAt:   timestamppb.New(failure.FailedAt),
+		RetryAfter: timestamppb.New(failure.RetryAfter),
+	}
+}
+
+func optionalTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func (s *Server) resourceStatus(ctx context.Context, encodedUrl, normalizedUrl string) (*api.ResourceStatus, error) {
+	progress, err := s.dsFrom(ctx).Progress(encodedUrl)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "internal error: %v", err)
+	}
+	return &api.ResourceStatus{
+		Url:             normalizedUrl,
+		State:           resourceStates[progress.Status],
+		DownloadStarted: optionalTimestamp(progress.DownloadStarted),
+		RawBytes:        int64(progress.RawBytes),
+		Protocol:        progress.Protocol,
+		Failure:         newFetchFailureProto(progress.Failure),
+		RefreshFailure:  newFetchFailureProto(progress.RefreshFailure),
+	}, nil
+}
+
+func (s *knoxServer) GetStatus(ctx context.Context, req *api.GetStatusRequest) (*api.ResourceStatus, error) {
+	encodedUrl, normalizedUrl, err := s.resolveRequestedUrl(req.Url)
+	if err != nil {
+		return nil, err
+	}
+	return s.resourceStatus(ctx, encodedUrl, normalizedUrl)
+}
+
+func (s *knoxServer) Create(ctx context.Context, req *api.CreateRequest) (*api.ResourceStatus, error) {
+	encodedUrl, normalizedUrl, err := s.resolveRequestedUrl(req.Url)
+	if err != nil {
+		return nil, err
+	}
+	f, _, err := s.openCachedPage(ctx, encodedUrl, normalizedUrl, req.UserAgent)
+	if err != nil {
+		return nil, cacheErrorStatus(err)
+	}
+	f.Close()
+	return s.resourceStatus(ctx, encodedUrl, normalizedUrl)
+}
+
+func (s *knoxServer) Open(req *api.OpenRequest, stream api.Knox_OpenServer) error {
+	encodedUrl, normalizedUrl, err := s.resolveRequestedUrl(req.Url)
+	if err != nil {
+		return err
+	}
+	f, _, err := s.openCachedPage(stream.Context(), encodedUrl, normalizedUrl, req.UserAgent)
+	if err != nil {
+		return cacheErrorStatus(err)
+	}
+	defer f.Close()
+
+	headers := &api.ResourceHeaders{
+		ContentHash: f.ContentHash(),
+		CapturedAt:  optionalTimestamp(f.CapturedAt()),
+	}
+	names := []string{}
+	for name := range *f.Headers() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers.Headers = append(headers.Headers, &api.Header{Name: name, Values: (*f.Headers())[name]})
+	}
+	if err := stream.Send(&api.OpenResponse{Part: &api.OpenResponse_Headers{Headers: headers}}); err != nil {
+		return err
+	}
+	buf := make([]byte, openChunkBytes)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&api.OpenResponse{Part: &api.OpenResponse_Chunk{Chunk: buf[:n]}}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return status.Errorf(codes.Internal, "failed to read resource: %v", err)
+		}
+	}
+}
+
+func (s *knoxServer) List(ctx context.Context, req *api.ListRequest) (*api.ListResponse, error) {
+	count := int(req.Count)
+	if count <= 0 {
+		count = defaultGrpcListCount
+	}
+	if req.Offset < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset must not be negative")
+	}
+	ri, err := s.dsFrom(ctx).List(int(req.Offset), count)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "internal error: %v", err)
+	}
+	resp := &api.ListResponse{}
+	for ri.HasNext() {
+		rm, err := ri.Next()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "internal error: %v", err)
+		}
+		resp.Resources = append(resp.Resources, &api.ResourceMetadata{
+			Url:              rm.Url,
+			DownloadStarted:  optionalTimestamp(rm.DownloadStarted),
+			DownloadDuration: durationpb.New(rm.DownloadDuration),
+			RawBytes:         int64(rm.RawBytes),
+			BytesOnDisk:      int64(rm.BytesOnDisk),
+			AccessCount:      rm.AccessCount,
+			LastAccessed:     optionalTimestamp(rm.LastAccessed),
+			Protocol:         rm.Protocol,
+		})
+	}
+	return resp, nil
+}
+
+func (s *knoxServer) GetStats(ctx context.Context, req *api.GetStatsRequest) (*api.Stats, error) {
+	stats, err := s.dsFrom(ctx).Stats()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "internal error: %v", err)
+	}
+	return &api.Stats{
+		RecordCount:          stats.RecordCount,
+		DiskConsumptionBytes: int64(stats.DiskConsumptionBytes),
+		Hits:                 stats.Hits,
+		Misses:               stats.Misses,
+		CircuitBreakers:      s.circuitBreakerStats(),
+	}, nil
+}
+
+func (s *Server) circuitBreakerStats() []*api.CircuitBreaker {
+	if s.upstreamBreakers == nil {
+		return nil
+	}
+	return s.upstreamBreakers.snapshot(time.Now())
+}
+
+func (s *knoxServer) Delete(ctx context.Context, req *api.DeleteRequest) (*api.DeleteResponse, error) {
+	if s.config.ReadOnly {
+		return nil, status.Error(codes.PermissionDenied, errReadOnly.Error())
+	}
+	encodedUrl, normalizedUrl, err := s.resolveRequestedUrl(req.Url)
+	if err != nil {
+		return nil, err
+	}
+	err = s.dsFrom(ctx).Delete(encodedUrl)
+	if errors.Is(err, datastore.ErrResourceNotCached) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if errors.Is(err, datastore.ErrResourceBusy) || errors.Is(err, datastore.ErrResourceHeld) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "internal error: %v", err)
+	}
+	log.Printf("Deleted %s\n", req.Url)
+	s.publishEvent(ctx, eventDeleted, encodedUrl, normalizedUrl, nil)
+	return &api.DeleteResponse{}, nil
+}
+
+// Returns a gRPC server for the API, serving the same caches as s.
+func (s *Server) NewGrpcServer() *grpc.Server {
+	srv := grpc.NewServer()
+	api.RegisterKnoxServer(srv, &knoxServer{Server: s})
+	return srv
+}
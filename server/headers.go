@@ -0,0 +1,161 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gnossen/knoxcache/datastore"
+	"github.com/gnossen/knoxcache/headerfilter"
+)
+
+// Applies the store rules to the headers of a response from host, and
+// returns the headers they dropped or replaced, as the origin sent them.
+func (s *Server) applyStoreRules(host string, header http.Header) http.Header {
+	original := header.Clone()
+	s.settings().headerFilter.Apply(headerfilter.Store, host, header)
+	filtered := http.Header{}
+	for key, values := range original {
+		if !reflect.DeepEqual(header[key], values) {
+			filtered[key] = values
+		}
+	}
+	return filtered
+}
+
+type requestHeaderRow struct {
+	Name  string
+	Value string
+}
+
+type storedHeaderRow struct {
+	Name  string
+	Value string
+	// What happens to the header when the resource is served.
+	Served string
+}
+
+type filteredHeaderRow struct {
+	Name  string
+	Value string
+	// Whether the header was dropped or replaced, and by which rule if it
+	// still exists.
+	Change string
+}
+
+type adminHeadersData struct {
+	Url       string
+	CachedUrl string
+	Request   []requestHeaderRow
+	Stored    []storedHeaderRow
+	Filtered  []filteredHeaderRow
+}
+
+func sortedHeaderKeys(header http.Header) []string {
+	var keys []string
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Describes the rule for header, if there is one.
+func (s *Server) describeRule(stage headerfilter.Stage, host, header string) string {
+	r, ok := s.settings().headerFilter.Match(stage, host, header)
+	if !ok {
+		return ""
+	}
+	text := strings.TrimSpace(fmt.Sprintf("%s %s %s %s %s", r.Stage, r.Host, r.Header, r.Action, r.Value))
+	return fmt.Sprintf(" by \"%s\" (%s)", text, r.Source)
+}
+
+// Shows the response headers stored for a resource and what is done to each
+// when it is served, along with the headers that were dropped or replaced
+// before it was stored and the request headers it was fetched with.
+func (s *Server) handleAdminHeadersRequest(w http.ResponseWriter, r *http.Request) {
+	encodedUrl := strings.TrimPrefix(r.URL.Path, "/admin/headers/")
+	decodedUrl, err := encoder.Decode(encodedUrl)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl))
+		return
+	}
+	stored, filtered, err := s.dsFrom(r.Context()).StoredHeaders(encodedUrl)
+	if errors.Is(err, datastore.ErrResourceNotCached) {
+		writeError(w, 404, "Resource is not cached.")
+		return
+	} else if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	request, err := s.dsFrom(r.Context()).RequestHeaders(encodedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	host := ""
+	if parsedUrl, err := url.Parse(keyUrl(decodedUrl)); err == nil {
+		host = parsedUrl.Hostname()
+	}
+	// The same steps as serving the resource.
+	served := stored.Clone()
+	s.settings().headerFilter.Apply(headerfilter.Serve, host, served)
+	s.transformCspHeaders(served)
+
+	data := adminHeadersData{Url: decodedUrl}
+	data.CachedUrl, _ = translateAbsoluteUrlToCachedUrl(decodedUrl, getProtocol(r), s.getHost(r))
+	for _, key := range sortedHeaderKeys(*request) {
+		for _, value := range (*request)[key] {
+			data.Request = append(data.Request, requestHeaderRow{key, value})
+		}
+	}
+	for _, key := range sortedHeaderKeys(*stored) {
+		servedValues, ok := served[key]
+		for i, value := range (*stored)[key] {
+			row := storedHeaderRow{Name: key, Value: value, Served: "Sent"}
+			if !ok {
+				row.Served = "Dropped" + s.describeRule(headerfilter.Serve, host, key)
+			} else if len(servedValues) != len((*stored)[key]) {
+				// Some of the values were dropped, e.g. some of the cookies.
+				if !containsString(servedValues, value) {
+					row.Served = "Dropped" + s.describeRule(headerfilter.Serve, host, key)
+				}
+			} else if servedValues[i] != value {
+				row.Served = "Sent as " + servedValues[i] + s.describeRule(headerfilter.Serve, host, key)
+			}
+			data.Stored = append(data.Stored, row)
+		}
+	}
+	for _, key := range sortedHeaderKeys(served) {
+		if _, ok := (*stored)[key]; ok {
+			continue
+		}
+		for _, value := range served[key] {
+			data.Stored = append(data.Stored, storedHeaderRow{key, "", "Added as " + value + s.describeRule(headerfilter.Serve, host, key)})
+		}
+	}
+	for _, key := range sortedHeaderKeys(*filtered) {
+		change := "Dropped"
+		if _, ok := (*stored)[key]; ok {
+			change = "Replaced"
+		}
+		change += s.describeRule(headerfilter.Store, host, key)
+		for _, value := range (*filtered)[key] {
+			data.Filtered = append(data.Filtered, filteredHeaderRow{key, value, change})
+		}
+	}
+	s.renderPage(w, 200, "admin_headers.html", data)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+// Places the resource under legal hold if the form's held field is true and
+// releases it otherwise, then goes back to the admin page it was sent from.
+// Holds are only ever changed here, so that only those allowed on the admin
+// pages can release them; the API just reports them.
+func (s *Server) handleAdminHoldRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, 405, "Method not allowed.")
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeError(w, 403, "Cross-site requests are not allowed.")
+		return
+	}
+	prefix := "/admin/hold/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, 400, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	encodedUrl := r.URL.Path[len(prefix):]
+	decodedUrl, err := encoder.Decode(encodedUrl)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl))
+		return
+	}
+	held, err := strconv.ParseBool(r.FormValue("held"))
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Bad held value '%s'", r.FormValue("held")))
+		return
+	}
+	err = s.dsFrom(r.Context()).SetHold(encodedUrl, held)
+	if errors.Is(err, datastore.ErrResourceNotCached) {
+		writeError(w, 404, "Resource is not cached.")
+		return
+	} else if errors.Is(err, datastore.ErrResourceBusy) {
+		writeError(w, 409, "Resource is being downloaded. Try again once it's done.")
+		return
+	} else if err != nil {
+		writeError(w, 500, fmt.Sprintf("Failed to change hold: %v", err))
+		return
+	}
+	if held {
+		log.Printf("Placed %s under legal hold\n", decodedUrl)
+	} else {
+		log.Printf("Released %s from legal hold\n", decodedUrl)
+	}
+	http.Redirect(w, r, adminReturnUrl(r, "/admin/list/0"), http.StatusSeeOther)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"plugin"
+
+	"github.com/gnossen/knoxcache/datastore"
+	"golang.org/x/net/html"
+)
+
+// Called with every request to an origin, including those made while
+// following redirects or rendering a page, before it is sent. It may modify
+// the request. Returning an error refuses the fetch.
+type BeforeFetchHook func(req *http.Request) error
+
+// Called with every response from an origin before its body is read. It may
+// modify the response's headers. Returning an error refuses to cache it.
+type AfterFetchHook func(resp *http.Response) error
+
+// Called with every cached page as it is served, after its links have been
+// rewritten to point into the cache, so that it can be modified in place.
+// Returning an error fails the request.
+type TransformHook func(doc *html.Node, pageUrl *url.URL) error
+
+// Wraps the handler serving every request to knox, e.g. to check that the
+// client is allowed in.
+type ServeHook func(next http.Handler) http.Handler
+
+// Hooks run in the order they were registered and must be registered before
+// New is called, e.g. from the init function of a package or plugin.
+var beforeFetchHooks []BeforeFetchHook
+var afterFetchHooks []AfterFetchHook
+var transformHooks []TransformHook
+var serveHooks []ServeHook
+
+func OnBeforeFetch(hook BeforeFetchHook) {
+	beforeFetchHooks = append(beforeFetchHooks, hook)
+}
+
+func OnAfterFetch(hook AfterFetchHook) {
+	afterFetchHooks = append(afterFetchHooks, hook)
+}
+
+func OnTransform(hook TransformHook) {
+	transformHooks = append(transformHooks, hook)
+}
+
+func OnServe(hook ServeHook) {
+	serveHooks = append(serveHooks, hook)
+}
+
+// Opens each Go plugin, which registers its hooks when initialized. Plugins
+// have to be built against the same version of this package.
+func loadPlugins(paths []string) error {
+	for _, path := range paths {
+		if _, err := plugin.Open(path); err != nil {
+			return fmt.Errorf("failed to load plugin %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Runs the fetch hooks around each round trip to an origin.
+type hookTransport struct {
+	next http.RoundTripper
+}
+
+func (t hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(beforeFetchHooks) != 0 {
+		// Round trippers mustn't modify the caller's request.
+		req = req.Clone(req.Context())
+	}
+	for _, hook := range beforeFetchHooks {
+		if err := hook(req); err != nil {
+			return nil, fmt.Errorf("%w: %v", datastore.ErrRefused, err)
+		}
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range afterFetchHooks {
+		if err := hook(resp); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w: %v", datastore.ErrRefused, err)
+		}
+	}
+	return resp, nil
+}
+
+func runTransformHooks(doc *html.Node, pageUrl *url.URL) error {
+	for _, hook := range transformHooks {
+		if err := hook(doc, pageUrl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wraps handler so that the first serve hook registered sees requests first.
+func wrapServeHooks(handler http.Handler) http.Handler {
+	for i := len(serveHooks) - 1; i >= 0; i-- {
+		handler = serveHooks[i](handler)
+	}
+	return handler
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gnossen/knoxcache/datastore"
+	"golang.org/x/net/html"
+)
+
+func TestFetchHooks(t *testing.T) {
+	defer func() {
+		beforeFetchHooks = nil
+		afterFetchHooks = nil
+	}()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(401)
+		}
+		if r.URL.Path == "/tracker.js" {
+			w.Header().Set("Content-Type", "application/javascript")
+		}
+		io.WriteString(w, "body")
+	}))
+	defer origin.Close()
+	OnBeforeFetch(func(req *http.Request) error {
+		if strings.HasPrefix(req.URL.Path, "/private/") {
+			return errors.New("private")
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		return nil
+	})
+	OnAfterFetch(func(resp *http.Response) error {
+		if resp.Header.Get("Content-Type") == "application/javascript" {
+			return errors.New("no scripts")
+		}
+		resp.Header.Set("X-Checked", "yes")
+		return nil
+	})
+	client := &http.Client{Transport: hookTransport{http.DefaultTransport}}
+
+	req, _ := http.NewRequest("GET", origin.URL+"/page", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("X-Checked") != "yes" {
+		t.Errorf("Expected hooks to modify the request and response. got = %d, %v", resp.StatusCode, resp.Header)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("Expected the caller's request to be left alone.")
+	}
+
+	for _, path := range []string{"/private/page", "/tracker.js"} {
+		if _, err := client.Get(origin.URL + path); !errors.Is(err, datastore.ErrRefused) {
+			t.Errorf("Expected %s to be refused. got = %v", path, err)
+		}
+	}
+}
+
+func TestTransformHooks(t *testing.T) {
+	defer func() { transformHooks = nil }()
+	OnTransform(func(doc *html.Node, pageUrl *url.URL) error {
+		var visit func(node *html.Node)
+		visit = func(node *html.Node) {
+			for c := node.FirstChild; c != nil; {
+				next := c.NextSibling
+				if c.Type == html.ElementNode && c.Data == "aside" {
+					node.RemoveChild(c)
+				} else {
+					visit(c)
+				}
+				c = next
+			}
+		}
+		visit(doc)
+		return nil
+	})
+	s := newServer(DefaultConfig())
+	pageUrl, _ := url.Parse("http://example.com/page")
+	var out bytes.Buffer
+	page := `<html><body><p>kept</p><aside>ad</aside><a href="/other">link</a></body></html>`
+	if err := s.transformHtml(pageUrl, strings.NewReader(page), &out, "http", "localhost:8080"); err != nil {
+		t.Fatalf("Failed to transform: %v", err)
+	}
+	if strings.Contains(out.String(), "aside") || !strings.Contains(out.String(), "kept") {
+		t.Errorf("Expected hook to scrub the page. got = %s", out.String())
+	}
+	if !strings.Contains(out.String(), "http://localhost:8080/c/") {
+		t.Errorf("Expected hook to run alongside link rewriting. got = %s", out.String())
+	}
+
+	OnTransform(func(doc *html.Node, pageUrl *url.URL) error {
+		return errors.New("broken")
+	})
+	if err := s.transformHtml(pageUrl, strings.NewReader(page), io.Discard, "http", "localhost:8080"); err == nil {
+		t.Errorf("Expected a failing hook to fail the transform.")
+	}
+}
+
+func TestServeHooks(t *testing.T) {
+	defer func() { serveHooks = nil }()
+	var order []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		OnServe(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				if r.Header.Get("X-Token") == "" {
+					http.Error(w, "Forbidden", 403)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+	handler := wrapServeHooks(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/list/0", nil))
+	if w.Code != 403 || strings.Join(order, ",") != "first" {
+		t.Errorf("Expected first hook to refuse the request. got = %d, %v", w.Code, order)
+	}
+
+	order = nil
+	req := httptest.NewRequest("GET", "/admin/list/0", nil)
+	req.Header.Set("X-Token", "token")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if strings.Join(order, ",") != "first,second,handler" {
+		t.Errorf("Wrong order. got = %v", order)
+	}
+}
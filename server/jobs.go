@@ -0,0 +1,993 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+	enc "github.com/gnossen/knoxcache/encoder"
+)
+
+// The kinds of job, each caching or refreshing its items in its own way.
+const (
+	// Caches a single URL.
+	jobUrl = "url"
+
+	// Caches a list of URLs, like those from /api/v1/cache:batch.
+	jobBatch = "batch"
+
+	// Caches a page and the pages within its scope that it links to, and
+	// those they link to, up to a depth.
+	jobCrawl = "crawl"
+
+	// Refreshes the cached resources matching a filter, listed when the job
+	// starts.
+	jobRefresh = "refresh"
+)
+
+// How often the queue is checked for jobs that are due.
+const jobPollInterval = time.Second
+
+// The most jobs each cache runs at once.
+const maxRunningJobs = 2
+
+// How often a running job's lease is renewed, well within the datastore's
+// lease duration.
+const jobLeaseRenewInterval = 10 * time.Second
+
+// The deepest a crawl may go, and the most pages it may visit by default
+// and in all.
+const maxCrawlDepth = 5
+const defaultCrawlPages = 100
+const maxCrawlPages = 1000
+
+// The most resources a refresh job may refresh.
+const maxRefreshItems = 10000
+
+// How many resources are listed at a time while filling in a refresh job.
+const refreshListPageSize = 500
+
+const maxJobsPerPage = 100
+const maxJobItemsPerPage = 100
+
+// How many of the last lines of a job's log are shown.
+const jobLogLines = 100
+
+// What a job was asked to do besides which URLs to cache.
+type jobParams struct {
+	// For crawls, how many links away from the first page to follow, and
+	// the most pages to visit in all.
+	Depth    int `json:"depth,omitempty"`
+	MaxPages int `json:"max_pages,omitempty"`
+
+	// For crawls, which links to follow: those to the same host, or with
+	// scope "domain" to the same registrable domain, whose paths start
+	// with path_prefix, that match an include pattern if there are any and
+	// no exclude pattern. And how many bytes to download at most before
+	// the pages left are skipped.
+	Scope      string   `json:"scope,omitempty"`
+	PathPrefix string   `json:"path_prefix,omitempty"`
+	Include    []string `json:"include,omitempty"`
+	Exclude    []string `json:"exclude,omitempty"`
+	MaxBytes   int      `json:"max_bytes,omitempty"`
+
+	// For refreshes, the host and media type of the resources to refresh,
+	// written like the filters of /admin/list, and how long ago they must
+	// have been captured, written like a --retention age.
+	Host        string `json:"host,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	OlderThan   string `json:"older_than,omitempty"`
+}
+
+// Kept with a job as its datastore.Job.Spec.
+type jobSpec struct {
+	jobParams
+
+	// Of the client that asked for the job, so that it is fetched on their
+	// behalf even once they're gone.
+	UserAgent string      `json:"user_agent,omitempty"`
+	Header    http.Header `json:"header,omitempty"`
+}
+
+func parseJobSpec(encoded string) (jobSpec, error) {
+	var spec jobSpec
+	if encoded == "" {
+		return spec, nil
+	}
+	err := json.Unmarshal([]byte(encoded), &spec)
+	return spec, err
+}
+
+func (s *Server) wakeJobRunner() {
+	select {
+	case s.jobsQueued <- struct{}{}:
+	default:
+	}
+}
+
+// Why a running job was stopped before it was done.
+type jobStop int
+
+const (
+	jobNotStopped jobStop = iota
+	jobStopCancelled
+	jobStopPaused
+	jobStopShutDown
+	jobStopLeaseLost
+)
+
+type runningJobKey struct {
+	host string
+	id   uint
+}
+
+// Stops the job if it is running here. Returns false if it isn't.
+func (s *Server) stopRunningJob(ctx context.Context, id uint, why jobStop) bool {
+	s.runningJobsMu.Lock()
+	stop, ok := s.runningJobs[runningJobKey{virtualHostFrom(ctx), id}]
+	s.runningJobsMu.Unlock()
+	if ok {
+		stop(why)
+	}
+	return ok
+}
+
+// Records message in the log of a job, and in knox's.
+func (s *Server) logJob(ctx context.Context, id uint, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("Job %d: %s\n", id, message)
+	if err := s.dsFrom(ctx).AppendJobLog(id, message); err != nil {
+		log.Printf("Failed to write to the log of job %d: %v\n", id, err)
+	}
+}
+
+func (s *Server) runJobsPeriodically() {
+	defer s.backgroundWork.Done()
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	var running sync.WaitGroup
+	defer running.Wait()
+	slots := map[string]chan struct{}{}
+	for _, ctx := range s.cacheContexts() {
+		slots[virtualHostFrom(ctx)] = make(chan struct{}, maxRunningJobs)
+	}
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.jobsQueued:
+		case <-s.stopBackground:
+			return
+		}
+		// Jobs that are running carry on, but none are started.
+		if s.inMaintenance() {
+			continue
+		}
+		for _, ctx := range s.cacheContexts() {
+			s.startDueJobs(ctx, slots[virtualHostFrom(ctx)], &running)
+		}
+	}
+}
+
+// Claims the due jobs of the cache ctx is for and runs them, while fewer
+// than maxRunningJobs of them are running.
+func (s *Server) startDueJobs(ctx context.Context, slots chan struct{}, running *sync.WaitGroup) {
+	for {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return
+		}
+		j, err := s.dsFrom(ctx).ClaimJob()
+		if err != nil || j == nil {
+			<-slots
+			if err != nil {
+				log.Printf("Failed to look for jobs to run: %v\n", err)
+			}
+			return
+		}
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer func() { <-slots }()
+			s.runJob(ctx, *j)
+		}()
+	}
+}
+
+// Works through the items of a claimed job a few at a time until they're
+// all done or the job is stopped. A job stopped because knox is shutting
+// down is put back in the queue to carry on with when it starts again.
+func (s *Server) runJob(ctx context.Context, j datastore.Job) {
+	store := s.dsFrom(ctx)
+	spec, err := parseJobSpec(j.Spec)
+	if err != nil {
+		s.endJob(ctx, j.Id, datastore.JobFailed, fmt.Sprintf("Bad job spec: %v", err))
+		return
+	}
+	ctx = withClientHeaders(ctx, spec.Header)
+	ctx = withDownloadPriority(ctx, backgroundPriority)
+	// Stopping the job gives up on the downloads it is in the middle of.
+	ctx = withAbortableDownloads(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	stopped := jobNotStopped
+	stop := func(why jobStop) {
+		mu.Lock()
+		// Cancelling wins over pausing or shutting down, which would only
+		// have the job carried on with later.
+		if stopped == jobNotStopped || (why == jobStopCancelled && stopped != jobStopLeaseLost) {
+			stopped = why
+		}
+		mu.Unlock()
+		cancel()
+	}
+	key := runningJobKey{virtualHostFrom(ctx), j.Id}
+	s.runningJobsMu.Lock()
+	s.runningJobs[key] = stop
+	s.runningJobsMu.Unlock()
+	defer func() {
+		s.runningJobsMu.Lock()
+		delete(s.runningJobs, key)
+		s.runningJobsMu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(jobLeaseRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.stopBackground:
+				stop(jobStopShutDown)
+				return
+			case <-done:
+				return
+			}
+			requested, err := store.RenewJobLease(j.Id)
+			if errors.Is(err, datastore.ErrLeaseLost) {
+				stop(jobStopLeaseLost)
+				return
+			} else if err != nil {
+				log.Printf("Failed to renew the lease on job %d: %v\n", j.Id, err)
+			} else if requested == datastore.JobCancelled {
+				stop(jobStopCancelled)
+			} else if requested == datastore.JobPaused {
+				stop(jobStopPaused)
+			}
+		}
+	}()
+
+	if j.CancelRequested {
+		stop(jobStopCancelled)
+	} else if j.PauseRequested {
+		stop(jobStopPaused)
+	} else if j.Items[datastore.JobItemDone]+j.Items[datastore.JobItemFailed] != 0 {
+		s.logJob(ctx, j.Id, "Carrying on from where it stopped")
+	} else {
+		s.logJob(ctx, j.Id, "Started")
+	}
+	if j.Kind == jobRefresh && j.TotalItems() == 0 && ctx.Err() == nil {
+		if err := s.listRefreshItems(ctx, j.Id, spec); err != nil {
+			s.endJob(ctx, j.Id, datastore.JobFailed, fmt.Sprintf("Failed to list the resources to refresh: %v", err))
+			return
+		}
+	}
+	for ctx.Err() == nil {
+		if j.Kind == jobCrawl && spec.MaxBytes > 0 && s.crawlBudgetSpent(ctx, j.Id, spec) {
+			break
+		}
+		items, err := store.NextJobItems(j.Id, defaultWarmConcurrency)
+		if err != nil {
+			s.endJob(ctx, j.Id, datastore.JobFailed, fmt.Sprintf("Failed to get the next items: %v", err))
+			return
+		}
+		if len(items) == 0 {
+			break
+		}
+		var wg sync.WaitGroup
+		for _, item := range items {
+			wg.Add(1)
+			go func(item datastore.JobItem) {
+				defer wg.Done()
+				state, errMsg, bytes := s.runJobItem(ctx, j, spec, item)
+				if state == datastore.JobItemFailed && ctx.Err() != nil {
+					// Given up on because the job was stopped. The item is
+					// still running, so ending or releasing the job settles
+					// it like those that weren't started.
+					return
+				}
+				if state == datastore.JobItemFailed {
+					s.logJob(ctx, j.Id, "Failed to %s %s: %s", jobVerb(j.Kind), item.Url, errMsg)
+				}
+				if err := store.FinishJobItem(item.Id, state, errMsg, bytes); err != nil {
+					log.Printf("Failed to record how %s went for job %d: %v\n", item.Url, j.Id, err)
+				}
+			}(item)
+		}
+		wg.Wait()
+	}
+
+	mu.Lock()
+	why := stopped
+	mu.Unlock()
+	switch why {
+	case jobNotStopped:
+		s.endJob(ctx, j.Id, datastore.JobFinished, "")
+	case jobStopCancelled:
+		s.endJob(ctx, j.Id, datastore.JobCancelled, "")
+	case jobStopPaused:
+		if err := store.ReleaseJob(j.Id, datastore.JobPaused); err != nil {
+			log.Printf("Failed to pause job %d: %v\n", j.Id, err)
+			return
+		}
+		s.logJob(ctx, j.Id, "Paused")
+	case jobStopShutDown:
+		if err := store.ReleaseJob(j.Id, datastore.JobQueued); err != nil {
+			log.Printf("Failed to put job %d back in the queue: %v\n", j.Id, err)
+			return
+		}
+		s.logJob(ctx, j.Id, "Stopped because knox is shutting down; it will carry on once knox starts again")
+	case jobStopLeaseLost:
+		log.Printf("Job %d was taken over by another instance\n", j.Id)
+	}
+}
+
+// Ends a job claimed here and logs how it went.
+func (s *Server) endJob(ctx context.Context, id uint, state datastore.JobState, errMsg string) {
+	if err := s.dsFrom(ctx).EndJob(id, state, errMsg); err != nil {
+		log.Printf("Failed to end job %d: %v\n", id, err)
+		return
+	}
+	summary := string(state)
+	if j, err := s.dsFrom(ctx).Job(id); err == nil {
+		summary = fmt.Sprintf("%s with %d done, %d skipped, %d failed, %d cancelled", summary,
+			j.Items[datastore.JobItemDone], j.Items[datastore.JobItemSkipped],
+			j.Items[datastore.JobItemFailed]+j.Items[datastore.JobItemInvalid], j.Items[datastore.JobItemCancelled])
+	}
+	if errMsg != "" {
+		summary += ": " + errMsg
+	}
+	s.logJob(ctx, id, "%s", strings.ToUpper(summary[:1])+summary[1:])
+}
+
+func jobVerb(kind string) string {
+	if kind == jobRefresh {
+		return "refresh"
+	}
+	return "cache"
+}
+
+// Deals with one item of a job, returning what became of it and how many
+// bytes were downloaded for it.
+func (s *Server) runJobItem(ctx context.Context, j datastore.Job, spec jobSpec, item datastore.JobItem) (datastore.JobItemState, string, int) {
+	if j.Kind == jobRefresh {
+		refreshed, err := s.refreshPage(ctx, item.HashedUrl, item.Url, spec.UserAgent)
+		if err != nil {
+			return datastore.JobItemFailed, err.Error(), 0
+		} else if !refreshed {
+			return datastore.JobItemSkipped, "", 0
+		}
+		return datastore.JobItemDone, "", 0
+	}
+	fetched, bytes, err := s.cacheBatchUrl(ctx, item.HashedUrl, item.Url, spec.UserAgent)
+	if err != nil {
+		return datastore.JobItemFailed, err.Error(), bytes
+	}
+	if j.Kind != jobCrawl {
+		// URLs that were cached when the job was queued were skipped then.
+		return datastore.JobItemDone, "", bytes
+	}
+	if item.Depth < spec.Depth {
+		s.queueLinkedPages(ctx, j.Id, spec, item)
+	}
+	if !fetched {
+		return datastore.JobItemSkipped, "", 0
+	}
+	return datastore.JobItemDone, "", bytes
+}
+
+// Whether a crawl has downloaded its max_bytes, in which case the pages it
+// has left are skipped.
+func (s *Server) crawlBudgetSpent(ctx context.Context, id uint, spec jobSpec) bool {
+	j, err := s.dsFrom(ctx).Job(id)
+	if err != nil {
+		log.Printf("Failed to look up job %d: %v\n", id, err)
+		return false
+	}
+	if j.Bytes < spec.MaxBytes {
+		return false
+	}
+	errMsg := fmt.Sprintf("The crawl downloaded its max_bytes of %d", spec.MaxBytes)
+	if err := s.dsFrom(ctx).SkipJobItems(id, errMsg); err != nil {
+		log.Printf("Failed to skip the rest of job %d: %v\n", id, err)
+		return false
+	}
+	s.logJob(ctx, id, "Skipping the pages left since the crawl downloaded %d bytes, its max_bytes being %d", j.Bytes, spec.MaxBytes)
+	return true
+}
+
+// Adds the pages within the crawl's scope that a page it visited links to,
+// to be visited in turn.
+func (s *Server) queueLinkedPages(ctx context.Context, id uint, spec jobSpec, item datastore.JobItem) {
+	scope, err := newCrawlScope(spec.jobParams)
+	if err != nil {
+		s.logJob(ctx, id, "Failed to follow the links of %s: %v", item.Url, err)
+		return
+	}
+	links, pageUrl, err := s.pageLinks(ctx, item.HashedUrl)
+	if err != nil {
+		s.logJob(ctx, id, "Failed to follow the links of %s: %v", item.Url, err)
+		return
+	}
+	var linked []datastore.JobItem
+	for _, link := range links {
+		linkUrl, err := url.Parse(link.Url)
+		if err != nil || !scope.allows(pageUrl, linkUrl) {
+			continue
+		}
+		linked = append(linked, datastore.JobItem{Url: link.Url, HashedUrl: link.HashedUrl, Depth: item.Depth + 1})
+	}
+	if _, err := s.dsFrom(ctx).AddJobItems(id, linked, spec.MaxPages); err != nil {
+		s.logJob(ctx, id, "Failed to queue the links of %s: %v", item.Url, err)
+	}
+}
+
+// Adds the cached resources a refresh job is for to it, the most recently
+// captured first. Held resources and captured requests other than plain
+// GETs are left out, since they can't be refreshed.
+func (s *Server) listRefreshItems(ctx context.Context, id uint, spec jobSpec) error {
+	var capturedBefore time.Time
+	if spec.OlderThan != "" {
+		age, err := parseAge(spec.OlderThan)
+		if err != nil {
+			return err
+		}
+		capturedBefore = time.Now().Add(-age)
+	}
+	filter := datastore.ListFilter{Host: spec.Host, ContentType: spec.ContentType}
+	cursor := ""
+	total := 0
+	for total < maxRefreshItems && ctx.Err() == nil {
+		ri, err := s.dsFrom(ctx).ListAfter(cursor, refreshListPageSize, filter)
+		if err != nil {
+			return err
+		}
+		listed := 0
+		var items []datastore.JobItem
+		for ri.HasNext() {
+			metadata, err := ri.Next()
+			if err != nil {
+				return err
+			}
+			listed++
+			cursor = metadata.Cursor
+			if metadata.Held || (!capturedBefore.IsZero() && !metadata.DownloadStarted.Before(capturedBefore)) {
+				continue
+			}
+			if _, _, _, ok := enc.ParseRequestKey(metadata.Url); ok {
+				continue
+			}
+			encodedUrl, err := encoder.Encode(metadata.Url)
+			if err != nil {
+				log.Printf("failed to encode %s: %v\n", metadata.Url, err)
+				continue
+			}
+			items = append(items, datastore.JobItem{Url: metadata.Url, HashedUrl: encodedUrl})
+		}
+		added, err := s.dsFrom(ctx).AddJobItems(id, items, maxRefreshItems)
+		if err != nil {
+			return err
+		}
+		total += added
+		if listed < refreshListPageSize {
+			break
+		}
+	}
+	s.logJob(ctx, id, "Found %d resources to refresh", total)
+	return nil
+}
+
+// Returns an item for each URL, normalized, or an invalid one for URLs that
+// can't be cached. With skipCached, URLs that are cached already are
+// skipped.
+func (s *Server) jobItemsFor(ctx context.Context, rawUrls []string, skipCached bool) []datastore.JobItem {
+	items := make([]datastore.JobItem, 0, len(rawUrls))
+	for _, rawUrl := range rawUrls {
+		normalizedUrl, err := s.urlNormalizer.Normalize(strings.TrimSpace(rawUrl))
+		var encodedUrl string
+		if err == nil && isHttpUrl(normalizedUrl, &url.URL{}) {
+			encodedUrl, err = encoder.Encode(normalizedUrl)
+		} else {
+			err = errors.New("not an http or https URL")
+		}
+		if err != nil {
+			items = append(items, datastore.JobItem{Url: rawUrl, State: datastore.JobItemInvalid, Error: fmt.Sprintf("Could not interpret requested url '%s'", rawUrl)})
+			continue
+		}
+		item := datastore.JobItem{Url: normalizedUrl, HashedUrl: encodedUrl}
+		if status, err := s.dsFrom(ctx).Status(encodedUrl); skipCached && err == nil && status == datastore.ResourceCached {
+			item.State = datastore.JobItemSkipped
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// Queues a job of kind for the client of r. Returns an error fit to show
+// them if the request doesn't make sense.
+func (s *Server) queueJob(r *http.Request, kind string, rawUrls []string, params jobParams, runAt time.Time) (datastore.Job, error) {
+	var items []datastore.JobItem
+	switch kind {
+	case jobUrl, jobBatch:
+		if kind == jobUrl && len(rawUrls) != 1 {
+			return datastore.Job{}, errors.New("A url job takes exactly one url.")
+		} else if len(rawUrls) == 0 {
+			return datastore.Job{}, errors.New("No urls were given.")
+		} else if len(rawUrls) > maxBatchUrls {
+			return datastore.Job{}, fmt.Errorf("A batch may have at most %d urls.", maxBatchUrls)
+		}
+		items = s.jobItemsFor(r.Context(), rawUrls, true)
+	case jobCrawl:
+		if len(rawUrls) != 1 {
+			return datastore.Job{}, errors.New("A crawl takes exactly one url to start from.")
+		}
+		if params.Depth < 1 || params.Depth > maxCrawlDepth {
+			return datastore.Job{}, fmt.Errorf("A crawl's depth must be from 1 to %d.", maxCrawlDepth)
+		}
+		if params.MaxPages == 0 {
+			params.MaxPages = defaultCrawlPages
+		} else if params.MaxPages < 0 || params.MaxPages > maxCrawlPages {
+			return datastore.Job{}, fmt.Errorf("A crawl may visit from 1 to %d pages.", maxCrawlPages)
+		}
+		if _, err := newCrawlScope(params); err != nil {
+			return datastore.Job{}, err
+		}
+		if params.MaxBytes < 0 {
+			return datastore.Job{}, errors.New("A crawl's max_bytes can't be negative.")
+		}
+		// The first page's links are followed even if it is cached.
+		items = s.jobItemsFor(r.Context(), rawUrls, false)
+		if items[0].State == datastore.JobItemInvalid {
+			return datastore.Job{}, errors.New(items[0].Error)
+		}
+	case jobRefresh:
+		if len(rawUrls) != 0 {
+			return datastore.Job{}, errors.New("A refresh job takes no urls; it refreshes the cached resources matching its host, content_type and older_than.")
+		}
+		if params.OlderThan != "" {
+			if _, err := parseAge(params.OlderThan); err != nil {
+				return datastore.Job{}, fmt.Errorf("Bad older_than '%s'.", params.OlderThan)
+			}
+		}
+	default:
+		return datastore.Job{}, fmt.Errorf("Unknown job kind '%s'.", kind)
+	}
+	spec, err := json.Marshal(jobSpec{
+		jobParams: params,
+		UserAgent: r.Header.Get("User-Agent"),
+		Header:    clientHeadersFrom(r.Context()),
+	})
+	if err != nil {
+		return datastore.Job{}, err
+	}
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+	j, err := s.dsFrom(r.Context()).CreateJob(kind, string(spec), runAt, items)
+	if err != nil {
+		return datastore.Job{}, err
+	}
+	log.Printf("Queued %s job %d with %d items\n", kind, j.Id, j.TotalItems())
+	s.wakeJobRunner()
+	return j, nil
+}
+
+type jobItemJson struct {
+	Url   string `json:"url"`
+	Depth int    `json:"depth,omitempty"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+type jobLogEntryJson struct {
+	At      time.Time `json:"at"`
+	Message string    `json:"message"`
+}
+
+type jobJson struct {
+	Id        uint   `json:"id"`
+	StatusUrl string `json:"status_url"`
+	Kind      string `json:"kind"`
+	jobParams
+	State           string         `json:"state"`
+	Error           string         `json:"error,omitempty"`
+	Created         time.Time      `json:"created"`
+	RunAt           time.Time      `json:"run_at"`
+	Started         *time.Time     `json:"started,omitempty"`
+	Finished        *time.Time     `json:"finished,omitempty"`
+	CancelRequested bool           `json:"cancel_requested,omitempty"`
+	PauseRequested  bool           `json:"pause_requested,omitempty"`
+	Done            bool           `json:"done"`
+	Total           int            `json:"total"`
+	Items           map[string]int `json:"items"`
+	Bytes           int            `json:"bytes"`
+
+	// Only for a single job.
+	Results []jobItemJson     `json:"results,omitempty"`
+	Log     []jobLogEntryJson `json:"log,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newJobJson(j datastore.Job) jobJson {
+	spec, _ := parseJobSpec(j.Spec)
+	items := map[string]int{}
+	for state, count := range j.Items {
+		items[string(state)] = count
+	}
+	return jobJson{
+		Id:              j.Id,
+		StatusUrl:       fmt.Sprintf("/api/v1/jobs/%d", j.Id),
+		Kind:            j.Kind,
+		jobParams:       spec.jobParams,
+		State:           string(j.State),
+		Error:           j.Error,
+		Created:         j.Created,
+		RunAt:           j.RunAt,
+		Started:         optionalTime(j.Started),
+		Finished:        optionalTime(j.Finished),
+		CancelRequested: j.CancelRequested && !j.Ended(),
+		PauseRequested:  j.PauseRequested && !j.Ended(),
+		Done:            j.Ended(),
+		Total:           j.TotalItems(),
+		Items:           items,
+		Bytes:           j.Bytes,
+	}
+}
+
+type jobRequestJson struct {
+	Kind string   `json:"kind"`
+	Urls []string `json:"urls"`
+	jobParams
+
+	// When to start the job. Right away if left out.
+	RunAt time.Time `json:"run_at"`
+}
+
+// Lists jobs, the most recent first, or queues one.
+func (s *Server) handleJobsApiRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		pageNum, err := intQueryParam(r, "page", 0)
+		if err != nil || pageNum < 0 {
+			writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Bad page '%s'", r.FormValue("page"))})
+			return
+		}
+		jobs, err := s.dsFrom(r.Context()).Jobs(pageNum*maxJobsPerPage, maxJobsPerPage)
+		if err != nil {
+			writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Failed to list jobs: %v", err)})
+			return
+		}
+		jobsJson := []jobJson{}
+		for _, j := range jobs {
+			jobsJson = append(jobsJson, newJobJson(j))
+		}
+		writeJson(w, 200, map[string][]jobJson{"jobs": jobsJson})
+	case "POST":
+		if s.config.ReadOnly {
+			writeReadOnlyError(w, r)
+			return
+		}
+		if s.isCrossSiteRequest(r) {
+			writeJson(w, 403, map[string]string{"error": "Cross-site requests are not allowed."})
+			return
+		}
+		var jobReq jobRequestJson
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWarmRequestBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&jobReq); err != nil {
+			writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Bad job request: %v", err)})
+			return
+		}
+		if s.inMaintenance() {
+			writeJson(w, 503, map[string]string{"error": errMaintenance.Error()})
+			return
+		}
+		j, err := s.queueJob(r, jobReq.Kind, jobReq.Urls, jobReq.jobParams, jobReq.RunAt)
+		if err != nil {
+			writeJson(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJson(w, 202, newJobJson(j))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJson(w, 405, map[string]string{"error": "Method not allowed."})
+	}
+}
+
+// Splits a path like prefix/12 or prefix/12/pause into the job id and what
+// is to be done with the job.
+func parseJobPath(path, prefix string) (uint, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)
+	id, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || !strings.HasPrefix(path, prefix) {
+		return 0, "", false
+	}
+	if len(parts) == 1 {
+		return uint(id), "", true
+	}
+	return uint(id), parts[1], true
+}
+
+// Reports on a job, with its log and a page of its items, or cancels,
+// pauses or resumes it.
+func (s *Server) handleJobApiRequest(w http.ResponseWriter, r *http.Request) {
+	id, action, ok := parseJobPath(r.URL.Path, "/api/v1/jobs/")
+	if _, known := jobActions[action]; !ok || (action != "" && !known) {
+		writeJson(w, 404, map[string]string{"error": fmt.Sprintf("Bad URI: %s", r.URL.Path)})
+		return
+	}
+	if action != "" {
+		s.writable(s.handleJobActionApiRequest)(w, r)
+		return
+	}
+	j, err := s.dsFrom(r.Context()).Job(id)
+	if errors.Is(err, datastore.ErrNoJob) {
+		writeJson(w, 404, map[string]string{"error": "No such job."})
+		return
+	} else if err != nil {
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Failed to look up job: %v", err)})
+		return
+	}
+	pageNum, err := intQueryParam(r, "page", 0)
+	if err != nil || pageNum < 0 {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Bad page '%s'", r.FormValue("page"))})
+		return
+	}
+	items, err := s.dsFrom(r.Context()).JobItems(id, pageNum*maxJobItemsPerPage, maxJobItemsPerPage)
+	if err != nil {
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Failed to list job items: %v", err)})
+		return
+	}
+	entries, err := s.dsFrom(r.Context()).JobLog(id, jobLogLines)
+	if err != nil {
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Failed to read job log: %v", err)})
+		return
+	}
+	status := newJobJson(j)
+	for _, item := range items {
+		status.Results = append(status.Results, jobItemJson{item.Url, item.Depth, string(item.State), item.Error})
+	}
+	for _, entry := range entries {
+		status.Log = append(status.Log, jobLogEntryJson{entry.At, entry.Message})
+	}
+	writeJson(w, 200, status)
+}
+
+// What may be done with a job through /api/v1/jobs/{id}/{action} or
+// /admin/jobs/{id}/{action}.
+var jobActions = map[string]func(*Server, *http.Request, uint) error{
+	"cancel": (*Server).cancelJob,
+	"pause":  (*Server).pauseJob,
+	"resume": (*Server).resumeJob,
+}
+
+// Logs that a job was changed right away if it is in the state the change
+// leads to, or that the change is waiting on whoever is running it.
+func (s *Server) logJobChange(ctx context.Context, id uint, state datastore.JobState, done, waiting string) {
+	j, err := s.dsFrom(ctx).Job(id)
+	if err != nil {
+		log.Printf("Failed to look up job %d: %v\n", id, err)
+		return
+	}
+	if j.State == state {
+		s.logJob(ctx, id, done)
+	} else {
+		s.logJob(ctx, id, waiting)
+	}
+}
+
+// Cancels a job for the client of r. A running job stops once it has given
+// up on the items it is in the middle of, which are cancelled along with
+// those it hadn't got to.
+func (s *Server) cancelJob(r *http.Request, id uint) error {
+	if err := s.dsFrom(r.Context()).CancelJob(id); err != nil {
+		return err
+	}
+	s.logJobChange(r.Context(), id, datastore.JobCancelled, "Cancelled", "Cancelling")
+	s.stopRunningJob(r.Context(), id, jobStopCancelled)
+	return nil
+}
+
+// Pauses a job for the client of r. A running job stops the same way as when
+// cancelled, but the items it gave up on are queued again, so that resuming
+// the job fetches them from scratch.
+func (s *Server) pauseJob(r *http.Request, id uint) error {
+	if err := s.dsFrom(r.Context()).PauseJob(id); err != nil {
+		return err
+	}
+	s.logJobChange(r.Context(), id, datastore.JobPaused, "Paused", "Pausing")
+	s.stopRunningJob(r.Context(), id, jobStopPaused)
+	return nil
+}
+
+// Resumes a paused job for the client of r.
+func (s *Server) resumeJob(r *http.Request, id uint) error {
+	if err := s.dsFrom(r.Context()).ResumeJob(id); err != nil {
+		return err
+	}
+	s.logJob(r.Context(), id, "Resumed")
+	s.wakeJobRunner()
+	return nil
+}
+
+func (s *Server) handleJobActionApiRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJson(w, 405, map[string]string{"error": "Changing a job requires a POST."})
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeJson(w, 403, map[string]string{"error": "Cross-site requests are not allowed."})
+		return
+	}
+	id, action, _ := parseJobPath(r.URL.Path, "/api/v1/jobs/")
+	err := jobActions[action](s, r, id)
+	if errors.Is(err, datastore.ErrNoJob) {
+		writeJson(w, 404, map[string]string{"error": "No such job."})
+		return
+	} else if errors.Is(err, datastore.ErrJobEnded) {
+		writeJson(w, 409, map[string]string{"error": "The job has already ended."})
+		return
+	} else if errors.Is(err, datastore.ErrJobNotPaused) {
+		writeJson(w, 409, map[string]string{"error": "The job isn't paused."})
+		return
+	} else if err != nil {
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Failed to %s job: %v", action, err)})
+		return
+	}
+	j, err := s.dsFrom(r.Context()).Job(id)
+	if err != nil {
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Failed to look up job: %v", err)})
+		return
+	}
+	writeJson(w, 200, newJobJson(j))
+}
+
+type adminJobsData struct {
+	Jobs      []jobJson
+	ReturnUrl string
+	Page      int
+	HasPrev   bool
+	PrevPage  int
+	HasNext   bool
+	NextPage  int
+}
+
+func (s *Server) handleAdminJobsRequest(w http.ResponseWriter, r *http.Request) {
+	pageNum, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || pageNum < 0 {
+		pageNum = 0
+	}
+	jobs, err := s.dsFrom(r.Context()).Jobs(pageNum*maxJobsPerPage, maxJobsPerPage)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to list jobs: %v\n", err)
+		log.Printf(msg)
+		writeError(w, 500, msg)
+		return
+	}
+	var rows []jobJson
+	for _, j := range jobs {
+		rows = append(rows, newJobJson(j))
+	}
+	s.renderPage(w, 200, "admin_jobs.html", adminJobsData{
+		Jobs:      rows,
+		ReturnUrl: r.URL.RequestURI(),
+		Page:      pageNum + 1,
+		HasPrev:   pageNum != 0,
+		PrevPage:  pageNum - 1,
+		HasNext:   len(jobs) == maxJobsPerPage,
+		NextPage:  pageNum + 1,
+	})
+}
+
+type adminJobData struct {
+	Job       jobJson
+	Items     []datastore.JobItem
+	Log       []datastore.JobLogEntry
+	ReturnUrl string
+	Page      int
+	HasPrev   bool
+	PrevPage  int
+	HasNext   bool
+	NextPage  int
+}
+
+func (s *Server) handleAdminJobRequest(w http.ResponseWriter, r *http.Request) {
+	id, action, ok := parseJobPath(r.URL.Path, "/admin/jobs/")
+	if _, known := jobActions[action]; !ok || (action != "" && !known) {
+		writeError(w, 404, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	if action != "" {
+		s.writable(s.handleAdminJobActionRequest)(w, r)
+		return
+	}
+	j, err := s.dsFrom(r.Context()).Job(id)
+	if errors.Is(err, datastore.ErrNoJob) {
+		writeError(w, 404, "No such job.")
+		return
+	} else if err != nil {
+		writeError(w, 500, fmt.Sprintf("Failed to look up job: %v", err))
+		return
+	}
+	pageNum, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || pageNum < 0 {
+		pageNum = 0
+	}
+	items, err := s.dsFrom(r.Context()).JobItems(id, pageNum*maxJobItemsPerPage, maxJobItemsPerPage)
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Failed to list job items: %v", err))
+		return
+	}
+	entries, err := s.dsFrom(r.Context()).JobLog(id, jobLogLines)
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Failed to read job log: %v", err))
+		return
+	}
+	s.renderPage(w, 200, "admin_job.html", adminJobData{
+		Job:       newJobJson(j),
+		Items:     items,
+		Log:       entries,
+		ReturnUrl: r.URL.RequestURI(),
+		Page:      pageNum + 1,
+		HasPrev:   pageNum != 0,
+		PrevPage:  pageNum - 1,
+		HasNext:   len(items) == maxJobItemsPerPage,
+		NextPage:  pageNum + 1,
+	})
+}
+
+// Cancels, pauses or resumes a job from the jobs pages and sends the browser
+// back to the page it came from.
+func (s *Server) handleAdminJobActionRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, 405, "Method not allowed.")
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeError(w, 403, "Cross-site requests are not allowed.")
+		return
+	}
+	id, action, _ := parseJobPath(r.URL.Path, "/admin/jobs/")
+	err := jobActions[action](s, r, id)
+	if errors.Is(err, datastore.ErrNoJob) {
+		writeError(w, 404, "No such job.")
+		return
+	} else if err != nil && !errors.Is(err, datastore.ErrJobEnded) && !errors.Is(err, datastore.ErrJobNotPaused) {
+		// The job may have changed since the page was shown, which the page
+		// it is sent back to will show.
+		writeError(w, 500, fmt.Sprintf("Failed to %s job: %v", action, err))
+		return
+	}
+	http.Redirect(w, r, adminReturnUrl(r, fmt.Sprintf("/admin/jobs/%d", id)), http.StatusSeeOther)
+}
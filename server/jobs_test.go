@@ -0,0 +1,43 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+func TestParseJobPath(t *testing.T) {
+	for _, tc := range []struct {
+		path   string
+		id     uint
+		action string
+		ok     bool
+	}{
+		{"/api/v1/jobs/12", 12, "", true},
+		{"/api/v1/jobs/12/cancel", 12, "cancel", true},
+		{"/api/v1/jobs/", 0, "", false},
+		{"/api/v1/jobs/abc", 0, "", false},
+		{"/api/v1/jobs/-1", 0, "", false},
+		{"/admin/jobs/12", 0, "", false},
+	} {
+		id, action, ok := parseJobPath(tc.path, "/api/v1/jobs/")
+		if id != tc.id || action != tc.action || ok != tc.ok {
+			t.Errorf("Wrong parse of %s. got = %d, %q, %v, want = %d, %q, %v", tc.path, id, action, ok, tc.id, tc.action, tc.ok)
+		}
+	}
+}
+
+func TestJobSpec(t *testing.T) {
+	spec := jobSpec{jobParams: jobParams{Depth: 2, MaxPages: 50}, UserAgent: "test"}
+	encoded := `{"depth":2,"max_pages":50,"user_agent":"test"}`
+	if got := newJobJson(datastore.Job{Spec: encoded}).jobParams; !reflect.DeepEqual(got, spec.jobParams) {
+		t.Errorf("Wrong params. got = %+v, want = %+v", got, spec.jobParams)
+	}
+	if parsed, err := parseJobSpec(encoded); err != nil || !reflect.DeepEqual(parsed, spec) {
+		t.Errorf("Wrong spec. got = %+v, %v, want = %+v", parsed, err, spec)
+	}
+	if parsed, err := parseJobSpec(""); err != nil || !reflect.DeepEqual(parsed, jobSpec{}) {
+		t.Errorf("Expected a job without a spec to get the defaults. got = %+v, %v", parsed, err)
+	}
+}
@@ -0,0 +1,3360 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gnossen/knoxcache/csp"
+	"github.com/gnossen/knoxcache/datastore"
+	enc "github.com/gnossen/knoxcache/encoder"
+	"github.com/gnossen/knoxcache/headerfilter"
+	"github.com/gnossen/knoxcache/hostfilter"
+	"github.com/gnossen/knoxcache/metrics"
+	"github.com/gnossen/knoxcache/normalizer"
+	"github.com/gnossen/knoxcache/oidc"
+	"github.com/gnossen/knoxcache/renderer"
+	"github.com/gnossen/knoxcache/resolver"
+	"github.com/gnossen/knoxcache/robots"
+	"github.com/gnossen/knoxcache/typefilter"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	texttemplate "text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// TODO: How do we take time slicing into account?
+
+const defaultListenHost = "0.0.0.0"
+const defaultPort = "8080"
+
+const maxUrlDisplaySize = 160
+
+const maxResourcesPerPage = 100
+
+// How much of a resumable download to store between checkpoints.
+const checkpointBytes = 8 * 1024 * 1024
+
+// How much of a page is read when indexing it for search and how much of its
+// text is kept.
+const maxIndexedPageBytes = 16 * 1024 * 1024
+const maxIndexedTextBytes = 1024 * 1024
+
+const maxSearchResultsPerPage = 25
+
+// How many of a page's outgoing links are recorded for the broken link report.
+const maxRecordedLinks = 1000
+
+const maxBrokenLinksPerPage = 100
+
+var adminListRegex = regexp.MustCompile("^/admin/list/([0-9]+)$")
+var resourceStatusRegex = regexp.MustCompile("^/api/v1/resources/([^/]+)/status$")
+var resourceRefreshRegex = regexp.MustCompile("^/api/v1/resources/([^/]+)/refresh$")
+var resourceShareRegex = regexp.MustCompile("^/api/v1/resources/([^/]+)/share$")
+var resourceEventsRegex = regexp.MustCompile("^/api/v1/resources/([^/]+)/events$")
+var adminRefreshRegex = regexp.MustCompile("^/admin/refresh/([^/]+)$")
+
+var encoder = enc.NewDefaultEncoder()
+
+// A caching proxy, made by New. Each has its own caches, downloads,
+// background work and metrics, so several can run in one process.
+type Server struct {
+	config Config
+
+	// The default cache.
+	ds datastore.FileDatastore
+
+	// The caches of --virtual-host, by host. Requests for any other host are
+	// served from ds, the default cache.
+	virtualHostStores map[string]datastore.FileDatastore
+
+	// How the default cache and the virtual hosts' caches write bodies.
+	durability datastore.Durability
+
+	// The *runtimeSettings that Reload can change while the server runs.
+	currentSettings atomic.Value
+
+	urlNormalizer        normalizer.Normalizer
+	skipCompressionTypes typefilter.TypeList
+
+	// Lowercased. Links with these schemes are left as they are.
+	keptLinkSchemes map[string]bool
+
+	// The hosts whose scripts are rewritten by rewriteScriptUrls.
+	scriptRewriteHosts hostfilter.HostList
+
+	// Canonicalized names of the headers passed on from clients.
+	forwardHeaders []string
+
+	// Sent to origins unless the client sent a forwarded header of the same
+	// name.
+	upstreamHeaders http.Header
+
+	// The --retention rules in the order they were given. The first matching
+	// a resource's host decides how long it is kept.
+	retentionRules []retentionRule
+
+	fetchClient      *http.Client
+	upstreamBreakers *circuitBreakers
+	downloads        *downloadQueue
+
+	// Chrome isn't started until a page is rendered, so this is set up
+	// whether or not it's installed.
+	pageRenderer *renderer.Renderer
+
+	reservationsMu sync.Mutex
+
+	// The bytes that downloads in flight in this instance expect to write,
+	// by the virtual host whose cache they are for.
+	diskReservations map[string]int64
+
+	robotsTxtMu sync.Mutex
+
+	// The robots.txt rules of each origin, by scheme and host.
+	robotsTxtCache map[string]robotsTxtEntry
+
+	// Set while knox is down for maintenance, when cached resources are still
+	// served but no new downloads start, so that the ones running can finish
+	// before an upgrade or a backup.
+	maintenanceMode int32
+
+	// Events waiting to be published. Nil if publishing is disabled.
+	eventQueue chan cacheEventJson
+
+	// Guards liveSubscribers and activeDownloads.
+	liveMu sync.Mutex
+
+	// The event streams open to admin pages.
+	liveSubscribers map[chan cacheEventJson]bool
+
+	// Closed by EndEventStreams.
+	liveStreamsEnded chan struct{}
+	endLiveStreams   sync.Once
+
+	// Downloads in flight in this instance.
+	activeDownloads map[*activeDownload]bool
+
+	// Wakes the job runner up so that a job that was just queued is started
+	// without waiting for the next poll.
+	jobsQueued chan struct{}
+
+	// Stops the jobs running here, by the virtual host they're for and id.
+	runningJobsMu sync.Mutex
+	runningJobs   map[runningJobKey]func(jobStop)
+
+	linkSigningKey []byte
+
+	// The role given to each group by --oidc-group-role.
+	oidcGroupRoles   map[string]string
+	oidcClientSecret string
+
+	// Signs the session and login cookies. A new one is made each time knox
+	// starts, which signs everyone out.
+	sessionKey []byte
+
+	oidcMu sync.Mutex
+
+	// Found on the first sign-in rather than in New, so that knox can start
+	// while the provider is down.
+	oidcProvider *oidc.Provider
+
+	pageTemplates         *htmltemplate.Template
+	serviceWorkerTemplate *texttemplate.Template
+	interceptionScript    string
+	staticHandler         http.Handler
+
+	metricsRegistry          *metrics.Registry
+	cacheHits                *metrics.Counter
+	cacheMisses              *metrics.Counter
+	downloadsRefusedForSpace *metrics.Counter
+	eventsPublished          *metrics.Counter
+	eventsDropped            *metrics.Counter
+	resourcesReplicated      *metrics.Counter
+	replicationFailures      *metrics.Counter
+	resourcesExpired         *metrics.Counter
+	resourcesOffloaded       *metrics.Counter
+
+	// Closed by Close to stop the goroutines started by New, which are
+	// tracked by backgroundWork.
+	stopBackground chan struct{}
+	backgroundWork sync.WaitGroup
+
+	// Serves every request, once New has set it up.
+	handler http.Handler
+}
+
+// Returns a server for c with nothing set up yet, as New starts from.
+func newServer(c Config) *Server {
+	s := &Server{
+		config:            c,
+		virtualHostStores: map[string]datastore.FileDatastore{},
+		keptLinkSchemes:   map[string]bool{},
+		upstreamHeaders:   http.Header{},
+		downloads:         newDownloadQueue(0),
+		diskReservations:  map[string]int64{},
+		robotsTxtCache:    map[string]robotsTxtEntry{},
+		liveSubscribers:   map[chan cacheEventJson]bool{},
+		liveStreamsEnded:  make(chan struct{}),
+		activeDownloads:   map[*activeDownload]bool{},
+		jobsQueued:        make(chan struct{}, 1),
+		runningJobs:       map[runningJobKey]func(jobStop){},
+		metricsRegistry:   metrics.NewRegistry(),
+		stopBackground:    make(chan struct{}),
+	}
+	s.currentSettings.Store(&runtimeSettings{})
+	s.cacheHits = s.metricsRegistry.NewCounter("knox_cache_hits_total", "Requests for resources that were already cached.")
+	s.cacheMisses = s.metricsRegistry.NewCounter("knox_cache_misses_total", "Requests for resources that had to be fetched.")
+	s.downloadsRefusedForSpace = s.metricsRegistry.NewCounter("knox_downloads_refused_for_space_total", "Downloads refused because the datastore was short on disk space or over --disk-budget.")
+	s.eventsPublished = s.metricsRegistry.NewCounter("knox_events_published_total", "Cache lifecycle events published to --events-to.")
+	s.eventsDropped = s.metricsRegistry.NewCounter("knox_events_dropped_total", "Cache lifecycle events dropped because the queue was full or publishing failed.")
+	s.resourcesReplicated = s.metricsRegistry.NewCounter("knox_resources_replicated_total", "Completed resources copied to the replica.")
+	s.replicationFailures = s.metricsRegistry.NewCounter("knox_replication_failures_total", "Replication passes that stopped early because of an error.")
+	s.resourcesExpired = s.metricsRegistry.NewCounter("knox_resources_expired_total", "Resources deleted for having outlived their --retention rule.")
+	s.resourcesOffloaded = s.metricsRegistry.NewCounter("knox_resources_offloaded_total", "Resources whose bodies were moved to the cold tier.")
+	return s
+}
+
+var linkAttrs = map[string][]string{
+	"a":      []string{"href"},
+	"link":   []string{"href"},
+	"meta":   []string{"content"},
+	"script": []string{"src"},
+	"img":    []string{"src"},
+}
+
+// Applied after any configured rules, so they can be overridden with keep.
+var defaultHeaderRules = []string{
+	"store * Content-Length drop",
+	"store * Alt-Svc drop",
+	"store * Date drop",
+	"store * Strict-Transport-Security drop",
+	"store * Via drop",
+}
+
+// Schemes of links that aren't fetched over HTTP, so pointing them at the
+// cache only breaks them.
+var defaultKeepLinkSchemes = []string{"mailto", "tel", "sms", "javascript", "data", "blob"}
+
+var linkSchemeRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*$`)
+
+// Formats whose bodies are compressed already, so that compressing them
+// again only costs CPU and sometimes makes them bigger. SVG and BMP images
+// aren't compressed.
+var defaultSkipCompressionTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif",
+	"video/*", "audio/*", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-xz", "application/x-bzip2",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".mp4", ".webm", ".mp3", ".woff", ".woff2", ".zip", ".gz", ".7z", ".xz",
+}
+
+// Bodies that are compressed already are stored as they are.
+func (s *Server) compressionLevel(contentType string, urlPath string) int {
+	if s.skipCompressionTypes.Matches(contentType, urlPath) {
+		return gzip.NoCompression
+	}
+	return s.config.CompressionLevel
+}
+
+// TODO: Dark mode.
+
+var dataSizeUnits []string = []string{
+	"B",
+	"KB",
+	"MB",
+	"GB",
+	"TB",
+	"PB",
+}
+
+func formatUnit(magnitude float64, unit string) string {
+	magnitudeString := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.2f", magnitude), "0"), ".")
+	return magnitudeString + unit
+}
+
+func formatDataSize(bytes int) string {
+	currentUnitSize := float64(bytes)
+	for unitIndex := 0; unitIndex < len(dataSizeUnits)-1; unitIndex += 1 {
+		if currentUnitSize < 1024.0 {
+			return formatUnit(currentUnitSize, dataSizeUnits[unitIndex])
+		}
+		currentUnitSize = currentUnitSize / 1024.0
+	}
+	return formatUnit(currentUnitSize, dataSizeUnits[len(dataSizeUnits)-1])
+}
+
+// URL is assumed to be a normalized absolute URL.
+func translateAbsoluteUrlToCachedUrl(toTranslate string, protocol string, host string) (string, error) {
+	encoded, err := encoder.Encode(toTranslate)
+	if err != nil {
+		return "", nil
+	}
+	return fmt.Sprintf("%s://%s/c/%s", protocol, host, encoded), nil
+}
+
+// Returns the URL a cache key refers to, which is either the key itself or part
+// of a request key.
+func keyUrl(key string) string {
+	if _, _, requestUrl, ok := enc.ParseRequestKey(key); ok {
+		return requestUrl
+	}
+	return key
+}
+
+// Resolves a possibly relative link against baseUrl and normalizes it.
+func (s *Server) resolveUrl(toResolve string, baseUrl *url.URL) (string, error) {
+	parsedUrl, err := url.Parse(toResolve)
+	if err != nil {
+		return "", err
+	}
+	var absoluteUrl *url.URL
+	if !parsedUrl.IsAbs() {
+		absoluteUrl = baseUrl.ResolveReference(parsedUrl)
+	} else {
+		absoluteUrl = parsedUrl
+	}
+	return s.urlNormalizer.Normalize(absoluteUrl.String())
+}
+
+// Returns the scheme of a link, lowercased, or "" if it is relative.
+// Browsers ignore tabs and newlines anywhere in a link and spaces around it,
+// so they are here too.
+func linkScheme(link string) string {
+	link = strings.NewReplacer("\t", "", "\n", "", "\r", "").Replace(strings.TrimSpace(link))
+	i := strings.IndexAny(link, ":/?#")
+	if i <= 0 || link[i] != ':' || !linkSchemeRegex.MatchString(link[:i]) {
+		return ""
+	}
+	return strings.ToLower(link[:i])
+}
+
+// Whether a link should be left as it is: links to fragments of the page
+// they're on, and links with schemes in keptLinkSchemes.
+func (s *Server) keepLink(link string) bool {
+	if strings.HasPrefix(strings.TrimSpace(link), "#") {
+		return true
+	}
+	return s.keptLinkSchemes[linkScheme(link)]
+}
+
+// Points a link on a cached page at the cache, unless keepLink says to leave
+// it as it is.
+func (s *Server) translateCachedUrl(toTranslate string, baseUrl *url.URL, protocol string, host string) (string, error) {
+	if s.keepLink(toTranslate) {
+		return toTranslate, nil
+	}
+	// Fragments never reach the origin, so the link is to the same cached
+	// resource with or without one. The browser still needs it to scroll to
+	// the right place once the cached copy loads.
+	fragment := ""
+	if i := strings.Index(toTranslate, "#"); i >= 0 {
+		toTranslate, fragment = toTranslate[:i], toTranslate[i:]
+		if fragment == "#" {
+			fragment = ""
+		}
+	}
+	normalizedUrl, err := s.resolveUrl(toTranslate, baseUrl)
+	if err != nil {
+		return "", err
+	}
+	translated, err := translateAbsoluteUrlToCachedUrl(normalizedUrl, protocol, host)
+	if err != nil {
+		return "", err
+	}
+	return translated + fragment, nil
+}
+
+func (s *Server) modifyLink(tag string, node *html.Node, baseUrl *url.URL, protocol string, host string) {
+	translatedAny := false
+	for i, attr := range node.Attr {
+		for _, linkAttr := range linkAttrs[tag] {
+			if attr.Key == linkAttr {
+				translated, err := s.translateCachedUrl(node.Attr[i].Val, baseUrl, protocol, host)
+				if err != nil {
+					fmt.Println("Failed to parse as URL.")
+					continue
+				}
+				if translated != node.Attr[i].Val {
+					node.Attr[i].Val = translated
+					translatedAny = true
+				}
+			}
+		}
+	}
+	if translatedAny {
+		// Subresource integrity hashes describe what the origin sent, which
+		// the copy served from the cache may not match, e.g. if it was
+		// refreshed since the page was cached. Browsers refuse to use a
+		// subresource whose hash doesn't match, so it's better to go without.
+		removeAttr(node, "integrity")
+	}
+}
+
+func (s *Server) addInterceptionScript(doc *html.Node) error {
+	doc.InsertBefore(s.interceptionScriptNode(), doc.FirstChild)
+	return nil
+}
+
+func (s *Server) interceptionScriptNode() *html.Node {
+	scriptNode := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Script,
+		Data:     "script",
+		Attr:     []html.Attribute{},
+	}
+	scriptTextNode := &html.Node{
+		Type:     html.TextNode,
+		DataAtom: atom.Plaintext,
+		Data:     s.interceptionScript,
+		Attr:     []html.Attribute{},
+	}
+	scriptNode.AppendChild(scriptTextNode)
+	return scriptNode
+}
+
+var cspHeaderKeys = []string{
+	"Content-Security-Policy",
+	"Content-Security-Policy-Report-Only",
+}
+
+// The CSP source allowing the script added by addInterceptionScript to run.
+func (s *Server) interceptionScriptSource() string {
+	hash := sha256.Sum256([]byte(s.interceptionScript))
+	return "'sha256-" + base64.StdEncoding.EncodeToString(hash[:]) + "'"
+}
+
+// Applies --csp-mode to a policy. Returns the empty string if the policy
+// should be removed.
+func (s *Server) transformCsp(policy string) string {
+	switch s.config.CspMode {
+	case "adapt":
+		return csp.Adapt(policy, s.interceptionScriptSource())
+	case "drop":
+		return ""
+	}
+	return policy
+}
+
+func (s *Server) transformCspHeaders(headers http.Header) {
+	for _, key := range cspHeaderKeys {
+		var transformed []string
+		for _, value := range headers.Values(key) {
+			if policy := s.transformCsp(value); policy != "" {
+				transformed = append(transformed, policy)
+			}
+		}
+		headers.Del(key)
+		for _, policy := range transformed {
+			headers.Add(key, policy)
+		}
+	}
+}
+
+// Reports whether node is a <meta http-equiv> tag for one of cspHeaderKeys.
+func isCspMeta(node *html.Node) bool {
+	if node.Data != "meta" {
+		return false
+	}
+	for _, attr := range node.Attr {
+		if attr.Key != "http-equiv" {
+			continue
+		}
+		for _, key := range cspHeaderKeys {
+			if strings.EqualFold(strings.TrimSpace(attr.Val), key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Applies --csp-mode to a CSP meta tag, removing it if the policy should be.
+func (s *Server) transformCspMeta(node *html.Node) {
+	for i, attr := range node.Attr {
+		if attr.Key != "content" {
+			continue
+		}
+		if policy := s.transformCsp(attr.Val); policy != "" {
+			node.Attr[i].Val = policy
+			return
+		}
+	}
+	node.Parent.RemoveChild(node)
+}
+
+// Link types that only open connections to an origin ahead of time. Archived
+// pages load everything from knox, so they'd only tell the origin that the
+// page is being read.
+var connectionHints = map[string]bool{"dns-prefetch": true, "preconnect": true}
+
+// Drops the connection hints from a <link>'s rel, and the link itself if
+// nothing else is left of it. Reports whether the link was removed.
+//
+// Preloads keep their as and crossorigin attributes, since a preload is only
+// used by a later request with the same destination and CORS mode, and those
+// later requests keep theirs too. Image preloads lose their imagesrcset and
+// imagesizes, whose candidates aren't rewritten, so that the image in href is
+// preloaded from the cache rather than one of them from the origin.
+func transformLinkHints(node *html.Node) bool {
+	i, ok := getAttr(node, "rel")
+	if !ok {
+		return false
+	}
+	var kept []string
+	hints := 0
+	for _, linkType := range strings.Fields(node.Attr[i].Val) {
+		if connectionHints[strings.ToLower(linkType)] {
+			hints += 1
+		} else {
+			kept = append(kept, linkType)
+		}
+	}
+	if hints > 0 && len(kept) == 0 {
+		node.Parent.RemoveChild(node)
+		return true
+	} else if hints > 0 {
+		node.Attr[i].Val = strings.Join(kept, " ")
+	}
+	for _, linkType := range kept {
+		if strings.EqualFold(linkType, "preload") {
+			removeAttr(node, "imagesrcset")
+			removeAttr(node, "imagesizes")
+		}
+	}
+	return false
+}
+
+// The parser, like browsers that run scripts, reads what's in a <noscript> as
+// text, but browsers that don't read it as markup, which may link to the
+// origin like any other. Parses that markup, transforms it with visit, and
+// puts it back as text.
+func transformNoscript(node *html.Node, visit func(*html.Node)) {
+	text := node.FirstChild
+	if text == nil || text != node.LastChild || text.Type != html.TextNode {
+		return
+	}
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(text.Data), body)
+	if err != nil {
+		return
+	}
+	for _, n := range nodes {
+		body.AppendChild(n)
+	}
+	for c := body.FirstChild; c != nil; {
+		// c may be removed while visiting it.
+		next := c.NextSibling
+		visit(c)
+		c = next
+	}
+	var buf bytes.Buffer
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&buf, c); err != nil {
+			return
+		}
+	}
+	text.Data = buf.String()
+}
+
+func getContentType(headers *http.Header) string {
+	contentType := "text/html"
+	rawContentType := headers.Get("Content-Type")
+	if rawContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(rawContentType)
+		// If we cannot parse the MIME type, assume HTML.
+		if err == nil {
+			contentType = mediaType
+		}
+	}
+
+	return contentType
+}
+
+// Like getContentType for a cached resource, but without parsing its headers.
+func cachedContentType(f datastore.ResourceInfo) string {
+	if contentType := f.ContentType(); contentType != "" {
+		return contentType
+	}
+	return "text/html"
+}
+
+// Rewrites an element of a cached page in place, pointing its links at the
+// cache and applying --csp-mode. Reports whether it was removed from its
+// parent instead, and whether it links to an icon.
+func (s *Server) rewriteElement(node *html.Node, resourceUrl *url.URL, protocol string, host string) (bool, bool) {
+	if isCspMeta(node) {
+		// Its content is a policy rather than a URL.
+		s.transformCspMeta(node)
+		return node.Parent == nil, false
+	}
+	if node.Data == "link" && transformLinkHints(node) {
+		return true, false
+	}
+	if _, ok := linkAttrs[node.Data]; ok {
+		s.modifyLink(node.Data, node, resourceUrl, protocol, host)
+	}
+	if node.DataAtom == atom.Link && hasLinkType(node, "manifest") {
+		linkManifest(node, protocol, host)
+	}
+	return false, node.DataAtom == atom.Link && hasLinkType(node, "icon")
+}
+
+// TODO: Cache the transformation if it becomes a bottleneck.
+func (s *Server) transformHtml(resourceUrl *url.URL, in io.Reader, out io.Writer, protocol string, host string) error {
+	// Transform hooks are handed the whole document.
+	if len(transformHooks) != 0 {
+		return s.transformHtmlDocument(resourceUrl, in, out, protocol, host)
+	}
+	return s.streamTransformHtml(resourceUrl, in, out, protocol, host)
+}
+
+// Like streamTransformHtml, but parses the whole page first so that the
+// transform hooks can be run on it.
+func (s *Server) transformHtmlDocument(resourceUrl *url.URL, in io.Reader, out io.Writer, protocol string, host string) error {
+	linksIcon := false
+	var visitNode func(node *html.Node)
+	visitNode = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			if node.DataAtom == atom.Noscript {
+				transformNoscript(node, visitNode)
+				return
+			}
+			removed, icon := s.rewriteElement(node, resourceUrl, protocol, host)
+			if removed {
+				return
+			}
+			linksIcon = linksIcon || icon
+		}
+		for c := node.FirstChild; c != nil; {
+			// c may be removed while visiting it.
+			next := c.NextSibling
+			visitNode(c)
+			c = next
+		}
+	}
+
+	doc, err := html.Parse(in)
+	if err != nil {
+		return err
+	}
+
+	err = s.addInterceptionScript(doc)
+	if err != nil {
+		return err
+	}
+
+	visitNode(doc)
+	if !linksIcon {
+		s.addDefaultIcon(doc, resourceUrl, protocol, host)
+	}
+	if err := runTransformHooks(doc, resourceUrl); err != nil {
+		return err
+	}
+	html.Render(out, doc)
+
+	return nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (s *Server) newUpstreamTlsConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[s.config.UpstreamTlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %s", s.config.UpstreamTlsMinVersion)
+	}
+	tlsConfig := &tls.Config{MinVersion: minVersion}
+	if s.config.UpstreamTlsSessionCacheSize > 0 {
+		// Lets reconnections to an origin resume their TLS sessions instead
+		// of doing full handshakes.
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(s.config.UpstreamTlsSessionCacheSize)
+	}
+	if s.config.UpstreamCaFile != "" {
+		pem, err := ioutil.ReadFile(s.config.UpstreamCaFile)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig.RootCAs, err = x509.SystemCertPool(); err != nil {
+			return nil, err
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", s.config.UpstreamCaFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Creates the client that queries --dns-over-https. Resolving the endpoint's
+// host with the system's resolvers, or connecting through a proxy, would leak
+// the very lookups DNS over HTTPS is meant to keep private.
+func (s *Server) newDohClient() (*http.Client, error) {
+	endpoint, err := url.Parse(s.config.DnsOverHttps)
+	if err != nil {
+		return nil, fmt.Errorf("bad --dns-over-https URL: %v", err)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if s.config.DnsServer != "" {
+		dialer.Resolver = resolver.NewServerResolver(s.config.DnsServer)
+	} else if net.ParseIP(endpoint.Hostname()) == nil {
+		return nil, fmt.Errorf("--dns-over-https needs an IP address rather than %s unless --dns-server is given", endpoint.Hostname())
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	// The endpoint is trusted configuration, so it isn't subject to
+	// hostFilter.
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport, Timeout: 10 * time.Second}, nil
+}
+
+func (s *Server) newUpstreamResolver() (resolver.Resolver, error) {
+	var r resolver.Resolver = net.DefaultResolver
+	if s.config.DnsOverHttps != "" {
+		dohClient, err := s.newDohClient()
+		if err != nil {
+			return nil, err
+		}
+		r = resolver.NewDohResolver(s.config.DnsOverHttps, dohClient)
+	} else if s.config.DnsServer != "" {
+		r = resolver.NewServerResolver(s.config.DnsServer)
+	}
+	if s.config.DnsCacheTtl > 0 {
+		r = resolver.NewCachingResolver(r, s.config.DnsCacheTtl)
+	}
+	return r, nil
+}
+
+// Configured rules come first so that they take precedence over the defaults.
+func newHeaderFilter(c Config) (headerfilter.HeaderFilter, error) {
+	var rules []headerfilter.Rule
+	if c.HeaderRulesFile != "" {
+		loaded, err := headerfilter.LoadRules(c.HeaderRulesFile)
+		if err != nil {
+			return headerfilter.HeaderFilter{}, err
+		}
+		rules = append(rules, loaded...)
+	}
+	lines := []string{}
+	policy := c.SetCookiePolicy
+	if c.StripSetCookie {
+		policy = "strip"
+	}
+	switch policy {
+	case "pass":
+	case "strip-auth":
+		lines = append(lines, "serve * Set-Cookie strip-auth")
+	case "strip":
+		lines = append(lines, "serve * Set-Cookie drop")
+	default:
+		return headerfilter.HeaderFilter{}, fmt.Errorf("unknown Set-Cookie policy %s", policy)
+	}
+	lines = append(lines, defaultHeaderRules...)
+	for _, line := range lines {
+		rule, err := headerfilter.ParseRule(line, "default")
+		if err != nil {
+			return headerfilter.HeaderFilter{}, err
+		}
+		rules = append(rules, rule)
+	}
+	return headerfilter.NewHeaderFilter(rules), nil
+}
+
+// Creates the transport shared by all upstream fetches, so that connections
+// to each origin are pooled and reused rather than left in TIME_WAIT.
+// TODO: HTTP/3. quic-go dials its own UDP sockets, so it would need to be
+// taught about hostFilter first.
+func (s *Server) newUpstreamTransport() (*http.Transport, error) {
+	upstreamResolver, err := s.newUpstreamResolver()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Connecting through a proxy would hide the origin's address from
+	// hostFilter.
+	transport.Proxy = nil
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: s.config.UpstreamKeepAlive,
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		// Looked up for each connection so that reloaded host rules apply
+		// to the pool.
+		return s.settings().hostFilter.DialContext(dialer, tracingResolver{upstreamResolver})(ctx, network, address)
+	}
+	transport.MaxIdleConns = s.config.UpstreamMaxIdleConns
+	transport.MaxIdleConnsPerHost = s.config.UpstreamMaxIdleConnsPerHost
+	transport.MaxConnsPerHost = s.config.UpstreamMaxConnsPerHost
+	transport.IdleConnTimeout = s.config.UpstreamIdleConnTimeout
+	transport.ResponseHeaderTimeout = s.config.UpstreamResponseHeaderTimeout
+	tlsConfig, err := s.newUpstreamTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	if s.config.UpstreamHttp2 {
+		transport.ForceAttemptHTTP2 = true
+	} else {
+		// A non-nil empty map is how HTTP/2 is turned off.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport, nil
+}
+
+// Creates the client used for all upstream fetches. Every connection,
+// including those made while following redirects, is checked against
+// hostFilter.
+func (s *Server) newFetchClient() (*http.Client, error) {
+	transport, err := s.newUpstreamTransport()
+	if err != nil {
+		return nil, err
+	}
+	var roundTripper http.RoundTripper = transport
+	if s.config.UpstreamReadTimeout > 0 {
+		roundTripper = stallTransport{roundTripper, s.config.UpstreamReadTimeout}
+	}
+	// Installed even without bandwidth caps, which may be added by a
+	// reload.
+	roundTripper = throttleTransport{roundTripper, s.settings}
+	s.upstreamBreakers = nil
+	if s.config.CircuitBreakerFailures > 0 {
+		s.upstreamBreakers = newCircuitBreakers(s.config.CircuitBreakerFailures, s.config.CircuitBreakerCooldown)
+		roundTripper = breakerTransport{roundTripper, s.upstreamBreakers}
+	}
+	return &http.Client{
+		Transport: hookTransport{decodingTransport{roundTripper}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return s.settings().hostFilter.CheckHost(req.URL.Host)
+		},
+	}, nil
+}
+
+// A request made through the capture API. Unless it is a plain GET, its
+// response is cached under a request key rather than its URL.
+type capturedRequest struct {
+	Method string
+	Url    string
+	Header http.Header
+	Body   []byte
+
+	// Nil if the request was captured without options.
+	Options *captureOptions
+}
+
+func (c *capturedRequest) newRequest() (*http.Request, error) {
+	req, err := http.NewRequest(c.Method, c.Url, bytes.NewReader(c.Body))
+	if err != nil {
+		return nil, err
+	}
+	if c.Header != nil {
+		req.Header = c.Header.Clone()
+	}
+	return req, nil
+}
+
+// Fetches srcUrl, or captured if it isn't nil, into resourceWriter. When
+// refreshing, cached holds the headers of the copy being replaced so that the
+// origin can report that it is still current instead of sending it again. If
+// the origin can't be reached, times out or returns a server error, the
+// failure is recorded in the datastore and returned as a
+// datastore.FetchFailure.
+func (s *Server) cachePage(ctx context.Context, srcUrl string, resourceWriter datastore.ResourceWriter, userAgent string, cached *http.Header, captured *capturedRequest) (err error) {
+	priority := downloadPriorityFrom(ctx)
+	// Only waiting in the queue is given up on once the caller is done; a
+	// download that has started runs to completion unless the caller marked
+	// it abortable.
+	queueCtx := ctx
+	ctx, span := tracer.Start(detachSpan(ctx), "cachePage", trace.WithAttributes(semconv.HTTPURLKey.String(srcUrl)))
+	defer func() { endSpan(span, err) }()
+	if downloadsAbortable(queueCtx) {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-queueCtx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	// Capture options are written first so that a failure is recorded with
+	// them, and the capture can be retried the same way.
+	if captured != nil && captured.Options != nil && !captured.Options.empty() {
+		resourceWriter.WriteCaptureOptions(captured.Options.encode())
+	}
+	_, queueSpan := tracer.Start(ctx, "queue", trace.WithAttributes(attribute.Int("priority", int(priority))))
+	err = s.downloads.acquire(queueCtx, priority)
+	queueSpan.End()
+	if err != nil && downloadsAbortable(queueCtx) {
+		resourceWriter.Abandon()
+		return err
+	} else if err != nil {
+		// Nothing was fetched, so the next request may try again right away.
+		resourceWriter.Fail(err, time.Now())
+		return err
+	}
+	defer s.downloads.release()
+	encodedUrl, err := encoder.Encode(srcUrl)
+	if err != nil {
+		resourceWriter.Fail(err, time.Now())
+		return err
+	}
+	download := s.startTrackingDownload(ctx, srcUrl, encodedUrl)
+	defer s.stopTrackingDownload(download)
+	resourceWriter = trackingResourceWriter{resourceWriter, download}
+	releaseSpace := func() {}
+	defer func() { releaseSpace() }()
+	fail := func(fetchErr error) error {
+		if queueCtx.Err() != nil && ctx.Err() != nil {
+			// Given up on rather than failed, so nothing is recorded.
+			log.Printf("Gave up on getting url %s: %v\n", srcUrl, queueCtx.Err())
+			if err := resourceWriter.Abandon(); err != nil {
+				log.Printf("Failed to abandon %s: %v\n", srcUrl, err)
+			}
+			return queueCtx.Err()
+		}
+		log.Printf("Failed to get url %s: %v\n", srcUrl, fetchErr)
+		var blocked hostfilter.BlockedError
+		isBlocked := errors.As(fetchErr, &blocked)
+		if isBlocked {
+			// E.g. a redirect to a blocked host, which retrying won't get
+			// around, so it is recorded as refused rather than as an origin
+			// that may come back.
+			fetchErr = fmt.Errorf("%w: %v", datastore.ErrRefused, blocked)
+		}
+		if errors.Is(fetchErr, syscall.ENOSPC) {
+			fetchErr = fmt.Errorf("%w: the datastore's disk is full", errInsufficientStorage)
+		}
+		if errors.Is(fetchErr, errInsufficientStorage) {
+			// Nothing is kept, and the next request may try again once
+			// there is room.
+			resourceWriter.Fail(fetchErr, time.Now())
+			s.publishEvent(ctx, eventFailed, encodedUrl, srcUrl, fetchErr)
+			return fetchErr
+		}
+		failedAt := time.Now()
+		attempts := 1
+		if previous, err := s.dsFrom(ctx).RecordedFailure(encodedUrl); err != nil {
+			log.Printf("Failed to look up earlier failures of %s: %v\n", srcUrl, err)
+		} else if previous != nil {
+			attempts = previous.Attempts + 1
+		}
+		retryAfter := failedAt.Add(s.failureBackoff(attempts))
+		if err := resourceWriter.Fail(fetchErr, retryAfter); err != nil {
+			log.Printf("Failed to record failure for %s: %v\n", srcUrl, err)
+		}
+		s.publishEvent(ctx, eventFailed, encodedUrl, srcUrl, fetchErr)
+		if isBlocked {
+			return blocked
+		}
+		return datastore.FetchFailure{
+			Url:        srcUrl,
+			Reason:     fetchErr.Error(),
+			FailedAt:   failedAt,
+			RetryAfter: retryAfter,
+			Refused:    errors.Is(fetchErr, datastore.ErrRefused),
+			Attempts:   attempts,
+		}
+	}
+	// Bytes of the body already stored and the validator of the version they
+	// came from. Non-zero only when resuming an interrupted download,
+	// possibly one abandoned by another instance.
+	resumeFrom, validator, err := resourceWriter.Resume()
+	if err != nil {
+		return fail(err)
+	}
+	// Only GETs can be resumed with a range request.
+	resumable := captured == nil || captured.Method == "GET"
+	// The tags flagging why robots directives forbid archiving the resource,
+	// under --robots-policy=flag.
+	var robotsTags []string
+	// The beginning of an HTML body, searched for robots <meta> elements.
+	var robotsHead *bytes.Buffer
+	if resumeFrom != 0 && !resumable {
+		if err := resourceWriter.Reset(); err != nil {
+			return fail(err)
+		}
+		resumeFrom = 0
+	}
+	for attempt := 0; ; attempt += 1 {
+		var req *http.Request
+		if captured != nil {
+			req, err = captured.newRequest()
+		} else {
+			req, err = http.NewRequest("GET", srcUrl, nil)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if attempt == 0 && s.config.RobotsPolicy != robotsIgnore && !s.robotsTxtRules(ctx, req.URL, userAgent).Allowed(req.URL.RequestURI()) {
+			if err := s.applyRobotsPolicy(srcUrl, "robots.txt disallows it", robotsDisallowedTag, &robotsTags); err != nil {
+				return fail(err)
+			}
+		}
+		fetchCtx, fetchSpan := tracer.Start(ctx, "fetch", trace.WithAttributes(attribute.Int("attempt", attempt)))
+		req = req.WithContext(withFetchTrace(fetchCtx))
+		if userAgent != "" && req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", userAgent)
+		}
+		s.setUpstreamHeaders(ctx, req)
+		if resumeFrom != 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resumeFrom))
+			req.Header.Set("If-Range", validator)
+		} else if cached != nil {
+			if etag := cached.Get("ETag"); etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			} else if lastModified := cached.Get("Last-Modified"); lastModified != "" {
+				req.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+		resp, err := s.fetchClient.Do(req)
+		if err != nil {
+			endSpan(fetchSpan, err)
+			return fail(err)
+		}
+		fetchSpan.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+		fetchSpan.End()
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			return fail(fmt.Errorf("origin responded with %s", resp.Status))
+		}
+		if resp.StatusCode == 304 && cached != nil {
+			resp.Body.Close()
+			log.Printf("%s has not changed\n", srcUrl)
+			return resourceWriter.NotModified()
+		}
+		resourceWriter.WriteProtocol(resp.Proto)
+		resourceWriter.WriteContentEncoding(originalContentEncoding(resp))
+
+		if resumeFrom != 0 && (resp.StatusCode != 206 || contentRangeStart(resp) != resumeFrom) {
+			// The origin sent the whole thing, probably because the resource
+			// changed since the interrupted attempt.
+			log.Printf("Could not resume %s, restarting from the beginning\n", srcUrl)
+			if err := resourceWriter.Reset(); err != nil {
+				resp.Body.Close()
+				return fail(err)
+			}
+			resumeFrom = 0
+		}
+
+		releaseSpace()
+		expectedBytes := int64(0)
+		if resp.ContentLength > 0 {
+			expectedBytes = resp.ContentLength
+		}
+		if releaseSpace, err = s.reserveDiskSpace(ctx, expectedBytes); err != nil {
+			releaseSpace = func() {}
+			resp.Body.Close()
+			return fail(err)
+		}
+
+		if err := resourceWriter.SetCompressionLevel(s.compressionLevel(resp.Header.Get("Content-Type"), req.URL.Path)); err != nil {
+			resp.Body.Close()
+			return fail(err)
+		}
+
+		if resumeFrom == 0 {
+			if resp.StatusCode == 206 {
+				resp.Body.Close()
+				return fail(fmt.Errorf("origin responded with unrequested partial content"))
+			}
+			if err := s.settings().typeFilter.Check(resp.Header.Get("Content-Type"), req.URL.Path); err != nil {
+				resp.Body.Close()
+				return fail(fmt.Errorf("%w: %v", datastore.ErrRefused, err))
+			}
+			if s.config.RobotsPolicy != robotsIgnore {
+				if robots.HeaderNoArchive(resp.Header.Values("X-Robots-Tag"), robots.Agent) {
+					if err := s.applyRobotsPolicy(srcUrl, "its X-Robots-Tag forbids archiving it", robotsNoArchiveTag, &robotsTags); err != nil {
+						resp.Body.Close()
+						return fail(err)
+					}
+				} else if robotsHead == nil && getContentType(&resp.Header) == "text/html" {
+					robotsHead = &bytes.Buffer{}
+					resourceWriter = robotsSniffingWriter{resourceWriter, robotsHead}
+				}
+			}
+			log.Printf("Caching %s as %s\n", srcUrl, encodedUrl)
+			validator = ""
+			if resumable {
+				validator = resumeValidator(resp)
+			}
+			requestHeaders := s.recordedRequestHeaders(req)
+			resourceWriter.WriteRequestHeaders(&requestHeaders)
+			filtered := s.applyStoreRules(req.URL.Hostname(), resp.Header)
+			resourceWriter.WriteFilteredHeaders(&filtered)
+			resourceWriter.WriteHeaders(&resp.Header)
+			resourceWriter.WriteStatusCode(resp.StatusCode)
+			if s.rendersPage(captured) && getContentType(&resp.Header) == "text/html" {
+				resp.Body.Close()
+				if err := s.renderInto(ctx, srcUrl, resourceWriter, userAgent); err != nil {
+					return fail(err)
+				}
+				break
+			}
+		} else {
+			log.Printf("Resuming %s at byte %d\n", srcUrl, resumeFrom)
+			// The origin honored If-Range, so this continues the complete
+			// response the download started with.
+			resourceWriter.WriteStatusCode(200)
+		}
+
+		if resp.ContentLength >= 0 {
+			download.expectBytes(int64(resumeFrom) + resp.ContentLength)
+		} else {
+			download.expectBytes(0)
+		}
+		_, bodySpan := tracer.Start(ctx, "body", trace.WithAttributes(attribute.Int("resume_from", resumeFrom)))
+		err = copyWithCheckpoints(resourceWriter, resp.Body, validator)
+		resp.Body.Close()
+		endSpan(bodySpan, err)
+		if err == nil {
+			break
+		}
+		if validator == "" || attempt >= s.config.MaxResumeAttempts {
+			return fail(err)
+		}
+		log.Printf("Download of %s interrupted: %v\n", srcUrl, err)
+		if resumeFrom, validator, err = resourceWriter.Resume(); err != nil {
+			return fail(err)
+		}
+	}
+
+	if robotsHead != nil && robots.MetaNoArchive(robotsHead.Bytes(), robots.Agent) {
+		if err := s.applyRobotsPolicy(srcUrl, "its robots meta tag forbids archiving it", robotsNoArchiveTag, &robotsTags); err != nil {
+			return fail(err)
+		}
+	}
+
+	_, storeSpan := tracer.Start(ctx, "store")
+	err = resourceWriter.Close()
+	endSpan(storeSpan, err)
+	if err != nil {
+		return err
+	}
+	if err := s.dsFrom(ctx).AddTags(encodedUrl, robotsTags); err != nil {
+		log.Printf("Failed to tag %s: %v\n", srcUrl, err)
+	}
+	s.publishEvent(ctx, eventCompleted, encodedUrl, srcUrl, nil)
+	_, indexSpan := tracer.Start(ctx, "index")
+	s.indexPage(ctx, encodedUrl, userAgent)
+	indexSpan.End()
+	if captured != nil && captured.Options != nil && captured.Options.Depth > 0 {
+		go s.captureLinkedPages(ctx, encodedUrl, userAgent, *captured.Options)
+	}
+	return nil
+}
+
+// Renders srcUrl in the headless browser and stores the resulting document in
+// resourceWriter. The subresources the page loaded are cached too so that the
+// rendered page doesn't have to fetch them again.
+func (s *Server) renderInto(ctx context.Context, srcUrl string, resourceWriter datastore.ResourceWriter, userAgent string) error {
+	log.Printf("Rendering %s\n", srcUrl)
+	_, span := tracer.Start(ctx, "render")
+	rendered, err := s.pageRenderer.Render(srcUrl, userAgent)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(resourceWriter, rendered.Html); err != nil {
+		return err
+	}
+	for _, subresource := range rendered.Subresources {
+		s.cacheSubresource(ctx, subresource)
+	}
+	return nil
+}
+
+// Stores a subresource loaded while rendering a page unless it is already
+// cached. Failures are only logged since the page can still fetch it later.
+func (s *Server) cacheSubresource(ctx context.Context, subresource renderer.Subresource) {
+	normalizedUrl, err := s.urlNormalizer.Normalize(subresource.Url)
+	if err != nil {
+		log.Printf("Could not normalize subresource url '%s': %v\n", subresource.Url, err)
+		return
+	}
+	encodedUrl, err := encoder.Encode(normalizedUrl)
+	if err != nil {
+		log.Printf("Could not interpret subresource url '%s': %v\n", normalizedUrl, err)
+		return
+	}
+	parsedUrl, err := url.Parse(normalizedUrl)
+	if err != nil {
+		log.Printf("Could not parse subresource url '%s': %v\n", normalizedUrl, err)
+		return
+	}
+	if err := s.settings().typeFilter.Check(subresource.Headers.Get("Content-Type"), parsedUrl.Path); err != nil {
+		log.Printf("Not caching subresource %s: %v\n", normalizedUrl, err)
+		return
+	}
+	resourceWriter, err := s.dsFrom(ctx).TryCreate(normalizedUrl, encodedUrl)
+	if err != nil {
+		log.Printf("Failed to cache subresource %s: %v\n", normalizedUrl, err)
+		return
+	} else if resourceWriter == nil {
+		return
+	}
+	s.publishEvent(ctx, eventCreated, encodedUrl, normalizedUrl, nil)
+	filtered := s.applyStoreRules(parsedUrl.Hostname(), subresource.Headers)
+	resourceWriter.WriteFilteredHeaders(&filtered)
+	resourceWriter.WriteHeaders(&subresource.Headers)
+	resourceWriter.WriteProtocol(subresource.Protocol)
+	// The renderer only hands over successful responses.
+	resourceWriter.WriteStatusCode(200)
+	if _, err := resourceWriter.Write(subresource.Body); err != nil {
+		resourceWriter.Fail(err, time.Now())
+		s.publishEvent(ctx, eventFailed, encodedUrl, normalizedUrl, err)
+		log.Printf("Failed to cache subresource %s: %v\n", normalizedUrl, err)
+		return
+	}
+	if err := resourceWriter.Close(); err != nil {
+		log.Printf("Failed to cache subresource %s: %v\n", normalizedUrl, err)
+		return
+	}
+	s.publishEvent(ctx, eventCompleted, encodedUrl, normalizedUrl, nil)
+}
+
+// Elements whose contents aren't shown as text.
+var unindexedElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+}
+
+// Returns the title and visible text of an HTML document with runs of
+// whitespace collapsed.
+func extractText(doc *html.Node) (string, string) {
+	var title string
+	var text strings.Builder
+	var visit func(node *html.Node)
+	visit = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			if unindexedElements[node.Data] {
+				return
+			}
+			if node.Data == "title" {
+				if title == "" && node.FirstChild != nil {
+					title = strings.Join(strings.Fields(node.FirstChild.Data), " ")
+				}
+				return
+			}
+		}
+		if node.Type == html.TextNode && text.Len() < maxIndexedTextBytes {
+			if words := strings.Fields(node.Data); len(words) != 0 {
+				if text.Len() != 0 {
+					text.WriteByte(' ')
+				}
+				text.WriteString(strings.Join(words, " "))
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			visit(child)
+		}
+	}
+	visit(doc)
+	return title, text.String()
+}
+
+// Returns the distinct http and https URLs an HTML document links to or loads,
+// other than pageUrl itself.
+func (s *Server) extractLinks(doc *html.Node, pageUrl *url.URL) []datastore.Link {
+	seen := map[string]bool{pageUrl.String(): true}
+	var links []datastore.Link
+	var visit func(node *html.Node)
+	visit = func(node *html.Node) {
+		if len(links) >= maxRecordedLinks {
+			return
+		}
+		// Meta content is only sometimes a URL.
+		if node.Type == html.ElementNode && node.Data != "meta" {
+			for _, key := range linkAttrs[node.Data] {
+				value := attrValue(node, key)
+				// Fragments never reach the origin, so they don't make
+				// for a different resource.
+				if i := strings.Index(value, "#"); i >= 0 {
+					value = value[:i]
+				}
+				if value == "" || !isHttpUrl(value, pageUrl) {
+					continue
+				}
+				normalizedUrl, err := s.resolveUrl(value, pageUrl)
+				if err != nil || seen[normalizedUrl] {
+					continue
+				}
+				seen[normalizedUrl] = true
+				encodedUrl, err := encoder.Encode(normalizedUrl)
+				if err != nil {
+					continue
+				}
+				links = append(links, datastore.Link{Url: normalizedUrl, HashedUrl: encodedUrl})
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			visit(child)
+		}
+	}
+	visit(doc)
+	return links
+}
+
+// Makes a freshly cached HTML page findable through search, records its
+// outgoing links, and starts caching the manifest and icons it links to.
+// Failures are only logged since the page itself was cached successfully.
+func (s *Server) indexPage(ctx context.Context, encodedUrl string, userAgent string) {
+	f, err := s.dsFrom(ctx).Open(encodedUrl)
+	if err != nil {
+		log.Printf("Failed to open %s for indexing: %v\n", encodedUrl, err)
+		return
+	}
+	defer f.Close()
+	if cachedContentType(f) != "text/html" {
+		return
+	}
+	doc, err := html.Parse(io.LimitReader(f, maxIndexedPageBytes))
+	if err != nil {
+		log.Printf("Failed to parse %s for indexing: %v\n", f.ResourceURL(), err)
+		return
+	}
+	title, text := extractText(doc)
+	if err := s.dsFrom(ctx).IndexText(encodedUrl, title, text); err != nil {
+		log.Printf("Failed to index %s: %v\n", f.ResourceURL(), err)
+	}
+	pageUrl, err := url.Parse(keyUrl(f.ResourceURL()))
+	if err != nil {
+		log.Printf("Failed to parse %s for links: %v\n", f.ResourceURL(), err)
+		return
+	}
+	if err := s.dsFrom(ctx).RecordLinks(encodedUrl, s.extractLinks(doc, pageUrl)); err != nil {
+		log.Printf("Failed to record links of %s: %v\n", f.ResourceURL(), err)
+	}
+	s.cacheAppResources(ctx, doc, pageUrl, userAgent)
+}
+
+// Returns a validator suitable for an If-Range header if the response can be
+// resumed with a Range request, otherwise "".
+func resumeValidator(resp *http.Response) string {
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return ""
+	}
+	// The body was encoded on the wire and decoded by decodingTransport, so
+	// the bytes stored don't line up with the byte ranges the origin serves.
+	if resp.Uncompressed {
+		return ""
+	}
+	// Weak ETags may not be used with If-Range.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// Returns the first byte position of a 206 response or -1 if it can't be
+// determined.
+func contentRangeStart(resp *http.Response) int {
+	var start, end int
+	var total string
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return -1
+	}
+	return start
+}
+
+// Copies body into resourceWriter, checkpointing every checkpointBytes so that
+// an interrupted download of a large resource can pick up where it left off.
+func copyWithCheckpoints(resourceWriter datastore.ResourceWriter, body io.Reader, validator string) error {
+	for {
+		_, err := io.CopyN(resourceWriter, body, checkpointBytes)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if validator != "" {
+			if err := resourceWriter.Checkpoint(validator); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Error messages often echo the requested URL back, so they must never be
+// interpreted as HTML.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	io.WriteString(w, msg)
+}
+
+// Writes an error response for a resource that could not be cached.
+func (s *Server) writeCacheError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errReadOnly) {
+		writeError(w, 404, "Resource is not cached, and knox is serving read-only.")
+		return
+	}
+	if errors.Is(err, errMaintenance) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+		s.renderPage(w, 503, "maintenance.html", nil)
+		return
+	}
+	if errors.Is(err, errInsufficientStorage) {
+		writeError(w, 507, fmt.Sprintf("Refusing to cache: %v\n", err))
+		return
+	}
+	var blocked hostfilter.BlockedError
+	if errors.As(err, &blocked) {
+		writeError(w, 403, fmt.Sprintf("Refusing to fetch: %v\n", blocked))
+		return
+	}
+	var failure datastore.FetchFailure
+	if errors.As(err, &failure) && failure.Refused {
+		writeError(w, 403, fmt.Sprintf("Refusing to cache: %s\n", failure.Reason))
+		return
+	}
+	if errors.As(err, &failure) {
+		retryIn := time.Until(failure.RetryAfter).Round(time.Second)
+		if retryIn < 0 {
+			retryIn = 0
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryIn.Seconds())))
+		writeError(w, 502, fmt.Sprintf("Origin unreachable: %s\nRetrying after %v.\n", failure.Reason, retryIn))
+		return
+	}
+	writeError(w, 500, fmt.Sprintf("Internal error: %v\n", err))
+}
+
+// How many times to try taking over a download abandoned by another instance
+// before giving up on serving a request.
+const maxTakeoverAttempts = 3
+
+// Caches the requested resource if necessary and opens it, waiting for any
+// in-progress download to finish. Returns whether the copy is stale because
+// it expired and could not be refreshed.
+// Records the access as a cache hit unless this request had to fetch it.
+func (s *Server) openCachedPage(ctx context.Context, encodedUrl, rawUrl string, userAgent string) (datastore.ResourceReader, bool, error) {
+	fetchedAny := false
+	stale := false
+	for attempt := 0; ; attempt += 1 {
+		fetched, err := s.maybeCachePage(ctx, encodedUrl, rawUrl, userAgent)
+		if err != nil {
+			return nil, false, err
+		}
+		if !fetched {
+			fetched, stale, err = s.maybeRefreshExpiredPage(ctx, encodedUrl, rawUrl, userAgent)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		fetchedAny = fetchedAny || fetched
+		_, openSpan := tracer.Start(ctx, "datastore.Open")
+		f, err := s.dsFrom(ctx).Open(encodedUrl)
+		endSpan(openSpan, err)
+		if errors.Is(err, datastore.ErrLeaseExpired) && attempt < maxTakeoverAttempts {
+			log.Printf("Download of %s was abandoned, retrying\n", rawUrl)
+			continue
+		}
+		if err == nil {
+			s.recordAccess(ctx, encodedUrl, !fetchedAny)
+		}
+		return f, stale, err
+	}
+}
+
+// Refreshes the resource if it was cached longer than its TTL ago, as
+// resourceTtlOf decides it. Returns whether it was refreshed and whether
+// the existing copy must be served stale because it could not be refreshed,
+// either just now or during a recent attempt.
+func (s *Server) maybeRefreshExpiredPage(ctx context.Context, encodedUrl, rawUrl string, userAgent string) (bool, bool, error) {
+	if s.config.ReadOnly || s.inMaintenance() {
+		return false, false, nil
+	}
+	progress, err := s.dsFrom(ctx).Progress(encodedUrl)
+	if err != nil {
+		return false, false, err
+	}
+	// Held resources are kept as they were captured, however old.
+	if progress.Status != datastore.ResourceCached || progress.Held {
+		return false, false, nil
+	}
+	resourceTtl := s.resourceTtlOf(ctx, encodedUrl, parseCaptureOptions(progress.CaptureOptions), progress.DownloadStarted)
+	if resourceTtl == 0 || time.Since(progress.DownloadStarted) < resourceTtl {
+		return false, false, nil
+	}
+	if progress.RefreshFailure != nil && time.Now().Before(progress.RefreshFailure.RetryAfter) {
+		return false, true, nil
+	}
+	refreshed, err := s.refreshPage(ctx, encodedUrl, rawUrl, userAgent)
+	if err != nil {
+		// Whatever went wrong, the existing copy is better than nothing.
+		log.Printf("Serving stale copy of %s: %v\n", rawUrl, err)
+		return false, true, nil
+	}
+	return refreshed, false, nil
+}
+
+func (s *Server) recordAccess(ctx context.Context, encodedUrl string, hit bool) {
+	if hit {
+		s.cacheHits.Inc()
+	} else {
+		s.cacheMisses.Inc()
+	}
+	if err := s.dsFrom(ctx).RecordAccess(encodedUrl, hit); err != nil {
+		log.Printf("Failed to record access to %s: %v\n", encodedUrl, err)
+	}
+}
+
+func (s *Server) flushAccessesPeriodically() {
+	defer s.backgroundWork.Done()
+	ticker := time.NewTicker(s.config.AccessFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, store := range s.allDatastores() {
+				if err := store.FlushAccesses(); err != nil {
+					log.Printf("Failed to flush accesses: %v\n", err)
+				}
+			}
+		case <-s.stopBackground:
+			return
+		}
+	}
+}
+
+// Returns the ETag under which a cached resource is served, or "" if its
+// content hash is unknown. Rewritten HTML depends on the host it is served
+// from, so it only gets a weak ETag.
+func cachedEtag(f datastore.ResourceInfo, contentType string) string {
+	if f.ContentHash() == "" {
+		return ""
+	}
+	etag := fmt.Sprintf("\"%s\"", f.ContentHash())
+	if contentType == "text/html" {
+		etag = "W/" + etag
+	}
+	return etag
+}
+
+// Reports whether etag matches one of the entity tags in an If-None-Match
+// header, using the weak comparison required for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the client's copy of a resource is still current according
+// to its conditional request headers. If-None-Match takes precedence over
+// If-Modified-Since.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etag != "" && etagMatches(ifNoneMatch, etag)
+	}
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+	// HTTP dates only have a resolution of one second.
+	return !lastModified.Truncate(time.Second).After(ifModifiedSince)
+}
+
+// Writes the headers a cached resource is served with. Returns the URL it
+// was fetched from and its content type, or false if there is no body to
+// write because the client's copy is current or the URL is bad.
+func (s *Server) writeCachedHeaders(f datastore.ResourceInfo, w http.ResponseWriter, r *http.Request) (*url.URL, string, bool) {
+	parsedUrl, parseErr := url.Parse(keyUrl(f.ResourceURL()))
+	if parseErr != nil {
+		log.Printf("Failed to parse URL %s: %v\n", parsedUrl, parseErr)
+		writeError(w, 400, fmt.Sprintf("Bad URL: %v", parseErr))
+		return nil, "", false
+	}
+	headers := http.Header{}
+	for key, values := range *f.Headers() {
+		headers[key] = values
+	}
+	s.settings().headerFilter.Apply(headerfilter.Serve, parsedUrl.Hostname(), headers)
+	s.transformCspHeaders(headers)
+	for key, values := range headers {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	// Validators describe knox's copy rather than the origin's.
+	contentType := cachedContentType(f)
+	etag := cachedEtag(f, contentType)
+	w.Header().Del("ETag")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	lastModified := f.CapturedAt()
+	w.Header().Del("Last-Modified")
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil, "", false
+	}
+	// Bodies are stored decoded, so a length kept from the origin may not
+	// match, and how long a rewritten body is isn't known without rewriting
+	// it. Clients can show the progress of the rest.
+	w.Header().Del("Content-Length")
+	if !s.transformsBody(captureOptionsOf(f), parsedUrl, contentType) {
+		w.Header().Set("Content-Length", strconv.Itoa(f.RawBytes()))
+	}
+	return parsedUrl, contentType, true
+}
+
+// Whether the body of a resource captured with options is served rewritten
+// rather than as stored.
+func (s *Server) transformsBody(options captureOptions, resourceUrl *url.URL, contentType string) bool {
+	if contentType == "text/html" {
+		return options.rewritesHtml()
+	}
+	return options.rewritesScripts() && s.rewritesScript(resourceUrl, contentType)
+}
+
+func (s *Server) serveExistingPage(encodedUrl string, f datastore.ResourceReader, w http.ResponseWriter, r *http.Request) {
+	defer f.Close()
+	decodedUrl, _ := encoder.Decode(encodedUrl)
+	log.Printf("Serving %s (%s)\n", decodedUrl, encodedUrl)
+	parsedUrl, contentType, ok := s.writeCachedHeaders(f, w, r)
+	if !ok {
+		return
+	}
+	protocol := getProtocol(r)
+	host := s.getHost(r)
+	options := captureOptionsOf(f)
+
+	// Transform the page.
+	if contentType == "text/html" && options.rewritesHtml() {
+		_, span := tracer.Start(r.Context(), "transform")
+		err := s.transformHtml(parsedUrl, f, w, protocol, host)
+		endSpan(span, err)
+		if err != nil {
+			log.Printf("Failed to transform HTML: %v\n", err)
+			writeError(w, 500, fmt.Sprintf("Failed to transform HTML: %v", err))
+			return
+		}
+	} else if options.rewritesScripts() && s.rewritesScript(parsedUrl, contentType) {
+		if err := s.rewriteScriptUrls(parsedUrl, f, w, protocol, host); err != nil {
+			log.Printf("Error serving '%s': %v\n", f.ResourceURL(), err)
+		}
+	} else if gzipped, size, ok := s.storedGzip(r, f); ok {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		if !headerHasToken(w.Header(), "Vary", "Accept-Encoding") {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		weakenEtag(w.Header())
+		if _, err := io.Copy(w, gzipped); err != nil {
+			log.Printf("Error serving '%s': %v\n", f.ResourceURL(), err)
+		}
+	} else {
+		_, err := io.Copy(flushWriter{w}, f)
+		if err != nil {
+			log.Printf("Error serving '%s': %v\n", f.ResourceURL(), err)
+		}
+	}
+}
+
+// Sends each write to the client right away rather than once a buffer
+// fills, so that resources still being downloaded reach it as they arrive.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+func getProtocol(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	return "http"
+}
+
+func (s *Server) getHost(r *http.Request) string {
+	if hostHeader := r.Host; hostHeader != "" {
+		return hostHeader
+	}
+	return s.config.AdvertiseAddress
+}
+
+// Takes on downloading the requested resource unless it is already cached or
+// being downloaded, in which case the writer is nil. Returns a
+// datastore.FetchFailure if a recent attempt to fetch the resource failed.
+func (s *Server) startCachingPage(ctx context.Context, encodedUrl, rawUrl string) (datastore.ResourceWriter, error) {
+	failure, err := s.dsFrom(ctx).Failure(encodedUrl)
+	if err != nil {
+		return nil, err
+	}
+	if failure != nil {
+		return nil, *failure
+	}
+	if s.config.ReadOnly {
+		return nil, s.requireCached(ctx, encodedUrl, errReadOnly)
+	}
+	if s.inMaintenance() {
+		return nil, s.requireCached(ctx, encodedUrl, errMaintenance)
+	}
+
+	parsedUrl, err := url.Parse(keyUrl(rawUrl))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.settings().hostFilter.CheckHost(parsedUrl.Host); err != nil {
+		return nil, err
+	}
+
+	resourceWriter, err := s.dsFrom(ctx).TryCreate(rawUrl, encodedUrl)
+	if resourceWriter != nil {
+		// Checked only once there is a download to start so that what is
+		// cached is still served while space is short.
+		if err := s.checkDiskSpaceFor(ctx); err != nil {
+			resourceWriter.Fail(err, time.Now())
+			return nil, err
+		}
+		s.publishEvent(ctx, eventCreated, encodedUrl, rawUrl, nil)
+	}
+	return resourceWriter, err
+}
+
+// Caches requested resource if it does not exist, otherwise returns immediately.
+// Returns whether the resource was fetched, or a datastore.FetchFailure if a
+// recent attempt to fetch the resource failed.
+func (s *Server) maybeCachePage(ctx context.Context, encodedUrl, rawUrl string, userAgent string) (bool, error) {
+	resourceWriter, err := s.startCachingPage(ctx, encodedUrl, rawUrl)
+	if err != nil {
+		return false, err
+	}
+
+	if resourceWriter != nil {
+		err = s.cachePage(ctx, rawUrl, resourceWriter, userAgent, nil, nil)
+		if err != nil {
+			return true, err
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Returned when asked to refresh the response to a captured request other
+// than a plain GET.
+var errNotRefreshable = errors.New("captured requests are not repeated since they may have side effects")
+
+// Downloads a cached resource again, replacing it once the download completes.
+// Returns false if the resource is not cached or is already being refreshed.
+func (s *Server) refreshPage(ctx context.Context, encodedUrl, rawUrl string, userAgent string) (bool, error) {
+	if s.config.ReadOnly {
+		return false, errReadOnly
+	}
+	if s.inMaintenance() {
+		return false, errMaintenance
+	}
+	if _, _, _, ok := enc.ParseRequestKey(rawUrl); ok {
+		return false, errNotRefreshable
+	}
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return false, err
+	}
+	if err := s.settings().hostFilter.CheckHost(parsedUrl.Host); err != nil {
+		return false, err
+	}
+	resourceWriter, err := s.dsFrom(ctx).TryRefresh(encodedUrl)
+	if err != nil || resourceWriter == nil {
+		return false, err
+	}
+	log.Printf("Refreshing %s\n", rawUrl)
+	// Without the existing headers the origin just sends everything again.
+	var cached *http.Header
+	// Captured again with the options it was captured with, if any.
+	var captured *capturedRequest
+	if existing, err := s.dsFrom(ctx).Open(encodedUrl); err == nil {
+		cached = existing.Headers()
+		captured = capturedWithOptions(rawUrl, existing.CaptureOptions())
+		existing.Close()
+	}
+	if err := s.cachePage(ctx, rawUrl, resourceWriter, userAgent, cached, captured); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+func (s *Server) handlePageRequest(w http.ResponseWriter, r *http.Request) {
+	// Strip the slash
+	prefix := "/c/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, 400, "Bad URI.")
+		return
+	}
+	encodedUrl := r.URL.Path[len(prefix):]
+	// Links issued before the encoding scheme changed are aliases of the
+	// resources they point to.
+	if canonical, err := s.dsFrom(r.Context()).ResolveAlias(encodedUrl); err != nil {
+		s.writeCacheError(w, err)
+		return
+	} else if canonical != "" {
+		http.Redirect(w, r, prefix+canonical, http.StatusMovedPermanently)
+		return
+	}
+	decodedUrl, err := encoder.Decode(encodedUrl)
+	if err != nil {
+		msg := fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl)
+		writeError(w, 400, msg)
+		return
+	}
+	if _, _, _, ok := enc.ParseRequestKey(decodedUrl); ok {
+		s.serveCapturedRequest(encodedUrl, w, r)
+		return
+	}
+
+	normalizedUrl, err := s.urlNormalizer.Normalize(decodedUrl)
+	if err != nil {
+		msg := fmt.Sprintf("Could not normalize requested url '%s'", decodedUrl)
+		writeError(w, 400, msg)
+		return
+	}
+	if normalizedUrl != decodedUrl {
+		// Send the client to the canonical entry so equivalent URLs share one.
+		cachedUrl, err := translateAbsoluteUrlToCachedUrl(normalizedUrl, getProtocol(r), s.getHost(r))
+		if err != nil {
+			writeError(w, 500, fmt.Sprintf("Failed to get cached URL: %v", err))
+			return
+		}
+		http.Redirect(w, r, cachedUrl, http.StatusFound)
+		return
+	}
+
+	if r.Method == "HEAD" && s.serveCachedHead(encodedUrl, w, r) {
+		return
+	}
+	f, stale, err := s.openCachedPage(r.Context(), encodedUrl, decodedUrl, r.Header.Get("User-Agent"))
+	if err != nil {
+		log.Printf("Failed to open file for hash %s: %v", encodedUrl, err)
+		s.writeCacheError(w, err)
+		return
+	}
+	if stale {
+		w.Header().Add("Warning", `110 - "Response is Stale"`)
+		w.Header().Add("Warning", `111 - "Revalidation Failed"`)
+	}
+
+	s.serveExistingPage(encodedUrl, f, w, r)
+	return
+}
+
+// Answers a HEAD for a cached resource from what is stored about it, without
+// opening its body. Returns false, having written nothing, if the resource
+// isn't cached or is due to be refreshed, in which case the request is
+// answered like a GET.
+func (s *Server) serveCachedHead(encodedUrl string, w http.ResponseWriter, r *http.Request) bool {
+	info, err := s.dsFrom(r.Context()).Stat(encodedUrl)
+	if err != nil {
+		if !errors.Is(err, datastore.ErrResourceNotCached) {
+			log.Printf("Failed to look up %s: %v\n", encodedUrl, err)
+		}
+		return false
+	}
+	if resourceTtl := s.resourceTtlOf(r.Context(), encodedUrl, captureOptionsOf(info), info.CapturedAt()); resourceTtl != 0 && time.Since(info.CapturedAt()) >= resourceTtl {
+		return false
+	}
+	s.recordAccess(r.Context(), encodedUrl, true)
+	s.writeCachedHeaders(info, w, r)
+	return true
+}
+
+func queryError(w http.ResponseWriter) {
+	writeError(w, 400, "Invalid query.")
+}
+
+func servedFrom(context context.Context) string {
+	return fmt.Sprint(context.Value(http.LocalAddrContextKey))
+}
+
+type createPageData struct {
+	CachedUrl string
+	// The resource the page follows the download of.
+	EncodedUrl  string
+	ServedFrom  string
+	Bookmarklet htmltemplate.URL
+	CsrfToken   string
+}
+
+// A javascript: link that sends the tab it's clicked in to /capture.
+func (s *Server) bookmarklet(r *http.Request) htmltemplate.URL {
+	captureUrl, _ := json.Marshal(fmt.Sprintf("%s://%s/capture?url=", getProtocol(r), s.getHost(r)))
+	return htmltemplate.URL(fmt.Sprintf("javascript:location.href=%s+encodeURIComponent(location.href)", captureUrl))
+}
+
+func (s *Server) renderCreatePage(w http.ResponseWriter, r *http.Request, cachedUrl, encodedUrl string) {
+	token, err := csrfToken(w, r)
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Internal error: %v", err))
+		return
+	}
+	s.renderPage(w, 200, "create.html", createPageData{
+		CachedUrl:   cachedUrl,
+		EncodedUrl:  encodedUrl,
+		ServedFrom:  servedFrom(r.Context()),
+		Bookmarklet: s.bookmarklet(r),
+		CsrfToken:   token,
+	})
+}
+
+// Shows the create form on a GET and starts caching the URL posted from it
+// on a POST, answering with a page that follows the download. The URL goes in
+// the body so that it stays out of access logs.
+func (s *Server) handleCreatePageRequest(w http.ResponseWriter, r *http.Request) {
+	queries := r.URL.Query()
+	if s.config.ReadOnly {
+		// There is nothing to create, so the list of what is cached is
+		// the place to start.
+		if len(queries) != 0 || r.Method == "POST" {
+			writeReadOnlyError(w, r)
+			return
+		}
+		http.Redirect(w, r, "/admin/list/0", http.StatusFound)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		if len(queries) == 0 {
+			s.renderCreatePage(w, r, "", "")
+			return
+		}
+		// Links and scripts from before the form was posted keep working
+		// through /capture, which the bookmarklet uses as well.
+		requestedUrls, ok := queries["url"]
+		if len(queries) != 1 || !ok || len(requestedUrls) != 1 {
+			queryError(w)
+			return
+		}
+		http.Redirect(w, r, "/capture?"+url.Values{"url": requestedUrls}.Encode(), http.StatusFound)
+	case "POST":
+		if s.isCrossSiteRequest(r) {
+			writeError(w, 403, "Cross-site requests are not allowed.")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxCaptureRequestBytes)
+		if err := r.ParseForm(); err != nil {
+			writeError(w, 400, fmt.Sprintf("Bad form: %v", err))
+			return
+		}
+		if !checkCsrfToken(r) {
+			writeError(w, 403, "The form has expired. Reload the page and try again.")
+			return
+		}
+		rawUrl := r.PostFormValue("url")
+		if rawUrl == "" {
+			writeError(w, 400, "No url was given.")
+			return
+		}
+		requestedUrl, err := s.urlNormalizer.Normalize(rawUrl)
+		if err != nil {
+			writeError(w, 400, fmt.Sprintf("Could not normalize requested url '%s'", rawUrl))
+			return
+		}
+		encodedUrl, err := encoder.Encode(requestedUrl)
+		if err != nil {
+			writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", requestedUrl))
+			return
+		}
+		resourceWriter, err := s.startCachingPage(r.Context(), encodedUrl, requestedUrl)
+		if err != nil {
+			s.writeCacheError(w, err)
+			return
+		}
+		if resourceWriter != nil {
+			go s.cachePage(detachSpan(r.Context()), requestedUrl, resourceWriter, r.Header.Get("User-Agent"), nil, nil)
+		}
+		cachedUrl, err := translateAbsoluteUrlToCachedUrl(requestedUrl, getProtocol(r), s.getHost(r))
+		if err != nil {
+			writeError(w, 500, fmt.Sprintf("Failed to get cached URL: %v", err))
+			return
+		}
+		s.renderCreatePage(w, r, cachedUrl, encodedUrl)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		writeError(w, 405, "Method not allowed.")
+	}
+}
+
+// Starts caching the requested URL without waiting for it and sends the client
+// to the cached copy, or to its progress while it downloads.
+func (s *Server) handleCaptureRequest(w http.ResponseWriter, r *http.Request) {
+	requestedUrls, ok := r.URL.Query()["url"]
+	if !ok || len(requestedUrls) != 1 {
+		queryError(w)
+		return
+	}
+	requestedUrl, err := s.urlNormalizer.Normalize(requestedUrls[0])
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not normalize requested url '%s'", requestedUrls[0]))
+		return
+	}
+	encodedUrl, err := encoder.Encode(requestedUrl)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", requestedUrl))
+		return
+	}
+	resourceWriter, err := s.startCachingPage(r.Context(), encodedUrl, requestedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	if resourceWriter != nil {
+		// The download outlives this request, which ends with the redirect
+		// to the progress page.
+		go s.cachePage(detachSpan(r.Context()), requestedUrl, resourceWriter, r.Header.Get("User-Agent"), nil, nil)
+	} else if status, err := s.dsFrom(r.Context()).Status(encodedUrl); err == nil && status == datastore.ResourceCached {
+		cachedUrl, err := translateAbsoluteUrlToCachedUrl(requestedUrl, getProtocol(r), s.getHost(r))
+		if err != nil {
+			writeError(w, 500, fmt.Sprintf("Failed to get cached URL: %v", err))
+			return
+		}
+		http.Redirect(w, r, cachedUrl, http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/progress/"+encodedUrl, http.StatusFound)
+}
+
+type progressPageData struct {
+	Url      string
+	RawBytes int
+}
+
+// Shows how far along the download of a resource is, reloading until it
+// completes and then sending the client to the cached copy.
+func (s *Server) handleProgressRequest(w http.ResponseWriter, r *http.Request) {
+	prefix := "/progress/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, 404, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	encodedUrl := r.URL.Path[len(prefix):]
+	if _, err := encoder.Decode(encodedUrl); err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl))
+		return
+	}
+	progress, err := s.dsFrom(r.Context()).Progress(encodedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	switch progress.Status {
+	case datastore.ResourceCached:
+		cachedUrl, err := translateAbsoluteUrlToCachedUrl(progress.Url, getProtocol(r), s.getHost(r))
+		if err != nil {
+			writeError(w, 500, fmt.Sprintf("Failed to get cached URL: %v", err))
+			return
+		}
+		http.Redirect(w, r, cachedUrl, http.StatusFound)
+	case datastore.ResourceDownloading:
+		s.renderPage(w, 200, "progress.html", progressPageData{progress.Url, progress.RawBytes})
+	case datastore.ResourceFailed:
+		s.writeCacheError(w, *progress.Failure)
+	default:
+		writeError(w, 404, "Resource is not being cached.")
+	}
+}
+
+// Shortens url for display, with its hostname in Unicode if it is an
+// internationalized one.
+func shortenedUrl(url string) string {
+	url = normalizer.DisplayUrl(url)
+	if utf8.RuneCountInString(url) <= maxUrlDisplaySize {
+		return url
+	}
+	return string([]rune(url)[:maxUrlDisplaySize]) + "..."
+}
+
+type adminListRow struct {
+	datastore.ResourceMetadata
+	CachedUrl  string
+	EncodedUrl string
+	Tags       []string
+}
+
+type adminListData struct {
+	Stats           datastore.ResourceStats
+	HitRatioPercent float64
+	Rows            []adminListRow
+	Page            int
+	PageIndex       int
+	PageCount       int
+	HasPrev         bool
+	PrevPage        int
+	PrevCursor      string
+	HasNext         bool
+	NextPage        int
+	NextCursor      string
+
+	// The content type listed, or empty for all of them.
+	ContentType string
+
+	// The host listed, or empty for all of them.
+	Host string
+
+	// Where to come back to after acting on a resource.
+	ReturnUrl string
+}
+
+// Reads the resources ri lists into rows, looking up the tags of all of them
+// at once rather than one row at a time.
+func (s *Server) adminListRows(ri datastore.ResourceIterator, r *http.Request) []adminListRow {
+	cachePrefix := fmt.Sprintf("%s://%s/c/", getProtocol(r), s.getHost(r))
+	var rows []adminListRow
+	var encodedUrls []string
+	for ri.HasNext() {
+		metadata, err := ri.Next()
+		if err != nil {
+			log.Printf("failed to list entry: %v\n", err)
+			continue
+		}
+		encodedUrl, err := encoder.Encode(metadata.Url)
+		if err != nil {
+			log.Printf("failed to encode %s: %v\n", metadata.Url, err)
+			continue
+		}
+		rows = append(rows, adminListRow{ResourceMetadata: metadata, CachedUrl: cachePrefix + encodedUrl, EncodedUrl: encodedUrl})
+		encodedUrls = append(encodedUrls, encodedUrl)
+	}
+	tags, err := s.dsFrom(r.Context()).TagsOf(encodedUrls)
+	if err != nil {
+		log.Printf("failed to get tags: %v\n", err)
+	}
+	for i := range rows {
+		rows[i].Tags = tags[rows[i].EncodedUrl]
+	}
+	return rows
+}
+
+func (s *Server) handleAdminListRequest(w http.ResponseWriter, r *http.Request) {
+	// TODO: Figure out a way to write resource count and total size at
+	// beginning without first having to iterate through the whole thing.
+
+	if !adminListRegex.MatchString(r.URL.Path) {
+		writeError(w, 400, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+
+	pageNumStr := adminListRegex.FindStringSubmatch(r.URL.Path)[1]
+	pageNum, err := strconv.Atoi(pageNumStr)
+	if err != nil {
+		log.Printf("%v", adminListRegex)
+		writeError(w, 500, fmt.Sprintf("Internal error: %v", err))
+		return
+	}
+	stats, err := s.dsFrom(r.Context()).Stats()
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get global stats: %v\n", err)
+		log.Printf(msg)
+		writeError(w, 500, msg)
+		return
+	}
+	filter := datastore.ListFilter{ContentType: r.FormValue("type"), Host: r.FormValue("host")}
+	var ri datastore.ResourceIterator
+	if before := r.FormValue("before"); before != "" {
+		ri, err = s.dsFrom(r.Context()).ListBefore(before, maxResourcesPerPage, filter)
+	} else if after := r.FormValue("after"); after != "" || pageNum == 0 || filter != (datastore.ListFilter{}) {
+		ri, err = s.dsFrom(r.Context()).ListAfter(after, maxResourcesPerPage, filter)
+	} else {
+		// A page linked to without a cursor, e.g. from an old bookmark.
+		ri, err = s.dsFrom(r.Context()).List(pageNum*maxResourcesPerPage, maxResourcesPerPage)
+	}
+	if errors.Is(err, datastore.ErrBadCursor) {
+		writeError(w, 400, "Malformed cursor.")
+		return
+	} else if err != nil {
+		msg := fmt.Sprintf("Failed to list resources: %v\n", err)
+		log.Printf(msg)
+		writeError(w, 500, msg)
+		return
+	}
+	rows := s.adminListRows(ri, r)
+	var firstCursor, lastCursor string
+	if len(rows) != 0 {
+		firstCursor = rows[0].Cursor
+		lastCursor = rows[len(rows)-1].Cursor
+	}
+
+	pageCount := int((stats.RecordCount + maxResourcesPerPage - 1) / maxResourcesPerPage)
+	if pageCount == 0 {
+		pageCount = 1
+	}
+	hasNext := len(rows) == maxResourcesPerPage && pageNum+1 < pageCount
+	if filter.ContentType != "" || filter.Host != "" {
+		// Only the total across all resources is known.
+		pageCount = 0
+		hasNext = len(rows) == maxResourcesPerPage
+	}
+	s.renderPage(w, 200, "admin_list.html", adminListData{
+		Stats:           stats,
+		HitRatioPercent: 100 * hitRatio(stats),
+		Rows:            rows,
+		Page:            pageNum + 1,
+		PageIndex:       pageNum,
+		PageCount:       pageCount,
+		HasPrev:         pageNum != 0 && firstCursor != "",
+		PrevPage:        pageNum - 1,
+		PrevCursor:      firstCursor,
+		HasNext:         hasNext,
+		NextPage:        pageNum + 1,
+		NextCursor:      lastCursor,
+		ContentType:     filter.ContentType,
+		Host:            filter.Host,
+		ReturnUrl:       r.URL.RequestURI(),
+	})
+}
+
+// Escapes a search snippet and highlights the matches within it.
+func snippetHtml(snippet string) htmltemplate.HTML {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, datastore.SnippetMatchStart, "<mark>")
+	escaped = strings.ReplaceAll(escaped, datastore.SnippetMatchEnd, "</mark>")
+	return htmltemplate.HTML(escaped)
+}
+
+type searchResultRow struct {
+	datastore.SearchResult
+	CachedUrl   string
+	SnippetHtml htmltemplate.HTML
+}
+
+type adminSearchData struct {
+	Query    string
+	Rows     []searchResultRow
+	Page     int
+	HasPrev  bool
+	PrevPage int
+	HasNext  bool
+	NextPage int
+}
+
+func (s *Server) handleAdminSearchRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("q")
+	pageNum, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || pageNum < 0 {
+		pageNum = 0
+	}
+	results, err := s.dsFrom(r.Context()).Search(query, pageNum*maxSearchResultsPerPage, maxSearchResultsPerPage)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to search resources: %v\n", err)
+		log.Printf(msg)
+		writeError(w, 500, msg)
+		return
+	}
+	var rows []searchResultRow
+	for _, result := range results {
+		cachedUrl, err := translateAbsoluteUrlToCachedUrl(result.Url, getProtocol(r), s.getHost(r))
+		if err != nil {
+			log.Printf("failed to get cached URL for %s: %v\n", result.Url, err)
+			continue
+		}
+		rows = append(rows, searchResultRow{result, cachedUrl, snippetHtml(result.Snippet)})
+	}
+	s.renderPage(w, 200, "admin_search.html", adminSearchData{
+		Query:    query,
+		Rows:     rows,
+		Page:     pageNum + 1,
+		HasPrev:  pageNum != 0,
+		PrevPage: pageNum - 1,
+		HasNext:  len(results) == maxSearchResultsPerPage,
+		NextPage: pageNum + 1,
+	})
+}
+
+type adminRewriteData struct {
+	Url        string
+	Rules      []normalizer.RewriteRule
+	Steps      []normalizer.RewriteStep
+	Normalized string
+	Error      string
+
+	// Set if normalizing the result changes it again, which would send
+	// clients from one URL to the next indefinitely.
+	Renormalized string
+}
+
+// Shows how a URL would be rewritten without fetching anything.
+func (s *Server) handleAdminRewriteRequest(w http.ResponseWriter, r *http.Request) {
+	data := adminRewriteData{
+		Url:   r.FormValue("url"),
+		Rules: s.urlNormalizer.RewriteRules(),
+	}
+	if data.Url != "" {
+		var err error
+		data.Normalized, data.Steps, err = s.urlNormalizer.Explain(data.Url)
+		if err != nil {
+			data.Error = err.Error()
+		} else if renormalized, err := s.urlNormalizer.Normalize(data.Normalized); err != nil {
+			data.Error = err.Error()
+		} else if renormalized != data.Normalized {
+			data.Renormalized = renormalized
+		}
+	}
+	s.renderPage(w, 200, "admin_rewrite.html", data)
+}
+
+// How many of the largest resources the usage report lists by default.
+const defaultUsageReportCount = 50
+
+type adminUsageData struct {
+	Stats     datastore.ResourceStats
+	Top       int
+	Largest   []adminListRow
+	Usage     datastore.DiskUsage
+	ReturnUrl string
+}
+
+// Reports what is using the most disk to guide cleanup.
+func (s *Server) handleAdminUsageRequest(w http.ResponseWriter, r *http.Request) {
+	top, err := intQueryParam(r, "top", defaultUsageReportCount)
+	if err != nil || top == 0 {
+		writeError(w, 400, "top must be a positive integer.")
+		return
+	}
+	stats, err := s.dsFrom(r.Context()).Stats()
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Failed to get global stats: %v", err))
+		return
+	}
+	ri, err := s.dsFrom(r.Context()).Largest(0, top)
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Failed to list resources: %v", err))
+		return
+	}
+	usage, err := s.dsFrom(r.Context()).DiskUsage()
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Failed to get disk usage: %v", err))
+		return
+	}
+	s.renderPage(w, 200, "admin_usage.html", adminUsageData{
+		Stats:     stats,
+		Top:       top,
+		Largest:   s.adminListRows(ri, r),
+		Usage:     usage,
+		ReturnUrl: r.URL.RequestURI(),
+	})
+}
+
+// Where to send the browser after an admin action. Forms may ask to come back
+// to the admin page they were submitted from.
+func adminReturnUrl(r *http.Request, fallback string) string {
+	returnUrl := r.FormValue("return")
+	if strings.HasPrefix(returnUrl, "/admin/") {
+		return returnUrl
+	}
+	return fallback
+}
+
+func (s *Server) handleAdminDeleteRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, 405, "Method not allowed.")
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeError(w, 403, "Cross-site requests are not allowed.")
+		return
+	}
+	prefix := "/admin/delete/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, 400, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	encodedUrl := r.URL.Path[len(prefix):]
+	decodedUrl, err := encoder.Decode(encodedUrl)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl))
+		return
+	}
+	err = s.dsFrom(r.Context()).Delete(encodedUrl)
+	if errors.Is(err, datastore.ErrResourceNotCached) {
+		writeError(w, 404, "Resource is not cached.")
+		return
+	} else if errors.Is(err, datastore.ErrResourceBusy) {
+		writeError(w, 409, "Resource is being downloaded. Try again once it's done.")
+		return
+	} else if errors.Is(err, datastore.ErrResourceHeld) {
+		writeError(w, 403, "Resource is under legal hold.")
+		return
+	} else if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	log.Printf("Deleted %s\n", decodedUrl)
+	s.publishEvent(r.Context(), eventDeleted, encodedUrl, decodedUrl, nil)
+	http.Redirect(w, r, adminReturnUrl(r, "/admin/list/0"), http.StatusSeeOther)
+}
+
+type brokenLinkRow struct {
+	datastore.BrokenLink
+	CachedUrl         string
+	CachedReferrerUrl string
+}
+
+type adminLinksData struct {
+	Rows     []brokenLinkRow
+	Page     int
+	HasPrev  bool
+	PrevPage int
+	HasNext  bool
+	NextPage int
+}
+
+func (s *Server) handleAdminLinksRequest(w http.ResponseWriter, r *http.Request) {
+	pageNum, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || pageNum < 0 {
+		pageNum = 0
+	}
+	links, err := s.dsFrom(r.Context()).BrokenLinks(pageNum*maxBrokenLinksPerPage, maxBrokenLinksPerPage)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to list broken links: %v\n", err)
+		log.Printf(msg)
+		writeError(w, 500, msg)
+		return
+	}
+	var rows []brokenLinkRow
+	for _, link := range links {
+		cachedUrl, err := translateAbsoluteUrlToCachedUrl(link.Url, getProtocol(r), s.getHost(r))
+		if err != nil {
+			log.Printf("failed to get cached URL for %s: %v\n", link.Url, err)
+			continue
+		}
+		cachedReferrerUrl, err := translateAbsoluteUrlToCachedUrl(link.ExampleReferrer, getProtocol(r), s.getHost(r))
+		if err != nil {
+			log.Printf("failed to get cached URL for %s: %v\n", link.ExampleReferrer, err)
+			continue
+		}
+		rows = append(rows, brokenLinkRow{link, cachedUrl, cachedReferrerUrl})
+	}
+	s.renderPage(w, 200, "admin_links.html", adminLinksData{
+		Rows:     rows,
+		Page:     pageNum + 1,
+		HasPrev:  pageNum != 0,
+		PrevPage: pageNum - 1,
+		HasNext:  len(links) == maxBrokenLinksPerPage,
+		NextPage: pageNum + 1,
+	})
+}
+
+// Refreshes a resource from the admin list and sends the browser back to the
+// page it came from.
+// Reports whether a browser sent r on behalf of a page from another site,
+// e.g. a form on a malicious page posting to the refresh endpoints. Requests
+// from clients that send neither Sec-Fetch-Site nor Origin, like curl, are
+// let through.
+func (s *Server) isCrossSiteRequest(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		parsedOrigin, err := url.Parse(origin)
+		return err != nil || parsedOrigin.Host != s.getHost(r)
+	}
+	return false
+}
+
+func (s *Server) handleAdminRefreshRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, 405, "Method not allowed.")
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeError(w, 403, "Cross-site requests are not allowed.")
+		return
+	}
+	if !adminRefreshRegex.MatchString(r.URL.Path) {
+		writeError(w, 400, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	encodedUrl := adminRefreshRegex.FindStringSubmatch(r.URL.Path)[1]
+	decodedUrl, err := encoder.Decode(encodedUrl)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl))
+		return
+	}
+	pageNum, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || pageNum < 0 {
+		pageNum = 0
+	}
+	// The list shows the old copy until the refresh completes, so there's
+	// no point in keeping the browser waiting for it. A resource that is
+	// already being refreshed will be up to date soon enough anyway.
+	userAgent := r.Header.Get("User-Agent")
+	go func() {
+		if _, err := s.refreshPage(r.Context(), encodedUrl, decodedUrl, userAgent); err != nil {
+			log.Printf("Failed to refresh %s: %v\n", decodedUrl, err)
+		}
+	}()
+	http.Redirect(w, r, adminReturnUrl(r, fmt.Sprintf("/admin/list/%d", pageNum)), http.StatusSeeOther)
+}
+
+var resourceStatusNames = map[datastore.ResourceStatus]string{
+	datastore.ResourceNotCached:   "not_cached",
+	datastore.ResourceDownloading: "downloading",
+	datastore.ResourceCached:      "cached",
+	datastore.ResourceFailed:      "failed",
+}
+
+type resourceFailureJson struct {
+	Reason     string    `json:"reason"`
+	FailedAt   time.Time `json:"failed_at"`
+	RetryAfter time.Time `json:"retry_after"`
+	Refused    bool      `json:"refused,omitempty"`
+}
+
+type resourceStatusJson struct {
+	Url             string               `json:"url"`
+	State           string               `json:"state"`
+	DownloadStarted *time.Time           `json:"download_started,omitempty"`
+	RawBytes        int                  `json:"raw_bytes"`
+	Protocol        string               `json:"protocol,omitempty"`
+	ContentEncoding string               `json:"content_encoding,omitempty"`
+	Failure         *resourceFailureJson `json:"failure,omitempty"`
+	RefreshFailure  *resourceFailureJson `json:"refresh_failure,omitempty"`
+	Held            bool                 `json:"held,omitempty"`
+}
+
+func newResourceFailureJson(failure *datastore.FetchFailure) *resourceFailureJson {
+	if failure == nil {
+		return nil
+	}
+	return &resourceFailureJson{
+		Reason:     failure.Reason,
+		FailedAt:   failure.FailedAt,
+		RetryAfter: failure.RetryAfter,
+		Refused:    failure.Refused,
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v\n", err)
+	}
+}
+
+func (s *Server) handleResourceApiRequest(w http.ResponseWriter, r *http.Request) {
+	if resourceRefreshRegex.MatchString(r.URL.Path) {
+		s.writable(s.handleResourceRefreshRequest)(w, r)
+		return
+	}
+	if resourceShareRegex.MatchString(r.URL.Path) {
+		s.handleResourceShareRequest(w, r)
+		return
+	}
+	if resourceEventsRegex.MatchString(r.URL.Path) {
+		s.handleResourceEventsRequest(w, r)
+		return
+	}
+	s.handleResourceStatusRequest(w, r)
+}
+
+func (s *Server) handleResourceStatusRequest(w http.ResponseWriter, r *http.Request) {
+	if !resourceStatusRegex.MatchString(r.URL.Path) {
+		writeJson(w, 404, map[string]string{"error": fmt.Sprintf("Bad URI: %s", r.URL.Path)})
+		return
+	}
+	encodedUrl := resourceStatusRegex.FindStringSubmatch(r.URL.Path)[1]
+	decodedUrl, err := encoder.Decode(encodedUrl)
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl)})
+		return
+	}
+	s.writeResourceStatus(w, r, encodedUrl, decodedUrl)
+}
+
+// Downloads the resource again regardless of how recently it was cached and
+// responds with its status once the new copy has replaced the old one.
+func (s *Server) handleResourceRefreshRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJson(w, 405, map[string]string{"error": "Refreshing requires a POST."})
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeJson(w, 403, map[string]string{"error": "Cross-site requests are not allowed."})
+		return
+	}
+	encodedUrl := resourceRefreshRegex.FindStringSubmatch(r.URL.Path)[1]
+	decodedUrl, err := encoder.Decode(encodedUrl)
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl)})
+		return
+	}
+	refreshed, err := s.refreshPage(r.Context(), encodedUrl, decodedUrl, r.Header.Get("User-Agent"))
+	if err != nil {
+		log.Printf("Failed to refresh %s: %v\n", decodedUrl, err)
+		status := 500
+		var blocked hostfilter.BlockedError
+		var failure datastore.FetchFailure
+		if errors.As(err, &blocked) {
+			status = 403
+		} else if errors.As(err, &failure) {
+			status = 502
+		} else if errors.Is(err, errNotRefreshable) {
+			status = 400
+		} else if errors.Is(err, errMaintenance) {
+			status = 503
+		} else if errors.Is(err, errInsufficientStorage) {
+			status = 507
+		} else if errors.Is(err, datastore.ErrResourceHeld) {
+			status = 403
+		}
+		writeJson(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	if !refreshed {
+		status, err := s.dsFrom(r.Context()).Status(encodedUrl)
+		if err != nil {
+			writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Internal error: %v", err)})
+		} else if status == datastore.ResourceCached {
+			writeJson(w, 409, map[string]string{"error": "Resource is already being refreshed."})
+		} else {
+			writeJson(w, 404, map[string]string{"error": "Resource is not cached."})
+		}
+		return
+	}
+	s.writeResourceStatus(w, r, encodedUrl, decodedUrl)
+}
+
+// The largest capture API request accepted, body included.
+const maxCaptureRequestBytes = 8 * 1024 * 1024
+
+// Methods the capture API will send.
+var capturableMethods = map[string]bool{
+	"GET":  true,
+	"POST": true,
+}
+
+// Headers the capture API won't pass on since they describe the request to
+// knox or are set by the client when sending.
+var uncapturedHeaderKeys = []string{
+	// Set by decodingTransport to what knox can decode.
+	"Accept-Encoding",
+	"Connection",
+	"Content-Length",
+	"Host",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type captureRequestJson struct {
+	Method  string              `json:"method"`
+	Url     string              `json:"url"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+
+	// Options, stored with the resource. See captureOptions.
+	Cookies        map[string]string `json:"cookies"`
+	Ttl            string            `json:"ttl"`
+	RewriteHtml    *bool             `json:"rewrite_html"`
+	RewriteScripts *bool             `json:"rewrite_scripts"`
+	Render         *bool             `json:"render"`
+	Depth          int               `json:"depth"`
+}
+
+type captureResponseJson struct {
+	Key       string `json:"key"`
+	CachedUrl string `json:"cached_url"`
+	resourceStatusJson
+}
+
+// Caches the response to an arbitrary request, keyed on its method, URL, and
+// body, and responds with its status once it is cached. The stored response
+// is replayed from its cached URL. Options given with the request are stored
+// with the resource, and are ignored if it is cached already.
+func (s *Server) handleCaptureApiRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJson(w, 405, map[string]string{"error": "Capturing requires a POST."})
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeJson(w, 403, map[string]string{"error": "Cross-site requests are not allowed."})
+		return
+	}
+	var captureReq captureRequestJson
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCaptureRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&captureReq); err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Bad capture request: %v", err)})
+		return
+	}
+	method := strings.ToUpper(captureReq.Method)
+	if method == "" {
+		method = "GET"
+	}
+	if !capturableMethods[method] {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Method '%s' can't be captured.", captureReq.Method)})
+		return
+	}
+	if !isHttpUrl(captureReq.Url, &url.URL{}) {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Could not interpret requested url '%s'", captureReq.Url)})
+		return
+	}
+	requestedUrl, err := s.urlNormalizer.Normalize(captureReq.Url)
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Could not normalize requested url '%s'", captureReq.Url)})
+		return
+	}
+	captured := &capturedRequest{
+		Method: method,
+		Url:    requestedUrl,
+		Header: http.Header{},
+		Body:   []byte(captureReq.Body),
+	}
+	for key, values := range captureReq.Headers {
+		for _, value := range values {
+			captured.Header.Add(key, value)
+		}
+	}
+	for _, key := range uncapturedHeaderKeys {
+		captured.Header.Del(key)
+	}
+	if err := readCaptureOptions(captureReq, captured); err != nil {
+		writeJson(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	// Plain GETs share their entry with everything else that fetches the URL.
+	key := requestedUrl
+	if method != "GET" || len(captured.Body) != 0 {
+		key = enc.RequestKey(method, requestedUrl, captured.Body)
+	}
+	encodedKey, err := encoder.Encode(key)
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Could not interpret requested url '%s'", key)})
+		return
+	}
+
+	resourceWriter, err := s.startCachingPage(r.Context(), encodedKey, key)
+	if err == nil && resourceWriter != nil {
+		err = s.cachePage(r.Context(), key, resourceWriter, r.Header.Get("User-Agent"), nil, captured)
+	} else if err == nil {
+		// Cached already or being captured by someone else, in which case
+		// this waits for them.
+		var f datastore.ResourceReader
+		if f, err = s.dsFrom(r.Context()).Open(encodedKey); err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to capture %s: %v\n", key, err)
+		status := 500
+		var blocked hostfilter.BlockedError
+		var failure datastore.FetchFailure
+		if errors.As(err, &blocked) || (errors.As(err, &failure) && failure.Refused) {
+			status = 403
+		} else if errors.As(err, &failure) {
+			status = 502
+		} else if errors.Is(err, errMaintenance) {
+			status = 503
+		} else if errors.Is(err, errInsufficientStorage) {
+			status = 507
+		}
+		writeJson(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	status, err := s.getResourceStatus(r.Context(), encodedKey, key)
+	if err != nil {
+		log.Printf("Failed to get progress for %s: %v\n", encodedKey, err)
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Internal error: %v", err)})
+		return
+	}
+	cachedUrl, err := translateAbsoluteUrlToCachedUrl(key, getProtocol(r), s.getHost(r))
+	if err != nil {
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Failed to get cached URL: %v", err)})
+		return
+	}
+	writeJson(w, 200, captureResponseJson{encodedKey, cachedUrl, status})
+}
+
+// Replays the stored response to a request captured under a request key. Such
+// responses can only be fetched through the capture API since fetching them
+// takes more than a URL.
+func (s *Server) serveCapturedRequest(encodedKey string, w http.ResponseWriter, r *http.Request) {
+	status, err := s.dsFrom(r.Context()).Status(encodedKey)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	if status == datastore.ResourceNotCached {
+		writeError(w, 404, "Request has not been captured. Capture it with POST /api/v1/capture.")
+		return
+	}
+	f, err := s.dsFrom(r.Context()).Open(encodedKey)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	s.recordAccess(r.Context(), encodedKey, true)
+	s.serveExistingPage(encodedKey, f, w, r)
+}
+
+type searchResultJson struct {
+	Url             string    `json:"url"`
+	CachedUrl       string    `json:"cached_url"`
+	Title           string    `json:"title"`
+	DownloadStarted time.Time `json:"download_started"`
+
+	// HTML-escaped, with each match wrapped in a <mark> element.
+	SnippetHtml string `json:"snippet_html"`
+}
+
+type searchResponseJson struct {
+	Results []searchResultJson `json:"results"`
+}
+
+// Parses an optional non-negative integer query parameter.
+func intQueryParam(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return parsed, nil
+}
+
+func (s *Server) handleSearchApiRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("q")
+	if strings.TrimSpace(query) == "" {
+		writeJson(w, 400, map[string]string{"error": "Missing query."})
+		return
+	}
+	offset, err := intQueryParam(r, "offset", 0)
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	count, err := intQueryParam(r, "count", maxSearchResultsPerPage)
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if count > maxResourcesPerPage {
+		count = maxResourcesPerPage
+	}
+	results, err := s.dsFrom(r.Context()).Search(query, offset, count)
+	if err != nil {
+		log.Printf("Failed to search resources: %v\n", err)
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Internal error: %v", err)})
+		return
+	}
+	resp := searchResponseJson{Results: []searchResultJson{}}
+	for _, result := range results {
+		cachedUrl, err := translateAbsoluteUrlToCachedUrl(result.Url, getProtocol(r), s.getHost(r))
+		if err != nil {
+			log.Printf("failed to get cached URL for %s: %v\n", result.Url, err)
+			continue
+		}
+		resp.Results = append(resp.Results, searchResultJson{
+			Url:             result.Url,
+			CachedUrl:       cachedUrl,
+			Title:           result.Title,
+			DownloadStarted: result.DownloadStarted,
+			SnippetHtml:     string(snippetHtml(result.Snippet)),
+		})
+	}
+	writeJson(w, 200, resp)
+}
+
+type resourceListItemJson struct {
+	Url             string    `json:"url"`
+	CachedUrl       string    `json:"cached_url"`
+	DownloadStarted time.Time `json:"download_started"`
+	RawBytes        int       `json:"raw_bytes"`
+	BytesOnDisk     int       `json:"bytes_on_disk"`
+	AccessCount     int64     `json:"access_count"`
+	ContentType     string    `json:"content_type"`
+	StatusCode      int       `json:"status_code,omitempty"`
+	Cold            bool      `json:"cold"`
+}
+
+type resourceListResponseJson struct {
+	Resources []resourceListItemJson `json:"resources"`
+
+	// Passed as after to get the next page. Empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Lists cached resources, newest first, a page at a time.
+func (s *Server) handleResourceListApiRequest(w http.ResponseWriter, r *http.Request) {
+	count, err := intQueryParam(r, "count", maxSearchResultsPerPage)
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	if count == 0 {
+		count = maxSearchResultsPerPage
+	} else if count > maxResourcesPerPage {
+		count = maxResourcesPerPage
+	}
+	statusCode, err := intQueryParam(r, "status", 0)
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	filter := datastore.ListFilter{ContentType: r.FormValue("content_type"), StatusCode: statusCode}
+	ri, err := s.dsFrom(r.Context()).ListAfter(r.FormValue("after"), count, filter)
+	if errors.Is(err, datastore.ErrBadCursor) {
+		writeJson(w, 400, map[string]string{"error": "Malformed cursor."})
+		return
+	} else if err != nil {
+		log.Printf("Failed to list resources: %v\n", err)
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Internal error: %v", err)})
+		return
+	}
+	resp := resourceListResponseJson{Resources: []resourceListItemJson{}}
+	listed := 0
+	lastCursor := ""
+	for ri.HasNext() {
+		metadata, err := ri.Next()
+		if err != nil {
+			log.Printf("failed to list entry: %v\n", err)
+			continue
+		}
+		listed += 1
+		lastCursor = metadata.Cursor
+		cachedUrl, err := translateAbsoluteUrlToCachedUrl(metadata.Url, getProtocol(r), s.getHost(r))
+		if err != nil {
+			log.Printf("failed to get cached URL for %s: %v\n", metadata.Url, err)
+			continue
+		}
+		resp.Resources = append(resp.Resources, resourceListItemJson{
+			Url:             metadata.Url,
+			CachedUrl:       cachedUrl,
+			DownloadStarted: metadata.DownloadStarted,
+			RawBytes:        metadata.RawBytes,
+			BytesOnDisk:     metadata.BytesOnDisk,
+			AccessCount:     metadata.AccessCount,
+			ContentType:     metadata.ContentType,
+			StatusCode:      metadata.StatusCode,
+			Cold:            metadata.Cold,
+		})
+	}
+	if listed == count {
+		resp.NextCursor = lastCursor
+	}
+	writeJson(w, 200, resp)
+}
+
+func (s *Server) writeResourceStatus(w http.ResponseWriter, r *http.Request, encodedUrl, decodedUrl string) {
+	status, err := s.getResourceStatus(r.Context(), encodedUrl, decodedUrl)
+	if err != nil {
+		log.Printf("Failed to get progress for %s: %v\n", encodedUrl, err)
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Internal error: %v", err)})
+		return
+	}
+	writeJson(w, 200, status)
+}
+
+func (s *Server) getResourceStatus(ctx context.Context, encodedUrl, decodedUrl string) (resourceStatusJson, error) {
+	progress, err := s.dsFrom(ctx).Progress(encodedUrl)
+	if err != nil {
+		return resourceStatusJson{}, err
+	}
+	status := resourceStatusJson{
+		Url:             decodedUrl,
+		State:           resourceStatusNames[progress.Status],
+		RawBytes:        progress.RawBytes,
+		Protocol:        progress.Protocol,
+		ContentEncoding: progress.ContentEncoding,
+		Failure:         newResourceFailureJson(progress.Failure),
+		RefreshFailure:  newResourceFailureJson(progress.RefreshFailure),
+		Held:            progress.Held,
+	}
+	if !progress.DownloadStarted.IsZero() {
+		status.DownloadStarted = &progress.DownloadStarted
+	}
+	return status, nil
+}
+
+// Registers gauges for totals shared by every instance using the datastore.
+func (s *Server) registerDatastoreMetrics() {
+	stat := func(f func(stats datastore.ResourceStats) float64) func() float64 {
+		return func() float64 {
+			stats, err := s.ds.Stats()
+			if err != nil {
+				log.Printf("Failed to get global stats: %v\n", err)
+				return 0
+			}
+			return f(stats)
+		}
+	}
+	s.metricsRegistry.NewGaugeFunc("knox_resources", "Resources in the datastore.", stat(func(stats datastore.ResourceStats) float64 {
+		return float64(stats.RecordCount)
+	}))
+	s.metricsRegistry.NewGaugeFunc("knox_disk_usage_bytes", "Bytes on disk used by cached resources.", stat(func(stats datastore.ResourceStats) float64 {
+		return float64(stats.DiskConsumptionBytes)
+	}))
+	s.metricsRegistry.NewGaugeFunc("knox_datastore_hit_ratio", "Fraction of requests across all instances served from the cache.", stat(func(stats datastore.ResourceStats) float64 {
+		return hitRatio(stats)
+	}))
+	s.metricsRegistry.NewCounterFunc("knox_memory_cache_hits_total", "Cached resources served from memory.", func() float64 {
+		return float64(s.ds.MemoryCacheStats().Hits)
+	})
+	s.metricsRegistry.NewCounterFunc("knox_memory_cache_misses_total", "Cached resources read from disk because they weren't in memory.", func() float64 {
+		return float64(s.ds.MemoryCacheStats().Misses)
+	})
+	s.metricsRegistry.NewGaugeFunc("knox_memory_cache_bytes", "Bytes of bodies kept in memory.", func() float64 {
+		return float64(s.ds.MemoryCacheStats().Bytes)
+	})
+}
+
+func (s *Server) registerDownloadMetrics() {
+	s.metricsRegistry.NewGaugeFunc("knox_downloads_running", "Downloads from origins in progress.", func() float64 {
+		running, _ := s.downloads.counts()
+		return float64(running)
+	})
+	s.metricsRegistry.NewGaugeFunc("knox_downloads_queued", "Downloads waiting for one in progress to finish.", func() float64 {
+		_, waiting := s.downloads.counts()
+		return float64(waiting)
+	})
+}
+
+func hitRatio(stats datastore.ResourceStats) float64 {
+	if stats.Hits+stats.Misses == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+}
+
+func (s *Server) handleServiceWorker(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/javascript")
+	// TODO: Only evaluate this template once.
+	err := s.serviceWorkerTemplate.Execute(w, serviceWorkerData{s.config.AdvertiseAddress})
+	if err != nil {
+		log.Printf("Failed to render service worker: %v\n", err)
+	}
+}
+
+// Sets up the caching proxy described by c and starts its background work.
+// Several servers may run in one process, as long as each has its own
+// datastore root, and a server that was closed may be set up again.
+func New(c Config) (*Server, error) {
+	if err := loadPlugins(c.Plugins); err != nil {
+		return nil, err
+	}
+	s := newServer(c)
+	if err := s.setUpTracing(); err != nil {
+		return nil, fmt.Errorf("Failed to set up tracing: %v", err)
+	}
+	actualDbFile := s.config.DbFile
+	if actualDbFile == "" {
+		actualDbFile = path.Join(s.config.DatastoreRoot, "knox.db")
+	}
+	var err error
+	s.ds, err = datastore.NewFileDatastoreWithOptions(actualDbFile, s.config.DatastoreRoot, s.config.Sqlite)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.start(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Sets up everything New does once the default cache is open. Whatever it
+// got to before failing is undone by Close.
+func (s *Server) start() error {
+	if err := s.ds.CheckSchema(); err != nil {
+		return err
+	}
+	var err error
+	s.ds = s.ds.WithColdTier(s.config.ColdTierRoot)
+	if s.config.MemoryCacheBytes < 0 || s.config.MemoryCacheEntryBytes < 0 {
+		return fmt.Errorf("Memory cache sizes %d and %d must not be negative", s.config.MemoryCacheBytes, s.config.MemoryCacheEntryBytes)
+	}
+	s.ds = s.ds.WithMemoryCache(s.config.MemoryCacheBytes, s.config.MemoryCacheEntryBytes)
+	if s.durability, err = datastore.ParseDurability(s.config.Durability); err != nil {
+		return err
+	}
+	s.ds = s.ds.WithDurability(s.durability)
+	if err := s.openVirtualHosts(s.config.VirtualHosts); err != nil {
+		return fmt.Errorf("Failed to open virtual host: %v", err)
+	}
+	var stripPatterns []string
+	if s.config.StripDefaultTrackingParams {
+		stripPatterns = append(stripPatterns, normalizer.DefaultStripPatterns...)
+	}
+	stripPatterns = append(stripPatterns, s.config.StripQueryParams...)
+	var rewriteRules []normalizer.RewriteRule
+	if s.config.RewriteRulesFile != "" {
+		if rewriteRules, err = normalizer.LoadRewriteRules(s.config.RewriteRulesFile); err != nil {
+			return fmt.Errorf("Failed to load rewrite rules: %v", err)
+		}
+	}
+	s.urlNormalizer, err = normalizer.NewNormalizer(stripPatterns, rewriteRules)
+	if err != nil {
+		return fmt.Errorf("Failed to compile query parameter strip rules: %v", err)
+	}
+	initialSettings, err := newRuntimeSettings(s.config)
+	if err != nil {
+		return err
+	}
+	s.currentSettings.Store(initialSettings)
+	if s.config.AccessFlushInterval <= 0 {
+		return fmt.Errorf("Access flush interval %v is not positive", s.config.AccessFlushInterval)
+	}
+	if s.config.CompressionLevel < gzip.HuffmanOnly || s.config.CompressionLevel > gzip.BestCompression {
+		return fmt.Errorf("Compression level %d is not between %d and %d", s.config.CompressionLevel, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	skipTypes := s.config.SkipCompressionTypes
+	if s.config.SkipCompressionDefaultTypes {
+		skipTypes = append(skipTypes, defaultSkipCompressionTypes...)
+	}
+	s.skipCompressionTypes, err = typefilter.NewTypeList(skipTypes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse content types to skip compressing: %v", err)
+	}
+	keepSchemes := s.config.KeepLinkSchemes
+	if s.config.KeepDefaultLinkSchemes {
+		keepSchemes = append(keepSchemes, defaultKeepLinkSchemes...)
+	}
+	s.keptLinkSchemes = map[string]bool{}
+	for _, scheme := range keepSchemes {
+		if !linkSchemeRegex.MatchString(scheme) {
+			return fmt.Errorf("Bad link scheme %q", scheme)
+		}
+		s.keptLinkSchemes[strings.ToLower(scheme)] = true
+	}
+	if err := s.loadForwardHeaders(); err != nil {
+		return fmt.Errorf("Failed to parse forwarded headers: %v", err)
+	}
+	if s.scriptRewriteHosts, err = hostfilter.NewHostList(s.config.RewriteScriptUrlHosts); err != nil {
+		return fmt.Errorf("Failed to parse script rewriting hosts: %v", err)
+	}
+	if s.config.CspMode != "adapt" && s.config.CspMode != "keep" && s.config.CspMode != "drop" {
+		return fmt.Errorf("Unknown CSP mode %s", s.config.CspMode)
+	}
+	if s.config.RobotsPolicy != robotsIgnore && s.config.RobotsPolicy != robotsFlag && s.config.RobotsPolicy != robotsRefuse {
+		return fmt.Errorf("Unknown robots policy %s", s.config.RobotsPolicy)
+	}
+	if s.retentionRules, err = parseRetentionRules(s.config.RetentionRules); err != nil {
+		return fmt.Errorf("Failed to parse retention rules: %v", err)
+	}
+	s.fetchClient, err = s.newFetchClient()
+	if err != nil {
+		return fmt.Errorf("Failed to configure upstream client: %v", err)
+	}
+	s.pageRenderer = renderer.NewRenderer(renderer.Options{
+		ExecPath:    s.config.HeadlessBrowserPath,
+		NoSandbox:   s.config.HeadlessBrowserNoSandbox,
+		Client:      s.fetchClient,
+		LoadTimeout: s.config.RenderLoadTimeout,
+		IdleTimeout: s.config.RenderIdleTimeout,
+	})
+	if err := s.loadLinkSigningKey(); err != nil {
+		return fmt.Errorf("Failed to load link signing key: %v", err)
+	}
+	if err := s.setUpOidc(); err != nil {
+		return fmt.Errorf("Failed to set up OpenID Connect: %v", err)
+	}
+	if err := s.loadUi(); err != nil {
+		return fmt.Errorf("Failed to load UI: %v", err)
+	}
+	s.downloads = newDownloadQueue(s.config.MaxConcurrentDownloads)
+	s.registerDatastoreMetrics()
+	s.registerDownloadMetrics()
+	s.backgroundWork.Add(1)
+	go s.flushAccessesPeriodically()
+	if s.config.ReplicateTo != "" {
+		if s.config.ReplicationInterval <= 0 {
+			return fmt.Errorf("Replication interval %v is not positive", s.config.ReplicationInterval)
+		}
+		target, err := s.newReplicaTarget(s.config.ReplicateTo)
+		if err != nil {
+			return fmt.Errorf("Failed to open replica: %v", err)
+		}
+		s.backgroundWork.Add(1)
+		go s.replicatePeriodically(target)
+	}
+	if s.config.ColdTierRoot != "" {
+		if s.config.ColdTierAfter <= 0 {
+			return fmt.Errorf("Cold tier idle time %v is not positive", s.config.ColdTierAfter)
+		}
+		s.backgroundWork.Add(1)
+		go s.offloadIdlePeriodically()
+	}
+	// Nothing is deleted with --read-only, though the report still shows
+	// what would be.
+	if len(s.retentionRules) > 0 && !s.config.ReadOnly {
+		if s.config.RetentionInterval <= 0 {
+			return fmt.Errorf("Retention interval %v is not positive", s.config.RetentionInterval)
+		}
+		s.backgroundWork.Add(1)
+		go s.expireResourcesPeriodically()
+	}
+	// Nothing is fetched with --read-only.
+	if s.config.FailureRetries < 0 {
+		return fmt.Errorf("Failure retries %d is negative", s.config.FailureRetries)
+	} else if s.config.FailureRetries > 0 && !s.config.ReadOnly {
+		if s.config.FailureRetryInterval <= 0 {
+			return fmt.Errorf("Failure retry interval %v is not positive", s.config.FailureRetryInterval)
+		}
+		s.backgroundWork.Add(1)
+		go s.retryFailuresPeriodically()
+	}
+	// Jobs are only listed with --read-only, not queued or run.
+	if !s.config.ReadOnly {
+		s.backgroundWork.Add(1)
+		go s.runJobsPeriodically()
+	}
+	if s.config.EventsTo != "" {
+		sink, err := newEventSink(s.config.EventsTo)
+		if err != nil {
+			return fmt.Errorf("Failed to open event sink: %v", err)
+		}
+		s.eventQueue = make(chan cacheEventJson, eventQueueSize)
+		s.backgroundWork.Add(1)
+		go s.publishEventsPeriodically(sink)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleCreatePageRequest)
+	mux.HandleFunc("/c/", s.handlePageRequest)
+	mux.HandleFunc("/capture", s.writable(s.handleCaptureRequest))
+	mux.HandleFunc("/progress/", s.handleProgressRequest)
+	mux.HandleFunc("/admin/list/", s.handleAdminListRequest)
+	mux.HandleFunc("/service-worker.js", s.handleServiceWorker)
+	mux.HandleFunc("/admin/refresh/", s.writable(s.handleAdminRefreshRequest))
+	mux.HandleFunc("/admin/search", s.handleAdminSearchRequest)
+	mux.HandleFunc("/admin/links", s.handleAdminLinksRequest)
+	mux.HandleFunc("/admin/failures", s.handleAdminFailuresRequest)
+	mux.HandleFunc("/admin/retry/", s.writable(s.handleAdminRetryRequest))
+	mux.HandleFunc("/admin/jobs", s.handleAdminJobsRequest)
+	mux.HandleFunc("/admin/jobs/", s.handleAdminJobRequest)
+	mux.HandleFunc("/admin/rewrite", s.handleAdminRewriteRequest)
+	mux.HandleFunc("/admin/usage", s.handleAdminUsageRequest)
+	mux.HandleFunc("/admin/retention", s.handleAdminRetentionRequest)
+	mux.HandleFunc("/admin/delete/", s.writable(s.handleAdminDeleteRequest))
+	mux.HandleFunc("/admin/hold/", s.writable(s.handleAdminHoldRequest))
+	mux.HandleFunc("/admin/headers/", s.handleAdminHeadersRequest)
+	mux.HandleFunc("/admin/events", s.handleAdminEventsRequest)
+	mux.HandleFunc("/admin/import", s.writable(s.handleAdminImportRequest))
+	mux.HandleFunc("/admin/feed.xml", s.handleFeedRequest)
+	mux.HandleFunc("/admin/maintenance", s.handleAdminMaintenanceRequest)
+	mux.HandleFunc("/api/v1/resources", s.handleResourceListApiRequest)
+	mux.HandleFunc("/api/v1/resources/", s.handleResourceApiRequest)
+	mux.HandleFunc("/api/v1/search", s.handleSearchApiRequest)
+	mux.HandleFunc("/api/v1/capture", s.writable(s.handleCaptureApiRequest))
+	mux.HandleFunc("/api/v1/warm", s.writable(s.handleWarmApiRequest))
+	mux.HandleFunc("/api/v1/cache:batch", s.writable(s.handleBatchApiRequest))
+	mux.HandleFunc("/api/v1/batches/", s.handleBatchStatusApiRequest)
+	mux.HandleFunc("/api/v1/jobs", s.handleJobsApiRequest)
+	mux.HandleFunc("/api/v1/jobs/", s.handleJobApiRequest)
+	mux.HandleFunc("/api/v1/replicas", s.writable(s.handleReplicaApiRequest))
+	mux.HandleFunc("/api/v1/stats", s.handleStatsApiRequest)
+	mux.HandleFunc("/api/v1/maintenance", s.handleMaintenanceApiRequest)
+	mux.Handle("/metrics", s.metricsRegistry)
+	mux.HandleFunc("/bundle/", s.handleBundleRequest)
+	mux.HandleFunc("/read/", s.handleReaderRequest)
+	mux.HandleFunc("/pdf/", s.handlePdfRequest)
+	mux.HandleFunc("/manifest/", s.handleManifestRequest)
+	mux.HandleFunc("/s/", s.handleSignedLinkRequest)
+	mux.HandleFunc("/auth/login", s.handleLoginRequest)
+	mux.HandleFunc("/auth/callback", s.handleLoginCallbackRequest)
+	mux.HandleFunc("/auth/logout", s.handleLogoutRequest)
+	mux.Handle("/static/", s.staticHandler)
+	s.handler = traceRequests(s.restrictAdmin(s.requireAdminLogin(s.throttleResponses(s.compressResponses(wrapServeHooks(s.withVirtualHosts(s.withForwardedHeaders(mux))))))), mux)
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Stops the server's background work, like flushing accesses and
+// replicating, writes out the hit and access counts that haven't been flushed
+// yet, and closes the datastore. Call it once the listeners have stopped
+// serving s. s can't be used again afterwards, though New may set up another
+// server with the same Config.
+func (s *Server) Close() error {
+	close(s.stopBackground)
+	s.backgroundWork.Wait()
+	var firstErr error
+	for _, store := range s.allDatastores() {
+		if err := store.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Served only by a Server itself, since they let clients see
+// everything in the cache and change it.
+var adminPathPrefixes = []string{"/admin/", "/api/", "/metrics"}
+
+// Wraps a Server so that it refuses requests for the admin
+// pages, the APIs, and metrics, e.g. to serve cached pages to clients that
+// shouldn't manage the cache.
+func WithoutAdmin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range adminPathPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				writeError(w, 404, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+// How often the progress of downloads in flight is sent to the admin pages'
+// event streams.
+const liveProgressInterval = 1 * time.Second
+
+// How often an idle event stream is written to, so that neither the write
+// timeout nor a proxy in between closes it.
+const liveKeepAliveInterval = 15 * time.Second
+
+// How many events may wait to be sent to a slow event stream before more are
+// dropped.
+const liveSubscriberBufferSize = 100
+
+type activeDownload struct {
+	url        string
+	encodedUrl string
+	// The virtual host whose cache the download is for.
+	host     string
+	rawBytes int64
+	// How big the body will be once complete, or 0 if the origin didn't
+	// say.
+	contentLength int64
+}
+
+func (s *Server) subscribeLiveEvents() chan cacheEventJson {
+	ch := make(chan cacheEventJson, liveSubscriberBufferSize)
+	s.liveMu.Lock()
+	defer s.liveMu.Unlock()
+	s.liveSubscribers[ch] = true
+	return ch
+}
+
+func (s *Server) unsubscribeLiveEvents(ch chan cacheEventJson) {
+	s.liveMu.Lock()
+	defer s.liveMu.Unlock()
+	delete(s.liveSubscribers, ch)
+}
+
+// Sends event to every open event stream that has room for it.
+func (s *Server) broadcastLiveEvent(event cacheEventJson) {
+	s.liveMu.Lock()
+	defer s.liveMu.Unlock()
+	for ch := range s.liveSubscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Ends the event streams open to admin pages, which otherwise only end when
+// their clients go away, so that the listeners serving them can shut down.
+// Clients reconnect to another instance, if there is one, on their own.
+func (s *Server) EndEventStreams() {
+	s.endLiveStreams.Do(func() { close(s.liveStreamsEnded) })
+}
+
+func (s *Server) startTrackingDownload(ctx context.Context, rawUrl, encodedUrl string) *activeDownload {
+	download := &activeDownload{url: rawUrl, encodedUrl: encodedUrl, host: virtualHostFrom(ctx)}
+	s.liveMu.Lock()
+	defer s.liveMu.Unlock()
+	s.activeDownloads[download] = true
+	return download
+}
+
+// Records how big the body will be once complete, from the Content-Length of
+// the response being downloaded.
+func (d *activeDownload) expectBytes(contentLength int64) {
+	atomic.StoreInt64(&d.contentLength, contentLength)
+}
+
+// Returns the download in flight in this instance for encodedUrl in the cache
+// of the virtual host host, or nil if there isn't one.
+func (s *Server) findActiveDownload(host, encodedUrl string) *activeDownload {
+	s.liveMu.Lock()
+	defer s.liveMu.Unlock()
+	for download := range s.activeDownloads {
+		if download.host == host && download.encodedUrl == encodedUrl {
+			return download
+		}
+	}
+	return nil
+}
+
+func (s *Server) stopTrackingDownload(download *activeDownload) {
+	s.liveMu.Lock()
+	defer s.liveMu.Unlock()
+	delete(s.activeDownloads, download)
+}
+
+// Keeps count of the bytes of the body of a download written so far.
+type trackingResourceWriter struct {
+	datastore.ResourceWriter
+	download *activeDownload
+}
+
+func (tw trackingResourceWriter) Write(b []byte) (int, error) {
+	n, err := tw.ResourceWriter.Write(b)
+	atomic.AddInt64(&tw.download.rawBytes, int64(n))
+	return n, err
+}
+
+func (tw trackingResourceWriter) Resume() (int, string, error) {
+	rawBytes, validator, err := tw.ResourceWriter.Resume()
+	if err == nil {
+		atomic.StoreInt64(&tw.download.rawBytes, int64(rawBytes))
+	}
+	return rawBytes, validator, err
+}
+
+func (tw trackingResourceWriter) Reset() error {
+	err := tw.ResourceWriter.Reset()
+	if err == nil {
+		atomic.StoreInt64(&tw.download.rawBytes, 0)
+	}
+	return err
+}
+
+// Returns the progress of the downloads in flight for the cache of the
+// virtual host host, or of the default cache if host is "".
+func (s *Server) progressEvents(host string) []cacheEventJson {
+	now := time.Now()
+	s.liveMu.Lock()
+	defer s.liveMu.Unlock()
+	var events []cacheEventJson
+	for download := range s.activeDownloads {
+		if download.host != host {
+			continue
+		}
+		events = append(events, cacheEventJson{
+			Type:       eventProgress,
+			Time:       now,
+			Url:        download.url,
+			EncodedUrl: download.encodedUrl,
+			RawBytes:   atomic.LoadInt64(&download.rawBytes),
+		})
+	}
+	return events
+}
+
+func writeLiveEvent(w http.ResponseWriter, event cacheEventJson) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+// Streams the lifecycle events of resources as server-sent events, along
+// with the progress of downloads in flight every second, until the client
+// goes away. Only the events of the cache the request is for are sent.
+func (s *Server) handleAdminEventsRequest(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, 500, "Streaming is not supported.")
+		return
+	}
+	events := s.subscribeLiveEvents()
+	defer s.unsubscribeLiveEvents(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	// Tells the client how soon to reconnect once the stream ends.
+	fmt.Fprintf(w, "retry: 1000\n\n")
+	flusher.Flush()
+
+	host := virtualHostFrom(r.Context())
+	progressTicker := time.NewTicker(liveProgressInterval)
+	defer progressTicker.Stop()
+	keepAliveTicker := time.NewTicker(liveKeepAliveInterval)
+	defer keepAliveTicker.Stop()
+	for {
+		var err error
+		select {
+		case event := <-events:
+			if event.Host != host {
+				continue
+			}
+			err = writeLiveEvent(w, event)
+		case <-progressTicker.C:
+			for _, event := range s.progressEvents(host) {
+				if err = writeLiveEvent(w, event); err != nil {
+					break
+				}
+			}
+		case <-keepAliveTicker.C:
+			_, err = fmt.Fprintf(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.liveStreamsEnded:
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// How often /api/v1/resources/<hash>/events checks on the resource it follows.
+const resourceProgressInterval = 250 * time.Millisecond
+
+// What /api/v1/resources/<hash>/events sends about a resource, as a "state"
+// event when its state changes and as a "progress" event when only the bytes
+// downloaded so far do.
+type resourceProgressJson struct {
+	// One of not_cached, downloading, cached, or failed.
+	State    string `json:"state"`
+	RawBytes int64  `json:"raw_bytes"`
+	// Only known for downloads in flight in this instance whose origin sent
+	// a Content-Length.
+	ContentLength int64  `json:"content_length,omitempty"`
+	Percent       *int   `json:"percent,omitempty"`
+	CachedUrl     string `json:"cached_url,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+func (s *Server) getResourceProgress(r *http.Request, encodedUrl string) (resourceProgressJson, error) {
+	progress, err := s.dsFrom(r.Context()).Progress(encodedUrl)
+	if err != nil {
+		return resourceProgressJson{}, err
+	}
+	status := resourceProgressJson{
+		State:    resourceStatusNames[progress.Status],
+		RawBytes: int64(progress.RawBytes),
+	}
+	switch progress.Status {
+	case datastore.ResourceDownloading:
+		// The datastore only hears about the bytes written at each
+		// checkpoint.
+		if download := s.findActiveDownload(virtualHostFrom(r.Context()), encodedUrl); download != nil {
+			status.RawBytes = atomic.LoadInt64(&download.rawBytes)
+			status.ContentLength = atomic.LoadInt64(&download.contentLength)
+		}
+		if status.ContentLength > 0 {
+			percent := int(100 * status.RawBytes / status.ContentLength)
+			if percent > 100 {
+				percent = 100
+			}
+			status.Percent = &percent
+		}
+	case datastore.ResourceCached:
+		// Request keys have no cached URL.
+		status.CachedUrl, _ = translateAbsoluteUrlToCachedUrl(progress.Url, getProtocol(r), s.getHost(r))
+	case datastore.ResourceFailed:
+		status.Error = progress.Failure.Reason
+	}
+	return status, nil
+}
+
+// Streams the progress of the download of one resource as server-sent events
+// until it is cached or fails, or until the client goes away. Streams for
+// resources that aren't cached wait for a download to start.
+func (s *Server) handleResourceEventsRequest(w http.ResponseWriter, r *http.Request) {
+	encodedUrl := resourceEventsRegex.FindStringSubmatch(r.URL.Path)[1]
+	if _, err := encoder.Decode(encodedUrl); err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl)})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJson(w, 500, map[string]string{"error": "Streaming is not supported."})
+		return
+	}
+	events := s.subscribeLiveEvents()
+	defer s.unsubscribeLiveEvents(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "retry: 1000\n\n")
+	flusher.Flush()
+
+	host := virtualHostFrom(r.Context())
+	progressTicker := time.NewTicker(resourceProgressInterval)
+	defer progressTicker.Stop()
+	keepAliveTicker := time.NewTicker(liveKeepAliveInterval)
+	defer keepAliveTicker.Stop()
+	var last resourceProgressJson
+	for {
+		progress, err := s.getResourceProgress(r, encodedUrl)
+		if err != nil {
+			log.Printf("Failed to get progress for %s: %v\n", encodedUrl, err)
+			return
+		}
+		eventType := ""
+		if progress.State != last.State {
+			eventType = "state"
+		} else if progress.RawBytes != last.RawBytes || progress.ContentLength != last.ContentLength {
+			eventType = "progress"
+		}
+		if eventType != "" {
+			data, err := json.Marshal(progress)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		last = progress
+		if progress.State == "cached" || progress.State == "failed" {
+			return
+		}
+	wait:
+		for {
+			select {
+			case event := <-events:
+				if event.Host == host && event.EncodedUrl == encodedUrl {
+					break wait
+				}
+			case <-progressTicker.C:
+				break wait
+			case <-keepAliveTicker.C:
+				if _, err := fmt.Fprintf(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			case <-s.liveStreamsEnded:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gnossen/knoxcache/oidc"
+)
+
+// The roles --oidc-group-role gives people signed in to the admin pages.
+const (
+	// May look at the admin pages but not change anything through them.
+	roleViewer = "viewer"
+	// May do everything the admin pages allow, including releasing legal
+	// holds.
+	roleAdmin = "admin"
+)
+
+// How long a sign-in lasts before people have to sign in again.
+const sessionDuration = 12 * time.Hour
+
+// How long people have to sign in with the provider once sent to it.
+const loginDuration = 10 * time.Minute
+
+const (
+	sessionCookie = "knox_session"
+	loginCookie   = "knox_login"
+)
+
+// The scopes asked for besides openid, for the claims shown in the log.
+var oidcScopes = []string{"email", "profile"}
+
+var oidcClient = &http.Client{Timeout: 30 * time.Second}
+
+// Who signed in, as kept in the session cookie.
+type session struct {
+	Subject string `json:"sub"`
+	Name    string `json:"name,omitempty"`
+	Role    string `json:"role"`
+	Expires int64  `json:"exp"`
+}
+
+// What a sign-in in progress has to check once the provider sends people
+// back, as kept in the login cookie.
+type pendingLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+	Expires  int64  `json:"exp"`
+}
+
+func (s *Server) oidcEnabled() bool {
+	return s.config.OidcIssuer != ""
+}
+
+// Reads the client secret, parses the group roles, and makes the session
+// key for --oidc-issuer.
+func (s *Server) setUpOidc() error {
+	if !s.oidcEnabled() {
+		return nil
+	}
+	if s.config.OidcClientId == "" {
+		return fmt.Errorf("--oidc-client-id is required with --oidc-issuer")
+	}
+	if s.config.OidcClientSecretFile != "" {
+		secret, err := ioutil.ReadFile(s.config.OidcClientSecretFile)
+		if err != nil {
+			return err
+		}
+		if s.oidcClientSecret = strings.TrimSpace(string(secret)); s.oidcClientSecret == "" {
+			return fmt.Errorf("%s is empty", s.config.OidcClientSecretFile)
+		}
+	}
+	s.oidcGroupRoles = map[string]string{}
+	for _, spec := range s.config.OidcGroupRoles {
+		i := strings.LastIndex(spec, "=")
+		if i <= 0 {
+			return fmt.Errorf("expected group=role, got %s", spec)
+		}
+		group, role := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		if role != roleViewer && role != roleAdmin {
+			return fmt.Errorf("unknown role %s in %s; expected %s or %s", role, spec, roleViewer, roleAdmin)
+		}
+		s.oidcGroupRoles[group] = role
+	}
+	s.sessionKey = make([]byte, 32)
+	_, err := rand.Read(s.sessionKey)
+	return err
+}
+
+func (s *Server) getOidcProvider(ctx context.Context) (*oidc.Provider, error) {
+	s.oidcMu.Lock()
+	defer s.oidcMu.Unlock()
+	if s.oidcProvider == nil {
+		p, err := oidc.Discover(ctx, oidcClient, s.config.OidcIssuer)
+		if err != nil {
+			return nil, err
+		}
+		s.oidcProvider = p
+	}
+	return s.oidcProvider, nil
+}
+
+// Returns the highest role that any of groups is given, or "" if none is
+// given one. The group * stands for everyone who signs in.
+func (s *Server) roleForGroups(groups []string) string {
+	role := s.oidcGroupRoles["*"]
+	for _, group := range groups {
+		if role == roleAdmin {
+			break
+		}
+		if groupRole := s.oidcGroupRoles[group]; groupRole != "" {
+			role = groupRole
+		}
+	}
+	return role
+}
+
+// Returns v as JSON along with its signature, for a cookie.
+func (s *Server) signCookieValue(v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Fills in v from a value made by signCookieValue. Reports whether its
+// signature checked out.
+func (s *Server) readCookieValue(value string, v interface{}) bool {
+	i := strings.Index(value, ".")
+	if i < 0 {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, s.sessionKey)
+	mac.Write([]byte(value[:i]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(value[:i])
+	return err == nil && json.Unmarshal(payload, v) == nil
+}
+
+func setCookie(w http.ResponseWriter, r *http.Request, name, value, path string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   getProtocol(r) == "https",
+		HttpOnly: true,
+		// Lax rather than strict so that the cookie is sent along when the
+		// provider redirects back.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearCookie(w http.ResponseWriter, name, path string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: path, MaxAge: -1})
+}
+
+// Returns the session of whoever made r, or nil if they haven't signed in
+// or their session has expired.
+func (s *Server) sessionFrom(r *http.Request) *session {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	var sess session
+	if !s.readCookieValue(cookie.Value, &sess) || time.Now().Unix() > sess.Expires {
+		return nil
+	}
+	return &sess
+}
+
+func (s *Server) oidcRedirectUrl(r *http.Request) string {
+	return fmt.Sprintf("%s://%s/auth/callback", getProtocol(r), s.getHost(r))
+}
+
+// With --oidc-issuer, sends people who haven't signed in to the admin pages
+// off to do so, and refuses changes from those who may only look.
+func (s *Server) requireAdminLogin(handler http.Handler) http.Handler {
+	if !s.oidcEnabled() {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/admin/") {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		readOnlyMethod := r.Method == "GET" || r.Method == "HEAD"
+		sess := s.sessionFrom(r)
+		if sess == nil && readOnlyMethod {
+			http.Redirect(w, r, "/auth/login?"+url.Values{"return": {r.URL.RequestURI()}}.Encode(), http.StatusSeeOther)
+			return
+		} else if sess == nil {
+			writeError(w, 401, "Sign in at /auth/login first.")
+			return
+		}
+		if sess.Role != roleAdmin && !readOnlyMethod {
+			writeError(w, 403, fmt.Sprintf("The %s role may not change anything.", sess.Role))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Sends people to the provider to sign in, to come back to the admin page in
+// the return parameter afterwards.
+func (s *Server) handleLoginRequest(w http.ResponseWriter, r *http.Request) {
+	if !s.oidcEnabled() {
+		writeError(w, 404, "Signing in is not enabled.")
+		return
+	}
+	provider, err := s.getOidcProvider(r.Context())
+	if err != nil {
+		log.Printf("Failed to discover OpenID provider %s: %v\n", s.config.OidcIssuer, err)
+		writeError(w, 502, "The sign-in provider can't be reached.")
+		return
+	}
+	login := pendingLogin{Return: adminReturnUrl(r, "/admin/list/0"), Expires: time.Now().Add(loginDuration).Unix()}
+	for _, value := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *value, err = oidc.RandomString(); err != nil {
+			writeError(w, 500, fmt.Sprintf("Internal error: %v", err))
+			return
+		}
+	}
+	value, err := s.signCookieValue(login)
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Internal error: %v", err))
+		return
+	}
+	setCookie(w, r, loginCookie, value, "/auth/", loginDuration)
+	http.Redirect(w, r, provider.AuthCodeUrl(s.config.OidcClientId, s.oidcRedirectUrl(r), oidcScopes, login.State, login.Nonce, login.Verifier), http.StatusFound)
+}
+
+// Finishes signing in once the provider sends people back with a code.
+func (s *Server) handleLoginCallbackRequest(w http.ResponseWriter, r *http.Request) {
+	if !s.oidcEnabled() {
+		writeError(w, 404, "Signing in is not enabled.")
+		return
+	}
+	var login pendingLogin
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil || !s.readCookieValue(cookie.Value, &login) || time.Now().Unix() > login.Expires {
+		writeError(w, 400, "Sign-in expired. Try again from /auth/login.")
+		return
+	}
+	if !hmac.Equal([]byte(r.FormValue("state")), []byte(login.State)) {
+		writeError(w, 400, "Sign-in state doesn't match. Try again from /auth/login.")
+		return
+	}
+	clearCookie(w, loginCookie, "/auth/")
+	if providerErr := r.FormValue("error"); providerErr != "" {
+		writeError(w, 403, fmt.Sprintf("Sign-in failed: %s %s", providerErr, r.FormValue("error_description")))
+		return
+	}
+	provider, err := s.getOidcProvider(r.Context())
+	if err != nil {
+		log.Printf("Failed to discover OpenID provider %s: %v\n", s.config.OidcIssuer, err)
+		writeError(w, 502, "The sign-in provider can't be reached.")
+		return
+	}
+	idToken, err := provider.Exchange(r.Context(), s.config.OidcClientId, s.oidcClientSecret, s.oidcRedirectUrl(r), r.FormValue("code"), login.Verifier)
+	if err != nil {
+		log.Printf("Failed to sign in: %v\n", err)
+		writeError(w, 502, "The sign-in provider refused the sign-in.")
+		return
+	}
+	claims, err := provider.Verify(r.Context(), idToken, s.config.OidcClientId, login.Nonce, time.Now())
+	if err != nil {
+		log.Printf("Failed to sign in: %v\n", err)
+		writeError(w, 403, "The sign-in couldn't be verified.")
+		return
+	}
+	name := claims.String("email")
+	if name == "" {
+		name = claims.String("preferred_username")
+	}
+	role := s.roleForGroups(claims.Strings(s.config.OidcGroupsClaim))
+	if role == "" {
+		log.Printf("Refused sign-in of %s (%s), none of whose groups has a role\n", claims.String("sub"), name)
+		writeError(w, 403, "None of your groups may use the admin pages.")
+		return
+	}
+	value, err := s.signCookieValue(session{claims.String("sub"), name, role, time.Now().Add(sessionDuration).Unix()})
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Internal error: %v", err))
+		return
+	}
+	log.Printf("%s (%s) signed in as %s\n", claims.String("sub"), name, role)
+	setCookie(w, r, sessionCookie, value, "/", sessionDuration)
+	http.Redirect(w, r, login.Return, http.StatusSeeOther)
+}
+
+func (s *Server) handleLogoutRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, 405, "Method not allowed.")
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeError(w, 403, "Cross-site requests are not allowed.")
+		return
+	}
+	clearCookie(w, sessionCookie, "/")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
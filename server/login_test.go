@@ -0,0 +1,54 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoleForGroups(t *testing.T) {
+	s := newServer(DefaultConfig())
+	s.oidcGroupRoles = map[string]string{"ops": roleViewer, "admins": roleAdmin}
+	cases := []struct {
+		groups []string
+		want   string
+	}{
+		{[]string{"ops"}, roleViewer},
+		{[]string{"admins", "ops"}, roleAdmin},
+		{[]string{"ops", "admins"}, roleAdmin},
+		{[]string{"sales"}, ""},
+		{nil, ""},
+	}
+	for _, tc := range cases {
+		if got := s.roleForGroups(tc.groups); got != tc.want {
+			t.Errorf("Wrong role for %v. got = %q, want = %q", tc.groups, got, tc.want)
+		}
+	}
+	s.oidcGroupRoles["*"] = roleViewer
+	if got := s.roleForGroups([]string{"sales"}); got != roleViewer {
+		t.Errorf("Expected * to give everyone a role. got = %q", got)
+	}
+}
+
+func TestCookieValue(t *testing.T) {
+	s := newServer(DefaultConfig())
+	s.sessionKey = []byte("test key")
+	value, err := s.signCookieValue(session{Subject: "1234", Role: roleViewer, Expires: 1})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var sess session
+	if !s.readCookieValue(value, &sess) || sess.Subject != "1234" || sess.Role != roleViewer {
+		t.Errorf("Wrong session. got = %v", sess)
+	}
+	forged, err := s.signCookieValue(session{Subject: "1234", Role: roleAdmin, Expires: 1})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tampered := strings.SplitN(forged, ".", 2)[0] + "." + strings.SplitN(value, ".", 2)[1]
+	if s.readCookieValue(tampered, &sess) {
+		t.Errorf("Expected a cookie with someone else's signature to be refused.")
+	}
+	if s.readCookieValue("garbage", &sess) {
+		t.Errorf("Expected an unsigned cookie to be refused.")
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Returned during maintenance when asked for a resource that isn't cached, or
+// to refresh one that is.
+var errMaintenance = errors.New("knox is down for maintenance, so nothing new is being cached")
+
+// How soon clients refused during maintenance are told to try again.
+const maintenanceRetryAfter = 5 * time.Minute
+
+func (s *Server) inMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenanceMode) != 0
+}
+
+func (s *Server) setMaintenance(on bool) {
+	var mode int32
+	if on {
+		mode = 1
+	}
+	if atomic.SwapInt32(&s.maintenanceMode, mode) != mode {
+		if on {
+			log.Printf("Entering maintenance; downloads in flight will finish but no new ones will start\n")
+		} else {
+			log.Printf("Leaving maintenance\n")
+		}
+	}
+}
+
+type maintenanceJson struct {
+	Maintenance      bool `json:"maintenance"`
+	DownloadsRunning int  `json:"downloads_running"`
+	DownloadsQueued  int  `json:"downloads_queued"`
+	// Whether knox is in maintenance and every download has finished, so
+	// that it can be stopped or backed up.
+	Drained bool `json:"drained"`
+}
+
+func (s *Server) maintenanceStatus() maintenanceJson {
+	running, queued := s.downloads.counts()
+	on := s.inMaintenance()
+	return maintenanceJson{on, running, queued, on && running == 0 && queued == 0}
+}
+
+// Reports whether knox is in maintenance and how far it is from drained on a
+// GET, and enters or leaves maintenance on a POST of {"maintenance": bool}.
+func (s *Server) handleMaintenanceApiRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if s.isCrossSiteRequest(r) {
+			writeJson(w, 403, map[string]string{"error": "Cross-site requests are not allowed."})
+			return
+		}
+		var req struct {
+			Maintenance *bool `json:"maintenance"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Maintenance == nil {
+			writeJson(w, 400, map[string]string{"error": `Expected a body of {"maintenance": true} or {"maintenance": false}.`})
+			return
+		}
+		s.setMaintenance(*req.Maintenance)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJson(w, 405, map[string]string{"error": "Method not allowed."})
+		return
+	}
+	writeJson(w, 200, s.maintenanceStatus())
+}
+
+// Enters maintenance if the form's enable field is true and leaves it
+// otherwise, then goes back to the admin page it was sent from.
+func (s *Server) handleAdminMaintenanceRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, 405, "Method not allowed.")
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeError(w, 403, "Cross-site requests are not allowed.")
+		return
+	}
+	enable, err := strconv.ParseBool(r.FormValue("enable"))
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Bad enable value '%s'", r.FormValue("enable")))
+		return
+	}
+	s.setMaintenance(enable)
+	http.Redirect(w, r, adminReturnUrl(r, "/admin/list/0"), http.StatusSeeOther)
+}
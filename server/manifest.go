@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	enc "github.com/gnossen/knoxcache/encoder"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// The largest web app manifest that is rewritten. Bigger ones are served as
+// they are.
+const maxManifestBytes = 1 << 20
+
+// The link types of the icons cached along with a page, so that they show up
+// for the cached copy without the origin.
+var iconLinkTypes = []string{"icon", "apple-touch-icon", "apple-touch-icon-precomposed", "mask-icon"}
+
+// Reports whether the rel of a <link> includes linkType.
+func hasLinkType(node *html.Node, linkType string) bool {
+	for _, t := range strings.Fields(attrValue(node, "rel")) {
+		if strings.EqualFold(t, linkType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Points a rewritten <link rel=manifest> at /manifest/ rather than /c/, so
+// that the URLs in the manifest point at the cache too.
+func linkManifest(node *html.Node, protocol string, host string) {
+	i, ok := getAttr(node, "href")
+	if !ok {
+		return
+	}
+	cachePrefix := fmt.Sprintf("%s://%s/c/", protocol, host)
+	if strings.HasPrefix(node.Attr[i].Val, cachePrefix) {
+		node.Attr[i].Val = fmt.Sprintf("%s://%s/manifest/%s", protocol, host, node.Attr[i].Val[len(cachePrefix):])
+	}
+}
+
+// Adds a link to the origin's /favicon.ico to a page that doesn't link to an
+// icon, since browsers would otherwise ask knox for its own.
+func (s *Server) addDefaultIcon(doc *html.Node, pageUrl *url.URL, protocol string, host string) {
+	head := findElement(doc, atom.Head)
+	if head == nil {
+		return
+	}
+	if link := s.defaultIconLink(pageUrl, protocol, host); link != nil {
+		head.AppendChild(link)
+	}
+}
+
+// Returns the <link> addDefaultIcon adds, or nil if the page has no origin
+// to link to.
+func (s *Server) defaultIconLink(pageUrl *url.URL, protocol string, host string) *html.Node {
+	if pageUrl.Scheme != "http" && pageUrl.Scheme != "https" {
+		return nil
+	}
+	href, err := s.translateCachedUrl("/favicon.ico", pageUrl, protocol, host)
+	if err != nil {
+		return nil
+	}
+	return &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Link,
+		Data:     "link",
+		Attr:     []html.Attribute{{Key: "rel", Val: "icon"}, {Key: "href", Val: href}},
+	}
+}
+
+func findElement(node *html.Node, a atom.Atom) *html.Node {
+	if node.Type == html.ElementNode && node.DataAtom == a {
+		return node
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Starts caching the manifest and icons a page links to, and the icons in the
+// manifest, without waiting for them. Resources that are cached already are
+// left alone.
+func (s *Server) cacheAppResources(ctx context.Context, doc *html.Node, pageUrl *url.URL, userAgent string) {
+	ctx = withDownloadPriority(ctx, backgroundPriority)
+	var visit func(node *html.Node)
+	visit = func(node *html.Node) {
+		if node.Type == html.ElementNode && node.DataAtom == atom.Link {
+			href := attrValue(node, "href")
+			if href != "" && isHttpUrl(href, pageUrl) {
+				if hasLinkType(node, "manifest") {
+					go s.cacheManifest(ctx, href, pageUrl, userAgent)
+				} else {
+					for _, linkType := range iconLinkTypes {
+						if hasLinkType(node, linkType) {
+							go s.cacheLinkedResource(ctx, href, pageUrl, userAgent)
+							break
+						}
+					}
+				}
+			}
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			visit(c)
+		}
+	}
+	visit(doc)
+}
+
+// Caches the resource at link, resolved against baseUrl, and returns its URL
+// and encoded URL.
+func (s *Server) cacheLinkedResource(ctx context.Context, link string, baseUrl *url.URL, userAgent string) (string, string, error) {
+	if i := strings.Index(link, "#"); i >= 0 {
+		link = link[:i]
+	}
+	normalizedUrl, err := s.resolveUrl(link, baseUrl)
+	if err != nil {
+		return "", "", err
+	}
+	encodedUrl, err := encoder.Encode(normalizedUrl)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := s.maybeCachePage(ctx, encodedUrl, normalizedUrl, userAgent); err != nil {
+		log.Printf("Failed to cache %s: %v\n", normalizedUrl, err)
+		return "", "", err
+	}
+	return normalizedUrl, encodedUrl, nil
+}
+
+func (s *Server) cacheManifest(ctx context.Context, link string, pageUrl *url.URL, userAgent string) {
+	manifestUrl, encodedUrl, err := s.cacheLinkedResource(ctx, link, pageUrl, userAgent)
+	if err != nil {
+		return
+	}
+	f, err := s.dsFrom(ctx).Open(encodedUrl)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var manifest webAppManifest
+	if err := json.NewDecoder(io.LimitReader(f, maxManifestBytes)).Decode(&manifest); err != nil {
+		log.Printf("Failed to parse manifest %s: %v\n", manifestUrl, err)
+		return
+	}
+	baseUrl, err := url.Parse(manifestUrl)
+	if err != nil {
+		return
+	}
+	icons := manifest.Icons
+	for _, shortcut := range manifest.Shortcuts {
+		icons = append(icons, shortcut.Icons...)
+	}
+	for _, icon := range icons {
+		if icon.Src != "" && isHttpUrl(icon.Src, baseUrl) {
+			go s.cacheLinkedResource(ctx, icon.Src, baseUrl, userAgent)
+		}
+	}
+}
+
+// The parts of a web app manifest whose icons are cached along with it.
+type webAppManifest struct {
+	Icons     []manifestImage `json:"icons"`
+	Shortcuts []struct {
+		Icons []manifestImage `json:"icons"`
+	} `json:"shortcuts"`
+}
+
+type manifestImage struct {
+	Src string `json:"src"`
+}
+
+// Rewrites the URLs in a web app manifest, which are relative to the
+// manifest's own URL, to point at the cache. Members that aren't URLs, or
+// that knox doesn't know about, are kept as they are.
+func (s *Server) transformManifest(manifestUrl *url.URL, in io.Reader, out io.Writer, protocol string, host string) error {
+	body, err := ioutil.ReadAll(io.LimitReader(in, maxManifestBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxManifestBytes {
+		return fmt.Errorf("manifest is larger than %d bytes", maxManifestBytes)
+	}
+	var manifest map[string]interface{}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return err
+	}
+	translate := func(value interface{}) interface{} {
+		link, ok := value.(string)
+		if !ok {
+			return value
+		}
+		translated, err := s.translateCachedUrl(link, manifestUrl, protocol, host)
+		if err != nil {
+			return value
+		}
+		return translated
+	}
+	translateImages := func(value interface{}) {
+		images, _ := value.([]interface{})
+		for _, image := range images {
+			if image, ok := image.(map[string]interface{}); ok && image["src"] != nil {
+				image["src"] = translate(image["src"])
+			}
+		}
+	}
+	if manifest["start_url"] != nil {
+		manifest["start_url"] = translate(manifest["start_url"])
+	}
+	if manifest["scope"] != nil {
+		// The start URL is ignored unless it's within the scope, and encoded
+		// URLs don't share the prefixes of the URLs they encode, so the
+		// scope is the whole cache.
+		manifest["scope"] = fmt.Sprintf("%s://%s/c/", protocol, host)
+	}
+	translateImages(manifest["icons"])
+	translateImages(manifest["screenshots"])
+	shortcuts, _ := manifest["shortcuts"].([]interface{})
+	for _, shortcut := range shortcuts {
+		if shortcut, ok := shortcut.(map[string]interface{}); ok {
+			if shortcut["url"] != nil {
+				shortcut["url"] = translate(shortcut["url"])
+			}
+			translateImages(shortcut["icons"])
+		}
+	}
+	return json.NewEncoder(out).Encode(manifest)
+}
+
+// Serves a cached web app manifest, caching it first if it isn't, with its
+// URLs pointing at the cache. Anything that doesn't parse as a manifest is
+// sent to /c/ to be served as it is.
+func (s *Server) handleManifestRequest(w http.ResponseWriter, r *http.Request) {
+	prefix := "/manifest/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, 404, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	encodedUrl := r.URL.Path[len(prefix):]
+	decodedUrl, err := encoder.Decode(encodedUrl)
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl))
+		return
+	}
+	if _, _, _, ok := enc.ParseRequestKey(decodedUrl); ok {
+		http.Redirect(w, r, "/c/"+encodedUrl, http.StatusFound)
+		return
+	}
+	if normalizedUrl, err := s.urlNormalizer.Normalize(decodedUrl); err != nil || normalizedUrl != decodedUrl {
+		writeError(w, 400, fmt.Sprintf("Could not normalize requested url '%s'", decodedUrl))
+		return
+	}
+	f, _, err := s.openCachedPage(r.Context(), encodedUrl, decodedUrl, r.Header.Get("User-Agent"))
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	defer f.Close()
+	manifestUrl, err := url.Parse(keyUrl(f.ResourceURL()))
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Bad URL: %v", err))
+		return
+	}
+	var buf bytes.Buffer
+	if err := s.transformManifest(manifestUrl, f, &buf, getProtocol(r), s.getHost(r)); err != nil {
+		log.Printf("Serving %s without rewriting it as a manifest: %v\n", f.ResourceURL(), err)
+		http.Redirect(w, r, "/c/"+encodedUrl, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	buf.WriteTo(w)
+}
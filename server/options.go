@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+	"golang.org/x/net/html"
+)
+
+// The most levels of links a capture may follow from the page it captures.
+const maxCaptureDepth = 3
+
+// Options a resource is captured with through the capture API. They are
+// stored with it, so that refreshing it captures it the same way and serving
+// it honors them.
+type captureOptions struct {
+	// Sent to the origin with the request, cookies included.
+	Header http.Header `json:"header,omitempty"`
+
+	// How long the resource is served before it is fetched again, in place
+	// of --resource-ttl. Zero means forever.
+	Ttl *time.Duration `json:"ttl,omitempty"`
+
+	// Whether the resource is rewritten to point at the cache when it is
+	// served, if it is HTML or a script rewritten under
+	// --rewrite-script-urls. Both are by default.
+	RewriteHtml    *bool `json:"rewrite_html,omitempty"`
+	RewriteScripts *bool `json:"rewrite_scripts,omitempty"`
+
+	// Whether an HTML page is rendered in the headless browser. It isn't by
+	// default, since the browser only sends the User-Agent of Header.
+	Render *bool `json:"render,omitempty"`
+
+	// How many levels of links to pages on the same host are captured too,
+	// with the same options.
+	Depth int `json:"depth,omitempty"`
+}
+
+// Returns the options a resource was captured with from what
+// ResourceInfo.CaptureOptions returned. Options that can't be read are
+// ignored.
+func parseCaptureOptions(encoded string) captureOptions {
+	var options captureOptions
+	if encoded == "" {
+		return options
+	}
+	if err := json.Unmarshal([]byte(encoded), &options); err != nil {
+		log.Printf("Ignoring unreadable capture options %q: %v\n", encoded, err)
+		return captureOptions{}
+	}
+	return options
+}
+
+func (o captureOptions) encode() string {
+	encoded, _ := json.Marshal(o)
+	return string(encoded)
+}
+
+// Whether o asks for anything other than the defaults.
+func (o captureOptions) empty() bool {
+	return o.encode() == "{}"
+}
+
+// The TTL o asks for, or defaultTtl if it doesn't ask for one.
+func (o captureOptions) ttl(defaultTtl time.Duration) time.Duration {
+	if o.Ttl != nil {
+		return *o.Ttl
+	}
+	return defaultTtl
+}
+
+func (o captureOptions) rewritesHtml() bool {
+	return o.RewriteHtml == nil || *o.RewriteHtml
+}
+
+func (o captureOptions) rewritesScripts() bool {
+	return o.RewriteScripts == nil || *o.RewriteScripts
+}
+
+// Returns the request that refreshes rawUrl the way it was captured with
+// encodedOptions, or nil if it was captured without any.
+func capturedWithOptions(rawUrl string, encodedOptions string) *capturedRequest {
+	if encodedOptions == "" {
+		return nil
+	}
+	options := parseCaptureOptions(encodedOptions)
+	return &capturedRequest{Method: "GET", Url: rawUrl, Header: options.Header, Options: &options}
+}
+
+// Whether HTML fetched for captured, or for an ordinary request if it is nil,
+// is rendered in the headless browser.
+func (s *Server) rendersPage(captured *capturedRequest) bool {
+	if captured == nil {
+		return s.config.HeadlessRender
+	}
+	return captured.Options != nil && captured.Options.Render != nil && *captured.Options.Render && captured.Method == "GET"
+}
+
+// Reads the options of a capture API request into captured. Returns an error
+// describing the first bad one.
+func readCaptureOptions(captureReq captureRequestJson, captured *capturedRequest) error {
+	options := captureOptions{
+		RewriteHtml:    captureReq.RewriteHtml,
+		RewriteScripts: captureReq.RewriteScripts,
+		Render:         captureReq.Render,
+		Depth:          captureReq.Depth,
+	}
+	if captureReq.Ttl != "" {
+		ttl, err := parseAge(strings.ToLower(captureReq.Ttl))
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("Bad ttl '%s'.", captureReq.Ttl)
+		}
+		options.Ttl = &ttl
+	}
+	if options.Depth < 0 || options.Depth > maxCaptureDepth {
+		return fmt.Errorf("Depth must be between 0 and %d.", maxCaptureDepth)
+	}
+	plainGet := captured.Method == "GET" && len(captured.Body) == 0
+	if !plainGet && (options.Depth != 0 || (options.Render != nil && *options.Render)) {
+		return fmt.Errorf("Only plain GETs can be rendered or followed.")
+	}
+	names := make([]string, 0, len(captureReq.Cookies))
+	for name := range captureReq.Cookies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cookie := (&http.Cookie{Name: name, Value: captureReq.Cookies[name]}).String()
+		if cookie == "" {
+			return fmt.Errorf("Bad cookie '%s'.", name)
+		}
+		captured.Header.Add("Cookie", cookie)
+	}
+	// Only plain GETs are ever refreshed, so only their headers are needed
+	// again.
+	if plainGet && len(captured.Header) != 0 {
+		options.Header = captured.Header
+	}
+	if !options.empty() {
+		captured.Options = &options
+	}
+	return nil
+}
+
+// Captures the pages on the same host that the cached page at encodedUrl
+// links to, one at a time, with options one level shallower. Pages that are
+// cached already are left as they are.
+func (s *Server) captureLinkedPages(ctx context.Context, encodedUrl string, userAgent string, options captureOptions) {
+	ctx = withDownloadPriority(ctx, backgroundPriority)
+	links, err := s.sameHostLinks(ctx, encodedUrl)
+	if err != nil {
+		log.Printf("Failed to follow the links of %s: %v\n", encodedUrl, err)
+		return
+	}
+	options.Depth -= 1
+	for _, link := range links {
+		resourceWriter, err := s.startCachingPage(ctx, link.HashedUrl, link.Url)
+		if err != nil {
+			log.Printf("Not following link to %s: %v\n", link.Url, err)
+			continue
+		} else if resourceWriter == nil {
+			continue
+		}
+		linked := options
+		captured := &capturedRequest{Method: "GET", Url: link.Url, Header: options.Header, Options: &linked}
+		if err := s.cachePage(ctx, link.Url, resourceWriter, userAgent, nil, captured); err != nil {
+			log.Printf("Failed to capture linked page %s: %v\n", link.Url, err)
+		}
+	}
+}
+
+// Returns the links of the cached page at encodedUrl, along with its URL, or
+// no links if it isn't HTML.
+func (s *Server) pageLinks(ctx context.Context, encodedUrl string) ([]datastore.Link, *url.URL, error) {
+	f, err := s.dsFrom(ctx).Open(encodedUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	pageUrl, err := url.Parse(keyUrl(f.ResourceURL()))
+	if err != nil || cachedContentType(f) != "text/html" {
+		f.Close()
+		return nil, pageUrl, err
+	}
+	doc, err := html.Parse(io.LimitReader(f, maxIndexedPageBytes))
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.extractLinks(doc, pageUrl), pageUrl, nil
+}
+
+// Returns the links of the cached page at encodedUrl to pages on the same
+// host, or none if it isn't HTML.
+func (s *Server) sameHostLinks(ctx context.Context, encodedUrl string) ([]datastore.Link, error) {
+	allLinks, pageUrl, err := s.pageLinks(ctx, encodedUrl)
+	if err != nil {
+		return nil, err
+	}
+	var links []datastore.Link
+	for _, link := range allLinks {
+		linkUrl, err := url.Parse(link.Url)
+		if err != nil || !strings.EqualFold(linkUrl.Hostname(), pageUrl.Hostname()) {
+			continue
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// Returns the options of a cached resource, or the defaults if it has none.
+func captureOptionsOf(f datastore.ResourceInfo) captureOptions {
+	return parseCaptureOptions(f.CaptureOptions())
+}
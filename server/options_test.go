@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadCaptureOptions(t *testing.T) {
+	s := newServer(DefaultConfig())
+	no := false
+	yes := true
+
+	captured := &capturedRequest{Method: "GET", Url: "http://example.com/", Header: http.Header{"X-Token": {"abc"}}}
+	captureReq := captureRequestJson{Cookies: map[string]string{"b": "2", "a": "1"}, Ttl: "7d", RewriteHtml: &no, Depth: 2}
+	if err := readCaptureOptions(captureReq, captured); err != nil {
+		t.Fatalf("Failed to read options: %v", err)
+	}
+	if got := captured.Header.Values("Cookie"); !reflect.DeepEqual(got, []string{"a=1", "b=2"}) {
+		t.Errorf("Wrong cookies. got = %v", got)
+	}
+	if captured.Options == nil {
+		t.Fatalf("Expected options to be set.")
+	}
+	// Stored and read back the way a refresh sees them.
+	options := parseCaptureOptions(captured.Options.encode())
+	if options.ttl(time.Hour) != 7*24*time.Hour || options.rewritesHtml() || !options.rewritesScripts() || options.Depth != 2 {
+		t.Errorf("Wrong options. got = %+v", options)
+	}
+	if refresh := capturedWithOptions("http://example.com/", captured.Options.encode()); !reflect.DeepEqual(refresh.Header, captured.Header) || s.rendersPage(refresh) {
+		t.Errorf("Wrong refresh request. got = %+v", refresh)
+	}
+
+	// Requests without options store none, and are served like any other.
+	plain := &capturedRequest{Method: "POST", Url: "http://example.com/", Header: http.Header{"X-Token": {"abc"}}, Body: []byte("body")}
+	if err := readCaptureOptions(captureRequestJson{}, plain); err != nil || plain.Options != nil {
+		t.Errorf("Expected no options. got = %+v, %v", plain.Options, err)
+	}
+	if capturedWithOptions("http://example.com/", "") != nil {
+		t.Errorf("Expected no refresh request without options.")
+	}
+	resourceUrl, _ := url.Parse("http://example.com/")
+	if !s.transformsBody(parseCaptureOptions(""), resourceUrl, "text/html") || s.transformsBody(options, resourceUrl, "text/html") {
+		t.Errorf("Expected only pages captured with rewrite_html false to be served as stored.")
+	}
+
+	for _, bad := range []captureRequestJson{
+		{Ttl: "soon"},
+		{Ttl: "-1h"},
+		{Depth: maxCaptureDepth + 1},
+		{Cookies: map[string]string{"a b": "c"}},
+	} {
+		captured := &capturedRequest{Method: "GET", Url: "http://example.com/", Header: http.Header{}}
+		if err := readCaptureOptions(bad, captured); err == nil {
+			t.Errorf("Expected %+v to be refused.", bad)
+		}
+	}
+	post := &capturedRequest{Method: "POST", Url: "http://example.com/", Header: http.Header{}}
+	if err := readCaptureOptions(captureRequestJson{Render: &yes}, post); err == nil {
+		t.Errorf("Expected a POST not to be rendered.")
+	}
+}
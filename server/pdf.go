@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gnossen/knoxcache/datastore"
+	enc "github.com/gnossen/knoxcache/encoder"
+	"github.com/gnossen/knoxcache/renderer"
+)
+
+// Portrait dimensions in inches.
+var paperSizes = map[string][2]float64{
+	"letter":  {8.5, 11},
+	"legal":   {8.5, 14},
+	"tabloid": {11, 17},
+	"a3":      {11.69, 16.54},
+	"a4":      {8.27, 11.69},
+	"a5":      {5.83, 8.27},
+}
+
+const defaultPaperSize = "letter"
+const defaultMarginInches = 0.4
+
+// Inches per unit of length.
+var lengthUnits = map[string]float64{
+	"in": 1,
+	"cm": 1 / 2.54,
+	"mm": 1 / 25.4,
+	"pt": 1.0 / 72,
+	"px": 1.0 / 96,
+}
+
+// Parses a length like "0.5in" or "10mm" into inches.
+func parseLength(length string) (float64, error) {
+	for unit, inches := range lengthUnits {
+		if strings.HasSuffix(length, unit) {
+			magnitude, err := strconv.ParseFloat(strings.TrimSuffix(length, unit), 64)
+			if err != nil || magnitude < 0 {
+				break
+			}
+			return magnitude * inches, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid length '%s'", length)
+}
+
+func parsePdfOptions(query url.Values) (renderer.PdfOptions, error) {
+	sizeName := strings.ToLower(query.Get("size"))
+	if sizeName == "" {
+		sizeName = defaultPaperSize
+	}
+	size, ok := paperSizes[sizeName]
+	if !ok {
+		return renderer.PdfOptions{}, fmt.Errorf("unknown paper size '%s'", sizeName)
+	}
+	opts := renderer.PdfOptions{
+		PaperWidth:  size[0],
+		PaperHeight: size[1],
+		Margin:      defaultMarginInches,
+	}
+	if margin := query.Get("margin"); margin != "" {
+		var err error
+		if opts.Margin, err = parseLength(margin); err != nil {
+			return renderer.PdfOptions{}, err
+		}
+		if 2*opts.Margin >= opts.PaperWidth {
+			return renderer.PdfOptions{}, fmt.Errorf("margin '%s' leaves no room on the page", margin)
+		}
+	}
+	if landscape := query.Get("landscape"); landscape != "" {
+		var err error
+		if opts.Landscape, err = strconv.ParseBool(landscape); err != nil {
+			return renderer.PdfOptions{}, fmt.Errorf("invalid landscape '%s'", landscape)
+		}
+	}
+	return opts, nil
+}
+
+// Answers the requests made while printing a page from the cache, caching
+// anything that isn't cached yet just as /c/ would.
+func (s *Server) fetchFromCache(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return nil, fmt.Errorf("%s requests can't be answered from the cache", req.Method)
+	}
+	normalizedUrl, err := s.urlNormalizer.Normalize(req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+	encodedUrl, err := encoder.Encode(normalizedUrl)
+	if err != nil {
+		return nil, err
+	}
+	f, _, err := s.openCachedPage(req.Context(), encodedUrl, normalizedUrl, req.Header.Get("User-Agent"))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     f.Headers().Clone(),
+		Body:       f,
+		Request:    req,
+	}, nil
+}
+
+func (s *Server) handlePdfRequest(w http.ResponseWriter, r *http.Request) {
+	prefix := "/pdf/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, 404, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	encodedUrl := r.URL.Path[len(prefix):]
+	if _, err := encoder.Decode(encodedUrl); err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl))
+		return
+	}
+	opts, err := parsePdfOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, 400, fmt.Sprintf("Bad PDF options: %v", err))
+		return
+	}
+	status, err := s.dsFrom(r.Context()).Status(encodedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	if status != datastore.ResourceCached {
+		writeError(w, 404, "Resource is not cached.")
+		return
+	}
+	f, err := s.dsFrom(r.Context()).Open(encodedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	defer f.Close()
+	if cachedContentType(f) != "text/html" {
+		writeError(w, 400, "Only HTML pages can be exported as PDFs.")
+		return
+	}
+	if _, _, _, ok := enc.ParseRequestKey(f.ResourceURL()); ok {
+		writeError(w, 400, "Only pages fetched with plain GETs can be exported as PDFs.")
+		return
+	}
+	pageUrl, err := url.Parse(f.ResourceURL())
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Bad URL: %v", err))
+		return
+	}
+	pdf, err := s.pageRenderer.PrintToPdf(pageUrl.String(), r.Header.Get("User-Agent"), s.fetchFromCache, opts)
+	if err != nil {
+		log.Printf("Failed to print %s: %v\n", pageUrl, err)
+		writeError(w, 500, "Failed to print page.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.pdf\"", pageUrl.Hostname()))
+	w.Write(pdf)
+}
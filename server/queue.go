@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+type downloadPriority int
+
+const (
+	// Downloads someone is waiting on, e.g. from /c/ requests.
+	interactivePriority downloadPriority = iota
+	// Downloads started in bulk, e.g. by the warm API or a bookmarks import.
+	backgroundPriority
+	numDownloadPriorities
+)
+
+type downloadPriorityKey struct{}
+
+// Marks the downloads started with ctx as having priority p.
+func withDownloadPriority(ctx context.Context, p downloadPriority) context.Context {
+	return context.WithValue(ctx, downloadPriorityKey{}, p)
+}
+
+func downloadPriorityFrom(ctx context.Context) downloadPriority {
+	if p, ok := ctx.Value(downloadPriorityKey{}).(downloadPriority); ok {
+		return p
+	}
+	return interactivePriority
+}
+
+type abortableDownloadsKey struct{}
+
+// Marks the downloads started with ctx as being given up on once ctx is done,
+// even after they have started. Otherwise only waiting in the queue is.
+func withAbortableDownloads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, abortableDownloadsKey{}, true)
+}
+
+func downloadsAbortable(ctx context.Context) bool {
+	abortable, _ := ctx.Value(abortableDownloadsKey{}).(bool)
+	return abortable
+}
+
+// Limits how many downloads run at once. Queued downloads start in order of
+// priority, and in the order they were queued within a priority.
+type downloadQueue struct {
+	limit int
+
+	mu      sync.Mutex
+	running int
+	waiting [numDownloadPriorities][]chan struct{}
+}
+
+// A limit of zero lets every download start right away.
+func newDownloadQueue(limit int) *downloadQueue {
+	return &downloadQueue{limit: limit}
+}
+
+// Blocks until a download with priority p may start, or until ctx is done,
+// in which case it gives up its place in the queue and returns ctx's error.
+// The caller has to call release once it is done if acquire succeeds.
+func (q *downloadQueue) acquire(ctx context.Context, p downloadPriority) error {
+	q.mu.Lock()
+	if q.limit == 0 || q.running < q.limit {
+		q.running += 1
+		q.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	q.waiting[p] = append(q.waiting[p], ready)
+	q.mu.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, waiter := range q.waiting[p] {
+		if waiter == ready {
+			q.waiting[p] = append(q.waiting[p][:i:i], q.waiting[p][i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// The slot was handed over just as ctx was done, so pass it on.
+	q.releaseLocked()
+	return ctx.Err()
+}
+
+func (q *downloadQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked()
+}
+
+func (q *downloadQueue) releaseLocked() {
+	for p := range q.waiting {
+		if len(q.waiting[p]) != 0 {
+			// The slot passes straight to the next download, so running
+			// stays the same.
+			close(q.waiting[p][0])
+			q.waiting[p] = q.waiting[p][1:]
+			return
+		}
+	}
+	q.running -= 1
+}
+
+// Returns the number of downloads running and waiting to start.
+func (q *downloadQueue) counts() (int, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting := 0
+	for _, w := range q.waiting {
+		waiting += len(w)
+	}
+	return q.running, waiting
+}
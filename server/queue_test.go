@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDownloadQueue(t *testing.T) {
+	ctx := context.Background()
+	q := newDownloadQueue(1)
+	q.acquire(ctx, backgroundPriority)
+
+	started := make(chan string)
+	start := func(name string, p downloadPriority) {
+		_, before := q.counts()
+		go func() {
+			q.acquire(ctx, p)
+			started <- name
+		}()
+		// Wait for it to be queued so that the order is deterministic.
+		for _, waiting := q.counts(); waiting == before; _, waiting = q.counts() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	start("background1", backgroundPriority)
+	start("background2", backgroundPriority)
+	start("interactive", interactivePriority)
+	if running, waiting := q.counts(); running != 1 || waiting != 3 {
+		t.Fatalf("Wrong counts. got = %d running, %d waiting, want = 1, 3", running, waiting)
+	}
+
+	for _, want := range []string{"interactive", "background1", "background2"} {
+		q.release()
+		select {
+		case got := <-started:
+			if got != want {
+				t.Errorf("Wrong download started. got = %s, want = %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %s to start.", want)
+		}
+	}
+	q.release()
+	if running, waiting := q.counts(); running != 0 || waiting != 0 {
+		t.Errorf("Wrong counts. got = %d running, %d waiting, want = 0, 0", running, waiting)
+	}
+}
+
+func TestDownloadQueueCancel(t *testing.T) {
+	q := newDownloadQueue(1)
+	if err := q.acquire(context.Background(), interactivePriority); err != nil {
+		t.Fatalf("Failed to acquire: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- q.acquire(ctx, backgroundPriority)
+	}()
+	for _, waiting := q.counts(); waiting == 0; _, waiting = q.counts() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Errorf("Wrong error. got = %v, want = %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the canceled download to stop waiting.")
+	}
+	if running, waiting := q.counts(); running != 1 || waiting != 0 {
+		t.Errorf("Wrong counts. got = %d running, %d waiting, want = 1, 0", running, waiting)
+	}
+	q.release()
+	if running, waiting := q.counts(); running != 0 || waiting != 0 {
+		t.Errorf("Wrong counts. got = %d running, %d waiting, want = 0, 0", running, waiting)
+	}
+}
+
+func TestDownloadPriority(t *testing.T) {
+	ctx := context.Background()
+	if p := downloadPriorityFrom(ctx); p != interactivePriority {
+		t.Errorf("Wrong default priority. got = %d, want = %d", p, interactivePriority)
+	}
+	if p := downloadPriorityFrom(withDownloadPriority(ctx, backgroundPriority)); p != backgroundPriority {
+		t.Errorf("Wrong priority. got = %d, want = %d", p, backgroundPriority)
+	}
+}
@@ -0,0 +1,408 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gnossen/knoxcache/datastore"
+	"golang.org/x/net/html"
+)
+
+// Paragraphs shorter than this don't count towards their container's score.
+const minParagraphChars = 25
+
+// Bylines longer than this are probably whole paragraphs that happen to
+// mention the author.
+const maxBylineChars = 100
+
+// Elements dropped from the article along with everything in them.
+var droppedElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+	"nav":      true,
+	"aside":    true,
+	"footer":   true,
+	"form":     true,
+	"button":   true,
+	"input":    true,
+	"select":   true,
+	"textarea": true,
+	"iframe":   true,
+	"object":   true,
+	"embed":    true,
+	"svg":      true,
+	"canvas":   true,
+}
+
+// Elements kept in the article and the attributes they keep. Any other
+// element is replaced by its children.
+var articleElements = map[string][]string{
+	"p":          nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"ul":         nil,
+	"ol":         nil,
+	"li":         nil,
+	"dl":         nil,
+	"dt":         nil,
+	"dd":         nil,
+	"blockquote": nil,
+	"pre":        nil,
+	"code":       nil,
+	"em":         nil,
+	"strong":     nil,
+	"i":          nil,
+	"b":          nil,
+	"sub":        nil,
+	"sup":        nil,
+	"br":         nil,
+	"hr":         nil,
+	"figure":     nil,
+	"figcaption": nil,
+	"table":      nil,
+	"thead":      nil,
+	"tbody":      nil,
+	"tr":         nil,
+	"th":         nil,
+	"td":         nil,
+	"a":          []string{"href"},
+	"img":        []string{"src", "alt"},
+}
+
+// Class names and ids that suggest an element is or isn't the article.
+var unlikelyCandidateRegex = regexp.MustCompile(`(?i)comment|sidebar|footer|menu|nav|share|social|promo|related|advert|sponsor|cookie|banner|subscribe|popup|modal`)
+var likelyCandidateRegex = regexp.MustCompile(`(?i)article|body|content|entry|main|post|story|text`)
+var bylineRegex = regexp.MustCompile(`(?i)byline|author`)
+
+type readerArticle struct {
+	Title     string
+	Byline    string
+	SourceUrl string
+	CachedUrl string
+	Content   htmltemplate.HTML
+}
+
+func attrValue(node *html.Node, key string) string {
+	if i, ok := getAttr(node, key); ok {
+		return node.Attr[i].Val
+	}
+	return ""
+}
+
+// The text of node and its descendants with runs of whitespace collapsed.
+func nodeText(node *html.Node) string {
+	var text strings.Builder
+	var visit func(node *html.Node)
+	visit = func(node *html.Node) {
+		if node.Type == html.TextNode {
+			text.WriteString(node.Data)
+			text.WriteByte(' ')
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			visit(child)
+		}
+	}
+	visit(node)
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+func isUnlikelyCandidate(node *html.Node) bool {
+	if node.Data == "body" || node.Data == "article" || node.Data == "main" {
+		return false
+	}
+	names := attrValue(node, "class") + " " + attrValue(node, "id")
+	return unlikelyCandidateRegex.MatchString(names) && !likelyCandidateRegex.MatchString(names)
+}
+
+// The fraction of node's text that is inside links.
+func linkDensity(node *html.Node) float64 {
+	textLength := len(nodeText(node))
+	if textLength == 0 {
+		return 0
+	}
+	linkLength := 0
+	var visit func(node *html.Node)
+	visit = func(node *html.Node) {
+		if node.Type == html.ElementNode && node.Data == "a" {
+			linkLength += len(nodeText(node))
+			return
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			visit(child)
+		}
+	}
+	visit(node)
+	return float64(linkLength) / float64(textLength)
+}
+
+// Picks the element most likely to hold the article, in the spirit of
+// Readability: every paragraph with enough text credits its parent and, to a
+// lesser degree, its grandparent, and the highest scoring element wins once
+// boilerplate-looking and link-heavy elements are penalized.
+func findArticle(doc *html.Node) *html.Node {
+	scores := map[*html.Node]float64{}
+	var order []*html.Node
+	credit := func(node *html.Node, score float64) {
+		if node == nil || node.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[node]; !ok {
+			order = append(order, node)
+			names := attrValue(node, "class") + " " + attrValue(node, "id")
+			if likelyCandidateRegex.MatchString(names) {
+				scores[node] += 25
+			}
+			if node.Data == "article" || node.Data == "main" {
+				scores[node] += 10
+			}
+		}
+		scores[node] += score
+	}
+	var body *html.Node
+	var visit func(node *html.Node)
+	visit = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			if droppedElements[node.Data] || isUnlikelyCandidate(node) {
+				return
+			}
+			if node.Data == "body" {
+				body = node
+			}
+			if node.Data == "p" || node.Data == "pre" || node.Data == "td" {
+				text := nodeText(node)
+				if len(text) >= minParagraphChars {
+					score := 1 + float64(strings.Count(text, ",")) + float64(len(text)/100)
+					if score > 4 {
+						score = 4
+					}
+					credit(node.Parent, score)
+					if node.Parent != nil {
+						credit(node.Parent.Parent, score/2)
+					}
+				}
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			visit(child)
+		}
+	}
+	visit(doc)
+
+	var best *html.Node
+	bestScore := 0.0
+	for _, node := range order {
+		score := scores[node] * (1 - linkDensity(node))
+		if best == nil || score > bestScore {
+			best = node
+			bestScore = score
+		}
+	}
+	if best == nil {
+		return body
+	}
+	return best
+}
+
+// Returns the page's title, preferring the one it gives for sharing.
+func findTitle(doc *html.Node) string {
+	var title, ogTitle, heading string
+	var visit func(node *html.Node)
+	visit = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			switch node.Data {
+			case "title":
+				if title == "" {
+					title = nodeText(node)
+				}
+			case "meta":
+				if attrValue(node, "property") == "og:title" && ogTitle == "" {
+					ogTitle = strings.TrimSpace(attrValue(node, "content"))
+				}
+			case "h1":
+				if heading == "" {
+					heading = nodeText(node)
+				}
+			case "svg":
+				return
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			visit(child)
+		}
+	}
+	visit(doc)
+	for _, candidate := range []string{ogTitle, title, heading} {
+		if candidate != "" {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func findByline(doc *html.Node) string {
+	var meta, marked string
+	var visit func(node *html.Node)
+	visit = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			if node.Data == "meta" && attrValue(node, "name") == "author" && meta == "" {
+				meta = strings.TrimSpace(attrValue(node, "content"))
+			} else if marked == "" && (attrValue(node, "rel") == "author" || bylineRegex.MatchString(attrValue(node, "class")+" "+attrValue(node, "id"))) {
+				if text := nodeText(node); text != "" && len(text) <= maxBylineChars {
+					marked = text
+				}
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			visit(child)
+		}
+	}
+	visit(doc)
+	if meta != "" {
+		return meta
+	}
+	return marked
+}
+
+// Copies the children of from into a new parent to, keeping only the article
+// elements and attributes. Links and images are pointed at their cached copies.
+func (s *Server) cleanArticle(from *html.Node, to *html.Node, pageUrl *url.URL, protocol string, host string) {
+	for child := from.FirstChild; child != nil; child = child.NextSibling {
+		switch child.Type {
+		case html.TextNode:
+			to.AppendChild(&html.Node{Type: html.TextNode, Data: child.Data})
+		case html.ElementNode:
+			if droppedElements[child.Data] || isUnlikelyCandidate(child) {
+				continue
+			}
+			keptAttrs, ok := articleElements[child.Data]
+			if !ok {
+				s.cleanArticle(child, to, pageUrl, protocol, host)
+				continue
+			}
+			cleaned := &html.Node{Type: html.ElementNode, Data: child.Data, DataAtom: child.DataAtom}
+			for _, key := range keptAttrs {
+				value := attrValue(child, key)
+				// Lazily loaded images keep the real source elsewhere.
+				if key == "src" && attrValue(child, "data-src") != "" {
+					value = attrValue(child, "data-src")
+				}
+				if value == "" {
+					continue
+				}
+				if key == "src" || key == "href" {
+					if !isHttpUrl(value, pageUrl) {
+						continue
+					}
+					translated, err := s.translateCachedUrl(value, pageUrl, protocol, host)
+					if err != nil {
+						continue
+					}
+					value = translated
+				}
+				cleaned.Attr = append(cleaned.Attr, html.Attribute{Key: key, Val: value})
+			}
+			if child.Data == "img" && attrValue(cleaned, "src") == "" {
+				continue
+			}
+			s.cleanArticle(child, cleaned, pageUrl, protocol, host)
+			to.AppendChild(cleaned)
+		}
+	}
+}
+
+// Reports whether link resolves to an http or https URL, as opposed to e.g. a
+// javascript: or mailto: one.
+func isHttpUrl(link string, pageUrl *url.URL) bool {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	resolved := pageUrl.ResolveReference(parsed)
+	return resolved.Scheme == "http" || resolved.Scheme == "https"
+}
+
+func (s *Server) extractArticle(pageUrl *url.URL, in io.Reader, protocol string, host string) (readerArticle, error) {
+	doc, err := html.Parse(in)
+	if err != nil {
+		return readerArticle{}, err
+	}
+	cachedUrl, err := translateAbsoluteUrlToCachedUrl(pageUrl.String(), protocol, host)
+	if err != nil {
+		return readerArticle{}, err
+	}
+	article := readerArticle{
+		Title:     findTitle(doc),
+		Byline:    findByline(doc),
+		SourceUrl: pageUrl.String(),
+		CachedUrl: cachedUrl,
+	}
+	if found := findArticle(doc); found != nil {
+		cleaned := &html.Node{Type: html.DocumentNode}
+		s.cleanArticle(found, cleaned, pageUrl, protocol, host)
+		var buf bytes.Buffer
+		for child := cleaned.FirstChild; child != nil; child = child.NextSibling {
+			if err := html.Render(&buf, child); err != nil {
+				return readerArticle{}, err
+			}
+		}
+		article.Content = htmltemplate.HTML(buf.String())
+	}
+	return article, nil
+}
+
+func (s *Server) handleReaderRequest(w http.ResponseWriter, r *http.Request) {
+	prefix := "/read/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, 404, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	encodedUrl := r.URL.Path[len(prefix):]
+	if _, err := encoder.Decode(encodedUrl); err != nil {
+		writeError(w, 400, fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl))
+		return
+	}
+	status, err := s.dsFrom(r.Context()).Status(encodedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	if status != datastore.ResourceCached {
+		writeError(w, 404, "Resource is not cached.")
+		return
+	}
+	f, err := s.dsFrom(r.Context()).Open(encodedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	defer f.Close()
+	if cachedContentType(f) != "text/html" {
+		writeError(w, 400, "Only HTML pages can be read in reader mode.")
+		return
+	}
+	pageUrl, err := url.Parse(keyUrl(f.ResourceURL()))
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Bad URL: %v", err))
+		return
+	}
+	article, err := s.extractArticle(pageUrl, f, getProtocol(r), s.getHost(r))
+	if err != nil {
+		log.Printf("Failed to extract article from %s: %v\n", f.ResourceURL(), err)
+		writeError(w, 500, "Failed to extract article.")
+		return
+	}
+	s.renderPage(w, 200, "reader.html", article)
+}
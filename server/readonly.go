@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+// Returned with --read-only when asked for a resource that isn't cached, or
+// to change one that is.
+var errReadOnly = errors.New("knox is serving read-only, so nothing can be added to the cache or changed in it")
+
+// Wraps a handler that adds to or changes the cache so that it refuses every
+// request with --read-only.
+func (s *Server) writable(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.ReadOnly {
+			writeReadOnlyError(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeReadOnlyError(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJson(w, 403, map[string]string{"error": errReadOnly.Error()})
+		return
+	}
+	writeError(w, 403, errReadOnly.Error()+".")
+}
+
+// Stands in for startCachingPage while nothing may be downloaded: resources
+// that are cached or being downloaded already are served, and anything else
+// is refused with refusal.
+func (s *Server) requireCached(ctx context.Context, encodedUrl string, refusal error) error {
+	status, err := s.dsFrom(ctx).Status(encodedUrl)
+	if err != nil {
+		return err
+	}
+	if status == datastore.ResourceNotCached {
+		return refusal
+	}
+	return nil
+}
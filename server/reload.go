@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/gnossen/knoxcache/headerfilter"
+	"github.com/gnossen/knoxcache/hostfilter"
+	"github.com/gnossen/knoxcache/throttle"
+	"github.com/gnossen/knoxcache/typefilter"
+)
+
+// The settings that Reload can change while knox runs. They are replaced
+// as a whole, so anything that reads several of them should call settings
+// once and use what it returns throughout.
+type runtimeSettings struct {
+	hostFilter   hostfilter.HostFilter
+	typeFilter   typefilter.TypeFilter
+	headerFilter headerfilter.HeaderFilter
+
+	// Nil when the corresponding cap isn't configured.
+	upstreamLimiter          *throttle.Limiter
+	upstreamHostLimiters     *throttle.KeyedLimiter
+	downstreamLimiter        *throttle.Limiter
+	downstreamClientLimiters *throttle.KeyedLimiter
+
+	resourceTtl   time.Duration
+	failureTtl    time.Duration
+	maxFailureTtl time.Duration
+
+	honorOriginCacheControl bool
+	originTtlMin            time.Duration
+	originTtlMax            time.Duration
+
+	// The clients allowed to reach /admin/ and /api/. Empty allows all.
+	adminNetworks []*net.IPNet
+}
+
+func (s *Server) settings() *runtimeSettings {
+	return s.currentSettings.Load().(*runtimeSettings)
+}
+
+func newRuntimeSettings(c Config) (*runtimeSettings, error) {
+	s := &runtimeSettings{
+		upstreamLimiter:          throttle.NewLimiter(c.UpstreamBandwidth),
+		upstreamHostLimiters:     throttle.NewKeyedLimiter(c.UpstreamBandwidthPerHost),
+		downstreamLimiter:        throttle.NewLimiter(c.DownstreamBandwidth),
+		downstreamClientLimiters: throttle.NewKeyedLimiter(c.DownstreamBandwidthPerClient),
+		resourceTtl:              c.ResourceTtl,
+		failureTtl:               c.FailureTtl,
+		maxFailureTtl:            c.MaxFailureTtl,
+		honorOriginCacheControl:  c.HonorOriginCacheControl,
+		originTtlMin:             c.OriginTtlMin,
+		originTtlMax:             c.OriginTtlMax,
+	}
+	if c.HonorOriginCacheControl && c.OriginTtlMin <= 0 {
+		return nil, fmt.Errorf("Origin TTL minimum %v is not positive", c.OriginTtlMin)
+	}
+	if c.OriginTtlMax != 0 && c.OriginTtlMax < c.OriginTtlMin {
+		return nil, fmt.Errorf("Origin TTL maximum %v is less than the minimum %v", c.OriginTtlMax, c.OriginTtlMin)
+	}
+	var err error
+	deny := c.DenyHosts
+	if !c.AllowPrivateAddresses {
+		deny = append(deny, hostfilter.PrivateNetworks...)
+	}
+	s.hostFilter, err = hostfilter.NewHostFilter(c.AllowHosts, deny)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse host rules: %v", err)
+	}
+	s.typeFilter, err = typefilter.NewTypeFilter(c.AllowContentTypes, c.DenyContentTypes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse content type rules: %v", err)
+	}
+	s.headerFilter, err = newHeaderFilter(c)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse header rules: %v", err)
+	}
+	s.adminNetworks, err = parseAdminNetworks(c.AdminAllowNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse admin networks: %v", err)
+	}
+	return s, nil
+}
+
+// Returns c without the settings that Reload can change.
+func withoutRuntimeSettings(c Config) Config {
+	c.AllowHosts = nil
+	c.DenyHosts = nil
+	c.AllowPrivateAddresses = false
+	c.AllowContentTypes = nil
+	c.DenyContentTypes = nil
+	c.HeaderRulesFile = ""
+	c.SetCookiePolicy = ""
+	c.StripSetCookie = false
+	c.UpstreamBandwidth = 0
+	c.UpstreamBandwidthPerHost = 0
+	c.DownstreamBandwidth = 0
+	c.DownstreamBandwidthPerClient = 0
+	c.ResourceTtl = 0
+	c.FailureTtl = 0
+	c.MaxFailureTtl = 0
+	c.HonorOriginCacheControl = false
+	c.OriginTtlMin = 0
+	c.OriginTtlMax = 0
+	c.AdminAllowNetworks = nil
+	return c
+}
+
+// Applies the settings of c that can change while the server runs: the
+// allowed and denied hosts and content types, the header rules, which are
+// read from their file again, the Set-Cookie policy, the bandwidth caps, the
+// resource and failure TTLs and how far failures back off, whether and how
+// origins' Cache-Control decides TTLs instead, and the networks allowed to
+// manage knox. Requests and downloads in flight carry on,
+// and see the new settings from then on. If any other setting differs from the one the
+// server was started with, it is left as it was and a warning is logged.
+// Nothing changes if c is invalid.
+func (s *Server) Reload(c Config) error {
+	settings, err := newRuntimeSettings(c)
+	if err != nil {
+		return err
+	}
+	s.currentSettings.Store(settings)
+	if !reflect.DeepEqual(withoutRuntimeSettings(c), withoutRuntimeSettings(s.config)) {
+		log.Printf("Some changed settings only take effect after a restart\n")
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+// How many resources are listed at a time while replicating.
+const replicationBatchSize = 100
+
+// Resources that finished this recently are left for the next pass, since
+// transactions that finish at about the same time may commit out of order and
+// the replication cursor only moves forward.
+const replicationSettleTime = 10 * time.Second
+
+// Somewhere completed resources are copied to.
+type replicaTarget interface {
+	put(ctx context.Context, rr datastore.ReplicaResource, body io.Reader) error
+	close() error
+}
+
+// Another datastore, e.g. on a different disk.
+type datastoreReplica struct {
+	ds datastore.FileDatastore
+}
+
+func (r datastoreReplica) put(ctx context.Context, rr datastore.ReplicaResource, body io.Reader) error {
+	return r.ds.PutReplica(rr, body)
+}
+
+func (r datastoreReplica) close() error {
+	return r.ds.Close()
+}
+
+// Another knox instance started with --accept-replicas.
+type knoxReplica struct {
+	url    string
+	client *http.Client
+}
+
+// How a resource's metadata is sent to another knox instance, ahead of its
+// body in the same multipart request.
+type replicaResourceJson struct {
+	HashedUrl        string    `json:"hashed_url"`
+	Url              string    `json:"url"`
+	RequestHeaders   string    `json:"request_headers"`
+	ResponseHeaders  string    `json:"response_headers"`
+	CaptureOptions   string    `json:"capture_options,omitempty"`
+	DownloadStarted  time.Time `json:"download_started"`
+	DownloadFinished time.Time `json:"download_finished"`
+	RawBytes         int       `json:"raw_bytes"`
+	BytesOnDisk      int       `json:"bytes_on_disk"`
+	ContentHash      string    `json:"content_hash"`
+	Protocol         string    `json:"protocol"`
+	ContentEncoding  string    `json:"content_encoding"`
+	StatusCode       int       `json:"status_code"`
+	SingleGzipMember bool      `json:"single_gzip_member,omitempty"`
+}
+
+func (r knoxReplica) put(ctx context.Context, rr datastore.ReplicaResource, body io.Reader) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := func() error {
+			part, err := mw.CreateFormField("metadata")
+			if err != nil {
+				return err
+			}
+			if err := json.NewEncoder(part).Encode(replicaResourceJson(rr)); err != nil {
+				return err
+			}
+			if part, err = mw.CreateFormFile("body", rr.HashedUrl); err != nil {
+				return err
+			}
+			if _, err := io.Copy(part, body); err != nil {
+				return err
+			}
+			return mw.Close()
+		}()
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequestWithContext(ctx, "POST", r.url+"/api/v1/replicas", pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&failure)
+		return fmt.Errorf("%s: %s", res.Status, failure.Error)
+	}
+	return nil
+}
+
+func (r knoxReplica) close() error {
+	r.client.CloseIdleConnections()
+	return nil
+}
+
+// Interprets --replicate-to, which is either the URL of another knox instance
+// or a directory to keep a datastore in.
+func (s *Server) newReplicaTarget(target string) (replicaTarget, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return knoxReplica{strings.TrimRight(target, "/"), &http.Client{}}, nil
+	}
+	if strings.Contains(target, "://") {
+		return nil, fmt.Errorf("unsupported replica %s; expected a directory or an http(s) URL", target)
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+	replicaDs, err := datastore.NewFileDatastoreWithOptions(path.Join(target, "knox.db"), target, s.config.Sqlite)
+	if err != nil {
+		return nil, err
+	}
+	return datastoreReplica{replicaDs}, nil
+}
+
+// Copies every resource that has completed since the last pass to target,
+// moving the replication cursor along as it goes.
+func (s *Server) replicateNewResources(ctx context.Context, target replicaTarget) error {
+	cursor, err := s.ds.ReplicaCursor(s.config.ReplicateTo)
+	if err != nil {
+		return err
+	}
+	before := time.Now().Add(-replicationSettleTime)
+	for {
+		cursors, err := s.ds.FinishedAfter(cursor, before, replicationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(cursors) == 0 {
+			return nil
+		}
+		for _, next := range cursors {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			rr, f, err := s.ds.OpenReplica(next.ID)
+			if err == nil {
+				err = target.put(ctx, rr, f)
+				f.Close()
+				if err == nil {
+					s.resourcesReplicated.Inc()
+				}
+			}
+			// Resources that have gone since they were listed don't need
+			// copying.
+			if err != nil && !errors.Is(err, datastore.ErrResourceNotCached) {
+				return fmt.Errorf("failed to replicate resource %d: %v", next.ID, err)
+			}
+			cursor = next
+			if err := s.ds.SaveReplicaCursor(s.config.ReplicateTo, cursor); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) replicatePeriodically(target replicaTarget) {
+	defer s.backgroundWork.Done()
+	defer func() {
+		if err := target.close(); err != nil {
+			log.Printf("Failed to close replica %s: %v\n", s.config.ReplicateTo, err)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopBackground:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		if err := s.replicateNewResources(ctx, target); err != nil && ctx.Err() == nil {
+			s.replicationFailures.Inc()
+			log.Printf("Replication to %s stopped early: %v\n", s.config.ReplicateTo, err)
+		}
+		select {
+		case <-time.After(s.config.ReplicationInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Stores a resource sent by another knox instance replicating to this one,
+// replacing any copy already here.
+func (s *Server) handleReplicaApiRequest(w http.ResponseWriter, r *http.Request) {
+	if !s.config.AcceptReplicas {
+		writeJson(w, 404, map[string]string{"error": "This instance doesn't accept replicas."})
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJson(w, 405, map[string]string{"error": "Replicating requires a POST."})
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeJson(w, 403, map[string]string{"error": "Cross-site requests are not allowed."})
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Bad replica request: %v", err)})
+		return
+	}
+	part, err := mr.NextPart()
+	if err != nil || part.FormName() != "metadata" {
+		writeJson(w, 400, map[string]string{"error": "Bad replica request: expected metadata first."})
+		return
+	}
+	var rrJson replicaResourceJson
+	if err := json.NewDecoder(io.LimitReader(part, maxCaptureRequestBytes)).Decode(&rrJson); err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Bad replica metadata: %v", err)})
+		return
+	}
+	if decodedUrl, err := encoder.Decode(rrJson.HashedUrl); err != nil || decodedUrl != rrJson.Url {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Replica key '%s' doesn't match its URL", rrJson.HashedUrl)})
+		return
+	}
+	part, err = mr.NextPart()
+	if err != nil || part.FormName() != "body" {
+		writeJson(w, 400, map[string]string{"error": "Bad replica request: expected a body after the metadata."})
+		return
+	}
+	if err := s.dsFrom(r.Context()).PutReplica(datastore.ReplicaResource(rrJson), part); err != nil {
+		status := 400
+		if errors.Is(err, datastore.ErrResourceBusy) {
+			status = 409
+		}
+		writeJson(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, 200, map[string]string{})
+}
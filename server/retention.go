@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+	"github.com/gnossen/knoxcache/hostfilter"
+)
+
+// How many resources are listed at a time while looking for expired ones.
+const retentionPageSize = 500
+
+// How many of the resources each rule would delete are shown on
+// /admin/retention.
+const retentionReportCount = 100
+
+// A --retention rule, keeping the resources of the hosts it matches for
+// keepFor after they were captured, or forever if keepFor is zero.
+type retentionRule struct {
+	// The rule as given, for the report.
+	spec string
+	// Matches every host, including those of resources cached under
+	// request keys rather than URLs.
+	all     bool
+	hosts   hostfilter.HostList
+	keepFor time.Duration
+}
+
+// Parses a --retention rule, written host=age or host=forever. host is
+// written like a --allow-host rule, or is * to match every host. age is a
+// duration, e.g. 720h, or a number of days, e.g. 30d.
+func parseRetentionRule(spec string) (retentionRule, error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return retentionRule{}, fmt.Errorf("expected host=age or host=forever, got %s", spec)
+	}
+	host, age := strings.TrimSpace(spec[:i]), strings.ToLower(strings.TrimSpace(spec[i+1:]))
+	rule := retentionRule{spec: spec}
+	if host == "*" {
+		rule.all = true
+	} else {
+		hosts, err := hostfilter.NewHostList([]string{host})
+		if err != nil {
+			return retentionRule{}, err
+		}
+		rule.hosts = hosts
+	}
+	if age == "forever" {
+		return rule, nil
+	}
+	keepFor, err := parseAge(age)
+	if err != nil {
+		return retentionRule{}, fmt.Errorf("bad age %s in %s", age, spec)
+	}
+	rule.keepFor = keepFor
+	if rule.keepFor <= 0 {
+		return retentionRule{}, fmt.Errorf("age %s in %s is not positive", age, spec)
+	}
+	return rule, nil
+}
+
+// Parses a duration, e.g. 720h, or a number of days, e.g. 30d.
+func parseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(age)
+}
+
+func parseRetentionRules(specs []string) ([]retentionRule, error) {
+	var rules []retentionRule
+	for _, spec := range specs {
+		rule, err := parseRetentionRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule retentionRule) matches(host string) bool {
+	return rule.all || (host != "" && rule.hosts.Matches(host))
+}
+
+// How long the rule keeps resources, as shown in the report.
+func (rule retentionRule) keep() string {
+	if rule.keepFor == 0 {
+		return "forever"
+	}
+	if rule.keepFor == 24*time.Hour {
+		return "1 day"
+	}
+	if rule.keepFor%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%d days", rule.keepFor/(24*time.Hour))
+	}
+	return rule.keepFor.String()
+}
+
+// Returns the index of the rule that decides how long the resource cached
+// under rawUrl is kept, or -1 if none does and it is kept forever.
+func retentionRuleFor(rules []retentionRule, rawUrl string) int {
+	host := ""
+	if u, err := url.Parse(rawUrl); err == nil {
+		host = u.Host
+	}
+	for i, rule := range rules {
+		if rule.matches(host) {
+			return i
+		}
+	}
+	return -1
+}
+
+type expiredResource struct {
+	datastore.ResourceMetadata
+	EncodedUrl string
+}
+
+// Returns the resources in store that have outlived the rule that decides
+// how long they are kept as of now, by the index of that rule.
+func expiredResources(store datastore.FileDatastore, rules []retentionRule, now time.Time) (map[int][]expiredResource, error) {
+	expired := map[int][]expiredResource{}
+	cursor := ""
+	for {
+		ri, err := store.ListAfter(cursor, retentionPageSize, datastore.ListFilter{})
+		if err != nil {
+			return nil, err
+		}
+		listed := 0
+		for ri.HasNext() {
+			metadata, err := ri.Next()
+			if err != nil {
+				return nil, err
+			}
+			listed++
+			cursor = metadata.Cursor
+			i := retentionRuleFor(rules, metadata.Url)
+			// Held resources are kept whatever the rules say.
+			if metadata.Held || i < 0 || rules[i].keepFor == 0 || now.Sub(metadata.DownloadStarted) < rules[i].keepFor {
+				continue
+			}
+			encodedUrl, err := encoder.Encode(metadata.Url)
+			if err != nil {
+				log.Printf("failed to encode %s: %v\n", metadata.Url, err)
+				continue
+			}
+			expired[i] = append(expired[i], expiredResource{metadata, encodedUrl})
+		}
+		if listed < retentionPageSize {
+			return expired, nil
+		}
+	}
+}
+
+func (s *Server) expireResourcesPeriodically() {
+	defer s.backgroundWork.Done()
+	ticker := time.NewTicker(s.config.RetentionInterval)
+	defer ticker.Stop()
+	for {
+		// Nothing is deleted while knox is being backed up or upgraded.
+		if !s.inMaintenance() {
+			for _, ctx := range s.cacheContexts() {
+				if !s.expireResources(ctx) {
+					return
+				}
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-s.stopBackground:
+			return
+		}
+	}
+}
+
+// Deletes the expired resources of the cache ctx is for. Returns false if
+// it stopped early because knox is shutting down.
+func (s *Server) expireResources(ctx context.Context) bool {
+	expired, err := expiredResources(s.dsFrom(ctx), s.retentionRules, time.Now())
+	if err != nil {
+		log.Printf("Failed to look for expired resources: %v\n", err)
+		return true
+	}
+	for i, resources := range expired {
+		for _, resource := range resources {
+			select {
+			case <-s.stopBackground:
+				return false
+			default:
+			}
+			err := s.dsFrom(ctx).Delete(resource.EncodedUrl)
+			if errors.Is(err, datastore.ErrResourceNotCached) || errors.Is(err, datastore.ErrResourceBusy) || errors.Is(err, datastore.ErrResourceHeld) {
+				// Deleted or held meanwhile, or being refreshed, in which
+				// case it is looked at again on the next pass.
+				continue
+			} else if err != nil {
+				log.Printf("Failed to delete expired %s: %v\n", resource.Url, err)
+				continue
+			}
+			log.Printf("Deleted %s, which is past --retention %s\n", resource.Url, s.retentionRules[i].spec)
+			s.resourcesExpired.Inc()
+			s.publishEvent(ctx, eventDeleted, resource.EncodedUrl, resource.Url, nil)
+		}
+	}
+	return true
+}
+
+type retentionReportRow struct {
+	Spec      string
+	Keep      string
+	Count     int
+	Bytes     int
+	Resources []adminListRow
+	// Whether there were more resources than retentionReportCount.
+	Truncated bool
+}
+
+type adminRetentionData struct {
+	Rules []retentionReportRow
+	// Whether expired resources are being deleted, which they aren't with
+	// --read-only.
+	Enforced bool
+}
+
+// Shows what each --retention rule would delete if it were applied now,
+// without deleting anything.
+func (s *Server) handleAdminRetentionRequest(w http.ResponseWriter, r *http.Request) {
+	expired, err := expiredResources(s.dsFrom(r.Context()), s.retentionRules, time.Now())
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Failed to list resources: %v", err))
+		return
+	}
+	var rows []retentionReportRow
+	for i, rule := range s.retentionRules {
+		row := retentionReportRow{Spec: rule.spec, Keep: rule.keep()}
+		for _, resource := range expired[i] {
+			row.Count++
+			row.Bytes += resource.BytesOnDisk
+			if len(row.Resources) == retentionReportCount {
+				row.Truncated = true
+				continue
+			}
+			cachedUrl, err := translateAbsoluteUrlToCachedUrl(resource.Url, getProtocol(r), s.getHost(r))
+			if err != nil {
+				log.Printf("failed to get cached URL for %s: %v\n", resource.Url, err)
+				continue
+			}
+			row.Resources = append(row.Resources, adminListRow{ResourceMetadata: resource.ResourceMetadata, CachedUrl: cachedUrl, EncodedUrl: resource.EncodedUrl})
+		}
+		rows = append(rows, row)
+	}
+	s.renderPage(w, 200, "admin_retention.html", adminRetentionData{rows, !s.config.ReadOnly})
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetentionRule(t *testing.T) {
+	cases := []struct {
+		spec    string
+		keepFor time.Duration
+		keep    string
+	}{
+		{"news.example.com=30d", 30 * 24 * time.Hour, "30 days"},
+		{"*.example.com = 12h", 12 * time.Hour, "12h0m0s"},
+		{"docs.example.com=forever", 0, "forever"},
+		{"*=Forever", 0, "forever"},
+		{"10.0.0.0/8=1d", 24 * time.Hour, "1 day"},
+	}
+	for _, tc := range cases {
+		rule, err := parseRetentionRule(tc.spec)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tc.spec, err)
+			continue
+		}
+		if rule.keepFor != tc.keepFor || rule.keep() != tc.keep {
+			t.Errorf("Wrong age for %q. got = %v (%s), want = %v (%s)", tc.spec, rule.keepFor, rule.keep(), tc.keepFor, tc.keep)
+		}
+	}
+	for _, spec := range []string{"example.com", "example.com=", "example.com=soon", "example.com=0d", "example.com=-1h", "=30d", "10.0.0.0/33=30d"} {
+		if _, err := parseRetentionRule(spec); err == nil {
+			t.Errorf("Expected %q not to parse.", spec)
+		}
+	}
+}
+
+func TestRetentionRuleFor(t *testing.T) {
+	rules, err := parseRetentionRules([]string{"docs.example.com=forever", "*.example.com=30d", "*=90d"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cases := []struct {
+		url  string
+		want int
+	}{
+		{"https://docs.example.com/guide", 0},
+		{"https://DOCS.example.com:8443/guide", 0},
+		{"https://news.example.com/today", 1},
+		{"https://example.com/", 2},
+		{"https://other.com/", 2},
+		// Request keys that aren't URLs are only matched by *.
+		{"knox-key-123", 2},
+	}
+	for _, tc := range cases {
+		if got := retentionRuleFor(rules, tc.url); got != tc.want {
+			t.Errorf("Wrong rule for %s. got = %d, want = %d", tc.url, got, tc.want)
+		}
+	}
+	if got := retentionRuleFor(rules[:2], "https://other.com/"); got != -1 {
+		t.Errorf("Expected no rule for a host none match. got = %d", got)
+	}
+}
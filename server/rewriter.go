@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/url"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Tags that can appear in a <head> without ending it. Any other tag, or text
+// that isn't whitespace, starts the body.
+var headTags = map[atom.Atom]bool{
+	atom.Html: true, atom.Head: true, atom.Base: true, atom.Basefont: true, atom.Bgsound: true,
+	atom.Link: true, atom.Meta: true, atom.Noframes: true, atom.Noscript: true, atom.Script: true,
+	atom.Style: true, atom.Template: true, atom.Title: true,
+}
+
+// Tags whose content the tokenizer reads as text rather than markup.
+var rawTextTags = map[atom.Atom]bool{
+	atom.Iframe: true, atom.Noembed: true, atom.Noframes: true, atom.Noscript: true, atom.Plaintext: true,
+	atom.Script: true, atom.Style: true, atom.Textarea: true, atom.Title: true, atom.Xmp: true,
+}
+
+// Elements that have no end tag. Rewritten ones are written self-closing,
+// like html.Render writes them.
+var voidElements = map[atom.Atom]bool{
+	atom.Area: true, atom.Base: true, atom.Br: true, atom.Col: true, atom.Embed: true, atom.Hr: true, atom.Img: true,
+	atom.Input: true, atom.Keygen: true, atom.Link: true, atom.Meta: true, atom.Param: true, atom.Source: true,
+	atom.Track: true, atom.Wbr: true,
+}
+
+// Rewrites a page a token at a time, so that pages are served without being
+// held in memory whole. Whatever isn't rewritten is copied as it was.
+type htmlRewriter struct {
+	server      *Server
+	resourceUrl *url.URL
+	protocol    string
+	host        string
+
+	// Whether the page links to an icon so far.
+	linksIcon bool
+	// Whether the page is past its <head>, after which the default icon is
+	// no longer added. Unlike with the whole document, an icon linked from
+	// the body isn't known of in time.
+	headDone bool
+	// The raw text element the next text is the content of, if any.
+	rawText atom.Atom
+	// The raw bytes of the current tag, copied before the tokenizer
+	// lowercases its name.
+	raw []byte
+}
+
+// Rewrites the page read from in like transformHtmlDocument, without
+// parsing it whole.
+func (s *Server) streamTransformHtml(resourceUrl *url.URL, in io.Reader, out io.Writer, protocol string, host string) error {
+	w := bufio.NewWriter(out)
+	if err := html.Render(w, s.interceptionScriptNode()); err != nil {
+		return err
+	}
+	hr := &htmlRewriter{server: s, resourceUrl: resourceUrl, protocol: protocol, host: host}
+	if err := hr.rewrite(in, w); err != nil {
+		return err
+	}
+	// The page never got past its <head>.
+	if err := hr.endHead(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (hr *htmlRewriter) rewrite(in io.Reader, w *bufio.Writer) error {
+	z := html.NewTokenizer(in)
+	for {
+		tt := z.Next()
+		var err error
+		switch tt {
+		case html.ErrorToken:
+			if err := z.Err(); err != io.EOF {
+				return err
+			}
+			return nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			hr.raw = append(hr.raw[:0], z.Raw()...)
+			err = hr.rewriteTag(z.Token(), w)
+		case html.EndTagToken:
+			hr.raw = append(hr.raw[:0], z.Raw()...)
+			hr.rawText = 0
+			if name, _ := z.TagName(); !hr.headDone && atom.Lookup(name) == atom.Head {
+				err = hr.endHead(w)
+			}
+			if err == nil {
+				_, err = w.Write(hr.raw)
+			}
+		case html.TextToken:
+			err = hr.rewriteText(z.Raw(), w)
+		default:
+			_, err = w.Write(z.Raw())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (hr *htmlRewriter) rewriteTag(tok html.Token, w *bufio.Writer) error {
+	if !headTags[tok.DataAtom] {
+		if err := hr.endHead(w); err != nil {
+			return err
+		}
+	}
+	if tok.Type == html.StartTagToken && rawTextTags[tok.DataAtom] {
+		hr.rawText = tok.DataAtom
+	}
+	// The rewriting functions work on nodes, which can be removed from a
+	// parent.
+	node := &html.Node{Type: html.ElementNode, DataAtom: tok.DataAtom, Data: tok.Data, Attr: append([]html.Attribute(nil), tok.Attr...)}
+	(&html.Node{Type: html.ElementNode}).AppendChild(node)
+	if tok.DataAtom != atom.Noscript {
+		removed, icon := hr.server.rewriteElement(node, hr.resourceUrl, hr.protocol, hr.host)
+		if removed {
+			return nil
+		}
+		hr.linksIcon = hr.linksIcon || icon
+	}
+	if attrsEqual(node.Attr, tok.Attr) {
+		_, err := w.Write(hr.raw)
+		return err
+	}
+	tok.Attr = node.Attr
+	if voidElements[tok.DataAtom] {
+		tok.Type = html.SelfClosingTagToken
+	}
+	_, err := w.WriteString(tok.String())
+	return err
+}
+
+func (hr *htmlRewriter) rewriteText(raw []byte, w *bufio.Writer) error {
+	if hr.rawText == atom.Noscript {
+		return hr.rewriteNoscript(raw, w)
+	}
+	if hr.rawText == 0 && len(bytes.TrimSpace(raw)) != 0 {
+		if err := hr.endHead(w); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(raw)
+	return err
+}
+
+// Rewrites the content of a <noscript> like the rest of the page, since
+// browsers that don't run scripts read it as markup. See transformNoscript.
+func (hr *htmlRewriter) rewriteNoscript(raw []byte, w *bufio.Writer) error {
+	inner := &htmlRewriter{server: hr.server, resourceUrl: hr.resourceUrl, protocol: hr.protocol, host: hr.host, headDone: true}
+	if err := inner.rewrite(bytes.NewReader(raw), w); err != nil {
+		return err
+	}
+	hr.linksIcon = hr.linksIcon || inner.linksIcon
+	return nil
+}
+
+// Adds the default icon if the page hasn't linked to one by the end of its
+// <head>.
+func (hr *htmlRewriter) endHead(w *bufio.Writer) error {
+	if hr.headDone {
+		return nil
+	}
+	hr.headDone = true
+	if hr.linksIcon {
+		return nil
+	}
+	if link := hr.server.defaultIconLink(hr.resourceUrl, hr.protocol, hr.host); link != nil {
+		return html.Render(w, link)
+	}
+	return nil
+}
+
+func attrsEqual(a, b []html.Attribute) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestStreamTransformHtml(t *testing.T) {
+	s := newServer(DefaultConfig())
+	pageUrl, _ := url.Parse("http://example.com/dir/page")
+	cached := func(u string) string {
+		encoded, err := encoder.Encode(u)
+		if err != nil {
+			t.Fatalf("Failed to encode %s: %v", u, err)
+		}
+		return "https://knox.example/c/" + encoded
+	}
+	var script bytes.Buffer
+	if err := s.streamTransformHtml(pageUrl, strings.NewReader(""), &script, "https", "knox.example"); err != nil {
+		t.Fatalf("Failed to transform: %v", err)
+	}
+	icon := `<link rel="icon" href="` + cached("http://example.com/favicon.ico") + `"/>`
+	scriptTag := strings.TrimSuffix(script.String(), icon)
+
+	for _, tc := range []struct {
+		name string
+		page string
+		want string
+	}{
+		{
+			"links",
+			`<!DOCTYPE html><HTML><head><title>a < b</title></head><body><A HREF="other" class=x>link</A><img src='/a.png' integrity="sha256-x"></body></HTML>`,
+			`<!DOCTYPE html><HTML><head><title>a < b</title>` + icon + `</head><body><a href="` + cached("http://example.com/dir/other") + `" class="x">link</A><img src="` + cached("http://example.com/a.png") + `"/></body></HTML>`,
+		},
+		{
+			"untouched markup",
+			`<p id=x>kept <b>as is</b> &amp; <a href="#top">here</a></p><script>if (a < b && c) {}</script>`,
+			icon + `<p id=x>kept <b>as is</b> &amp; <a href="#top">here</a></p><script>if (a < b && c) {}</script>`,
+		},
+		{
+			"icon and hints",
+			`<head><link rel="icon" href="/i.png"><link rel=preconnect href="https://cdn.example"></head><body>text`,
+			`<head><link rel="icon" href="` + cached("http://example.com/i.png") + `"/></head><body>text`,
+		},
+		{
+			"implicit head",
+			`<meta charset="utf-8">  Text`,
+			`<meta charset="utf-8">` + icon + `  Text`,
+		},
+		{
+			"noscript",
+			`<body><noscript><img src="/pixel.gif"></noscript>`,
+			icon + `<body><noscript><img src="` + cached("http://example.com/pixel.gif") + `"/></noscript>`,
+		},
+	} {
+		var out bytes.Buffer
+		// A byte at a time, so that tokens span reads.
+		if err := s.streamTransformHtml(pageUrl, iotest.OneByteReader(strings.NewReader(tc.page)), &out, "https", "knox.example"); err != nil {
+			t.Fatalf("Failed to transform the %s page: %v", tc.name, err)
+		}
+		got := out.String()
+		if !strings.HasPrefix(got, scriptTag) {
+			t.Errorf("Expected the %s page to start with the interception script. got = %s", tc.name, got)
+			continue
+		}
+		if got = strings.TrimPrefix(got, scriptTag); got != tc.want {
+			t.Errorf("Wrong %s page.\ngot  = %s\nwant = %s", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+	"github.com/gnossen/knoxcache/robots"
+)
+
+// The values of --robots-policy.
+const (
+	// Robots directives make no difference.
+	robotsIgnore = "ignore"
+	// Resources the directives forbid archiving are cached and tagged with
+	// why.
+	robotsFlag = "flag"
+	// Resources the directives forbid archiving are refused.
+	robotsRefuse = "refuse"
+)
+
+// The tags a resource gets under --robots-policy=flag.
+const (
+	robotsDisallowedTag = "robots:disallowed"
+	robotsNoArchiveTag  = "robots:noarchive"
+)
+
+// How long an origin's robots.txt is used before it is fetched again.
+const robotsTxtTtl = 1 * time.Hour
+
+// How much of a robots.txt is read. RFC 9309 lets crawlers ignore anything
+// past 500 KiB.
+const maxRobotsTxtBytes = 500 * 1024
+
+// How much of an HTML page is searched for robots <meta> elements, which
+// belong in its head.
+const robotsMetaSniffBytes = 64 * 1024
+
+type robotsTxtEntry struct {
+	rules     robots.Rules
+	fetchedAt time.Time
+}
+
+// Returns the rules of the robots.txt of u's origin that apply to knox. A
+// robots.txt that is missing, or can't be fetched, allows everything.
+func (s *Server) robotsTxtRules(ctx context.Context, u *url.URL, userAgent string) robots.Rules {
+	origin := u.Scheme + "://" + u.Host
+	s.robotsTxtMu.Lock()
+	entry, ok := s.robotsTxtCache[origin]
+	s.robotsTxtMu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < robotsTxtTtl {
+		return entry.rules
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", origin+"/robots.txt", nil)
+	if err != nil {
+		return robots.Rules{}
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	resp, err := s.fetchClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to fetch %s: %v\n", req.URL, err)
+		return robots.Rules{}
+	}
+	defer resp.Body.Close()
+	var rules robots.Rules
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		rules = robots.Parse(io.LimitReader(resp.Body, maxRobotsTxtBytes), robots.Agent)
+	} else if resp.StatusCode >= 500 {
+		// Most likely temporary, so it is tried again next time.
+		log.Printf("Failed to fetch %s: %s\n", req.URL, resp.Status)
+		return robots.Rules{}
+	}
+	s.robotsTxtMu.Lock()
+	s.robotsTxtCache[origin] = robotsTxtEntry{rules, time.Now()}
+	s.robotsTxtMu.Unlock()
+	return rules
+}
+
+// Applies --robots-policy to a resource the robots directives forbid
+// archiving for reason. Returns the error to fail the download with under
+// robotsRefuse, and otherwise adds the tag to flag it with to tags.
+func (s *Server) applyRobotsPolicy(srcUrl string, reason string, tag string, tags *[]string) error {
+	if s.config.RobotsPolicy == robotsRefuse {
+		return fmt.Errorf("%w: %s", datastore.ErrRefused, reason)
+	}
+	log.Printf("Caching %s even though %s\n", srcUrl, reason)
+	*tags = append(*tags, tag)
+	return nil
+}
+
+// Keeps the beginning of the body written to a ResourceWriter, for finding
+// the robots <meta> elements of an HTML page.
+type robotsSniffingWriter struct {
+	datastore.ResourceWriter
+	head *bytes.Buffer
+}
+
+func (sw robotsSniffingWriter) Write(b []byte) (int, error) {
+	if room := robotsMetaSniffBytes - sw.head.Len(); room > 0 {
+		if room > len(b) {
+			room = len(b)
+		}
+		sw.head.Write(b[:room])
+	}
+	return sw.ResourceWriter.Write(b)
+}
+
+func (sw robotsSniffingWriter) Reset() error {
+	sw.head.Reset()
+	return sw.ResourceWriter.Reset()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Content types of scripts, without parameters.
+var scriptContentTypes = map[string]bool{
+	"application/javascript":   true,
+	"application/x-javascript": true,
+	"application/ecmascript":   true,
+	"text/javascript":          true,
+	"text/ecmascript":          true,
+}
+
+// Matches string literals that are absolute http(s) URLs, in single or double
+// quotes, with their slashes escaped or not. Template literals are left
+// alone since they may have parts filled in by the script.
+var scriptUrlRegex = regexp.MustCompile(scriptUrlPattern(`"`) + "|" + scriptUrlPattern(`'`))
+
+func scriptUrlPattern(quote string) string {
+	return fmt.Sprintf(`%[1]shttps?:(?:\\?/){2}(?:[^%[1]s\s\\]|\\/)+%[1]s`, quote)
+}
+
+// Reports whether the script at scriptUrl, with the given content type, should
+// have its URLs rewritten.
+func (s *Server) rewritesScript(scriptUrl *url.URL, contentType string) bool {
+	return scriptContentTypes[contentType] && s.scriptRewriteHosts.Matches(scriptUrl.Host)
+}
+
+// Points the string literals in a script that are absolute http(s) URLs at
+// the cache, since many pages put together the URLs of what they load in
+// script. This is best effort: URLs built out of several literals, or
+// anywhere but a literal, still go to the origin. Literals that look like the
+// first part of such a URL, ending in / ? & or =, are left as they are, since
+// pointing them at the cache would break the URL rather than cache it.
+func (s *Server) rewriteScriptUrls(scriptUrl *url.URL, in io.Reader, out io.Writer, protocol string, host string) error {
+	script, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	script = scriptUrlRegex.ReplaceAllFunc(script, func(literal []byte) []byte {
+		quote := string(literal[0])
+		value := string(literal[1 : len(literal)-1])
+		escaped := strings.Contains(value, `\/`)
+		link := strings.ReplaceAll(value, `\/`, "/")
+		if strings.ContainsAny(link[len(link)-1:], "/?&=") {
+			return literal
+		}
+		translated, err := s.translateCachedUrl(link, scriptUrl, protocol, host)
+		if err != nil || translated == "" {
+			return literal
+		}
+		if escaped {
+			translated = strings.ReplaceAll(translated, "/", `\/`)
+		}
+		return []byte(quote + translated + quote)
+	})
+	_, err = out.Write(script)
+	return err
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamConnectionPooling(t *testing.T) {
+	c := DefaultConfig()
+	c.UpstreamMaxConnsPerHost = 1
+	s := newServer(c)
+	var mu sync.Mutex
+	remoteAddrs := map[string]bool{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		remoteAddrs[r.RemoteAddr] = true
+	}))
+	defer origin.Close()
+	transport, err := s.newUpstreamTransport()
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	if transport.TLSClientConfig.ClientSessionCache == nil {
+		t.Errorf("Expected TLS sessions to be cached.")
+	}
+	client := &http.Client{Transport: transport}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(origin.URL)
+			if err != nil {
+				t.Errorf("Request failed: %v", err)
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if len(remoteAddrs) != 1 {
+		t.Errorf("Expected every fetch to share one connection. got = %v", remoteAddrs)
+	}
+}
+
+func testConfig(t *testing.T) Config {
+	datastoreRoot, err := ioutil.TempDir("", "knox-server-test")
+	if err != nil {
+		t.Fatalf("Failed to create test temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(datastoreRoot) })
+	c := DefaultConfig()
+	c.DatastoreRoot = datastoreRoot
+	return c
+}
+
+func expectStatus(t *testing.T, srv *httptest.Server, path string, want int) {
+	res, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatalf("Request for %s failed: %v", path, err)
+	}
+	res.Body.Close()
+	if res.StatusCode != want {
+		t.Errorf("Wrong status for %s. got = %d, want = %d", path, res.StatusCode, want)
+	}
+}
+
+func TestNew(t *testing.T) {
+	c := testConfig(t)
+	s, err := New(c)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	srv := httptest.NewServer(s)
+	for _, path := range []string{"/", "/admin/list/0", "/static/knox.css"} {
+		expectStatus(t, srv, path, 200)
+	}
+
+	reloaded := c
+	reloaded.DenyContentTypes = []string{"text/css"}
+	reloaded.ResourceTtl = time.Hour
+	if err := s.Reload(reloaded); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if err := s.settings().typeFilter.Check("text/css", "/knox.css"); err == nil || s.settings().resourceTtl != time.Hour {
+		t.Errorf("Expected reloaded settings to apply. got = %v, %v", err, s.settings().resourceTtl)
+	}
+	restricted := reloaded
+	restricted.AdminAllowNetworks = []string{"10.0.0.0/8", "192.168.1.1"}
+	if err := s.Reload(restricted); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	for path, want := range map[string]int{"/": 200, "/admin/list/0": 403, "/api/v1/stats": 403} {
+		expectStatus(t, srv, path, want)
+	}
+	restricted.AdminAllowNetworks = []string{"127.0.0.0/8", "::1"}
+	if err := s.Reload(restricted); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	expectStatus(t, srv, "/admin/list/0", 200)
+	invalid := reloaded
+	invalid.AllowHosts = []string{"10.0.0.0/99"}
+	invalid.ResourceTtl = time.Minute
+	if err := s.Reload(invalid); err == nil || s.settings().resourceTtl != time.Hour {
+		t.Errorf("Expected invalid settings to be refused. got = %v, %v", err, s.settings().resourceTtl)
+	}
+	srv.Close()
+	if err := s.Close(); err != nil {
+		t.Errorf("Failed to close server: %v", err)
+	}
+
+	// A server that was closed can be set up again.
+	s, err = New(c)
+	if err != nil {
+		t.Fatalf("Failed to create server again: %v", err)
+	}
+	srv = httptest.NewServer(s)
+	expectStatus(t, srv, "/admin/list/0", 200)
+	srv.Close()
+	if err := s.Close(); err != nil {
+		t.Errorf("Failed to close server: %v", err)
+	}
+}
+
+func TestNewTwice(t *testing.T) {
+	first, err := New(testConfig(t))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer first.Close()
+	c := testConfig(t)
+	c.AdminAllowNetworks = []string{"10.0.0.0/8"}
+	second, err := New(c)
+	if err != nil {
+		t.Fatalf("Failed to create a second server: %v", err)
+	}
+	defer second.Close()
+
+	// Each keeps its own settings and state.
+	firstSrv, secondSrv := httptest.NewServer(first), httptest.NewServer(second)
+	defer firstSrv.Close()
+	defer secondSrv.Close()
+	expectStatus(t, firstSrv, "/admin/list/0", 200)
+	expectStatus(t, secondSrv, "/admin/list/0", 403)
+	first.setMaintenance(true)
+	if !first.inMaintenance() || second.inMaintenance() {
+		t.Errorf("Expected only the first server to be in maintenance.")
+	}
+	bad := testConfig(t)
+	bad.CompressionLevel = 100
+	if _, err := New(bad); err == nil {
+		t.Errorf("Expected a server with a bad compression level to fail.")
+	}
+}
+
+func TestLinkScheme(t *testing.T) {
+	cases := map[string]string{
+		"mailto:a@b.example":         "mailto",
+		" JavaScript:void(0)":        "javascript",
+		"java\tscript:alert(1)":      "javascript",
+		"https://example.com/":       "https",
+		"/relative:colon":            "",
+		"page?next=http://a.example": "",
+		"#frag":                      "",
+		"1tel:5555":                  "",
+	}
+	for link, want := range cases {
+		if got := linkScheme(link); got != want {
+			t.Errorf("Wrong scheme for %q. got = %q, want = %q", link, got, want)
+		}
+	}
+}
+
+func TestTranslateCachedUrlFragments(t *testing.T) {
+	s := newServer(DefaultConfig())
+	baseUrl, _ := url.Parse("http://example.com/dir/page")
+	cases := map[string]string{
+		"other#section":                     "http://example.com/dir/other",
+		"/page#a#b":                         "http://example.com/page",
+		"http://example.com/page?q=1#top":   "http://example.com/page?q=1",
+		"/page#":                            "http://example.com/page",
+		"http://example.com/dir/page#intro": "http://example.com/dir/page",
+	}
+	for link, resolved := range cases {
+		encoded, err := encoder.Encode(resolved)
+		if err != nil {
+			t.Fatalf("Failed to encode %s: %v", resolved, err)
+		}
+		want := "https://knox.example/c/" + encoded
+		if i := strings.Index(link, "#"); i >= 0 && link[i:] != "#" {
+			want += link[i:]
+		}
+		got, err := s.translateCachedUrl(link, baseUrl, "https", "knox.example")
+		if err != nil || got != want {
+			t.Errorf("Wrong translation of %q. got = %q, %v, want = %q", link, got, err, want)
+		}
+	}
+}
+
+func TestRewriteScriptUrls(t *testing.T) {
+	s := newServer(DefaultConfig())
+	scriptUrl, _ := url.Parse("http://example.com/app.js")
+	cached := func(u string) string {
+		encoded, err := encoder.Encode(u)
+		if err != nil {
+			t.Fatalf("Failed to encode %s: %v", u, err)
+		}
+		return "https://knox.example/c/" + encoded
+	}
+	cases := map[string]string{
+		`load("https://cdn.example/a.png")`:         `load("` + cached("https://cdn.example/a.png") + `")`,
+		`var u = 'http://example.com/api?x=1#top';`: `var u = '` + cached("http://example.com/api?x=1") + `#top';`,
+		`{"src":"https:\/\/cdn.example\/b.js"}`:     `{"src":"` + strings.ReplaceAll(cached("https://cdn.example/b.js"), "/", `\/`) + `"}`,
+		`base = "https://cdn.example/img/" + name`:  `base = "https://cdn.example/img/" + name`,
+		`q = "https://example.com/search?q=" + q`:   `q = "https://example.com/search?q=" + q`,
+		"t = `https://cdn.example/${name}.png`":     "t = `https://cdn.example/${name}.png`",
+		`s = "see https://example.com/"`:            `s = "see https://example.com/"`,
+		`x = "https://" + host`:                     `x = "https://" + host`,
+	}
+	for script, want := range cases {
+		var out strings.Builder
+		if err := s.rewriteScriptUrls(scriptUrl, strings.NewReader(script), &out, "https", "knox.example"); err != nil {
+			t.Fatalf("Failed to rewrite %s: %v", script, err)
+		}
+		if got := out.String(); got != want {
+			t.Errorf("Wrong rewrite of %s. got = %s, want = %s", script, got, want)
+		}
+	}
+}
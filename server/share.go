@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+func (s *Server) loadLinkSigningKey() error {
+	if s.config.LinkSigningKeyFile == "" {
+		return nil
+	}
+	key, err := ioutil.ReadFile(s.config.LinkSigningKeyFile)
+	if err != nil {
+		return err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return fmt.Errorf("%s is empty", s.config.LinkSigningKeyFile)
+	}
+	s.linkSigningKey = key
+	return nil
+}
+
+// Signs read access to one resource of the cache ctx is for until expires, or
+// forever if expires is zero. Every cache shares the key, so the virtual host
+// is signed too, keeping a link to one cache from opening another's copy of
+// the same URL.
+func (s *Server) linkSignature(ctx context.Context, encodedUrl string, expires int64) string {
+	mac := hmac.New(sha256.New, s.linkSigningKey)
+	if host := virtualHostFrom(ctx); host != "" {
+		fmt.Fprintf(mac, "%s\n", host)
+	}
+	fmt.Fprintf(mac, "%s\n%d", encodedUrl, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) signedLink(ctx context.Context, encodedUrl string, expires int64, protocol string, host string) string {
+	query := url.Values{}
+	if expires != 0 {
+		query.Set("exp", strconv.FormatInt(expires, 10))
+	}
+	query.Set("sig", s.linkSignature(ctx, encodedUrl, expires))
+	return fmt.Sprintf("%s://%s/s/%s?%s", protocol, host, encodedUrl, query.Encode())
+}
+
+// Checks the signature and expiry of a request for /s/<encodedUrl> to the
+// cache ctx is for.
+func (s *Server) checkSignedLink(ctx context.Context, encodedUrl string, query url.Values) error {
+	var expires int64
+	if exp := query.Get("exp"); exp != "" {
+		var err error
+		if expires, err = strconv.ParseInt(exp, 10, 64); err != nil || expires <= 0 {
+			return errors.New("Bad expiry.")
+		}
+	}
+	expected := s.linkSignature(ctx, encodedUrl, expires)
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(expected)) {
+		return errors.New("Bad signature.")
+	}
+	if expires != 0 && time.Now().Unix() >= expires {
+		return errors.New("Link has expired.")
+	}
+	return nil
+}
+
+// Serves /s/<hash>, a cached resource shared by a signed link. Pages are
+// served as a single file, like /bundle/<hash>.html, so that they render
+// without access to anything else in the cache. Resources are never fetched
+// on behalf of signed links.
+func (s *Server) handleSignedLinkRequest(w http.ResponseWriter, r *http.Request) {
+	prefix := "/s/"
+	if !strings.HasPrefix(r.URL.Path, prefix) || len(s.linkSigningKey) == 0 {
+		writeError(w, 404, fmt.Sprintf("Bad URI: %s", r.URL.Path))
+		return
+	}
+	encodedUrl := r.URL.Path[len(prefix):]
+	if err := s.checkSignedLink(r.Context(), encodedUrl, r.URL.Query()); err != nil {
+		writeError(w, 403, err.Error())
+		return
+	}
+	// Links in the page point at their original locations, which mustn't
+	// learn the signature.
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	status, err := s.dsFrom(r.Context()).Status(encodedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	if status != datastore.ResourceCached {
+		writeError(w, 404, "Resource is not cached.")
+		return
+	}
+	f, err := s.dsFrom(r.Context()).Open(encodedUrl)
+	if err != nil {
+		s.writeCacheError(w, err)
+		return
+	}
+	s.recordAccess(r.Context(), encodedUrl, true)
+	if cachedContentType(f) != "text/html" {
+		s.serveExistingPage(encodedUrl, f, w, r)
+		return
+	}
+	defer f.Close()
+	parsedUrl, err := url.Parse(keyUrl(f.ResourceURL()))
+	if err != nil {
+		writeError(w, 500, fmt.Sprintf("Bad URL: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := s.writeHtmlBundle(r.Context(), parsedUrl, f, w); err != nil {
+		log.Printf("Failed to bundle %s: %v\n", f.ResourceURL(), err)
+	}
+}
+
+type shareJson struct {
+	Url     string     `json:"url"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Creates a signed link to a cached resource. The optional ttl parameter, e.g.
+// 24h, limits how long the link works.
+func (s *Server) handleResourceShareRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJson(w, 405, map[string]string{"error": "Sharing requires a POST."})
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeJson(w, 403, map[string]string{"error": "Cross-site requests are not allowed."})
+		return
+	}
+	if len(s.linkSigningKey) == 0 {
+		writeJson(w, 404, map[string]string{"error": "Shareable links are disabled. See --link-signing-key-file."})
+		return
+	}
+	encodedUrl := resourceShareRegex.FindStringSubmatch(r.URL.Path)[1]
+	if _, err := encoder.Decode(encodedUrl); err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Could not interpret requested url '%s'", encodedUrl)})
+		return
+	}
+	var expires int64
+	response := shareJson{}
+	if rawTtl := r.FormValue("ttl"); rawTtl != "" {
+		ttl, err := time.ParseDuration(rawTtl)
+		if err != nil || ttl <= 0 {
+			writeJson(w, 400, map[string]string{"error": "ttl must be a positive duration like 24h."})
+			return
+		}
+		expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+		expires = expiresAt.Unix()
+		response.Expires = &expiresAt
+	}
+	status, err := s.dsFrom(r.Context()).Status(encodedUrl)
+	if err != nil {
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Internal error: %v", err)})
+		return
+	}
+	if status != datastore.ResourceCached {
+		writeJson(w, 404, map[string]string{"error": "Resource is not cached."})
+		return
+	}
+	response.Url = s.signedLink(r.Context(), encodedUrl, expires, getProtocol(r), s.getHost(r))
+	writeJson(w, 200, response)
+}
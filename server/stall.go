@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Returned when an origin stops sending a body it has started on.
+var errUpstreamStalled = errors.New("origin stopped sending")
+
+// Gives up on responses whose origin goes longer than timeout without sending
+// any of the body. Only time spent waiting on the origin counts, not time
+// spent between reads, e.g. by throttling.
+type stallTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t stallTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &stallTimeoutBody{ReadCloser: resp.Body, timeout: t.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(t.timeout, func() {
+		atomic.StoreInt32(&body.stalled, 1)
+		cancel()
+	})
+	body.timer.Stop()
+	resp.Body = body
+	return resp, nil
+}
+
+type stallTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled int32
+}
+
+func (b *stallTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if atomic.LoadInt32(&b.stalled) != 0 {
+		return n, fmt.Errorf("%w for %v", errUpstreamStalled, b.timeout)
+	}
+	return n, err
+}
+
+func (b *stallTimeoutBody) Close() error {
+	b.timer.Stop()
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStallTransport(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/stall" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer origin.Close()
+	client := &http.Client{Transport: stallTransport{http.DefaultTransport, 100 * time.Millisecond}}
+
+	resp, err := client.Get(origin.URL + "/done")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	// Time between reads doesn't count.
+	time.Sleep(200 * time.Millisecond)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "partial" {
+		t.Errorf("Wrong body. got = %q, %v", body, err)
+	}
+
+	resp, err = client.Get(origin.URL + "/stall")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errUpstreamStalled) {
+			t.Errorf("Expected the stalled body to be given up on. got = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the stalled body to be given up on")
+	}
+}
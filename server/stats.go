@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+type statsDownloadJson struct {
+	Url        string `json:"url"`
+	EncodedUrl string `json:"encoded_url"`
+	RawBytes   int64  `json:"raw_bytes"`
+}
+
+type statsDomainJson struct {
+	Host          string `json:"host"`
+	ResourceCount int    `json:"resource_count"`
+	BytesOnDisk   int    `json:"bytes_on_disk"`
+	AccessCount   int64  `json:"access_count"`
+}
+
+// Served by /api/v1/stats. Hits, misses, and the aggregates are across every
+// instance sharing the datastore. The instance fields only count what this
+// instance has done since it started.
+type statsResponseJson struct {
+	ResourceCount int64   `json:"resource_count"`
+	BytesOnDisk   int     `json:"bytes_on_disk"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRatio      float64 `json:"hit_ratio"`
+
+	InstanceHits   uint64 `json:"instance_hits"`
+	InstanceMisses uint64 `json:"instance_misses"`
+
+	DownloadsRunning int                 `json:"downloads_running"`
+	DownloadsQueued  int                 `json:"downloads_queued"`
+	Downloads        []statsDownloadJson `json:"downloads"`
+
+	// Failed downloads whose retry time hasn't passed, the ones among them
+	// that caching policy refused, and cached resources whose last refresh
+	// failed.
+	Failed        int64 `json:"failed"`
+	Refused       int64 `json:"refused"`
+	RefreshFailed int64 `json:"refresh_failed"`
+
+	// The largest first.
+	Domains []statsDomainJson `json:"domains"`
+}
+
+// Reports the state of the cache as JSON for external dashboards.
+func (s *Server) handleStatsApiRequest(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.dsFrom(r.Context()).Stats()
+	if err != nil {
+		log.Printf("Failed to get global stats: %v\n", err)
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Internal error: %v", err)})
+		return
+	}
+	failures, err := s.dsFrom(r.Context()).FailureStats()
+	if err != nil {
+		log.Printf("Failed to get failure stats: %v\n", err)
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Internal error: %v", err)})
+		return
+	}
+	usage, err := s.dsFrom(r.Context()).DiskUsage()
+	if err != nil {
+		log.Printf("Failed to get disk usage: %v\n", err)
+		writeJson(w, 500, map[string]string{"error": fmt.Sprintf("Internal error: %v", err)})
+		return
+	}
+	running, queued := s.downloads.counts()
+	resp := statsResponseJson{
+		ResourceCount:    stats.RecordCount,
+		BytesOnDisk:      stats.DiskConsumptionBytes,
+		Hits:             stats.Hits,
+		Misses:           stats.Misses,
+		HitRatio:         hitRatio(stats),
+		InstanceHits:     s.cacheHits.Value(),
+		InstanceMisses:   s.cacheMisses.Value(),
+		DownloadsRunning: running,
+		DownloadsQueued:  queued,
+		Downloads:        []statsDownloadJson{},
+		Failed:           failures.Failed,
+		Refused:          failures.Refused,
+		RefreshFailed:    failures.RefreshFailed,
+		Domains:          domainsJson(usage),
+	}
+	for _, event := range s.progressEvents(virtualHostFrom(r.Context())) {
+		resp.Downloads = append(resp.Downloads, statsDownloadJson{event.Url, event.EncodedUrl, event.RawBytes})
+	}
+	sort.Slice(resp.Downloads, func(i, j int) bool {
+		return resp.Downloads[i].Url < resp.Downloads[j].Url
+	})
+	writeJson(w, 200, resp)
+}
+
+func domainsJson(usage datastore.DiskUsage) []statsDomainJson {
+	domains := []statsDomainJson{}
+	for _, group := range usage.ByHost {
+		domains = append(domains, statsDomainJson{group.Name, group.ResourceCount, group.BytesOnDisk, group.AccessCount})
+	}
+	return domains
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// How often resources that have become idle are looked for.
+const offloadInterval = 1 * time.Hour
+
+// How many resources are moved at a time, so that a pass that falls behind
+// doesn't hold up shutdown for long.
+const offloadBatchSize = 100
+
+func (s *Server) offloadIdlePeriodically() {
+	defer s.backgroundWork.Done()
+	ticker := time.NewTicker(offloadInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			moved, err := s.ds.OffloadIdle(time.Now().Add(-s.config.ColdTierAfter), offloadBatchSize)
+			s.resourcesOffloaded.Add(uint64(moved))
+			if err != nil {
+				log.Printf("Failed to offload idle resources: %v\n", err)
+			}
+			if err != nil || moved < offloadBatchSize {
+				break
+			}
+			select {
+			case <-s.stopBackground:
+				return
+			default:
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-s.stopBackground:
+			return
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+
+	"github.com/gnossen/knoxcache/resolver"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans go to the global tracer provider, so programs embedding the server
+// can send them wherever they like instead of setting Config.OtlpEndpoint.
+var tracer = otel.Tracer("github.com/gnossen/knoxcache/server")
+
+// Exports spans to the collector at --otlp-endpoint, if set. Spans are
+// exported in batches, so those from just before knox exits may be lost.
+func (s *Server) setUpTracing() error {
+	if s.config.OtlpEndpoint == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(s.config.OtlpEndpoint)
+	if err != nil {
+		return err
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+	switch endpoint.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return fmt.Errorf("OTLP endpoint %s is neither http nor https", s.config.OtlpEndpoint)
+	}
+	if endpoint.Path != "" && endpoint.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(endpoint.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(sdkresource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("knox"))),
+	))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return nil
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Keeps the span of ctx, the cache it is for, and the client headers it
+// forwards, but not its deadline or cancellation, for downloads that outlive
+// the request that started them.
+func detachSpan(ctx context.Context) context.Context {
+	detached := withVirtualHost(context.Background(), virtualHostFrom(ctx))
+	detached = withClientHeaders(detached, clientHeadersFrom(ctx))
+	return trace.ContextWithSpan(detached, trace.SpanFromContext(ctx))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Starts a span for each request handled by mux, named after the pattern it
+// matched and continuing the client's trace if it sent a traceparent header.
+func traceRequests(handler http.Handler, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+pattern,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(r.Method),
+				semconv.HTTPTargetKey.String(r.URL.Path),
+			))
+		defer span.End()
+		recorder := &statusRecorder{w, 200}
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// Records each lookup of an origin's addresses as a span.
+type tracingResolver struct {
+	resolver.Resolver
+}
+
+func (r tracingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ctx, span := tracer.Start(ctx, "dns", trace.WithAttributes(semconv.NetPeerNameKey.String(host)))
+	addrs, err := r.Resolver.LookupIPAddr(ctx, host)
+	endSpan(span, err)
+	return addrs, err
+}
+
+// Records connecting to an origin, the TLS handshake, and waiting for the
+// first byte of its response as children of the span in ctx.
+func withFetchTrace(ctx context.Context) context.Context {
+	var mu sync.Mutex
+	connects := map[string]trace.Span{}
+	var handshake, wait trace.Span
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			_, span := tracer.Start(ctx, "connect", trace.WithAttributes(attribute.String("net.peer.addr", addr)))
+			mu.Lock()
+			defer mu.Unlock()
+			connects[addr] = span
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if span, ok := connects[addr]; ok {
+				endSpan(span, err)
+				delete(connects, addr)
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			_, handshake = tracer.Start(ctx, "tls")
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if handshake != nil {
+				endSpan(handshake, err)
+				handshake = nil
+			}
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if wait != nil {
+				// The request is being retried on another connection.
+				wait.End()
+			}
+			_, wait = tracer.Start(ctx, "wait")
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if wait != nil {
+				wait.End()
+				wait = nil
+			}
+		},
+	})
+}
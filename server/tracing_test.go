@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnossen/knoxcache/hostfilter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// The global tracer provider can only be replaced once, so every test of
+// tracing shares this recorder.
+var spanRecorder = tracetest.NewSpanRecorder()
+
+func init() {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+func endedSpans(names ...string) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spanRecorder.Ended() {
+		for _, name := range names {
+			if span.Name() == name {
+				spans[name] = span
+			}
+		}
+	}
+	return spans
+}
+
+func TestTraceRequests(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/c/", func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracer.Start(r.Context(), "child")
+		span.End()
+		w.WriteHeader(502)
+	})
+	req := httptest.NewRequest("GET", "/c/aHR0cDovL2V4YW1wbGUuY29t", nil)
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	traceRequests(mux, mux).ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := endedSpans("GET /c/", "child")
+	server, child := spans["GET /c/"], spans["child"]
+	if server == nil || child == nil {
+		t.Fatalf("Missing spans. got = %v", spanRecorder.Ended())
+	}
+	if server.SpanContext().TraceID().String() != traceId {
+		t.Errorf("Expected the client's trace to be continued. got = %s", server.SpanContext().TraceID())
+	}
+	if child.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Expected handler's span to be a child of the request's.")
+	}
+	found := false
+	for _, attr := range server.Attributes() {
+		if attr.Key == "http.status_code" && attr.Value.AsInt64() == 502 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected status to be recorded. got = %v", server.Attributes())
+	}
+}
+
+func TestFetchTrace(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "body")
+	}))
+	defer origin.Close()
+	hf, err := hostfilter.NewHostFilter(nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create host filter: %v", err)
+	}
+	transport := &http.Transport{
+		DialContext: hf.DialContext(&net.Dialer{Timeout: 5 * time.Second}, tracingResolver{net.DefaultResolver}),
+	}
+	defer transport.CloseIdleConnections()
+
+	ctx, fetchSpan := tracer.Start(context.Background(), "fetch")
+	req, _ := http.NewRequestWithContext(withFetchTrace(ctx), "GET", strings.Replace(origin.URL, "127.0.0.1", "localhost", 1), nil)
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	fetchSpan.End()
+
+	spans := endedSpans("dns", "connect", "wait")
+	for _, name := range []string{"dns", "connect", "wait"} {
+		span := spans[name]
+		if span == nil {
+			t.Errorf("Missing %s span.", name)
+		} else if span.Parent().SpanID() != fetchSpan.SpanContext().SpanID() {
+			t.Errorf("Expected %s span to be a child of the fetch.", name)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	texttemplate "text/template"
+
+	"github.com/gnossen/knoxcache/normalizer"
+	"github.com/gnossen/knoxcache/ui"
+)
+
+type serviceWorkerData struct {
+	AdvertisedAddress string
+}
+
+func (s *Server) loadUi() error {
+	var files fs.FS = ui.Files
+	if s.config.TemplateDir != "" {
+		files = os.DirFS(s.config.TemplateDir)
+	}
+	pageTemplateFuncs := htmltemplate.FuncMap{
+		"dataSize":    formatDataSize,
+		"displayHost": normalizer.DisplayHost,
+		"shortUrl":    shortenedUrl,
+		"readOnly":    func() bool { return s.config.ReadOnly },
+		"maintenance": s.inMaintenance,
+		"oidc":        s.oidcEnabled,
+	}
+	var err error
+	s.pageTemplates, err = htmltemplate.New("").Funcs(pageTemplateFuncs).ParseFS(files, "templates/*.html")
+	if err != nil {
+		return err
+	}
+	s.serviceWorkerTemplate, err = texttemplate.ParseFS(files, "templates/service-worker.js")
+	if err != nil {
+		return err
+	}
+	script, err := fs.ReadFile(files, "static/interception.js")
+	if err != nil {
+		return err
+	}
+	s.interceptionScript = string(script)
+	static, err := fs.Sub(files, "static")
+	if err != nil {
+		return err
+	}
+	s.staticHandler = http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+	return nil
+}
+
+// Renders a page fully before writing anything so that a template error
+// doesn't leave a half-written page behind.
+func (s *Server) renderPage(w http.ResponseWriter, status int, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := s.pageTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("Failed to render %s: %v\n", name, err)
+		writeError(w, 500, "Failed to render page.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gnossen/knoxcache/datastore"
+)
+
+type virtualHostKey struct{}
+
+// Returns ctx marked as being for the cache of the virtual host host, or for
+// the default cache if host is "".
+func withVirtualHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, virtualHostKey{}, host)
+}
+
+// Returns the virtual host whose cache a request, or work done on behalf of
+// one, is for, or "" if it is for the default cache.
+func virtualHostFrom(ctx context.Context) string {
+	host, _ := ctx.Value(virtualHostKey{}).(string)
+	return host
+}
+
+// Returns the datastore of the cache a request, or work done on behalf of
+// one, is for.
+func (s *Server) dsFrom(ctx context.Context) datastore.FileDatastore {
+	if store, ok := s.virtualHostStores[virtualHostFrom(ctx)]; ok {
+		return store
+	}
+	return s.ds
+}
+
+// Returns every cache's datastore, the default one first, for background
+// work that covers all of them.
+func (s *Server) allDatastores() []datastore.FileDatastore {
+	stores := []datastore.FileDatastore{s.ds}
+	for _, store := range s.virtualHostStores {
+		stores = append(stores, store)
+	}
+	return stores
+}
+
+// Returns a context for each cache, the default one first, for background
+// work that covers all of them and has to know which one it is working on.
+func (s *Server) cacheContexts() []context.Context {
+	ctxs := []context.Context{context.Background()}
+	for host := range s.virtualHostStores {
+		ctxs = append(ctxs, withVirtualHost(context.Background(), host))
+	}
+	return ctxs
+}
+
+// Parses a --virtual-host, written host=root.
+func parseVirtualHost(spec string) (string, string, error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return "", "", fmt.Errorf("expected host=root, got %s", spec)
+	}
+	host, root := strings.ToLower(strings.TrimSpace(spec[:i])), strings.TrimSpace(spec[i+1:])
+	if host == "" || strings.ContainsAny(host, ":/ ") || root == "" {
+		return "", "", fmt.Errorf("expected host=root, got %s", spec)
+	}
+	return host, root, nil
+}
+
+// Opens the datastore of each virtual host, with its database in its root.
+// They don't have cold tiers, whose files would collide with those of the
+// default cache.
+func (s *Server) openVirtualHosts(specs []string) error {
+	for _, spec := range specs {
+		host, root, err := parseVirtualHost(spec)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.virtualHostStores[host]; ok {
+			return fmt.Errorf("%s is given more than once", host)
+		}
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return err
+		}
+		store, err := datastore.NewFileDatastoreWithOptions(path.Join(root, "knox.db"), root, s.config.Sqlite)
+		if err != nil {
+			return fmt.Errorf("%s: %v", host, err)
+		}
+		if err := store.CheckSchema(); err != nil {
+			return fmt.Errorf("%s: %v", host, err)
+		}
+		s.virtualHostStores[host] = store.WithMemoryCache(s.config.MemoryCacheBytes, s.config.MemoryCacheEntryBytes).WithDurability(s.durability)
+	}
+	return nil
+}
+
+// Marks each request for the name of a virtual host as being for its cache.
+// The port, if any, is ignored.
+func (s *Server) withVirtualHosts(handler http.Handler) http.Handler {
+	if len(s.virtualHostStores) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if _, ok := s.virtualHostStores[host]; ok {
+			r = r.WithContext(withVirtualHost(r.Context(), host))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The largest list of URLs the warm API accepts.
+const maxWarmRequestBytes = 1024 * 1024
+
+const defaultWarmConcurrency = 4
+const maxWarmConcurrency = 16
+
+type warmResultJson struct {
+	Url       string `json:"url"`
+	CachedUrl string `json:"cached_url,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type warmResponseJson struct {
+	Results   []warmResultJson `json:"results"`
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+}
+
+// Reads one URL per line, skipping blank lines and lines starting with #.
+func readUrlList(in io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+func (s *Server) warmUrl(ctx context.Context, rawUrl string, userAgent string, protocol string, host string) warmResultJson {
+	result := warmResultJson{Url: rawUrl}
+	normalizedUrl, err := s.urlNormalizer.Normalize(rawUrl)
+	if err != nil {
+		result.Error = fmt.Sprintf("Could not normalize url: %v", err)
+		return result
+	}
+	encodedUrl, err := encoder.Encode(normalizedUrl)
+	if err != nil {
+		result.Error = fmt.Sprintf("Could not interpret url: %v", err)
+		return result
+	}
+	if _, err := s.maybeCachePage(ctx, encodedUrl, normalizedUrl, userAgent); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if result.CachedUrl, err = translateAbsoluteUrlToCachedUrl(normalizedUrl, protocol, host); err != nil {
+		result.Error = fmt.Sprintf("Failed to get cached URL: %v", err)
+	}
+	return result
+}
+
+// Caches urls, at most concurrency at a time, starting one each tick if tick
+// isn't nil. URLs not yet started when ctx is done are reported as failed.
+func (s *Server) warmUrls(ctx context.Context, urls []string, concurrency int, tick <-chan time.Time, userAgent string, protocol string, host string) []warmResultJson {
+	// Requests for individual pages shouldn't have to wait behind these.
+	ctx = withDownloadPriority(ctx, backgroundPriority)
+	results := make([]warmResultJson, len(urls))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, rawUrl := range urls {
+		if i != 0 && tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			results[i] = warmResultJson{Url: rawUrl, Error: "Canceled."}
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, rawUrl string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = s.warmUrl(ctx, rawUrl, userAgent, protocol, host)
+			if results[i].Error != "" {
+				log.Printf("Failed to warm %s: %s\n", rawUrl, results[i].Error)
+			}
+		}(i, rawUrl)
+	}
+	wg.Wait()
+	return results
+}
+
+// Caches every URL in the request body, one per line, and reports how each
+// went once they're all done. The concurrency parameter limits how many are
+// fetched at once and the rate parameter how many are started per second.
+func (s *Server) handleWarmApiRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJson(w, 405, map[string]string{"error": "Warming requires a POST."})
+		return
+	}
+	if s.isCrossSiteRequest(r) {
+		writeJson(w, 403, map[string]string{"error": "Cross-site requests are not allowed."})
+		return
+	}
+	// Read before the parameters so that the body isn't mistaken for a form.
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWarmRequestBytes+1))
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Failed to read request: %v", err)})
+		return
+	}
+	if len(body) > maxWarmRequestBytes {
+		writeJson(w, 413, map[string]string{"error": "Too many URLs."})
+		return
+	}
+	urls, err := readUrlList(bytes.NewReader(body))
+	if err != nil {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("Failed to read URLs: %v", err)})
+		return
+	}
+	concurrency, err := intQueryParam(r, "concurrency", defaultWarmConcurrency)
+	if err != nil || concurrency == 0 || concurrency > maxWarmConcurrency {
+		writeJson(w, 400, map[string]string{"error": fmt.Sprintf("concurrency must be between 1 and %d.", maxWarmConcurrency)})
+		return
+	}
+	var rate float64
+	if rawRate := r.URL.Query().Get("rate"); rawRate != "" {
+		if rate, err = strconv.ParseFloat(rawRate, 64); err != nil || rate <= 0 {
+			writeJson(w, 400, map[string]string{"error": "rate must be a positive number of URLs per second."})
+			return
+		}
+	}
+
+	var tick <-chan time.Time
+	if interval := time.Duration(float64(time.Second) / rate); rate > 0 && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	results := s.warmUrls(r.Context(), urls, concurrency, tick, r.Header.Get("User-Agent"), getProtocol(r), s.getHost(r))
+	response := warmResponseJson{Results: results}
+	for _, result := range results {
+		if result.Error != "" {
+			response.Failed += 1
+		} else {
+			response.Succeeded += 1
+		}
+	}
+	writeJson(w, 200, response)
+}
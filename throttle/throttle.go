@@ -0,0 +1,205 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// The smallest burst a limiter allows, so that very low rates don't turn
+// every read into a wait.
+const minBurst = 4 * 1024
+
+// Limits the rate at which bytes pass through a stream with a token bucket
+// holding up to a second's worth of bytes. A nil *Limiter is unlimited.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Returns nil, which is unlimited, if bytesPerSecond isn't positive.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := float64(bytesPerSecond)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return &Limiter{rate: float64(bytesPerSecond), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// The most bytes that should be passed to a single call to WaitN to keep
+// the stream smooth.
+func (l *Limiter) Burst() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.burst)
+}
+
+// Blocks until n more bytes may pass, or until ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// Going into debt makes the callers that come after this one wait for
+	// it to be paid off.
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *Limiter) idle(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tokens+now.Sub(l.last).Seconds()*l.rate >= l.burst
+}
+
+// Once this many keys have limiters, those that are idle are forgotten.
+const maxIdleLimiters = 1024
+
+// Gives each key, e.g. a host, a limiter of its own.
+type KeyedLimiter struct {
+	bytesPerSecond int64
+
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+}
+
+// Returns nil, which is unlimited, if bytesPerSecond isn't positive.
+func NewKeyedLimiter(bytesPerSecond int64) *KeyedLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &KeyedLimiter{bytesPerSecond: bytesPerSecond, limiters: map[string]*Limiter{}}
+}
+
+// Returns the limiter for key.
+func (kl *KeyedLimiter) Get(key string) *Limiter {
+	if kl == nil {
+		return nil
+	}
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if l, ok := kl.limiters[key]; ok {
+		return l
+	}
+	if len(kl.limiters) >= maxIdleLimiters {
+		// An idle limiter behaves the same as a new one, so nothing is
+		// lost by dropping it.
+		now := time.Now()
+		for k, l := range kl.limiters {
+			if l.idle(now) {
+				delete(kl.limiters, k)
+			}
+		}
+	}
+	l := NewLimiter(kl.bytesPerSecond)
+	kl.limiters[key] = l
+	return l
+}
+
+// Returns the smallest positive burst of limiters, or 0 if they are all
+// unlimited.
+func burst(limiters []*Limiter) int {
+	b := 0
+	for _, l := range limiters {
+		if l != nil && (b == 0 || l.Burst() < b) {
+			b = l.Burst()
+		}
+	}
+	return b
+}
+
+func waitN(ctx context.Context, limiters []*Limiter, n int) error {
+	for _, l := range limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type reader struct {
+	ctx      context.Context
+	r        io.ReadCloser
+	limiters []*Limiter
+	burst    int
+}
+
+// Returns a reader that reads from r no faster than any of limiters allow.
+// Waiting stops with an error once ctx is done.
+func NewReader(ctx context.Context, r io.ReadCloser, limiters ...*Limiter) io.ReadCloser {
+	b := burst(limiters)
+	if b == 0 {
+		return r
+	}
+	return &reader{ctx, r, limiters, b}
+}
+
+func (tr *reader) Read(p []byte) (int, error) {
+	if len(p) > tr.burst {
+		p = p[:tr.burst]
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if werr := waitN(tr.ctx, tr.limiters, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (tr *reader) Close() error {
+	return tr.r.Close()
+}
+
+// Writes to w no faster than any of limiters allow. Waiting stops with an
+// error once ctx is done.
+func Write(ctx context.Context, w io.Writer, p []byte, limiters ...*Limiter) (int, error) {
+	b := burst(limiters)
+	if b == 0 {
+		return w.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > b {
+			chunk = chunk[:b]
+		}
+		if err := waitN(ctx, limiters, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
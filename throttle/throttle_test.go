@@ -0,0 +1,79 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestNilLimiterIsUnlimited(t *testing.T) {
+	if l := NewLimiter(0); l != nil {
+		t.Errorf("Expected no limiter for a rate of 0. got = %v", l)
+	}
+	var l *Limiter
+	if err := l.WaitN(context.Background(), 1<<30); err != nil {
+		t.Errorf("Expected a nil limiter not to wait. got = %v", err)
+	}
+	r := ioutil.NopCloser(bytes.NewReader(nil))
+	if NewReader(context.Background(), r, nil, nil) != r {
+		t.Errorf("Expected unlimited readers not to be wrapped.")
+	}
+}
+
+func TestReader(t *testing.T) {
+	// The first burst is free, so this should take about a second.
+	l := NewLimiter(8 * 1024)
+	data := bytes.Repeat([]byte("x"), 16*1024)
+	start := time.Now()
+	r := NewReader(context.Background(), ioutil.NopCloser(bytes.NewReader(data)), l)
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Wrong data. got %d bytes, %v", len(got), err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Wrong duration for 16KiB at 8KiB/s. got = %v", elapsed)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	l := NewLimiter(8 * 1024)
+	data := bytes.Repeat([]byte("x"), 16*1024)
+	var buf bytes.Buffer
+	start := time.Now()
+	if n, err := Write(context.Background(), &buf, data, l); err != nil || n != len(data) {
+		t.Fatalf("Failed to write. got = %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Wrong duration for 16KiB at 8KiB/s. got = %v", elapsed)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Wrong data written.")
+	}
+}
+
+func TestCanceledWait(t *testing.T) {
+	l := NewLimiter(1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := NewReader(ctx, ioutil.NopCloser(bytes.NewReader(make([]byte, 64*1024))), l)
+	if _, err := io.Copy(ioutil.Discard, r); err != context.Canceled {
+		t.Errorf("Wrong error. got = %v, want = %v", err, context.Canceled)
+	}
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	kl := NewKeyedLimiter(1024)
+	if kl.Get("a") != kl.Get("a") {
+		t.Errorf("Expected the same limiter for the same key.")
+	}
+	if kl.Get("a") == kl.Get("b") {
+		t.Errorf("Expected different limiters for different keys.")
+	}
+	var unlimited *KeyedLimiter
+	if unlimited.Get("a") != nil {
+		t.Errorf("Expected a nil keyed limiter to be unlimited.")
+	}
+}
@@ -0,0 +1,153 @@
+package typefilter
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+// BlockedError is returned when a response is of a type that is not permitted
+// to be cached.
+type BlockedError struct {
+	ContentType string
+	Extension   string
+}
+
+func (e BlockedError) Error() string {
+	contentType := e.ContentType
+	if contentType == "" {
+		contentType = "(none)"
+	}
+	if e.Extension != "" {
+		return fmt.Sprintf("content type %s (%s) is not permitted", contentType, e.Extension)
+	}
+	return fmt.Sprintf("content type %s is not permitted", contentType)
+}
+
+// A rule is one of an exact MIME type ("text/html"), a wildcard matching any
+// subtype ("video/*"), or a file extension (".mp4").
+type rule struct {
+	mediaType string
+	wildcard  bool
+	extension string
+}
+
+func parseRule(s string) (rule, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return rule{}, fmt.Errorf("empty content type rule")
+	}
+	if strings.HasPrefix(s, ".") {
+		if len(s) == 1 || strings.ContainsAny(s, "/*") {
+			return rule{}, fmt.Errorf("invalid extension")
+		}
+		return rule{extension: s}, nil
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0], "*") {
+		return rule{}, fmt.Errorf("expected a MIME type like text/html or video/*")
+	}
+	if parts[1] == "*" {
+		return rule{mediaType: parts[0] + "/", wildcard: true}, nil
+	}
+	if strings.Contains(parts[1], "*") {
+		return rule{}, fmt.Errorf("only whole subtypes may be wildcarded")
+	}
+	return rule{mediaType: s}, nil
+}
+
+func (r rule) matches(mediaType string, extension string) bool {
+	if r.extension != "" {
+		return extension == r.extension
+	}
+	if r.wildcard {
+		return strings.HasPrefix(mediaType, r.mediaType)
+	}
+	return mediaType == r.mediaType
+}
+
+type TypeFilter struct {
+	allow []rule
+	deny  []rule
+}
+
+// If allow is empty, every response not matched by deny is permitted.
+// Otherwise, a response must match allow and not match deny.
+func NewTypeFilter(allow, deny []string) (TypeFilter, error) {
+	tf := TypeFilter{}
+	for _, s := range allow {
+		r, err := parseRule(s)
+		if err != nil {
+			return TypeFilter{}, fmt.Errorf("bad allow rule '%s': %v", s, err)
+		}
+		tf.allow = append(tf.allow, r)
+	}
+	for _, s := range deny {
+		r, err := parseRule(s)
+		if err != nil {
+			return TypeFilter{}, fmt.Errorf("bad deny rule '%s': %v", s, err)
+		}
+		tf.deny = append(tf.deny, r)
+	}
+	return tf, nil
+}
+
+func parseResponseType(contentType string, urlPath string) (string, string) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+	return mediaType, strings.ToLower(path.Ext(urlPath))
+}
+
+// Checks a response by its Content-Type header and the extension of the path
+// it was fetched from. Parameters like charset are ignored, and a response
+// without a parseable Content-Type only matches extension rules.
+func (tf TypeFilter) Check(contentType string, urlPath string) error {
+	mediaType, extension := parseResponseType(contentType, urlPath)
+	blocked := BlockedError{mediaType, extension}
+	for _, r := range tf.deny {
+		if r.matches(mediaType, extension) {
+			return blocked
+		}
+	}
+	if len(tf.allow) == 0 {
+		return nil
+	}
+	for _, r := range tf.allow {
+		if r.matches(mediaType, extension) {
+			return nil
+		}
+	}
+	return blocked
+}
+
+// A set of content types written the same way as TypeFilter rules.
+type TypeList struct {
+	rules []rule
+}
+
+func NewTypeList(types []string) (TypeList, error) {
+	tl := TypeList{}
+	for _, s := range types {
+		r, err := parseRule(s)
+		if err != nil {
+			return TypeList{}, fmt.Errorf("bad content type '%s': %v", s, err)
+		}
+		tl.rules = append(tl.rules, r)
+	}
+	return tl, nil
+}
+
+// Reports whether a response is of one of the types in the list, judging by
+// its Content-Type header and path the same way as TypeFilter.Check.
+func (tl TypeList) Matches(contentType string, urlPath string) bool {
+	mediaType, extension := parseResponseType(contentType, urlPath)
+	for _, r := range tl.rules {
+		if r.matches(mediaType, extension) {
+			return true
+		}
+	}
+	return false
+}
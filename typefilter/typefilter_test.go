@@ -0,0 +1,91 @@
+package typefilter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tf, err := NewTypeFilter(
+		[]string{"text/*", "image/*", ".pdf"},
+		[]string{"image/svg+xml", ".exe"},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create type filter: %v", err)
+	}
+	cases := []struct {
+		contentType string
+		path        string
+		want        bool
+	}{
+		{"text/html; charset=utf-8", "/", true},
+		{"TEXT/Plain", "/notes.txt", true},
+		{"image/png", "/a.png", true},
+		{"image/svg+xml", "/a.svg", false},
+		{"video/mp4", "/a.mp4", false},
+		{"application/octet-stream", "/paper.PDF", true},
+		{"text/plain", "/setup.exe", false},
+		{"", "/no-type", false},
+		{"not a type", "/", false},
+	}
+	for _, tc := range cases {
+		err := tf.Check(tc.contentType, tc.path)
+		if got := err == nil; got != tc.want {
+			t.Errorf("Wrong decision for '%s' at '%s'. got = %v, want = %v", tc.contentType, tc.path, got, tc.want)
+		}
+		var blocked BlockedError
+		if err != nil && !errors.As(err, &blocked) {
+			t.Errorf("Expected BlockedError for '%s' but got %v", tc.contentType, err)
+		}
+	}
+}
+
+func TestDenyOnly(t *testing.T) {
+	tf, err := NewTypeFilter(nil, []string{"video/*", "audio/*"})
+	if err != nil {
+		t.Fatalf("Failed to create type filter: %v", err)
+	}
+	if err := tf.Check("application/json", "/data"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := tf.Check("", "/data"); err != nil {
+		t.Errorf("Unexpected error for missing content type: %v", err)
+	}
+	err = tf.Check("video/webm", "/clip.webm")
+	if err == nil || err.Error() != "content type video/webm (.webm) is not permitted" {
+		t.Errorf("Wrong error. got = %v", err)
+	}
+}
+
+func TestBadRules(t *testing.T) {
+	for _, bad := range []string{"", "video", "*/*", "video/mp*", ".", "/mp4", "text/html/x"} {
+		if _, err := NewTypeFilter([]string{bad}, nil); err == nil {
+			t.Errorf("Expected rule '%s' to be rejected.", bad)
+		}
+	}
+}
+
+func TestTypeList(t *testing.T) {
+	tl, err := NewTypeList([]string{"image/*", "application/zip", ".woff2"})
+	if err != nil {
+		t.Fatalf("Failed to create type list: %v", err)
+	}
+	for _, tc := range []struct {
+		contentType string
+		urlPath     string
+		want        bool
+	}{
+		{"image/jpeg", "/photo", true},
+		{"application/zip; charset=binary", "/archive", true},
+		{"application/octet-stream", "/font.WOFF2", true},
+		{"text/html", "/index.html", false},
+		{"", "/data", false},
+	} {
+		if got := tl.Matches(tc.contentType, tc.urlPath); got != tc.want {
+			t.Errorf("Wrong match for %s at %s. got = %v, want = %v", tc.contentType, tc.urlPath, got, tc.want)
+		}
+	}
+	if _, err := NewTypeList([]string{"video"}); err == nil {
+		t.Errorf("Expected a bad content type to be rejected.")
+	}
+}
@@ -0,0 +1,85 @@
+// Follows /admin/events so that the admin list shows downloads as they
+// progress and picks up resources as they finish without being reloaded.
+(function() {
+    if (!window.EventSource) {
+        return;
+    }
+    var downloads = document.getElementById('downloads');
+    var downloadRows = {};
+
+    function dataSize(bytes) {
+        var units = ['B', 'KB', 'MB', 'GB', 'TB'];
+        var i = 0;
+        while (bytes >= 1024 && i < units.length - 1) {
+            bytes /= 1024;
+            i++;
+        }
+        return (i == 0 ? bytes : bytes.toFixed(1)) + ' ' + units[i];
+    }
+
+    function showProgress(event) {
+        var row = downloadRows[event.encoded_url];
+        if (!row) {
+            row = downloads.insertRow(-1);
+            var link = document.createElement('a');
+            link.href = event.url;
+            link.textContent = event.url;
+            var cell = row.insertCell(-1);
+            cell.className = 'source-url';
+            cell.appendChild(link);
+            row.insertCell(-1);
+            downloadRows[event.encoded_url] = row;
+        }
+        row.cells[1].textContent = dataSize(event.raw_bytes || 0);
+        downloads.hidden = false;
+    }
+
+    function removeProgress(event) {
+        var row = downloadRows[event.encoded_url];
+        if (row) {
+            row.remove();
+            delete downloadRows[event.encoded_url];
+        }
+        downloads.hidden = Object.keys(downloadRows).length == 0;
+    }
+
+    // Only the first page shows the newest resources. Later pages would shift
+    // under the reader.
+    var firstPage = /\/0$/.test(location.pathname) && !/[?&](before|after)=/.test(location.search);
+    var pendingUpdate = null;
+
+    function updateResources() {
+        if (!firstPage || pendingUpdate) {
+            return;
+        }
+        // Coalesces the bursts of completions of a page's subresources.
+        pendingUpdate = setTimeout(function() {
+            fetch(location.href).then(function(res) {
+                return res.text();
+            }).then(function(html) {
+                var doc = new DOMParser().parseFromString(html, 'text/html');
+                ['stats', 'resources'].forEach(function(id) {
+                    var updated = doc.getElementById(id);
+                    if (updated) {
+                        document.getElementById(id).replaceWith(updated);
+                    }
+                });
+            }).finally(function() {
+                pendingUpdate = null;
+            });
+        }, 1000);
+    }
+
+    var source = new EventSource('/admin/events');
+    source.addEventListener('progress', function(e) {
+        showProgress(JSON.parse(e.data));
+    });
+    source.addEventListener('completed', function(e) {
+        removeProgress(JSON.parse(e.data));
+        updateResources();
+    });
+    source.addEventListener('failed', function(e) {
+        removeProgress(JSON.parse(e.data));
+    });
+    source.addEventListener('deleted', updateResources);
+})();
@@ -0,0 +1,53 @@
+// Follows the download started from the create form so that the page shows
+// how far along it is and says when the cached copy is ready.
+(function() {
+    var capture = document.getElementById('capture');
+    if (!capture || !window.EventSource) {
+        return;
+    }
+    var state = document.getElementById('capture-state');
+    var progress = document.getElementById('capture-progress');
+    var bar = progress.querySelector('progress');
+    var bytes = progress.querySelector('span');
+
+    function dataSize(bytes) {
+        var units = ['B', 'KB', 'MB', 'GB', 'TB'];
+        var i = 0;
+        while (bytes >= 1024 && i < units.length - 1) {
+            bytes /= 1024;
+            i++;
+        }
+        return (i == 0 ? bytes : bytes.toFixed(1)) + ' ' + units[i];
+    }
+
+    function update(e) {
+        var status = JSON.parse(e.data);
+        if (status.state == 'downloading') {
+            state.textContent = 'Capturing';
+            // Without a percentage the bar shows that something is happening
+            // without saying how much is left.
+            if (status.percent != null) {
+                bar.value = status.percent;
+                bytes.textContent = dataSize(status.raw_bytes) + ' of ' + dataSize(status.content_length);
+            } else {
+                bar.removeAttribute('value');
+                bytes.textContent = dataSize(status.raw_bytes);
+            }
+            progress.hidden = false;
+        } else if (status.state == 'cached') {
+            state.textContent = 'Created';
+            progress.hidden = true;
+            source.close();
+        } else if (status.state == 'failed') {
+            state.textContent = 'Failed to capture';
+            bytes.textContent = status.error;
+            bar.hidden = true;
+            progress.hidden = false;
+            source.close();
+        }
+    }
+
+    var source = new EventSource(capture.dataset.events);
+    source.addEventListener('state', update);
+    source.addEventListener('progress', update);
+})();
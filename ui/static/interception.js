@@ -0,0 +1,21 @@
+if ('serviceWorker' in navigator) {
+    window.addEventListener('load', function() {
+        navigator.serviceWorker.register('../service-worker.js').then(function(registration){
+            console.log("Service worker registered with scope: ", registration.scope);
+            return navigator.serviceWorker.ready;
+        }).then(function(registration) {
+            // Hand everything this page loaded to the service worker so the
+            // page keeps rendering once the network is gone.
+            var resources = performance.getEntriesByType('resource').map(function(entry) {
+                return entry.name;
+            });
+            registration.active.postMessage({
+                type: 'precache',
+                page: window.location.href,
+                resources: resources,
+            });
+        }, function(err) {
+            console.log("Service worker registration failed: ", err);
+        });
+    });
+}
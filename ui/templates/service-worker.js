@@ -0,0 +1,160 @@
+// The worker is always served by knox itself, so its own origin is knox's
+// whichever scheme and address it was reached through.
+var knoxOrigin = self.location.origin;
+var knoxCacheName = "knox-v1";
+// The paths of knox's own routes, which requests from cached pages are left
+// pointing at. Keep in sync with the handlers registered in server/knox.go.
+var knoxPaths = /^\/(c|admin|bundle|api|metrics|manifest|static|read|pdf|s|progress|capture|auth|service-worker\.js)(\/|$)/;
+
+function encodeUrl(url) {
+    return btoa(url).replace(/\+/g, '-').replace(/\//g, '_');
+}
+
+function decodeUrl(encodedUrl) {
+    try {
+        return atob(encodedUrl.replace(/-/g, '+').replace(/_/g, '/'));
+    } catch (err) {
+        return null;
+    }
+}
+
+// Returns the original URL of the page knox serves at knoxUrl, or null if
+// knoxUrl is not a cached page.
+function cachedPageUrl(knoxUrl) {
+    if (!knoxUrl) {
+        return null;
+    }
+    var url = new URL(knoxUrl);
+    if (url.origin != knoxOrigin || url.pathname.indexOf('/c/') != 0) {
+        return null;
+    }
+    var decoded = decodeUrl(url.pathname.substring(3));
+    return decoded && /^https?:\/\//i.test(decoded) ? decoded : null;
+}
+
+// Maps a request made from the cached page pageUrl onto the knox URL serving
+// it. Returns null for requests that should go to the network untouched.
+function toKnoxUrl(requestUrl, pageUrl) {
+    var url = new URL(requestUrl);
+    if (url.origin != knoxOrigin) {
+        if (url.protocol != 'http:' && url.protocol != 'https:') {
+            return null;
+        }
+        return knoxOrigin + "/c/" + encodeUrl(requestUrl);
+    }
+    if (cachedPageUrl(requestUrl) != null) {
+        return requestUrl;
+    }
+    if (pageUrl == null) {
+        return null;
+    }
+    // Relative URLs were resolved against knox rather than the origin.
+    var relative = url.pathname + url.search;
+    if (url.pathname.indexOf('/c/') == 0) {
+        // Document-relative, resolved against /c/<hash>.
+        relative = url.pathname.substring(3) + url.search;
+    } else if (knoxPaths.test(url.pathname)) {
+        return null;
+    }
+    return knoxOrigin + "/c/" + encodeUrl(new URL(relative, pageUrl).href);
+}
+
+function requestingPageUrl(event) {
+    var fromReferrer = cachedPageUrl(event.request.referrer);
+    if (!event.clientId) {
+        return Promise.resolve(fromReferrer);
+    }
+    return self.clients.get(event.clientId).then(function(client) {
+        return (client && cachedPageUrl(client.url)) || fromReferrer;
+    });
+}
+
+// Fetches knoxUrl and stores the response in cache. Redirects, e.g. to the
+// live URL of a resource knox can't cache, are passed through but never
+// stored under knoxUrl.
+function fetchAndCache(cache, knoxUrl, init) {
+    return fetch(knoxUrl, init).then(function(response) {
+        if (response.ok && !response.redirected) {
+            cache.put(knoxUrl, response.clone());
+        }
+        return response;
+    });
+}
+
+// Checks whether knox has refreshed the copy of knoxUrl in cache, replacing
+// it if so.
+function revalidate(cache, knoxUrl, cached) {
+    var headers = {};
+    var etag = cached.headers.get('ETag');
+    var lastModified = cached.headers.get('Last-Modified');
+    if (etag) {
+        headers['If-None-Match'] = etag;
+    } else if (lastModified) {
+        headers['If-Modified-Since'] = lastModified;
+    }
+    return fetchAndCache(cache, knoxUrl, {headers: headers}).catch(function(err) {
+        // Offline. The cached copy is all there is.
+    });
+}
+
+// Serves anything already in Cache Storage without waiting on the network,
+// then revalidates it in the background so that refreshed pages are picked
+// up on the next visit.
+function staleWhileRevalidate(event, knoxUrl) {
+    return caches.open(knoxCacheName).then(function(cache) {
+        return cache.match(knoxUrl).then(function(cached) {
+            if (cached) {
+                event.waitUntil(revalidate(cache, knoxUrl, cached));
+                return cached;
+            }
+            return fetchAndCache(cache, knoxUrl);
+        });
+    });
+}
+
+self.addEventListener('install', function(event) {
+    self.skipWaiting();
+});
+
+self.addEventListener('activate', function(event) {
+    event.waitUntil(self.clients.claim());
+});
+
+self.addEventListener('fetch', function(event) {
+    if (event.request.method != 'GET') {
+        return;
+    }
+    event.respondWith(requestingPageUrl(event).then(function(pageUrl) {
+        var knoxUrl = toKnoxUrl(event.request.url, pageUrl);
+        if (knoxUrl == null) {
+            return fetch(event.request);
+        }
+        return staleWhileRevalidate(event, knoxUrl);
+    }));
+});
+
+self.addEventListener('message', function(event) {
+    if (!event.data || event.data.type != 'precache') {
+        return;
+    }
+    var pageUrl = cachedPageUrl(event.data.page);
+    var knoxUrls = [event.data.page];
+    event.data.resources.forEach(function(resource) {
+        var knoxUrl = toKnoxUrl(resource, pageUrl);
+        if (knoxUrl != null) {
+            knoxUrls.push(knoxUrl);
+        }
+    });
+    event.waitUntil(caches.open(knoxCacheName).then(function(cache) {
+        return Promise.all(knoxUrls.map(function(knoxUrl) {
+            return cache.match(knoxUrl).then(function(cached) {
+                if (cached) {
+                    return;
+                }
+                return fetchAndCache(cache, knoxUrl).catch(function(err) {
+                    console.log("Failed to precache ", knoxUrl, err);
+                });
+            });
+        }));
+    }));
+});
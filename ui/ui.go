@@ -0,0 +1,8 @@
+// Package ui holds knox's built-in UI. templates/ holds the pages and the
+// service worker and static/ is served as-is under /static/.
+package ui
+
+import "embed"
+
+//go:embed templates static
+var Files embed.FS